@@ -28,7 +28,6 @@ import (
 	"github.com/prometheus/prometheus/tsdb"
 
 	"github.com/thanos-io/objstore"
-	"github.com/thanos-io/objstore/client"
 	objstoretracing "github.com/thanos-io/objstore/tracing/opentracing"
 
 	blocksAPI "github.com/thanos-io/thanos/pkg/api/blocks"
@@ -39,6 +38,7 @@ import (
 	"github.com/thanos-io/thanos/pkg/component"
 	"github.com/thanos-io/thanos/pkg/dedup"
 	"github.com/thanos-io/thanos/pkg/extkingpin"
+	"github.com/thanos-io/thanos/pkg/extobjstore"
 	"github.com/thanos-io/thanos/pkg/extprom"
 	extpromhttp "github.com/thanos-io/thanos/pkg/extprom/http"
 	"github.com/thanos-io/thanos/pkg/logging"
@@ -83,6 +83,20 @@ func (cs compactionSet) levels(maxLevel int) ([]int64, error) {
 	return levels, nil
 }
 
+// maxLevelWithin returns the highest compaction level whose range does not exceed the given duration.
+func (cs compactionSet) maxLevelWithin(d time.Duration) (int, error) {
+	if d < cs[1] {
+		return 0, errors.Errorf("duration %s is lower than the range %s of the first compaction level", d, cs[1])
+	}
+	maxLevel := 1
+	for i, c := range cs {
+		if c <= d {
+			maxLevel = i
+		}
+	}
+	return maxLevel, nil
+}
+
 // maxLevel returns max available compaction level.
 func (cs compactionSet) maxLevel() int {
 	return len(cs) - 1
@@ -94,7 +108,7 @@ func registerCompact(app *extkingpin.App) {
 	conf.registerFlag(cmd)
 
 	cmd.Setup(func(g *run.Group, logger log.Logger, reg *prometheus.Registry, tracer opentracing.Tracer, _ <-chan struct{}, _ bool) error {
-		return runCompact(g, logger, tracer, reg, component.Compact, *conf, getFlagsMap(cmd.Flags()))
+		return runCompact(g, logger, tracer, reg, component.Compact, *conf, extkingpin.FlagsMap(cmd.Flags()))
 	})
 }
 
@@ -173,6 +187,14 @@ func runCompact(
 	conf compactConfig,
 	flagsMap map[string]string,
 ) (rerr error) {
+	if conf.downsampleOnly && conf.disableDownsampling {
+		return errors.New("--downsampling.only and --downsampling.disable are mutually exclusive")
+	}
+	downsampleOpts, err := downsampleRoundingOptions(conf.downsampleValueRounding)
+	if err != nil {
+		return err
+	}
+
 	deleteDelay := time.Duration(conf.deleteDelay)
 	compactMetrics := newCompactMetrics(reg, deleteDelay)
 	downsampleMetrics := newDownsampleMetrics(reg)
@@ -205,7 +227,7 @@ func runCompact(
 		return err
 	}
 
-	bkt, err := client.NewBucket(logger, confContentYaml, component.String())
+	bkt, err := extobjstore.NewBucket(logger, reg, confContentYaml, component.String())
 	if err != nil {
 		return err
 	}
@@ -221,6 +243,16 @@ func runCompact(
 		return err
 	}
 
+	blockEvents, err := newBlockEvents(logger, reg, conf.blockEvents, component)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if rerr != nil {
+			runutil.CloseWithLogOnErr(logger, blockEvents, "block events")
+		}
+	}()
+
 	// Ensure we close up everything properly.
 	defer func() {
 		if err != nil {
@@ -303,13 +335,32 @@ func runCompact(
 		}
 	}
 
-	levels, err := compactions.levels(conf.maxCompactionLevel)
+	if conf.maxCompactionLevel < compactions.maxLevel() {
+		level.Warn(logger).Log("msg", "Max compaction level is lower than should be", "current", conf.maxCompactionLevel, "default", compactions.maxLevel())
+	}
+
+	maxLevel := conf.maxCompactionLevel
+	if conf.maxBlockDuration != 0 {
+		l, err := compactions.maxLevelWithin(time.Duration(conf.maxBlockDuration))
+		if err != nil {
+			return errors.Wrap(err, "invalid --compact.max-block-duration")
+		}
+		maxLevel = min(maxLevel, l)
+	}
+	levels, err := compactions.levels(maxLevel)
 	if err != nil {
 		return errors.Wrap(err, "get compaction levels")
 	}
 
-	if conf.maxCompactionLevel < compactions.maxLevel() {
-		level.Warn(logger).Log("msg", "Max compaction level is lower than should be", "current", conf.maxCompactionLevel, "default", compactions.maxLevel())
+	// Downsampling only happens for blocks spanning long enough time ranges, so capping the compaction
+	// level may prevent blocks from ever being downsampled.
+	if maxRange := levels[len(levels)-1]; conf.maxBlockDuration != 0 && !conf.disableDownsampling {
+		if maxRange < downsample.ResLevel1DownsampleRange {
+			return errors.Errorf("max compaction range %s is lower than the minimum block size after which 5m resolution downsampling will occur (40 hours), disable downsampling with --downsampling.disable or increase --compact.max-block-duration", time.Duration(maxRange)*time.Millisecond)
+		}
+		if maxRange < downsample.ResLevel2DownsampleRange {
+			level.Warn(logger).Log("msg", "max compaction range is lower than the minimum block size after which 1h resolution downsampling will occur (10 days), blocks will not be downsampled to 1h resolution", "range", time.Duration(maxRange)*time.Millisecond)
+		}
 	}
 
 	ctx, cancel := context.WithCancel(context.Background())
@@ -369,9 +420,30 @@ func runCompact(
 		conf.blockFilesConcurrency,
 		conf.compactBlocksFetchConcurrency,
 	)
+	if conf.safeMode {
+		grouper.EnableSafeMode(reg)
+	}
+	if conf.recheckMarkers {
+		grouper.EnableMarkerRecheck(reg)
+	}
+	var auditLog *compact.AuditLog
+	if conf.auditLog != "none" {
+		hostname, err := os.Hostname()
+		if err != nil {
+			return errors.Wrap(err, "get hostname for audit log")
+		}
+		var auditBkt objstore.Bucket
+		if conf.auditLog == "bucket" {
+			auditBkt = insBkt
+		}
+		auditLog = compact.NewAuditLog(logger, auditBkt, hostname)
+		grouper.EnableAuditLog(auditLog)
+	}
+	grouper.EnableBlockEvents(blockEvents)
 	var planner compact.Planner
 
 	tsdbPlanner := compact.NewPlanner(logger, levels, noCompactMarkerFilter)
+	tsdbPlanner.EnableDefragmentation(int64(conf.defragmentationMinBlockSize))
 	largeIndexFilterPlanner := compact.WithLargeTotalIndexSizeFilter(
 		tsdbPlanner,
 		insBkt,
@@ -384,6 +456,8 @@ func runCompact(
 		planner = largeIndexFilterPlanner
 	}
 	blocksCleaner := compact.NewBlocksCleaner(logger, insBkt, ignoreDeletionMarkFilter, deleteDelay, compactMetrics.blocksCleaned, compactMetrics.blockCleanupFailures)
+	blocksCleaner.SetAuditLog(auditLog)
+	blocksCleaner.SetBlockEvents(blockEvents)
 	compactor, err := compact.NewBucketCompactor(
 		logger,
 		sy,
@@ -433,7 +507,7 @@ func runCompact(
 			return errors.Wrap(err, "syncing metas")
 		}
 
-		compact.BestEffortCleanAbortedPartialUploads(ctx, logger, sy.Partial(), insBkt, compactMetrics.partialUploadDeleteAttempts, compactMetrics.blocksCleaned, compactMetrics.blockCleanupFailures)
+		compact.BestEffortCleanAbortedPartialUploads(ctx, logger, sy.Partial(), insBkt, compactMetrics.partialUploadDeleteAttempts, compactMetrics.blocksCleaned, compactMetrics.blockCleanupFailures, auditLog)
 		if err := blocksCleaner.DeleteMarkedBlocks(ctx); err != nil {
 			return errors.Wrap(err, "cleaning marked blocks")
 		}
@@ -443,7 +517,9 @@ func runCompact(
 	}
 
 	compactMainFn := func() error {
-		if err := compactor.Compact(ctx); err != nil {
+		if conf.downsampleOnly {
+			level.Info(logger).Log("msg", "downsample-only mode, skipping compaction")
+		} else if err := compactor.Compact(ctx); err != nil {
 			return errors.Wrap(err, "compaction")
 		}
 
@@ -479,36 +555,47 @@ func runCompact(
 				conf.blockFilesConcurrency,
 				metadata.HashFunc(conf.hashFunc),
 				conf.acceptMalformedIndex,
+				conf.downsampleSinglePass,
+				conf.recheckMarkers,
+				blockEvents,
+				downsampleOpts...,
 			); err != nil {
 				return errors.Wrap(err, "first pass of downsampling failed")
 			}
 
-			level.Info(logger).Log("msg", "start second pass of downsampling")
-			if err := sy.SyncMetas(ctx); err != nil {
-				return errors.Wrap(err, "sync before second pass of downsampling")
-			}
+			// In a single pass, the first pass downsampled the new 5m blocks to 1h already when they were long enough.
+			if !conf.downsampleSinglePass {
+				level.Info(logger).Log("msg", "start second pass of downsampling")
+				if err := sy.SyncMetas(ctx); err != nil {
+					return errors.Wrap(err, "sync before second pass of downsampling")
+				}
 
-			// Regenerate the filtered list of blocks after the sync,
-			// to include the blocks created by the first pass.
-			filteredMetas = sy.Metas()
-			noDownsampleBlocks = noDownsampleMarkerFilter.NoDownsampleMarkedBlocks()
-			for ul := range noDownsampleBlocks {
-				delete(filteredMetas, ul)
-			}
+				// Regenerate the filtered list of blocks after the sync,
+				// to include the blocks created by the first pass.
+				filteredMetas = sy.Metas()
+				noDownsampleBlocks = noDownsampleMarkerFilter.NoDownsampleMarkedBlocks()
+				for ul := range noDownsampleBlocks {
+					delete(filteredMetas, ul)
+				}
 
-			if err := downsampleBucket(
-				ctx,
-				logger,
-				downsampleMetrics,
-				insBkt,
-				filteredMetas,
-				downsamplingDir,
-				conf.downsampleConcurrency,
-				conf.blockFilesConcurrency,
-				metadata.HashFunc(conf.hashFunc),
-				conf.acceptMalformedIndex,
-			); err != nil {
-				return errors.Wrap(err, "second pass of downsampling failed")
+				if err := downsampleBucket(
+					ctx,
+					logger,
+					downsampleMetrics,
+					insBkt,
+					filteredMetas,
+					downsamplingDir,
+					conf.downsampleConcurrency,
+					conf.blockFilesConcurrency,
+					metadata.HashFunc(conf.hashFunc),
+					conf.acceptMalformedIndex,
+					false,
+					conf.recheckMarkers,
+					blockEvents,
+					downsampleOpts...,
+				); err != nil {
+					return errors.Wrap(err, "second pass of downsampling failed")
+				}
 			}
 
 			level.Info(logger).Log("msg", "downsampling iterations done")
@@ -516,12 +603,18 @@ func runCompact(
 			level.Info(logger).Log("msg", "downsampling was explicitly disabled")
 		}
 
+		// Retention and cleanup mark and delete blocks, which is left to the compactor
+		// compacting the same blocks when running in downsample-only mode.
+		if conf.downsampleOnly {
+			return nil
+		}
+
 		// TODO(bwplotka): Find a way to avoid syncing if no op was done.
 		if err := sy.SyncMetas(ctx); err != nil {
 			return errors.Wrap(err, "sync before retention")
 		}
 
-		if err := compact.ApplyRetentionPolicyByResolution(ctx, logger, insBkt, sy.Metas(), retentionByResolution, compactMetrics.blocksMarked.WithLabelValues(metadata.DeletionMarkFilename, "")); err != nil {
+		if err := compact.ApplyRetentionPolicyByResolution(ctx, logger, insBkt, sy.Metas(), retentionByResolution, compactMetrics.blocksMarked.WithLabelValues(metadata.DeletionMarkFilename, ""), auditLog); err != nil {
 			return errors.Wrap(err, "retention failed")
 		}
 
@@ -530,6 +623,7 @@ func runCompact(
 
 	g.Add(func() error {
 		defer runutil.CloseWithLogOnErr(logger, insBkt, "bucket client")
+		defer runutil.CloseWithLogOnErr(logger, blockEvents, "block events")
 
 		if !conf.wait {
 			return compactMainFn()
@@ -617,7 +711,7 @@ func runCompact(
 
 		// Periodically remove partial blocks and blocks marked for deletion
 		// since one iteration potentially could take a long time.
-		if conf.cleanupBlocksInterval > 0 {
+		if conf.cleanupBlocksInterval > 0 && !conf.downsampleOnly {
 			g.Add(func() error {
 				return runutil.Repeat(conf.cleanupBlocksInterval, ctx.Done(), func() error {
 					err := cleanPartialMarked()
@@ -668,17 +762,19 @@ func runCompact(
 						return errors.Wrapf(err, "could not group metadata for compaction")
 					}
 
-					if err = ps.ProgressCalculate(ctx, groups); err != nil {
-						return errors.Wrapf(err, "could not calculate compaction progress")
-					}
+					if !conf.downsampleOnly {
+						if err = ps.ProgressCalculate(ctx, groups); err != nil {
+							return errors.Wrapf(err, "could not calculate compaction progress")
+						}
 
-					retGroups, err := grouper.Groups(metas)
-					if err != nil {
-						return errors.Wrapf(err, "could not group metadata for retention")
-					}
+						retGroups, err := grouper.Groups(metas)
+						if err != nil {
+							return errors.Wrapf(err, "could not group metadata for retention")
+						}
 
-					if err = rs.ProgressCalculate(ctx, retGroups); err != nil {
-						return errors.Wrapf(err, "could not calculate retention progress")
+						if err = rs.ProgressCalculate(ctx, retGroups); err != nil {
+							return errors.Wrapf(err, "could not calculate retention progress")
+						}
 					}
 
 					if !conf.disableDownsampling {
@@ -708,6 +804,7 @@ type compactConfig struct {
 	haltOnError                                    bool
 	acceptMalformedIndex                           bool
 	maxCompactionLevel                             int
+	maxBlockDuration                               model.Duration
 	http                                           httpConfig
 	dataDir                                        string
 	objStore                                       extflag.PathOrContent
@@ -716,6 +813,7 @@ type compactConfig struct {
 	wait                                           bool
 	waitInterval                                   time.Duration
 	disableDownsampling                            bool
+	downsampleOnly                                 bool
 	blockListStrategy                              string
 	blockMetaFetchConcurrency                      int
 	blockFilesConcurrency                          int
@@ -724,18 +822,25 @@ type compactConfig struct {
 	cleanupBlocksInterval                          time.Duration
 	compactionConcurrency                          int
 	downsampleConcurrency                          int
+	downsampleValueRounding                        []string
+	downsampleSinglePass                           bool
 	compactBlocksFetchConcurrency                  int
 	deleteDelay                                    model.Duration
 	dedupReplicaLabels                             []string
 	selectorRelabelConf                            extflag.PathOrContent
+	blockEvents                                    *extflag.PathOrContent
 	disableWeb                                     bool
 	webConf                                        webConfig
 	label                                          string
 	maxBlockIndexSize                              units.Base2Bytes
+	defragmentationMinBlockSize                    units.Base2Bytes
 	hashFunc                                       string
 	enableVerticalCompaction                       bool
 	dedupFunc                                      string
 	skipBlockWithOutOfOrderChunks                  bool
+	safeMode                                       bool
+	recheckMarkers                                 bool
+	auditLog                                       string
 	progressCalculateInterval                      time.Duration
 	filterConf                                     *store.FilterConfig
 	disableAdminOperations                         bool
@@ -749,6 +854,10 @@ func (cc *compactConfig) registerFlag(cmd extkingpin.FlagClause) {
 		Hidden().Default("false").BoolVar(&cc.acceptMalformedIndex)
 	cmd.Flag("debug.max-compaction-level", fmt.Sprintf("Maximum compaction level, default is %d: %s", compactions.maxLevel(), compactions.String())).
 		Hidden().Default(strconv.Itoa(compactions.maxLevel())).IntVar(&cc.maxCompactionLevel)
+	cmd.Flag("compact.max-block-duration", fmt.Sprintf("Maximum time range of blocks produced by compaction. Blocks stop being compacted once they reach the largest compaction range not exceeding this duration, out of: %s. "+
+		"Smaller blocks are faster to query and to compact again, at the cost of more blocks and storage. "+
+		"Must be at least 2d unless downsampling is disabled, as blocks are only downsampled to 5m resolution once they span 40h, and at least 14d for blocks to be downsampled to 1h resolution. 0 disables the limit.", compactions.String())).
+		Default("0s").SetValue(&cc.maxBlockDuration)
 
 	cc.http.registerFlag(cmd)
 
@@ -777,6 +886,10 @@ func (cc *compactConfig) registerFlag(cmd extkingpin.FlagClause) {
 	cmd.Flag("downsampling.disable", "Disables downsampling. This is not recommended "+
 		"as querying long time ranges without non-downsampled data is not efficient and useful e.g it is not possible to render all samples for a human eye anyway").
 		Default("false").BoolVar(&cc.disableDownsampling)
+	cmd.Flag("downsampling.only", "Only downsample blocks, without compacting them, applying retention or cleaning up blocks. "+
+		"Source blocks are never marked for deletion in this mode, so it can run next to a compactor started with --downsampling.disable against the same blocks. "+
+		"Cannot be used together with --downsampling.disable.").
+		Default("false").BoolVar(&cc.downsampleOnly)
 
 	strategies := strings.Join([]string{string(concurrentDiscovery), string(recursiveDiscovery)}, ", ")
 	cmd.Flag("block-discovery-strategy", "One of "+strategies+". When set to concurrent, stores will concurrently issue one call per directory to discover active blocks in the bucket. The recursive strategy iterates through all objects in the bucket, recursively traversing into each directory. This avoids N+1 calls at the expense of having slower bucket iterations.").
@@ -800,6 +913,10 @@ func (cc *compactConfig) registerFlag(cmd extkingpin.FlagClause) {
 		Default("1").IntVar(&cc.compactBlocksFetchConcurrency)
 	cmd.Flag("downsample.concurrency", "Number of goroutines to use when downsampling blocks.").
 		Default("1").IntVar(&cc.downsampleConcurrency)
+	cmd.Flag("downsample.single-pass", "Downsample raw blocks spanning enough time for both resolutions to 5m and then 1h in a single pass, "+
+		"reusing the local 5m block instead of uploading it and downloading it again in a second pass. The resulting blocks are the same.").
+		Default("false").BoolVar(&cc.downsampleSinglePass)
+	registerDownsampleRoundingFlag(cmd, &cc.downsampleValueRounding)
 
 	cmd.Flag("delete-delay", "Time before a block marked for deletion is deleted from bucket. "+
 		"If delete-delay is non zero, blocks will be marked for deletion and compactor component will delete blocks marked for deletion from the bucket. "+
@@ -831,9 +948,21 @@ func (cc *compactConfig) registerFlag(cmd extkingpin.FlagClause) {
 		"Default is due to https://github.com/thanos-io/thanos/issues/1424, but it's overall recommended to keeps block size to some reasonable size.").
 		Hidden().Default("64GB").BytesVar(&cc.maxBlockIndexSize)
 
+	cmd.Flag("compact.defragmentation-min-block-size", "Minimum size of blocks targeted by the defragmentation pass of the planner. Before level compaction, adjacent blocks smaller than this size, "+
+		"e.g. produced by receivers cutting their heads often, are merged together within the time range of the second compaction level and without reaching the range from which blocks are downsampled. 0 disables the defragmentation pass.").
+		Default("0B").BytesVar(&cc.defragmentationMinBlockSize)
+
 	cmd.Flag("compact.skip-block-with-out-of-order-chunks", "When set to true, mark blocks containing index with out-of-order chunks for no compact instead of halting the compaction").
 		Hidden().Default("false").BoolVar(&cc.skipBlockWithOutOfOrderChunks)
 
+	cmd.Flag("compact.safe-mode", "When set to true, every compacted block is downloaded again after upload and verified (index health, series and samples matching its meta.json and, without overlaps, the source blocks) before the source blocks are marked for deletion. If verification fails, the compacted block is deleted, the source blocks are kept and compaction halts.").
+		Default("false").BoolVar(&cc.safeMode)
+	cmd.Flag("compact.recheck-markers", "When set to true, the no-compact and no-downsample markers of blocks are checked again right before compacting or downsampling them, with one existence check per block, and the operation is aborted if a marker was written since the blocks were synced.").
+		Default("false").BoolVar(&cc.recheckMarkers)
+
+	cmd.Flag("compact.audit-log", "Write an audit record of each compaction, retention and deletion of blocks, with the source and result blocks, the reason and the compactor host. One of none, log (write records to the log) or bucket (also upload each record to the audit/ directory of the bucket).").
+		Default("none").EnumVar(&cc.auditLog, "none", "log", "bucket")
+
 	cmd.Flag("hash-func", "Specify which hash function to use when calculating the hashes of produced files. If no function has been specified, it does not happen. This permits avoiding downloading some files twice albeit at some performance cost. Possible values are: \"\", \"SHA256\".").
 		Default("").EnumVar(&cc.hashFunc, "SHA256", "")
 
@@ -846,6 +975,7 @@ func (cc *compactConfig) registerFlag(cmd extkingpin.FlagClause) {
 	cmd.Flag("web.disable", "Disable Block Viewer UI.").Default("false").BoolVar(&cc.disableWeb)
 
 	cc.selectorRelabelConf = *extkingpin.RegisterSelectorRelabelFlags(cmd)
+	cc.blockEvents = registerBlockEventsFlag(cmd)
 
 	cc.webConf.registerFlag(cmd)
 
@@ -0,0 +1,32 @@
+// Copyright (c) The Thanos Authors.
+// Licensed under the Apache License 2.0.
+
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/efficientgo/core/testutil"
+)
+
+func TestCompactionSet_MaxLevelWithin(t *testing.T) {
+	for _, tc := range []struct {
+		duration time.Duration
+		expected int
+	}{
+		{duration: 2 * time.Hour, expected: 1},
+		{duration: 40 * time.Hour, expected: 2},
+		{duration: 2 * 24 * time.Hour, expected: 3},
+		{duration: 7 * 24 * time.Hour, expected: 3},
+		{duration: 14 * 24 * time.Hour, expected: 4},
+		{duration: 365 * 24 * time.Hour, expected: 4},
+	} {
+		l, err := compactions.maxLevelWithin(tc.duration)
+		testutil.Ok(t, err)
+		testutil.Equals(t, tc.expected, l, "duration %s", tc.duration)
+	}
+
+	_, err := compactions.maxLevelWithin(time.Hour)
+	testutil.NotOk(t, err)
+}
@@ -14,11 +14,15 @@ import (
 
 	"github.com/KimMachineGun/automemlimit/memlimit"
 	extflag "github.com/efficientgo/tools/extkingpin"
+	"github.com/go-kit/log"
 	"github.com/pkg/errors"
 
+	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/common/model"
 	"github.com/prometheus/prometheus/model/labels"
 
+	"github.com/thanos-io/thanos/pkg/block/lifecycle"
+	"github.com/thanos-io/thanos/pkg/component"
 	"github.com/thanos-io/thanos/pkg/extkingpin"
 	"github.com/thanos-io/thanos/pkg/shipper"
 )
@@ -121,6 +125,8 @@ type reloaderConfig struct {
 	retryInterval   time.Duration
 	method          string
 	processName     string
+	driftCheck      bool
+	driftTimeout    time.Duration
 }
 
 const (
@@ -153,6 +159,12 @@ func (rc *reloaderConfig) registerFlag(cmd extkingpin.FlagClause) *reloaderConfi
 	cmd.Flag("reloader.process-name",
 		"Executable name used to match the process being reloaded when using the signal method.").
 		Default("prometheus").StringVar(&rc.processName)
+	cmd.Flag("reloader.config-drift-check",
+		"If true, the reloader compares the configuration reported by Prometheus with the intended configuration after each reload and reports any drift.").
+		Default("false").BoolVar(&rc.driftCheck)
+	cmd.Flag("reloader.config-drift-timeout",
+		"Controls how long the reloader waits for Prometheus to report the intended configuration before considering that it drifted.").
+		Default("30s").DurationVar(&rc.driftTimeout)
 
 	return rc
 }
@@ -163,6 +175,7 @@ type shipperConfig struct {
 	allowOutOfOrderUpload bool
 	hashFunc              string
 	metaFileName          string
+	blockEvents           *extflag.PathOrContent
 }
 
 func (sc *shipperConfig) registerFlag(cmd extkingpin.FlagClause) *shipperConfig {
@@ -180,9 +193,26 @@ func (sc *shipperConfig) registerFlag(cmd extkingpin.FlagClause) *shipperConfig
 	cmd.Flag("hash-func", "Specify which hash function to use when calculating the hashes of produced files. If no function has been specified, it does not happen. This permits avoiding downloading some files twice albeit at some performance cost. Possible values are: \"\", \"SHA256\".").
 		Default("").EnumVar(&sc.hashFunc, "SHA256", "")
 	cmd.Flag("shipper.meta-file-name", "the file to store shipper metadata in").Default(shipper.DefaultMetaFilename).StringVar(&sc.metaFileName)
+	sc.blockEvents = registerBlockEventsFlag(cmd)
 	return sc
 }
 
+func registerBlockEventsFlag(cmd extkingpin.FlagClause) *extflag.PathOrContent {
+	return extflag.RegisterPathOrContent(cmd, "block-events.config",
+		"YAML file that contains the configuration of a webhook notified of the blocks uploaded, compacted and deleted, e.g. to keep an external data catalog up to date. See format details: https://thanos.io/tip/thanos/storage.md/#block-events",
+		extflag.WithEnvSubstitution())
+}
+
+// newBlockEvents returns the notifier of block events configured by the given flag. It must be closed to send the
+// queued events.
+func newBlockEvents(logger log.Logger, reg prometheus.Registerer, conf *extflag.PathOrContent, comp component.Component) (lifecycle.Notifier, error) {
+	confYaml, err := conf.Content()
+	if err != nil {
+		return nil, errors.Wrap(err, "get content of block events configuration")
+	}
+	return lifecycle.NewNotifier(logger, reg, confYaml, comp.String())
+}
+
 type webConfig struct {
 	routePrefix      string
 	externalPrefix   string
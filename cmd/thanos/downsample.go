@@ -21,10 +21,10 @@ import (
 	"github.com/prometheus/client_golang/prometheus/promauto"
 	"github.com/prometheus/prometheus/tsdb"
 	"github.com/prometheus/prometheus/tsdb/chunkenc"
+	"github.com/thanos-io/thanos/pkg/block/lifecycle"
 	"github.com/thanos-io/thanos/pkg/compact"
 
 	"github.com/thanos-io/objstore"
-	"github.com/thanos-io/objstore/client"
 	objstoretracing "github.com/thanos-io/objstore/tracing/opentracing"
 
 	"github.com/thanos-io/thanos/pkg/block"
@@ -32,6 +32,8 @@ import (
 	"github.com/thanos-io/thanos/pkg/compact/downsample"
 	"github.com/thanos-io/thanos/pkg/component"
 	"github.com/thanos-io/thanos/pkg/errutil"
+	"github.com/thanos-io/thanos/pkg/extkingpin"
+	"github.com/thanos-io/thanos/pkg/extobjstore"
 	"github.com/thanos-io/thanos/pkg/extprom"
 	"github.com/thanos-io/thanos/pkg/prober"
 	"github.com/thanos-io/thanos/pkg/runutil"
@@ -42,6 +44,8 @@ type DownsampleMetrics struct {
 	downsamples        *prometheus.CounterVec
 	downsampleFailures *prometheus.CounterVec
 	downsampleDuration *prometheus.HistogramVec
+	// abortedMarked counts downsamplings aborted because the block was marked for no downsampling after planning.
+	abortedMarked prometheus.Counter
 }
 
 func newDownsampleMetrics(reg *prometheus.Registry) *DownsampleMetrics {
@@ -60,10 +64,38 @@ func newDownsampleMetrics(reg *prometheus.Registry) *DownsampleMetrics {
 		Help:    "Duration of downsample runs",
 		Buckets: []float64{60, 300, 900, 1800, 3600, 7200, 14400}, // 1m, 5m, 15m, 30m, 60m, 120m, 240m
 	}, []string{"resolution"})
+	m.abortedMarked = promauto.With(reg).NewCounter(prometheus.CounterOpts{
+		Name: "thanos_compact_downsample_aborted_marked_total",
+		Help: "Total number of downsamplings aborted because the block was marked for no downsampling after planning.",
+	})
 
 	return m
 }
 
+// registerDownsampleRoundingFlag registers the flag configuring the rounding of downsampled values into rules.
+func registerDownsampleRoundingFlag(cmd extkingpin.FlagClause, rules *[]string) {
+	cmd.Flag("downsample.value-rounding", "Round the sum, min and max aggregates of the downsampled series matching the given selector "+
+		"to the given number of significant figures, e.g. 3:{job=\"node\"}, to make their chunks compress better at the cost of precision. "+
+		"The first matching rule applies (repeated flag). Series named like counters, i.e. ending with _total, _count, _sum or _bucket, are never rounded.").
+		PlaceHolder("<figures>:<selector>").StringsVar(rules)
+}
+
+// downsampleRoundingOptions returns the downsampling options rounding values according to the given rules.
+func downsampleRoundingOptions(rules []string) ([]downsample.Option, error) {
+	if len(rules) == 0 {
+		return nil, nil
+	}
+	rounding := make([]downsample.Rounding, 0, len(rules))
+	for _, r := range rules {
+		parsed, err := downsample.ParseRounding(r)
+		if err != nil {
+			return nil, errors.Wrap(err, "parse --downsample.value-rounding")
+		}
+		rounding = append(rounding, parsed)
+	}
+	return []downsample.Option{downsample.WithRounding(rounding...)}, nil
+}
+
 func RunDownsample(
 	g *run.Group,
 	logger log.Logger,
@@ -78,13 +110,15 @@ func RunDownsample(
 	objStoreConfig *extflag.PathOrContent,
 	comp component.Component,
 	hashFunc metadata.HashFunc,
+	blockEvents lifecycle.Notifier,
+	downsampleOpts ...downsample.Option,
 ) error {
 	confContentYaml, err := objStoreConfig.Content()
 	if err != nil {
 		return err
 	}
 
-	bkt, err := client.NewBucket(logger, confContentYaml, component.Downsample.String())
+	bkt, err := extobjstore.NewBucket(logger, reg, confContentYaml, component.Downsample.String())
 	if err != nil {
 		return err
 	}
@@ -134,7 +168,7 @@ func RunDownsample(
 					metrics.downsamples.WithLabelValues(resolutionLabel)
 					metrics.downsampleFailures.WithLabelValues(resolutionLabel)
 				}
-				if err := downsampleBucket(ctx, logger, metrics, insBkt, metas, dataDir, downsampleConcurrency, blockFilesConcurrency, hashFunc, false); err != nil {
+				if err := downsampleBucket(ctx, logger, metrics, insBkt, metas, dataDir, downsampleConcurrency, blockFilesConcurrency, hashFunc, false, false, false, blockEvents, downsampleOpts...); err != nil {
 					return errors.Wrap(err, "downsampling failed")
 				}
 
@@ -143,7 +177,7 @@ func RunDownsample(
 				if err != nil {
 					return errors.Wrap(err, "sync before second pass of downsampling")
 				}
-				if err := downsampleBucket(ctx, logger, metrics, insBkt, metas, dataDir, downsampleConcurrency, blockFilesConcurrency, hashFunc, false); err != nil {
+				if err := downsampleBucket(ctx, logger, metrics, insBkt, metas, dataDir, downsampleConcurrency, blockFilesConcurrency, hashFunc, false, false, false, blockEvents, downsampleOpts...); err != nil {
 					return errors.Wrap(err, "downsampling failed")
 				}
 				return nil
@@ -185,6 +219,10 @@ func downsampleBucket(
 	blockFilesConcurrency int,
 	hashFunc metadata.HashFunc,
 	acceptMalformedIndex bool,
+	singlePass bool,
+	recheckMarkers bool,
+	blockEvents lifecycle.Notifier,
+	downsampleOpts ...downsample.Option,
 ) (rerr error) {
 	if err := os.MkdirAll(dir, 0750); err != nil {
 		return errors.Wrap(err, "create dir")
@@ -256,13 +294,31 @@ func downsampleBucket(
 		go func() {
 			defer wg.Done()
 			for m := range metaCh {
-				resolution := downsample.ResLevel1
+				if recheckMarkers {
+					// The markers were read when the metas were synced, the block may have been marked since.
+					marked, err := block.IsMarked(workerCtx, bkt, m.ULID, metadata.NoDownsampleMarkFilename)
+					if err != nil {
+						errCh <- compact.NewRetryError(err)
+						continue
+					}
+					if marked {
+						level.Info(logger).Log("msg", "block was marked for no downsampling; aborting downsampling", "block", m.ULID)
+						metrics.abortedMarked.Inc()
+						continue
+					}
+				}
+
+				resolutions := []int64{downsample.ResLevel1}
 				errMsg := "downsampling to 5 min"
 				if m.Thanos.Downsample.Resolution == downsample.ResLevel1 {
-					resolution = downsample.ResLevel2
+					resolutions = []int64{downsample.ResLevel2}
 					errMsg = "downsampling to 60 min"
+				} else if singlePass && m.MaxTime-m.MinTime >= downsample.ResLevel2DownsampleRange && missingSources(m, sources1h) {
+					// The 5m block would be downsampled to 1h by the next pass anyway.
+					resolutions = append(resolutions, downsample.ResLevel2)
+					errMsg = "downsampling to 5 and 60 min"
 				}
-				if err := processDownsampling(workerCtx, logger, bkt, m, dir, resolution, hashFunc, metrics, acceptMalformedIndex, blockFilesConcurrency); err != nil {
+				if err := processDownsampling(workerCtx, logger, bkt, m, dir, resolutions, hashFunc, metrics, acceptMalformedIndex, blockFilesConcurrency, blockEvents, downsampleOpts...); err != nil {
 					metrics.downsampleFailures.WithLabelValues(m.Thanos.ResolutionString()).Inc()
 					errCh <- errors.Wrap(err, errMsg)
 
@@ -282,14 +338,7 @@ metaSendLoop:
 			continue
 
 		case downsample.ResLevel0:
-			missing := false
-			for _, id := range m.Compaction.Sources {
-				if _, ok := sources5m[id]; !ok {
-					missing = true
-					break
-				}
-			}
-			if !missing {
+			if !missingSources(m, sources5m) {
 				continue
 			}
 			// Only downsample blocks once we are sure to get roughly 2 chunks out of it.
@@ -300,14 +349,7 @@ metaSendLoop:
 			}
 
 		case downsample.ResLevel1:
-			missing := false
-			for _, id := range m.Compaction.Sources {
-				if _, ok := sources1h[id]; !ok {
-					missing = true
-					break
-				}
-			}
-			if !missing {
+			if !missingSources(m, sources1h) {
 				continue
 			}
 			// Only downsample blocks once we are sure to get roughly 2 chunks out of it.
@@ -342,17 +384,32 @@ metaSendLoop:
 	return downsampleErrs.Err()
 }
 
+// missingSources returns true if some sources of the block are not in the given sources of downsampled blocks.
+func missingSources(m *metadata.Meta, sources map[ulid.ULID]struct{}) bool {
+	for _, id := range m.Compaction.Sources {
+		if _, ok := sources[id]; !ok {
+			return true
+		}
+	}
+	return false
+}
+
+// processDownsampling downloads the block and downsamples it to each of the given increasing resolutions in turn,
+// uploading every resulting block. Each resolution after the first one is downsampled from the block of the previous
+// resolution, exactly like a later pass would after downloading it.
 func processDownsampling(
 	ctx context.Context,
 	logger log.Logger,
 	bkt objstore.Bucket,
 	m *metadata.Meta,
 	dir string,
-	resolution int64,
+	resolutions []int64,
 	hashFunc metadata.HashFunc,
 	metrics *DownsampleMetrics,
 	acceptMalformedIndex bool,
 	blockFilesConcurrency int,
+	blockEvents lifecycle.Notifier,
+	downsampleOpts ...downsample.Option,
 ) error {
 	begin := time.Now()
 	bdir := filepath.Join(dir, m.ULID.String())
@@ -367,8 +424,62 @@ func processDownsampling(
 		return errors.Wrap(err, "input block index not valid")
 	}
 
-	begin = time.Now()
+	src, srcDir := m, bdir
+	for i, resolution := range resolutions {
+		begin = time.Now()
 
+		meta, err := downsampleLocalBlock(ctx, logger, src, srcDir, dir, resolution, acceptMalformedIndex, downsampleOpts...)
+		if err != nil {
+			return err
+		}
+		id := meta.ULID
+		resdir := filepath.Join(dir, id.String())
+
+		downsampleDuration := time.Since(begin)
+		level.Info(logger).Log("msg", "downsampled block",
+			"from", src.ULID, "to", id, "duration", downsampleDuration, "duration_ms", downsampleDuration.Milliseconds())
+		metrics.downsampleDuration.WithLabelValues(src.Thanos.ResolutionString()).Observe(downsampleDuration.Seconds())
+		if i > 0 {
+			// The downsampling of m is counted by the caller.
+			metrics.downsamples.WithLabelValues(src.Thanos.ResolutionString()).Inc()
+		}
+
+		begin = time.Now()
+
+		err = block.Upload(ctx, logger, bkt, resdir, hashFunc)
+		if err != nil {
+			return compact.NewRetryError(errors.Wrapf(err, "upload downsampled block %s", id))
+		}
+
+		level.Info(logger).Log("msg", "uploaded block", "id", id, "duration", time.Since(begin), "duration_ms", time.Since(begin).Milliseconds())
+		blockEvents.Notify(lifecycle.NewEvent(lifecycle.EventCreated, id, meta))
+
+		// It is not harmful if these fails.
+		if err := os.RemoveAll(srcDir); err != nil {
+			level.Warn(logger).Log("msg", "failed to clean directory", "dir", srcDir, "err", err)
+		}
+		src, srcDir = meta, resdir
+	}
+	if err := os.RemoveAll(srcDir); err != nil {
+		level.Warn(logger).Log("msg", "failed to clean directory", "resdir", srcDir, "err", err)
+	}
+
+	return nil
+}
+
+// downsampleLocalBlock downsamples the block with the given meta stored in bdir to the given resolution.
+// The result is written into a new block directory within dir, its index is verified and its meta.json is
+// updated with the index stats. It returns the meta of the resulting block.
+func downsampleLocalBlock(
+	ctx context.Context,
+	logger log.Logger,
+	m *metadata.Meta,
+	bdir string,
+	dir string,
+	resolution int64,
+	acceptMalformedIndex bool,
+	downsampleOpts ...downsample.Option,
+) (*metadata.Meta, error) {
 	var pool chunkenc.Pool
 	if m.Thanos.Downsample.Resolution == 0 {
 		pool = chunkenc.NewPool()
@@ -378,32 +489,27 @@ func processDownsampling(
 
 	b, err := tsdb.OpenBlock(logger, bdir, pool)
 	if err != nil {
-		return errors.Wrapf(err, "open block %s", m.ULID)
+		return nil, errors.Wrapf(err, "open block %s", m.ULID)
 	}
 	defer runutil.CloseWithLogOnErr(log.With(logger, "outcome", "potential left mmap file handlers left"), b, "tsdb reader")
 
-	id, err := downsample.Downsample(ctx, logger, m, b, dir, resolution)
+	id, err := downsample.Downsample(ctx, logger, m, b, dir, resolution, downsampleOpts...)
 	if err != nil {
-		return errors.Wrapf(err, "downsample block %s to window %d", m.ULID, resolution)
+		return nil, errors.Wrapf(err, "downsample block %s to window %d", m.ULID, resolution)
 	}
 	resdir := filepath.Join(dir, id.String())
 
-	downsampleDuration := time.Since(begin)
-	level.Info(logger).Log("msg", "downsampled block",
-		"from", m.ULID, "to", id, "duration", downsampleDuration, "duration_ms", downsampleDuration.Milliseconds())
-	metrics.downsampleDuration.WithLabelValues(m.Thanos.ResolutionString()).Observe(downsampleDuration.Seconds())
-
 	stats, err := block.GatherIndexHealthStats(ctx, logger, filepath.Join(resdir, block.IndexFilename), m.MinTime, m.MaxTime)
 	if err == nil {
 		err = stats.AnyErr()
 	}
 	if err != nil && !acceptMalformedIndex {
-		return errors.Wrap(err, "output block index not valid")
+		return nil, errors.Wrap(err, "output block index not valid")
 	}
 
 	meta, err := metadata.ReadFromDir(resdir)
 	if err != nil {
-		return errors.Wrap(err, "read meta")
+		return nil, errors.Wrap(err, "read meta")
 	}
 
 	if stats.ChunkMaxSize > 0 {
@@ -413,25 +519,7 @@ func processDownsampling(
 		meta.Thanos.IndexStats.SeriesMaxSize = stats.SeriesMaxSize
 	}
 	if err := meta.WriteToDir(logger, resdir); err != nil {
-		return errors.Wrap(err, "write meta")
-	}
-
-	begin = time.Now()
-
-	err = block.Upload(ctx, logger, bkt, resdir, hashFunc)
-	if err != nil {
-		return compact.NewRetryError(errors.Wrapf(err, "upload downsampled block %s", id))
+		return nil, errors.Wrap(err, "write meta")
 	}
-
-	level.Info(logger).Log("msg", "uploaded block", "id", id, "duration", time.Since(begin), "duration_ms", time.Since(begin).Milliseconds())
-
-	// It is not harmful if these fails.
-	if err := os.RemoveAll(bdir); err != nil {
-		level.Warn(logger).Log("msg", "failed to clean directory", "dir", bdir, "err", err)
-	}
-	if err := os.RemoveAll(resdir); err != nil {
-		level.Warn(logger).Log("msg", "failed to clean directory", "resdir", bdir, "err", err)
-	}
-
-	return nil
+	return meta, nil
 }
@@ -5,14 +5,17 @@ package main
 
 import (
 	"context"
+	"encoding/json"
 	"fmt"
 	"io"
 	"os"
 	"os/signal"
 	"path/filepath"
+	"reflect"
 	"regexp"
 	"runtime"
 	"runtime/debug"
+	"sync/atomic"
 	"syscall"
 
 	"github.com/go-kit/log"
@@ -23,12 +26,15 @@ import (
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/collectors"
 	versioncollector "github.com/prometheus/client_golang/prometheus/collectors/version"
+	"github.com/prometheus/client_golang/prometheus/promauto"
 	"github.com/prometheus/common/version"
 	"go.uber.org/automaxprocs/maxprocs"
 	"gopkg.in/alecthomas/kingpin.v2"
 
+	"github.com/thanos-io/thanos/pkg/extgrpc"
 	"github.com/thanos-io/thanos/pkg/extkingpin"
 	"github.com/thanos-io/thanos/pkg/logging"
+	"github.com/thanos-io/thanos/pkg/runtimeinfo"
 	"github.com/thanos-io/thanos/pkg/tracing/client"
 
 	// use the original golang/protobuf package we can continue serializing
@@ -51,6 +57,27 @@ const Name = "proto"
 // error while marshaling: failed to marshal, message is *v1.ExportTraceServiceRequest (missing vtprotobuf helpers).
 type vtprotoCodec struct {
 	fallback encoding.CodecV2
+
+	// fallbacks counts operations handled by the fallback codec by message type.
+	// It is nil unless enabled, in which case the fallback path does not do any extra work.
+	fallbacks atomic.Pointer[prometheus.CounterVec]
+}
+
+// codec is the registered proto codec.
+var codec = &vtprotoCodec{}
+
+// enableFallbackMetric makes the codec count operations handled by the fallback codec.
+func (c *vtprotoCodec) enableFallbackMetric(reg prometheus.Registerer) {
+	c.fallbacks.Store(promauto.With(reg).NewCounterVec(prometheus.CounterOpts{
+		Name: "thanos_grpc_codec_fallback_operations_total",
+		Help: "Total number of gRPC marshal and unmarshal operations of messages without vtprotobuf helpers, handled by the slower fallback codec.",
+	}, []string{"operation", "type"}))
+}
+
+func (c *vtprotoCodec) observeFallback(operation string, v any) {
+	if fallbacks := c.fallbacks.Load(); fallbacks != nil {
+		fallbacks.WithLabelValues(operation, reflect.TypeOf(v).String()).Inc()
+	}
 }
 
 type vtprotoMessage interface {
@@ -79,6 +106,7 @@ func (c *vtprotoCodec) Marshal(v any) (mem.BufferSlice, error) {
 		return mem.BufferSlice{mem.NewBuffer(buf, pool)}, nil
 	}
 
+	c.observeFallback("marshal", v)
 	return c.fallback.Marshal(v)
 }
 
@@ -89,16 +117,16 @@ func (c *vtprotoCodec) Unmarshal(data mem.BufferSlice, v any) error {
 		return m.UnmarshalVT(buf.ReadOnlyData())
 	}
 
+	c.observeFallback("unmarshal", v)
 	return c.fallback.Unmarshal(data, v)
 }
-func (vtprotoCodec) Name() string {
+func (*vtprotoCodec) Name() string {
 	return Name
 }
 
 func init() {
-	encoding.RegisterCodecV2(&vtprotoCodec{
-		fallback: encoding.GetCodecV2("proto"),
-	})
+	codec.fallback = encoding.GetCodecV2("proto")
+	encoding.RegisterCodecV2(codec)
 }
 
 func main() {
@@ -117,7 +145,13 @@ func main() {
 		Default("info").Enum("error", "warn", "info", "debug")
 	logFormat := app.Flag("log.format", "Log format to use. Possible options: logfmt or json.").
 		Default(logging.LogFormatLogfmt).Enum(logging.LogFormatLogfmt, logging.LogFormatJSON)
+	logStartupInfo := app.Flag("log.startup-info", "Log a single structured line with the component, build information and effective Go runtime settings (GOMAXPROCS, GOGC, GOMEMLIMIT) on startup. The same information is served as JSON on /debug/info.").
+		Default("false").Bool()
 	tracingConfig := extkingpin.RegisterCommonTracingFlags(app)
+	dumpConfig := app.Flag("dump-config", "Print the effective configuration of the command as JSON and exit, for validation in CI. It holds the values of all flags, including defaults, and the parsed YAML configurations given by path or content flags, with the fields which may hold credentials redacted.").
+		Default("false").Bool()
+	grpcCodecFallbackMetric := app.Flag("grpc.codec-fallback-metric", "Count gRPC messages marshaled or unmarshaled without vtprotobuf helpers by message type in the thanos_grpc_codec_fallback_operations_total metric, to detect hot paths missing the optimized codec.").
+		Default("false").Bool()
 
 	goMemLimitConf := goMemLimitConfig{}
 
@@ -133,6 +167,13 @@ func main() {
 	registerQueryFrontend(app)
 
 	cmd, setup := app.Parse()
+	if *dumpConfig {
+		if err := dumpResolvedConfig(os.Stdout, cmd, app.CommandFlags(cmd)); err != nil {
+			fmt.Fprintln(os.Stderr, errors.Wrapf(err, "dump config of %s command", cmd))
+			os.Exit(1)
+		}
+		os.Exit(0)
+	}
 	logger := logging.NewLogger(*logLevel, *logFormat, *debugName)
 
 	if err := configureGoAutoMemLimit(goMemLimitConf); err != nil {
@@ -150,6 +191,10 @@ func main() {
 		level.Warn(logger).Log("warn", errors.Wrapf(err, "failed to set GOMAXPROCS: %v", err))
 	}
 
+	if *logStartupInfo {
+		level.Info(logger).Log(append([]interface{}{"msg", "starting Thanos"}, runtimeinfo.New(cmd).Keyvals()...)...)
+	}
+
 	metrics := prometheus.NewRegistry()
 	metrics.MustRegister(
 		versioncollector.NewCollector("thanos"),
@@ -159,6 +204,12 @@ func main() {
 		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
 	)
 
+	extgrpc.InstrumentCompressors(metrics)
+
+	if *grpcCodecFallbackMetric {
+		codec.enableFallbackMetric(metrics)
+	}
+
 	// Some packages still use default Register. Replace to have those metrics.
 	prometheus.DefaultRegisterer = metrics
 
@@ -273,23 +324,15 @@ func reload(logger log.Logger, cancel <-chan struct{}, r chan<- struct{}) error
 	}
 }
 
-func getFlagsMap(flags []*kingpin.FlagModel) map[string]string {
-	flagsMap := map[string]string{}
-
-	// Exclude kingpin default flags to expose only Thanos ones.
-	boilerplateFlags := kingpin.New("", "").Version("")
-
-	for _, f := range flags {
-		if boilerplateFlags.GetFlag(f.Name) != nil {
-			continue
-		}
-		// Mask inline objstore flag which can have credentials.
-		if f.Name == "objstore.config" || f.Name == "objstore.config-file" {
-			flagsMap[f.Name] = "<REDACTED>"
-			continue
-		}
-		flagsMap[f.Name] = f.Value.String()
+// dumpResolvedConfig writes the effective configuration of the command as JSON.
+func dumpResolvedConfig(w io.Writer, cmd string, flags []*kingpin.FlagModel) error {
+	c, err := extkingpin.ResolveConfig(cmd, flags)
+	if err != nil {
+		return err
 	}
-
-	return flagsMap
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	// Keep <REDACTED> readable instead of escaping it as \u003cREDACTED\u003e.
+	enc.SetEscapeHTML(false)
+	return enc.Encode(c)
 }
@@ -7,11 +7,14 @@ import (
 	"context"
 	"fmt"
 	"math"
+	"net"
 	"net/http"
+	"strconv"
 	"strings"
 	"time"
 
 	extflag "github.com/efficientgo/tools/extkingpin"
+	"github.com/prometheus/prometheus/promql/parser"
 	"google.golang.org/grpc"
 
 	"github.com/go-kit/log"
@@ -35,11 +38,11 @@ import (
 	"github.com/thanos-io/thanos/pkg/block"
 	"github.com/thanos-io/thanos/pkg/compact/downsample"
 	"github.com/thanos-io/thanos/pkg/component"
+	"github.com/thanos-io/thanos/pkg/dedup"
 	"github.com/thanos-io/thanos/pkg/discovery/cache"
 	"github.com/thanos-io/thanos/pkg/discovery/dns"
 	"github.com/thanos-io/thanos/pkg/exemplars"
 	"github.com/thanos-io/thanos/pkg/extgrpc"
-	"github.com/thanos-io/thanos/pkg/extgrpc/snappy"
 	"github.com/thanos-io/thanos/pkg/extkingpin"
 	"github.com/thanos-io/thanos/pkg/extprom"
 	extpromhttp "github.com/thanos-io/thanos/pkg/extprom/http"
@@ -54,8 +57,10 @@ import (
 	"github.com/thanos-io/thanos/pkg/runutil"
 	grpcserver "github.com/thanos-io/thanos/pkg/server/grpc"
 	httpserver "github.com/thanos-io/thanos/pkg/server/http"
+	"github.com/thanos-io/thanos/pkg/server/http/middleware"
 	"github.com/thanos-io/thanos/pkg/store"
 	"github.com/thanos-io/thanos/pkg/store/labelpb"
+	"github.com/thanos-io/thanos/pkg/store/storepb"
 	"github.com/thanos-io/thanos/pkg/targets"
 	"github.com/thanos-io/thanos/pkg/tenancy"
 	"github.com/thanos-io/thanos/pkg/tls"
@@ -91,13 +96,16 @@ func registerQuery(app *extkingpin.App) {
 	key := cmd.Flag("grpc-client-tls-key", "TLS Key for the client's certificate").Default("").String()
 	caCert := cmd.Flag("grpc-client-tls-ca", "TLS CA Certificates to use to verify gRPC servers").Default("").String()
 	serverName := cmd.Flag("grpc-client-server-name", "Server name to verify the hostname on the returned gRPC certificates. See https://tools.ietf.org/html/rfc4366#section-3.1").Default("").String()
-	compressionOptions := strings.Join([]string{snappy.Name, compressionNone}, ", ")
-	grpcCompression := cmd.Flag("grpc-compression", "Compression algorithm to use for gRPC requests to other clients. Must be one of: "+compressionOptions).Default(compressionNone).Enum(snappy.Name, compressionNone)
+	serverNameOverrides := cmd.Flag("grpc-client-server-name-override", "Server name to use for TLS connections to the given endpoint instead of --grpc-client-server-name, also sent as SNI (repeatable). The endpoint is matched against the address of statically configured or resolved endpoints, either with or without the port, and against the name of endpoint groups.").
+		PlaceHolder("<endpoint>=<server-name>").Strings()
+	compressionOptions := append(append([]string{}, extgrpc.Compressors...), compressionNone)
+	grpcCompression := cmd.Flag("grpc-compression", "Compression algorithm to use for gRPC requests to other clients, e.g. StoreAPI servers, which compress their responses with the same algorithm. Compression reduces the network traffic at the cost of CPU, see the thanos_grpc_compression_* metrics. Must be one of: "+strings.Join(compressionOptions, ", ")).Default(compressionNone).Enum(compressionOptions...)
 
 	webRoutePrefix := cmd.Flag("web.route-prefix", "Prefix for API and UI endpoints. This allows thanos UI to be served on a sub-path. Defaults to the value of --web.external-prefix. This option is analogous to --web.route-prefix of Prometheus.").Default("").String()
 	webExternalPrefix := cmd.Flag("web.external-prefix", "Static prefix for all HTML links and redirect URLs in the UI query web interface. Actual endpoints are still served on / or the web.route-prefix. This allows thanos UI to be served behind a reverse proxy that strips a URL sub-path.").Default("").String()
 	webPrefixHeaderName := cmd.Flag("web.prefix-header", "Name of HTTP request header used for dynamic prefixing of UI links and redirects. This option is ignored if web.external-prefix argument is set. Security risk: enable this option only if a reverse proxy in front of thanos is resetting the header. The --web.prefix-header=X-Forwarded-Prefix option can be useful, for example, if Thanos UI is served via Traefik reverse proxy with PathPrefixStrip option enabled, which sends the stripped prefix value in X-Forwarded-Prefix header. This allows thanos UI to be served on a sub-path.").Default("").String()
 	webDisableCORS := cmd.Flag("web.disable-cors", "Whether to disable CORS headers to be set by Thanos. By default Thanos sets CORS headers to be allowed by all.").Default("false").Bool()
+	webBrotliLevel := cmd.Flag("web.brotli-compression-level", "Brotli compression level, from 0 to 11, of API responses to clients preferring Brotli over gzip in their Accept-Encoding header. Higher levels reduce the bandwidth at the cost of CPU.").Default(strconv.Itoa(middleware.DefaultBrotliLevel)).Int()
 
 	queryTimeout := extkingpin.ModelDuration(cmd.Flag("query.timeout", "Maximum time to process query by query node.").
 		Default("2m"))
@@ -105,6 +113,8 @@ func registerQuery(app *extkingpin.App) {
 	defaultEngine := cmd.Flag("query.promql-engine", "Default PromQL engine to use.").Default(string(apiv1.PromqlEnginePrometheus)).
 		Enum(string(apiv1.PromqlEnginePrometheus), string(apiv1.PromqlEngineThanos))
 	extendedFunctionsEnabled := cmd.Flag("query.enable-x-functions", "Whether to enable extended rate functions (xrate, xincrease and xdelta). Only has effect when used with Thanos engine.").Default("false").Bool()
+	experimentalFunctionsTenants := cmd.Flag("query.experimental-functions-tenant", "Tenant allowed to use experimental PromQL functions, i.e. the extended rate functions with the Thanos engine and the experimental functions of Prometheus (repeated). Queries of other tenants using them fail.").
+		PlaceHolder("<tenant>").Strings()
 	promqlQueryMode := cmd.Flag("query.mode", "PromQL query mode. One of: local, distributed.").
 		Default(string(queryModeLocal)).
 		Enum(string(queryModeLocal), string(queryModeDistributed))
@@ -118,16 +128,30 @@ func registerQuery(app *extkingpin.App) {
 	maxConcurrentSelects := cmd.Flag("query.max-concurrent-select", "Maximum number of select requests made concurrently per a query.").
 		Default("4").Int()
 
+	seriesSoftLimit := cmd.Flag("query.series-soft-limit", "Number of series a single query can touch before a warning is added to its response. The query still returns results. Use --store.limits.request-series to abort queries touching too many series instead. 0 means no limit.").
+		Default("0").Uint64()
+
+	chunkDecodeWorkers := cmd.Flag("query.chunk-decode-workers", "Number of goroutines decoding the chunks of selected series ahead of query evaluation, shared by all queries. Decoding big queries in parallel uses more cores but buffers their decoded samples until they are evaluated, which increases memory usage. 0 decodes chunks inline during evaluation, as does a single available CPU.").
+		Default("0").Int()
+
 	queryConnMetricLabels := cmd.Flag("query.conn-metric.label", "Optional selection of query connection metric labels to be collected from endpoint set").
 		Default(string(query.ExternalLabels), string(query.StoreType)).
 		Enums(string(query.ExternalLabels), string(query.StoreType))
 
 	queryReplicaLabels := cmd.Flag("query.replica-label", "Labels to treat as a replica indicator along which data is deduplicated. Still you will be able to query without deduplication using 'dedup=false' parameter. Data includes time series, recording rules, and alerting rules.").
 		Strings()
+	dedupCounterResetWindow := extkingpin.ModelDuration(cmd.Flag("query.dedup-counter-reset-window", "Experimental. If not 0, deduplication of counters, i.e. series queried by rate, irate, increase and resets, avoids counter resets seen by only some replicas, e.g. because they restarted at different times: when the selected replica resets, another replica continuing the counter within this window is selected instead. This is heuristic and more expensive than the default deduplication.").
+		Default("0s"))
+	strictDedupTolerance := cmd.Flag("query.strict-dedup-tolerance", "Relative difference up to which the values of replicas are considered consistent by queries with the 'strict_dedup=true' parameter, which report series whose replicas disagree as a warning instead of silently picking the samples of one replica.").
+		Default("0.01").Float64()
+	dedupScopes := cmd.Flag("query.dedup-scope", "Experimental. Group of replica labels deduplicated together with its own policy, in the <policy>:<replica label>[,<replica label>...] format (repeated). Scopes are deduplicated in sequence, after the replica labels not belonging to any scope, which are deduplicated together with the penalty policy. Policies: penalty picks the samples of one replica at a time, switching replicas on gaps, e.g. for Prometheus HA pairs; chain merges the samples of all replicas, e.g. for exact copies of the same data. Labels of scopes must be replica labels.").
+		PlaceHolder("<policy>:<replica labels>").Strings()
 	queryPartitionLabels := cmd.Flag("query.partition-label", "Labels that partition the leaf queriers. This is used to scope down the labelsets of leaf queriers when using the distributed query mode. If set, these labels must form a partition of the leaf queriers. Partition labels must not intersect with replica labels. Every TSDB of a leaf querier must have these labels. This is useful when there are multiple external labels that are irrelevant for the partition as it allows the distributed engine to ignore them for some optimizations. If this is empty then all labels are used as partition labels.").Strings()
 
 	instantDefaultMaxSourceResolution := extkingpin.ModelDuration(cmd.Flag("query.instant.default.max_source_resolution", "default value for max_source_resolution for instant queries. If not set, defaults to 0s only taking raw resolution into account. 1h can be a good value if you use instant queries over time ranges that incorporate times outside of your raw-retention.").Default("0s").Hidden())
 
+	enableRawChunksDebugAPI := cmd.Flag("query.enable-raw-chunks-debug-api", "Enable the /api/v1/debug/raw_chunks endpoint returning the raw encoded chunks of series selected by equality matchers, for offline analysis of chunk encoding issues.").Default("false").Bool()
+
 	defaultMetadataTimeRange := cmd.Flag("query.metadata.default-time-range", "The default metadata time range duration for retrieving labels through Labels and Series API when the range parameters are not specified. The zero value means range covers the time since the beginning.").Default("0s").Duration()
 
 	selectorLabels := cmd.Flag("selector-label", "Query selector labels that will be exposed in info endpoint (repeated).").
@@ -165,6 +189,16 @@ func registerQuery(app *extkingpin.App) {
 	strictEndpointGroups := extkingpin.Addrs(cmd.Flag("endpoint-group-strict", "Experimental: DNS name of statically configured Thanos API server groups (repeatable) that are always used, even if the health check fails.").
 		PlaceHolder("<endpoint-group-strict>"))
 
+	cachedEndpoints := cmd.Flag("endpoint.cached", "Experimental: Addresses of statically configured StoreAPI servers (repeatable), e.g. Store Gateways reached over slow links, whose responses are cached in the cache configured with --endpoint.cache-config. Only cache StoreAPI servers serving data which does not change, like blocks in object storage, as responses are cached for the configured TTL.").
+		PlaceHolder("<endpoint>").Strings()
+
+	endpointCacheConf := *extflag.RegisterPathOrContent(
+		cmd,
+		"endpoint.cache-config",
+		"YAML file that contains the cache configuration of the responses of the StoreAPI servers set by --endpoint.cached. See format details: https://thanos.io/tip/components/query.md/#caching-remote-stores",
+		extflag.WithEnvSubstitution(),
+	)
+
 	fileSDFiles := cmd.Flag("store.sd-files", "Path to files that contain addresses of store API servers. The path can be a glob pattern (repeatable).").
 		PlaceHolder("<path>").Strings()
 
@@ -182,8 +216,10 @@ func registerQuery(app *extkingpin.App) {
 
 	endpointInfoTimeout := extkingpin.ModelDuration(cmd.Flag("endpoint.info-timeout", "Timeout of gRPC Info requests.").Default("5s").Hidden())
 
-	enableAutodownsampling := cmd.Flag("query.auto-downsampling", "Enable automatic adjustment (step / 5) to what source of data should be used in store gateways if no max_source_resolution param is specified.").
+	enableAutodownsampling := cmd.Flag("query.auto-downsampling", "Enable automatic adjustment (step / 5, or as configured by --query.auto-downsampling.policy) to what source of data should be used in store gateways if no max_source_resolution param is specified.").
 		Default("false").Bool()
+	autoDownsamplingPolicyRules := cmd.Flag("query.auto-downsampling.policy", "Rule of the form <min step>:<max source resolution> replacing step / 5 to select what source of data range queries with automatic downsampling read, e.g. '5m:5m' allows queries with a step of at least 5m to read data downsampled to 5m (repeated flag). Queries with a step below the minimum step of all rules read raw data. A resolution must not be coarser than the minimum step of its rule.").
+		PlaceHolder("<min step>:<resolution>").Strings()
 
 	enableQueryPartialResponse := cmd.Flag("query.partial-response", "Enable partial response for queries if no partial_response param is specified. --no-query.partial-response for disabling.").
 		Default("true").Bool()
@@ -210,6 +246,8 @@ func registerQuery(app *extkingpin.App) {
 		Default("1s"))
 
 	storeResponseTimeout := extkingpin.ModelDuration(cmd.Flag("store.response-timeout", "If a Store doesn't send any data in this specified duration then a Store will be ignored and partial data will be returned if it's enabled. 0 disables timeout.").Default("0ms"))
+	storeSeriesRetries := cmd.Flag("store.series-retries", "Maximum number of times the Series stream of a Store failing with an UNAVAILABLE error is retried. Streams are restarted from scratch. With lazy retrieval only streams failing before their first response are retried. Other errors are not retried. 0 disables retries.").Default("0").Int()
+	storeSeriesRetryTimeout := extkingpin.ModelDuration(cmd.Flag("store.series-retry-timeout", "Maximum time from the first request of the Series stream of a Store to its last retry.").Default("10s"))
 
 	storeSelectorRelabelConf := *extflag.RegisterPathOrContent(
 		cmd,
@@ -218,6 +256,13 @@ func registerQuery(app *extkingpin.App) {
 		extflag.WithEnvSubstitution(),
 	)
 
+	histogramMergeConf := *extflag.RegisterPathOrContent(
+		cmd,
+		"query.histogram-merge-config",
+		"YAML file mapping native histograms to the classic histograms they are merged with by queries with the 'merge_histograms=true' parameter. Only native histograms with a mapping are merged, by default with the classic histogram of the same name.",
+		extflag.WithEnvSubstitution(),
+	)
+
 	reqLogConfig := extkingpin.RegisterRequestLoggingFlags(cmd)
 
 	alertQueryURL := cmd.Flag("alert.query-url", "The external Thanos Query URL that would be set in all alerts 'Source' field.").String()
@@ -294,6 +339,35 @@ func registerQuery(app *extkingpin.App) {
 			return err
 		}
 
+		histogramMergeContent, err := histogramMergeConf.Content()
+		if err != nil {
+			return errors.Wrap(err, "error while reading histogram merge configuration")
+		}
+		histogramMerger, err := query.NewHistogramMerger(histogramMergeContent)
+		if err != nil {
+			return err
+		}
+
+		autoDownsamplingPolicy, err := query.ParseAutoDownsamplingPolicy(*autoDownsamplingPolicyRules)
+		if err != nil {
+			return errors.Wrap(err, "parse auto downsampling policy")
+		}
+
+		var cachingClients *store.CachingClients
+		if len(*cachedEndpoints) > 0 {
+			endpointCacheContent, err := endpointCacheConf.Content()
+			if err != nil {
+				return errors.Wrap(err, "error while reading endpoint cache configuration")
+			}
+			if len(endpointCacheContent) == 0 {
+				return errors.New("--endpoint.cached requires --endpoint.cache-config or --endpoint.cache-config-file")
+			}
+			cachingClients, err = store.NewCachingClientsFromYaml(endpointCacheContent, *cachedEndpoints, logger, reg)
+			if err != nil {
+				return errors.Wrap(err, "create endpoint cache")
+			}
+		}
+
 		return runQuery(
 			g,
 			logger,
@@ -311,6 +385,7 @@ func registerQuery(app *extkingpin.App) {
 			*key,
 			*caCert,
 			*serverName,
+			*serverNameOverrides,
 			*httpBindAddr,
 			*httpTLSConfig,
 			time.Duration(*httpGracePeriod),
@@ -319,17 +394,23 @@ func registerQuery(app *extkingpin.App) {
 			*webPrefixHeaderName,
 			*maxConcurrentQueries,
 			*maxConcurrentSelects,
+			*seriesSoftLimit,
+			*chunkDecodeWorkers,
+			time.Duration(*dedupCounterResetWindow),
+			*strictDedupTolerance,
+			*dedupScopes,
 			time.Duration(*defaultRangeQueryStep),
 			time.Duration(*queryTimeout),
 			*lookbackDelta,
 			*dynamicLookbackDelta,
 			time.Duration(*defaultEvaluationInterval),
 			time.Duration(*storeResponseTimeout),
+			store.SeriesRetryConfig{MaxRetries: *storeSeriesRetries, Timeout: time.Duration(*storeSeriesRetryTimeout)},
 			*queryConnMetricLabels,
 			*queryReplicaLabels,
 			*queryPartitionLabels,
 			selectorLset,
-			getFlagsMap(cmd.Flags()),
+			extkingpin.FlagsMap(cmd.Flags()),
 			*endpoints,
 			*endpointGroups,
 			*stores,
@@ -355,6 +436,9 @@ func registerQuery(app *extkingpin.App) {
 			*strictEndpoints,
 			*strictEndpointGroups,
 			*webDisableCORS,
+			*webBrotliLevel,
+			histogramMerger,
+			autoDownsamplingPolicy,
 			*alertQueryURL,
 			*grpcProxyStrategy,
 			*queryTelemetryDurationQuantiles,
@@ -363,6 +447,7 @@ func registerQuery(app *extkingpin.App) {
 			*defaultEngine,
 			storeRateLimits,
 			*extendedFunctionsEnabled,
+			*experimentalFunctionsTenants,
 			store.NewTSDBSelector(tsdbSelector),
 			queryMode(*promqlQueryMode),
 			*tenantHeader,
@@ -370,6 +455,8 @@ func registerQuery(app *extkingpin.App) {
 			*tenantCertField,
 			*enforceTenancy,
 			*tenantLabel,
+			*enableRawChunksDebugAPI,
+			cachingClients,
 		)
 	})
 }
@@ -393,6 +480,7 @@ func runQuery(
 	key string,
 	caCert string,
 	serverName string,
+	serverNameOverrides []string,
 	httpBindAddr string,
 	httpTLSConfig string,
 	httpGracePeriod time.Duration,
@@ -401,12 +489,18 @@ func runQuery(
 	webPrefixHeaderName string,
 	maxConcurrentQueries int,
 	maxConcurrentSelects int,
+	seriesSoftLimit uint64,
+	chunkDecodeWorkers int,
+	dedupCounterResetWindow time.Duration,
+	strictDedupTolerance float64,
+	dedupScopeFlags []string,
 	defaultRangeQueryStep time.Duration,
 	queryTimeout time.Duration,
 	lookbackDelta time.Duration,
 	dynamicLookbackDelta bool,
 	defaultEvaluationInterval time.Duration,
 	storeResponseTimeout time.Duration,
+	storeSeriesRetries store.SeriesRetryConfig,
 	queryConnMetricLabels []string,
 	queryReplicaLabels []string,
 	queryPartitionLabels []string,
@@ -437,6 +531,9 @@ func runQuery(
 	strictEndpoints []string,
 	strictEndpointGroups []string,
 	disableCORS bool,
+	brotliLevel int,
+	histogramMerger *query.HistogramMerger,
+	autoDownsamplingPolicy query.AutoDownsamplingPolicy,
 	alertQueryURL string,
 	grpcProxyStrategy string,
 	queryTelemetryDurationQuantiles []float64,
@@ -445,6 +542,7 @@ func runQuery(
 	defaultEngine string,
 	storeRateLimits store.SeriesSelectLimits,
 	extendedFunctionsEnabled bool,
+	experimentalFunctionsTenants []string,
 	tsdbSelector *store.TSDBSelector,
 	queryMode queryMode,
 	tenantHeader string,
@@ -452,6 +550,8 @@ func runQuery(
 	tenantCertField string,
 	enforceTenancy bool,
 	tenantLabel string,
+	enableRawChunksDebugAPI bool,
+	cachingClients *store.CachingClients,
 ) error {
 	comp := component.Query
 	if alertQueryURL == "" {
@@ -474,6 +574,29 @@ func runQuery(
 	if grpcCompression != compressionNone {
 		dialOpts = append(dialOpts, grpc.WithDefaultCallOptions(grpc.UseCompressor(grpcCompression)))
 	}
+	endpointDialOpts, err := serverNameDialOpts(logger, secure, skipVerify, cert, key, caCert, serverNameOverrides)
+	if err != nil {
+		return err
+	}
+	if strictDedupTolerance < 0 {
+		return errors.New("--query.strict-dedup-tolerance must not be negative")
+	}
+	dedupScopes := make([]dedup.Scope, 0, len(dedupScopeFlags))
+	for _, f := range dedupScopeFlags {
+		scope, err := dedup.ParseScope(f)
+		if err != nil {
+			return errors.Wrap(err, "parse --query.dedup-scope")
+		}
+		dedupScopes = append(dedupScopes, scope)
+	}
+	if err := dedup.ValidateScopes(dedupScopes, queryReplicaLabels); err != nil {
+		return errors.Wrap(err, "validate --query.dedup-scope")
+	}
+	if len(experimentalFunctionsTenants) > 0 {
+		// The experimental functions of Prometheus can only be enabled globally, the QueryAPI rejects them for
+		// the queries of other tenants.
+		parser.EnableExperimentalFunctions = true
+	}
 
 	fileSDCache := cache.New()
 	dnsStoreProvider := dns.NewProvider(
@@ -537,6 +660,7 @@ func runQuery(
 	options := []store.ProxyStoreOption{
 		store.WithTSDBSelector(tsdbSelector),
 		store.WithProxyStoreDebugLogging(debugLogging),
+		store.WithSeriesRetries(storeSeriesRetries),
 	}
 
 	var (
@@ -558,12 +682,14 @@ func runQuery(
 			endpointGroupAddrs,
 			strictEndpointGroups,
 			dialOpts,
+			endpointDialOpts,
 			unhealthyStoreTimeout,
 			endpointInfoTimeout,
 			queryConnMetricLabels...,
 		)
+		getStoreClients = cachingClients.Wrap(endpoints.GetStoreClients)
 
-		proxyStore       = store.NewProxyStore(logger, reg, endpoints.GetStoreClients, component.Query, selectorLset, storeResponseTimeout, store.RetrievalStrategy(grpcProxyStrategy), options...)
+		proxyStore       = store.NewProxyStore(logger, reg, getStoreClients, component.Query, selectorLset, storeResponseTimeout, store.RetrievalStrategy(grpcProxyStrategy), options...)
 		seriesProxy      = store.NewLimitedStoreServer(store.NewInstrumentedStoreServer(reg, proxyStore), reg, storeRateLimits)
 		rulesProxy       = rules.NewProxy(logger, endpoints.GetRulesClients)
 		targetsProxy     = targets.NewProxy(logger, endpoints.GetTargetsClients)
@@ -575,6 +701,11 @@ func runQuery(
 			seriesProxy,
 			maxConcurrentSelects,
 			queryTimeout,
+			seriesSoftLimit,
+			dedupCounterResetWindow,
+			strictDedupTolerance,
+			dedupScopes,
+			chunkDecodeWorkers,
 		)
 	)
 
@@ -683,11 +814,12 @@ func runQuery(
 		level.Info(logger).Log("msg", "Distributed query mode enabled, using Thanos as the default query engine.")
 		defaultEngine = string(apiv1.PromqlEngineThanos)
 		remoteEngineEndpoints = query.NewRemoteEndpoints(logger, endpoints.GetQueryAPIClients, query.Opts{
-			AutoDownsample:        enableAutodownsampling,
-			ReplicaLabels:         queryReplicaLabels,
-			PartitionLabels:       queryPartitionLabels,
-			Timeout:               queryTimeout,
-			EnablePartialResponse: enableQueryPartialResponse,
+			AutoDownsample:         enableAutodownsampling,
+			ReplicaLabels:          queryReplicaLabels,
+			PartitionLabels:        queryPartitionLabels,
+			Timeout:                queryTimeout,
+			EnablePartialResponse:  enableQueryPartialResponse,
+			AutoDownsamplingPolicy: autoDownsamplingPolicy,
 		})
 	}
 
@@ -724,6 +856,10 @@ func runQuery(
 		// TODO(bplotka in PR #513 review): pass all flags, not only the flags needed by prefix rewriting.
 		ui.NewQueryUI(logger, endpoints, webExternalPrefix, webPrefixHeaderName, alertQueryURL, tenantHeader, defaultTenant, enforceTenancy).Register(router, ins)
 
+		var rawChunksStore storepb.StoreServer
+		if enableRawChunksDebugAPI {
+			rawChunksStore = seriesProxy
+		}
 		api := apiv1.NewQueryAPI(
 			logger,
 			endpoints.GetEndpointStatus,
@@ -765,8 +901,17 @@ func runQuery(
 			tenantCertField,
 			enforceTenancy,
 			tenantLabel,
+			rawChunksStore,
+			experimentalFunctionsTenants,
 		)
 
+		compress, err := middleware.NewCompressionHandler(brotliLevel)
+		if err != nil {
+			return errors.Wrap(err, "create response compression")
+		}
+		api.SetCompression(compress)
+		api.SetHistogramMerger(histogramMerger)
+		api.SetAutoDownsamplingPolicy(autoDownsamplingPolicy)
 		api.Register(router.WithPrefix("/api/v1"), tracer, logger, ins, logMiddleware)
 
 		srv := httpserver.New(logger, reg, comp, httpProbe,
@@ -818,7 +963,7 @@ func runQuery(
 		)
 
 		defaultEngineType := querypb.EngineType(querypb.EngineType_value[defaultEngine])
-		grpcAPI := apiv1.NewGRPCAPI(time.Now, queryReplicaLabels, queryableCreator, engineFactory, defaultEngineType, lookbackDeltaCreator, instantDefaultMaxSourceResolution)
+		grpcAPI := apiv1.NewGRPCAPI(time.Now, queryReplicaLabels, queryableCreator, engineFactory, defaultEngineType, lookbackDeltaCreator, instantDefaultMaxSourceResolution, defaultTenant, experimentalFunctionsTenants)
 		s := grpcserver.New(logger, reg, tracer, grpcLogOpts, logFilterMethods, comp, grpcProbe,
 			grpcserver.WithServer(apiv1.RegisterQueryServer(grpcAPI)),
 			grpcserver.WithServer(store.RegisterStoreServer(seriesProxy, logger)),
@@ -875,10 +1020,17 @@ func prepareEndpointSet(
 	endpointGroupAddrs []string,
 	strictEndpointGroups []string,
 	dialOpts []grpc.DialOption,
+	endpointDialOpts func(addr string) []grpc.DialOption,
 	unhealthyStoreTimeout time.Duration,
 	endpointInfoTimeout time.Duration,
 	queryConnMetricLabels ...string,
 ) *query.EndpointSet {
+	newSpec := func(addr string, isStrictStatic bool, opts ...grpc.DialOption) *query.GRPCEndpointSpec {
+		if endpointDialOpts != nil {
+			opts = append(opts, endpointDialOpts(addr)...)
+		}
+		return query.NewGRPCEndpointSpec(addr, isStrictStatic, opts...)
+	}
 	endpointSet := query.NewEndpointSet(
 		time.Now,
 		logger,
@@ -886,30 +1038,30 @@ func prepareEndpointSet(
 		func() (specs []*query.GRPCEndpointSpec) {
 			// Add strict & static nodes.
 			for _, addr := range strictStores {
-				specs = append(specs, query.NewGRPCEndpointSpec(addr, true))
+				specs = append(specs, newSpec(addr, true))
 			}
 
 			for _, addr := range strictEndpoints {
-				specs = append(specs, query.NewGRPCEndpointSpec(addr, true))
+				specs = append(specs, newSpec(addr, true))
 			}
 
 			for _, dnsProvider := range dnsProviders {
 				var tmpSpecs []*query.GRPCEndpointSpec
 
 				for _, addr := range dnsProvider.Addresses() {
-					tmpSpecs = append(tmpSpecs, query.NewGRPCEndpointSpec(addr, false))
+					tmpSpecs = append(tmpSpecs, newSpec(addr, false))
 				}
 				tmpSpecs = removeDuplicateEndpointSpecs(logger, duplicatedStores, tmpSpecs)
 				specs = append(specs, tmpSpecs...)
 			}
 
 			for _, eg := range endpointGroupAddrs {
-				spec := query.NewGRPCEndpointSpec(fmt.Sprintf("thanos:///%s", eg), false, extgrpc.EndpointGroupGRPCOpts()...)
+				spec := newSpec(fmt.Sprintf("thanos:///%s", eg), false, extgrpc.EndpointGroupGRPCOpts()...)
 				specs = append(specs, spec)
 			}
 
 			for _, eg := range strictEndpointGroups {
-				spec := query.NewGRPCEndpointSpec(fmt.Sprintf("thanos:///%s", eg), true, extgrpc.EndpointGroupGRPCOpts()...)
+				spec := newSpec(fmt.Sprintf("thanos:///%s", eg), true, extgrpc.EndpointGroupGRPCOpts()...)
 				specs = append(specs, spec)
 			}
 
@@ -937,6 +1089,64 @@ func prepareEndpointSet(
 	return endpointSet
 }
 
+// serverNameDialOpts parses the given <endpoint>=<server-name> overrides and returns a function providing
+// the dial options using the overridden TLS server name for the endpoint with the given address, if any.
+func serverNameDialOpts(logger log.Logger, secure, skipVerify bool, cert, key, caCert string, overrides []string) (func(addr string) []grpc.DialOption, error) {
+	serverNames, err := parseServerNameOverrides(overrides)
+	if err != nil {
+		return nil, err
+	}
+	if len(serverNames) == 0 {
+		return nil, nil
+	}
+	if !secure {
+		return nil, errors.New("--grpc-client-server-name-override requires --grpc-client-tls-secure")
+	}
+
+	opts := make(map[string][]grpc.DialOption, len(serverNames))
+	for endpoint, serverName := range serverNames {
+		o, err := extgrpc.StoreClientServerNameGRPCOpts(logger, skipVerify, cert, key, caCert, serverName)
+		if err != nil {
+			return nil, errors.Wrapf(err, "building gRPC client for endpoint %s", endpoint)
+		}
+		opts[endpoint] = o
+	}
+	return func(addr string) []grpc.DialOption {
+		return opts[serverNameOverrideKey(addr, serverNames)]
+	}, nil
+}
+
+// parseServerNameOverrides parses <endpoint>=<server-name> pairs into a map.
+func parseServerNameOverrides(overrides []string) (map[string]string, error) {
+	serverNames := make(map[string]string, len(overrides))
+	for _, o := range overrides {
+		endpoint, serverName, ok := strings.Cut(o, "=")
+		if !ok || endpoint == "" || serverName == "" {
+			return nil, errors.Errorf("invalid server name override %q, expected <endpoint>=<server-name>", o)
+		}
+		if _, ok := serverNames[endpoint]; ok {
+			return nil, errors.Errorf("duplicate server name override for endpoint %s", endpoint)
+		}
+		serverNames[endpoint] = serverName
+	}
+	return serverNames, nil
+}
+
+// serverNameOverrideKey returns the endpoint of the server name override matching the given endpoint address.
+// The full address takes precedence over the host without port. Endpoint groups are matched by their name.
+func serverNameOverrideKey(addr string, serverNames map[string]string) string {
+	addr = strings.TrimPrefix(addr, "thanos:///")
+	if _, ok := serverNames[addr]; ok {
+		return addr
+	}
+	if host, _, err := net.SplitHostPort(addr); err == nil {
+		if _, ok := serverNames[host]; ok {
+			return host
+		}
+	}
+	return ""
+}
+
 // LookbackDeltaFactory creates from 1 to 3 lookback deltas depending on
 // dynamicLookbackDelta and eo.LookbackDelta and returns a function
 // that returns appropriate lookback delta for given maxSourceResolutionMillis.
@@ -6,12 +6,12 @@ package main
 import (
 	"net"
 	"net/http"
+	"strconv"
 	"time"
 
 	extflag "github.com/efficientgo/tools/extkingpin"
 	"github.com/go-kit/log"
 	"github.com/go-kit/log/level"
-	"github.com/klauspost/compress/gzhttp"
 	"github.com/oklog/run"
 	"github.com/opentracing/opentracing-go"
 	"github.com/pkg/errors"
@@ -91,15 +91,35 @@ func registerQueryFrontend(app *extkingpin.App) {
 	cmd.Flag("query-range.horizontal-shards", "Split queries in this many requests when query duration is below query-range.max-split-interval.").
 		Default("0").Int64Var(&cfg.QueryRangeConfig.HorizontalShards)
 
+	cmd.Flag("query-range.align-splits-with-step", "Round the split interval computed from query-range.horizontal-shards up to query-range.min-split-interval times a power of two and to a multiple of the step, so that requests for slightly different ranges are split at the same boundaries and reuse the same results cache entries. Unlike query-range.align-range-with-step, this never changes the returned data points.").
+		Default("false").BoolVar(&cfg.QueryRangeConfig.AlignSplitsWithStep)
+
+	cmd.Flag("query-range.experimental-split-target-samples", "Experimental: split query range requests so that each request selects about this many samples, estimated with a probe query counting the samples of the query selectors over the 5 minutes before its end. "+
+		"Queries are split by query-range.split-interval, or query-range.min-split-interval and query-range.max-split-interval, when the estimation fails. 0 disables it.").
+		Default("0").Int64Var(&cfg.QueryRangeConfig.SplitTargetSamples)
+
 	cmd.Flag("query-range.max-retries-per-request", "Maximum number of retries for a single query range request; beyond this, the downstream error is returned.").
 		Default("5").IntVar(&cfg.QueryRangeConfig.MaxRetries)
 
+	cmd.Flag("query-range.max-response-bytes", "Maximum size of query range responses. Encoding of larger responses is aborted and 413 is returned instead, suggesting to query with a larger step. A unit is required, supported units: B, KB, MB, GB, TB, PB, EB. Ex: \"512MB\". 0 disables the limit.").
+		Default("0").BytesVar(&cfg.QueryRangeConfig.MaxResponseBytes)
+
 	cmd.Flag("query-frontend.enable-x-functions", "Enable experimental x- functions in query-frontend. --no-query-frontend.enable-x-functions for disabling.").
 		Default("false").BoolVar(&cfg.EnableXFunctions)
 
 	cmd.Flag("query-range.max-query-length", "Limit the query time range (end - start time) in the query-frontend, 0 disables it.").
 		Default("0").DurationVar((*time.Duration)(&cfg.QueryRangeConfig.Limits.MaxQueryLength))
 
+	cmd.Flag("query-range.require-metric-name-for-queries-longer-than", "Reject range and instant queries with selectors without a metric name, like {job=\"x\"}, which select data over a time range longer than this. "+
+		"The time range of a selector is the query time range plus the ranges of the range selectors and subqueries enclosing it. 0 disables it.").
+		Default("0").DurationVar((*time.Duration)(&cfg.QueryRangeConfig.Limits.RequireMetricNameForQueriesLongerThan))
+
+	cmd.Flag("query-range.allow-cache-bypass", "Let range queries bypass reading the results cache with the no_cache=true parameter or a Cache-Control: no-cache header, e.g. to replace a suspected stale cache entry. Their fresh results are still cached. "+
+		"Requests to bypass the cache are otherwise ignored. Enable it per tenant with --query-range.tenant-limits-config rather than for all tenants.").
+		Default("false").BoolVar(&cfg.QueryRangeConfig.Limits.AllowCacheBypass)
+
+	cfg.QueryRangeConfig.TenantLimitsPathOrContent = *extflag.RegisterPathOrContent(cmd, "query-range.tenant-limits-config", "YAML file that contains per-tenant overrides of the query range limits, keyed by tenant. Limits not overridden for a tenant default to the ones set by flags.", extflag.WithEnvSubstitution())
+
 	cmd.Flag("query-range.max-query-parallelism", "Maximum number of query range requests will be scheduled in parallel by the Frontend.").
 		Default("14").IntVar(&cfg.QueryRangeConfig.Limits.MaxQueryParallelism)
 
@@ -124,6 +144,9 @@ func registerQueryFrontend(app *extkingpin.App) {
 	cmd.Flag("labels.response-cache-max-freshness", "Most recent allowed cacheable result for labels requests, to prevent caching very recent results that might still be in flux.").
 		Default("1m").DurationVar((*time.Duration)(&cfg.LabelsConfig.Limits.MaxCacheFreshness))
 
+	cmd.Flag("labels.response-cache-recent-ttl", "How long cached results of labels and series requests whose time range ends within the last labels.split-interval are reused, so that new series show up. Older results are kept for the expiration configured in labels.response-cache-config. 0 disables it.").
+		Default("5m").DurationVar(&cfg.LabelsConfig.RecentCacheTTL)
+
 	cmd.Flag("labels.partial-response", "Enable partial response for labels requests if no partial_response param is specified. --no-labels.partial-response for disabling.").
 		Default("true").BoolVar(&cfg.LabelsConfig.PartialResponseStrategy)
 
@@ -135,6 +158,9 @@ func registerQueryFrontend(app *extkingpin.App) {
 	cmd.Flag("cache-compression-type", "Use compression in results cache. Supported values are: 'snappy' and '' (disable compression).").
 		Default("").StringVar(&cfg.CacheCompression)
 
+	cmd.Flag("cache-checksum", "Store a checksum with results cache entries and treat entries failing verification as cache misses. Entries are stored under keys of their own, so enabling it starts with an empty cache.").
+		Default("false").BoolVar(&cfg.CacheChecksum)
+
 	cmd.Flag("query-frontend.downstream-url", "URL of downstream Prometheus Query compatible API.").
 		Default("http://localhost:9090").StringVar(&cfg.DownstreamURL)
 
@@ -143,6 +169,9 @@ func registerQueryFrontend(app *extkingpin.App) {
 	cmd.Flag("query-frontend.compress-responses", "Compress HTTP responses.").
 		Default("false").BoolVar(&cfg.CompressResponses)
 
+	cmd.Flag("query-frontend.brotli-compression-level", "Brotli compression level, from 0 to 11, of responses to clients preferring Brotli over gzip in their Accept-Encoding header, when compressing HTTP responses. Higher levels reduce the bandwidth at the cost of CPU.").
+		Default(strconv.Itoa(middleware.DefaultBrotliLevel)).IntVar(&cfg.BrotliCompressionLevel)
+
 	cmd.Flag("query-frontend.log-queries-longer-than", "Log queries that are slower than the specified duration. "+
 		"Set to 0 to disable. Set to < 0 to enable on all queries.").Default("0").DurationVar(&cfg.CortexHandlerConfig.LogQueriesLongerThan)
 
@@ -161,6 +190,10 @@ func registerQueryFrontend(app *extkingpin.App) {
 
 	cmd.Flag("query-frontend.vertical-shards", "Number of shards to use when distributing shardable PromQL queries. For more details, you can refer to the Vertical query sharding proposal: https://thanos.io/tip/proposals-accepted/202205-vertical-query-sharding.md").IntVar(&cfg.NumShards)
 
+	cmd.Flag("query-frontend.instant-query-split-interval", "Split instant queries aggregating a range selector or subquery longer than this interval over time with sum_over_time, count_over_time, max_over_time or min_over_time into queries over ranges of at most this interval, executed in parallel and combined. "+
+		"Other instant queries are not split. 0 disables it.").
+		Default("0").DurationVar(&cfg.InstantQuerySplitInterval)
+
 	cmd.Flag("query-frontend.slow-query-logs-user-header", "Set the value of the field remote_user in the slow query logs to the value of the given HTTP header. Falls back to reading the user from the basic auth header.").PlaceHolder("<http-header-name>").Default("").StringVar(&cfg.CortexHandlerConfig.SlowQueryLogsUserHeader)
 
 	reqLogConfig := extkingpin.RegisterRequestLoggingFlags(cmd)
@@ -269,10 +302,22 @@ func runQueryFrontend(
 		}
 		cfg.QueryRangeConfig.ResultsCacheConfig = &queryrange.ResultsCacheConfig{
 			Compression: cfg.CacheCompression,
+			Checksum:    cfg.CacheChecksum,
 			CacheConfig: *cacheConfig,
 		}
 	}
 
+	tenantLimitsConfContentYaml, err := cfg.QueryRangeConfig.TenantLimitsPathOrContent.Content()
+	if err != nil {
+		return err
+	}
+	if len(tenantLimitsConfContentYaml) > 0 {
+		cfg.QueryRangeConfig.TenantLimits, err = queryfrontend.NewTenantLimits(*cfg.QueryRangeConfig.Limits, tenantLimitsConfContentYaml)
+		if err != nil {
+			return errors.Wrap(err, "initializing the query range tenant limits")
+		}
+	}
+
 	labelsCacheConfContentYaml, err := cfg.LabelsConfig.CachePathOrContent.Content()
 	if err != nil {
 		return err
@@ -284,6 +329,7 @@ func runQueryFrontend(
 		}
 		cfg.LabelsConfig.ResultsCacheConfig = &queryrange.ResultsCacheConfig{
 			Compression: cfg.CacheCompression,
+			Checksum:    cfg.CacheChecksum,
 			CacheConfig: *cacheConfig,
 		}
 	}
@@ -298,6 +344,7 @@ func runQueryFrontend(
 		}
 	}
 
+	cfg.CacheStats = queryfrontend.NewCacheStats()
 	tripperWare, err := queryfrontend.NewTripperware(cfg.Config, reg, logger)
 	if err != nil {
 		return errors.Wrap(err, "setup tripperwares")
@@ -324,7 +371,11 @@ func runQueryFrontend(
 	// Create the query frontend transport.
 	handler := transport.NewHandler(*cfg.CortexHandlerConfig, roundTripper, logger, nil)
 	if cfg.CompressResponses {
-		handler = gzhttp.GzipHandler(handler)
+		compress, err := middleware.NewCompressionHandler(cfg.BrotliCompressionLevel)
+		if err != nil {
+			return errors.Wrap(err, "create response compression")
+		}
+		handler = compress(handler)
 	}
 
 	httpProbe := prober.NewHTTP()
@@ -368,6 +419,7 @@ func runQueryFrontend(
 			return hf
 		}
 		srv.Handle("/", instr(handler.ServeHTTP))
+		srv.Handle("/frontend/cache/stats", instr(cfg.CacheStats.ServeHTTP))
 
 		g.Add(func() error {
 			statusProber.Healthy()
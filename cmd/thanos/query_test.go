@@ -7,6 +7,7 @@ import (
 	"testing"
 	"time"
 
+	"github.com/go-kit/log"
 	"github.com/prometheus/prometheus/promql"
 
 	"github.com/efficientgo/core/testutil"
@@ -94,3 +95,43 @@ func TestLookbackDeltaFactory(t *testing.T) {
 		}
 	}
 }
+
+func TestServerNameOverrides(t *testing.T) {
+	serverNames, err := parseServerNameOverrides([]string{
+		"store-a.example.com:10901=store-a.internal",
+		"store-b.example.com=store-b.internal",
+		"store-b.example.com:10902=store-b2.internal",
+		"group.example.com:10901=group.internal",
+	})
+	testutil.Ok(t, err)
+
+	for addr, expected := range map[string]string{
+		"store-a.example.com:10901":         "store-a.example.com:10901",
+		"store-a.example.com:10902":         "",
+		"store-b.example.com:10901":         "store-b.example.com",
+		"store-b.example.com:10902":         "store-b.example.com:10902",
+		"thanos:///group.example.com:10901": "group.example.com:10901",
+		"10.0.0.1:10901":                    "",
+		"store-c.example.com:10901":         "",
+	} {
+		testutil.Equals(t, expected, serverNameOverrideKey(addr, serverNames), addr)
+	}
+
+	for _, invalid := range [][]string{
+		{"store-a.example.com"},
+		{"=store-a.internal"},
+		{"store-a.example.com="},
+		{"store-a.example.com=a", "store-a.example.com=b"},
+	} {
+		_, err := parseServerNameOverrides(invalid)
+		testutil.NotOk(t, err, "%v", invalid)
+	}
+
+	_, err = serverNameDialOpts(log.NewNopLogger(), false, false, "", "", "", []string{"store-a.example.com=store-a.internal"})
+	testutil.NotOk(t, err)
+
+	endpointDialOpts, err := serverNameDialOpts(log.NewNopLogger(), true, false, "", "", "", []string{"store-a.example.com=store-a.internal"})
+	testutil.Ok(t, err)
+	testutil.Equals(t, 1, len(endpointDialOpts("store-a.example.com:10901")))
+	testutil.Equals(t, 0, len(endpointDialOpts("store-b.example.com:10901")))
+}
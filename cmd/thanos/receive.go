@@ -7,6 +7,7 @@ import (
 	"context"
 	"os"
 	"path"
+	"strconv"
 	"strings"
 	"time"
 
@@ -29,19 +30,21 @@ import (
 	"gopkg.in/yaml.v2"
 
 	"github.com/thanos-io/objstore"
-	"github.com/thanos-io/objstore/client"
 	objstoretracing "github.com/thanos-io/objstore/tracing/opentracing"
 
+	"github.com/thanos-io/thanos/pkg/block/lifecycle"
 	"github.com/thanos-io/thanos/pkg/block/metadata"
 	"github.com/thanos-io/thanos/pkg/component"
 	"github.com/thanos-io/thanos/pkg/exemplars"
 	"github.com/thanos-io/thanos/pkg/extgrpc"
 	"github.com/thanos-io/thanos/pkg/extgrpc/snappy"
 	"github.com/thanos-io/thanos/pkg/extkingpin"
+	"github.com/thanos-io/thanos/pkg/extobjstore"
 	"github.com/thanos-io/thanos/pkg/extprom"
 	"github.com/thanos-io/thanos/pkg/info"
 	"github.com/thanos-io/thanos/pkg/info/infopb"
 	"github.com/thanos-io/thanos/pkg/logging"
+	meta "github.com/thanos-io/thanos/pkg/metadata"
 	"github.com/thanos-io/thanos/pkg/prober"
 	"github.com/thanos-io/thanos/pkg/receive"
 	"github.com/thanos-io/thanos/pkg/runutil"
@@ -73,6 +76,12 @@ func registerReceive(app *extkingpin.App) {
 		if lset.Len() == 0 {
 			return errors.New("no external labels configured for receive, uniquely identifying external labels must be configured (ideally with `receive_` prefix); see https://thanos.io/tip/thanos/storage.md#external-labels for details.")
 		}
+		if conf.remoteReadConcurrencyLimit <= 0 {
+			return errors.New("--receive.remote-read.concurrent-limit must be greater than 0")
+		}
+		if conf.backpressureThreshold < 0 || conf.backpressureThreshold > 1 {
+			return errors.New("--receive.backpressure.threshold must be between 0 and 1")
+		}
 
 		grpcLogOpts, logFilterMethods, err := logging.ParsegRPCOptions(conf.reqLogConfig)
 
@@ -88,7 +97,7 @@ func registerReceive(app *extkingpin.App) {
 			MaxBytes:                       int64(conf.tsdbMaxBytes),
 			OutOfOrderCapMax:               conf.tsdbOutOfOrderCapMax,
 			NoLockfile:                     conf.noLockFile,
-			WALCompression:                 wlog.ParseCompressionType(conf.walCompression, string(wlog.CompressionSnappy)),
+			WALCompression:                 wlog.ParseCompressionType(conf.walCompression, conf.walCompressionType),
 			MaxExemplars:                   conf.tsdbMaxExemplars,
 			EnableExemplarStorage:          conf.tsdbMaxExemplars > 0,
 			HeadChunksWriteQueueSize:       int(conf.tsdbWriteQueueSize),
@@ -160,6 +169,7 @@ func runReceive(
 	}
 
 	var bkt objstore.Bucket
+	var blockEvents lifecycle.Notifier = lifecycle.NopNotifier{}
 	confContentYaml, err := conf.objStoreConfig.Content()
 	if err != nil {
 		return err
@@ -180,15 +190,29 @@ func runReceive(
 			}
 			// The background shipper continuously scans the data directory and uploads
 			// new blocks to object storage service.
-			bkt, err = client.NewBucket(logger, confContentYaml, comp.String())
+			bkt, err = extobjstore.NewBucket(logger, reg, confContentYaml, comp.String())
 			if err != nil {
 				return err
 			}
 			bkt = objstoretracing.WrapWithTraces(objstore.WrapWithMetrics(bkt, extprom.WrapRegistererWithPrefix("thanos_", reg), bkt.Name()))
+
+			blockEvents, err = newBlockEvents(logger, reg, conf.blockEvents, comp)
+			if err != nil {
+				return err
+			}
 		} else {
 			level.Info(logger).Log("msg", "no supported bucket was configured, uploads will be disabled")
 		}
 	}
+	if conf.blockUploadEnabled && (!enableIngestion || !upload) {
+		return errors.New("--receive.block-upload.enabled requires the receiver to ingest metrics and object storage to be configured")
+	}
+	if conf.blockUploadEnabled && conf.blockUploadBearerTokenFile == "" && conf.rwServerClientCA == "" {
+		return errors.New("--receive.block-upload.enabled requires uploads to be authenticated with --receive.block-upload.bearer-token-file or --remote-write.server-tls-client-ca")
+	}
+	if conf.tenantOverridesFile != "" && conf.tenantOverridesBearerTokenFile == "" && conf.rwServerClientCA == "" {
+		return errors.New("--receive.tenant-overrides-file requires the tenant overrides API to be authenticated with --receive.tenant-overrides.bearer-token-file or --remote-write.server-tls-client-ca")
+	}
 
 	// TODO(brancz): remove after a couple of versions
 	// Migrate non-multi-tsdb capable storage to multi-tsdb disk layout.
@@ -205,6 +229,48 @@ func runReceive(
 		return errors.Wrap(err, "parse relabel configuration")
 	}
 
+	var seriesValidator *receive.SeriesValidator
+	validationContentYaml, err := conf.validationConfigPath.Content()
+	if err != nil {
+		return errors.Wrap(err, "get content of validation configuration")
+	}
+	if len(validationContentYaml) > 0 {
+		validationConfig, err := receive.ParseValidationConfig(validationContentYaml)
+		if err != nil {
+			return err
+		}
+		if seriesValidator, err = receive.NewSeriesValidator(*validationConfig, reg); err != nil {
+			return errors.Wrap(err, "create series validator")
+		}
+	}
+
+	tenantSeriesThresholds := make(map[string]uint64, len(conf.tsdbEarlyHeadCompactionTenantSeriesThreshold))
+	for tenant, threshold := range conf.tsdbEarlyHeadCompactionTenantSeriesThreshold {
+		n, err := strconv.ParseUint(threshold, 10, 64)
+		if err != nil {
+			return errors.Wrapf(err, "parse early head compaction series threshold of tenant %s", tenant)
+		}
+		tenantSeriesThresholds[tenant] = n
+	}
+	tenantWALCheckpointIntervals := make(map[string]time.Duration, len(conf.tsdbWALCheckpointTenantInterval))
+	for tenant, interval := range conf.tsdbWALCheckpointTenantInterval {
+		d, err := model.ParseDuration(interval)
+		if err != nil {
+			return errors.Wrapf(err, "parse WAL checkpoint interval of tenant %s", tenant)
+		}
+		tenantWALCheckpointIntervals[tenant] = time.Duration(d)
+	}
+	earlyHeadCompactionOpts := receive.EarlyHeadCompactionOptions{
+		SeriesThreshold:              conf.tsdbEarlyHeadCompactionSeriesThreshold,
+		TenantSeriesThresholds:       tenantSeriesThresholds,
+		KeepDuration:                 conf.tsdbEarlyHeadCompactionKeepDuration,
+		WALCheckpointInterval:        time.Duration(*conf.tsdbWALCheckpointInterval),
+		TenantWALCheckpointIntervals: tenantWALCheckpointIntervals,
+	}
+	if err := earlyHeadCompactionOpts.Validate(); err != nil {
+		return errors.Wrap(err, "validate --tsdb.wal-checkpoint.interval")
+	}
+
 	dbs := receive.NewMultiTSDB(
 		conf.dataDir,
 		logger,
@@ -215,10 +281,22 @@ func runReceive(
 		bkt,
 		conf.allowOutOfOrderUpload,
 		hashFunc,
+		receive.WithTenantQuarantine(receive.TenantQuarantineOptions{
+			ErrorThreshold: conf.tenantQuarantineErrorThreshold,
+			Window:         conf.tenantQuarantineWindow,
+			Cooldown:       conf.tenantQuarantineCooldown,
+		}),
+		receive.WithEarlyHeadCompaction(earlyHeadCompactionOpts),
+		receive.WithIdleTenantEviction(time.Duration(*conf.tsdbIdleTenantTTL)),
+		receive.WithMetricMetadata(receive.MetricMetadataOptions{Limit: conf.metadataLimit, TTL: conf.metadataTTL}),
+		receive.WithBlockEvents(blockEvents),
 	)
 	writer := receive.NewWriter(log.With(logger, "component", "receive-writer"), dbs, &receive.WriterOptions{
 		Intern:                   conf.writerInterning,
 		TooFarInFutureTimeWindow: int64(time.Duration(*conf.tsdbTooFarInFutureTimeWindow)),
+		TooFarInPastTimeWindow:   int64(time.Duration(*conf.tsdbTooFarInPastTimeWindow)),
+		TimestampBoundsAction:    receive.TimestampBoundsAction(conf.tsdbTimestampBoundsAction),
+		Registerer:               reg,
 	})
 
 	var limitsConfig *receive.RootLimitsConfig
@@ -236,8 +314,11 @@ func runReceive(
 	if err != nil {
 		return errors.Wrap(err, "creating limiter")
 	}
+	if enableIngestion {
+		limiter.SetLocalHeadSeries(dbs)
+	}
 
-	webHandler := receive.NewHandler(log.With(logger, "component", "receive-handler"), &receive.Options{
+	handlerOpts := &receive.Options{
 		Writer:               writer,
 		ListenAddress:        conf.rwAddress,
 		Registry:             reg,
@@ -258,8 +339,60 @@ func runReceive(
 		TSDBStats:            dbs,
 		Limiter:              limiter,
 
-		AsyncForwardWorkerCount: conf.asyncForwardWorkerCount,
-	})
+		AsyncForwardWorkerCount:   conf.asyncForwardWorkerCount,
+		ForwardConnectionsPerPeer: conf.forwardConnsPerPeer,
+		ForwardIdleTimeout:        conf.forwardIdleTimeout,
+
+		RemoteReadSampleLimit:      conf.remoteReadSampleLimit,
+		RemoteReadConcurrencyLimit: conf.remoteReadConcurrencyLimit,
+		RemoteReadMaxBytesInFrame:  conf.remoteReadMaxBytesInFrame,
+
+		SeriesValidator: seriesValidator,
+	}
+	if conf.metadataLimit > 0 {
+		handlerOpts.MetadataAppender = dbs
+	}
+	if conf.backpressureMaxDelay > 0 {
+		handlerOpts.Backpressure = &receive.BackpressureOptions{
+			MaxDelay:  conf.backpressureMaxDelay,
+			Threshold: conf.backpressureThreshold,
+		}
+		if enableIngestion {
+			handlerOpts.Backpressure.CompactionLag = dbs
+		}
+	}
+	if enableIngestion {
+		handlerOpts.TenantReader = dbs
+	}
+	if conf.blockUploadEnabled {
+		handlerOpts.BlockUploader = dbs
+		handlerOpts.BlockUpload = receive.BlockUploadOptions{
+			MaxFileSize:  int64(conf.blockUploadMaxFileSize),
+			MaxBlockSize: int64(conf.blockUploadMaxBlockSize),
+		}
+		if conf.blockUploadBearerTokenFile != "" {
+			if handlerOpts.BlockUpload.BearerToken, err = readBearerTokenFile(conf.blockUploadBearerTokenFile); err != nil {
+				return errors.Wrap(err, "block upload")
+			}
+		}
+	}
+	var tenantOverrides *receive.TenantOverrides
+	if conf.tenantOverridesFile != "" {
+		tenantOverrides, err = receive.LoadTenantOverrides(conf.tenantOverridesFile)
+		if err != nil {
+			return err
+		}
+		handlerOpts.TenantOverrides = tenantOverrides
+		if conf.tenantOverridesBearerTokenFile != "" {
+			if handlerOpts.TenantOverridesBearerToken, err = readBearerTokenFile(conf.tenantOverridesBearerTokenFile); err != nil {
+				return errors.Wrap(err, "tenant overrides")
+			}
+		}
+		if enableIngestion {
+			handlerOpts.TenantDrainer = dbs
+		}
+	}
+	webHandler := receive.NewHandler(log.With(logger, "component", "receive-handler"), handlerOpts)
 
 	grpcProbe := prober.NewGRPC()
 	httpProbe := prober.NewHTTP()
@@ -283,7 +416,7 @@ func runReceive(
 
 		level.Debug(logger).Log("msg", "setting up TSDB")
 		{
-			if err := startTSDBAndUpload(g, logger, reg, dbs, uploadC, hashringChangedChan, upload, uploadDone, statusProber, bkt, receive.HashringAlgorithm(conf.hashringsAlgorithm)); err != nil {
+			if err := startTSDBAndUpload(g, logger, reg, dbs, uploadC, hashringChangedChan, upload, uploadDone, statusProber, bkt, blockEvents, receive.HashringAlgorithm(conf.hashringsAlgorithm)); err != nil {
 				return err
 			}
 		}
@@ -291,7 +424,7 @@ func runReceive(
 
 	level.Debug(logger).Log("msg", "setting up hashring")
 	{
-		if err := setupHashring(g, logger, reg, conf, hashringChangedChan, webHandler, statusProber, enableIngestion, dbs); err != nil {
+		if err := setupHashring(g, logger, reg, conf, hashringChangedChan, webHandler, statusProber, enableIngestion, dbs, tenantOverrides); err != nil {
 			return err
 		}
 	}
@@ -341,8 +474,7 @@ func runReceive(
 			WriteableStoreServer: webHandler,
 		}
 
-		infoSrv := info.NewInfoServer(
-			component.Receive.String(),
+		infoOpts := []info.ServerOptionFunc{
 			info.WithLabelSetFunc(func() []*labelpb.LabelSet { return proxy.LabelSet() }),
 			info.WithStoreInfoFunc(func() (*infopb.StoreInfo, error) {
 				if httpProbe.IsReady() {
@@ -358,18 +490,24 @@ func runReceive(
 				return nil, errors.New("Not ready")
 			}),
 			info.WithExemplarsInfoFunc(),
-		)
-
-		srv := grpcserver.New(logger, receive.NewUnRegisterer(reg), tracer, grpcLogOpts, logFilterMethods, comp, grpcProbe,
+		}
+		grpcOpts := []grpcserver.Option{
 			grpcserver.WithServer(store.RegisterStoreServer(rw, logger)),
 			grpcserver.WithServer(store.RegisterWritableStoreServer(rw)),
 			grpcserver.WithServer(exemplars.RegisterExemplarsServer(exemplars.NewMultiTSDB(dbs.TSDBExemplars))),
-			grpcserver.WithServer(info.RegisterInfoServer(infoSrv)),
 			grpcserver.WithListen(conf.grpcConfig.bindAddress),
 			grpcserver.WithGracePeriod(conf.grpcConfig.gracePeriod),
 			grpcserver.WithMaxConnAge(conf.grpcConfig.maxConnectionAge),
 			grpcserver.WithTLSConfig(tlsCfg),
-		)
+		}
+		if conf.metadataLimit > 0 {
+			infoOpts = append(infoOpts, info.WithMetricMetadataInfoFunc())
+			grpcOpts = append(grpcOpts, grpcserver.WithServer(meta.RegisterMetadataServer(meta.NewMultiTSDB(dbs.MetricMetadata))))
+		}
+		infoSrv := info.NewInfoServer(component.Receive.String(), infoOpts...)
+		grpcOpts = append(grpcOpts, grpcserver.WithServer(info.RegisterInfoServer(infoSrv)))
+
+		srv := grpcserver.New(logger, receive.NewUnRegisterer(reg), tracer, grpcLogOpts, logFilterMethods, comp, grpcProbe, grpcOpts...)
 
 		g.Add(
 			func() error {
@@ -436,6 +574,21 @@ func runReceive(
 		})
 	}
 
+	if earlyHeadCompactionOpts.Enabled() {
+		level.Debug(logger).Log("msg", "setting up periodic early head compaction")
+		ctx, cancel := context.WithCancel(context.Background())
+		g.Add(func() error {
+			return runutil.Repeat(time.Minute, ctx.Done(), func() error {
+				if err := dbs.CompactHeadsEarly(ctx); err != nil {
+					level.Error(logger).Log("msg", "early head compaction failed", "err", err)
+				}
+				return nil
+			})
+		}, func(err error) {
+			cancel()
+		})
+	}
+
 	{
 		if limiter.CanReload() {
 			ctx, cancel := context.WithCancel(context.Background())
@@ -467,6 +620,7 @@ func setupHashring(g *run.Group,
 	statusProber prober.Probe,
 	enableIngestion bool,
 	dbs *receive.MultiTSDB,
+	tenantOverrides *receive.TenantOverrides,
 ) error {
 	// Note: the hashring configuration watcher
 	// is the sender and thus closes the chan.
@@ -534,17 +688,22 @@ func setupHashring(g *run.Group,
 					return nil
 				}
 
+				var h receive.Hashring
 				if c == nil {
-					webHandler.Hashring(receive.SingleNodeHashring(conf.endpoint))
+					h = receive.SingleNodeHashring(conf.endpoint)
 					level.Info(logger).Log("msg", "Empty hashring config. Set up single node hashring.")
 				} else {
-					h, err := receive.NewMultiHashring(algorithm, conf.replicationFactor, c)
+					var err error
+					h, err = receive.NewMultiHashring(algorithm, conf.replicationFactor, c)
 					if err != nil {
 						return errors.Wrap(err, "unable to create new hashring from config")
 					}
-					webHandler.Hashring(h)
 					level.Info(logger).Log("msg", "Set up hashring for the given hashring config.")
 				}
+				if tenantOverrides != nil {
+					h = tenantOverrides.Hashring(h)
+				}
+				webHandler.Hashring(h)
 
 				if err := dbs.SetHashringConfig(c); err != nil {
 					return errors.Wrap(err, "failed to set hashring config in MultiTSDB")
@@ -580,6 +739,7 @@ func startTSDBAndUpload(g *run.Group,
 	uploadDone chan struct{},
 	statusProber prober.Probe,
 	bkt objstore.Bucket,
+	blockEvents lifecycle.Notifier,
 	hashringAlgorithm receive.HashringAlgorithm,
 ) error {
 
@@ -693,6 +853,8 @@ func startTSDBAndUpload(g *run.Group,
 				defer func() {
 					runutil.CloseWithLogOnErr(logger, bkt, "bucket client")
 				}()
+				// Send the events of the blocks uploaded before quitting.
+				defer runutil.CloseWithLogOnErr(logger, blockEvents, "block events")
 
 				// Before quitting, ensure all blocks are uploaded.
 				defer func() {
@@ -740,6 +902,19 @@ func startTSDBAndUpload(g *run.Group,
 	return nil
 }
 
+// readBearerTokenFile returns the bearer token stored in the file at the given path.
+func readBearerTokenFile(path string) (string, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return "", errors.Wrap(err, "read bearer token file")
+	}
+	token := strings.TrimSpace(string(b))
+	if token == "" {
+		return "", errors.Errorf("bearer token file %s is empty", path)
+	}
+	return token, nil
+}
+
 func migrateLegacyStorage(logger log.Logger, dataDir, defaultTenantID string) error {
 	defaultTenantDataDir := path.Join(dataDir, defaultTenantID)
 
@@ -797,6 +972,7 @@ type receiveConfig struct {
 	labelStrs []string
 
 	objStoreConfig *extflag.PathOrContent
+	blockEvents    *extflag.PathOrContent
 	retention      *model.Duration
 
 	hashringsFilePath    string
@@ -818,6 +994,8 @@ type receiveConfig struct {
 	tsdbMinBlockDuration         *model.Duration
 	tsdbMaxBlockDuration         *model.Duration
 	tsdbTooFarInFutureTimeWindow *model.Duration
+	tsdbTooFarInPastTimeWindow   *model.Duration
+	tsdbTimestampBoundsAction    string
 	tsdbOutOfOrderTimeWindow     *model.Duration
 	tsdbOutOfOrderCapMax         int64
 	tsdbAllowOverlappingBlocks   bool
@@ -827,7 +1005,15 @@ type receiveConfig struct {
 	tsdbMemorySnapshotOnShutdown bool
 	tsdbEnableNativeHistograms   bool
 
+	tsdbEarlyHeadCompactionSeriesThreshold       uint64
+	tsdbEarlyHeadCompactionTenantSeriesThreshold map[string]string
+	tsdbEarlyHeadCompactionKeepDuration          time.Duration
+	tsdbWALCheckpointInterval                    *model.Duration
+	tsdbWALCheckpointTenantInterval              map[string]string
+	tsdbIdleTenantTTL                            *model.Duration
+
 	walCompression       bool
+	walCompressionType   string
 	noLockFile           bool
 	writerInterning      bool
 	splitTenantLabelName string
@@ -837,14 +1023,39 @@ type receiveConfig struct {
 	ignoreBlockSize       bool
 	allowOutOfOrderUpload bool
 
-	reqLogConfig      *extflag.PathOrContent
-	relabelConfigPath *extflag.PathOrContent
+	reqLogConfig         *extflag.PathOrContent
+	relabelConfigPath    *extflag.PathOrContent
+	validationConfigPath *extflag.PathOrContent
 
 	writeLimitsConfig       *extflag.PathOrContent
 	storeRateLimits         store.SeriesSelectLimits
 	limitsConfigReloadTimer time.Duration
 
+	tenantQuarantineErrorThreshold int
+	tenantQuarantineWindow         time.Duration
+	tenantQuarantineCooldown       time.Duration
+
+	metadataLimit int
+	metadataTTL   time.Duration
+
+	backpressureMaxDelay  time.Duration
+	backpressureThreshold float64
+
+	blockUploadEnabled         bool
+	blockUploadBearerTokenFile string
+	blockUploadMaxFileSize     units.Base2Bytes
+	blockUploadMaxBlockSize    units.Base2Bytes
+
+	tenantOverridesFile            string
+	tenantOverridesBearerTokenFile string
+
 	asyncForwardWorkerCount uint
+	forwardConnsPerPeer     int
+	forwardIdleTimeout      time.Duration
+
+	remoteReadSampleLimit      int
+	remoteReadConcurrencyLimit int
+	remoteReadMaxBytesInFrame  int
 }
 
 func (rc *receiveConfig) registerFlag(cmd extkingpin.FlagClause) {
@@ -879,6 +1090,7 @@ func (rc *receiveConfig) registerFlag(cmd extkingpin.FlagClause) {
 	cmd.Flag("label", "External labels to announce. This flag will be removed in the future when handling multiple tsdb instances is added.").PlaceHolder("key=\"value\"").StringsVar(&rc.labelStrs)
 
 	rc.objStoreConfig = extkingpin.RegisterCommonObjStoreFlags(cmd, "", false)
+	rc.blockEvents = registerBlockEventsFlag(cmd)
 
 	rc.retention = extkingpin.ModelDuration(cmd.Flag("tsdb.retention", "How long to retain raw samples on local storage. 0d - disables the retention policy (i.e. infinite retention). For more details on how retention is enforced for individual tenants, please refer to the Tenant lifecycle management section in the Receive documentation: https://thanos.io/tip/components/receive.md/#tenant-lifecycle-management").Default("15d"))
 
@@ -909,17 +1121,32 @@ func (rc *receiveConfig) registerFlag(cmd extkingpin.FlagClause) {
 	cmd.Flag("receive.replica-header", "HTTP header specifying the replica number of a write request.").Default(receive.DefaultReplicaHeader).StringVar(&rc.replicaHeader)
 
 	cmd.Flag("receive.forward.async-workers", "Number of concurrent workers processing forwarding of remote-write requests.").Default("5").UintVar(&rc.asyncForwardWorkerCount)
+	cmd.Flag("receive.forward.connections-per-peer", "Number of gRPC (HTTP/2) connections kept open to each peer for forwarding and replicating remote-write requests. Requests are multiplexed over these connections in a round-robin fashion. Increase it if a single connection per peer becomes a bottleneck under high load.").
+		Default("1").IntVar(&rc.forwardConnsPerPeer)
+	cmd.Flag("receive.forward.idle-timeout", "Duration after which a connection to a peer without any forwarded requests is closed. It is transparently reopened on the next request. 0 keeps connections open forever.").
+		Default("30m").DurationVar(&rc.forwardIdleTimeout)
 	compressionOptions := strings.Join([]string{snappy.Name, compressionNone}, ", ")
 	cmd.Flag("receive.grpc-compression", "Compression algorithm to use for gRPC requests to other receivers. Must be one of: "+compressionOptions).Default(snappy.Name).EnumVar(&rc.compression, snappy.Name, compressionNone)
 
 	cmd.Flag("receive.replication-factor", "How many times to replicate incoming write requests.").Default("1").Uint64Var(&rc.replicationFactor)
 
+	cmd.Flag("receive.remote-read.sample-limit", "Maximum number of samples to return via the remote read endpoint, in a single non-streamed query. 0 means no limit. Streamed responses are limited by the frame size instead.").
+		Default("50000000").IntVar(&rc.remoteReadSampleLimit)
+
+	cmd.Flag("receive.remote-read.concurrent-limit", "Maximum number of concurrent remote read requests served from the local TSDBs. Must be greater than 0.").
+		Default("10").IntVar(&rc.remoteReadConcurrencyLimit)
+
+	cmd.Flag("receive.remote-read.max-bytes-in-frame", "Maximum number of bytes in a single frame of streamed remote read responses. Note that client might have limit on frame size as well.").
+		Default("1048576").IntVar(&rc.remoteReadMaxBytesInFrame)
+
 	rc.forwardTimeout = extkingpin.ModelDuration(cmd.Flag("receive-forward-timeout", "Timeout for each forward request.").Default("5s").Hidden())
 
 	rc.maxBackoff = extkingpin.ModelDuration(cmd.Flag("receive-forward-max-backoff", "Maximum backoff for each forward fan-out request").Default("5s").Hidden())
 
 	rc.relabelConfigPath = extflag.RegisterPathOrContent(cmd, "receive.relabel-config", "YAML file that contains relabeling configuration.", extflag.WithEnvSubstitution())
 
+	rc.validationConfigPath = extflag.RegisterPathOrContent(cmd, "receive.validation-config", "YAML file that contains the validation rules series of tenants must follow, e.g. allowed metric names or required labels. Series violating them are dropped after relabeling, and the write request fails with 400 once the other series are written.", extflag.WithEnvSubstitution())
+
 	rc.tsdbMinBlockDuration = extkingpin.ModelDuration(cmd.Flag("tsdb.min-block-duration", "Min duration for local TSDB blocks").Default("2h").Hidden())
 
 	rc.tsdbMaxBlockDuration = extkingpin.ModelDuration(cmd.Flag("tsdb.max-block-duration", "Max duration for local TSDB blocks").Default("2h").Hidden())
@@ -929,6 +1156,15 @@ func (rc *receiveConfig) registerFlag(cmd extkingpin.FlagClause) {
 			"Please note enable this flag will reject samples in the future of receive local NTP time + configured duration due to clock skew in remote write clients.",
 	).Default("0s"))
 
+	rc.tsdbTooFarInPastTimeWindow = extkingpin.ModelDuration(cmd.Flag("tsdb.too-far-in-past.time-window",
+		"Configures the allowed time window for ingesting samples too far in the past of receive local NTP time, e.g. of remote write clients with clocks lagging behind. Disabled (0s) by default.",
+	).Default("0s"))
+
+	cmd.Flag("tsdb.timestamp-bounds.action",
+		"Action taken on samples too far in the future or the past, see --tsdb.too-far-in-future.time-window and --tsdb.too-far-in-past.time-window. "+
+			"'reject' rejects them as out of bounds, 'clamp' ingests them at the timestamp of the bound they exceed instead.",
+	).Default(string(receive.TimestampBoundsReject)).EnumVar(&rc.tsdbTimestampBoundsAction, string(receive.TimestampBoundsReject), string(receive.TimestampBoundsClamp))
+
 	rc.tsdbOutOfOrderTimeWindow = extkingpin.ModelDuration(cmd.Flag("tsdb.out-of-order.time-window",
 		"[EXPERIMENTAL] Configures the allowed time window for ingestion of out-of-order samples. Disabled (0s) by default"+
 			"Please note if you enable this option and you use compactor, make sure you have the --enable-vertical-compaction flag enabled, otherwise you might risk compactor halt.",
@@ -944,6 +1180,9 @@ func (rc *receiveConfig) registerFlag(cmd extkingpin.FlagClause) {
 
 	cmd.Flag("tsdb.wal-compression", "Compress the tsdb WAL.").Default("true").BoolVar(&rc.walCompression)
 
+	cmd.Flag("tsdb.wal-compression-type", "Compression algorithm of the tsdb WAL of every tenant, used if --tsdb.wal-compression is enabled. Changing it does not prevent replaying WAL segments written with another algorithm.").
+		Default(string(wlog.CompressionSnappy)).EnumVar(&rc.walCompressionType, string(wlog.CompressionSnappy), string(wlog.CompressionZstd))
+
 	cmd.Flag("tsdb.no-lockfile", "Do not create lockfile in TSDB data directory. In any case, the lockfiles will be deleted on next startup.").Default("false").BoolVar(&rc.noLockFile)
 
 	cmd.Flag("tsdb.max-exemplars",
@@ -965,6 +1204,28 @@ func (rc *receiveConfig) registerFlag(cmd extkingpin.FlagClause) {
 		"[EXPERIMENTAL] Enables the ingestion of native histograms.").
 		Default("false").Hidden().BoolVar(&rc.tsdbEnableNativeHistograms)
 
+	cmd.Flag("tsdb.early-head-compaction.series-threshold",
+		"Number of head series of a tenant above which its head is compacted before it spans a block range, bounding the memory used by high cardinality tenants. "+
+			"Only the head data older than --tsdb.early-head-compaction.keep-duration is compacted, into blocks aligned to the block range. 0 disables early head compaction.").
+		Default("0").Uint64Var(&rc.tsdbEarlyHeadCompactionSeriesThreshold)
+	cmd.Flag("tsdb.early-head-compaction.tenant-series-threshold",
+		"Overrides --tsdb.early-head-compaction.series-threshold for a tenant. 0 disables early head compaction for the tenant. Can be repeated.").
+		PlaceHolder("<tenant>=<series>").StringMapVar(&rc.tsdbEarlyHeadCompactionTenantSeriesThreshold)
+	cmd.Flag("tsdb.early-head-compaction.keep-duration",
+		"Duration of the most recent data kept in the head on early head compaction, within which late samples are still accepted. It is also the minimum duration of the blocks compacted early.").
+		Default("15m").DurationVar(&rc.tsdbEarlyHeadCompactionKeepDuration)
+	rc.tsdbWALCheckpointInterval = extkingpin.ModelDuration(cmd.Flag("tsdb.wal-checkpoint.interval",
+		"Duration of head data older than --tsdb.early-head-compaction.keep-duration from which on the head of a tenant is compacted early, which checkpoints its WAL. "+
+			"It bounds the WAL replayed after a crash to about the keep duration plus this interval of data, at the cost of more disk I/O and smaller blocks. It must be at least the keep duration. 0 only checkpoints the WAL on the regular head compactions.").
+		Default("0s"))
+	cmd.Flag("tsdb.wal-checkpoint.tenant-interval",
+		"Overrides --tsdb.wal-checkpoint.interval for a tenant. 0 disables the early WAL checkpoints of the tenant. Can be repeated.").
+		PlaceHolder("<tenant>=<duration>").StringMapVar(&rc.tsdbWALCheckpointTenantInterval)
+	rc.tsdbIdleTenantTTL = extkingpin.ModelDuration(cmd.Flag("tsdb.idle-tenant-ttl",
+		"Duration without any write after which the TSDB of a tenant is evicted by the periodic tenant pruning: its head is flushed and shipped, then the TSDB is closed and removed from disk. "+
+			"The next write of the tenant opens a new TSDB. Only used with object storage. 0 disables it.").
+		Default("0s"))
+
 	cmd.Flag("writer.intern",
 		"[EXPERIMENTAL] Enables string interning in receive writer, for more optimized memory usage.").
 		Default("false").Hidden().BoolVar(&rc.writerInterning)
@@ -985,6 +1246,38 @@ func (rc *receiveConfig) registerFlag(cmd extkingpin.FlagClause) {
 	rc.writeLimitsConfig = extflag.RegisterPathOrContent(cmd, "receive.limits-config", "YAML file that contains limit configuration.", extflag.WithEnvSubstitution(), extflag.WithHidden())
 	cmd.Flag("receive.limits-config-reload-timer", "Minimum amount of time to pass for the limit configuration to be reloaded. Helps to avoid excessive reloads.").
 		Default("1s").Hidden().DurationVar(&rc.limitsConfigReloadTimer)
+
+	cmd.Flag("receive.tenant-quarantine.error-threshold", "Number of TSDB errors of a tenant, i.e. write requests failing with errors other than out of order, duplicate or out of bounds samples, and failed head compactions, within --receive.tenant-quarantine.window after which the tenant is quarantined: its writes are rejected with 503 and its head compaction is stopped until --receive.tenant-quarantine.cooldown passed. 0 disables quarantine.").
+		Default("0").IntVar(&rc.tenantQuarantineErrorThreshold)
+	cmd.Flag("receive.tenant-quarantine.window", "Window within which TSDB errors of a tenant are counted to quarantine it.").
+		Default("1m").DurationVar(&rc.tenantQuarantineWindow)
+	cmd.Flag("receive.tenant-quarantine.cooldown", "How long a tenant stays quarantined.").
+		Default("5m").DurationVar(&rc.tenantQuarantineCooldown)
+
+	cmd.Flag("receive.metadata.limit", "Maximum number of metric metadata entries stored per tenant from the metadata of remote write requests, and served by the metadata API. Metadata is kept in memory and is not forwarded to other receivers. 0 disables storing metadata.").
+		Default("0").IntVar(&rc.metadataLimit)
+	cmd.Flag("receive.metadata.ttl", "Duration after which the metadata of a metric is removed if it was not received again.").
+		Default("10m").DurationVar(&rc.metadataTTL)
+
+	cmd.Flag("receive.backpressure.max-delay", "Delay advised to clients at full pressure on the write path, with the "+receive.BackpressureDelayHeader+" response header, along with the cause of the pressure in the "+receive.BackpressureHeader+" header. "+
+		"Pressure is estimated from the number of write requests queued behind the max_concurrency write limit and from the compaction lag of the local TSDBs, and advised delays are proportional to it. Hints are advisory, clients may ignore them. 0 disables hints.").
+		Default("0s").DurationVar(&rc.backpressureMaxDelay)
+	cmd.Flag("receive.backpressure.threshold", "Pressure on the write path, between 0 and 1, from which responses advise clients to slow down.").
+		Default("0.5").FloatVar(&rc.backpressureThreshold)
+
+	cmd.Flag("receive.block-upload.enabled", "[EXPERIMENTAL] Enables the HTTP API to upload TSDB blocks into the local storage of tenants, e.g. to backfill historical data. Uploaded blocks are validated and shipped to object storage like the blocks of the tenants' TSDBs. Requires ingestion and object storage.").
+		Default("false").BoolVar(&rc.blockUploadEnabled)
+	cmd.Flag("receive.block-upload.bearer-token-file", "[EXPERIMENTAL] Path to the file containing the bearer token which block upload requests must carry in their Authorization header. Either it or --remote-write.server-tls-client-ca is required to enable block upload.").
+		PlaceHolder("<path>").StringVar(&rc.blockUploadBearerTokenFile)
+	cmd.Flag("receive.block-upload.max-file-size", "[EXPERIMENTAL] Maximum size of a single uploaded block file. 0 means no limit.").
+		Default("1GiB").BytesVar(&rc.blockUploadMaxFileSize)
+	cmd.Flag("receive.block-upload.max-block-size", "[EXPERIMENTAL] Maximum size of the index and chunk files of an uploaded block. 0 means no limit.").
+		Default("16GiB").BytesVar(&rc.blockUploadMaxBlockSize)
+
+	cmd.Flag("receive.tenant-overrides-file", "[EXPERIMENTAL] Path to the file persisting tenant overrides, which route the writes of tenants to given nodes regardless of the hashring configuration. Enables the HTTP API moving tenants to other nodes. The file is created if it does not exist.").
+		PlaceHolder("<path>").StringVar(&rc.tenantOverridesFile)
+	cmd.Flag("receive.tenant-overrides.bearer-token-file", "[EXPERIMENTAL] Path to the file containing the bearer token which requests to the tenant overrides API must carry in their Authorization header. Either it or --remote-write.server-tls-client-ca is required to enable tenant overrides.").
+		PlaceHolder("<path>").StringVar(&rc.tenantOverridesBearerTokenFile)
 }
 
 // determineMode returns the ReceiverMode that this receiver is configured to run in.
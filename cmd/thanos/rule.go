@@ -43,7 +43,6 @@ import (
 	"gopkg.in/yaml.v2"
 
 	"github.com/thanos-io/objstore"
-	"github.com/thanos-io/objstore/client"
 	objstoretracing "github.com/thanos-io/objstore/tracing/opentracing"
 	"github.com/thanos-io/promql-engine/execution/parse"
 
@@ -57,6 +56,7 @@ import (
 	"github.com/thanos-io/thanos/pkg/extannotations"
 	"github.com/thanos-io/thanos/pkg/extgrpc"
 	"github.com/thanos-io/thanos/pkg/extkingpin"
+	"github.com/thanos-io/thanos/pkg/extobjstore"
 	"github.com/thanos-io/thanos/pkg/extprom"
 	extpromhttp "github.com/thanos-io/thanos/pkg/extprom/http"
 	"github.com/thanos-io/thanos/pkg/extpromql"
@@ -102,6 +102,7 @@ type ruleConfig struct {
 	evalInterval      time.Duration
 	outageTolerance   time.Duration
 	forGracePeriod    time.Duration
+	maxConcurrentEval int64
 	ruleFiles         []string
 	objStoreConfig    *extflag.PathOrContent
 	dataDir           string
@@ -154,6 +155,8 @@ func registerRule(app *extkingpin.App) {
 		Default("1h").DurationVar(&conf.outageTolerance)
 	cmd.Flag("for-grace-period", "Minimum duration between alert and restored \"for\" state. This is maintained only for alerts with configured \"for\" time greater than grace period.").
 		Default("10m").DurationVar(&conf.forGracePeriod)
+	cmd.Flag("eval-concurrency", "Maximum number of rules evaluated concurrently, in addition to the sequential evaluation of each rule group. Rule groups are always evaluated independently of each other. Within a group, only rules which neither depend on nor are depended on by other rules of the group are evaluated concurrently, so dependent rules are still evaluated in order. The limit is shared across all rule groups. 0 disables concurrent rule evaluation.").
+		Default("0").Int64Var(&conf.maxConcurrentEval)
 	cmd.Flag("restore-ignored-label", "Label names to be ignored when restoring alerts from the remote storage. This is only used in stateless mode.").
 		StringsVar(&conf.ignoredLabelNames)
 
@@ -164,6 +167,11 @@ func registerRule(app *extkingpin.App) {
 
 	conf.rwConfig = extflag.RegisterPathOrContent(cmd, "remote-write.config", "YAML config for the remote-write configurations, that specify servers where samples should be sent to (see https://prometheus.io/docs/prometheus/latest/configuration/configuration/#remote_write). This automatically enables stateless mode for ruler and no series will be stored in the ruler's TSDB. If an empty config (or file) is provided, the flag is ignored and ruler is run with its own TSDB.", extflag.WithEnvSubstitution())
 
+	rwWALMaxTime := extkingpin.ModelDuration(cmd.Flag("remote-write.wal-max-time", "Maximum time rule evaluation results are kept in the WAL in stateless mode. Results not sent to the remote write endpoints within this time are dropped, so the buffer stays bounded while an endpoint is down. Rule evaluation never waits for remote write.").
+		Default("4h"))
+	rwWALTruncateFrequency := extkingpin.ModelDuration(cmd.Flag("remote-write.wal-truncate-frequency", "How often the WAL is truncated in stateless mode. Must not be greater than --remote-write.wal-max-time.").
+		Default("2h"))
+
 	conf.objStoreConfig = extkingpin.RegisterCommonObjStoreFlags(cmd, "", false)
 
 	reqLogConfig := extkingpin.RegisterRequestLoggingFlags(cmd)
@@ -188,9 +196,14 @@ func registerRule(app *extkingpin.App) {
 			WALCompression:    wlog.ParseCompressionType(*walCompression, string(wlog.CompressionSnappy)),
 		}
 
+		if *rwWALTruncateFrequency > *rwWALMaxTime {
+			return errors.Errorf("--remote-write.wal-truncate-frequency (%s) must not be greater than --remote-write.wal-max-time (%s)", *rwWALTruncateFrequency, *rwWALMaxTime)
+		}
 		agentOpts := &agent.Options{
-			WALCompression: wlog.ParseCompressionType(*walCompression, string(wlog.CompressionSnappy)),
-			NoLockfile:     *noLockFile,
+			WALCompression:    wlog.ParseCompressionType(*walCompression, string(wlog.CompressionSnappy)),
+			NoLockfile:        *noLockFile,
+			TruncateFrequency: time.Duration(*rwWALTruncateFrequency),
+			MaxWALTime:        int64(time.Duration(*rwWALMaxTime) / time.Millisecond),
 		}
 
 		// Parse and check query configuration.
@@ -248,7 +261,7 @@ func registerRule(app *extkingpin.App) {
 			comp,
 			*conf,
 			reload,
-			getFlagsMap(cmd.Flags()),
+			extkingpin.FlagsMap(cmd.Flags()),
 			httpLogOpts,
 			grpcLogOpts,
 			logFilterMethods,
@@ -439,6 +452,7 @@ func runRule(
 			nil,
 			nil,
 			dialOpts,
+			nil,
 			5*time.Minute,
 			5*time.Second,
 		)
@@ -639,6 +653,9 @@ func runRule(
 				ResendDelay:     conf.resendDelay,
 				OutageTolerance: conf.outageTolerance,
 				ForGracePeriod:  conf.forGracePeriod,
+
+				ConcurrentEvalsEnabled: conf.maxConcurrentEval > 0,
+				MaxConcurrentEvals:     conf.maxConcurrentEval,
 			},
 			queryFuncCreator(logger, queryClients, promClients, grpcEndpointSet, metrics.duplicatedQuery, metrics.ruleEvalWarnings, conf.query.httpMethod, conf.query.doNotAddThanosParams),
 			conf.lset,
@@ -834,7 +851,7 @@ func runRule(
 	if len(confContentYaml) > 0 {
 		// The background shipper continuously scans the data directory and uploads
 		// new blocks to Google Cloud Storage or an S3-compatible storage service.
-		bkt, err := client.NewBucket(logger, confContentYaml, component.Rule.String())
+		bkt, err := extobjstore.NewBucket(logger, reg, confContentYaml, component.Rule.String())
 		if err != nil {
 			return err
 		}
@@ -847,12 +864,19 @@ func runRule(
 			}
 		}()
 
+		blockEvents, err := newBlockEvents(logger, reg, conf.shipper.blockEvents, component.Rule)
+		if err != nil {
+			return err
+		}
+
 		s := shipper.New(logger, reg, conf.dataDir, bkt, func() labels.Labels { return conf.lset }, metadata.RulerSource, nil, conf.shipper.allowOutOfOrderUpload, metadata.HashFunc(conf.shipper.hashFunc), conf.shipper.metaFileName)
+		s.SetBlockEvents(blockEvents)
 
 		ctx, cancel := context.WithCancel(context.Background())
 
 		g.Add(func() error {
 			defer runutil.CloseWithLogOnErr(logger, bkt, "bucket client")
+			defer runutil.CloseWithLogOnErr(logger, blockEvents, "block events")
 
 			return runutil.Repeat(30*time.Second, ctx.Done(), func() error {
 				if _, err := s.Sync(ctx); err != nil {
@@ -25,7 +25,6 @@ import (
 	"github.com/prometheus/prometheus/model/labels"
 
 	"github.com/thanos-io/objstore"
-	"github.com/thanos-io/objstore/client"
 	objstoretracing "github.com/thanos-io/objstore/tracing/opentracing"
 
 	"github.com/thanos-io/thanos/pkg/block/metadata"
@@ -33,6 +32,7 @@ import (
 	"github.com/thanos-io/thanos/pkg/component"
 	"github.com/thanos-io/thanos/pkg/exemplars"
 	"github.com/thanos-io/thanos/pkg/extkingpin"
+	"github.com/thanos-io/thanos/pkg/extobjstore"
 	"github.com/thanos-io/thanos/pkg/extprom"
 	"github.com/thanos-io/thanos/pkg/info"
 	"github.com/thanos-io/thanos/pkg/info/infopb"
@@ -98,6 +98,11 @@ func registerSidecar(app *extkingpin.App) {
 			return fmt.Errorf("invalid reload method: %s", conf.reloader.method)
 		}
 
+		if conf.reloader.driftCheck {
+			opts.ConfigStatusURL = reloader.ConfigStatusURLFromBase(conf.prometheus.url)
+			opts.ConfigDriftTimeout = conf.reloader.driftTimeout
+		}
+
 		rl := reloader.New(log.With(logger, "component", "reloader"),
 			extprom.WrapRegistererWithPrefix("thanos_sidecar_", reg),
 			&opts)
@@ -127,6 +132,7 @@ func runSidecar(
 		maxt: math.MaxInt64,
 
 		limitMinTime: conf.limitMinTime,
+		limitMaxTime: conf.limitMaxTime,
 		client:       promclient.NewWithTracingClient(logger, httpClient, "thanos-sidecar"),
 	}
 
@@ -367,7 +373,7 @@ func runSidecar(
 	if uploads {
 		// The background shipper continuously scans the data directory and uploads
 		// new blocks to Google Cloud Storage or an S3-compatible storage service.
-		bkt, err := client.NewBucket(logger, confContentYaml, component.Sidecar.String())
+		bkt, err := extobjstore.NewBucket(logger, reg, confContentYaml, component.Sidecar.String())
 		if err != nil {
 			return err
 		}
@@ -384,9 +390,15 @@ func runSidecar(
 			level.Error(logger).Log("err", err)
 		}
 
+		blockEvents, err := newBlockEvents(logger, reg, conf.shipper.blockEvents, component.Sidecar)
+		if err != nil {
+			return err
+		}
+
 		ctx, cancel := context.WithCancel(context.Background())
 		g.Add(func() error {
 			defer runutil.CloseWithLogOnErr(logger, bkt, "bucket client")
+			defer runutil.CloseWithLogOnErr(logger, blockEvents, "block events")
 
 			promReadyTimeout := conf.prometheus.readyTimeout
 			extLabelsCtx, cancel := context.WithTimeout(ctx, promReadyTimeout)
@@ -404,6 +416,7 @@ func runSidecar(
 			uploadCompactedFunc := func() bool { return conf.shipper.uploadCompacted }
 			s := shipper.New(logger, reg, conf.tsdb.path, bkt, m.Labels, metadata.SidecarSource,
 				uploadCompactedFunc, conf.shipper.allowOutOfOrderUpload, metadata.HashFunc(conf.shipper.hashFunc), conf.shipper.metaFileName)
+			s.SetBlockEvents(blockEvents)
 
 			return runutil.Repeat(30*time.Second, ctx.Done(), func() error {
 				if uploaded, err := s.Sync(ctx); err != nil {
@@ -473,6 +486,8 @@ type promMetadata struct {
 	labels       labels.Labels
 	promVersion  string
 	limitMinTime thanosmodel.TimeOrDurationValue
+	// limitMaxTime is not set unless configured, in which case it bounds the advertised max time.
+	limitMaxTime thanosmodel.TimeOrDurationValue
 
 	client *promclient.Client
 }
@@ -513,7 +528,14 @@ func (s *promMetadata) Timestamps() (mint, maxt int64) {
 	s.mtx.Lock()
 	defer s.mtx.Unlock()
 
-	return s.mint, s.maxt
+	mint, maxt = s.mint, s.maxt
+	// Relative max time limits move with time, so they are evaluated on every call.
+	if s.limitMaxTime.Time != nil || s.limitMaxTime.Dur != nil {
+		if limit := s.limitMaxTime.PrometheusTimestamp(); limit < maxt {
+			maxt = limit
+		}
+	}
+	return mint, maxt
 }
 
 func (s *promMetadata) BuildVersion(ctx context.Context) error {
@@ -546,6 +568,7 @@ type sidecarConfig struct {
 	objStore        extflag.PathOrContent
 	shipper         shipperConfig
 	limitMinTime    thanosmodel.TimeOrDurationValue
+	limitMaxTime    thanosmodel.TimeOrDurationValue
 	storeRateLimits store.SeriesSelectLimits
 }
 
@@ -561,4 +584,6 @@ func (sc *sidecarConfig) registerFlag(cmd extkingpin.FlagClause) {
 	sc.storeRateLimits.RegisterFlags(cmd)
 	cmd.Flag("min-time", "Start of time range limit to serve. Thanos sidecar will serve only metrics, which happened later than this value. Option can be a constant time in RFC3339 format or time duration relative to current time, such as -1d or 2h45m. Valid duration units are ms, s, m, h, d, w, y.").
 		Default("0000-01-01T00:00:00Z").SetValue(&sc.limitMinTime)
+	cmd.Flag("max-time", "End of time range limit to serve. Thanos sidecar will serve only metrics, which happened earlier than this value. Option can be a constant time in RFC3339 format or time duration relative to current time, such as -1d or 2h45m. Valid duration units are ms, s, m, h, d, w, y. No limit by default.").
+		SetValue(&sc.limitMaxTime)
 }
@@ -0,0 +1,37 @@
+// Copyright (c) The Thanos Authors.
+// Licensed under the Apache License 2.0.
+
+package main
+
+import (
+	"math"
+	"testing"
+	"time"
+
+	"github.com/efficientgo/core/testutil"
+
+	thanosmodel "github.com/thanos-io/thanos/pkg/model"
+)
+
+func TestPromMetadata_Timestamps(t *testing.T) {
+	m := &promMetadata{}
+	testutil.Ok(t, m.limitMinTime.Set("0000-01-01T00:00:00Z"))
+	m.UpdateTimestamps(1000, math.MaxInt64)
+
+	// Without --max-time, the max time is not limited.
+	mint, maxt := m.Timestamps()
+	testutil.Equals(t, int64(1000), mint)
+	testutil.Equals(t, int64(math.MaxInt64), maxt)
+
+	testutil.Ok(t, m.limitMaxTime.Set("1970-01-01T00:00:05Z"))
+	mint, maxt = m.Timestamps()
+	testutil.Equals(t, int64(1000), mint)
+	testutil.Equals(t, int64(5000), maxt)
+
+	// Relative max times move with time.
+	m.limitMaxTime = thanosmodel.TimeOrDurationValue{}
+	testutil.Ok(t, m.limitMaxTime.Set("-1h"))
+	_, maxt = m.Timestamps()
+	expected := time.Now().Add(-time.Hour).UnixMilli()
+	testutil.Assert(t, maxt <= expected && maxt > expected-time.Minute.Milliseconds(), "unexpected max time %d, expected about %d", maxt, expected)
+}
@@ -21,9 +21,9 @@ import (
 	"github.com/prometheus/client_golang/prometheus"
 	commonmodel "github.com/prometheus/common/model"
 	"github.com/prometheus/common/route"
+	"github.com/prometheus/prometheus/model/labels"
 
 	"github.com/thanos-io/objstore"
-	"github.com/thanos-io/objstore/client"
 	objstoretracing "github.com/thanos-io/objstore/tracing/opentracing"
 
 	blocksAPI "github.com/thanos-io/thanos/pkg/api/blocks"
@@ -33,8 +33,10 @@ import (
 	"github.com/thanos-io/thanos/pkg/component"
 	hidden "github.com/thanos-io/thanos/pkg/extflag"
 	"github.com/thanos-io/thanos/pkg/extkingpin"
+	"github.com/thanos-io/thanos/pkg/extobjstore"
 	"github.com/thanos-io/thanos/pkg/extprom"
 	extpromhttp "github.com/thanos-io/thanos/pkg/extprom/http"
+	"github.com/thanos-io/thanos/pkg/extpromql"
 	"github.com/thanos-io/thanos/pkg/gate"
 	"github.com/thanos-io/thanos/pkg/info"
 	"github.com/thanos-io/thanos/pkg/info/infopb"
@@ -48,6 +50,7 @@ import (
 	"github.com/thanos-io/thanos/pkg/store"
 	storecache "github.com/thanos-io/thanos/pkg/store/cache"
 	"github.com/thanos-io/thanos/pkg/store/labelpb"
+	"github.com/thanos-io/thanos/pkg/store/storepb"
 	"github.com/thanos-io/thanos/pkg/tls"
 	"github.com/thanos-io/thanos/pkg/ui"
 )
@@ -73,12 +76,28 @@ type storeConfig struct {
 	httpConfig                  httpConfig
 	indexCacheSizeBytes         units.Base2Bytes
 	chunkPoolSize               units.Base2Bytes
+	chunkPoolMinSizeClass       units.Base2Bytes
+	chunkPoolMaxSizeClass       units.Base2Bytes
 	estimatedMaxSeriesSize      uint64
 	estimatedMaxChunkSize       uint64
 	seriesBatchSize             int
+	seriesResponseChunkBatch    int
+	chunkReadAheadMaxSize       units.Base2Bytes
+	maxBlocksPerQuery           int
 	storeRateLimits             store.SeriesSelectLimits
 	maxDownloadedBytes          units.Base2Bytes
+	inMemoryBlocksMaxAge        time.Duration
+	inMemoryBlocksMaxSize       units.Base2Bytes
+	postingsWarmupSelectors     []string
+	postingsWarmupMaxSize       units.Base2Bytes
+	readinessQueries            extflag.PathOrContent
+	readinessQueriesTimeout     time.Duration
+	caseInsensitiveExtLabels    []string
 	maxConcurrency              int
+	adaptiveConcurrency         bool
+	seriesPrioritization        bool
+	seriesPriorityMaxWait       commonmodel.Duration
+	memorySoftLimit             units.Base2Bytes
 	component                   component.StoreAPI
 	debugLogging                bool
 	syncInterval                time.Duration
@@ -89,6 +108,7 @@ type storeConfig struct {
 	selectorRelabelConf         extflag.PathOrContent
 	advertiseCompatibilityLabel bool
 	consistencyDelay            commonmodel.Duration
+	blockServeDelay             commonmodel.Duration
 	ignoreDeletionMarksDelay    commonmodel.Duration
 	disableWeb                  bool
 	webConfig                   webConfig
@@ -101,12 +121,16 @@ type storeConfig struct {
 	lazyExpandedPostingsEnabled bool
 
 	indexHeaderLazyDownloadStrategy string
+	indexHeaderMmapAdvice           string
+	indexHeaderProgressiveLoad      bool
 }
 
 func (sc *storeConfig) registerFlag(cmd extkingpin.FlagClause) {
 	sc.httpConfig = *sc.httpConfig.registerFlag(cmd)
 	sc.grpcConfig = *sc.grpcConfig.registerFlag(cmd)
 	sc.storeRateLimits.RegisterFlags(cmd)
+	cmd.Flag("store.limits.max-blocks-per-query", "The maximum number of blocks a single Series request can touch. The Series call fails with ResourceExhausted before reading any block if this limit is exceeded. 0 means no limit.").
+		Default("0").IntVar(&sc.maxBlocksPerQuery)
 
 	cmd.Flag("data-dir", "Local data directory used for caching purposes (index-header, in-mem cache items and meta.jsons). If removed, no data will be lost, just store will have to rebuild the cache. NOTE: Putting raw blocks here will not cause the store to read them. For such use cases use Prometheus + sidecar. Ignored if --no-cache-index-header option is specified.").
 		Default("./data").StringVar(&sc.dataDir)
@@ -130,6 +154,12 @@ func (sc *storeConfig) registerFlag(cmd extkingpin.FlagClause) {
 	cmd.Flag("chunk-pool-size", "Maximum size of concurrently allocatable bytes reserved strictly to reuse for chunks in memory.").
 		Default("2GB").BytesVar(&sc.chunkPoolSize)
 
+	cmd.Flag("chunk-pool.min-size-class", "Size of the smallest chunk pool size class. Size classes double from this value up to --chunk-pool.max-size-class; requests bigger than the largest class are allocated directly.").
+		Default("64KB").BytesVar(&sc.chunkPoolMinSizeClass)
+
+	cmd.Flag("chunk-pool.max-size-class", "Size of the largest chunk pool size class. Must not be lower than --chunk-pool.min-size-class.").
+		Default("64MB").BytesVar(&sc.chunkPoolMaxSizeClass)
+
 	cmd.Flag("store.grpc.touched-series-limit", "DEPRECATED: use store.limits.request-series.").Default("0").Uint64Var(&sc.storeRateLimits.SeriesPerRequest)
 	cmd.Flag("store.grpc.series-sample-limit", "DEPRECATED: use store.limits.request-samples.").Default("0").Uint64Var(&sc.storeRateLimits.SamplesPerRequest)
 
@@ -137,8 +167,41 @@ func (sc *storeConfig) registerFlag(cmd extkingpin.FlagClause) {
 		"Maximum amount of downloaded (either fetched or touched) bytes in a single Series/LabelNames/LabelValues call. The Series call fails if this limit is exceeded. 0 means no limit.").
 		Default("0").BytesVar(&sc.maxDownloadedBytes)
 
+	cmd.Flag("store.in-memory-blocks.max-age", "Keep the index and chunks of blocks whose max time is within this duration from now fully in memory, so recent queries are served without fetching from object storage. Blocks are evicted from memory once they age out of this window. 0 disables it.").
+		Default("0s").DurationVar(&sc.inMemoryBlocksMaxAge)
+
+	cmd.Flag("store.in-memory-blocks.max-size", "Maximum total size of index and chunk files of recent blocks held in memory. Recent blocks not fitting are read from object storage as usual. Only used if --store.in-memory-blocks.max-age is set.").
+		Default("1GB").BytesVar(&sc.inMemoryBlocksMaxSize)
+
+	cmd.Flag("store.postings-warmup.selector", "Series selector, e.g. '{namespace=\"prod\"}', whose postings are fetched into the index cache when a block is loaded, so that the first queries using it or some of its label matchers do not pay for the postings lookup. Can be repeated. Disabled by default.").
+		PlaceHolder("<selector>").StringsVar(&sc.postingsWarmupSelectors)
+
+	cmd.Flag("store.postings-warmup.max-size", "Maximum size of postings fetched per block by the postings warm-up. Warm-up of a block stops once it is reached. 0 means no limit.").
+		Default("16MB").BytesVar(&sc.postingsWarmupMaxSize)
+
+	sc.readinessQueries = *extflag.RegisterPathOrContent(cmd, "store.readiness-queries",
+		"YAML list of representative queries the store serves after the initial sync before reporting ready, so that traffic is only routed to it once the blocks and caches they touch are warm. Failed queries are retried. See format details: https://thanos.io/tip/components/store.md/#readiness-queries",
+	)
+	cmd.Flag("store.readiness-queries.timeout", "Maximum time spent running the --store.readiness-queries. Once it expires, the store reports ready even if the queries did not succeed.").
+		Default("5m").DurationVar(&sc.readinessQueriesTimeout)
+
+	cmd.Flag("store.case-insensitive-external-label", "Name of an external label whose values are matched ignoring case when selecting blocks, e.g. so that cluster=\"prod\" also selects blocks labeled cluster=\"Prod\". Stopgap for buckets with inconsistently labeled blocks, fix the labels of the blocks instead. Can be repeated.").
+		PlaceHolder("<label>").StringsVar(&sc.caseInsensitiveExtLabels)
+
 	cmd.Flag("store.grpc.series-max-concurrency", "Maximum number of concurrent Series calls.").Default("20").IntVar(&sc.maxConcurrency)
 
+	cmd.Flag("store.grpc.series-adaptive-concurrency", "If true, the number of concurrent Series calls is reduced when memory usage approaches --store.grpc.series-memory-soft-limit and ramps back up to --store.grpc.series-max-concurrency when memory usage recovers. Series calls over the reduced limit are rejected with ResourceExhausted.").
+		Default("false").BoolVar(&sc.adaptiveConcurrency)
+
+	cmd.Flag("store.grpc.series-memory-soft-limit", "Memory usage the adaptive Series concurrency limit is based on. 0 means using the Go runtime memory limit set by GOMEMLIMIT. Only used if --store.grpc.series-adaptive-concurrency is set.").
+		Default("0").BytesVar(&sc.memorySoftLimit)
+
+	cmd.Flag("store.grpc.series-prioritization", "If true, Series calls waiting for one of the --store.grpc.series-max-concurrency slots are served in order of the priority hint set by the querier in the thanos-priority request metadata: high, normal or low. Calls without a priority hint have the normal priority.").
+		Default("false").BoolVar(&sc.seriesPrioritization)
+
+	cmd.Flag("store.grpc.series-priority-max-wait", "Maximum time a Series call waits before it is served ahead of calls with higher priority, to bound the starvation of low priority calls. 0 means no bound. Only used if --store.grpc.series-prioritization is set.").
+		Default("10s").SetValue(&sc.seriesPriorityMaxWait)
+
 	sc.component = component.Store
 
 	sc.objStoreConfig = *extkingpin.RegisterCommonObjStoreFlags(cmd, "", true)
@@ -150,7 +213,7 @@ func (sc *storeConfig) registerFlag(cmd extkingpin.FlagClause) {
 	cmd.Flag("block-discovery-strategy", "One of "+strategies+". When set to concurrent, stores will concurrently issue one call per directory to discover active blocks in the bucket. The recursive strategy iterates through all objects in the bucket, recursively traversing into each directory. This avoids N+1 calls at the expense of having slower bucket iterations.").
 		Default(string(concurrentDiscovery)).StringVar(&sc.blockListStrategy)
 
-	cmd.Flag("block-sync-concurrency", "Number of goroutines to use when constructing index-cache.json blocks from object storage. Must be equal or greater than 1.").
+	cmd.Flag("block-sync-concurrency", "Maximum number of blocks loaded concurrently from object storage, including their index-header downloads. Blocks beyond this limit are queued and become queryable as they load. Must be equal or greater than 1.").
 		Default("20").IntVar(&sc.blockSyncConcurrency)
 
 	cmd.Flag("block-meta-fetch-concurrency", "Number of goroutines to use when fetching block metadata from object storage.").
@@ -159,6 +222,12 @@ func (sc *storeConfig) registerFlag(cmd extkingpin.FlagClause) {
 	cmd.Flag("debug.series-batch-size", "The batch size when fetching series from TSDB blocks. Setting the number too high can lead to slower retrieval, while setting it too low can lead to throttling caused by too many calls made to object storage.").
 		Hidden().Default(strconv.Itoa(store.SeriesBatchSize)).IntVar(&sc.seriesBatchSize)
 
+	cmd.Flag("store.series-response-chunk-batch-size", "Maximum number of chunks sent in a single Series response message. Series with more chunks are split into several messages with the same labels, which the querier merges back together. Smaller batches improve time to first byte and bound the size of each message, larger batches reduce the per-message overhead. 0 sends all chunks of a series in one message.").
+		Default("0").IntVar(&sc.seriesResponseChunkBatch)
+
+	cmd.Flag("store.chunk-read-ahead-max-size", "Maximum number of bytes read ahead past the last chunk fetched from a chunk file. When series are loaded in several batches, the first chunks of the next batch are often served from the read-ahead bytes instead of with another request to object storage. The read-ahead size adapts to how much of it was used, starting from 16KB up to this maximum. 0 disables read-ahead.").
+		Default("0").BytesVar(&sc.chunkReadAheadMaxSize)
+
 	cmd.Flag("debug.estimated-max-series-size", "Estimated max series size. Setting a value might result in over fetching data while a small value might result in data refetch. Default value is 64KB.").
 		Hidden().Default(strconv.Itoa(store.EstimatedMaxSeriesSize)).Uint64Var(&sc.estimatedMaxSeriesSize)
 
@@ -186,6 +255,11 @@ func (sc *storeConfig) registerFlag(cmd extkingpin.FlagClause) {
 	cmd.Flag("consistency-delay", "Minimum age of all blocks before they are being read. Set it to safe value (e.g 30m) if your object storage is eventually consistent. GCS and S3 are (roughly) strongly consistent.").
 		Default("0s").SetValue(&sc.consistencyDelay)
 
+	cmd.Flag("store.block-serve-delay", "Minimum time since blocks were uploaded, or their meta.json was last modified, before they are first served. "+
+		"Unlike --consistency-delay, it is based on the upload time of blocks in the bucket rather than their creation time, "+
+		"which protects against serving blocks that are still being finalized. 0s disables the delay.").
+		Default("0s").SetValue(&sc.blockServeDelay)
+
 	cmd.Flag("ignore-deletion-marks-delay", "Duration after which the blocks marked for deletion will be filtered out while fetching blocks. "+
 		"The idea of ignore-deletion-marks-delay is to ignore blocks that are marked for deletion with some delay. This ensures store can still serve blocks that are meant to be deleted but do not have a replacement yet. "+
 		"If delete-delay duration is provided to compactor or bucket verify component, it will upload deletion-mark.json file to mark after what duration the block should be deleted rather than deleting the block straight away. "+
@@ -206,6 +280,20 @@ func (sc *storeConfig) registerFlag(cmd extkingpin.FlagClause) {
 		Default(string(indexheader.EagerDownloadStrategy)).
 		EnumVar(&sc.indexHeaderLazyDownloadStrategy, string(indexheader.EagerDownloadStrategy), string(indexheader.LazyDownloadStrategy))
 
+	mmapAdvices := make([]string, 0, len(indexheader.MmapAdvices))
+	for _, a := range indexheader.MmapAdvices {
+		mmapAdvices = append(mmapAdvices, string(a))
+	}
+	cmd.Flag("store.index-header-mmap-advice", "Access pattern advised to the kernel (madvise) for the memory maps of index-headers. Supported values: "+strings.Join(mmapAdvices, ", ")+". "+
+		"normal keeps the default read-ahead of the kernel. random disables read-ahead, which reduces page cache thrashing and minor faults when index-headers do not fit into the page cache. "+
+		"sequential makes read-ahead more aggressive and willneed reads index-headers ahead when they are loaded. Ignored on platforms other than Linux.").
+		Default(string(indexheader.MmapAdviceNormal)).
+		EnumVar(&sc.indexHeaderMmapAdvice, mmapAdvices...)
+
+	cmd.Flag("store.index-header-progressive-load", "If true, Store Gateway loads the postings offset tables of index-headers in the background, in the sorted order of label names, "+
+		"so that large blocks are queryable before their index-headers are fully loaded. Requests needing label names which are not loaded yet wait for them to be loaded.").
+		Default("false").BoolVar(&sc.indexHeaderProgressiveLoad)
+
 	cmd.Flag("web.disable", "Disable Block Viewer UI.").Default("false").BoolVar(&sc.disableWeb)
 
 	cmd.Flag("web.external-prefix", "Static prefix for all HTML links and redirect URLs in the bucket web UI interface. Actual endpoints are still served on / or the web.route-prefix. This allows thanos bucket web UI to be served behind a reverse proxy that strips a URL sub-path.").
@@ -256,7 +344,7 @@ func registerStore(app *extkingpin.App) {
 			grpcLogOpts,
 			logFilterMethods,
 			*conf,
-			getFlagsMap(cmd.Flags()),
+			extkingpin.FlagsMap(cmd.Flags()),
 		)
 	})
 }
@@ -309,7 +397,7 @@ func runStore(
 		return err
 	}
 
-	bkt, err := client.NewBucket(logger, confContentYaml, conf.component.String())
+	bkt, err := extobjstore.NewBucket(logger, reg, confContentYaml, conf.component.String())
 	if err != nil {
 		return err
 	}
@@ -320,6 +408,20 @@ func runStore(
 		return errors.Wrap(err, "get caching bucket configuration")
 	}
 
+	readinessQueriesYaml, err := conf.readinessQueries.Content()
+	if err != nil {
+		return errors.Wrap(err, "get content of readiness queries")
+	}
+	var readinessQueries []store.ReadinessQuery
+	if len(readinessQueriesYaml) > 0 {
+		if readinessQueries, err = store.ParseReadinessQueries(readinessQueriesYaml); err != nil {
+			return err
+		}
+		if conf.readinessQueriesTimeout <= 0 {
+			return errors.New("--store.readiness-queries.timeout must be positive")
+		}
+	}
+
 	r := route.New()
 
 	if len(cachingBucketConfigYaml) > 0 {
@@ -369,14 +471,18 @@ func runStore(
 		return errors.Errorf("unknown sync strategy %s", conf.blockListStrategy)
 	}
 	ignoreDeletionMarkFilter := block.NewIgnoreDeletionMarkFilter(logger, insBkt, time.Duration(conf.ignoreDeletionMarksDelay), conf.blockMetaFetchConcurrency)
-	metaFetcher, err := block.NewMetaFetcher(logger, conf.blockMetaFetchConcurrency, insBkt, blockLister, dataDir, extprom.WrapRegistererWithPrefix("thanos_", reg),
-		[]block.MetadataFilter{
-			block.NewTimePartitionMetaFilter(conf.filterConf.MinTime, conf.filterConf.MaxTime),
-			block.NewLabelShardedMetaFilter(relabelConfig),
-			block.NewConsistencyDelayMetaFilter(logger, time.Duration(conf.consistencyDelay), extprom.WrapRegistererWithPrefix("thanos_", reg)),
-			ignoreDeletionMarkFilter,
-			block.NewDeduplicateFilter(conf.blockMetaFetchConcurrency),
-		})
+	filters := []block.MetadataFilter{
+		block.NewTimePartitionMetaFilter(conf.filterConf.MinTime, conf.filterConf.MaxTime),
+		block.NewLabelShardedMetaFilter(relabelConfig),
+		block.NewConsistencyDelayMetaFilter(logger, time.Duration(conf.consistencyDelay), extprom.WrapRegistererWithPrefix("thanos_", reg)),
+		ignoreDeletionMarkFilter,
+	}
+	if conf.blockServeDelay > 0 {
+		// Recently uploaded blocks are filtered out before deduplication, so that their source blocks keep being served.
+		filters = append(filters, block.NewUploadDelayMetaFilter(logger, insBkt, time.Duration(conf.blockServeDelay), conf.blockMetaFetchConcurrency))
+	}
+	filters = append(filters, block.NewDeduplicateFilter(conf.blockMetaFetchConcurrency))
+	metaFetcher, err := block.NewMetaFetcher(logger, conf.blockMetaFetchConcurrency, insBkt, blockLister, dataDir, extprom.WrapRegistererWithPrefix("thanos_", reg), filters)
 	if err != nil {
 		return errors.Wrap(err, "meta fetcher")
 	}
@@ -386,9 +492,30 @@ func runStore(
 		return errors.Errorf("max concurrency value cannot be lower than 0 (got %v)", conf.maxConcurrency)
 	}
 
-	queriesGate := gate.New(extprom.WrapRegistererWithPrefix("thanos_bucket_store_series_", reg), int(conf.maxConcurrency), gate.Queries)
+	var queriesGate gate.Gate
+	if conf.seriesPrioritization {
+		queriesGate = gate.NewPriority(extprom.WrapRegistererWithPrefix("thanos_bucket_store_series_", reg), int(conf.maxConcurrency), gate.Queries,
+			func(ctx context.Context) int { return int(store.PriorityFromContext(ctx)) }, time.Duration(conf.seriesPriorityMaxWait))
+	} else {
+		queriesGate = gate.New(extprom.WrapRegistererWithPrefix("thanos_bucket_store_series_", reg), int(conf.maxConcurrency), gate.Queries)
+	}
+	if conf.adaptiveConcurrency {
+		memoryGate, err := store.NewMemoryPressureGate(logger, reg, queriesGate, conf.maxConcurrency, uint64(conf.memorySoftLimit))
+		if err != nil {
+			return errors.Wrap(err, "create adaptive Series concurrency limiter")
+		}
+		queriesGate = memoryGate
+
+		ctx, cancel := context.WithCancel(context.Background())
+		g.Add(func() error {
+			memoryGate.Run(ctx, time.Second)
+			return nil
+		}, func(error) {
+			cancel()
+		})
+	}
 
-	chunkPool, err := store.NewDefaultChunkBytesPool(uint64(conf.chunkPoolSize))
+	chunkPool, err := store.NewChunkBytesPool(reg, int(conf.chunkPoolMinSizeClass), int(conf.chunkPoolMaxSizeClass), uint64(conf.chunkPoolSize))
 	if err != nil {
 		return errors.Wrap(err, "create chunk pool")
 	}
@@ -409,6 +536,9 @@ func runStore(
 		store.WithFilterConfig(conf.filterConf),
 		store.WithChunkHashCalculation(true),
 		store.WithSeriesBatchSize(conf.seriesBatchSize),
+		store.WithSeriesResponseChunkBatchSize(conf.seriesResponseChunkBatch),
+		store.WithChunkReadAhead(int(conf.chunkReadAheadMaxSize)),
+		store.WithMaxBlocksPerQuery(conf.maxBlocksPerQuery),
 		store.WithBlockEstimatedMaxSeriesFunc(func(m metadata.Meta) uint64 {
 			if m.Thanos.IndexStats.SeriesMaxSize > 0 &&
 				uint64(m.Thanos.IndexStats.SeriesMaxSize) < conf.estimatedMaxSeriesSize {
@@ -427,11 +557,30 @@ func runStore(
 		store.WithIndexHeaderLazyDownloadStrategy(
 			indexheader.IndexHeaderLazyDownloadStrategy(conf.indexHeaderLazyDownloadStrategy).StrategyToDownloadFunc(),
 		),
+		store.WithIndexHeaderMmapAdvice(indexheader.MmapAdvice(conf.indexHeaderMmapAdvice)),
+		store.WithIndexHeaderProgressiveLoad(conf.indexHeaderProgressiveLoad),
 	}
 
 	if conf.debugLogging {
 		options = append(options, store.WithDebugLogging())
 	}
+	if conf.inMemoryBlocksMaxAge > 0 {
+		options = append(options, store.WithInMemoryRecentBlocks(conf.inMemoryBlocksMaxAge, int64(conf.inMemoryBlocksMaxSize)))
+	}
+	if len(conf.postingsWarmupSelectors) > 0 {
+		selectors := make([][]*labels.Matcher, 0, len(conf.postingsWarmupSelectors))
+		for _, s := range conf.postingsWarmupSelectors {
+			ms, err := extpromql.ParseMetricSelector(s)
+			if err != nil {
+				return errors.Wrapf(err, "parse postings warm-up selector %s", s)
+			}
+			selectors = append(selectors, ms)
+		}
+		options = append(options, store.WithPostingsWarmup(selectors, int64(conf.postingsWarmupMaxSize)))
+	}
+	if len(conf.caseInsensitiveExtLabels) > 0 {
+		options = append(options, store.WithCaseInsensitiveExternalLabels(conf.caseInsensitiveExtLabels))
+	}
 
 	bs, err := store.NewBucketStore(
 		insBkt,
@@ -477,6 +626,10 @@ func runStore(
 				return errors.Wrap(err, "bucket store initial sync")
 			}
 
+			if len(readinessQueries) > 0 {
+				runReadinessQueries(ctx, logger, bs, readinessQueries, conf.readinessQueriesTimeout)
+			}
+
 			level.Info(logger).Log("msg", "bucket store ready", "init_duration", time.Since(begin).String())
 			close(bucketStoreReady)
 
@@ -561,7 +714,31 @@ func runStore(
 
 		srv.Handle("/", r)
 	}
+	srv.Handle("/debug/blocks", bs.BlocksMemoryHandler())
 
 	level.Info(logger).Log("msg", "starting store node")
 	return nil
 }
+
+// runReadinessQueries runs the readiness queries against s until they all succeed, retrying them on failure. Once
+// timeout expires, it gives up so that the store reports ready anyway.
+func runReadinessQueries(ctx context.Context, logger log.Logger, s storepb.StoreServer, queries []store.ReadinessQuery, timeout time.Duration) {
+	level.Info(logger).Log("msg", "running readiness queries", "queries", len(queries))
+	begin := time.Now()
+
+	readinessCtx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	err := runutil.Retry(retryIntervalDuration*time.Second, readinessCtx.Done(), func() error {
+		if err := store.RunReadinessQueries(readinessCtx, s, queries, time.Now()); err != nil {
+			level.Warn(logger).Log("msg", "readiness queries failed, retrying", "err", err)
+			return err
+		}
+		return nil
+	})
+	if err != nil {
+		level.Warn(logger).Log("msg", "readiness queries did not succeed in time, reporting ready anyway", "timeout", timeout, "err", err)
+		return
+	}
+	level.Info(logger).Log("msg", "readiness queries succeeded", "duration", time.Since(begin).String())
+}
@@ -12,6 +12,7 @@ import (
 	"io"
 	"net/http"
 	"os"
+	"path"
 	"path/filepath"
 	"sort"
 	"strconv"
@@ -19,6 +20,7 @@ import (
 	"text/template"
 	"time"
 
+	"github.com/dustin/go-humanize"
 	extflag "github.com/efficientgo/tools/extkingpin"
 	"github.com/go-kit/log"
 	"github.com/go-kit/log/level"
@@ -35,22 +37,24 @@ import (
 	"github.com/prometheus/prometheus/model/relabel"
 	"github.com/prometheus/prometheus/tsdb"
 	"github.com/prometheus/prometheus/tsdb/chunkenc"
+	"github.com/prometheus/prometheus/tsdb/tombstones"
 	"golang.org/x/text/language"
 	"golang.org/x/text/message"
 	"gopkg.in/yaml.v3"
 
 	"github.com/thanos-io/objstore"
-	"github.com/thanos-io/objstore/client"
 	objstoretracing "github.com/thanos-io/objstore/tracing/opentracing"
 
 	v1 "github.com/thanos-io/thanos/pkg/api/blocks"
 	"github.com/thanos-io/thanos/pkg/block"
+	"github.com/thanos-io/thanos/pkg/block/lifecycle"
 	"github.com/thanos-io/thanos/pkg/block/metadata"
 	"github.com/thanos-io/thanos/pkg/compact"
 	"github.com/thanos-io/thanos/pkg/compact/downsample"
 	"github.com/thanos-io/thanos/pkg/compactv2"
 	"github.com/thanos-io/thanos/pkg/component"
 	"github.com/thanos-io/thanos/pkg/extkingpin"
+	"github.com/thanos-io/thanos/pkg/extobjstore"
 	"github.com/thanos-io/thanos/pkg/extprom"
 	extpromhttp "github.com/thanos-io/thanos/pkg/extprom/http"
 	"github.com/thanos-io/thanos/pkg/logging"
@@ -139,6 +143,29 @@ type bucketDownsampleConfig struct {
 	blockFilesConcurrency int
 	dataDir               string
 	hashFunc              string
+	valueRounding         []string
+}
+
+type bucketDownsampleOneConfig struct {
+	blockID               string
+	resolution            string
+	dataDir               string
+	upload                bool
+	blockFilesConcurrency int
+	hashFunc              string
+	valueRounding         []string
+}
+
+type bucketGCConfig struct {
+	minAge               time.Duration
+	delete               bool
+	blockSyncConcurrency int
+}
+
+type bucketCostConfig struct {
+	groupBy              []string
+	output               string
+	blockSyncConcurrency int
 }
 
 type bucketCleanupConfig struct {
@@ -165,6 +192,15 @@ type bucketUploadBlocksConfig struct {
 	labels []string
 }
 
+type bucketCompareConfig struct {
+	blocksA               []string
+	blocksB               []string
+	dataDir               string
+	tolerance             float64
+	maxDifferences        int
+	blockFilesConcurrency int
+}
+
 func (tbc *bucketVerifyConfig) registerBucketVerifyFlag(cmd extkingpin.FlagClause) *bucketVerifyConfig {
 	cmd.Flag("repair", "Attempt to repair blocks for which issues were detected").
 		Short('r').Default("false").BoolVar(&tbc.repair)
@@ -253,6 +289,24 @@ func (tbc *bucketDownsampleConfig) registerBucketDownsampleFlag(cmd extkingpin.F
 		Default("./data").StringVar(&tbc.dataDir)
 	cmd.Flag("hash-func", "Specify which hash function to use when calculating the hashes of produced files. If no function has been specified, it does not happen. This permits avoiding downloading some files twice albeit at some performance cost. Possible values are: \"\", \"SHA256\".").
 		Default("").EnumVar(&tbc.hashFunc, "SHA256", "")
+	registerDownsampleRoundingFlag(cmd, &tbc.valueRounding)
+
+	return tbc
+}
+
+func (tbc *bucketDownsampleOneConfig) registerBucketDownsampleOneFlag(cmd extkingpin.FlagClause) *bucketDownsampleOneConfig {
+	cmd.Flag("id", "ID (ULID) of the block to downsample.").Required().StringVar(&tbc.blockID)
+	cmd.Flag("resolution", "Resolution to downsample the block to. It has to be greater than the resolution of the block.").
+		Default("5m").EnumVar(&tbc.resolution, "5m", "1h")
+	cmd.Flag("data-dir", "Data directory in which to download the block and write the downsampled block.").
+		Default("./data").StringVar(&tbc.dataDir)
+	cmd.Flag("upload", "Upload the downsampled block to the bucket. By default it is only written to the data directory.").
+		Default("false").BoolVar(&tbc.upload)
+	cmd.Flag("block-files-concurrency", "Number of goroutines to use when fetching/uploading block files from object storage.").
+		Default("1").IntVar(&tbc.blockFilesConcurrency)
+	cmd.Flag("hash-func", "Specify which hash function to use when calculating the hashes of produced files. If no function has been specified, it does not happen. This permits avoiding downloading some files twice albeit at some performance cost. Possible values are: \"\", \"SHA256\".").
+		Default("").EnumVar(&tbc.hashFunc, "SHA256", "")
+	registerDownsampleRoundingFlag(cmd, &tbc.valueRounding)
 
 	return tbc
 }
@@ -265,6 +319,26 @@ func (tbc *bucketMarkBlockConfig) registerBucketMarkBlockFlag(cmd extkingpin.Fla
 	return tbc
 }
 
+func (tbc *bucketGCConfig) registerBucketGCFlag(cmd extkingpin.FlagClause) *bucketGCConfig {
+	cmd.Flag("min-age", "Minimum age of orphaned objects before they are considered for removal. Both the block ULID and every object of an orphaned block have to be older than this, to avoid racing in-progress uploads.").
+		Default("48h").DurationVar(&tbc.minAge)
+	cmd.Flag("delete", "Delete orphaned blocks. By default only a dry run is performed and nothing is removed.").
+		Default("false").BoolVar(&tbc.delete)
+	cmd.Flag("block-sync-concurrency", "Number of goroutines to use when syncing block metadata from object storage.").
+		Default("20").IntVar(&tbc.blockSyncConcurrency)
+	return tbc
+}
+
+func (tbc *bucketCostConfig) registerBucketCostFlag(cmd extkingpin.FlagClause) *bucketCostConfig {
+	cmd.Flag("group-by", "External label to break down the storage cost by, e.g. the tenant label (repeated).").
+		PlaceHolder("<label>").StringsVar(&tbc.groupBy)
+	cmd.Flag("output", "Output format for result. Currently supports table, csv, tsv, json.").
+		Default("table").EnumVar(&tbc.output, append(outputTypes, "json")...)
+	cmd.Flag("block-sync-concurrency", "Number of goroutines to use when syncing block metadata from object storage.").
+		Default("20").IntVar(&tbc.blockSyncConcurrency)
+	return tbc
+}
+
 func (tbc *bucketCleanupConfig) registerBucketCleanupFlag(cmd extkingpin.FlagClause) *bucketCleanupConfig {
 	cmd.Flag("delete-delay", "Time before a block marked for deletion is deleted from bucket.").Default("48h").DurationVar(&tbc.deleteDelay)
 	cmd.Flag("consistency-delay", fmt.Sprintf("Minimum age of fresh (non-compacted) blocks before they are being processed. Malformed blocks older than the maximum of consistency-delay and %v will be removed.", compact.PartialUploadThresholdAge)).
@@ -291,6 +365,20 @@ func (tbc *bucketUploadBlocksConfig) registerBucketUploadBlocksFlag(cmd extkingp
 	return tbc
 }
 
+func (tbc *bucketCompareConfig) registerBucketCompareFlag(cmd extkingpin.FlagClause) *bucketCompareConfig {
+	cmd.Flag("a", "ID (ULID) of the blocks of the first set to compare (repeated flag), e.g. the sources of a compaction.").Required().StringsVar(&tbc.blocksA)
+	cmd.Flag("b", "ID (ULID) of the blocks of the second set to compare (repeated flag), e.g. the result of a compaction.").Required().StringsVar(&tbc.blocksB)
+	cmd.Flag("data-dir", "Data directory in which to download the blocks.").
+		Default(filepath.Join(os.TempDir(), "thanos-compare")).StringVar(&tbc.dataDir)
+	cmd.Flag("tolerance", "Relative difference up to which float values are considered equal.").
+		Default("0").Float64Var(&tbc.tolerance)
+	cmd.Flag("max-differences", "Maximum number of differences to print.").
+		Default("10").IntVar(&tbc.maxDifferences)
+	cmd.Flag("block-files-concurrency", "Number of goroutines to use when fetching block files from object storage.").
+		Default("1").IntVar(&tbc.blockFilesConcurrency)
+	return tbc
+}
+
 func registerBucket(app extkingpin.AppClause) {
 	cmd := app.Command("bucket", "Bucket utility commands")
 
@@ -301,11 +389,15 @@ func registerBucket(app extkingpin.AppClause) {
 	registerBucketWeb(cmd, objStoreConfig)
 	registerBucketReplicate(cmd, objStoreConfig)
 	registerBucketDownsample(cmd, objStoreConfig)
+	registerBucketDownsampleOne(cmd, objStoreConfig)
 	registerBucketCleanup(cmd, objStoreConfig)
+	registerBucketGC(cmd, objStoreConfig)
+	registerBucketCost(cmd, objStoreConfig)
 	registerBucketMarkBlock(cmd, objStoreConfig)
 	registerBucketRewrite(cmd, objStoreConfig)
 	registerBucketRetention(cmd, objStoreConfig)
 	registerBucketUploadBlocks(cmd, objStoreConfig)
+	registerBucketCompare(cmd, objStoreConfig)
 }
 
 func registerBucketVerify(app extkingpin.AppClause, objStoreConfig *extflag.PathOrContent) {
@@ -327,7 +419,7 @@ func registerBucketVerify(app extkingpin.AppClause, objStoreConfig *extflag.Path
 			return err
 		}
 
-		bkt, err := client.NewBucket(logger, confContentYaml, component.Bucket.String())
+		bkt, err := extobjstore.NewBucket(logger, reg, confContentYaml, component.Bucket.String())
 		if err != nil {
 			return err
 		}
@@ -346,7 +438,7 @@ func registerBucketVerify(app extkingpin.AppClause, objStoreConfig *extflag.Path
 			}
 		} else {
 			// nil Prometheus registerer: don't create conflicting metrics.
-			backupBkt, err = client.NewBucket(logger, backupconfContentYaml, component.Bucket.String())
+			backupBkt, err = extobjstore.NewBucket(logger, reg, backupconfContentYaml, component.Bucket.String())
 			if err != nil {
 				return err
 			}
@@ -411,7 +503,7 @@ func registerBucketLs(app extkingpin.AppClause, objStoreConfig *extflag.PathOrCo
 			return err
 		}
 
-		bkt, err := client.NewBucket(logger, confContentYaml, component.Bucket.String())
+		bkt, err := extobjstore.NewBucket(logger, reg, confContentYaml, component.Bucket.String())
 		if err != nil {
 			return err
 		}
@@ -519,7 +611,7 @@ func registerBucketInspect(app extkingpin.AppClause, objStoreConfig *extflag.Pat
 			return err
 		}
 
-		bkt, err := client.NewBucket(logger, confContentYaml, component.Bucket.String())
+		bkt, err := extobjstore.NewBucket(logger, reg, confContentYaml, component.Bucket.String())
 		if err != nil {
 			return err
 		}
@@ -622,14 +714,14 @@ func registerBucketWeb(app extkingpin.AppClause, objStoreConfig *extflag.PathOrC
 		bucketUI := ui.NewBucketUI(logger, tbc.webExternalPrefix, tbc.webPrefixHeaderName, component.Bucket)
 		bucketUI.Register(router, ins)
 
-		flagsMap := getFlagsMap(cmd.Flags())
+		flagsMap := extkingpin.FlagsMap(cmd.Flags())
 
 		confContentYaml, err := objStoreConfig.Content()
 		if err != nil {
 			return err
 		}
 
-		bkt, err := client.NewBucket(logger, confContentYaml, component.Bucket.String())
+		bkt, err := extobjstore.NewBucket(logger, reg, confContentYaml, component.Bucket.String())
 		if err != nil {
 			return errors.Wrap(err, "bucket client")
 		}
@@ -798,11 +890,127 @@ func registerBucketDownsample(app extkingpin.AppClause, objStoreConfig *extflag.
 	tbc.registerBucketDownsampleFlag(cmd)
 
 	cmd.Setup(func(g *run.Group, logger log.Logger, reg *prometheus.Registry, tracer opentracing.Tracer, _ <-chan struct{}, _ bool) error {
+		downsampleOpts, err := downsampleRoundingOptions(tbc.valueRounding)
+		if err != nil {
+			return err
+		}
 		return RunDownsample(g, logger, reg, *httpAddr, *httpTLSConfig, time.Duration(*httpGracePeriod), tbc.dataDir,
-			tbc.waitInterval, tbc.downsampleConcurrency, tbc.blockFilesConcurrency, objStoreConfig, component.Downsample, metadata.HashFunc(tbc.hashFunc))
+			tbc.waitInterval, tbc.downsampleConcurrency, tbc.blockFilesConcurrency, objStoreConfig, component.Downsample, metadata.HashFunc(tbc.hashFunc), lifecycle.NopNotifier{}, downsampleOpts...)
+	})
+}
+
+func registerBucketDownsampleOne(app extkingpin.AppClause, objStoreConfig *extflag.PathOrContent) {
+	cmd := app.Command("downsample-one", "Downsample a single block from the bucket on demand, without running the compactor. "+
+		"The downsampled block is verified and written to the data directory, and optionally uploaded back to the bucket. "+
+		"NOTE: Uploading a downsampled block the compactor already produced results in overlapping blocks.")
+
+	tbc := &bucketDownsampleOneConfig{}
+	tbc.registerBucketDownsampleOneFlag(cmd)
+
+	cmd.Setup(func(g *run.Group, logger log.Logger, reg *prometheus.Registry, _ opentracing.Tracer, _ <-chan struct{}, _ bool) error {
+		confContentYaml, err := objStoreConfig.Content()
+		if err != nil {
+			return err
+		}
+
+		bkt, err := extobjstore.NewBucket(logger, reg, confContentYaml, component.Downsample.String())
+		if err != nil {
+			return err
+		}
+		insBkt := objstoretracing.WrapWithTraces(objstore.WrapWithMetrics(bkt, extprom.WrapRegistererWithPrefix("thanos_", reg), bkt.Name()))
+
+		id, err := ulid.Parse(tbc.blockID)
+		if err != nil {
+			return errors.Errorf("id is not a valid block ULID, got: %v", tbc.blockID)
+		}
+		resolution := downsample.ResLevel1
+		if tbc.resolution == "1h" {
+			resolution = downsample.ResLevel2
+		}
+		downsampleOpts, err := downsampleRoundingOptions(tbc.valueRounding)
+		if err != nil {
+			return err
+		}
+
+		ctx, cancel := context.WithCancel(context.Background())
+		g.Add(func() error {
+			defer runutil.CloseWithLogOnErr(logger, insBkt, "bucket client")
+
+			meta, err := downsampleOneBlock(ctx, logger, insBkt, id, resolution, tbc, downsampleOpts...)
+			if err != nil {
+				return err
+			}
+			level.Info(logger).Log("msg", "downsample done", "source", id, "new", meta.ULID)
+			return nil
+		}, func(err error) {
+			cancel()
+		})
+		return nil
 	})
 }
 
+// downsampleOneBlock downloads the given block into the data directory, downsamples it to the given resolution,
+// optionally uploads the result and prints a summary of the source and resulting blocks to stdout.
+func downsampleOneBlock(ctx context.Context, logger log.Logger, bkt objstore.Bucket, id ulid.ULID, resolution int64, tbc *bucketDownsampleOneConfig, downsampleOpts ...downsample.Option) (*metadata.Meta, error) {
+	bdir := filepath.Join(tbc.dataDir, id.String())
+	if err := os.RemoveAll(bdir); err != nil {
+		return nil, errors.Wrap(err, "clean block directory")
+	}
+
+	level.Info(logger).Log("msg", "downloading block", "id", id)
+	if err := block.Download(ctx, logger, bkt, id, bdir, objstore.WithFetchConcurrency(tbc.blockFilesConcurrency)); err != nil {
+		return nil, errors.Wrapf(err, "download block %s", id)
+	}
+	m, err := metadata.ReadFromDir(bdir)
+	if err != nil {
+		return nil, errors.Wrapf(err, "read meta of %s", id)
+	}
+	if m.Thanos.Downsample.Resolution >= resolution {
+		return nil, errors.Errorf("block %s already has resolution %s, cannot downsample it to %s", id, m.Thanos.ResolutionString(), tbc.resolution)
+	}
+	if err := block.VerifyIndex(ctx, logger, filepath.Join(bdir, block.IndexFilename), m.MinTime, m.MaxTime); err != nil {
+		return nil, errors.Wrap(err, "input block index not valid")
+	}
+
+	meta, err := downsampleLocalBlock(ctx, logger, m, bdir, tbc.dataDir, resolution, false, downsampleOpts...)
+	if err != nil {
+		return nil, err
+	}
+	resdir := filepath.Join(tbc.dataDir, meta.ULID.String())
+
+	if tbc.upload {
+		level.Info(logger).Log("msg", "uploading downsampled block", "id", meta.ULID)
+		if err := block.Upload(ctx, logger, bkt, resdir, metadata.HashFunc(tbc.hashFunc)); err != nil {
+			return nil, errors.Wrapf(err, "upload downsampled block %s", meta.ULID)
+		}
+	}
+
+	t := Table{Header: []string{"", "SOURCE", "DOWNSAMPLED"}}
+	for _, l := range []struct {
+		name string
+		get  func(*metadata.Meta) string
+	}{
+		{"ULID", func(m *metadata.Meta) string { return m.ULID.String() }},
+		{"RESOLUTION", func(m *metadata.Meta) string { return m.Thanos.ResolutionString() }},
+		{"FROM", func(m *metadata.Meta) string { return time.UnixMilli(m.MinTime).UTC().Format(time.RFC3339) }},
+		{"UNTIL", func(m *metadata.Meta) string { return time.UnixMilli(m.MaxTime).UTC().Format(time.RFC3339) }},
+		{"#SERIES", func(m *metadata.Meta) string { return strconv.FormatUint(m.Stats.NumSeries, 10) }},
+		{"#SAMPLES", func(m *metadata.Meta) string { return strconv.FormatUint(m.Stats.NumSamples, 10) }},
+		{"#CHUNKS", func(m *metadata.Meta) string { return strconv.FormatUint(m.Stats.NumChunks, 10) }},
+	} {
+		t.Lines = append(t.Lines, []string{l.name, l.get(m), l.get(meta)})
+	}
+	uploaded := "no"
+	if tbc.upload {
+		uploaded = "yes"
+	}
+	t.Lines = append(t.Lines, []string{"DIRECTORY", bdir, resdir}, []string{"UPLOADED", "", uploaded})
+	if err := printTable(os.Stdout, t); err != nil {
+		return nil, err
+	}
+	return meta, nil
+}
+
 func registerBucketCleanup(app extkingpin.AppClause, objStoreConfig *extflag.PathOrContent) {
 	cmd := app.Command(component.Cleanup.String(), "Cleans up all blocks marked for deletion.")
 
@@ -826,7 +1034,7 @@ func registerBucketCleanup(app extkingpin.AppClause, objStoreConfig *extflag.Pat
 			return err
 		}
 
-		bkt, err := client.NewBucket(logger, confContentYaml, component.Cleanup.String())
+		bkt, err := extobjstore.NewBucket(logger, reg, confContentYaml, component.Cleanup.String())
 		if err != nil {
 			return err
 		}
@@ -883,7 +1091,7 @@ func registerBucketCleanup(app extkingpin.AppClause, objStoreConfig *extflag.Pat
 
 		level.Info(logger).Log("msg", "synced blocks done")
 
-		compact.BestEffortCleanAbortedPartialUploads(ctx, logger, sy.Partial(), insBkt, stubCounter, stubCounter, stubCounter)
+		compact.BestEffortCleanAbortedPartialUploads(ctx, logger, sy.Partial(), insBkt, stubCounter, stubCounter, stubCounter, nil)
 		if err := blocksCleaner.DeleteMarkedBlocks(ctx); err != nil {
 			return errors.Wrap(err, "error cleaning blocks")
 		}
@@ -893,6 +1101,370 @@ func registerBucketCleanup(app extkingpin.AppClause, objStoreConfig *extflag.Pat
 	})
 }
 
+func registerBucketGC(app extkingpin.AppClause, objStoreConfig *extflag.PathOrContent) {
+	cmd := app.Command("gc", "Finds objects in the bucket which do not belong to any block, such as leftovers of failed uploads and incomplete deletions, and optionally removes them. "+
+		"Runs in dry-run mode unless --delete is set.")
+
+	tbc := &bucketGCConfig{}
+	tbc.registerBucketGCFlag(cmd)
+
+	cmd.Setup(func(g *run.Group, logger log.Logger, reg *prometheus.Registry, _ opentracing.Tracer, _ <-chan struct{}, _ bool) error {
+		confContentYaml, err := objStoreConfig.Content()
+		if err != nil {
+			return err
+		}
+
+		bkt, err := extobjstore.NewBucket(logger, reg, confContentYaml, component.Bucket.String())
+		if err != nil {
+			return err
+		}
+		insBkt := objstoretracing.WrapWithTraces(objstore.WrapWithMetrics(bkt, extprom.WrapRegistererWithPrefix("thanos_", reg), bkt.Name()))
+
+		ctx, cancel := context.WithCancel(context.Background())
+		g.Add(func() error {
+			defer runutil.CloseWithLogOnErr(logger, insBkt, "bucket client")
+
+			t, err := bucketGC(ctx, logger, reg, insBkt, tbc, time.Now())
+			if err != nil {
+				return err
+			}
+			return printTable(os.Stdout, t)
+		}, func(err error) {
+			cancel()
+		})
+		return nil
+	})
+}
+
+// bucketGC finds orphaned objects in the bucket and deletes them if requested. Orphaned blocks are block directories
+// without meta.json, left behind by aborted uploads and incomplete deletions. They are only deleted if both the block
+// and all of its objects are older than the minimum age. Objects outside of block directories are reported but never
+// deleted, since they might be written by other tools.
+func bucketGC(ctx context.Context, logger log.Logger, reg prometheus.Registerer, bkt objstore.InstrumentedBucket, tbc *bucketGCConfig, now time.Time) (Table, error) {
+	t := Table{Header: []string{"OBJECT", "TYPE", "#OBJECTS", "SIZE", "LAST MODIFIED", "ACTION"}}
+
+	baseBlockIDsFetcher := block.NewConcurrentLister(logger, bkt)
+	fetcher, err := block.NewMetaFetcher(logger, tbc.blockSyncConcurrency, bkt, baseBlockIDsFetcher, "", extprom.WrapRegistererWithPrefix(extpromPrefix, reg), nil)
+	if err != nil {
+		return t, errors.Wrap(err, "create meta fetcher")
+	}
+	_, partial, err := fetcher.Fetch(ctx)
+	if err != nil {
+		return t, errors.Wrap(err, "fetch metas")
+	}
+
+	var orphaned []ulid.ULID
+	for id, err := range partial {
+		// Blocks with corrupted meta.json might still be repaired, leave them alone.
+		if errors.Cause(err) != block.ErrorSyncMetaNotFound {
+			level.Warn(logger).Log("msg", "skipping block with unreadable meta.json", "block", id, "err", err)
+			continue
+		}
+		orphaned = append(orphaned, id)
+	}
+	sort.Slice(orphaned, func(i, j int) bool { return orphaned[i].Compare(orphaned[j]) < 0 })
+
+	minTime := now.Add(-tbc.minAge)
+	for _, id := range orphaned {
+		var (
+			objects      int
+			size         int64
+			lastModified time.Time
+		)
+		if err := bkt.Iter(ctx, id.String(), func(name string) error {
+			attrs, err := bkt.Attributes(ctx, name)
+			if err != nil {
+				return errors.Wrapf(err, "get attributes of %s", name)
+			}
+			objects++
+			size += attrs.Size
+			if attrs.LastModified.After(lastModified) {
+				lastModified = attrs.LastModified
+			}
+			return nil
+		}, objstore.WithRecursiveIter); err != nil {
+			return t, errors.Wrapf(err, "list objects of block %s", id)
+		}
+
+		action := "would delete"
+		switch {
+		case ulid.Time(id.Time()).After(minTime) || lastModified.After(minTime):
+			action = "skipped: too recent"
+		case tbc.delete:
+			// The upload might have completed since the block was fetched, check once more right before deleting.
+			ok, err := bkt.Exists(ctx, path.Join(id.String(), block.MetaFilename))
+			if err != nil {
+				return t, errors.Wrapf(err, "check meta.json of block %s", id)
+			}
+			if ok {
+				action = "skipped: meta.json appeared"
+				break
+			}
+			if err := block.Delete(ctx, logger, bkt, id); err != nil {
+				return t, errors.Wrapf(err, "delete orphaned block %s", id)
+			}
+			level.Info(logger).Log("msg", "deleted orphaned block", "block", id, "objects", objects)
+			action = "deleted"
+		}
+		t.Lines = append(t.Lines, []string{id.String() + "/", "orphaned block", strconv.Itoa(objects), humanize.IBytes(uint64(size)), lastModified.UTC().Format(time.RFC3339), action})
+	}
+
+	if err := bkt.Iter(ctx, "", func(name string) error {
+		if _, ok := block.IsBlockDir(name); ok || strings.HasPrefix(name, "debug/") {
+			return nil
+		}
+		t.Lines = append(t.Lines, []string{name, "unknown", "", "", "", "kept"})
+		return nil
+	}); err != nil {
+		return t, errors.Wrap(err, "list bucket")
+	}
+
+	return t, nil
+}
+
+func registerBucketCost(app extkingpin.AppClause, objStoreConfig *extflag.PathOrContent) {
+	cmd := app.Command("cost", "Estimates the object storage cost of the blocks in the bucket, broken down by external labels, resolution and storage tier. "+
+		"Block sizes are taken from the block metadata, or from the object listing for blocks without file sizes in their metadata, so no block is downloaded.")
+
+	tbc := &bucketCostConfig{}
+	tbc.registerBucketCostFlag(cmd)
+	pricingConfig := extflag.RegisterPathOrContent(cmd, "pricing.config", "YAML file that contains the pricing model of the object storage provider. See format details: https://thanos.io/tip/components/tools.md/#bucket-cost", extflag.WithEnvSubstitution())
+
+	cmd.Setup(func(g *run.Group, logger log.Logger, reg *prometheus.Registry, _ opentracing.Tracer, _ <-chan struct{}, _ bool) error {
+		pricingYaml, err := pricingConfig.Content()
+		if err != nil {
+			return err
+		}
+		pricing, err := parseBucketCostPricing(pricingYaml)
+		if err != nil {
+			return errors.Wrap(err, "parse pricing config")
+		}
+
+		confContentYaml, err := objStoreConfig.Content()
+		if err != nil {
+			return err
+		}
+
+		bkt, err := extobjstore.NewBucket(logger, reg, confContentYaml, component.Bucket.String())
+		if err != nil {
+			return err
+		}
+		insBkt := objstoretracing.WrapWithTraces(objstore.WrapWithMetrics(bkt, extprom.WrapRegistererWithPrefix("thanos_", reg), bkt.Name()))
+
+		ctx, cancel := context.WithCancel(context.Background())
+		g.Add(func() error {
+			defer runutil.CloseWithLogOnErr(logger, insBkt, "bucket client")
+
+			report, err := bucketCost(ctx, logger, reg, insBkt, tbc, pricing, time.Now())
+			if err != nil {
+				return err
+			}
+			switch outputType(tbc.output) {
+			case TABLE:
+				return printTable(os.Stdout, report.table())
+			case CSV:
+				return printCSV(os.Stdout, report.table())
+			case TSV:
+				return printTSV(os.Stdout, report.table())
+			}
+			enc := json.NewEncoder(os.Stdout)
+			enc.SetIndent("", "\t")
+			return enc.Encode(report)
+		}, func(err error) {
+			cancel()
+		})
+		return nil
+	})
+}
+
+// bucketCostPricing is the pricing model of an object storage provider.
+type bucketCostPricing struct {
+	Currency string `yaml:"currency"`
+	// PricePerGiBMonth is the price of storing one GiB for a month in the default storage tier.
+	PricePerGiBMonth float64 `yaml:"price_per_gib_month"`
+	// Tiers are cheaper storage tiers objects are moved to as they age, e.g. by lifecycle rules of the bucket.
+	Tiers []bucketCostTier `yaml:"tiers"`
+}
+
+type bucketCostTier struct {
+	Name string `yaml:"name"`
+	// MinAge is the age of objects from which on they are stored in this tier.
+	MinAge           prommodel.Duration `yaml:"min_age"`
+	PricePerGiBMonth float64            `yaml:"price_per_gib_month"`
+}
+
+const defaultBucketCostTier = "default"
+
+func parseBucketCostPricing(conf []byte) (*bucketCostPricing, error) {
+	pricing := &bucketCostPricing{Currency: "USD"}
+	if err := yaml.Unmarshal(conf, pricing); err != nil {
+		return nil, err
+	}
+	if pricing.PricePerGiBMonth < 0 {
+		return nil, errors.New("price must not be negative")
+	}
+	names := map[string]struct{}{defaultBucketCostTier: {}}
+	for _, tier := range pricing.Tiers {
+		if _, ok := names[tier.Name]; ok || tier.Name == "" {
+			return nil, errors.Errorf("tier names must be unique and not empty, got %q", tier.Name)
+		}
+		names[tier.Name] = struct{}{}
+		if tier.MinAge <= 0 {
+			return nil, errors.Errorf("minimum age of tier %s must be positive", tier.Name)
+		}
+		if tier.PricePerGiBMonth < 0 {
+			return nil, errors.Errorf("price of tier %s must not be negative", tier.Name)
+		}
+	}
+	// Look up the tiers of the oldest objects first.
+	sort.SliceStable(pricing.Tiers, func(i, j int) bool { return pricing.Tiers[i].MinAge > pricing.Tiers[j].MinAge })
+	return pricing, nil
+}
+
+// tier returns the name and price of the storage tier of objects of the given age.
+func (p *bucketCostPricing) tier(age time.Duration) (string, float64) {
+	for _, tier := range p.Tiers {
+		if age >= time.Duration(tier.MinAge) {
+			return tier.Name, tier.PricePerGiBMonth
+		}
+	}
+	return defaultBucketCostTier, p.PricePerGiBMonth
+}
+
+// bucketCostReport is the estimated storage cost of a bucket.
+type bucketCostReport struct {
+	Currency string           `json:"currency"`
+	GroupBy  []string         `json:"group_by,omitempty"`
+	Groups   []bucketCostItem `json:"groups"`
+	Total    bucketCostItem   `json:"total"`
+}
+
+// bucketCostItem is the storage cost of the blocks of a group.
+type bucketCostItem struct {
+	Labels      map[string]string `json:"labels,omitempty"`
+	Resolution  string            `json:"resolution,omitempty"`
+	Tier        string            `json:"tier,omitempty"`
+	Blocks      int               `json:"blocks"`
+	SizeBytes   int64             `json:"size_bytes"`
+	MonthlyCost float64           `json:"monthly_cost"`
+
+	resolution int64
+}
+
+func (i *bucketCostItem) add(blocks int, size int64, cost float64) {
+	i.Blocks += blocks
+	i.SizeBytes += size
+	i.MonthlyCost += cost
+}
+
+func (r *bucketCostReport) table() Table {
+	t := Table{Header: []string{"LABELS", "RESOLUTION", "TIER", "#BLOCKS", "SIZE", "COST/MONTH (" + r.Currency + ")"}}
+	line := func(labels, resolution, tier string, i bucketCostItem) []string {
+		return []string{labels, resolution, tier, strconv.Itoa(i.Blocks), humanize.IBytes(uint64(i.SizeBytes)), strconv.FormatFloat(i.MonthlyCost, 'f', 2, 64)}
+	}
+	for _, g := range r.Groups {
+		t.Lines = append(t.Lines, line(bucketCostLabels(r.GroupBy, g.Labels), g.Resolution, g.Tier, g))
+	}
+	t.Lines = append(t.Lines, line("TOTAL", "", "", r.Total))
+	return t
+}
+
+func bucketCostLabels(names []string, lset map[string]string) string {
+	var b strings.Builder
+	for _, name := range names {
+		if b.Len() > 0 {
+			b.WriteString(",")
+		}
+		fmt.Fprintf(&b, "%s=%q", name, lset[name])
+	}
+	return b.String()
+}
+
+// bucketCost estimates the monthly storage cost of the blocks in the bucket, grouped by the external labels to group by,
+// resolution and storage tier. The storage tier of a block is chosen by the time its objects were written, which is the
+// time of its ULID. Objects outside of blocks, such as orphaned objects, are not accounted for.
+func bucketCost(ctx context.Context, logger log.Logger, reg prometheus.Registerer, bkt objstore.InstrumentedBucket, tbc *bucketCostConfig, pricing *bucketCostPricing, now time.Time) (*bucketCostReport, error) {
+	baseBlockIDsFetcher := block.NewConcurrentLister(logger, bkt)
+	fetcher, err := block.NewMetaFetcher(logger, tbc.blockSyncConcurrency, bkt, baseBlockIDsFetcher, "", extprom.WrapRegistererWithPrefix(extpromPrefix, reg), nil)
+	if err != nil {
+		return nil, errors.Wrap(err, "create meta fetcher")
+	}
+	metas, partial, err := fetcher.Fetch(ctx)
+	if err != nil {
+		return nil, errors.Wrap(err, "fetch metas")
+	}
+	if len(partial) > 0 {
+		level.Warn(logger).Log("msg", "blocks without readable meta.json are not accounted for, see the bucket gc command", "blocks", len(partial))
+	}
+
+	report := &bucketCostReport{Currency: pricing.Currency, GroupBy: tbc.groupBy}
+	groups := map[string]*bucketCostItem{}
+	for id, meta := range metas {
+		size, err := blockSize(ctx, bkt, meta)
+		if err != nil {
+			return nil, errors.Wrapf(err, "get size of block %s", id)
+		}
+		tier, price := pricing.tier(now.Sub(ulid.Time(id.Time())))
+		cost := float64(size) / (1 << 30) * price
+
+		lset := make(map[string]string, len(tbc.groupBy))
+		for _, name := range tbc.groupBy {
+			lset[name] = meta.Thanos.Labels[name]
+		}
+		key := fmt.Sprintf("%s\xff%d\xff%s", bucketCostLabels(tbc.groupBy, lset), meta.Thanos.Downsample.Resolution, tier)
+		g, ok := groups[key]
+		if !ok {
+			g = &bucketCostItem{Resolution: "raw", Tier: tier, resolution: meta.Thanos.Downsample.Resolution}
+			if len(lset) > 0 {
+				g.Labels = lset
+			}
+			if res := meta.Thanos.Downsample.Resolution; res > 0 {
+				g.Resolution = prommodel.Duration(time.Duration(res) * time.Millisecond).String()
+			}
+			groups[key] = g
+		}
+		g.add(1, size, cost)
+		report.Total.add(1, size, cost)
+	}
+
+	for _, g := range groups {
+		report.Groups = append(report.Groups, *g)
+	}
+	sort.Slice(report.Groups, func(i, j int) bool {
+		gi, gj := report.Groups[i], report.Groups[j]
+		if li, lj := bucketCostLabels(tbc.groupBy, gi.Labels), bucketCostLabels(tbc.groupBy, gj.Labels); li != lj {
+			return li < lj
+		}
+		if gi.resolution != gj.resolution {
+			return gi.resolution < gj.resolution
+		}
+		return gi.Tier < gj.Tier
+	})
+	return report, nil
+}
+
+// blockSize returns the size of the objects of the block. It is taken from the files of the metadata if present, otherwise
+// from the attributes of the objects of the block.
+func blockSize(ctx context.Context, bkt objstore.BucketReader, meta *metadata.Meta) (int64, error) {
+	var size int64
+	for _, f := range meta.Thanos.Files {
+		size += f.SizeBytes
+	}
+	if size > 0 {
+		return size, nil
+	}
+
+	err := bkt.Iter(ctx, meta.ULID.String(), func(name string) error {
+		attrs, err := bkt.Attributes(ctx, name)
+		if err != nil {
+			return errors.Wrapf(err, "get attributes of %s", name)
+		}
+		size += attrs.Size
+		return nil
+	}, objstore.WithRecursiveIter)
+	return size, err
+}
+
 type tablePrinter func(w io.Writer, t Table) error
 
 func printTable(w io.Writer, t Table) error {
@@ -1083,7 +1655,7 @@ func registerBucketMarkBlock(app extkingpin.AppClause, objStoreConfig *extflag.P
 			return err
 		}
 
-		bkt, err := client.NewBucket(logger, confContentYaml, component.Mark.String())
+		bkt, err := extobjstore.NewBucket(logger, reg, confContentYaml, component.Mark.String())
 		if err != nil {
 			return err
 		}
@@ -1163,7 +1735,7 @@ func registerBucketRewrite(app extkingpin.AppClause, objStoreConfig *extflag.Pat
 			return err
 		}
 
-		bkt, err := client.NewBucket(logger, confContentYaml, component.Rewrite.String())
+		bkt, err := extobjstore.NewBucket(logger, reg, confContentYaml, component.Rewrite.String())
 		if err != nil {
 			return err
 		}
@@ -1268,11 +1840,12 @@ func registerBucketRewrite(app extkingpin.AppClause, objStoreConfig *extflag.Pat
 					return err
 				}
 
+				changes := &changeCounter{ChangeLogger: changeLog}
 				var comp *compactv2.Compactor
 				if tbc.dryRun {
-					comp = compactv2.NewDryRun(tbc.tmpDir, logger, changeLog, chunkPool)
+					comp = compactv2.NewDryRun(tbc.tmpDir, logger, changes, chunkPool)
 				} else {
-					comp = compactv2.New(tbc.tmpDir, logger, changeLog, chunkPool)
+					comp = compactv2.New(tbc.tmpDir, logger, changes, chunkPool)
 				}
 
 				level.Info(logger).Log("msg", "starting rewrite for block", "source", id, "new", newID, "toDelete", string(deletionsYaml), "toRelabel", string(relabelYaml))
@@ -1294,14 +1867,23 @@ func registerBucketRewrite(app extkingpin.AppClause, objStoreConfig *extflag.Pat
 					return err
 				}
 
-				level.Info(logger).Log("msg", "uploading new block", "source", id, "new", newID)
-				if tbc.promBlocks {
-					if err := block.UploadPromBlock(ctx, logger, insBkt, filepath.Join(tbc.tmpDir, newID.String()), metadata.HashFunc(*hashFunc)); err != nil {
-						return errors.Wrap(err, "upload")
+				if changes.count == 0 && !tbc.promBlocks {
+					// Only the meta file differs, reuse the index and chunks of the source block
+					// instead of uploading them again. Use the bucket as created to keep server-side copy.
+					level.Info(logger).Log("msg", "no series were modified, copying files of source block", "source", id, "new", newID)
+					if err := block.Copy(ctx, logger, bkt, id, meta); err != nil {
+						return errors.Wrap(err, "copy")
 					}
 				} else {
-					if err := block.Upload(ctx, logger, insBkt, filepath.Join(tbc.tmpDir, newID.String()), metadata.HashFunc(*hashFunc)); err != nil {
-						return errors.Wrap(err, "upload")
+					level.Info(logger).Log("msg", "uploading new block", "source", id, "new", newID)
+					if tbc.promBlocks {
+						if err := block.UploadPromBlock(ctx, logger, insBkt, filepath.Join(tbc.tmpDir, newID.String()), metadata.HashFunc(*hashFunc)); err != nil {
+							return errors.Wrap(err, "upload")
+						}
+					} else {
+						if err := block.Upload(ctx, logger, insBkt, filepath.Join(tbc.tmpDir, newID.String()), metadata.HashFunc(*hashFunc)); err != nil {
+							return errors.Wrap(err, "upload")
+						}
 					}
 				}
 				level.Info(logger).Log("msg", "uploaded", "source", id, "new", newID)
@@ -1371,7 +1953,7 @@ func registerBucketRetention(app extkingpin.AppClause, objStoreConfig *extflag.P
 			return err
 		}
 
-		bkt, err := client.NewBucket(logger, confContentYaml, component.Retention.String())
+		bkt, err := extobjstore.NewBucket(logger, reg, confContentYaml, component.Retention.String())
 		if err != nil {
 			return err
 		}
@@ -1429,7 +2011,7 @@ func registerBucketRetention(app extkingpin.AppClause, objStoreConfig *extflag.P
 
 		level.Warn(logger).Log("msg", "GLOBAL COMPACTOR SHOULD __NOT__ BE RUNNING ON THE SAME BUCKET")
 
-		if err := compact.ApplyRetentionPolicyByResolution(ctx, logger, insBkt, sy.Metas(), retentionByResolution, stubCounter); err != nil {
+		if err := compact.ApplyRetentionPolicyByResolution(ctx, logger, insBkt, sy.Metas(), retentionByResolution, stubCounter, nil); err != nil {
 			return errors.Wrap(err, "retention failed")
 		}
 		return nil
@@ -1460,7 +2042,7 @@ func registerBucketUploadBlocks(app extkingpin.AppClause, objStoreConfig *extfla
 			return errors.Wrap(err, "unable to parse objstore config")
 		}
 
-		bkt, err := client.NewBucket(logger, confContentYaml, component.Upload.String())
+		bkt, err := extobjstore.NewBucket(logger, reg, confContentYaml, component.Upload.String())
 		if err != nil {
 			return errors.Wrap(err, "unable to create bucket")
 		}
@@ -1486,3 +2068,147 @@ func registerBucketUploadBlocks(app extkingpin.AppClause, objStoreConfig *extfla
 		return nil
 	})
 }
+
+func registerBucketCompare(app extkingpin.AppClause, objStoreConfig *extflag.PathOrContent) {
+	cmd := app.Command("compare", "Compare the series and samples of two sets of raw blocks, e.g. to check that the result of a compaction or "+
+		"rewrite is equivalent to its sources. The samples of the blocks of each set are merged and compared within the intersection of "+
+		"the time ranges of both sets. Several samples at the same timestamp, e.g. of overlapping blocks, are reported as merged if one of them "+
+		"is equal to the sample of the other set. Exits with an error if any series or sample differs.")
+
+	tbc := &bucketCompareConfig{}
+	tbc.registerBucketCompareFlag(cmd)
+
+	cmd.Setup(func(g *run.Group, logger log.Logger, reg *prometheus.Registry, _ opentracing.Tracer, _ <-chan struct{}, _ bool) error {
+		confContentYaml, err := objStoreConfig.Content()
+		if err != nil {
+			return err
+		}
+
+		bkt, err := extobjstore.NewBucket(logger, reg, confContentYaml, component.Bucket.String())
+		if err != nil {
+			return err
+		}
+		insBkt := objstoretracing.WrapWithTraces(objstore.WrapWithMetrics(bkt, extprom.WrapRegistererWithPrefix("thanos_", reg), bkt.Name()))
+
+		var idsA, idsB []ulid.ULID
+		for _, ids := range []struct {
+			flags []string
+			ids   *[]ulid.ULID
+		}{{tbc.blocksA, &idsA}, {tbc.blocksB, &idsB}} {
+			for _, id := range ids.flags {
+				u, err := ulid.Parse(id)
+				if err != nil {
+					return errors.Errorf("id is not a valid block ULID, got: %v", id)
+				}
+				*ids.ids = append(*ids.ids, u)
+			}
+		}
+
+		ctx, cancel := context.WithCancel(context.Background())
+		g.Add(func() error {
+			defer runutil.CloseWithLogOnErr(logger, insBkt, "bucket client")
+
+			cmp, err := bucketCompare(ctx, logger, insBkt, idsA, idsB, tbc)
+			if err != nil {
+				return err
+			}
+			for _, d := range cmp.Differences {
+				fmt.Fprintln(os.Stdout, d)
+			}
+			if err := printTable(os.Stdout, bucketCompareTable(cmp)); err != nil {
+				return err
+			}
+			if n := cmp.Discrepancies(); n > 0 {
+				return errors.Errorf("blocks are not equivalent: %d series or samples differ", n)
+			}
+			level.Info(logger).Log("msg", "blocks are equivalent")
+			return nil
+		}, func(err error) {
+			cancel()
+		})
+		return nil
+	})
+}
+
+// bucketCompare downloads the raw blocks a and b into the data directory and compares their series and samples.
+func bucketCompare(ctx context.Context, logger log.Logger, bkt objstore.Bucket, a, b []ulid.ULID, tbc *bucketCompareConfig) (_ *block.Comparison, err error) {
+	chunkPool := chunkenc.NewPool()
+	open := func(ids []ulid.ULID) ([]block.Reader, error) {
+		var readers []block.Reader
+		for _, id := range ids {
+			bdir := filepath.Join(tbc.dataDir, id.String())
+			if err := os.RemoveAll(bdir); err != nil {
+				return nil, errors.Wrap(err, "clean block directory")
+			}
+			level.Info(logger).Log("msg", "downloading block", "id", id)
+			if err := block.Download(ctx, logger, bkt, id, bdir, objstore.WithFetchConcurrency(tbc.blockFilesConcurrency)); err != nil {
+				return nil, errors.Wrapf(err, "download block %s", id)
+			}
+			m, err := metadata.ReadFromDir(bdir)
+			if err != nil {
+				return nil, errors.Wrapf(err, "read meta of %s", id)
+			}
+			if m.Thanos.Downsample.Resolution != downsample.ResLevel0 {
+				return nil, errors.Errorf("block %s has resolution %s, only raw blocks can be compared", id, m.Thanos.ResolutionString())
+			}
+			r, err := tsdb.OpenBlock(logger, bdir, chunkPool)
+			if err != nil {
+				return nil, errors.Wrapf(err, "open block %s", id)
+			}
+			readers = append(readers, r)
+		}
+		return readers, nil
+	}
+
+	var blocks []*tsdb.Block
+	defer func() {
+		for _, b := range blocks {
+			runutil.CloseWithErrCapture(&err, b, "close block")
+		}
+	}()
+	var sets [2][]block.Reader
+	for i, ids := range [][]ulid.ULID{a, b} {
+		readers, err := open(ids)
+		for _, r := range readers {
+			blocks = append(blocks, r.(*tsdb.Block))
+		}
+		if err != nil {
+			return nil, err
+		}
+		sets[i] = readers
+	}
+
+	level.Info(logger).Log("msg", "comparing blocks", "a", fmt.Sprint(a), "b", fmt.Sprint(b))
+	return block.Compare(ctx, sets[0], sets[1], tbc.tolerance, tbc.maxDifferences)
+}
+
+func bucketCompareTable(cmp *block.Comparison) Table {
+	return Table{
+		Header: []string{"", "SERIES", "SAMPLES"},
+		Lines: [][]string{
+			{"IN BOTH", strconv.Itoa(cmp.Series), ""},
+			{"EQUAL", "", strconv.Itoa(cmp.Samples)},
+			{"MERGED", "", strconv.Itoa(cmp.MergedSamples)},
+			{"ONLY IN A", strconv.Itoa(cmp.SeriesOnlyInA), strconv.Itoa(cmp.SamplesOnlyInA)},
+			{"ONLY IN B", strconv.Itoa(cmp.SeriesOnlyInB), strconv.Itoa(cmp.SamplesOnlyInB)},
+			{"DIFFERENT", "", strconv.Itoa(cmp.DifferentSamples)},
+		},
+	}
+}
+
+// changeCounter counts the series deleted or modified by a rewrite.
+type changeCounter struct {
+	compactv2.ChangeLogger
+
+	count int
+}
+
+func (c *changeCounter) DeleteSeries(del labels.Labels, intervals tombstones.Intervals) {
+	c.count++
+	c.ChangeLogger.DeleteSeries(del, intervals)
+}
+
+func (c *changeCounter) ModifySeries(old, new labels.Labels) {
+	c.count++
+	c.ChangeLogger.ModifySeries(old, new)
+}
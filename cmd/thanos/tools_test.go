@@ -4,12 +4,32 @@
 package main
 
 import (
+	"bytes"
+	"context"
+	"encoding/json"
 	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/go-kit/log"
+	"github.com/oklog/ulid"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/prometheus/model/labels"
+	"github.com/prometheus/prometheus/tsdb"
+	"github.com/thanos-io/objstore"
 
 	"github.com/efficientgo/core/testutil"
+	"github.com/prometheus/prometheus/tsdb/chunks"
+	"github.com/prometheus/prometheus/tsdb/record"
+	"github.com/prometheus/prometheus/tsdb/wlog"
+
+	"github.com/thanos-io/thanos/pkg/block"
+	"github.com/thanos-io/thanos/pkg/block/metadata"
+	"github.com/thanos-io/thanos/pkg/testutil/e2eutil"
 )
 
 func Test_CheckRules(t *testing.T) {
@@ -53,3 +73,271 @@ func Test_CheckRules_Glob(t *testing.T) {
 	testutil.NotOk(t, checkRulesFiles(logger, files), "expected err for file %s", files)
 	testutil.Ok(t, os.Chmod(filename, 0777), "failed to change file permissions of %s to 0777", filename)
 }
+
+func Test_BucketGC(t *testing.T) {
+	ctx := context.Background()
+	now := time.Now().Add(100 * time.Hour)
+
+	var (
+		complete  = ulid.MustNew(ulid.Timestamp(now.Add(-72*time.Hour)), bytes.NewReader(bytes.Repeat([]byte{1}, 16)))
+		orphaned  = ulid.MustNew(ulid.Timestamp(now.Add(-72*time.Hour)), bytes.NewReader(bytes.Repeat([]byte{2}, 16)))
+		uploading = ulid.MustNew(ulid.Timestamp(now.Add(-time.Hour)), bytes.NewReader(bytes.Repeat([]byte{3}, 16)))
+		corrupted = ulid.MustNew(ulid.Timestamp(now.Add(-72*time.Hour)), bytes.NewReader(bytes.Repeat([]byte{4}, 16)))
+	)
+
+	setup := func(t *testing.T) objstore.InstrumentedBucket {
+		bkt := objstore.NewInMemBucket()
+		upload := func(name, content string) {
+			testutil.Ok(t, bkt.Upload(ctx, name, bytes.NewBufferString(content)))
+		}
+
+		meta, err := json.Marshal(metadata.Meta{BlockMeta: tsdb.BlockMeta{ULID: complete, Version: metadata.TSDBVersion1}, Thanos: metadata.Thanos{Version: metadata.ThanosVersion1}})
+		testutil.Ok(t, err)
+		upload(path.Join(complete.String(), block.MetaFilename), string(meta))
+		upload(path.Join(complete.String(), block.IndexFilename), "index")
+		upload(path.Join(orphaned.String(), block.IndexFilename), "index")
+		upload(path.Join(orphaned.String(), block.ChunksDirname, "000001"), "chunks")
+		upload(path.Join(uploading.String(), block.ChunksDirname, "000001"), "chunks")
+		upload(path.Join(corrupted.String(), block.MetaFilename), "{")
+		upload(path.Join(block.DebugMetas, complete.String()+".json"), string(meta))
+		upload("unknown.txt", "unknown")
+		return objstore.WithNoopInstr(bkt)
+	}
+
+	t.Run("dry run", func(t *testing.T) {
+		bkt := setup(t)
+		tbl, err := bucketGC(ctx, log.NewNopLogger(), prometheus.NewRegistry(), bkt, &bucketGCConfig{minAge: 48 * time.Hour, blockSyncConcurrency: 1}, now)
+		testutil.Ok(t, err)
+		testutil.Equals(t, [][]string{
+			{orphaned.String() + "/", "orphaned block", "2", "11 B", tbl.Lines[0][4], "would delete"},
+			{uploading.String() + "/", "orphaned block", "1", "6 B", tbl.Lines[1][4], "skipped: too recent"},
+			{"unknown.txt", "unknown", "", "", "", "kept"},
+		}, tbl.Lines)
+
+		ok, err := bkt.Exists(ctx, path.Join(orphaned.String(), block.IndexFilename))
+		testutil.Ok(t, err)
+		testutil.Assert(t, ok, "dry run must not delete anything")
+	})
+
+	t.Run("delete", func(t *testing.T) {
+		bkt := setup(t)
+		_, err := bucketGC(ctx, log.NewNopLogger(), prometheus.NewRegistry(), bkt, &bucketGCConfig{minAge: 48 * time.Hour, delete: true, blockSyncConcurrency: 1}, now)
+		testutil.Ok(t, err)
+
+		for name, exists := range map[string]bool{
+			path.Join(complete.String(), block.MetaFilename):             true,
+			path.Join(orphaned.String(), block.IndexFilename):            false,
+			path.Join(orphaned.String(), block.ChunksDirname, "000001"):  false,
+			path.Join(uploading.String(), block.ChunksDirname, "000001"): true,
+			path.Join(corrupted.String(), block.MetaFilename):            true,
+			"unknown.txt": true,
+		} {
+			ok, err := bkt.Exists(ctx, name)
+			testutil.Ok(t, err)
+			testutil.Equals(t, exists, ok, name)
+		}
+	})
+}
+
+func Test_BucketCost(t *testing.T) {
+	ctx := context.Background()
+	now := time.Now()
+
+	var (
+		recent    = ulid.MustNew(ulid.Timestamp(now.Add(-time.Hour)), bytes.NewReader(bytes.Repeat([]byte{1}, 16)))
+		old       = ulid.MustNew(ulid.Timestamp(now.Add(-40*24*time.Hour)), bytes.NewReader(bytes.Repeat([]byte{2}, 16)))
+		noSizes   = ulid.MustNew(ulid.Timestamp(now.Add(-time.Hour)), bytes.NewReader(bytes.Repeat([]byte{3}, 16)))
+		otherTeam = ulid.MustNew(ulid.Timestamp(now.Add(-time.Hour)), bytes.NewReader(bytes.Repeat([]byte{4}, 16)))
+	)
+
+	bkt := objstore.NewInMemBucket()
+	upload := func(id ulid.ULID, tenant string, resolution int64, files []metadata.File) {
+		meta, err := json.Marshal(metadata.Meta{
+			BlockMeta: tsdb.BlockMeta{ULID: id, Version: metadata.TSDBVersion1},
+			Thanos: metadata.Thanos{
+				Version:    metadata.ThanosVersion1,
+				Labels:     map[string]string{"tenant": tenant},
+				Downsample: metadata.ThanosDownsample{Resolution: resolution},
+				Files:      files,
+			},
+		})
+		testutil.Ok(t, err)
+		testutil.Ok(t, bkt.Upload(ctx, path.Join(id.String(), block.MetaFilename), bytes.NewReader(meta)))
+	}
+	upload(recent, "a", 0, []metadata.File{{RelPath: block.IndexFilename, SizeBytes: 1 << 29}, {RelPath: block.MetaFilename}})
+	upload(old, "a", 0, []metadata.File{{RelPath: block.IndexFilename, SizeBytes: 1 << 30}})
+	upload(noSizes, "a", 5*60*1000, nil)
+	testutil.Ok(t, bkt.Upload(ctx, path.Join(noSizes.String(), block.IndexFilename), strings.NewReader("index")))
+	upload(otherTeam, "b", 0, []metadata.File{{RelPath: block.IndexFilename, SizeBytes: 1 << 30}})
+
+	pricing, err := parseBucketCostPricing([]byte(`
+price_per_gib_month: 0.02
+tiers:
+- name: archive
+  min_age: 90d
+  price_per_gib_month: 0.001
+- name: infrequent
+  min_age: 30d
+  price_per_gib_month: 0.01
+`))
+	testutil.Ok(t, err)
+
+	report, err := bucketCost(ctx, log.NewNopLogger(), prometheus.NewRegistry(), objstore.WithNoopInstr(bkt), &bucketCostConfig{groupBy: []string{"tenant"}, blockSyncConcurrency: 1}, pricing, now)
+	testutil.Ok(t, err)
+
+	metaSize := func(id ulid.ULID) int64 {
+		attrs, err := bkt.Attributes(ctx, path.Join(id.String(), block.MetaFilename))
+		testutil.Ok(t, err)
+		return attrs.Size
+	}
+	noSizesSize := metaSize(noSizes) + int64(len("index"))
+	testutil.Equals(t, "USD", report.Currency)
+	testutil.Equals(t, []bucketCostItem{
+		{Labels: map[string]string{"tenant": "a"}, Resolution: "raw", Tier: "default", Blocks: 1, SizeBytes: 1 << 29, MonthlyCost: 0.01},
+		{Labels: map[string]string{"tenant": "a"}, Resolution: "raw", Tier: "infrequent", Blocks: 1, SizeBytes: 1 << 30, MonthlyCost: 0.01},
+		{Labels: map[string]string{"tenant": "a"}, Resolution: "5m", Tier: "default", Blocks: 1, SizeBytes: noSizesSize, MonthlyCost: float64(noSizesSize) / (1 << 30) * 0.02, resolution: 5 * 60 * 1000},
+		{Labels: map[string]string{"tenant": "b"}, Resolution: "raw", Tier: "default", Blocks: 1, SizeBytes: 1 << 30, MonthlyCost: 0.02},
+	}, report.Groups)
+	testutil.Equals(t, 4, report.Total.Blocks)
+	testutil.Equals(t, int64(1<<29+1<<30+1<<30)+noSizesSize, report.Total.SizeBytes)
+
+	tbl := report.table()
+	testutil.Equals(t, []string{"LABELS", "RESOLUTION", "TIER", "#BLOCKS", "SIZE", "COST/MONTH (USD)"}, tbl.Header)
+	testutil.Equals(t, []string{`tenant="b"`, "raw", "default", "1", "1.0 GiB", "0.02"}, tbl.Lines[3])
+	testutil.Equals(t, []string{"TOTAL", "", "", "4", "2.5 GiB", "0.04"}, tbl.Lines[4])
+
+	for _, conf := range []string{
+		"price_per_gib_month: -1",
+		"tiers: [{name: cold, price_per_gib_month: 0.01}]",
+		"tiers: [{name: default, min_age: 30d}]",
+	} {
+		_, err := parseBucketCostPricing([]byte(conf))
+		testutil.NotOk(t, err, conf)
+	}
+}
+
+func Test_BucketCompare(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+
+	createBlock := func(resolution int64, series ...labels.Labels) ulid.ULID {
+		id, err := e2eutil.CreateBlock(ctx, dir, series, 100, 0, 1000, labels.FromStrings("ext", "1"), resolution, metadata.NoneFunc)
+		testutil.Ok(t, err)
+		return id
+	}
+	var (
+		a          = createBlock(0, labels.FromStrings("a", "1"), labels.FromStrings("a", "2"))
+		b          = createBlock(0, labels.FromStrings("a", "2"), labels.FromStrings("a", "3"))
+		downsample = createBlock(5*60*1000, labels.FromStrings("a", "1"))
+	)
+	bkt := objstore.NewInMemBucket()
+	for _, id := range []ulid.ULID{a, b, downsample} {
+		testutil.Ok(t, block.Upload(ctx, log.NewNopLogger(), bkt, filepath.Join(dir, id.String()), metadata.NoneFunc))
+	}
+	tbc := &bucketCompareConfig{dataDir: filepath.Join(dir, "compare"), maxDifferences: 10, blockFilesConcurrency: 1}
+
+	cmp, err := bucketCompare(ctx, log.NewNopLogger(), bkt, []ulid.ULID{a}, []ulid.ULID{a}, tbc)
+	testutil.Ok(t, err)
+	testutil.Equals(t, 2, cmp.Series)
+	testutil.Equals(t, 200, cmp.Samples)
+	testutil.Equals(t, 0, cmp.Discrepancies())
+
+	// Blocks are created with random values, so the samples of the common series differ too.
+	tbc.maxDifferences = 1
+	cmp, err = bucketCompare(ctx, log.NewNopLogger(), bkt, []ulid.ULID{a}, []ulid.ULID{b}, tbc)
+	testutil.Ok(t, err)
+	testutil.Equals(t, 1, cmp.SeriesOnlyInA)
+	testutil.Equals(t, 1, cmp.SeriesOnlyInB)
+	testutil.Equals(t, 100, cmp.DifferentSamples)
+	testutil.Equals(t, []string{`series {a="1"} is only in A`}, cmp.Differences)
+	tbl := bucketCompareTable(cmp)
+	testutil.Equals(t, []string{"ONLY IN A", "1", "0"}, tbl.Lines[3])
+	testutil.Equals(t, []string{"DIFFERENT", "", "100"}, tbl.Lines[5])
+
+	_, err = bucketCompare(ctx, log.NewNopLogger(), bkt, []ulid.ULID{a}, []ulid.ULID{downsample}, tbc)
+	testutil.NotOk(t, err)
+}
+
+func Test_VerifyWAL(t *testing.T) {
+	logger := log.NewNopLogger()
+	var enc record.Encoder
+
+	// setup writes a WAL with a checkpoint of segment 0 and three more segments, each with a new series and samples
+	// of all series created so far.
+	setup := func(t *testing.T) string {
+		dir := filepath.Join(t.TempDir(), "wal")
+		w, err := wlog.New(logger, nil, dir, wlog.CompressionNone)
+		testutil.Ok(t, err)
+
+		for i := 0; i < 4; i++ {
+			ref := chunks.HeadSeriesRef(i + 1)
+			testutil.Ok(t, w.Log(enc.Series([]record.RefSeries{{Ref: ref, Labels: labels.FromStrings("i", strconv.Itoa(i))}}, nil)))
+			var samples []record.RefSample
+			for r := chunks.HeadSeriesRef(1); r <= ref; r++ {
+				samples = append(samples, record.RefSample{Ref: r, T: int64(i), V: float64(i)})
+			}
+			testutil.Ok(t, w.Log(enc.Samples(samples, nil)))
+			_, err := w.NextSegmentSync()
+			testutil.Ok(t, err)
+		}
+		_, err = wlog.Checkpoint(logger, w, 0, 0, func(chunks.HeadSeriesRef) bool { return true }, 0)
+		testutil.Ok(t, err)
+		testutil.Ok(t, w.Close())
+		return dir
+	}
+
+	t.Run("valid", func(t *testing.T) {
+		r, err := verifyWAL(logger, setup(t))
+		testutil.Ok(t, err)
+		testutil.Equals(t, []walIssue(nil), r.issues)
+		testutil.Equals(t, "checkpoint.00000000", r.checkpoint)
+		// The checkpoint segment and segments 1 to 4. Segment 0 is covered by the checkpoint.
+		testutil.Equals(t, 5, r.segments)
+		testutil.Equals(t, 4, len(r.series))
+		testutil.Equals(t, 1+2+3+4, r.samples)
+	})
+	t.Run("unknown series", func(t *testing.T) {
+		dir := setup(t)
+		w, err := wlog.New(logger, nil, dir, wlog.CompressionNone)
+		testutil.Ok(t, err)
+		testutil.Ok(t, w.Log(enc.Samples([]record.RefSample{{Ref: 42, T: 5, V: 5}}, nil)))
+		testutil.Ok(t, w.Close())
+
+		r, err := verifyWAL(logger, dir)
+		testutil.Ok(t, err)
+		testutil.Equals(t, 1, len(r.issues))
+		testutil.Equals(t, "00000005", r.issues[0].segment)
+		testutil.Equals(t, "samples record references 1 unknown series, e.g. ref 42", r.issues[0].msg)
+	})
+	t.Run("missing segment", func(t *testing.T) {
+		dir := setup(t)
+		testutil.Ok(t, os.Remove(filepath.Join(dir, "00000002")))
+
+		r, err := verifyWAL(logger, dir)
+		testutil.Ok(t, err)
+		testutil.Equals(t, 2, len(r.issues))
+		testutil.Equals(t, "00000003", r.issues[0].segment)
+		testutil.Equals(t, "segments are not sequential, expected segment 2 after segment 1", r.issues[0].msg)
+		// Series 2 was created in the missing segment.
+		testutil.Equals(t, "samples record references 1 unknown series, e.g. ref 3", r.issues[1].msg)
+	})
+	t.Run("checksum mismatch", func(t *testing.T) {
+		dir := setup(t)
+		fn := filepath.Join(dir, "00000003")
+		b, err := os.ReadFile(fn)
+		testutil.Ok(t, err)
+		// Flip a bit in the data of the first record, right after its header.
+		b[8] ^= 1
+		testutil.Ok(t, os.WriteFile(fn, b, 0o644))
+
+		r, err := verifyWAL(logger, dir)
+		testutil.Ok(t, err)
+		testutil.Assert(t, len(r.issues) > 0)
+		testutil.Equals(t, "00000003", r.issues[0].segment)
+		testutil.Assert(t, strings.Contains(r.issues[0].msg, "unexpected checksum"), r.issues[0].msg)
+	})
+	t.Run("no WAL", func(t *testing.T) {
+		_, err := verifyWAL(logger, filepath.Join(t.TempDir(), "wal"))
+		testutil.NotOk(t, err)
+	})
+}
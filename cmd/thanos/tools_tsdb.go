@@ -0,0 +1,280 @@
+// Copyright (c) The Thanos Authors.
+// Licensed under the Apache License 2.0.
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+
+	"github.com/go-kit/log"
+	"github.com/go-kit/log/level"
+	"github.com/oklog/run"
+	"github.com/opentracing/opentracing-go"
+	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/prometheus/model/labels"
+	"github.com/prometheus/prometheus/tsdb/chunks"
+	"github.com/prometheus/prometheus/tsdb/record"
+	"github.com/prometheus/prometheus/tsdb/wlog"
+
+	"github.com/thanos-io/thanos/pkg/extkingpin"
+	"github.com/thanos-io/thanos/pkg/runutil"
+)
+
+type tsdbWALVerifyConfig struct {
+	path string
+}
+
+func (tc *tsdbWALVerifyConfig) registerFlag(cmd extkingpin.FlagClause) *tsdbWALVerifyConfig {
+	cmd.Flag("path", "Path to the TSDB directory holding the WAL in its wal subdirectory. For receive, this is the directory of the tenant in the TSDB path, e.g. <tsdb.path>/<tenant>.").
+		Required().StringVar(&tc.path)
+	return tc
+}
+
+func registerTSDB(app extkingpin.AppClause) {
+	cmd := app.Command("tsdb", "TSDB utility commands")
+
+	registerTSDBWALVerify(cmd)
+}
+
+func registerTSDBWALVerify(app extkingpin.AppClause) {
+	cmd := app.Command("wal-verify", "Replays the WAL of a TSDB, e.g. of a receive tenant, and reports inconsistencies without modifying it. "+
+		"Exits with a non-zero code if any inconsistency was found. Do not run it on a WAL which is being written to, since the last segment might be incomplete.")
+	tc := &tsdbWALVerifyConfig{}
+	tc.registerFlag(cmd)
+	cmd.Setup(func(g *run.Group, logger log.Logger, _ *prometheus.Registry, _ opentracing.Tracer, _ <-chan struct{}, _ bool) error {
+		// Dummy actor to immediately kill the group after the run function returns.
+		g.Add(func() error { return nil }, func(error) {})
+
+		r, err := verifyWAL(logger, filepath.Join(tc.path, "wal"))
+		if err != nil {
+			return err
+		}
+		if err := printTable(os.Stdout, r.table()); err != nil {
+			return err
+		}
+		level.Info(logger).Log("msg", "WAL verified", "checkpoint", r.checkpoint, "segments", r.segments, "records", r.records,
+			"series", len(r.series), "samples", r.samples, "issues", len(r.issues))
+		if len(r.issues) > 0 {
+			return errors.Errorf("found %d inconsistencies in WAL %s", len(r.issues), filepath.Join(tc.path, "wal"))
+		}
+		return nil
+	})
+}
+
+// walIssue is an inconsistency found in a WAL.
+type walIssue struct {
+	// segment is the path of the segment relative to the WAL directory.
+	segment string
+	offset  int64
+	msg     string
+}
+
+// walReport is the result of verifying a WAL.
+type walReport struct {
+	checkpoint string
+	segments   int
+	records    int
+	samples    int
+
+	series map[chunks.HeadSeriesRef]labels.Labels
+	issues []walIssue
+}
+
+func (r *walReport) table() Table {
+	t := Table{Header: []string{"SEGMENT", "OFFSET", "ISSUE"}}
+	for _, i := range r.issues {
+		offset := ""
+		if i.offset >= 0 {
+			offset = strconv.FormatInt(i.offset, 10)
+		}
+		t.Lines = append(t.Lines, []string{i.segment, offset, i.msg})
+	}
+	return t
+}
+
+func (r *walReport) addIssue(segment string, offset int64, format string, args ...interface{}) {
+	r.issues = append(r.issues, walIssue{segment: segment, offset: offset, msg: fmt.Sprintf(format, args...)})
+}
+
+// verifyWAL replays the WAL in dir the way the TSDB head does: the last checkpoint first, followed by the segments
+// after it. It reports segments which are missing or out of order, records which cannot be read, e.g. due to
+// checksum mismatches, records which cannot be decoded and records referencing series unknown at that point.
+// The WAL is only read, never repaired. Reading continues with the next segment after an unreadable record,
+// so series created in the rest of a corrupted segment are reported as unknown references afterwards.
+func verifyWAL(logger log.Logger, dir string) (*walReport, error) {
+	if _, err := os.Stat(dir); err != nil {
+		return nil, errors.Wrap(err, "stat WAL directory")
+	}
+	r := &walReport{series: map[chunks.HeadSeriesRef]labels.Labels{}}
+
+	checkpoint, checkpointIdx, err := wlog.LastCheckpoint(dir)
+	switch {
+	case errors.Is(err, record.ErrNotFound):
+		checkpointIdx = -1
+	case err != nil:
+		return nil, errors.Wrap(err, "find last checkpoint")
+	default:
+		r.checkpoint = filepath.Base(checkpoint)
+		segs, err := listWALSegments(checkpoint)
+		if err != nil {
+			return nil, errors.Wrap(err, "list checkpoint segments")
+		}
+		r.verifySegments(logger, dir, r.checkpoint, segs)
+	}
+
+	segs, err := listWALSegments(dir)
+	if err != nil {
+		return nil, errors.Wrap(err, "list segments")
+	}
+	// Segments up to the checkpoint are only left over if the WAL was not truncated after the checkpoint was written.
+	// The TSDB head skips them on replay.
+	for len(segs) > 0 && segs[0] <= checkpointIdx {
+		segs = segs[1:]
+	}
+	r.verifySegments(logger, dir, "", segs)
+	return r, nil
+}
+
+// listWALSegments returns the sorted indexes of the segments in dir.
+func listWALSegments(dir string) ([]int, error) {
+	files, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	var segs []int
+	for _, f := range files {
+		if f.IsDir() {
+			continue
+		}
+		k, err := strconv.Atoi(f.Name())
+		if err != nil {
+			continue
+		}
+		segs = append(segs, k)
+	}
+	sort.Ints(segs)
+	return segs, nil
+}
+
+// verifySegments reads the given segments of the subdirectory subdir of the WAL directory dir in order.
+func (r *walReport) verifySegments(logger log.Logger, dir, subdir string, segs []int) {
+	for i, k := range segs {
+		name := wlog.SegmentName(subdir, k)
+		if i > 0 && segs[i-1]+1 != k {
+			r.addIssue(name, -1, "segments are not sequential, expected segment %d after segment %d", segs[i-1]+1, segs[i-1])
+		}
+		r.verifySegment(logger, filepath.Join(dir, name), name)
+	}
+}
+
+func (r *walReport) verifySegment(logger log.Logger, fn, name string) {
+	seg, err := wlog.OpenReadSegment(fn)
+	if err != nil {
+		r.addIssue(name, -1, "open segment: %v", err)
+		return
+	}
+	rd := wlog.NewSegmentBufReader(seg)
+	defer runutil.CloseWithLogOnErr(logger, rd, "WAL segment reader")
+	r.segments++
+
+	var (
+		dec     = record.NewDecoder(labels.NewSymbolTable())
+		wr      = wlog.NewReader(rd)
+		series  []record.RefSeries
+		samples []record.RefSample
+		hists   []record.RefHistogramSample
+		fhists  []record.RefFloatHistogramSample
+		exs     []record.RefExemplar
+		meta    []record.RefMetadata
+		markers []record.RefMmapMarker
+	)
+	for {
+		offset := wr.Offset()
+		if !wr.Next() {
+			break
+		}
+		r.records++
+		rec := wr.Record()
+
+		var (
+			refs []chunks.HeadSeriesRef
+			err  error
+		)
+		switch typ := dec.Type(rec); typ {
+		case record.Series:
+			series, err = dec.Series(rec, series[:0])
+			for _, s := range series {
+				if lset, ok := r.series[s.Ref]; ok && !labels.Equal(lset, s.Labels) {
+					r.addIssue(name, offset, "series ref %d redefined from %s to %s", s.Ref, lset, s.Labels)
+				}
+				r.series[s.Ref] = s.Labels
+			}
+		case record.Samples:
+			samples, err = dec.Samples(rec, samples[:0])
+			r.samples += len(samples)
+			for _, s := range samples {
+				refs = append(refs, s.Ref)
+			}
+		case record.HistogramSamples:
+			hists, err = dec.HistogramSamples(rec, hists[:0])
+			r.samples += len(hists)
+			for _, s := range hists {
+				refs = append(refs, s.Ref)
+			}
+		case record.FloatHistogramSamples:
+			fhists, err = dec.FloatHistogramSamples(rec, fhists[:0])
+			r.samples += len(fhists)
+			for _, s := range fhists {
+				refs = append(refs, s.Ref)
+			}
+		case record.Exemplars:
+			exs, err = dec.Exemplars(rec, exs[:0])
+			for _, e := range exs {
+				refs = append(refs, e.Ref)
+			}
+		case record.Metadata:
+			meta, err = dec.Metadata(rec, meta[:0])
+			for _, m := range meta {
+				refs = append(refs, m.Ref)
+			}
+		case record.MmapMarkers:
+			markers, err = dec.MmapMarkers(rec, markers[:0])
+			for _, m := range markers {
+				refs = append(refs, m.Ref)
+			}
+		case record.Tombstones:
+			// Tombstones may reference series which were deleted already.
+			_, err = dec.Tombstones(rec, nil)
+		default:
+			r.addIssue(name, offset, "unknown record type %d", typ)
+			continue
+		}
+		if err != nil {
+			r.addIssue(name, offset, "decode %s record: %v", dec.Type(rec), err)
+			continue
+		}
+
+		var unknown []chunks.HeadSeriesRef
+		for _, ref := range refs {
+			if _, ok := r.series[ref]; !ok {
+				unknown = append(unknown, ref)
+			}
+		}
+		if len(unknown) > 0 {
+			r.addIssue(name, offset, "%s record references %d unknown series, e.g. ref %d", dec.Type(rec), len(unknown), unknown[0])
+		}
+	}
+	if err := wr.Err(); err != nil {
+		var cerr *wlog.CorruptionErr
+		if errors.As(err, &cerr) {
+			r.addIssue(name, cerr.Offset, "read record: %v", cerr.Err)
+			return
+		}
+		r.addIssue(name, wr.Offset(), "read record: %v", err)
+	}
+}
@@ -105,3 +105,8 @@ func TestSnappyCache(t *testing.T) {
 	cache := cache.NewSnappy(cache.NewMockCache(), log.NewNopLogger())
 	testCache(t, cache)
 }
+
+func TestChecksumCache(t *testing.T) {
+	cache := cache.NewChecksum(cache.NewMockCache(), nil, log.NewNopLogger())
+	testCache(t, cache)
+}
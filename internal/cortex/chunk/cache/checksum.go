@@ -0,0 +1,99 @@
+// Copyright (c) The Cortex Authors.
+// Licensed under the Apache License 2.0.
+
+package cache
+
+import (
+	"context"
+	"encoding/binary"
+	"hash/crc32"
+	"strings"
+
+	"github.com/go-kit/log"
+	"github.com/go-kit/log/level"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+const (
+	checksumSize = crc32.Size
+	// checksumVersion is the version of the format of entries stored with a checksum, stored in front of them.
+	checksumVersion byte = 1
+	// checksumKeyPrefix keeps entries stored with a checksum apart from entries of the same cache stored without one,
+	// e.g. by instances not upgraded yet during a rolling upgrade.
+	checksumKeyPrefix = "crc:"
+)
+
+var castagnoliTable = crc32.MakeTable(crc32.Castagnoli)
+
+type checksumCache struct {
+	next   Cache
+	logger log.Logger
+
+	mismatches prometheus.Counter
+}
+
+// NewChecksum makes a new cache wrapper which stores a version byte and a CRC32 checksum in front of
+// every entry, under keys of their own, and verifies them on fetch. Entries failing verification are
+// reported as missing, as are entries of an unknown version, silently.
+func NewChecksum(next Cache, reg prometheus.Registerer, logger log.Logger) Cache {
+	return &checksumCache{
+		next:   next,
+		logger: logger,
+		mismatches: promauto.With(reg).NewCounter(prometheus.CounterOpts{
+			Namespace: "cortex",
+			Name:      "cache_checksum_mismatches_total",
+			Help:      "Total count of cache entries discarded because of a checksum mismatch.",
+		}),
+	}
+}
+
+func (c *checksumCache) Store(ctx context.Context, keys []string, bufs [][]byte) {
+	cs := make([][]byte, 0, len(bufs))
+	for _, buf := range bufs {
+		b := make([]byte, 1+checksumSize+len(buf))
+		b[0] = checksumVersion
+		binary.BigEndian.PutUint32(b[1:], crc32.Checksum(buf, castagnoliTable))
+		copy(b[1+checksumSize:], buf)
+		cs = append(cs, b)
+	}
+	c.next.Store(ctx, prefixKeys(keys), cs)
+}
+
+func (c *checksumCache) Fetch(ctx context.Context, keys []string) ([]string, [][]byte, []string) {
+	found, bufs, missing := c.next.Fetch(ctx, prefixKeys(keys))
+	vfound := make([]string, 0, len(found))
+	vbufs := make([][]byte, 0, len(bufs))
+	vmissing := make([]string, 0, len(missing))
+	for _, key := range missing {
+		vmissing = append(vmissing, strings.TrimPrefix(key, checksumKeyPrefix))
+	}
+	for i, buf := range bufs {
+		key := strings.TrimPrefix(found[i], checksumKeyPrefix)
+		if len(buf) == 0 || buf[0] != checksumVersion {
+			vmissing = append(vmissing, key)
+			continue
+		}
+		if len(buf) < 1+checksumSize || binary.BigEndian.Uint32(buf[1:]) != crc32.Checksum(buf[1+checksumSize:], castagnoliTable) {
+			level.Warn(c.logger).Log("msg", "discarding cache entry with checksum mismatch", "key", key)
+			c.mismatches.Inc()
+			vmissing = append(vmissing, key)
+			continue
+		}
+		vfound = append(vfound, key)
+		vbufs = append(vbufs, buf[1+checksumSize:])
+	}
+	return vfound, vbufs, vmissing
+}
+
+func (c *checksumCache) Stop() {
+	c.next.Stop()
+}
+
+func prefixKeys(keys []string) []string {
+	prefixed := make([]string, 0, len(keys))
+	for _, key := range keys {
+		prefixed = append(prefixed, checksumKeyPrefix+key)
+	}
+	return prefixed
+}
@@ -0,0 +1,59 @@
+// Copyright (c) The Cortex Authors.
+// Licensed under the Apache License 2.0.
+
+package cache
+
+import (
+	"context"
+	"testing"
+
+	"github.com/go-kit/log"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/require"
+)
+
+func TestChecksumCache_Corruption(t *testing.T) {
+	ctx := context.Background()
+	reg := prometheus.NewPedanticRegistry()
+	next := NewMockCache().(*mockCache)
+	c := NewChecksum(next, reg, log.NewNopLogger())
+
+	c.Store(ctx, []string{"a", "b", "c"}, [][]byte{[]byte("foo"), []byte("bar"), []byte("baz")})
+
+	// Flip a payload bit of one entry and truncate another.
+	next.cache["crc:b"][len(next.cache["crc:b"])-1] ^= 0x01
+	next.cache["crc:c"] = next.cache["crc:c"][:2]
+
+	found, bufs, missing := c.Fetch(ctx, []string{"a", "b", "c", "d"})
+	require.Equal(t, []string{"a"}, found)
+	require.Equal(t, [][]byte{[]byte("foo")}, bufs)
+	require.ElementsMatch(t, []string{"b", "c", "d"}, missing)
+	require.Equal(t, 2.0, testutil.ToFloat64(c.(*checksumCache).mismatches))
+}
+
+func TestChecksumCache_Format(t *testing.T) {
+	ctx := context.Background()
+	reg := prometheus.NewPedanticRegistry()
+	next := NewMockCache().(*mockCache)
+	c := NewChecksum(next, reg, log.NewNopLogger())
+
+	// Entries stored without checksum, e.g. by instances not upgraded yet, are not read.
+	next.Store(ctx, []string{"a"}, [][]byte{[]byte("foo")})
+	found, _, missing := c.Fetch(ctx, []string{"a"})
+	require.Empty(t, found)
+	require.Equal(t, []string{"a"}, missing)
+
+	// Nor are entries stored with checksum read without it.
+	c.Store(ctx, []string{"b"}, [][]byte{[]byte("bar")})
+	found, _, missing = next.Fetch(ctx, []string{"b"})
+	require.Empty(t, found)
+	require.Equal(t, []string{"b"}, missing)
+
+	// Entries of an unknown version are silent misses.
+	next.cache["crc:b"][0] = checksumVersion + 1
+	found, _, missing = c.Fetch(ctx, []string{"b"})
+	require.Empty(t, found)
+	require.Equal(t, []string{"b"}, missing)
+	require.Equal(t, 0.0, testutil.ToFloat64(c.(*checksumCache).mismatches))
+}
@@ -177,6 +177,14 @@ func NewFifoCache(name string, cfg FifoCacheConfig, reg prometheus.Registerer, l
 	}
 }
 
+// Size returns the current number of entries and size in bytes of the cache.
+func (c *FifoCache) Size() (items int, bytes uint64) {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+
+	return len(c.entries), c.currSizeBytes
+}
+
 // Fetch implements Cache.
 func (c *FifoCache) Fetch(ctx context.Context, keys []string) (found []string, bufs [][]byte, missing []string) {
 	found, missing, bufs = make([]string, 0, len(keys)), make([]string, 0, len(keys)), make([][]byte, 0, len(keys))
@@ -54,6 +54,7 @@ type CacheGenNumberLoader interface {
 type ResultsCacheConfig struct {
 	CacheConfig                cache.Config `yaml:"cache"`
 	Compression                string       `yaml:"compression"`
+	Checksum                   bool         `yaml:"checksum"`
 	CacheQueryableSamplesStats bool         `yaml:"cache_queryable_samples_stats"`
 }
 
@@ -62,6 +63,7 @@ func (cfg *ResultsCacheConfig) RegisterFlags(f *flag.FlagSet) {
 	cfg.CacheConfig.RegisterFlagsWithPrefix("frontend.", "", f)
 
 	f.StringVar(&cfg.Compression, "frontend.compression", "", "Use compression in results cache. Supported values are: 'snappy' and '' (disable compression).")
+	f.BoolVar(&cfg.Checksum, "frontend.cache-checksum", false, "Store a checksum with results cache entries and treat entries failing verification as cache misses.")
 	f.BoolVar(&cfg.CacheQueryableSamplesStats, "frontend.cache-queryable-samples-stats", false, "Cache Statistics queryable samples on results cache.")
 }
 
@@ -173,6 +175,12 @@ type resultsCache struct {
 	cacheQueryableSamplesStats bool
 }
 
+// CacheBypassRequest is implemented by requests which can ask not to be served from the cache,
+// e.g. to replace a suspected stale entry. Their results are still cached.
+type CacheBypassRequest interface {
+	GetBypassCache() bool
+}
+
 // NewResultsCacheMiddleware creates results cache middleware from config.
 // The middleware cache result using a unique cache key for a given request (step,query,user) and interval.
 // The cache assumes that each request length (end-start) is below or equal the interval.
@@ -197,6 +205,11 @@ func NewResultsCacheMiddleware(
 	if cfg.Compression == "snappy" {
 		c = cache.NewSnappy(c, logger)
 	}
+	if cfg.Checksum {
+		// Verify cached responses against a checksum of their serialized form, so that
+		// corrupted entries are treated as misses rather than returned to the user.
+		c = cache.NewChecksum(c, reg, logger)
+	}
 
 	if cacheGenNumberLoader != nil {
 		c = cache.NewCacheGenNumMiddleware(c)
@@ -254,8 +267,10 @@ func (s resultsCache) Do(ctx context.Context, r Request) (Response, error) {
 		return s.next.Do(ctx, r)
 	}
 
-	cached, ok := s.get(ctx, key)
-	if ok {
+	if br, ok := r.(CacheBypassRequest); ok && br.GetBypassCache() {
+		// The fresh results replace the cached ones.
+		response, extents, err = s.handleMiss(ctx, r, maxCacheTime)
+	} else if cached, ok := s.get(ctx, key); ok {
 		response, extents, err = s.handleHit(ctx, r, cached, maxCacheTime)
 	} else {
 		response, extents, err = s.handleMiss(ctx, r, maxCacheTime)
@@ -401,6 +401,10 @@ func Test_evaluateAtModifier(t *testing.T) {
 				[2m:])
 			[10m:])`,
 		},
+		{
+			in:       "max_over_time(rate(http_requests_total[5m])[1h:1m] @ end()) - max_over_time(rate(http_requests_total[5m])[1h:1m])",
+			expected: "max_over_time(rate(http_requests_total[5m])[1h:1m] @ 1646300.800) - max_over_time(rate(http_requests_total[5m])[1h:1m])",
+		},
 		{
 			// parse error: @ modifier must be preceded by an instant vector selector or range vector selector or a subquery
 			in:                "sum(http_requests_total[5m]) @ 10.001",
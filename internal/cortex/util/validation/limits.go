@@ -74,16 +74,18 @@ type Limits struct {
 	MaxGlobalMetadataPerMetric          int `yaml:"max_global_metadata_per_metric" json:"max_global_metadata_per_metric"`
 
 	// Querier enforced limits.
-	MaxChunksPerQueryFromStore   int            `yaml:"max_chunks_per_query" json:"max_chunks_per_query"` // TODO Remove in Cortex 1.12.
-	MaxChunksPerQuery            int            `yaml:"max_fetched_chunks_per_query" json:"max_fetched_chunks_per_query"`
-	MaxFetchedSeriesPerQuery     int            `yaml:"max_fetched_series_per_query" json:"max_fetched_series_per_query"`
-	MaxFetchedChunkBytesPerQuery int            `yaml:"max_fetched_chunk_bytes_per_query" json:"max_fetched_chunk_bytes_per_query"`
-	MaxQueryLookback             model.Duration `yaml:"max_query_lookback" json:"max_query_lookback"`
-	MaxQueryLength               model.Duration `yaml:"max_query_length" json:"max_query_length"`
-	MaxQueryParallelism          int            `yaml:"max_query_parallelism" json:"max_query_parallelism"`
-	CardinalityLimit             int            `yaml:"cardinality_limit" json:"cardinality_limit"`
-	MaxCacheFreshness            model.Duration `yaml:"max_cache_freshness" json:"max_cache_freshness"`
-	MaxQueriersPerTenant         int            `yaml:"max_queriers_per_tenant" json:"max_queriers_per_tenant"`
+	MaxChunksPerQueryFromStore            int            `yaml:"max_chunks_per_query" json:"max_chunks_per_query"` // TODO Remove in Cortex 1.12.
+	MaxChunksPerQuery                     int            `yaml:"max_fetched_chunks_per_query" json:"max_fetched_chunks_per_query"`
+	MaxFetchedSeriesPerQuery              int            `yaml:"max_fetched_series_per_query" json:"max_fetched_series_per_query"`
+	MaxFetchedChunkBytesPerQuery          int            `yaml:"max_fetched_chunk_bytes_per_query" json:"max_fetched_chunk_bytes_per_query"`
+	MaxQueryLookback                      model.Duration `yaml:"max_query_lookback" json:"max_query_lookback"`
+	MaxQueryLength                        model.Duration `yaml:"max_query_length" json:"max_query_length"`
+	MaxQueryParallelism                   int            `yaml:"max_query_parallelism" json:"max_query_parallelism"`
+	CardinalityLimit                      int            `yaml:"cardinality_limit" json:"cardinality_limit"`
+	MaxCacheFreshness                     model.Duration `yaml:"max_cache_freshness" json:"max_cache_freshness"`
+	MaxQueriersPerTenant                  int            `yaml:"max_queriers_per_tenant" json:"max_queriers_per_tenant"`
+	RequireMetricNameForQueriesLongerThan model.Duration `yaml:"require_metric_name_for_queries_longer_than" json:"require_metric_name_for_queries_longer_than"`
+	AllowCacheBypass                      bool           `yaml:"allow_cache_bypass" json:"allow_cache_bypass"`
 
 	// Ruler defaults and limits.
 	RulerEvaluationDelay        model.Duration `yaml:"ruler_evaluation_delay_duration" json:"ruler_evaluation_delay_duration"`
@@ -429,6 +431,16 @@ func (o *Overrides) MaxQueryLength(userID string) time.Duration {
 	return time.Duration(o.getOverridesForUser(userID).MaxQueryLength)
 }
 
+// RequireMetricNameForQueriesLongerThan returns the time range above which query selectors must have a metric name.
+func (o *Overrides) RequireMetricNameForQueriesLongerThan(userID string) time.Duration {
+	return time.Duration(o.getOverridesForUser(userID).RequireMetricNameForQueriesLongerThan)
+}
+
+// AllowCacheBypass returns whether queries can ask to bypass reading the results cache.
+func (o *Overrides) AllowCacheBypass(userID string) bool {
+	return o.getOverridesForUser(userID).AllowCacheBypass
+}
+
 // MaxCacheFreshness returns the period after which results are cacheable,
 // to prevent caching of very recent results.
 func (o *Overrides) MaxCacheFreshness(userID string) time.Duration {
@@ -57,6 +57,8 @@ const (
 	ErrorExec     ErrorType = "execution"
 	ErrorBadData  ErrorType = "bad_data"
 	ErrorInternal ErrorType = "internal"
+	// ErrorUnavailable is returned when a store failed and partial response is disabled.
+	ErrorUnavailable ErrorType = "unavailable"
 )
 
 var corsHeaders = map[string]string{
@@ -201,13 +203,26 @@ func GetRuntimeInfoFunc(logger log.Logger) RuntimeInfoFn {
 
 type InstrFunc func(name string, f ApiFunc) http.HandlerFunc
 
-// GetInstr returns a http HandlerFunc with the instrumentation middleware.
+// GetInstr returns a http HandlerFunc with the instrumentation middleware, gzipping responses.
 func GetInstr(
 	tracer opentracing.Tracer,
 	logger log.Logger,
 	ins extpromhttp.InstrumentationMiddleware,
 	logMiddleware *logging.HTTPServerMiddleware,
 	disableCORS bool,
+) InstrFunc {
+	return GetInstrWithCompression(tracer, logger, ins, logMiddleware, disableCORS, gzhttp.GzipHandler)
+}
+
+// GetInstrWithCompression returns a http HandlerFunc with the instrumentation middleware, compressing responses
+// with the given wrapper, e.g. one returned by middleware.NewCompressionHandler.
+func GetInstrWithCompression(
+	tracer opentracing.Tracer,
+	logger log.Logger,
+	ins extpromhttp.InstrumentationMiddleware,
+	logMiddleware *logging.HTTPServerMiddleware,
+	disableCORS bool,
+	compress func(http.Handler) http.HandlerFunc,
 ) InstrFunc {
 	instr := func(name string, f ApiFunc) http.HandlerFunc {
 		hf := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
@@ -229,7 +244,7 @@ func GetInstr(
 		return middleware.RequestID(
 			tracing.HTTPMiddleware(tracer, name, logger,
 				ins.NewHandler(name,
-					gzhttp.GzipHandler(
+					compress(
 						logMiddleware.HTTPMiddleware(name, hf),
 					),
 				),
@@ -276,7 +291,7 @@ func RespondError(w http.ResponseWriter, apiErr *ApiError, data interface{}) {
 		code = http.StatusBadRequest
 	case ErrorExec:
 		code = 422
-	case ErrorCanceled, ErrorTimeout:
+	case ErrorCanceled, ErrorTimeout, ErrorUnavailable:
 		code = http.StatusServiceUnavailable
 	case ErrorInternal:
 		code = http.StatusInternalServerError
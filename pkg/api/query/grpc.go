@@ -19,6 +19,7 @@ import (
 	"github.com/thanos-io/thanos/pkg/query"
 	"github.com/thanos-io/thanos/pkg/store/labelpb"
 	"github.com/thanos-io/thanos/pkg/store/storepb/prompb"
+	"github.com/thanos-io/thanos/pkg/tenancy"
 	"github.com/thanos-io/thanos/pkg/tracing"
 )
 
@@ -30,6 +31,9 @@ type GRPCAPI struct {
 	defaultEngine               querypb.EngineType
 	lookbackDeltaCreate         func(int64) time.Duration
 	defaultMaxResolutionSeconds time.Duration
+	defaultTenant               string
+	// experimentalFunctionsTenants are the tenants allowed to use experimental PromQL functions.
+	experimentalFunctionsTenants map[string]struct{}
 
 	querypb.UnimplementedQueryServer
 }
@@ -42,7 +46,13 @@ func NewGRPCAPI(
 	defaultEngine querypb.EngineType,
 	lookbackDeltaCreate func(int64) time.Duration,
 	defaultMaxResolutionSeconds time.Duration,
+	defaultTenant string,
+	experimentalFunctionsTenants []string,
 ) *GRPCAPI {
+	experimentalTenants := make(map[string]struct{}, len(experimentalFunctionsTenants))
+	for _, tenant := range experimentalFunctionsTenants {
+		experimentalTenants[tenant] = struct{}{}
+	}
 	return &GRPCAPI{
 		now:                         now,
 		replicaLabels:               replicaLabels,
@@ -51,6 +61,9 @@ func NewGRPCAPI(
 		defaultEngine:               defaultEngine,
 		lookbackDeltaCreate:         lookbackDeltaCreate,
 		defaultMaxResolutionSeconds: defaultMaxResolutionSeconds,
+		defaultTenant:               defaultTenant,
+
+		experimentalFunctionsTenants: experimentalTenants,
 	}
 }
 
@@ -61,7 +74,7 @@ func RegisterQueryServer(queryServer querypb.QueryServer) func(*grpc.Server) {
 }
 
 func (g *GRPCAPI) Query(request *querypb.QueryRequest, server querypb.Query_QueryServer) error {
-	ctx := server.Context()
+	ctx := query.ContextWithTouchedSeries(server.Context())
 
 	if request.TimeoutSeconds != 0 {
 		var cancel context.CancelFunc
@@ -114,8 +127,9 @@ func (g *GRPCAPI) Query(request *querypb.QueryRequest, server querypb.Query_Quer
 		return status.Error(codes.Aborted, result.Err.Error())
 	}
 
-	if len(result.Warnings) != 0 {
-		if err := server.Send(querypb.NewQueryWarningsResponse(result.Warnings.AsErrors()...)); err != nil {
+	// Warnings are sent one by one, so that receivers can deduplicate them across queries.
+	for _, warn := range result.Warnings.AsErrors() {
+		if err := server.Send(querypb.NewQueryWarningsResponse(warn)); err != nil {
 			return err
 		}
 	}
@@ -166,12 +180,21 @@ func (g *GRPCAPI) getQueryForEngine(ctx context.Context, request *querypb.QueryR
 	}
 	switch engineParam {
 	case querypb.EngineType_prometheus:
+		if _, err := g.experimentalFunctionsEnabled(ctx, request.Query, nil); err != nil {
+			return nil, err
+		}
 		queryEngine := g.engineFactory.GetPrometheusEngine()
 		return queryEngine.NewInstantQuery(ctx, queryable, promql.NewPrometheusQueryOpts(false, lookbackDelta), request.Query, ts)
 	case querypb.EngineType_thanos:
-		queryEngine := g.engineFactory.GetThanosEngine()
-		plan, err := logicalplan.Unmarshal(request.QueryPlan.GetJson())
+		plan, planErr := logicalplan.Unmarshal(request.QueryPlan.GetJson())
+		if planErr != nil {
+			plan = nil
+		}
+		queryEngine, err := g.thanosEngine(ctx, request.Query, plan)
 		if err != nil {
+			return nil, err
+		}
+		if plan == nil {
 			return queryEngine.NewInstantQuery(ctx, queryable, promql.NewPrometheusQueryOpts(false, lookbackDelta), request.Query, ts)
 		}
 
@@ -182,7 +205,7 @@ func (g *GRPCAPI) getQueryForEngine(ctx context.Context, request *querypb.QueryR
 }
 
 func (g *GRPCAPI) QueryRange(request *querypb.QueryRangeRequest, srv querypb.Query_QueryRangeServer) error {
-	ctx := srv.Context()
+	ctx := query.ContextWithTouchedSeries(srv.Context())
 	if request.TimeoutSeconds != 0 {
 		var cancel context.CancelFunc
 		timeout := time.Duration(request.TimeoutSeconds) * time.Second
@@ -234,8 +257,9 @@ func (g *GRPCAPI) QueryRange(request *querypb.QueryRangeRequest, srv querypb.Que
 		return status.Error(codes.Aborted, result.Err.Error())
 	}
 
-	if len(result.Warnings) != 0 {
-		if err := srv.Send(querypb.NewQueryRangeWarningsResponse(result.Warnings.AsErrors()...)); err != nil {
+	// Warnings are sent one by one, so that receivers can deduplicate them across queries.
+	for _, warn := range result.Warnings.AsErrors() {
+		if err := srv.Send(querypb.NewQueryRangeWarningsResponse(warn)); err != nil {
 			return err
 		}
 	}
@@ -319,12 +343,21 @@ func (g *GRPCAPI) getRangeQueryForEngine(
 
 	switch engineParam {
 	case querypb.EngineType_prometheus:
+		if _, err := g.experimentalFunctionsEnabled(ctx, request.Query, nil); err != nil {
+			return nil, err
+		}
 		queryEngine := g.engineFactory.GetPrometheusEngine()
 		return queryEngine.NewRangeQuery(ctx, queryable, promql.NewPrometheusQueryOpts(false, lookbackDelta), request.Query, startTime, endTime, interval)
 	case querypb.EngineType_thanos:
-		thanosEngine := g.engineFactory.GetThanosEngine()
-		plan, err := logicalplan.Unmarshal(request.QueryPlan.GetJson())
+		plan, planErr := logicalplan.Unmarshal(request.QueryPlan.GetJson())
+		if planErr != nil {
+			plan = nil
+		}
+		thanosEngine, err := g.thanosEngine(ctx, request.Query, plan)
 		if err != nil {
+			return nil, err
+		}
+		if plan == nil {
 			return thanosEngine.NewRangeQuery(ctx, queryable, promql.NewPrometheusQueryOpts(false, lookbackDelta), request.Query, startTime, endTime, interval)
 		}
 		return thanosEngine.NewRangeQueryFromPlan(ctx, queryable, promql.NewPrometheusQueryOpts(false, lookbackDelta), plan, startTime, endTime, interval)
@@ -332,3 +365,43 @@ func (g *GRPCAPI) getRangeQueryForEngine(
 		return nil, status.Error(codes.InvalidArgument, "invalid engine parameter")
 	}
 }
+
+// thanosEngine returns the Thanos engine to evaluate the query of the tenant of the request with.
+func (g *GRPCAPI) thanosEngine(ctx context.Context, qs string, plan logicalplan.Node) (ThanosEngine, error) {
+	enabled, err := g.experimentalFunctionsEnabled(ctx, qs, plan)
+	if err != nil {
+		return nil, err
+	}
+	if enabled {
+		return g.engineFactory.GetThanosEngineWithXFunctions(), nil
+	}
+	return g.engineFactory.GetThanosEngine(), nil
+}
+
+// experimentalFunctionsEnabled reports whether the tenant of the request is allowed to use experimental PromQL
+// functions, and returns an error if the query uses them although it is not, like QueryAPI.engineForTenant. The
+// plan is checked instead of the query string if given, since it is what gets evaluated.
+func (g *GRPCAPI) experimentalFunctionsEnabled(ctx context.Context, qs string, plan logicalplan.Node) (bool, error) {
+	// Without allowed tenants, the engines reject experimental functions on their own.
+	if len(g.experimentalFunctionsTenants) == 0 {
+		return false, nil
+	}
+	tenant, ok := tenancy.GetTenantFromGRPCMetadata(ctx)
+	if !ok {
+		tenant = g.defaultTenant
+	}
+	if _, ok := g.experimentalFunctionsTenants[tenant]; ok {
+		return true, nil
+	}
+
+	var err error
+	if plan != nil {
+		err = checkPlanExperimentalFunctions(plan, g.engineFactory.enableXFunctions)
+	} else {
+		err = checkExperimentalFunctions(qs, g.engineFactory.enableXFunctions)
+	}
+	if err != nil {
+		return false, status.Errorf(codes.InvalidArgument, "tenant %s: %s", tenant, err)
+	}
+	return false, nil
+}
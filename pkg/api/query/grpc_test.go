@@ -5,6 +5,7 @@ package v1
 
 import (
 	"context"
+	"fmt"
 	"testing"
 	"time"
 
@@ -14,28 +15,33 @@ import (
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/prometheus/model/labels"
 	"github.com/prometheus/prometheus/promql"
+	"github.com/prometheus/prometheus/promql/parser"
 	"github.com/prometheus/prometheus/storage"
 	"github.com/prometheus/prometheus/util/annotations"
 	"github.com/thanos-io/promql-engine/logicalplan"
 	equery "github.com/thanos-io/promql-engine/query"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
 
 	"github.com/thanos-io/thanos/pkg/api/query/querypb"
 	"github.com/thanos-io/thanos/pkg/component"
 	"github.com/thanos-io/thanos/pkg/extpromql"
 	"github.com/thanos-io/thanos/pkg/query"
 	"github.com/thanos-io/thanos/pkg/store"
+	"github.com/thanos-io/thanos/pkg/tenancy"
 )
 
 func TestGRPCQueryAPIWithQueryPlan(t *testing.T) {
 	logger := log.NewNopLogger()
 	reg := prometheus.NewRegistry()
 	proxy := store.NewProxyStore(logger, reg, func() []store.Client { return nil }, component.Store, labels.EmptyLabels(), 1*time.Minute, store.LazyRetrieval)
-	queryableCreator := query.NewQueryableCreator(logger, reg, proxy, 1, 1*time.Minute)
+	queryableCreator := query.NewQueryableCreator(logger, reg, proxy, 1, 1*time.Minute, 0, 0, 0, nil, 0)
 	lookbackDeltaFunc := func(i int64) time.Duration { return 5 * time.Minute }
 	engineFactory := &QueryEngineFactory{
 		thanosEngine: &engineStub{},
 	}
-	api := NewGRPCAPI(time.Now, nil, queryableCreator, engineFactory, querypb.EngineType_thanos, lookbackDeltaFunc, 0)
+	api := NewGRPCAPI(time.Now, nil, queryableCreator, engineFactory, querypb.EngineType_thanos, lookbackDeltaFunc, 0, tenancy.DefaultTenant, nil)
 
 	expr, err := extpromql.ParseExpr("metric")
 	testutil.Ok(t, err)
@@ -76,7 +82,7 @@ func TestGRPCQueryAPIErrorHandling(t *testing.T) {
 	logger := log.NewNopLogger()
 	reg := prometheus.NewRegistry()
 	proxy := store.NewProxyStore(logger, reg, func() []store.Client { return nil }, component.Store, labels.EmptyLabels(), 1*time.Minute, store.LazyRetrieval)
-	queryableCreator := query.NewQueryableCreator(logger, reg, proxy, 1, 1*time.Minute)
+	queryableCreator := query.NewQueryableCreator(logger, reg, proxy, 1, 1*time.Minute, 0, 0, 0, nil, 0)
 	lookbackDeltaFunc := func(i int64) time.Duration { return 5 * time.Minute }
 	tests := []struct {
 		name   string
@@ -100,7 +106,7 @@ func TestGRPCQueryAPIErrorHandling(t *testing.T) {
 		engineFactory := &QueryEngineFactory{
 			prometheusEngine: test.engine,
 		}
-		api := NewGRPCAPI(time.Now, nil, queryableCreator, engineFactory, querypb.EngineType_prometheus, lookbackDeltaFunc, 0)
+		api := NewGRPCAPI(time.Now, nil, queryableCreator, engineFactory, querypb.EngineType_prometheus, lookbackDeltaFunc, 0, tenancy.DefaultTenant, nil)
 		t.Run("range_query", func(t *testing.T) {
 			rangeRequest := &querypb.QueryRangeRequest{
 				Query:            "metric",
@@ -148,6 +154,82 @@ func TestGRPCQueryAPIErrorHandling(t *testing.T) {
 	}
 }
 
+func TestGRPCQueryAPIExperimentalFunctions(t *testing.T) {
+	logger := log.NewNopLogger()
+	reg := prometheus.NewRegistry()
+	proxy := store.NewProxyStore(logger, reg, func() []store.Client { return nil }, component.Store, labels.EmptyLabels(), 1*time.Minute, store.LazyRetrieval)
+	queryableCreator := query.NewQueryableCreator(logger, reg, proxy, 1, 1*time.Minute, 0, 0, 0, nil, 0)
+	lookbackDeltaFunc := func(i int64) time.Duration { return 5 * time.Minute }
+	engineFactory := NewQueryEngineFactory(promql.EngineOpts{MaxSamples: 10000, Timeout: time.Minute}, nil, false)
+
+	// Like with --query.experimental-functions-tenant.
+	defer func(enabled bool) { parser.EnableExperimentalFunctions = enabled }(parser.EnableExperimentalFunctions)
+	parser.EnableExperimentalFunctions = true
+
+	for _, tc := range []struct {
+		engine        querypb.EngineType
+		tenant, query string
+		expectedErr   string
+	}{
+		{engine: querypb.EngineType_thanos, tenant: "trusted", query: "xrate(up[5m])"},
+		{engine: querypb.EngineType_thanos, tenant: "other", query: "rate(up[5m])"},
+		{engine: querypb.EngineType_thanos, tenant: "other", query: "sum(xincrease(up[5m]))", expectedErr: `tenant other: experimental function "xincrease" is not enabled`},
+		{engine: querypb.EngineType_thanos, tenant: "", query: "xrate(up[5m])", expectedErr: `tenant default-tenant: experimental function "xrate" is not enabled`},
+		{engine: querypb.EngineType_prometheus, tenant: "trusted", query: `sort_by_label(up, "job")`},
+		{engine: querypb.EngineType_prometheus, tenant: "other", query: `sort_by_label(up, "job")`, expectedErr: `tenant other: experimental function "sort_by_label" is not enabled`},
+	} {
+		expr, err := extpromql.ParseExpr(tc.query)
+		testutil.Ok(t, err)
+		planBytes, err := logicalplan.Marshal(logicalplan.NewFromAST(expr, &equery.Options{}, logicalplan.PlanOptions{}).Root())
+		testutil.Ok(t, err)
+
+		ctx := context.Background()
+		if tc.tenant != "" {
+			ctx = metadata.NewIncomingContext(ctx, metadata.Pairs(tenancy.DefaultTenantHeader, tc.tenant))
+		}
+		for _, plan := range []*querypb.QueryPlan{nil, {Encoding: &querypb.QueryPlan_Json{Json: planBytes}}} {
+			t.Run(fmt.Sprintf("%s %s %s plan=%t", tc.engine, tc.tenant, tc.query, plan != nil), func(t *testing.T) {
+				api := NewGRPCAPI(time.Now, nil, queryableCreator, engineFactory, tc.engine, lookbackDeltaFunc, 0, "default-tenant", []string{"trusted"})
+
+				rangeErr := api.QueryRange(&querypb.QueryRangeRequest{
+					Query:            tc.query,
+					StartTimeSeconds: 0,
+					IntervalSeconds:  10,
+					EndTimeSeconds:   300,
+					QueryPlan:        plan,
+				}, newQueryRangeServer(ctx))
+				instantErr := api.Query(&querypb.QueryRequest{
+					Query:          tc.query,
+					TimeoutSeconds: 60,
+					QueryPlan:      plan,
+				}, newQueryServer(ctx))
+
+				for _, err := range []error{rangeErr, instantErr} {
+					if tc.expectedErr == "" {
+						testutil.Ok(t, err)
+						continue
+					}
+					testutil.NotOk(t, err)
+					testutil.Equals(t, codes.InvalidArgument, status.Code(err))
+					testutil.Equals(t, tc.expectedErr, status.Convert(err).Message())
+				}
+			})
+		}
+	}
+
+	// The plan is what gets evaluated, so it is checked instead of the query string.
+	expr, err := extpromql.ParseExpr("xrate(up[5m])")
+	testutil.Ok(t, err)
+	planBytes, err := logicalplan.Marshal(logicalplan.NewFromAST(expr, &equery.Options{}, logicalplan.PlanOptions{}).Root())
+	testutil.Ok(t, err)
+	api := NewGRPCAPI(time.Now, nil, queryableCreator, engineFactory, querypb.EngineType_thanos, lookbackDeltaFunc, 0, "default-tenant", []string{"trusted"})
+	err = api.Query(&querypb.QueryRequest{
+		Query:     "rate(up[5m])",
+		QueryPlan: &querypb.QueryPlan{Encoding: &querypb.QueryPlan_Json{Json: planBytes}},
+	}, newQueryServer(metadata.NewIncomingContext(context.Background(), metadata.Pairs(tenancy.DefaultTenantHeader, "other"))))
+	testutil.Equals(t, codes.InvalidArgument, status.Code(err))
+}
+
 type engineStub struct {
 	promql.QueryEngine
 	err   error
@@ -0,0 +1,148 @@
+// Copyright (c) The Thanos Authors.
+// Licensed under the Apache License 2.0.
+
+package v1
+
+import (
+	"context"
+	"net/http"
+
+	"github.com/pkg/errors"
+	"github.com/prometheus/prometheus/model/labels"
+	"github.com/prometheus/prometheus/model/timestamp"
+
+	"github.com/thanos-io/thanos/pkg/api"
+	"github.com/thanos-io/thanos/pkg/store"
+	"github.com/thanos-io/thanos/pkg/store/labelpb"
+	"github.com/thanos-io/thanos/pkg/store/storepb"
+	"github.com/thanos-io/thanos/pkg/tenancy"
+)
+
+// RawChunksSeries is a series along with its raw encoded chunks, as returned by the stores.
+type RawChunksSeries struct {
+	Labels labels.Labels `json:"labels"`
+	Chunks []RawChunk    `json:"chunks"`
+}
+
+// RawChunk is an encoded chunk. Its data is encoded in base64 in JSON responses.
+type RawChunk struct {
+	MinTime  int64  `json:"minTime"`
+	MaxTime  int64  `json:"maxTime"`
+	Encoding string `json:"encoding"`
+	Data     []byte `json:"data"`
+}
+
+// rawChunksServer collects the responses of a Series call.
+type rawChunksServer struct {
+	// This field just exist to pseudo-implement the unused methods of the interface.
+	storepb.Store_SeriesServer
+	ctx context.Context
+
+	series   []RawChunksSeries
+	warnings []error
+}
+
+func (s *rawChunksServer) Send(r *storepb.SeriesResponse) error {
+	if w := r.GetWarning(); w != "" {
+		s.warnings = append(s.warnings, errors.New(w))
+		return nil
+	}
+	series := r.GetSeries()
+	if series == nil {
+		return nil
+	}
+
+	res := RawChunksSeries{
+		Labels: labelpb.LabelpbLabelsToPromLabels(series.Labels),
+		Chunks: make([]RawChunk, 0, len(series.Chunks)),
+	}
+	for _, c := range series.Chunks {
+		if c.Raw == nil {
+			continue
+		}
+		res.Chunks = append(res.Chunks, RawChunk{
+			MinTime:  c.MinTime,
+			MaxTime:  c.MaxTime,
+			Encoding: c.Raw.Type.String(),
+			Data:     c.Raw.Data,
+		})
+	}
+	s.series = append(s.series, res)
+	return nil
+}
+
+func (s *rawChunksServer) Context() context.Context {
+	return s.ctx
+}
+
+// rawChunks returns the raw encoded chunks of the series selected by a single selector of equality
+// matchers, which makes it possible to analyze the encoding of chunks offline.
+func (qapi *QueryAPI) rawChunks(r *http.Request) (interface{}, []error, *api.ApiError, func()) {
+	if err := r.ParseForm(); err != nil {
+		return nil, nil, &api.ApiError{Typ: api.ErrorInternal, Err: errors.Wrap(err, "parse form")}, func() {}
+	}
+
+	if len(r.Form[MatcherParam]) != 1 {
+		return nil, nil, &api.ApiError{Typ: api.ErrorBadData, Err: errors.New("exactly one match[] parameter must be provided")}, func() {}
+	}
+	if r.FormValue("start") == "" || r.FormValue("end") == "" {
+		return nil, nil, &api.ApiError{Typ: api.ErrorBadData, Err: errors.New("start and end parameters must be provided")}, func() {}
+	}
+
+	start, end, err := parseMetadataTimeRange(r, qapi.defaultMetadataTimeRange)
+	if err != nil {
+		return nil, nil, &api.ApiError{Typ: api.ErrorBadData, Err: err}, func() {}
+	}
+
+	matcherSets, ctx, err := tenancy.RewriteLabelMatchers(r.Context(), r, qapi.tenantHeader, qapi.defaultTenant, qapi.tenantCertField, qapi.enforceTenancy, qapi.tenantLabel, r.Form[MatcherParam])
+	if err != nil {
+		return nil, nil, &api.ApiError{Typ: api.ErrorBadData, Err: err}, func() {}
+	}
+	// Only exact matchers are allowed, so that chunks can only be fetched for a few specific series.
+	for _, m := range matcherSets[0] {
+		if m.Type != labels.MatchEqual || m.Value == "" {
+			return nil, nil, &api.ApiError{Typ: api.ErrorBadData, Err: errors.Errorf("only equality matchers with a non-empty value are allowed, got %s", m)}, func() {}
+		}
+	}
+	sms, err := storepb.PromMatchersToMatchers(matcherSets[0]...)
+	if err != nil {
+		return nil, nil, &api.ApiError{Typ: api.ErrorBadData, Err: err}, func() {}
+	}
+
+	storeDebugMatchers, apiErr := qapi.parseStoreDebugMatchersParam(r)
+	if apiErr != nil {
+		return nil, nil, apiErr, func() {}
+	}
+
+	limit, err := parseLimitParam(r.FormValue("limit"))
+	if err != nil {
+		return nil, nil, &api.ApiError{Typ: api.ErrorBadData, Err: err}, func() {}
+	}
+
+	enablePartialResponse, apiErr := qapi.parsePartialResponseParam(r, qapi.enableQueryPartialResponse)
+	if apiErr != nil {
+		return nil, nil, apiErr, func() {}
+	}
+	partialResponseStrategy := storepb.PartialResponseStrategy_ABORT
+	if enablePartialResponse {
+		partialResponseStrategy = storepb.PartialResponseStrategy_WARN
+	}
+
+	ctx = context.WithValue(ctx, store.StoreMatcherKey, storeDebugMatchers)
+	srv := &rawChunksServer{ctx: ctx}
+	if err := qapi.rawChunksStore.Series(&storepb.SeriesRequest{
+		MinTime:                 timestamp.FromTime(start),
+		MaxTime:                 timestamp.FromTime(end),
+		Limit:                   int64(limit),
+		Matchers:                sms,
+		Aggregates:              []storepb.Aggr{storepb.Aggr_RAW},
+		PartialResponseStrategy: partialResponseStrategy,
+	}, srv); err != nil {
+		return nil, nil, storeAPIError(api.ErrorExec, err), func() {}
+	}
+
+	if srv.series == nil {
+		srv.series = []RawChunksSeries{}
+	}
+	return srv.series, srv.warnings, nil, func() {}
+}
@@ -0,0 +1,113 @@
+// Copyright (c) The Thanos Authors.
+// Licensed under the Apache License 2.0.
+
+package v1
+
+import (
+	"net/http"
+	"net/url"
+	"testing"
+
+	"github.com/efficientgo/core/testutil"
+	"github.com/pkg/errors"
+	"github.com/prometheus/prometheus/model/labels"
+
+	baseAPI "github.com/thanos-io/thanos/pkg/api"
+	"github.com/thanos-io/thanos/pkg/store/labelpb"
+	"github.com/thanos-io/thanos/pkg/store/storepb"
+)
+
+type rawChunksTestStore struct {
+	storepb.StoreServer
+
+	req *storepb.SeriesRequest
+}
+
+func (s *rawChunksTestStore) Series(req *storepb.SeriesRequest, srv storepb.Store_SeriesServer) error {
+	s.req = req
+	if err := srv.Send(storepb.NewWarnSeriesResponse(errors.New("store unavailable"))); err != nil {
+		return err
+	}
+	return srv.Send(storepb.NewSeriesResponse(&storepb.Series{
+		Labels: labelpb.PromLabelsToLabelpbLabels(labels.FromStrings("__name__", "up", "job", "foo")),
+		Chunks: []*storepb.AggrChunk{
+			{MinTime: 0, MaxTime: 10, Raw: &storepb.Chunk{Type: storepb.Chunk_XOR, Data: []byte{1, 2, 3}}},
+			{MinTime: 11, MaxTime: 20, Raw: &storepb.Chunk{Type: storepb.Chunk_HISTOGRAM, Data: []byte{4, 5}}},
+		},
+	}))
+}
+
+func TestRawChunks(t *testing.T) {
+	s := &rawChunksTestStore{}
+	qapi := &QueryAPI{
+		baseAPI:        &baseAPI.BaseAPI{},
+		rawChunksStore: s,
+		tenantHeader:   "thanos-tenant",
+		defaultTenant:  "default-tenant",
+		tenantLabel:    "tenant_id",
+	}
+
+	for _, tc := range []struct {
+		name   string
+		params url.Values
+		err    bool
+	}{
+		{
+			name:   "missing matcher",
+			params: url.Values{"start": {"0"}, "end": {"1"}},
+			err:    true,
+		},
+		{
+			name:   "several matchers",
+			params: url.Values{"match[]": {`up{job="foo"}`, `up{job="bar"}`}, "start": {"0"}, "end": {"1"}},
+			err:    true,
+		},
+		{
+			name:   "missing time range",
+			params: url.Values{"match[]": {`up{job="foo"}`}},
+			err:    true,
+		},
+		{
+			name:   "regexp matcher",
+			params: url.Values{"match[]": {`up{job=~"foo.*"}`}, "start": {"0"}, "end": {"1"}},
+			err:    true,
+		},
+		{
+			name:   "empty equality matcher",
+			params: url.Values{"match[]": {`up{job=""}`}, "start": {"0"}, "end": {"1"}},
+			err:    true,
+		},
+		{
+			name:   "exact matchers",
+			params: url.Values{"match[]": {`up{job="foo"}`}, "start": {"0"}, "end": {"1"}, "limit": {"5"}},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			r, err := http.NewRequest(http.MethodGet, "/api/v1/debug/raw_chunks?"+tc.params.Encode(), nil)
+			testutil.Ok(t, err)
+
+			res, warnings, apiErr, _ := qapi.rawChunks(r)
+			if tc.err {
+				testutil.Assert(t, apiErr != nil, "expected error")
+				testutil.Equals(t, baseAPI.ErrorBadData, apiErr.Typ)
+				return
+			}
+			testutil.Assert(t, apiErr == nil, "unexpected error %v", apiErr)
+			testutil.Equals(t, 1, len(warnings))
+			testutil.Equals(t, "store unavailable", warnings[0].Error())
+			testutil.Equals(t, []RawChunksSeries{{
+				Labels: labels.FromStrings("__name__", "up", "job", "foo"),
+				Chunks: []RawChunk{
+					{MinTime: 0, MaxTime: 10, Encoding: "XOR", Data: []byte{1, 2, 3}},
+					{MinTime: 11, MaxTime: 20, Encoding: "HISTOGRAM", Data: []byte{4, 5}},
+				},
+			}}, res)
+
+			testutil.Equals(t, int64(0), s.req.MinTime)
+			testutil.Equals(t, int64(1000), s.req.MaxTime)
+			testutil.Equals(t, int64(5), s.req.Limit)
+			testutil.Equals(t, []storepb.Aggr{storepb.Aggr_RAW}, s.req.Aggregates)
+			testutil.Equals(t, 2, len(s.req.Matchers))
+		})
+	}
+}
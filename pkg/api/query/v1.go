@@ -31,6 +31,7 @@ import (
 	"time"
 
 	"github.com/go-kit/log"
+	"github.com/klauspost/compress/gzhttp"
 	"github.com/opentracing/opentracing-go"
 	"github.com/pkg/errors"
 	"github.com/prometheus/client_golang/prometheus"
@@ -42,11 +43,15 @@ import (
 	"github.com/prometheus/prometheus/promql"
 	"github.com/prometheus/prometheus/promql/parser"
 	"github.com/prometheus/prometheus/storage"
+	"github.com/prometheus/prometheus/tsdb/chunkenc"
 	"github.com/prometheus/prometheus/util/annotations"
 	"github.com/prometheus/prometheus/util/stats"
 	promqlapi "github.com/thanos-io/promql-engine/api"
 	"github.com/thanos-io/promql-engine/engine"
+	"github.com/thanos-io/promql-engine/execution/function"
 	"github.com/thanos-io/promql-engine/logicalplan"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
 
 	"github.com/thanos-io/thanos/pkg/api"
 	"github.com/thanos-io/thanos/pkg/exemplars"
@@ -85,6 +90,9 @@ const (
 	RuleNameParam            = "rule_name[]"
 	RuleGroupParam           = "rule_group[]"
 	FileParam                = "file[]"
+	DebugOriginParam         = "debug_origin"
+	StrictDedupParam         = "strict_dedup"
+	MergeHistogramsParam     = "merge_histograms"
 )
 
 type PromqlEngineType string
@@ -110,6 +118,9 @@ type QueryEngineFactory struct {
 	createThanosEngine sync.Once
 	thanosEngine       ThanosEngine
 	enableXFunctions   bool
+
+	createThanosXEngine sync.Once
+	thanosXEngine       ThanosEngine
 }
 
 func (f *QueryEngineFactory) GetPrometheusEngine() promql.QueryEngine {
@@ -125,25 +136,44 @@ func (f *QueryEngineFactory) GetPrometheusEngine() promql.QueryEngine {
 
 func (f *QueryEngineFactory) GetThanosEngine() ThanosEngine {
 	f.createThanosEngine.Do(func() {
-		opts := engine.Opts{
-			EngineOpts:       f.engineOpts,
-			Engine:           f.GetPrometheusEngine(),
-			EnableAnalysis:   true,
-			EnableXFunctions: f.enableXFunctions,
-		}
 		if f.thanosEngine != nil {
 			return
 		}
-		if f.remoteEngineEndpoints == nil {
-			f.thanosEngine = engine.New(opts)
-		} else {
-			f.thanosEngine = engine.NewDistributedEngine(opts, f.remoteEngineEndpoints)
-		}
+		f.thanosEngine = f.newThanosEngine(f.enableXFunctions)
 	})
 
 	return f.thanosEngine
 }
 
+// GetThanosEngineWithXFunctions returns the Thanos engine with the extended functions enabled, for queries of
+// tenants allowed to use experimental functions.
+func (f *QueryEngineFactory) GetThanosEngineWithXFunctions() ThanosEngine {
+	if f.enableXFunctions {
+		return f.GetThanosEngine()
+	}
+	f.createThanosXEngine.Do(func() {
+		if f.thanosXEngine != nil {
+			return
+		}
+		f.thanosXEngine = f.newThanosEngine(true)
+	})
+
+	return f.thanosXEngine
+}
+
+func (f *QueryEngineFactory) newThanosEngine(enableXFunctions bool) ThanosEngine {
+	opts := engine.Opts{
+		EngineOpts:       f.engineOpts,
+		Engine:           f.GetPrometheusEngine(),
+		EnableAnalysis:   true,
+		EnableXFunctions: enableXFunctions,
+	}
+	if f.remoteEngineEndpoints == nil {
+		return engine.New(opts)
+	}
+	return engine.NewDistributedEngine(opts, f.remoteEngineEndpoints)
+}
+
 func NewQueryEngineFactory(engineOpts promql.EngineOpts, remoteEngineEndpoints promqlapi.RemoteEndpoints, enableExtendedFunctions bool) *QueryEngineFactory {
 	return &QueryEngineFactory{
 		engineOpts:            engineOpts,
@@ -191,6 +221,20 @@ type QueryAPI struct {
 	tenantCertField string
 	enforceTenancy  bool
 	tenantLabel     string
+
+	// rawChunksStore serves the raw chunks debug endpoint, which is disabled if nil.
+	rawChunksStore storepb.StoreServer
+
+	// experimentalFunctionsTenants are the tenants allowed to use experimental PromQL functions.
+	experimentalFunctionsTenants map[string]struct{}
+
+	// compress compresses the responses of the query endpoints.
+	compress func(http.Handler) http.HandlerFunc
+
+	// histogramMerger merges classic histograms into native histograms for queries with the merge_histograms parameter.
+	histogramMerger *query.HistogramMerger
+	// autoDownsamplingPolicy selects the maximum source resolution of range queries with automatic downsampling.
+	autoDownsamplingPolicy query.AutoDownsamplingPolicy
 }
 
 // NewQueryAPI returns an initialized QueryAPI type.
@@ -225,10 +269,16 @@ func NewQueryAPI(
 	tenantCertField string,
 	enforceTenancy bool,
 	tenantLabel string,
+	rawChunksStore storepb.StoreServer,
+	experimentalFunctionsTenants []string,
 ) *QueryAPI {
 	if statsAggregatorFactory == nil {
 		statsAggregatorFactory = &store.NoopSeriesStatsAggregatorFactory{}
 	}
+	experimentalTenants := make(map[string]struct{}, len(experimentalFunctionsTenants))
+	for _, tenant := range experimentalFunctionsTenants {
+		experimentalTenants[tenant] = struct{}{}
+	}
 	return &QueryAPI{
 		baseAPI:                                api.NewBaseAPI(logger, disableCORS, flagsMap),
 		logger:                                 logger,
@@ -259,6 +309,10 @@ func NewQueryAPI(
 		tenantCertField:                        tenantCertField,
 		enforceTenancy:                         enforceTenancy,
 		tenantLabel:                            tenantLabel,
+		rawChunksStore:                         rawChunksStore,
+		experimentalFunctionsTenants:           experimentalTenants,
+		compress:                               gzhttp.GzipHandler,
+		histogramMerger:                        &query.HistogramMerger{},
 
 		queryRangeHist: promauto.With(reg).NewHistogram(prometheus.HistogramOpts{
 			Name:    "thanos_query_range_requested_timespan_duration_seconds",
@@ -268,11 +322,28 @@ func NewQueryAPI(
 	}
 }
 
+// SetCompression sets the wrapper compressing the responses of the query endpoints, gzip by default.
+func (qapi *QueryAPI) SetCompression(compress func(http.Handler) http.HandlerFunc) {
+	qapi.compress = compress
+}
+
+// SetHistogramMerger sets how queries with the merge_histograms parameter merge classic histograms into native
+// histograms. By default, native histograms are merged with the classic histograms of the same name.
+func (qapi *QueryAPI) SetHistogramMerger(m *query.HistogramMerger) {
+	qapi.histogramMerger = m
+}
+
+// SetAutoDownsamplingPolicy sets how the maximum source resolution of range queries is selected from their step,
+// when automatic downsampling is enabled or requested with max_source_resolution=auto. By default, step / 5 is used.
+func (qapi *QueryAPI) SetAutoDownsamplingPolicy(p query.AutoDownsamplingPolicy) {
+	qapi.autoDownsamplingPolicy = p
+}
+
 // Register the API's endpoints in the given router.
 func (qapi *QueryAPI) Register(r *route.Router, tracer opentracing.Tracer, logger log.Logger, ins extpromhttp.InstrumentationMiddleware, logMiddleware *logging.HTTPServerMiddleware) {
 	qapi.baseAPI.Register(r, tracer, logger, ins, logMiddleware)
 
-	instr := api.GetInstr(tracer, logger, ins, logMiddleware, qapi.disableCORS)
+	instr := api.GetInstrWithCompression(tracer, logger, ins, logMiddleware, qapi.disableCORS, qapi.compress)
 
 	r.Get("/query", instr("query", qapi.query))
 	r.Post("/query", instr("query", qapi.query))
@@ -286,16 +357,32 @@ func (qapi *QueryAPI) Register(r *route.Router, tracer opentracing.Tracer, logge
 	r.Get("/query_range_explain", instr("query", qapi.queryRangeExplain))
 	r.Post("/query_range_explain", instr("query", qapi.queryRangeExplain))
 
+	r.Get("/format_query", instr("format_query", qapi.formatQuery))
+	r.Post("/format_query", instr("format_query", qapi.formatQuery))
+
 	r.Get("/label/:name/values", instr("label_values", qapi.labelValues))
 
 	r.Get("/series", instr("series", qapi.series))
 	r.Post("/series", instr("series", qapi.series))
 
+	r.Get("/series/last_timestamp", instr("series_last_timestamp", qapi.seriesLastTimestamp))
+	r.Post("/series/last_timestamp", instr("series_last_timestamp", qapi.seriesLastTimestamp))
+
+	r.Get("/series/time_range", instr("series_time_range", qapi.seriesTimeRange))
+	r.Post("/series/time_range", instr("series_time_range", qapi.seriesTimeRange))
+
+	r.Get("/metric_names/stats", instr("metric_names_stats", qapi.metricNamesStats))
+	r.Post("/metric_names/stats", instr("metric_names_stats", qapi.metricNamesStats))
+
 	r.Get("/labels", instr("label_names", qapi.labelNames))
 	r.Post("/labels", instr("label_names", qapi.labelNames))
 
 	r.Get("/stores", instr("stores", qapi.stores))
 
+	if qapi.rawChunksStore != nil {
+		r.Get("/debug/raw_chunks", instr("raw_chunks", qapi.rawChunks))
+	}
+
 	r.Get("/alerts", instr("alerts", NewAlertsHandler(qapi.ruleGroups, qapi.enableRulePartialResponse)))
 	r.Get("/rules", instr("rules", NewRulesHandler(qapi.ruleGroups, qapi.enableRulePartialResponse)))
 
@@ -314,6 +401,21 @@ type queryData struct {
 	// Additional Thanos Response field.
 	QueryAnalysis queryTelemetry `json:"analysis,omitempty"`
 	Warnings      []error        `json:"warnings,omitempty"`
+	// Origins of the selected series, only set when requested with the debug_origin parameter.
+	Origins []store.SeriesOrigin `json:"origins,omitempty"`
+}
+
+// queryStats are the statistics of a query, including the maximum resolution of the data it read.
+type queryStats struct {
+	stats.BuiltinStats
+	MaxSourceResolution string `json:"maxSourceResolution"`
+}
+
+func newQueryStats(qry promql.Query, maxSourceResolutionMillis int64) *queryStats {
+	return &queryStats{
+		BuiltinStats:        stats.NewQueryStats(qry.Stats()).Builtin(),
+		MaxSourceResolution: model.Duration(time.Duration(maxSourceResolutionMillis) * time.Millisecond).String(),
+	}
 }
 
 type queryTelemetry struct {
@@ -339,6 +441,60 @@ func (qapi *QueryAPI) parseEnableDedupParam(r *http.Request) (enableDeduplicatio
 	return enableDeduplication, nil
 }
 
+// parseDebugOriginParam returns a tracker for the origin of the series selected by the query if it
+// was requested, nil otherwise.
+func (qapi *QueryAPI) parseDebugOriginParam(r *http.Request) (*store.OriginTracker, *api.ApiError) {
+	val := r.FormValue(DebugOriginParam)
+	if val == "" {
+		return nil, nil
+	}
+	enabled, err := strconv.ParseBool(val)
+	if err != nil {
+		return nil, &api.ApiError{Typ: api.ErrorBadData, Err: errors.Wrapf(err, "'%s' parameter", DebugOriginParam)}
+	}
+	if !enabled {
+		return nil, nil
+	}
+	return store.NewOriginTracker(), nil
+}
+
+// parseStrictDedupParam returns true if the query should report series whose replicas disagree.
+func (qapi *QueryAPI) parseStrictDedupParam(r *http.Request) (bool, *api.ApiError) {
+	val := r.FormValue(StrictDedupParam)
+	if val == "" {
+		return false, nil
+	}
+	strict, err := strconv.ParseBool(val)
+	if err != nil {
+		return false, &api.ApiError{Typ: api.ErrorBadData, Err: errors.Wrapf(err, "'%s' parameter", StrictDedupParam)}
+	}
+	return strict, nil
+}
+
+// parseMergeHistogramsParam returns true if the query should merge classic histograms into native histograms.
+func (qapi *QueryAPI) parseMergeHistogramsParam(r *http.Request) (bool, *api.ApiError) {
+	val := r.FormValue(MergeHistogramsParam)
+	if val == "" {
+		return false, nil
+	}
+	merge, err := strconv.ParseBool(val)
+	if err != nil {
+		return false, &api.ApiError{Typ: api.ErrorBadData, Err: errors.Wrapf(err, "'%s' parameter", MergeHistogramsParam)}
+	}
+	return merge, nil
+}
+
+// seriesOrigins returns the origins recorded by tracker, merging replicas if deduplication is enabled.
+func seriesOrigins(tracker *store.OriginTracker, enableDedup bool, replicaLabels []string) []store.SeriesOrigin {
+	if tracker == nil {
+		return nil
+	}
+	if !enableDedup {
+		return tracker.Origins()
+	}
+	return tracker.Origins(replicaLabels...)
+}
+
 func (qapi *QueryAPI) parseEngineParam(r *http.Request) (queryEngine promql.QueryEngine, e PromqlEngineType, _ *api.ApiError) {
 	var engine promql.QueryEngine
 
@@ -359,6 +515,69 @@ func (qapi *QueryAPI) parseEngineParam(r *http.Request) (queryEngine promql.Quer
 	return engine, param, nil
 }
 
+// engineForTenant checks that the experimental PromQL functions used by the query are enabled for the tenant, and
+// returns the engine of the given type to evaluate the query of the tenant with.
+func (qapi *QueryAPI) engineForTenant(engine promql.QueryEngine, engineType PromqlEngineType, tenant, qs string) (promql.QueryEngine, *api.ApiError) {
+	// Without allowed tenants, the engines reject experimental functions on their own.
+	if len(qapi.experimentalFunctionsTenants) == 0 {
+		return engine, nil
+	}
+	if _, ok := qapi.experimentalFunctionsTenants[tenant]; ok {
+		if engineType == PromqlEngineThanos {
+			return qapi.engineFactory.GetThanosEngineWithXFunctions(), nil
+		}
+		return engine, nil
+	}
+	if err := checkExperimentalFunctions(qs, qapi.engineFactory.enableXFunctions); err != nil {
+		return nil, &api.ApiError{Typ: api.ErrorBadData, Err: errors.Wrapf(err, "tenant %s", tenant)}
+	}
+	return engine, nil
+}
+
+// checkExperimentalFunctions returns an error naming the first experimental function used by the query. Extended
+// functions are not considered experimental if enableXFunctions is set. Queries which do not parse are left to the
+// engine to report.
+func checkExperimentalFunctions(qs string, enableXFunctions bool) error {
+	expr, err := extpromql.ParseExpr(qs)
+	if err != nil {
+		return nil
+	}
+	parser.Inspect(expr, func(node parser.Node, _ []parser.Node) error {
+		call, ok := node.(*parser.Call)
+		if !ok || err != nil {
+			return nil
+		}
+		err = checkExperimentalFunction(call.Func.Name, enableXFunctions)
+		return nil
+	})
+	return err
+}
+
+// checkPlanExperimentalFunctions is checkExperimentalFunctions for a query given as a logical plan.
+func checkPlanExperimentalFunctions(plan logicalplan.Node, enableXFunctions bool) error {
+	var err error
+	logicalplan.Traverse(&plan, func(node *logicalplan.Node) {
+		call, ok := (*node).(*logicalplan.FunctionCall)
+		if !ok || err != nil {
+			return
+		}
+		err = checkExperimentalFunction(call.Func.Name, enableXFunctions)
+	})
+	return err
+}
+
+// checkExperimentalFunction returns an error if the function with the given name is experimental. The function is
+// looked up by name, since the definitions in plans received from other queriers cannot be trusted.
+func checkExperimentalFunction(name string, enableXFunctions bool) error {
+	if _, ok := function.XFunctions[name]; ok && !enableXFunctions {
+		return errors.Errorf("experimental function %q is not enabled", name)
+	}
+	if f, ok := parser.Functions[name]; ok && f.Experimental {
+		return errors.Errorf("experimental function %q is not enabled", name)
+	}
+	return nil
+}
+
 func (qapi *QueryAPI) parseReplicaLabelsParam(r *http.Request) (replicaLabels []string, _ *api.ApiError) {
 	if err := r.ParseForm(); err != nil {
 		return nil, &api.ApiError{Typ: api.ErrorInternal, Err: errors.Wrap(err, "parse form")}
@@ -425,6 +644,40 @@ func (qapi *QueryAPI) parseDownsamplingParamMillis(r *http.Request, defaultVal t
 }
 
 func (qapi *QueryAPI) parsePartialResponseParam(r *http.Request, defaultEnablePartialResponse bool) (enablePartialResponse bool, _ *api.ApiError) {
+	return parsePartialResponseParam(r, defaultEnablePartialResponse)
+}
+
+// partialResponseStrategy returns the partial response strategy requested with the partial_response
+// parameter, or the one of the given default if the parameter is not set.
+func partialResponseStrategy(r *http.Request, defaultEnablePartialResponse bool) (storepb.PartialResponseStrategy, *api.ApiError) {
+	enablePartialResponse, apiErr := parsePartialResponseParam(r, defaultEnablePartialResponse)
+	if apiErr != nil {
+		return storepb.PartialResponseStrategy_ABORT, apiErr
+	}
+	if enablePartialResponse {
+		return storepb.PartialResponseStrategy_WARN, nil
+	}
+	return storepb.PartialResponseStrategy_ABORT, nil
+}
+
+// storeAPIError returns an API error of the given type for err, unless err was caused by a store
+// failing while partial response is disabled, in which case the error is of type unavailable.
+func storeAPIError(typ api.ErrorType, err error) *api.ApiError {
+	cause := err
+	if serr, ok := err.(promql.ErrStorage); ok {
+		cause = serr.Err
+	}
+	var se interface{ GRPCStatus() *status.Status }
+	if errors.As(cause, &se) {
+		switch se.GRPCStatus().Code() {
+		case codes.Aborted, codes.Unavailable:
+			typ = api.ErrorUnavailable
+		}
+	}
+	return &api.ApiError{Typ: typ, Err: err}
+}
+
+func parsePartialResponseParam(r *http.Request, defaultEnablePartialResponse bool) (enablePartialResponse bool, _ *api.ApiError) {
 	// Overwrite the cli flag when provided as a query parameter.
 	if val := r.FormValue(PartialResponseParam); val != "" {
 		var err error
@@ -499,6 +752,15 @@ func processAnalysis(a *engine.AnalyzeOutputNode) queryTelemetry {
 	return analysis
 }
 
+// formatQuery parses the query and returns it pretty-printed, like the format_query endpoint of Prometheus.
+func (qapi *QueryAPI) formatQuery(r *http.Request) (interface{}, []error, *api.ApiError, func()) {
+	expr, err := extpromql.ParseExpr(r.FormValue("query"))
+	if err != nil {
+		return nil, nil, &api.ApiError{Typ: api.ErrorBadData, Err: errors.Wrap(err, `invalid parameter "query"`)}, func() {}
+	}
+	return expr.Pretty(0), nil, nil, func() {}
+}
+
 func (qapi *QueryAPI) queryExplain(r *http.Request) (interface{}, []error, *api.ApiError, func()) {
 	engine, engineParam, apiErr := qapi.parseEngineParam(r)
 	if apiErr != nil {
@@ -572,6 +834,17 @@ func (qapi *QueryAPI) queryExplain(r *http.Request) (interface{}, []error, *api.
 		return nil, nil, apiErr, func() {}
 	}
 	ctx = context.WithValue(ctx, tenancy.TenantKey, tenant)
+	engine, apiErr = qapi.engineForTenant(engine, engineParam, tenant, r.FormValue("query"))
+	if apiErr != nil {
+		return nil, nil, apiErr, func() {}
+	}
+
+	priority, err := store.GetPriorityFromHTTP(r)
+	if err != nil {
+		apiErr = &api.ApiError{Typ: api.ErrorBadData, Err: err}
+		return nil, nil, apiErr, func() {}
+	}
+	ctx = store.ContextWithPriority(ctx, priority)
 
 	var seriesStats []storepb.SeriesStatsCounter
 	qry, err := engine.NewInstantQuery(
@@ -651,11 +924,36 @@ func (qapi *QueryAPI) query(r *http.Request) (interface{}, []error, *api.ApiErro
 		return nil, nil, apiErr, func() {}
 	}
 
-	engine, _, apiErr := qapi.parseEngineParam(r)
+	engine, engineParam, apiErr := qapi.parseEngineParam(r)
 	if apiErr != nil {
 		return nil, nil, apiErr, func() {}
 	}
 
+	originTracker, apiErr := qapi.parseDebugOriginParam(r)
+	if apiErr != nil {
+		return nil, nil, apiErr, func() {}
+	}
+	if originTracker != nil {
+		ctx = store.WithOriginTracker(ctx, originTracker)
+	}
+
+	strictDedup, apiErr := qapi.parseStrictDedupParam(r)
+	if apiErr != nil {
+		return nil, nil, apiErr, func() {}
+	}
+	if strictDedup {
+		ctx = query.ContextWithStrictDedup(ctx)
+	}
+
+	mergeHistograms, apiErr := qapi.parseMergeHistogramsParam(r)
+	if apiErr != nil {
+		return nil, nil, apiErr, func() {}
+	}
+	if mergeHistograms {
+		ctx = query.ContextWithHistogramMerge(ctx, qapi.histogramMerger)
+	}
+	ctx = query.ContextWithTouchedSeries(ctx)
+
 	lookbackDelta := qapi.lookbackDeltaCreate(maxSourceResolution)
 	// Get custom lookback delta from request.
 	lookbackDeltaFromReq, apiErr := qapi.parseLookbackDeltaParam(r)
@@ -670,6 +968,10 @@ func (qapi *QueryAPI) query(r *http.Request) (interface{}, []error, *api.ApiErro
 	if err != nil {
 		return nil, nil, &api.ApiError{Typ: api.ErrorBadData, Err: err}, func() {}
 	}
+	engine, apiErr = qapi.engineForTenant(engine, engineParam, tenant, queryStr)
+	if apiErr != nil {
+		return nil, nil, apiErr, func() {}
+	}
 
 	var (
 		qry         promql.Query
@@ -720,9 +1022,9 @@ func (qapi *QueryAPI) query(r *http.Request) (interface{}, []error, *api.ApiErro
 		case promql.ErrQueryTimeout:
 			return nil, nil, &api.ApiError{Typ: api.ErrorTimeout, Err: res.Err}, qry.Close
 		case promql.ErrStorage:
-			return nil, nil, &api.ApiError{Typ: api.ErrorInternal, Err: res.Err}, qry.Close
+			return nil, nil, storeAPIError(api.ErrorInternal, res.Err), qry.Close
 		}
-		return nil, nil, &api.ApiError{Typ: api.ErrorExec, Err: res.Err}, qry.Close
+		return nil, nil, storeAPIError(api.ErrorExec, res.Err), qry.Close
 	}
 
 	aggregator := qapi.seriesStatsAggregatorFactory.NewAggregator(tenant)
@@ -734,13 +1036,14 @@ func (qapi *QueryAPI) query(r *http.Request) (interface{}, []error, *api.ApiErro
 	// Optional stats field in response if parameter "stats" is not empty.
 	var qs stats.QueryStats
 	if r.FormValue(Stats) != "" {
-		qs = stats.NewQueryStats(qry.Stats())
+		qs = newQueryStats(qry, maxSourceResolution)
 	}
 	return &queryData{
 		ResultType:    res.Value.Type(),
 		Result:        res.Value,
 		Stats:         qs,
 		QueryAnalysis: analysis,
+		Origins:       seriesOrigins(originTracker, enableDedup, replicaLabels),
 	}, res.Warnings.AsErrors(), nil, qry.Close
 }
 
@@ -811,8 +1114,8 @@ func (qapi *QueryAPI) queryRangeExplain(r *http.Request) (interface{}, []error,
 		return nil, nil, apiErr, func() {}
 	}
 
-	// If no max_source_resolution is specified fit at least 5 samples between steps.
-	maxSourceResolution, apiErr := qapi.parseDownsamplingParamMillis(r, step/5)
+	// If no max_source_resolution is specified, select it from the step.
+	maxSourceResolution, apiErr := qapi.parseDownsamplingParamMillis(r, qapi.autoDownsamplingPolicy.MaxSourceResolution(step))
 	if apiErr != nil {
 		return nil, nil, apiErr, func() {}
 	}
@@ -843,6 +1146,17 @@ func (qapi *QueryAPI) queryRangeExplain(r *http.Request) (interface{}, []error,
 		return nil, nil, apiErr, func() {}
 	}
 	ctx = context.WithValue(ctx, tenancy.TenantKey, tenant)
+	engine, apiErr = qapi.engineForTenant(engine, engineParam, tenant, r.FormValue("query"))
+	if apiErr != nil {
+		return nil, nil, apiErr, func() {}
+	}
+
+	priority, err := store.GetPriorityFromHTTP(r)
+	if err != nil {
+		apiErr = &api.ApiError{Typ: api.ErrorBadData, Err: err}
+		return nil, nil, apiErr, func() {}
+	}
+	ctx = store.ContextWithPriority(ctx, priority)
 
 	var seriesStats []storepb.SeriesStatsCounter
 	qry, err := engine.NewRangeQuery(
@@ -933,8 +1247,8 @@ func (qapi *QueryAPI) queryRange(r *http.Request) (interface{}, []error, *api.Ap
 		return nil, nil, apiErr, func() {}
 	}
 
-	// If no max_source_resolution is specified fit at least 5 samples between steps.
-	maxSourceResolution, apiErr := qapi.parseDownsamplingParamMillis(r, step/5)
+	// If no max_source_resolution is specified, select it from the step.
+	maxSourceResolution, apiErr := qapi.parseDownsamplingParamMillis(r, qapi.autoDownsamplingPolicy.MaxSourceResolution(step))
 	if apiErr != nil {
 		return nil, nil, apiErr, func() {}
 	}
@@ -949,10 +1263,35 @@ func (qapi *QueryAPI) queryRange(r *http.Request) (interface{}, []error, *api.Ap
 		return nil, nil, apiErr, func() {}
 	}
 
-	engine, _, apiErr := qapi.parseEngineParam(r)
+	engine, engineParam, apiErr := qapi.parseEngineParam(r)
+	if apiErr != nil {
+		return nil, nil, apiErr, func() {}
+	}
+
+	originTracker, apiErr := qapi.parseDebugOriginParam(r)
+	if apiErr != nil {
+		return nil, nil, apiErr, func() {}
+	}
+	if originTracker != nil {
+		ctx = store.WithOriginTracker(ctx, originTracker)
+	}
+
+	strictDedup, apiErr := qapi.parseStrictDedupParam(r)
 	if apiErr != nil {
 		return nil, nil, apiErr, func() {}
 	}
+	if strictDedup {
+		ctx = query.ContextWithStrictDedup(ctx)
+	}
+
+	mergeHistograms, apiErr := qapi.parseMergeHistogramsParam(r)
+	if apiErr != nil {
+		return nil, nil, apiErr, func() {}
+	}
+	if mergeHistograms {
+		ctx = query.ContextWithHistogramMerge(ctx, qapi.histogramMerger)
+	}
+	ctx = query.ContextWithTouchedSeries(ctx)
 
 	lookbackDelta := qapi.lookbackDeltaCreate(maxSourceResolution)
 	// Get custom lookback delta from request.
@@ -968,6 +1307,10 @@ func (qapi *QueryAPI) queryRange(r *http.Request) (interface{}, []error, *api.Ap
 	if err != nil {
 		return nil, nil, &api.ApiError{Typ: api.ErrorBadData, Err: err}, func() {}
 	}
+	engine, apiErr = qapi.engineForTenant(engine, engineParam, tenant, queryStr)
+	if apiErr != nil {
+		return nil, nil, apiErr, func() {}
+	}
 
 	// Record the query range requested.
 	qapi.queryRangeHist.Observe(end.Sub(start).Seconds())
@@ -1023,7 +1366,7 @@ func (qapi *QueryAPI) queryRange(r *http.Request) (interface{}, []error, *api.Ap
 		case promql.ErrQueryTimeout:
 			return nil, nil, &api.ApiError{Typ: api.ErrorTimeout, Err: res.Err}, qry.Close
 		}
-		return nil, nil, &api.ApiError{Typ: api.ErrorExec, Err: res.Err}, qry.Close
+		return nil, nil, storeAPIError(api.ErrorExec, res.Err), qry.Close
 	}
 	aggregator := qapi.seriesStatsAggregatorFactory.NewAggregator(tenant)
 	for i := range seriesStats {
@@ -1034,13 +1377,14 @@ func (qapi *QueryAPI) queryRange(r *http.Request) (interface{}, []error, *api.Ap
 	// Optional stats field in response if parameter "stats" is not empty.
 	var qs stats.QueryStats
 	if r.FormValue(Stats) != "" {
-		qs = stats.NewQueryStats(qry.Stats())
+		qs = newQueryStats(qry, maxSourceResolution)
 	}
 	return &queryData{
 		ResultType:    res.Value.Type(),
 		Result:        res.Value,
 		Stats:         qs,
 		QueryAnalysis: analysis,
+		Origins:       seriesOrigins(originTracker, enableDedup, replicaLabels),
 	}, res.Warnings.AsErrors(), nil, qry.Close
 }
 
@@ -1107,7 +1451,7 @@ func (qapi *QueryAPI) labelValues(r *http.Request) (interface{}, []error, *api.A
 		for _, matchers := range matcherSets {
 			vals, callWarnings, err = q.LabelValues(ctx, name, hints, matchers...)
 			if err != nil {
-				return nil, nil, &api.ApiError{Typ: api.ErrorExec, Err: err}, func() {}
+				return nil, nil, storeAPIError(api.ErrorExec, err), func() {}
 			}
 			warnings.Merge(callWarnings)
 			for _, val := range vals {
@@ -1123,7 +1467,7 @@ func (qapi *QueryAPI) labelValues(r *http.Request) (interface{}, []error, *api.A
 	} else {
 		vals, warnings, err = q.LabelValues(ctx, name, hints)
 		if err != nil {
-			return nil, nil, &api.ApiError{Typ: api.ErrorExec, Err: err}, func() {}
+			return nil, nil, storeAPIError(api.ErrorExec, err), func() {}
 		}
 	}
 
@@ -1226,11 +1570,352 @@ func (qapi *QueryAPI) series(r *http.Request) (interface{}, []error, *api.ApiErr
 		}
 	}
 	if set.Err() != nil {
-		return nil, nil, &api.ApiError{Typ: api.ErrorExec, Err: set.Err()}, func() {}
+		return nil, nil, storeAPIError(api.ErrorExec, set.Err()), func() {}
 	}
 	return metrics, warnings.AsErrors(), nil, func() {}
 }
 
+// SeriesLastTimestamp is the timestamp of the last sample of a series.
+type SeriesLastTimestamp struct {
+	Metric    labels.Labels `json:"metric"`
+	Timestamp model.Time    `json:"timestamp"`
+}
+
+// seriesLastTimestamp returns the timestamp of the last raw sample of each series matching the given selectors
+// within the requested time range. Stores are hinted to only return the chunks which can contain the last sample,
+// so it is much cheaper than querying all samples, e.g. with a range query.
+func (qapi *QueryAPI) seriesLastTimestamp(r *http.Request) (interface{}, []error, *api.ApiError, func()) {
+	if err := r.ParseForm(); err != nil {
+		return nil, nil, &api.ApiError{Typ: api.ErrorInternal, Err: errors.Wrap(err, "parse form")}, func() {}
+	}
+
+	if len(r.Form[MatcherParam]) == 0 {
+		return nil, nil, &api.ApiError{Typ: api.ErrorBadData, Err: errors.New("no match[] parameter provided")}, func() {}
+	}
+
+	start, end, err := parseMetadataTimeRange(r, qapi.defaultMetadataTimeRange)
+	if err != nil {
+		return nil, nil, &api.ApiError{Typ: api.ErrorBadData, Err: err}, func() {}
+	}
+
+	matcherSets, ctx, err := tenancy.RewriteLabelMatchers(r.Context(), r, qapi.tenantHeader, qapi.defaultTenant, qapi.tenantCertField, qapi.enforceTenancy, qapi.tenantLabel, r.Form[MatcherParam])
+	if err != nil {
+		apiErr := &api.ApiError{Typ: api.ErrorBadData, Err: err}
+		return nil, nil, apiErr, func() {}
+	}
+
+	enableDedup, apiErr := qapi.parseEnableDedupParam(r)
+	if apiErr != nil {
+		return nil, nil, apiErr, func() {}
+	}
+
+	replicaLabels, apiErr := qapi.parseReplicaLabelsParam(r)
+	if apiErr != nil {
+		return nil, nil, apiErr, func() {}
+	}
+
+	storeDebugMatchers, apiErr := qapi.parseStoreDebugMatchersParam(r)
+	if apiErr != nil {
+		return nil, nil, apiErr, func() {}
+	}
+
+	limit, err := parseLimitParam(r.FormValue("limit"))
+	if err != nil {
+		return nil, nil, &api.ApiError{Typ: api.ErrorBadData, Err: err}, func() {}
+	}
+
+	enablePartialResponse, apiErr := qapi.parsePartialResponseParam(r, qapi.enableQueryPartialResponse)
+	if apiErr != nil {
+		return nil, nil, apiErr, func() {}
+	}
+
+	mint, maxt := timestamp.FromTime(start), timestamp.FromTime(end)
+	q, err := qapi.queryableCreate(
+		enableDedup,
+		replicaLabels,
+		storeDebugMatchers,
+		0,
+		enablePartialResponse,
+		false,
+		nil,
+		query.NoopSeriesStatsReporter,
+	).Querier(mint, maxt)
+	if err != nil {
+		return nil, nil, &api.ApiError{Typ: api.ErrorExec, Err: err}, func() {}
+	}
+	defer runutil.CloseWithLogOnErr(qapi.logger, q, "queryable series last timestamp")
+
+	// A last_over_time over the whole time range only needs the last sample of each series.
+	hints := &storage.SelectHints{
+		Limit: toHintLimit(limit),
+		Start: mint,
+		End:   maxt,
+		Func:  storepb.LastOverTimeFunc,
+		Range: maxt - mint,
+	}
+
+	var sets []storage.SeriesSet
+	for _, mset := range matcherSets {
+		sets = append(sets, q.Select(ctx, true, hints, mset...))
+	}
+
+	var (
+		res = []SeriesLastTimestamp{}
+		set = storage.NewMergeSeriesSet(sets, storage.ChainedSeriesMerge)
+		it  chunkenc.Iterator
+	)
+	warnings := set.Warnings()
+	for set.Next() {
+		series := set.At()
+		it = series.Iterator(it)
+
+		last := int64(math.MinInt64)
+		for vt := it.Next(); vt != chunkenc.ValNone; vt = it.Next() {
+			last = it.AtT()
+		}
+		if err := it.Err(); err != nil {
+			return nil, nil, storeAPIError(api.ErrorExec, err), func() {}
+		}
+		if last == math.MinInt64 {
+			continue
+		}
+
+		if limit > 0 && len(res) == limit {
+			warnings.Add(errors.New("results truncated due to limit"))
+			break
+		}
+		res = append(res, SeriesLastTimestamp{Metric: series.Labels(), Timestamp: model.Time(last)})
+	}
+	if set.Err() != nil {
+		return nil, nil, storeAPIError(api.ErrorExec, set.Err()), func() {}
+	}
+	return res, warnings.AsErrors(), nil, func() {}
+}
+
+// SeriesTimeRange is the time range of the samples of the series matching a request.
+type SeriesTimeRange struct {
+	MinTime model.Time             `json:"minTime"`
+	MaxTime model.Time             `json:"maxTime"`
+	Stores  []SeriesStoreTimeRange `json:"stores"`
+}
+
+// SeriesStoreTimeRange is the time range of the samples of the series matching a request in a store.
+type SeriesStoreTimeRange struct {
+	Store   string     `json:"store"`
+	MinTime model.Time `json:"minTime"`
+	MaxTime model.Time `json:"maxTime"`
+	// Reported is false if the store does not report time ranges, the time range of its data is used instead.
+	Reported bool `json:"reported"`
+}
+
+// seriesTimeRange returns the time range of the samples of the series matching the given selectors within the
+// requested time range, across all stores. Stores only consult their block time ranges and index, so the time range
+// is approximate: it is as precise as the blocks for Store Gateways and as the chunks for stores backed by a TSDB.
+// The response is null if no series match.
+func (qapi *QueryAPI) seriesTimeRange(r *http.Request) (interface{}, []error, *api.ApiError, func()) {
+	if err := r.ParseForm(); err != nil {
+		return nil, nil, &api.ApiError{Typ: api.ErrorInternal, Err: errors.Wrap(err, "parse form")}, func() {}
+	}
+
+	if len(r.Form[MatcherParam]) == 0 {
+		return nil, nil, &api.ApiError{Typ: api.ErrorBadData, Err: errors.New("no match[] parameter provided")}, func() {}
+	}
+
+	start, end, err := parseMetadataTimeRange(r, qapi.defaultMetadataTimeRange)
+	if err != nil {
+		return nil, nil, &api.ApiError{Typ: api.ErrorBadData, Err: err}, func() {}
+	}
+
+	matcherSets, ctx, err := tenancy.RewriteLabelMatchers(r.Context(), r, qapi.tenantHeader, qapi.defaultTenant, qapi.tenantCertField, qapi.enforceTenancy, qapi.tenantLabel, r.Form[MatcherParam])
+	if err != nil {
+		apiErr := &api.ApiError{Typ: api.ErrorBadData, Err: err}
+		return nil, nil, apiErr, func() {}
+	}
+
+	storeDebugMatchers, apiErr := qapi.parseStoreDebugMatchersParam(r)
+	if apiErr != nil {
+		return nil, nil, apiErr, func() {}
+	}
+
+	enablePartialResponse, apiErr := qapi.parsePartialResponseParam(r, qapi.enableQueryPartialResponse)
+	if apiErr != nil {
+		return nil, nil, apiErr, func() {}
+	}
+
+	mint, maxt := timestamp.FromTime(start), timestamp.FromTime(end)
+	q, err := qapi.queryableCreate(
+		false,
+		nil,
+		storeDebugMatchers,
+		math.MaxInt64,
+		enablePartialResponse,
+		true,
+		nil,
+		query.NoopSeriesStatsReporter,
+	).Querier(mint, maxt)
+	if err != nil {
+		return nil, nil, &api.ApiError{Typ: api.ErrorExec, Err: err}, func() {}
+	}
+	defer runutil.CloseWithLogOnErr(qapi.logger, q, "queryable series time range")
+
+	tracker := store.NewSeriesTimeRangeTracker()
+	ctx = store.WithSeriesTimeRangeTracker(ctx, tracker)
+	hints := &storage.SelectHints{
+		Start: mint,
+		End:   maxt,
+	}
+
+	var sets []storage.SeriesSet
+	for _, mset := range matcherSets {
+		sets = append(sets, q.Select(ctx, false, hints, mset...))
+	}
+
+	// Stores reporting time ranges do not return series, the others return the matching series without chunks.
+	set := storage.NewMergeSeriesSet(sets, storage.ChainedSeriesMerge)
+	warnings := set.Warnings()
+	for set.Next() {
+	}
+	if set.Err() != nil {
+		return nil, nil, storeAPIError(api.ErrorExec, set.Err()), func() {}
+	}
+
+	ranges := tracker.TimeRanges()
+	if len(ranges) == 0 {
+		return nil, warnings.AsErrors(), nil, func() {}
+	}
+	res := &SeriesTimeRange{MinTime: model.Latest, MaxTime: model.Earliest, Stores: make([]SeriesStoreTimeRange, 0, len(ranges))}
+	for _, sr := range ranges {
+		res.MinTime = min(res.MinTime, model.Time(sr.MinTime))
+		res.MaxTime = max(res.MaxTime, model.Time(sr.MaxTime))
+		res.Stores = append(res.Stores, SeriesStoreTimeRange{
+			Store:    sr.Store,
+			MinTime:  model.Time(sr.MinTime),
+			MaxTime:  model.Time(sr.MaxTime),
+			Reported: sr.Reported,
+		})
+	}
+	return res, warnings.AsErrors(), nil, func() {}
+}
+
+// MetricNamesStats are the approximate statistics of the metric names matching a request.
+type MetricNamesStats struct {
+	Metrics []MetricNameStats       `json:"metrics"`
+	Stores  []MetricNamesStoreStats `json:"stores"`
+}
+
+// MetricNameStats are the approximate number of series and freshness of a metric name.
+type MetricNameStats struct {
+	Name          string     `json:"name"`
+	Series        int64      `json:"series"`
+	LastTimestamp model.Time `json:"lastTimestamp"`
+}
+
+// MetricNamesStoreStats tells whether a store reported the statistics of its metric names.
+type MetricNamesStoreStats struct {
+	Store string `json:"store"`
+	// Reported is false if the store does not report statistics, its series are counted instead and the end of its
+	// data is used as freshness.
+	Reported bool `json:"reported"`
+}
+
+// metricNamesStats returns the approximate number of series and freshness of every metric name matching the given
+// selectors, all metric names by default, within the requested time range, across all stores. Stores answer from
+// their index without sending any chunk: Store Gateways estimate the number of series from the size of the postings
+// in the largest block and use the end of the most recent block as freshness, stores backed by a TSDB count series and
+// use the end of the most recent chunk. Series are summed across stores, so replicated series are counted once per
+// replica.
+func (qapi *QueryAPI) metricNamesStats(r *http.Request) (interface{}, []error, *api.ApiError, func()) {
+	if err := r.ParseForm(); err != nil {
+		return nil, nil, &api.ApiError{Typ: api.ErrorInternal, Err: errors.Wrap(err, "parse form")}, func() {}
+	}
+
+	start, end, err := parseMetadataTimeRange(r, qapi.defaultMetadataTimeRange)
+	if err != nil {
+		return nil, nil, &api.ApiError{Typ: api.ErrorBadData, Err: err}, func() {}
+	}
+
+	limit, err := parseLimitParam(r.FormValue("limit"))
+	if err != nil {
+		return nil, nil, &api.ApiError{Typ: api.ErrorBadData, Err: err}, func() {}
+	}
+
+	selectors := r.Form[MatcherParam]
+	if len(selectors) == 0 {
+		selectors = []string{`{__name__=~".+"}`}
+	}
+	matcherSets, ctx, err := tenancy.RewriteLabelMatchers(r.Context(), r, qapi.tenantHeader, qapi.defaultTenant, qapi.tenantCertField, qapi.enforceTenancy, qapi.tenantLabel, selectors)
+	if err != nil {
+		apiErr := &api.ApiError{Typ: api.ErrorBadData, Err: err}
+		return nil, nil, apiErr, func() {}
+	}
+
+	storeDebugMatchers, apiErr := qapi.parseStoreDebugMatchersParam(r)
+	if apiErr != nil {
+		return nil, nil, apiErr, func() {}
+	}
+
+	enablePartialResponse, apiErr := qapi.parsePartialResponseParam(r, qapi.enableQueryPartialResponse)
+	if apiErr != nil {
+		return nil, nil, apiErr, func() {}
+	}
+
+	mint, maxt := timestamp.FromTime(start), timestamp.FromTime(end)
+	q, err := qapi.queryableCreate(
+		false,
+		nil,
+		storeDebugMatchers,
+		math.MaxInt64,
+		enablePartialResponse,
+		true,
+		nil,
+		query.NoopSeriesStatsReporter,
+	).Querier(mint, maxt)
+	if err != nil {
+		return nil, nil, &api.ApiError{Typ: api.ErrorExec, Err: err}, func() {}
+	}
+	defer runutil.CloseWithLogOnErr(qapi.logger, q, "queryable metric names stats")
+
+	tracker := store.NewMetricNameStatsTracker()
+	ctx = store.WithMetricNameStatsTracker(ctx, tracker)
+	hints := &storage.SelectHints{
+		Start: mint,
+		End:   maxt,
+	}
+
+	var sets []storage.SeriesSet
+	for _, mset := range matcherSets {
+		sets = append(sets, q.Select(ctx, false, hints, mset...))
+	}
+
+	// Stores reporting statistics do not return series, the others return the matching series without chunks.
+	set := storage.NewMergeSeriesSet(sets, storage.ChainedSeriesMerge)
+	warnings := set.Warnings()
+	for set.Next() {
+	}
+	if set.Err() != nil {
+		return nil, nil, storeAPIError(api.ErrorExec, set.Err()), func() {}
+	}
+
+	stats := tracker.Stats()
+	if limit > 0 && len(stats) > limit {
+		stats = stats[:limit]
+		warnings = warnings.Add(errors.New("results truncated due to limit"))
+	}
+	stores := tracker.Stores()
+	res := &MetricNamesStats{Metrics: make([]MetricNameStats, 0, len(stats)), Stores: make([]MetricNamesStoreStats, 0, len(stores))}
+	for _, st := range stats {
+		res.Metrics = append(res.Metrics, MetricNameStats{
+			Name:          st.Name,
+			Series:        st.Series,
+			LastTimestamp: model.Time(st.LastTimestamp),
+		})
+	}
+	for _, s := range stores {
+		res.Stores = append(res.Stores, MetricNamesStoreStats{Store: s.Store, Reported: s.Reported})
+	}
+	return res, warnings.AsErrors(), nil, func() {}
+}
+
 func (qapi *QueryAPI) labelNames(r *http.Request) (interface{}, []error, *api.ApiError, func()) {
 	start, end, err := parseMetadataTimeRange(r, qapi.defaultMetadataTimeRange)
 	if err != nil {
@@ -1288,7 +1973,7 @@ func (qapi *QueryAPI) labelNames(r *http.Request) (interface{}, []error, *api.Ap
 		for _, matchers := range matcherSets {
 			names, callWarnings, err = q.LabelNames(ctx, hints, matchers...)
 			if err != nil {
-				return nil, nil, &api.ApiError{Typ: api.ErrorExec, Err: err}, func() {}
+				return nil, nil, storeAPIError(api.ErrorExec, err), func() {}
 			}
 			warnings.Merge(callWarnings)
 			for _, val := range names {
@@ -1306,7 +1991,7 @@ func (qapi *QueryAPI) labelNames(r *http.Request) (interface{}, []error, *api.Ap
 	}
 
 	if err != nil {
-		return nil, nil, &api.ApiError{Typ: api.ErrorExec, Err: err}, func() {}
+		return nil, nil, storeAPIError(api.ErrorExec, err), func() {}
 	}
 	if names == nil {
 		names = make([]string, 0)
@@ -1335,12 +2020,12 @@ func (qapi *QueryAPI) stores(_ *http.Request) (interface{}, []error, *api.ApiErr
 // NewTargetsHandler created handler compatible with HTTP /api/v1/targets https://prometheus.io/docs/prometheus/latest/querying/api/#targets
 // which uses gRPC Unary Targets API.
 func NewTargetsHandler(client targets.UnaryClient, enablePartialResponse bool) func(*http.Request) (interface{}, []error, *api.ApiError, func()) {
-	ps := storepb.PartialResponseStrategy_ABORT
-	if enablePartialResponse {
-		ps = storepb.PartialResponseStrategy_WARN
-	}
-
 	return func(r *http.Request) (interface{}, []error, *api.ApiError, func()) {
+		ps, apiErr := partialResponseStrategy(r, enablePartialResponse)
+		if apiErr != nil {
+			return nil, nil, apiErr, func() {}
+		}
+
 		stateParam := r.URL.Query().Get("state")
 		state, ok := targetspb.TargetsRequest_State_value[strings.ToUpper(stateParam)]
 		if !ok {
@@ -1357,7 +2042,7 @@ func NewTargetsHandler(client targets.UnaryClient, enablePartialResponse bool) f
 
 		t, warnings, err := client.Targets(r.Context(), req)
 		if err != nil {
-			return nil, nil, &api.ApiError{Typ: api.ErrorInternal, Err: errors.Wrap(err, "retrieving targets")}, func() {}
+			return nil, nil, storeAPIError(api.ErrorInternal, errors.Wrap(err, "retrieving targets")), func() {}
 		}
 
 		return t, warnings.AsErrors(), nil, func() {}
@@ -1367,22 +2052,22 @@ func NewTargetsHandler(client targets.UnaryClient, enablePartialResponse bool) f
 // NewAlertsHandler created handler compatible with HTTP /api/v1/alerts https://prometheus.io/docs/prometheus/latest/querying/api/#alerts
 // which uses gRPC Unary Rules API (Rules API works for both /alerts and /rules).
 func NewAlertsHandler(client rules.UnaryClient, enablePartialResponse bool) func(*http.Request) (interface{}, []error, *api.ApiError, func()) {
-	ps := storepb.PartialResponseStrategy_ABORT
-	if enablePartialResponse {
-		ps = storepb.PartialResponseStrategy_WARN
-	}
-
 	return func(r *http.Request) (interface{}, []error, *api.ApiError, func()) {
 		span, ctx := tracing.StartSpan(r.Context(), "receive_http_request")
 		defer span.Finish()
 
+		ps, apiErr := partialResponseStrategy(r, enablePartialResponse)
+		if apiErr != nil {
+			return nil, nil, apiErr, func() {}
+		}
+
 		var (
 			groups   *rulespb.RuleGroups
 			warnings annotations.Annotations
 			err      error
 		)
 
-		// TODO(bwplotka): Allow exactly the same functionality as query API: passing replica, dedup and partial response as HTTP params as well.
+		// TODO(bwplotka): Allow exactly the same functionality as query API: passing replica and dedup as HTTP params as well.
 		req := &rulespb.RulesRequest{
 			Type:                    rulespb.RulesRequest_ALERT,
 			PartialResponseStrategy: ps,
@@ -1391,7 +2076,7 @@ func NewAlertsHandler(client rules.UnaryClient, enablePartialResponse bool) func
 			groups, warnings, err = client.Rules(ctx, req)
 		})
 		if err != nil {
-			return nil, nil, &api.ApiError{Typ: api.ErrorInternal, Err: errors.Errorf("error retrieving rules: %v", err)}, func() {}
+			return nil, nil, storeAPIError(api.ErrorInternal, errors.Wrap(err, "error retrieving rules")), func() {}
 		}
 
 		var resp struct {
@@ -1413,15 +2098,15 @@ func NewAlertsHandler(client rules.UnaryClient, enablePartialResponse bool) func
 // NewRulesHandler created handler compatible with HTTP /api/v1/rules https://prometheus.io/docs/prometheus/latest/querying/api/#rules
 // which uses gRPC Unary Rules API.
 func NewRulesHandler(client rules.UnaryClient, enablePartialResponse bool) func(*http.Request) (interface{}, []error, *api.ApiError, func()) {
-	ps := storepb.PartialResponseStrategy_ABORT
-	if enablePartialResponse {
-		ps = storepb.PartialResponseStrategy_WARN
-	}
-
 	return func(r *http.Request) (interface{}, []error, *api.ApiError, func()) {
 		span, ctx := tracing.StartSpan(r.Context(), "receive_http_request")
 		defer span.Finish()
 
+		ps, apiErr := partialResponseStrategy(r, enablePartialResponse)
+		if apiErr != nil {
+			return nil, nil, apiErr, func() {}
+		}
+
 		var (
 			groups   *rulespb.RuleGroups
 			warnings annotations.Annotations
@@ -1441,7 +2126,7 @@ func NewRulesHandler(client rules.UnaryClient, enablePartialResponse bool) func(
 			return nil, nil, &api.ApiError{Typ: api.ErrorInternal, Err: errors.Errorf("error parsing request form='%v'", MatcherParam)}, func() {}
 		}
 
-		// TODO(bwplotka): Allow exactly the same functionality as query API: passing replica, dedup and partial response as HTTP params as well.
+		// TODO(bwplotka): Allow exactly the same functionality as query API: passing replica and dedup as HTTP params as well.
 		req := &rulespb.RulesRequest{
 			Type:                    rulespb.RulesRequest_Type(typ),
 			PartialResponseStrategy: ps,
@@ -1454,7 +2139,7 @@ func NewRulesHandler(client rules.UnaryClient, enablePartialResponse bool) func(
 			groups, warnings, err = client.Rules(ctx, req)
 		})
 		if err != nil {
-			return nil, nil, &api.ApiError{Typ: api.ErrorInternal, Err: errors.Errorf("error retrieving rules: %v", err)}, func() {}
+			return nil, nil, storeAPIError(api.ErrorInternal, errors.Wrap(err, "error retrieving rules")), func() {}
 		}
 		return groups, warnings.AsErrors(), nil, func() {}
 	}
@@ -1463,15 +2148,15 @@ func NewRulesHandler(client rules.UnaryClient, enablePartialResponse bool) func(
 // NewExemplarsHandler creates handler compatible with HTTP /api/v1/query_exemplars https://prometheus.io/docs/prometheus/latest/querying/api/#querying-exemplars
 // which uses gRPC Unary Exemplars API.
 func NewExemplarsHandler(client exemplars.UnaryClient, enablePartialResponse bool) func(*http.Request) (interface{}, []error, *api.ApiError, func()) {
-	ps := storepb.PartialResponseStrategy_ABORT
-	if enablePartialResponse {
-		ps = storepb.PartialResponseStrategy_WARN
-	}
-
 	return func(r *http.Request) (interface{}, []error, *api.ApiError, func()) {
 		span, ctx := tracing.StartSpan(r.Context(), "exemplar_query_request")
 		defer span.Finish()
 
+		ps, apiErr := partialResponseStrategy(r, enablePartialResponse)
+		if apiErr != nil {
+			return nil, nil, apiErr, func() {}
+		}
+
 		var (
 			data     []*exemplarspb.ExemplarData
 			warnings annotations.Annotations
@@ -1499,7 +2184,7 @@ func NewExemplarsHandler(client exemplars.UnaryClient, enablePartialResponse boo
 		})
 
 		if err != nil {
-			return nil, nil, &api.ApiError{Typ: api.ErrorInternal, Err: errors.Wrap(err, "retrieving exemplars")}, func() {}
+			return nil, nil, storeAPIError(api.ErrorInternal, errors.Wrap(err, "retrieving exemplars")), func() {}
 		}
 		return data, warnings.AsErrors(), nil, func() {}
 	}
@@ -1608,15 +2293,15 @@ func toHintLimit(limit int) int {
 // NewMetricMetadataHandler creates handler compatible with HTTP /api/v1/metadata https://prometheus.io/docs/prometheus/latest/querying/api/#querying-metric-metadata
 // which uses gRPC Unary Metadata API.
 func NewMetricMetadataHandler(client metadata.UnaryClient, enablePartialResponse bool) func(*http.Request) (interface{}, []error, *api.ApiError, func()) {
-	ps := storepb.PartialResponseStrategy_ABORT
-	if enablePartialResponse {
-		ps = storepb.PartialResponseStrategy_WARN
-	}
-
 	return func(r *http.Request) (interface{}, []error, *api.ApiError, func()) {
 		span, ctx := tracing.StartSpan(r.Context(), "metadata_http_request")
 		defer span.Finish()
 
+		ps, apiErr := partialResponseStrategy(r, enablePartialResponse)
+		if apiErr != nil {
+			return nil, nil, apiErr, func() {}
+		}
+
 		var (
 			t        map[string][]*metadatapb.Meta
 			warnings annotations.Annotations
@@ -1643,7 +2328,7 @@ func NewMetricMetadataHandler(client metadata.UnaryClient, enablePartialResponse
 			t, warnings, err = client.MetricMetadata(ctx, req)
 		})
 		if err != nil {
-			return nil, nil, &api.ApiError{Typ: api.ErrorInternal, Err: errors.Wrap(err, "retrieving metadata")}, func() {}
+			return nil, nil, storeAPIError(api.ErrorInternal, errors.Wrap(err, "retrieving metadata")), func() {}
 		}
 
 		return t, warnings.AsErrors(), nil, func() {}
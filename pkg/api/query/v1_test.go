@@ -32,6 +32,7 @@ import (
 
 	"github.com/efficientgo/core/testutil"
 	"github.com/go-kit/log"
+	"github.com/pkg/errors"
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promauto"
 	"github.com/prometheus/common/route"
@@ -52,6 +53,7 @@ import (
 	baseAPI "github.com/thanos-io/thanos/pkg/api"
 	"github.com/thanos-io/thanos/pkg/compact"
 	"github.com/thanos-io/thanos/pkg/component"
+	"github.com/thanos-io/thanos/pkg/exemplars/exemplarspb"
 	"github.com/thanos-io/thanos/pkg/gate"
 	"github.com/thanos-io/thanos/pkg/query"
 	"github.com/thanos-io/thanos/pkg/rules/rulespb"
@@ -62,6 +64,8 @@ import (
 	"github.com/thanos-io/thanos/pkg/testutil/custom"
 	"github.com/thanos-io/thanos/pkg/testutil/e2eutil"
 	"github.com/thanos-io/thanos/pkg/testutil/testpromcompatibility"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
 )
 
 func TestMain(m *testing.M) {
@@ -170,7 +174,7 @@ func TestQueryEndpoints(t *testing.T) {
 		baseAPI: &baseAPI.BaseAPI{
 			Now: func() time.Time { return now },
 		},
-		queryableCreate:       query.NewQueryableCreator(nil, nil, newProxyStoreWithTSDBStore(db), 2, timeout),
+		queryableCreate:       query.NewQueryableCreator(nil, nil, newProxyStoreWithTSDBStore(db), 2, timeout, 0, 0, 0, nil, 0),
 		engineFactory:         ef,
 		defaultEngine:         PromqlEnginePrometheus,
 		lookbackDeltaCreate:   func(m int64) time.Duration { return time.Duration(0) },
@@ -522,7 +526,7 @@ func TestQueryExplainEndpoints(t *testing.T) {
 		baseAPI: &baseAPI.BaseAPI{
 			Now: func() time.Time { return now },
 		},
-		queryableCreate:       query.NewQueryableCreator(nil, nil, newProxyStoreWithTSDBStore(db), 2, timeout),
+		queryableCreate:       query.NewQueryableCreator(nil, nil, newProxyStoreWithTSDBStore(db), 2, timeout, 0, 0, 0, nil, 0),
 		engineFactory:         ef,
 		defaultEngine:         PromqlEnginePrometheus,
 		lookbackDeltaCreate:   func(m int64) time.Duration { return time.Duration(0) },
@@ -574,6 +578,83 @@ func TestQueryExplainEndpoints(t *testing.T) {
 	}
 }
 
+func TestQueryExperimentalFunctions(t *testing.T) {
+	db, err := e2eutil.NewTSDB()
+	defer func() { testutil.Ok(t, db.Close()) }()
+	testutil.Ok(t, err)
+
+	now := time.Now()
+	timeout := 100 * time.Second
+	api := &QueryAPI{
+		baseAPI: &baseAPI.BaseAPI{
+			Now: func() time.Time { return now },
+		},
+		queryableCreate: query.NewQueryableCreator(nil, nil, newProxyStoreWithTSDBStore(db), 2, timeout, 0, 0, 0, nil, 0),
+		engineFactory: NewQueryEngineFactory(promql.EngineOpts{
+			MaxSamples: 10000,
+			Timeout:    timeout,
+		}, nil, false),
+		defaultEngine:       PromqlEngineThanos,
+		lookbackDeltaCreate: func(m int64) time.Duration { return time.Duration(0) },
+		gate:                gate.New(nil, 4, gate.Queries),
+		queryRangeHist: promauto.With(prometheus.NewRegistry()).NewHistogram(prometheus.HistogramOpts{
+			Name: "query_range_hist",
+		}),
+		seriesStatsAggregatorFactory: &store.NoopSeriesStatsAggregatorFactory{},
+		tenantHeader:                 "thanos-tenant",
+		defaultTenant:                "default-tenant",
+		experimentalFunctionsTenants: map[string]struct{}{"trusted": {}},
+	}
+
+	for _, tc := range []struct {
+		tenant, query string
+		expectedErr   string
+	}{
+		{tenant: "trusted", query: "xrate(up[5m])"},
+		{tenant: "other", query: "rate(up[5m])"},
+		{tenant: "other", query: "sum(xincrease(up[5m]))", expectedErr: `tenant other: experimental function "xincrease" is not enabled`},
+		{tenant: "", query: "xrate(up[5m])", expectedErr: `tenant default-tenant: experimental function "xrate" is not enabled`},
+	} {
+		t.Run(tc.tenant+" "+tc.query, func(t *testing.T) {
+			for name, endpoint := range map[string]baseAPI.ApiFunc{"query": api.query, "query_range": api.queryRange} {
+				req, err := http.NewRequest(http.MethodGet, "http://example.com?"+url.Values{
+					"query": []string{tc.query},
+					"time":  []string{"123.4"},
+					"start": []string{"0"},
+					"end":   []string{"500"},
+					"step":  []string{"10"},
+				}.Encode(), nil)
+				testutil.Ok(t, err)
+				if tc.tenant != "" {
+					req.Header.Set("thanos-tenant", tc.tenant)
+				}
+
+				_, _, apiErr, release := endpoint(req)
+				release()
+				if tc.expectedErr == "" {
+					testutil.Assert(t, apiErr == nil, "%s: unexpected error %v", name, apiErr)
+					continue
+				}
+				testutil.Assert(t, apiErr != nil, "%s: expected error", name)
+				testutil.Equals(t, baseAPI.ErrorBadData, apiErr.Typ)
+				testutil.Equals(t, tc.expectedErr, apiErr.Err.Error())
+			}
+		})
+	}
+}
+
+func TestCheckExperimentalFunctions(t *testing.T) {
+	testutil.Ok(t, checkExperimentalFunctions("rate(up[5m])", false))
+	testutil.Ok(t, checkExperimentalFunctions("xrate(up[5m])", true))
+	testutil.NotOk(t, checkExperimentalFunctions("xrate(up[5m])", false))
+	// Queries which do not parse are left to the engine.
+	testutil.Ok(t, checkExperimentalFunctions("rate(up[5m]", false))
+
+	defer func(enabled bool) { parser.EnableExperimentalFunctions = enabled }(parser.EnableExperimentalFunctions)
+	parser.EnableExperimentalFunctions = true
+	testutil.Equals(t, `experimental function "sort_by_label" is not enabled`, checkExperimentalFunctions(`sort_by_label(up, "job")`, true).Error())
+}
+
 func TestQueryAnalyzeEndpoints(t *testing.T) {
 	db, err := e2eutil.NewTSDB()
 	defer func() { testutil.Ok(t, db.Close()) }()
@@ -591,7 +672,7 @@ func TestQueryAnalyzeEndpoints(t *testing.T) {
 		baseAPI: &baseAPI.BaseAPI{
 			Now: func() time.Time { return now },
 		},
-		queryableCreate:       query.NewQueryableCreator(nil, nil, newProxyStoreWithTSDBStore(db), 2, timeout),
+		queryableCreate:       query.NewQueryableCreator(nil, nil, newProxyStoreWithTSDBStore(db), 2, timeout, 0, 0, 0, nil, 0),
 		engineFactory:         ef,
 		defaultEngine:         PromqlEnginePrometheus,
 		lookbackDeltaCreate:   func(m int64) time.Duration { return time.Duration(0) },
@@ -740,7 +821,7 @@ func TestMetadataEndpoints(t *testing.T) {
 		baseAPI: &baseAPI.BaseAPI{
 			Now: func() time.Time { return now },
 		},
-		queryableCreate:     query.NewQueryableCreator(nil, nil, newProxyStoreWithTSDBStore(db), 2, timeout),
+		queryableCreate:     query.NewQueryableCreator(nil, nil, newProxyStoreWithTSDBStore(db), 2, timeout, 0, 0, 0, nil, 0),
 		engineFactory:       ef,
 		defaultEngine:       PromqlEnginePrometheus,
 		lookbackDeltaCreate: func(m int64) time.Duration { return time.Duration(0) },
@@ -756,7 +837,7 @@ func TestMetadataEndpoints(t *testing.T) {
 		baseAPI: &baseAPI.BaseAPI{
 			Now: func() time.Time { return now },
 		},
-		queryableCreate:          query.NewQueryableCreator(nil, nil, newProxyStoreWithTSDBStore(db), 2, timeout),
+		queryableCreate:          query.NewQueryableCreator(nil, nil, newProxyStoreWithTSDBStore(db), 2, timeout, 0, 0, 0, nil, 0),
 		engineFactory:            ef,
 		defaultEngine:            PromqlEnginePrometheus,
 		lookbackDeltaCreate:      func(m int64) time.Duration { return time.Duration(0) },
@@ -973,6 +1054,114 @@ func TestMetadataEndpoints(t *testing.T) {
 			},
 			response: []labels.Labels{},
 		},
+		{
+			endpoint: api.seriesLastTimestamp,
+			query: url.Values{
+				"match[]": []string{`{__name__=~"test_metric[12]"}`},
+			},
+			response: []SeriesLastTimestamp{
+				{Metric: labels.FromStrings("__name__", "test_metric1", "foo", "bar"), Timestamp: 540_000},
+				{Metric: labels.FromStrings("__name__", "test_metric1", "foo", "boo"), Timestamp: 540_000},
+				{Metric: labels.FromStrings("__name__", "test_metric2", "foo", "boo"), Timestamp: 540_000},
+			},
+		},
+		{
+			endpoint: api.seriesLastTimestamp,
+			query: url.Values{
+				"match[]": []string{`test_metric2`},
+				"end":     []string{"330"},
+			},
+			response: []SeriesLastTimestamp{
+				{Metric: labels.FromStrings("__name__", "test_metric2", "foo", "boo"), Timestamp: 300_000},
+			},
+		},
+		{
+			endpoint: api.seriesLastTimestamp,
+			query: url.Values{
+				"match[]": []string{`test_metric2`},
+				"start":   []string{"600"},
+			},
+			response: []SeriesLastTimestamp{},
+		},
+		{
+			endpoint: api.seriesLastTimestamp,
+			errType:  baseAPI.ErrorBadData,
+		},
+		{
+			endpoint: api.seriesTimeRange,
+			query: url.Values{
+				"match[]": []string{`test_metric2`},
+			},
+			response: &SeriesTimeRange{
+				MinTime: 0,
+				MaxTime: 540_000,
+				Stores:  []SeriesStoreTimeRange{{Store: "1", MinTime: 0, MaxTime: 540_000, Reported: true}},
+			},
+		},
+		{
+			endpoint: api.seriesTimeRange,
+			query: url.Values{
+				"match[]": []string{`test_metric2`},
+				"start":   []string{"60"},
+				"end":     []string{"330"},
+			},
+			// Chunks crossing the bounds of the request are trimmed to the samples within them.
+			response: &SeriesTimeRange{
+				MinTime: 60_000,
+				MaxTime: 300_000,
+				Stores:  []SeriesStoreTimeRange{{Store: "1", MinTime: 60_000, MaxTime: 300_000, Reported: true}},
+			},
+		},
+		{
+			endpoint: api.seriesTimeRange,
+			query: url.Values{
+				"match[]": []string{`test_metric3`},
+			},
+			response: nil,
+		},
+		{
+			endpoint: api.seriesTimeRange,
+			errType:  baseAPI.ErrorBadData,
+		},
+		{
+			endpoint: api.metricNamesStats,
+			query: url.Values{
+				"match[]": []string{`{__name__=~"test_metric[12]"}`},
+			},
+			response: &MetricNamesStats{
+				Metrics: []MetricNameStats{
+					{Name: "test_metric1", Series: 2, LastTimestamp: 540_000},
+					{Name: "test_metric2", Series: 1, LastTimestamp: 540_000},
+				},
+				Stores: []MetricNamesStoreStats{{Store: "1", Reported: true}},
+			},
+		},
+		{
+			endpoint: api.metricNamesStats,
+			query: url.Values{
+				"match[]": []string{`{__name__=~"test_metric[12]"}`},
+				"end":     []string{"330"},
+				"limit":   []string{"1"},
+			},
+			response: &MetricNamesStats{
+				Metrics: []MetricNameStats{{Name: "test_metric1", Series: 2, LastTimestamp: 300_000}},
+				Stores:  []MetricNamesStoreStats{{Store: "1", Reported: true}},
+			},
+		},
+		{
+			endpoint: api.metricNamesStats,
+			query: url.Values{
+				"match[]": []string{`test_metric3`},
+			},
+			response: &MetricNamesStats{Metrics: []MetricNameStats{}, Stores: []MetricNamesStoreStats{}},
+		},
+		{
+			endpoint: api.metricNamesStats,
+			query: url.Values{
+				"limit": []string{"-1"},
+			},
+			errType: baseAPI.ErrorBadData,
+		},
 		{
 			endpoint: apiWithLabelLookback.series,
 			query: url.Values{
@@ -1351,6 +1540,39 @@ func TestStoresEndpoint(t *testing.T) {
 	}
 }
 
+func TestFormatQueryEndpoint(t *testing.T) {
+	qapi := &QueryAPI{}
+
+	for i, test := range []endpointTestCase{
+		{
+			endpoint: qapi.formatQuery,
+			query:    url.Values{"query": []string{"foo+bar"}},
+			response: "foo + bar",
+		},
+		{
+			endpoint: qapi.formatQuery,
+			method:   http.MethodPost,
+			query:    url.Values{"query": []string{`sum by(job)(rate(http_requests_total{job="api"}[5m]))`}},
+			response: `sum by (job) (rate(http_requests_total{job="api"}[5m]))`,
+		},
+		{
+			// Functions of the Thanos engine are supported.
+			endpoint: qapi.formatQuery,
+			query:    url.Values{"query": []string{"xrate(foo[5m])"}},
+			response: "xrate(foo[5m])",
+		},
+		{
+			endpoint: qapi.formatQuery,
+			query:    url.Values{"query": []string{"invalid_expression/"}},
+			errType:  baseAPI.ErrorBadData,
+		},
+	} {
+		if ok := testEndpoint(t, test, strings.TrimSpace(fmt.Sprintf("#%d %s", i, test.query.Encode())), reflect.DeepEqual); !ok {
+			return
+		}
+	}
+}
+
 func TestParseTime(t *testing.T) {
 	ts, err := time.Parse(time.RFC3339Nano, "2015-06-03T13:21:58.555Z")
 	if err != nil {
@@ -2002,3 +2224,61 @@ func (s sample) FH() *histogram.FloatHistogram {
 func (s sample) Type() chunkenc.ValueType {
 	return chunkenc.ValFloat
 }
+
+type mockedExemplarsClient struct {
+	req *exemplarspb.ExemplarsRequest
+	err error
+}
+
+func (c *mockedExemplarsClient) Exemplars(_ context.Context, req *exemplarspb.ExemplarsRequest) ([]*exemplarspb.ExemplarData, annotations.Annotations, error) {
+	c.req = req
+	if req.PartialResponseStrategy == storepb.PartialResponseStrategy_ABORT {
+		return nil, nil, c.err
+	}
+	return nil, annotations.New().Add(c.err), nil
+}
+
+func TestExemplarsHandlerPartialResponse(t *testing.T) {
+	client := &mockedExemplarsClient{err: errors.Wrap(status.Error(codes.Unavailable, "store down"), "fetching exemplars")}
+	endpoint := NewExemplarsHandler(client, true)
+
+	for _, tc := range []struct {
+		param       string
+		expectedPRS storepb.PartialResponseStrategy
+		expectedErr baseAPI.ErrorType
+	}{
+		{param: "", expectedPRS: storepb.PartialResponseStrategy_WARN},
+		{param: "true", expectedPRS: storepb.PartialResponseStrategy_WARN},
+		{param: "false", expectedPRS: storepb.PartialResponseStrategy_ABORT, expectedErr: baseAPI.ErrorUnavailable},
+		{param: "foo", expectedErr: baseAPI.ErrorBadData},
+	} {
+		t.Run(tc.param, func(t *testing.T) {
+			client.req = nil
+			req, err := http.NewRequest(http.MethodGet, "http://example.com?query=up&partial_response="+tc.param, nil)
+			testutil.Ok(t, err)
+
+			_, warnings, apiErr, release := endpoint(req)
+			defer release()
+			if tc.expectedErr != "" {
+				testutil.Assert(t, apiErr != nil, "expected error")
+				testutil.Equals(t, tc.expectedErr, apiErr.Typ)
+				if tc.expectedErr == baseAPI.ErrorBadData {
+					return
+				}
+			} else {
+				testutil.Assert(t, apiErr == nil, "unexpected error %v", apiErr)
+				testutil.Equals(t, 1, len(warnings))
+			}
+			testutil.Equals(t, tc.expectedPRS, client.req.PartialResponseStrategy)
+		})
+	}
+}
+
+func TestStoreAPIError(t *testing.T) {
+	unavailable := errors.Wrap(status.Error(codes.Aborted, "receive series from store"), "proxy Series()")
+
+	testutil.Equals(t, baseAPI.ErrorUnavailable, storeAPIError(baseAPI.ErrorExec, unavailable).Typ)
+	testutil.Equals(t, baseAPI.ErrorUnavailable, storeAPIError(baseAPI.ErrorInternal, promql.ErrStorage{Err: unavailable}).Typ)
+	testutil.Equals(t, baseAPI.ErrorExec, storeAPIError(baseAPI.ErrorExec, errors.New("bad query")).Typ)
+	testutil.Equals(t, baseAPI.ErrorExec, storeAPIError(baseAPI.ErrorExec, status.Error(codes.InvalidArgument, "bad matchers")).Typ)
+}
@@ -22,9 +22,11 @@ import (
 	"github.com/oklog/ulid"
 	"github.com/pkg/errors"
 	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/prometheus/tsdb/chunks"
 	"github.com/thanos-io/objstore"
 
 	"github.com/thanos-io/thanos/pkg/block/metadata"
+	"github.com/thanos-io/thanos/pkg/extobjstore/objcopy"
 	"github.com/thanos-io/thanos/pkg/runutil"
 )
 
@@ -174,6 +176,47 @@ func cleanUp(logger log.Logger, bkt objstore.Bucket, id ulid.ULID, err error) er
 	return err
 }
 
+// Copy creates the block described by meta from the index and chunks of the block src in the bucket.
+// It is meant for blocks which differ from their source only by their meta file, so that the files of the
+// source block do not have to be downloaded and uploaded again: objects are copied with server-side copy
+// if the bucket supports it, see objcopy.Copy. As with Upload, the meta file is uploaded last.
+func Copy(ctx context.Context, logger log.Logger, bkt objstore.Bucket, src ulid.ULID, meta *metadata.Meta) error {
+	dst := meta.ULID
+	if dst == src {
+		return errors.Errorf("cannot copy block %s onto itself", src)
+	}
+
+	var names []string
+	if err := bkt.Iter(ctx, src.String(), func(name string) error {
+		rel := strings.TrimPrefix(name, src.String()+objstore.DirDelim)
+		if rel == IndexFilename || strings.HasPrefix(rel, ChunksDirname+objstore.DirDelim) {
+			names = append(names, rel)
+		}
+		return nil
+	}, objstore.WithRecursiveIter); err != nil {
+		return errors.Wrapf(err, "list files of block %s", src)
+	}
+	if len(names) == 0 {
+		return errors.Errorf("block %s has no index or chunks", src)
+	}
+
+	for _, name := range names {
+		if err := objcopy.Copy(ctx, bkt, path.Join(src.String(), name), path.Join(dst.String(), name)); err != nil {
+			return cleanUp(logger, bkt, dst, errors.Wrapf(err, "copy %s", name))
+		}
+		level.Debug(logger).Log("msg", "copied file", "file", name, "src", src, "dst", dst)
+	}
+
+	var metaEncoded bytes.Buffer
+	if err := meta.Write(&metaEncoded); err != nil {
+		return cleanUp(logger, bkt, dst, errors.Wrap(err, "encode meta file"))
+	}
+	if err := bkt.Upload(ctx, path.Join(dst.String(), MetaFilename), &metaEncoded); err != nil {
+		return errors.Wrap(err, "upload meta file")
+	}
+	return nil
+}
+
 // MarkForDeletion creates a file which stores information about when the block was marked for deletion.
 func MarkForDeletion(ctx context.Context, logger log.Logger, bkt objstore.Bucket, id ulid.ULID, details string, markedForDeletion prometheus.Counter) error {
 	deletionMarkFile := path.Join(id.String(), metadata.DeletionMarkFilename)
@@ -375,6 +418,55 @@ func GatherFileStats(blockDir string, hf metadata.HashFunc, logger log.Logger) (
 	return res, err
 }
 
+// VerifyMeta checks that the given meta describes a valid block.
+func VerifyMeta(meta *metadata.Meta) error {
+	if meta.ULID == (ulid.ULID{}) {
+		return errors.New("missing block ULID")
+	}
+	if meta.MinTime < 0 || meta.MinTime >= meta.MaxTime {
+		return errors.Errorf("invalid time range [%d, %d)", meta.MinTime, meta.MaxTime)
+	}
+	return nil
+}
+
+// VerifyBlockDir verifies that the block in the given dir is complete and consistent with its meta file,
+// e.g. before accepting a block uploaded by a client. The files listed in the meta must exist with the
+// listed sizes, the chunk segments must be readable and the index must be healthy within the time range
+// of the block. It returns the meta of the block.
+func VerifyBlockDir(ctx context.Context, logger log.Logger, dir string) (*metadata.Meta, error) {
+	meta, err := metadata.ReadFromDir(dir)
+	if err != nil {
+		return nil, errors.Wrap(err, "read meta")
+	}
+	if err := VerifyMeta(meta); err != nil {
+		return nil, err
+	}
+
+	for _, f := range meta.Thanos.Files {
+		if f.RelPath == MetaFilename {
+			continue
+		}
+		fi, err := os.Stat(filepath.Join(dir, f.RelPath))
+		if err != nil {
+			return nil, errors.Wrapf(err, "stat %v", f.RelPath)
+		}
+		if fi.Size() != f.SizeBytes {
+			return nil, errors.Errorf("unexpected size of %v: expected %d bytes, got %d", f.RelPath, f.SizeBytes, fi.Size())
+		}
+	}
+
+	cr, err := chunks.NewDirReader(filepath.Join(dir, ChunksDirname), nil)
+	if err != nil {
+		return nil, errors.Wrap(err, "open chunks")
+	}
+	runutil.CloseWithLogOnErr(logger, cr, "close chunks reader")
+
+	if err := VerifyIndex(ctx, logger, filepath.Join(dir, IndexFilename), meta.MinTime, meta.MaxTime); err != nil {
+		return nil, errors.Wrap(err, "verify index")
+	}
+	return meta, nil
+}
+
 // MarkForNoCompact creates a file which marks block to be not compacted.
 func MarkForNoCompact(ctx context.Context, logger log.Logger, bkt objstore.Bucket, id ulid.ULID, reason metadata.NoCompactReason, details string, markedForNoCompact prometheus.Counter) error {
 	m := path.Join(id.String(), metadata.NoCompactMarkFilename)
@@ -438,6 +530,16 @@ func MarkForNoDownsample(ctx context.Context, logger log.Logger, bkt objstore.Bu
 	return nil
 }
 
+// IsMarked returns whether the block is marked with the given marker file, checking only that it exists.
+func IsMarked(ctx context.Context, bkt objstore.BucketReader, id ulid.ULID, markerFilename string) (bool, error) {
+	m := path.Join(id.String(), markerFilename)
+	exists, err := bkt.Exists(ctx, m)
+	if err != nil {
+		return false, errors.Wrapf(err, "check exists %s in bucket", m)
+	}
+	return exists, nil
+}
+
 // RemoveMark removes the file which marked the block for deletion, no-downsample or no-compact.
 func RemoveMark(ctx context.Context, logger log.Logger, bkt objstore.Bucket, id ulid.ULID, removeMark prometheus.Counter, markedFilename string) error {
 	markedFile := path.Join(id.String(), markedFilename)
@@ -278,6 +278,49 @@ func TestDelete(t *testing.T) {
 	}
 }
 
+func TestCopy(t *testing.T) {
+	defer custom.TolerantVerifyLeak(t)
+	ctx := context.Background()
+
+	tmpDir := t.TempDir()
+
+	bkt := objstore.NewInMemBucket()
+	src, err := e2eutil.CreateBlock(ctx, tmpDir, []labels.Labels{
+		labels.New(labels.Label{Name: "a", Value: "1"}),
+		labels.New(labels.Label{Name: "b", Value: "1"}),
+	}, 100, 0, 1000, labels.New(labels.Label{Name: "ext1", Value: "val1"}), 124, metadata.NoneFunc)
+	testutil.Ok(t, err)
+	testutil.Ok(t, Upload(ctx, log.NewNopLogger(), bkt, path.Join(tmpDir, src.String()), metadata.NoneFunc))
+	testutil.Ok(t, MarkForNoCompact(ctx, log.NewNopLogger(), bkt, src, metadata.ManualNoCompactReason, "", promauto.With(nil).NewCounter(prometheus.CounterOpts{})))
+
+	meta, err := DownloadMeta(ctx, log.NewNopLogger(), bkt, src)
+	testutil.Ok(t, err)
+	testutil.NotOk(t, Copy(ctx, log.NewNopLogger(), bkt, src, &meta))
+
+	dst := ulid.MustNew(1, nil)
+	meta.ULID = dst
+	meta.Thanos.Source = metadata.BucketRewriteSource
+	testutil.Ok(t, Copy(ctx, log.NewNopLogger(), bkt, src, &meta))
+
+	// Index and chunks are copied as is, markers are not.
+	objs := bkt.Objects()
+	testutil.Equals(t, objs[path.Join(src.String(), IndexFilename)], objs[path.Join(dst.String(), IndexFilename)])
+	testutil.Equals(t, objs[path.Join(src.String(), ChunksDirname, "000001")], objs[path.Join(dst.String(), ChunksDirname, "000001")])
+	_, ok := objs[path.Join(dst.String(), metadata.NoCompactMarkFilename)]
+	testutil.Assert(t, !ok, "markers must not be copied")
+	testutil.Equals(t, 7, len(objs))
+
+	got, err := DownloadMeta(ctx, log.NewNopLogger(), bkt, dst)
+	testutil.Ok(t, err)
+	testutil.Equals(t, dst, got.ULID)
+	testutil.Equals(t, metadata.BucketRewriteSource, got.Thanos.Source)
+
+	// Copying a block without files fails and leaves nothing behind.
+	meta.ULID = ulid.MustNew(2, nil)
+	testutil.NotOk(t, Copy(ctx, log.NewNopLogger(), bkt, ulid.MustNew(3, nil), &meta))
+	testutil.Equals(t, 7, len(bkt.Objects()))
+}
+
 func TestMarkForDeletion(t *testing.T) {
 	defer custom.TolerantVerifyLeak(t)
 	ctx := context.Background()
@@ -739,3 +782,61 @@ func TestRemoveMmarkForNoDownsample(t *testing.T) {
 		})
 	}
 }
+
+func TestVerifyBlockDir(t *testing.T) {
+	defer custom.TolerantVerifyLeak(t)
+	ctx := context.Background()
+	logger := log.NewNopLogger()
+
+	tmpDir := t.TempDir()
+	b1, err := e2eutil.CreateBlock(ctx, tmpDir, []labels.Labels{
+		labels.New(labels.Label{Name: "a", Value: "1"}),
+		labels.New(labels.Label{Name: "a", Value: "2"}),
+	}, 100, 0, 1000, labels.EmptyLabels(), 0, metadata.NoneFunc)
+	testutil.Ok(t, err)
+	bdir := path.Join(tmpDir, b1.String())
+
+	meta, err := metadata.ReadFromDir(bdir)
+	testutil.Ok(t, err)
+	meta.Thanos.Files, err = GatherFileStats(bdir, metadata.NoneFunc, logger)
+	testutil.Ok(t, err)
+	testutil.Ok(t, meta.WriteToDir(logger, bdir))
+
+	m, err := VerifyBlockDir(ctx, logger, bdir)
+	testutil.Ok(t, err)
+	testutil.Equals(t, b1, m.ULID)
+
+	t.Run("invalid time range", func(t *testing.T) {
+		m := *meta
+		m.MaxTime = m.MinTime
+		dir := t.TempDir()
+		testutil.Ok(t, m.WriteToDir(logger, dir))
+
+		_, err := VerifyBlockDir(ctx, logger, dir)
+		testutil.NotOk(t, err)
+		testutil.Equals(t, "invalid time range [0, 0)", err.Error())
+	})
+	t.Run("truncated chunks", func(t *testing.T) {
+		dir := path.Join(t.TempDir(), b1.String())
+		testutil.Ok(t, os.MkdirAll(path.Join(dir, ChunksDirname), os.ModePerm))
+		e2eutil.Copy(t, path.Join(bdir, MetaFilename), path.Join(dir, MetaFilename))
+		e2eutil.Copy(t, path.Join(bdir, IndexFilename), path.Join(dir, IndexFilename))
+		testutil.Ok(t, os.WriteFile(path.Join(dir, ChunksDirname, "000001"), []byte("chunks"), os.ModePerm))
+
+		_, err := VerifyBlockDir(ctx, logger, dir)
+		testutil.NotOk(t, err)
+		testutil.Assert(t, strings.HasPrefix(err.Error(), "unexpected size of chunks/000001"), err.Error())
+	})
+	t.Run("missing index", func(t *testing.T) {
+		m := *meta
+		m.Thanos.Files = nil
+		dir := path.Join(t.TempDir(), b1.String())
+		testutil.Ok(t, os.MkdirAll(path.Join(dir, ChunksDirname), os.ModePerm))
+		testutil.Ok(t, m.WriteToDir(logger, dir))
+		e2eutil.Copy(t, path.Join(bdir, ChunksDirname, "000001"), path.Join(dir, ChunksDirname, "000001"))
+
+		_, err := VerifyBlockDir(ctx, logger, dir)
+		testutil.NotOk(t, err)
+		testutil.Assert(t, strings.HasPrefix(err.Error(), "verify index"), err.Error())
+	})
+}
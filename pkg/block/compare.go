@@ -0,0 +1,335 @@
+// Copyright (c) The Thanos Authors.
+// Licensed under the Apache License 2.0.
+
+package block
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"sort"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/prometheus/prometheus/model/histogram"
+	"github.com/prometheus/prometheus/model/labels"
+	"github.com/prometheus/prometheus/model/value"
+	"github.com/prometheus/prometheus/tsdb"
+	"github.com/prometheus/prometheus/tsdb/chunkenc"
+	"github.com/prometheus/prometheus/tsdb/chunks"
+	"github.com/prometheus/prometheus/tsdb/index"
+
+	"github.com/thanos-io/thanos/pkg/runutil"
+)
+
+// Comparison is the result of comparing the series and samples of two sets of blocks, A and B.
+type Comparison struct {
+	// MinTime and MaxTime are the time range in which samples were compared, i.e. the intersection of the time
+	// ranges of both sets of blocks.
+	MinTime, MaxTime int64
+
+	// Series is the number of series present in both sets of blocks.
+	Series                       int
+	SeriesOnlyInA, SeriesOnlyInB int
+
+	// Samples is the number of timestamps with equal samples in both sets of blocks.
+	Samples int
+	// MergedSamples is the number of timestamps with several samples in at least one set of blocks, e.g. because
+	// of overlapping blocks or chunks, of which one is equal to a sample of the other set. This is what compaction
+	// does when merging overlapping samples, so these are not discrepancies.
+	MergedSamples                  int
+	SamplesOnlyInA, SamplesOnlyInB int
+	DifferentSamples               int
+
+	// Differences describes the first discrepancies found.
+	Differences []string
+
+	tolerance      float64
+	maxDifferences int
+}
+
+// Discrepancies returns the number of series and samples that differ between both sets of blocks.
+func (c *Comparison) Discrepancies() int {
+	return c.SeriesOnlyInA + c.SeriesOnlyInB + c.SamplesOnlyInA + c.SamplesOnlyInB + c.DifferentSamples
+}
+
+// Compare compares the series and samples of the raw blocks a with the ones of the raw blocks b, within the
+// intersection of their time ranges. The samples of the blocks of each set are merged, so that e.g. the source
+// blocks of a compaction can be compared with the resulting block.
+// Float values are equal if their difference is within the tolerance relative to them, histograms must be equal.
+// At most maxDifferences discrepancies are described in the comparison.
+func Compare(ctx context.Context, a, b []Reader, tolerance float64, maxDifferences int) (_ *Comparison, err error) {
+	if len(a) == 0 || len(b) == 0 {
+		return nil, errors.New("both sets of blocks must not be empty")
+	}
+	amint, amaxt := timeRange(a)
+	bmint, bmaxt := timeRange(b)
+	c := &Comparison{
+		MinTime:        max(amint, bmint),
+		MaxTime:        min(amaxt, bmaxt),
+		tolerance:      tolerance,
+		maxDifferences: maxDifferences,
+	}
+	if c.MinTime >= c.MaxTime {
+		return nil, errors.New("time ranges of both sets of blocks do not overlap")
+	}
+
+	var iters []*compareSeriesIterator
+	defer func() {
+		for _, it := range iters {
+			runutil.CloseWithErrCapture(&err, it.ir, "close index reader")
+			runutil.CloseWithErrCapture(&err, it.cr, "close chunk reader")
+		}
+	}()
+	for side, readers := range [][]Reader{a, b} {
+		for _, r := range readers {
+			it, err := newCompareSeriesIterator(ctx, r, side == 0)
+			if err != nil {
+				return nil, err
+			}
+			iters = append(iters, it)
+		}
+	}
+
+	active := make([]*compareSeriesIterator, 0, len(iters))
+	for _, it := range iters {
+		ok, err := it.next()
+		if err != nil {
+			return nil, err
+		}
+		if ok {
+			active = append(active, it)
+		}
+	}
+	for len(active) > 0 {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		lset := active[0].lset
+		for _, it := range active[1:] {
+			if labels.Compare(it.lset, lset) < 0 {
+				lset = it.lset
+			}
+		}
+		// Copy the labels, as they are overwritten when the iterators move to their next series.
+		lset = lset.Copy()
+
+		var as, bs []compareSample
+		remaining := active[:0]
+		for _, it := range active {
+			if labels.Compare(it.lset, lset) == 0 {
+				samples, err := it.samples(c.MinTime, c.MaxTime)
+				if err != nil {
+					return nil, errors.Wrapf(err, "read samples of series %s", lset)
+				}
+				if it.a {
+					as = append(as, samples...)
+				} else {
+					bs = append(bs, samples...)
+				}
+				ok, err := it.next()
+				if err != nil {
+					return nil, err
+				}
+				if !ok {
+					continue
+				}
+			}
+			remaining = append(remaining, it)
+		}
+		active = remaining
+
+		c.compareSeries(lset, as, bs)
+	}
+	return c, nil
+}
+
+func timeRange(readers []Reader) (mint, maxt int64) {
+	mint, maxt = math.MaxInt64, math.MinInt64
+	for _, r := range readers {
+		mint = min(mint, r.Meta().MinTime)
+		maxt = max(maxt, r.Meta().MaxTime)
+	}
+	return mint, maxt
+}
+
+func (c *Comparison) compareSeries(lset labels.Labels, a, b []compareSample) {
+	switch {
+	case len(a) == 0 && len(b) == 0:
+		return
+	case len(b) == 0:
+		c.SeriesOnlyInA++
+		c.difference("series %s is only in A", lset)
+		return
+	case len(a) == 0:
+		c.SeriesOnlyInB++
+		c.difference("series %s is only in B", lset)
+		return
+	}
+	c.Series++
+
+	sort.SliceStable(a, func(i, j int) bool { return a[i].t < a[j].t })
+	sort.SliceStable(b, func(i, j int) bool { return b[i].t < b[j].t })
+	for len(a) > 0 || len(b) > 0 {
+		t := int64(math.MaxInt64)
+		if len(a) > 0 {
+			t = a[0].t
+		}
+		if len(b) > 0 && b[0].t < t {
+			t = b[0].t
+		}
+		na, nb := 0, 0
+		for na < len(a) && a[na].t == t {
+			na++
+		}
+		for nb < len(b) && b[nb].t == t {
+			nb++
+		}
+
+		switch {
+		case nb == 0:
+			c.SamplesOnlyInA++
+			c.difference("series %s: sample %s at %s is only in A", lset, a[0], formatTimestamp(t))
+		case na == 0:
+			c.SamplesOnlyInB++
+			c.difference("series %s: sample %s at %s is only in B", lset, b[0], formatTimestamp(t))
+		case c.anyEqual(a[:na], b[:nb]):
+			if na == 1 && nb == 1 {
+				c.Samples++
+			} else {
+				c.MergedSamples++
+			}
+		default:
+			c.DifferentSamples++
+			c.difference("series %s: samples at %s differ, A has %s and B has %s", lset, formatTimestamp(t), a[0], b[0])
+		}
+		a, b = a[na:], b[nb:]
+	}
+}
+
+// anyEqual returns true if any sample of a is equal to any sample of b.
+func (c *Comparison) anyEqual(a, b []compareSample) bool {
+	for _, x := range a {
+		for _, y := range b {
+			if c.equal(x, y) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func (c *Comparison) equal(x, y compareSample) bool {
+	if x.fh != nil || y.fh != nil {
+		return x.fh != nil && y.fh != nil && x.fh.Equals(y.fh)
+	}
+	if math.IsNaN(x.f) || math.IsNaN(y.f) {
+		return math.IsNaN(x.f) && math.IsNaN(y.f) && value.IsStaleNaN(x.f) == value.IsStaleNaN(y.f)
+	}
+	return math.Abs(x.f-y.f) <= c.tolerance*math.Max(math.Abs(x.f), math.Abs(y.f))
+}
+
+func (c *Comparison) difference(format string, args ...interface{}) {
+	if len(c.Differences) < c.maxDifferences {
+		c.Differences = append(c.Differences, fmt.Sprintf(format, args...))
+	}
+}
+
+func formatTimestamp(t int64) string {
+	return time.UnixMilli(t).UTC().Format(time.RFC3339Nano)
+}
+
+type compareSample struct {
+	t  int64
+	f  float64
+	fh *histogram.FloatHistogram
+}
+
+func (s compareSample) String() string {
+	if s.fh != nil {
+		return s.fh.String()
+	}
+	return fmt.Sprintf("%g", s.f)
+}
+
+// compareSeriesIterator iterates over the series of a block in the order of their labels.
+type compareSeriesIterator struct {
+	a  bool
+	ir tsdb.IndexReader
+	cr tsdb.ChunkReader
+
+	postings index.Postings
+	builder  labels.ScratchBuilder
+	chks     []chunks.Meta
+	lset     labels.Labels
+	it       chunkenc.Iterator
+}
+
+func newCompareSeriesIterator(ctx context.Context, r Reader, a bool) (*compareSeriesIterator, error) {
+	ir, err := r.Index()
+	if err != nil {
+		return nil, errors.Wrapf(err, "open index of block %s", r.Meta().ULID)
+	}
+	cr, err := r.Chunks()
+	if err != nil {
+		runutil.CloseWithErrCapture(&err, ir, "close index reader")
+		return nil, errors.Wrapf(err, "open chunks of block %s", r.Meta().ULID)
+	}
+	key, value := index.AllPostingsKey()
+	p, err := ir.Postings(ctx, key, value)
+	if err != nil {
+		runutil.CloseWithErrCapture(&err, ir, "close index reader")
+		runutil.CloseWithErrCapture(&err, cr, "close chunk reader")
+		return nil, errors.Wrapf(err, "postings of block %s", r.Meta().ULID)
+	}
+	return &compareSeriesIterator{a: a, ir: ir, cr: cr, postings: ir.SortedPostings(p)}, nil
+}
+
+func (it *compareSeriesIterator) next() (bool, error) {
+	if !it.postings.Next() {
+		return false, errors.Wrap(it.postings.Err(), "iterate postings")
+	}
+	if err := it.ir.Series(it.postings.At(), &it.builder, &it.chks); err != nil {
+		return false, errors.Wrap(err, "read series")
+	}
+	it.builder.Sort()
+	it.lset = it.builder.Labels()
+	return true, nil
+}
+
+// samples returns the samples of the current series within [mint, maxt).
+func (it *compareSeriesIterator) samples(mint, maxt int64) ([]compareSample, error) {
+	var samples []compareSample
+	for _, meta := range it.chks {
+		if meta.MaxTime < mint || meta.MinTime >= maxt {
+			continue
+		}
+		chk, iterable, err := it.cr.ChunkOrIterable(meta)
+		if err != nil {
+			return nil, errors.Wrapf(err, "read chunk %d", meta.Ref)
+		}
+		if iterable != nil {
+			it.it = iterable.Iterator(it.it)
+		} else {
+			it.it = chk.Iterator(it.it)
+		}
+		for vt := it.it.Next(); vt != chunkenc.ValNone; vt = it.it.Next() {
+			var s compareSample
+			switch vt {
+			case chunkenc.ValFloat:
+				s.t, s.f = it.it.At()
+			case chunkenc.ValHistogram, chunkenc.ValFloatHistogram:
+				s.t, s.fh = it.it.AtFloatHistogram(nil)
+			default:
+				return nil, errors.Errorf("unknown value type %v", vt)
+			}
+			if s.t >= mint && s.t < maxt {
+				samples = append(samples, s)
+			}
+		}
+		if err := it.it.Err(); err != nil {
+			return nil, errors.Wrapf(err, "iterate chunk %d", meta.Ref)
+		}
+	}
+	return samples, nil
+}
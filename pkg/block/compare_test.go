@@ -0,0 +1,91 @@
+// Copyright (c) The Thanos Authors.
+// Licensed under the Apache License 2.0.
+
+package block
+
+import (
+	"context"
+	"path/filepath"
+	"testing"
+
+	"github.com/efficientgo/core/testutil"
+	"github.com/go-kit/log"
+	"github.com/prometheus/prometheus/model/labels"
+	"github.com/prometheus/prometheus/tsdb"
+)
+
+func TestCompare(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+
+	type sample struct {
+		lset labels.Labels
+		t    int64
+		v    float64
+	}
+	var (
+		a = labels.FromStrings("__name__", "up", "job", "a")
+		b = labels.FromStrings("__name__", "up", "job", "b")
+		c = labels.FromStrings("__name__", "up", "job", "c")
+	)
+	createBlock := func(samples ...sample) Reader {
+		w, err := tsdb.NewBlockWriter(log.NewNopLogger(), dir, tsdb.DefaultBlockDuration)
+		testutil.Ok(t, err)
+		app := w.Appender(ctx)
+		for _, s := range samples {
+			_, err := app.Append(0, s.lset, s.t, s.v)
+			testutil.Ok(t, err)
+		}
+		testutil.Ok(t, app.Commit())
+		id, err := w.Flush(ctx)
+		testutil.Ok(t, err)
+		testutil.Ok(t, w.Close())
+
+		r, err := tsdb.OpenBlock(nil, filepath.Join(dir, id.String()), nil)
+		testutil.Ok(t, err)
+		t.Cleanup(func() { testutil.Ok(t, r.Close()) })
+		return r
+	}
+
+	// Overlapping source blocks, as merged by a vertical compaction.
+	sources := []Reader{
+		createBlock(sample{a, 0, 1}, sample{a, 1000, 2}, sample{a, 2000, 3}, sample{b, 0, 1}),
+		createBlock(sample{a, 2000, 3.5}, sample{a, 3000, 4}),
+	}
+	compacted := []Reader{
+		createBlock(sample{a, 0, 1}, sample{a, 1000, 2.000001}, sample{a, 1500, 9}, sample{a, 2000, 3.5}, sample{a, 3000, 4}, sample{c, 0, 1}),
+	}
+
+	cmp, err := Compare(ctx, sources, compacted, 1e-6, 2)
+	testutil.Ok(t, err)
+	testutil.Equals(t, int64(0), cmp.MinTime)
+	testutil.Equals(t, int64(3001), cmp.MaxTime)
+	testutil.Equals(t, 1, cmp.Series)
+	testutil.Equals(t, 1, cmp.SeriesOnlyInA)
+	testutil.Equals(t, 1, cmp.SeriesOnlyInB)
+	testutil.Equals(t, 3, cmp.Samples)
+	testutil.Equals(t, 1, cmp.MergedSamples)
+	testutil.Equals(t, 0, cmp.SamplesOnlyInA)
+	testutil.Equals(t, 1, cmp.SamplesOnlyInB)
+	testutil.Equals(t, 0, cmp.DifferentSamples)
+	testutil.Equals(t, 3, cmp.Discrepancies())
+	testutil.Equals(t, []string{
+		`series {__name__="up", job="a"}: sample 9 at 1970-01-01T00:00:01.5Z is only in B`,
+		`series {__name__="up", job="b"} is only in A`,
+	}, cmp.Differences)
+
+	// Without tolerance, the slightly different value is a discrepancy.
+	cmp, err = Compare(ctx, sources, compacted, 0, 0)
+	testutil.Ok(t, err)
+	testutil.Equals(t, 2, cmp.Samples)
+	testutil.Equals(t, 1, cmp.DifferentSamples)
+	testutil.Equals(t, 4, cmp.Discrepancies())
+	testutil.Equals(t, 0, len(cmp.Differences))
+
+	// Only the samples within the intersection of the time ranges are compared.
+	cmp, err = Compare(ctx, sources[1:], compacted, 0, 10)
+	testutil.Ok(t, err)
+	testutil.Equals(t, int64(2000), cmp.MinTime)
+	testutil.Equals(t, 2, cmp.Samples)
+	testutil.Equals(t, 0, cmp.Discrepancies())
+}
@@ -529,7 +529,7 @@ func (f *BaseFetcher) fetchMetadata(ctx context.Context) (interface{}, error) {
 	mtx.Lock()
 	for blockULID, isPartial := range partialBlocks {
 		if isPartial {
-			resp.partial[blockULID] = errors.Errorf("block %s has no meta file", blockULID)
+			resp.partial[blockULID] = errors.Wrapf(ErrorSyncMetaNotFound, "block %s has no meta file", blockULID)
 			resp.noMetas++
 		}
 	}
@@ -948,6 +948,107 @@ func (f *ConsistencyDelayMetaFilter) Filter(_ context.Context, metas map[ulid.UL
 	return nil
 }
 
+// UploadDelayMetaFilter is a filter that filters out blocks whose meta.json was modified in the bucket within a given delay.
+// Unlike ConsistencyDelayMetaFilter, the delay is based on the upload time of blocks rather than their ULID, so that blocks
+// uploaded long after they were created, or whose meta.json is rewritten before they pass the filter, are also delayed.
+// Once a block passed the filter it is not checked again, so its meta.json being rewritten later does not delay it.
+// Not go-routine safe.
+type UploadDelayMetaFilter struct {
+	logger      log.Logger
+	bkt         objstore.InstrumentedBucketReader
+	delay       time.Duration
+	concurrency int
+
+	// Blocks whose meta.json was already older than the delay. They are not checked again.
+	stable map[ulid.ULID]struct{}
+}
+
+// NewUploadDelayMetaFilter creates UploadDelayMetaFilter.
+func NewUploadDelayMetaFilter(logger log.Logger, bkt objstore.InstrumentedBucketReader, delay time.Duration, concurrency int) *UploadDelayMetaFilter {
+	return &UploadDelayMetaFilter{
+		logger:      logger,
+		bkt:         bkt,
+		delay:       delay,
+		concurrency: concurrency,
+		stable:      map[ulid.ULID]struct{}{},
+	}
+}
+
+// Filter filters out blocks whose meta.json was modified within the delay.
+func (f *UploadDelayMetaFilter) Filter(ctx context.Context, metas map[ulid.ULID]*metadata.Meta, synced GaugeVec, modified GaugeVec) error {
+	for id := range f.stable {
+		if _, ok := metas[id]; !ok {
+			delete(f.stable, id)
+		}
+	}
+
+	// Make a copy of block IDs to check, in order to avoid concurrency issues
+	// between the scheduler and workers.
+	blockIDs := make([]ulid.ULID, 0, len(metas))
+	for id := range metas {
+		if _, ok := f.stable[id]; !ok {
+			blockIDs = append(blockIDs, id)
+		}
+	}
+
+	var (
+		eg  errgroup.Group
+		ch  = make(chan ulid.ULID, f.concurrency)
+		mtx sync.Mutex
+	)
+
+	for i := 0; i < f.concurrency; i++ {
+		eg.Go(func() error {
+			var lastErr error
+			for id := range ch {
+				attrs, err := f.bkt.ReaderWithExpectedErrs(f.bkt.IsObjNotFoundErr).Attributes(ctx, path.Join(id.String(), MetaFilename))
+				if err != nil && !f.bkt.IsObjNotFoundErr(err) {
+					// Remember the last error and continue to drain the channel.
+					lastErr = errors.Wrapf(err, "get attributes of meta.json of block %s", id)
+					continue
+				}
+
+				mtx.Lock()
+				switch {
+				case err != nil:
+					// The block is being deleted.
+					delete(metas, id)
+				case time.Since(attrs.LastModified) < f.delay:
+					level.Debug(f.logger).Log("msg", "block was uploaded too recently", "block", id, "last_modified", attrs.LastModified)
+					synced.WithLabelValues(tooFreshMeta).Inc()
+					delete(metas, id)
+				default:
+					f.stable[id] = struct{}{}
+				}
+				mtx.Unlock()
+			}
+
+			return lastErr
+		})
+	}
+
+	// Workers scheduled, distribute blocks.
+	eg.Go(func() error {
+		defer close(ch)
+
+		for _, id := range blockIDs {
+			select {
+			case ch <- id:
+				// Nothing to do.
+			case <-ctx.Done():
+				return ctx.Err()
+			}
+		}
+
+		return nil
+	})
+
+	if err := eg.Wait(); err != nil {
+		return errors.Wrap(err, "filter recently uploaded blocks")
+	}
+	return nil
+}
+
 // IgnoreDeletionMarkFilter is a filter that filters out the blocks that are marked for deletion after a given delay.
 // The delay duration is to make sure that the replacement block can be fetched before we filter out the old block.
 // Delay is not considered when computing DeletionMarkBlocks map.
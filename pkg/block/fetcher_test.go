@@ -14,6 +14,7 @@ import (
 	"path/filepath"
 	"runtime"
 	"sort"
+	"sync"
 	"testing"
 	"time"
 
@@ -1123,6 +1124,70 @@ func TestIgnoreDeletionMarkFilter_Filter(t *testing.T) {
 	})
 }
 
+// lastModifiedBucket returns the given modification times as attributes of objects.
+type lastModifiedBucket struct {
+	objstore.Bucket
+
+	lastModified map[string]time.Time
+
+	mtx        sync.Mutex
+	attrsCalls int
+}
+
+func (b *lastModifiedBucket) Attributes(ctx context.Context, name string) (objstore.ObjectAttributes, error) {
+	b.mtx.Lock()
+	b.attrsCalls++
+	b.mtx.Unlock()
+	attrs, err := b.Bucket.Attributes(ctx, name)
+	if err != nil {
+		return attrs, err
+	}
+	attrs.LastModified = b.lastModified[name]
+	return attrs, nil
+}
+
+func TestUploadDelayMetaFilter_Filter(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 120*time.Second)
+	defer cancel()
+
+	now := time.Now()
+	bkt := &lastModifiedBucket{Bucket: objstore.NewInMemBucket(), lastModified: map[string]time.Time{}}
+	for i, age := range []time.Duration{time.Hour, 10 * time.Minute, 2 * time.Hour} {
+		name := path.Join(ULID(i+1).String(), MetaFilename)
+		testutil.Ok(t, bkt.Upload(ctx, name, bytes.NewBufferString("{}")))
+		bkt.lastModified[name] = now.Add(-age)
+	}
+
+	f := NewUploadDelayMetaFilter(log.NewNopLogger(), objstore.WithNoopInstr(bkt), 30*time.Minute, 2)
+
+	input := map[ulid.ULID]*metadata.Meta{
+		ULID(1): {},
+		ULID(2): {},
+		ULID(3): {},
+		// Block deleted since it was listed.
+		ULID(4): {},
+	}
+	m := newTestFetcherMetrics()
+	testutil.Ok(t, f.Filter(ctx, input, m.Synced, nil))
+	testutil.Equals(t, 1.0, promtest.ToFloat64(m.Synced.WithLabelValues(tooFreshMeta)))
+	testutil.Equals(t, map[ulid.ULID]*metadata.Meta{ULID(1): {}, ULID(3): {}}, input)
+	testutil.Equals(t, 4, bkt.attrsCalls)
+
+	// Delayed blocks are served once their meta.json is old enough, while blocks already served are not checked again.
+	bkt.lastModified[path.Join(ULID(2).String(), MetaFilename)] = now.Add(-time.Hour)
+	bkt.lastModified[path.Join(ULID(3).String(), MetaFilename)] = now
+	input = map[ulid.ULID]*metadata.Meta{
+		ULID(1): {},
+		ULID(2): {},
+		ULID(3): {},
+	}
+	m = newTestFetcherMetrics()
+	testutil.Ok(t, f.Filter(ctx, input, m.Synced, nil))
+	testutil.Equals(t, 0.0, promtest.ToFloat64(m.Synced.WithLabelValues(tooFreshMeta)))
+	testutil.Equals(t, map[ulid.ULID]*metadata.Meta{ULID(1): {}, ULID(2): {}, ULID(3): {}}, input)
+	testutil.Equals(t, 5, bkt.attrsCalls)
+}
+
 func BenchmarkDeduplicateFilter_Filter(b *testing.B) {
 
 	var (
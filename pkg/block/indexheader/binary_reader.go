@@ -29,6 +29,7 @@ import (
 	"github.com/prometheus/prometheus/tsdb/fileutil"
 	"github.com/prometheus/prometheus/tsdb/index"
 	"github.com/thanos-io/objstore"
+	"go.uber.org/atomic"
 
 	"github.com/thanos-io/thanos/pkg/block"
 	"github.com/thanos-io/thanos/pkg/runutil"
@@ -554,14 +555,47 @@ type BinaryReader struct {
 
 	postingOffsetsInMemSampling int
 
+	// Set once the postings offset table is fully loaded, after which postings and nameSymbols are not modified anymore.
+	postingsLoaded atomic.Bool
+	// Progress of the background load of the postings offset table, nil if it is loaded before the reader is returned.
+	load *postingsLoad
+
 	metrics *BinaryReaderMetrics
 }
 
+var errPostingsLoadStopped = errors.New("the index-header has been closed while loading")
+
+// postingsLoad tracks the progress of the background load of the postings offset table. Label names are sorted in
+// the table, so any label name up to the last loaded one is either loaded or absent from the block.
+type postingsLoad struct {
+	// Protects postings of the reader until the load is done.
+	mtx      sync.Mutex
+	cond     *sync.Cond
+	started  bool
+	lastName string
+	done     bool
+	err      error
+
+	stopOnce sync.Once
+	stop     chan struct{}
+	stopped  chan struct{}
+}
+
+func newPostingsLoad() *postingsLoad {
+	l := &postingsLoad{
+		stop:    make(chan struct{}),
+		stopped: make(chan struct{}),
+	}
+	l.cond = sync.NewCond(&l.mtx)
+	return l
+}
+
 // NewBinaryReader loads or builds new index-header if not present on disk.
-func NewBinaryReader(ctx context.Context, logger log.Logger, bkt objstore.BucketReader, dir string, id ulid.ULID, postingOffsetsInMemSampling int, metrics *BinaryReaderMetrics) (*BinaryReader, error) {
+func NewBinaryReader(ctx context.Context, logger log.Logger, bkt objstore.BucketReader, dir string, id ulid.ULID, postingOffsetsInMemSampling int, metrics *BinaryReaderMetrics, opts ...BinaryReaderOption) (*BinaryReader, error) {
+	o := newBinaryReaderOptions(opts)
 	if dir != "" {
 		binfn := filepath.Join(dir, id.String(), block.IndexHeaderFilename)
-		br, err := newFileBinaryReader(binfn, postingOffsetsInMemSampling, metrics)
+		br, err := newFileBinaryReader(binfn, postingOffsetsInMemSampling, metrics, o)
 		if err == nil {
 			return br, nil
 		}
@@ -575,18 +609,18 @@ func NewBinaryReader(ctx context.Context, logger log.Logger, bkt objstore.Bucket
 		metrics.loadDuration.Observe(time.Since(start).Seconds())
 
 		level.Debug(logger).Log("msg", "built index-header file", "path", binfn, "elapsed", time.Since(start))
-		return newFileBinaryReader(binfn, postingOffsetsInMemSampling, metrics)
+		return newFileBinaryReader(binfn, postingOffsetsInMemSampling, metrics, o)
 	} else {
 		buf, err := WriteBinary(ctx, bkt, id, "")
 		if err != nil {
 			return nil, errors.Wrap(err, "generate index header")
 		}
 
-		return newMemoryBinaryReader(buf, postingOffsetsInMemSampling, metrics)
+		return newMemoryBinaryReader(buf, postingOffsetsInMemSampling, metrics, o)
 	}
 }
 
-func newMemoryBinaryReader(buf []byte, postingOffsetsInMemSampling int, metrics *BinaryReaderMetrics) (bw *BinaryReader, err error) {
+func newMemoryBinaryReader(buf []byte, postingOffsetsInMemSampling int, metrics *BinaryReaderMetrics, o binaryReaderOptions) (bw *BinaryReader, err error) {
 	r := &BinaryReader{
 		b:                           realByteSlice(buf),
 		c:                           nil,
@@ -595,24 +629,31 @@ func newMemoryBinaryReader(buf []byte, postingOffsetsInMemSampling int, metrics
 		metrics:                     metrics,
 	}
 
-	if err := r.init(); err != nil {
-		return nil, err
+	if err := r.init(o.progressiveLoad); err != nil {
+		return nil, corruptedError{err: err}
 	}
 
 	return r, nil
 }
 
-func newFileBinaryReader(path string, postingOffsetsInMemSampling int, metrics *BinaryReaderMetrics) (bw *BinaryReader, err error) {
+func newFileBinaryReader(path string, postingOffsetsInMemSampling int, metrics *BinaryReaderMetrics, o binaryReaderOptions) (bw *BinaryReader, err error) {
 	f, err := fileutil.OpenMmapFile(path)
 	if err != nil {
 		return nil, err
 	}
 	defer func() {
 		if err != nil {
-			runutil.CloseWithErrCapture(&err, f, "index header close")
+			// The close error is added to the message only, since capturing it hides the type of the error.
+			if cerr := f.Close(); cerr != nil {
+				err = errors.Wrapf(err, "index header close: %v", cerr)
+			}
 		}
 	}()
 
+	if err := madvise(f.Bytes(), o.mmapAdvice); err != nil {
+		return nil, errors.Wrap(err, "madvise index header")
+	}
+
 	r := &BinaryReader{
 		b:                           realByteSlice(f.Bytes()),
 		c:                           f,
@@ -621,8 +662,8 @@ func newFileBinaryReader(path string, postingOffsetsInMemSampling int, metrics *
 		metrics:                     metrics,
 	}
 
-	if err := r.init(); err != nil {
-		return nil, err
+	if err := r.init(o.progressiveLoad); err != nil {
+		return nil, corruptedError{err: err}
 	}
 
 	return r, nil
@@ -652,11 +693,16 @@ func newBinaryTOCFromByteSlice(bs index.ByteSlice) (*BinaryTOC, error) {
 	}, nil
 }
 
-func (r *BinaryReader) init() (err error) {
+// init reads the index-header. If progressive is true, the postings offset table of the v2 index format is
+// loaded in the background once init returns.
+func (r *BinaryReader) init(progressive bool) (err error) {
 	start := time.Now()
 
 	defer func() {
-		r.metrics.loadDuration.Observe(time.Since(start).Seconds())
+		// Progressive loads are observed once done.
+		if r.load == nil {
+			r.metrics.loadDuration.Observe(time.Since(start).Seconds())
+		}
 	}()
 	// Verify header.
 	if r.b.Len() < headerLen {
@@ -685,88 +731,162 @@ func (r *BinaryReader) init() (err error) {
 		return errors.Wrap(err, "read symbols")
 	}
 
-	var lastName, lastValue []byte
-	if r.indexVersion == index.FormatV1 {
-		// Earlier V1 formats don't have a sorted postings offset table, so
-		// load the whole offset table into memory.
-		r.postingsV1 = map[string]map[string]index.Range{}
-
-		var prevRng index.Range
-		if err := index.ReadPostingsOffsetTable(r.b, r.toc.PostingsOffsetTable, func(name, value []byte, postingsOffset uint64, _ int) error {
-			if lastName != nil {
-				prevRng.End = int64(postingsOffset - crc32.Size)
-				r.postingsV1[string(lastName)][string(lastValue)] = prevRng
-			}
-
-			if _, ok := r.postingsV1[string(name)]; !ok {
-				r.postingsV1[string(name)] = map[string]index.Range{}
-				r.postings[string(name)] = nil // Used to get a list of labelnames in places.
-			}
+	r.dec = &index.Decoder{LookupSymbol: r.LookupSymbol}
 
-			lastName = name
-			lastValue = value
-			prevRng = index.Range{Start: int64(postingsOffset + postingLengthFieldSize)}
+	if r.indexVersion == index.FormatV1 {
+		if err := r.readPostingsOffsetTableV1(); err != nil {
+			return err
+		}
+	} else if progressive {
+		r.load = newPostingsLoad()
+		go r.loadPostingsOffsetTable(start)
+		return nil
+	} else {
+		if err := r.readPostingsOffsetTable(func(name string, e *postingValueOffsets) error {
+			r.postings[name] = e
 			return nil
 		}); err != nil {
-			return errors.Wrap(err, "read postings table")
+			return err
 		}
-		if string(lastName) != "" {
-			prevRng.End = r.indexLastPostingEnd - crc32.Size
+	}
+	if err := r.initNameSymbols(); err != nil {
+		return err
+	}
+	r.postingsLoaded.Store(true)
+	return nil
+}
+
+// readPostingsOffsetTableV1 loads the whole postings offset table of the v1 index format in memory.
+func (r *BinaryReader) readPostingsOffsetTableV1() error {
+	// Earlier V1 formats don't have a sorted postings offset table, so
+	// load the whole offset table into memory.
+	r.postingsV1 = map[string]map[string]index.Range{}
+
+	var (
+		lastName, lastValue []byte
+		prevRng             index.Range
+	)
+	if err := index.ReadPostingsOffsetTable(r.b, r.toc.PostingsOffsetTable, func(name, value []byte, postingsOffset uint64, _ int) error {
+		if lastName != nil {
+			prevRng.End = int64(postingsOffset - crc32.Size)
 			r.postingsV1[string(lastName)][string(lastValue)] = prevRng
 		}
-	} else {
-		lastTableOff := 0
-		valueCount := 0
-
-		// For the postings offset table we keep every label name but only every nth
-		// label value (plus the first and last one), to save memory.
-		if err := index.ReadPostingsOffsetTable(r.b, r.toc.PostingsOffsetTable, func(name, value []byte, postingsOffset uint64, labelOffset int) error {
-			if _, ok := r.postings[string(name)]; !ok {
-				// Not seen before label name.
-				r.postings[string(name)] = &postingValueOffsets{}
-				if lastName != nil {
-					// Always include last value for each label name, unless it was just added in previous iteration based
-					// on valueCount.
-					if (valueCount-1)%r.postingOffsetsInMemSampling != 0 {
-						r.postings[string(lastName)].offsets = append(r.postings[string(lastName)].offsets, postingOffset{value: string(lastValue), tableOff: lastTableOff})
-					}
-					r.postings[string(lastName)].lastValOffset = int64(postingsOffset - crc32.Size)
-					lastName = nil
-					lastValue = nil
-				}
-				valueCount = 0
-			}
 
-			lastName = name
-			lastValue = value
-			lastTableOff = labelOffset
-			valueCount++
+		if _, ok := r.postingsV1[string(name)]; !ok {
+			r.postingsV1[string(name)] = map[string]index.Range{}
+			r.postings[string(name)] = nil // Used to get a list of labelnames in places.
+		}
 
-			if (valueCount-1)%r.postingOffsetsInMemSampling == 0 {
-				r.postings[string(name)].offsets = append(r.postings[string(name)].offsets, postingOffset{value: string(value), tableOff: labelOffset})
-			}
+		lastName = name
+		lastValue = value
+		prevRng = index.Range{Start: int64(postingsOffset + postingLengthFieldSize)}
+		return nil
+	}); err != nil {
+		return errors.Wrap(err, "read postings table")
+	}
+	if string(lastName) != "" {
+		prevRng.End = r.indexLastPostingEnd - crc32.Size
+		r.postingsV1[string(lastName)][string(lastValue)] = prevRng
+	}
+	return nil
+}
 
-			return nil
-		}); err != nil {
-			return errors.Wrap(err, "read postings table")
+// readPostingsOffsetTable reads the postings offset table of the v2 index format. It calls publish with the in-memory
+// postings offsets of every label name, in the sorted order of the table, once they are complete.
+func (r *BinaryReader) readPostingsOffsetTable(publish func(name string, e *postingValueOffsets) error) error {
+	var (
+		lastName, lastValue []byte
+		lastTableOff        int
+		valueCount          int
+		e                   *postingValueOffsets
+	)
+	complete := func(lastValOffset int64) error {
+		// Always include last value for each label name, unless it was just added in previous iteration based
+		// on valueCount.
+		if (valueCount-1)%r.postingOffsetsInMemSampling != 0 {
+			e.offsets = append(e.offsets, postingOffset{value: string(lastValue), tableOff: lastTableOff})
 		}
-		if lastName != nil {
-			if (valueCount-1)%r.postingOffsetsInMemSampling != 0 {
-				// Always include last value for each label name if not included already based on valueCount.
-				r.postings[string(lastName)].offsets = append(r.postings[string(lastName)].offsets, postingOffset{value: string(lastValue), tableOff: lastTableOff})
+		e.lastValOffset = lastValOffset
+		// Trim any extra space in the slice.
+		l := make([]postingOffset, len(e.offsets))
+		copy(l, e.offsets)
+		e.offsets = l
+		return publish(string(lastName), e)
+	}
+
+	// For the postings offset table we keep every label name but only every nth
+	// label value (plus the first and last one), to save memory.
+	if err := index.ReadPostingsOffsetTable(r.b, r.toc.PostingsOffsetTable, func(name, value []byte, postingsOffset uint64, labelOffset int) error {
+		if e == nil || !bytes.Equal(name, lastName) {
+			// Not seen before label name.
+			if e != nil {
+				if err := complete(int64(postingsOffset - crc32.Size)); err != nil {
+					return err
+				}
 			}
-			// In any case lastValOffset is unknown as don't have next posting anymore. Guess from TOC table.
-			// In worst case we will overfetch a few bytes.
-			r.postings[string(lastName)].lastValOffset = r.indexLastPostingEnd - crc32.Size
+			e = &postingValueOffsets{}
+			valueCount = 0
 		}
-		// Trim any extra space in the slices.
-		for k, v := range r.postings {
-			l := make([]postingOffset, len(v.offsets))
-			copy(l, v.offsets)
-			r.postings[k].offsets = l
+
+		lastName = name
+		lastValue = value
+		lastTableOff = labelOffset
+		valueCount++
+
+		if (valueCount-1)%r.postingOffsetsInMemSampling == 0 {
+			e.offsets = append(e.offsets, postingOffset{value: string(value), tableOff: labelOffset})
 		}
+		return nil
+	}); err != nil {
+		return errors.Wrap(err, "read postings table")
 	}
+	if e == nil {
+		return nil
+	}
+	// In any case lastValOffset is unknown as don't have next posting anymore. Guess from TOC table.
+	// In worst case we will overfetch a few bytes.
+	return complete(r.indexLastPostingEnd - crc32.Size)
+}
+
+// loadPostingsOffsetTable loads the postings offset table of the v2 index format in the background, making every
+// label name available as soon as it is read.
+func (r *BinaryReader) loadPostingsOffsetTable(start time.Time) {
+	defer close(r.load.stopped)
+
+	err := r.readPostingsOffsetTable(func(name string, e *postingValueOffsets) error {
+		select {
+		case <-r.load.stop:
+			return errPostingsLoadStopped
+		default:
+		}
+
+		r.load.mtx.Lock()
+		r.postings[name] = e
+		r.load.started = true
+		r.load.lastName = name
+		r.load.mtx.Unlock()
+		r.load.cond.Broadcast()
+		return nil
+	})
+	if err == nil {
+		// This goroutine is the only writer of postings, reading them without the lock is safe.
+		err = r.initNameSymbols()
+	}
+
+	r.load.mtx.Lock()
+	r.load.done = true
+	r.load.err = err
+	r.load.mtx.Unlock()
+	r.load.cond.Broadcast()
+
+	if err == nil {
+		r.postingsLoaded.Store(true)
+		r.metrics.loadDuration.Observe(time.Since(start).Seconds())
+	}
+}
 
+// initNameSymbols caches the symbols of all label names.
+func (r *BinaryReader) initNameSymbols() error {
 	r.nameSymbols = make(map[uint32]string, len(r.postings))
 	for k := range r.postings {
 		if k == "" {
@@ -778,12 +898,77 @@ func (r *BinaryReader) init() (err error) {
 		}
 		r.nameSymbols[off] = k
 	}
+	return nil
+}
 
-	r.dec = &index.Decoder{LookupSymbol: r.LookupSymbol}
+// postingValueOffsets returns the in-memory postings offsets of the label name. While the postings offset table is
+// loaded in the background, it waits for the label name to be loaded, or to be known to be absent from the block.
+func (r *BinaryReader) postingValueOffsets(name string) (*postingValueOffsets, bool, error) {
+	if r.postingsLoaded.Load() {
+		e, ok := r.postings[name]
+		return e, ok, nil
+	}
+
+	r.load.mtx.Lock()
+	defer r.load.mtx.Unlock()
+	for !r.load.done && (!r.load.started || r.load.lastName < name) {
+		r.load.cond.Wait()
+	}
+	e, ok := r.postings[name]
+	if !ok && r.load.err != nil {
+		// The label name may be in the part of the table which could not be loaded.
+		return nil, false, errors.Wrap(r.load.err, "load postings offset table")
+	}
+	return e, ok, nil
+}
+
+// waitPostingsLoaded waits for the postings offset table to be fully loaded.
+func (r *BinaryReader) waitPostingsLoaded() error {
+	if r.postingsLoaded.Load() {
+		return nil
+	}
 
+	r.load.mtx.Lock()
+	defer r.load.mtx.Unlock()
+	for !r.load.done {
+		r.load.cond.Wait()
+	}
+	if r.load.err != nil {
+		return errors.Wrap(r.load.err, "load postings offset table")
+	}
 	return nil
 }
 
+// MemoryUsage implements MemoryReporter.
+func (r *BinaryReader) MemoryUsage() (mapped, tables int64) {
+	// Approximate sizes of string headers and map entries.
+	const stringSize, entrySize = 16, 16
+
+	if !r.postingsLoaded.Load() && r.load != nil {
+		r.load.mtx.Lock()
+		defer r.load.mtx.Unlock()
+	}
+	for name, offsets := range r.postings {
+		tables += entrySize + stringSize + int64(len(name))
+		for _, o := range offsets.offsets {
+			tables += stringSize + int64(len(o.value)) + 8
+		}
+	}
+	for name, values := range r.postingsV1 {
+		tables += entrySize + stringSize + int64(len(name))
+		for value := range values {
+			tables += entrySize + stringSize + int64(len(value)) + 16
+		}
+	}
+	for _, name := range r.nameSymbols {
+		tables += entrySize + stringSize + int64(len(name)) + 4
+	}
+	if r.symbols != nil {
+		tables += int64(r.symbols.Size())
+	}
+	return int64(r.b.Len()), tables
+}
+
 func (r *BinaryReader) IndexVersion() (int, error) {
 	return r.indexVersion, nil
 }
@@ -834,7 +1019,10 @@ func (r *BinaryReader) postingsOffset(name string, values ...string) ([]index.Ra
 		return rngs, nil
 	}
 
-	e, ok := r.postings[name]
+	e, ok, err := r.postingValueOffsets(name)
+	if err != nil {
+		return nil, err
+	}
 	if !ok {
 		return nil, nil
 	}
@@ -980,8 +1168,11 @@ func (r *BinaryReader) LookupSymbol(ctx context.Context, o uint32) (string, erro
 		o += headerLen - index.HeaderLen
 	}
 
-	if s, ok := r.nameSymbols[o]; ok {
-		return s, nil
+	// Until the postings offset table is loaded, label names are looked up like values.
+	if r.postingsLoaded.Load() {
+		if s, ok := r.nameSymbols[o]; ok {
+			return s, nil
+		}
 	}
 
 	cacheIndex := o % valueSymbolsCacheSize
@@ -1020,7 +1211,10 @@ func (r *BinaryReader) LabelValues(name string) ([]string, error) {
 		return values, nil
 
 	}
-	e, ok := r.postings[name]
+	e, ok, err := r.postingValueOffsets(name)
+	if err != nil {
+		return nil, err
+	}
 	if !ok {
 		return nil, nil
 	}
@@ -1063,6 +1257,9 @@ func yoloString(b []byte) string {
 }
 
 func (r *BinaryReader) LabelNames() ([]string, error) {
+	if err := r.waitPostingsLoaded(); err != nil {
+		return nil, err
+	}
 	allPostingsKeyName, _ := index.AllPostingsKey()
 	labelNames := make([]string, 0, len(r.postings))
 	for name := range r.postings {
@@ -1077,6 +1274,11 @@ func (r *BinaryReader) LabelNames() ([]string, error) {
 }
 
 func (r *BinaryReader) Close() error {
+	if r.load != nil {
+		// Stop the background load before releasing the byte slice it reads.
+		r.load.stopOnce.Do(func() { close(r.load.stop) })
+		<-r.load.stopped
+	}
 	if r.c == nil {
 		return nil
 	}
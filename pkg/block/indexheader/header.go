@@ -14,6 +14,29 @@ import (
 // NotFoundRangeErr is an error returned by PostingsOffset when there is no posting for given name and value pairs.
 var NotFoundRangeErr = errors.New("range not found")
 
+// corruptedError is returned when an index-header cannot be parsed.
+type corruptedError struct {
+	err error
+}
+
+func (e corruptedError) Error() string { return "corrupted index-header: " + e.err.Error() }
+
+func (e corruptedError) Unwrap() error { return e.err }
+
+// IsCorrupted returns true if the error was caused by an index-header that cannot be parsed,
+// as opposed to e.g. a failure to download it.
+func IsCorrupted(err error) bool {
+	var c corruptedError
+	return errors.As(err, &c)
+}
+
+// MemoryReporter is implemented by Readers able to report their memory footprint.
+type MemoryReporter interface {
+	// MemoryUsage returns the size in bytes of the index-header mapped into memory, and an estimate of the size
+	// of the lookup tables built from it. Both are zero if the index-header is not loaded.
+	MemoryUsage() (mapped, tables int64)
+}
+
 // Reader is an interface allowing to read essential, minimal number of index fields from the small portion of index file called header.
 type Reader interface {
 	io.Closer
@@ -9,6 +9,8 @@ import (
 	"math"
 	"math/rand"
 	"path/filepath"
+	"reflect"
+	"runtime"
 	"sort"
 	"strconv"
 	"testing"
@@ -24,6 +26,7 @@ import (
 	"github.com/stretchr/testify/require"
 	"github.com/thanos-io/objstore"
 	"github.com/thanos-io/objstore/providers/filesystem"
+	"golang.org/x/sync/errgroup"
 
 	"github.com/efficientgo/core/testutil"
 	"github.com/thanos-io/thanos/pkg/block"
@@ -226,6 +229,19 @@ func TestReaders(t *testing.T) {
 				compareIndexToHeader(t, b, br)
 			})
 
+			t.Run("binary reader with progressive load", func(t *testing.T) {
+				fn := filepath.Join(tmpDir, id.String(), block.IndexHeaderFilename)
+				_, err := WriteBinary(ctx, bkt, id, fn)
+				testutil.Ok(t, err)
+
+				br, err := NewBinaryReader(ctx, log.NewNopLogger(), nil, tmpDir, id, 3, NewBinaryReaderMetrics(nil), WithProgressiveLoad(true))
+				testutil.Ok(t, err)
+
+				defer func() { testutil.Ok(t, br.Close()) }()
+
+				compareIndexToHeader(t, b, br)
+			})
+
 			t.Run("lazy binary reader", func(t *testing.T) {
 				fn := filepath.Join(tmpDir, id.String(), block.IndexHeaderFilename)
 				_, err := WriteBinary(ctx, bkt, id, fn)
@@ -243,6 +259,121 @@ func TestReaders(t *testing.T) {
 
 }
 
+func TestBinaryReader_MmapAdvice(t *testing.T) {
+	ctx := context.Background()
+	tmpDir := t.TempDir()
+
+	bkt, err := filesystem.NewBucket(filepath.Join(tmpDir, "bkt"))
+	testutil.Ok(t, err)
+	defer func() { testutil.Ok(t, bkt.Close()) }()
+
+	m := prepareIndexV2Block(t, tmpDir, bkt)
+
+	for _, advice := range MmapAdvices {
+		t.Run(string(advice), func(t *testing.T) {
+			br, err := NewBinaryReader(ctx, log.NewNopLogger(), bkt, tmpDir, m.ULID, 32, NewBinaryReaderMetrics(nil), WithMmapAdvice(advice))
+			testutil.Ok(t, err)
+			defer func() { testutil.Ok(t, br.Close()) }()
+
+			names, err := br.LabelNames()
+			testutil.Ok(t, err)
+			testutil.Assert(t, len(names) > 0, "expected label names")
+		})
+	}
+
+	if runtime.GOOS == "linux" {
+		_, err = NewBinaryReader(ctx, log.NewNopLogger(), bkt, tmpDir, m.ULID, 32, NewBinaryReaderMetrics(nil), WithMmapAdvice("unknown"))
+		testutil.NotOk(t, err)
+	}
+}
+
+func TestBinaryReader_ProgressiveLoad(t *testing.T) {
+	ctx := context.Background()
+	tmpDir := t.TempDir()
+
+	bkt, err := filesystem.NewBucket(filepath.Join(tmpDir, "bkt"))
+	testutil.Ok(t, err)
+	defer func() { testutil.Ok(t, bkt.Close()) }()
+
+	m := prepareIndexV2Block(t, tmpDir, bkt)
+
+	expected, err := NewBinaryReader(ctx, log.NewNopLogger(), bkt, tmpDir, m.ULID, 32, NewBinaryReaderMetrics(nil))
+	testutil.Ok(t, err)
+	defer func() { testutil.Ok(t, expected.Close()) }()
+
+	names, err := expected.LabelNames()
+	testutil.Ok(t, err)
+	testutil.Assert(t, len(names) > 1, "expected label names")
+
+	t.Run("concurrent lookups while loading", func(t *testing.T) {
+		br, err := NewBinaryReader(ctx, log.NewNopLogger(), bkt, tmpDir, m.ULID, 32, NewBinaryReaderMetrics(nil), WithProgressiveLoad(true))
+		testutil.Ok(t, err)
+		defer func() { testutil.Ok(t, br.Close()) }()
+
+		// Look label names up in reverse order, so that most of them wait for the load.
+		var g errgroup.Group
+		for i := len(names) - 1; i >= 0; i-- {
+			name := names[i]
+			g.Go(func() error {
+				values, err := br.LabelValues(name)
+				if err != nil {
+					return err
+				}
+				expValues, err := expected.LabelValues(name)
+				if err != nil {
+					return err
+				}
+				if !reflect.DeepEqual(expValues, values) {
+					return errors.Errorf("unexpected values of label %s", name)
+				}
+
+				rngs, err := br.PostingsOffsets(name, values...)
+				if err != nil {
+					return err
+				}
+				expRngs, err := expected.PostingsOffsets(name, values...)
+				if err != nil {
+					return err
+				}
+				if !reflect.DeepEqual(expRngs, rngs) {
+					return errors.Errorf("unexpected postings offsets of label %s", name)
+				}
+				return nil
+			})
+		}
+		g.Go(func() error {
+			// Label names absent from the block are only known to be absent once the load is done.
+			values, err := br.LabelValues("~not-found")
+			if err != nil {
+				return err
+			}
+			if len(values) > 0 {
+				return errors.New("unexpected values of absent label")
+			}
+			return nil
+		})
+		testutil.Ok(t, g.Wait())
+
+		actNames, err := br.LabelNames()
+		testutil.Ok(t, err)
+		testutil.Equals(t, names, actNames)
+		testutil.Assert(t, br.postingsLoaded.Load(), "expected the postings offset table to be loaded")
+		testutil.Equals(t, expected.nameSymbols, br.nameSymbols)
+	})
+
+	t.Run("close while loading", func(t *testing.T) {
+		br, err := NewBinaryReader(ctx, log.NewNopLogger(), bkt, tmpDir, m.ULID, 32, NewBinaryReaderMetrics(nil), WithProgressiveLoad(true))
+		testutil.Ok(t, err)
+		testutil.Ok(t, br.Close())
+
+		// The load has been stopped, lookups must not return partial results.
+		if !br.postingsLoaded.Load() {
+			_, err = br.LabelNames()
+			testutil.NotOk(t, err)
+		}
+	})
+}
+
 func compareIndexToHeader(t *testing.T, indexByteSlice index.ByteSlice, headerReader Reader) {
 	ctx := context.Background()
 
@@ -424,7 +555,7 @@ func BenchmarkBinaryReader(t *testing.B) {
 
 	t.ResetTimer()
 	for i := 0; i < t.N; i++ {
-		br, err := newFileBinaryReader(fn, 32, NewBinaryReaderMetrics(nil))
+		br, err := newFileBinaryReader(fn, 32, NewBinaryReaderMetrics(nil), newBinaryReaderOptions(nil))
 		testutil.Ok(t, err)
 		testutil.Ok(t, br.Close())
 	}
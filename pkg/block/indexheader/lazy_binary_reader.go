@@ -86,6 +86,8 @@ type LazyBinaryReader struct {
 
 	// If true, index header will be downloaded at query time rather than initialization time.
 	lazyDownload bool
+
+	binaryReaderOpts []BinaryReaderOption
 }
 
 // NewLazyBinaryReader makes a new LazyBinaryReader. If the index-header does not exist
@@ -103,6 +105,7 @@ func NewLazyBinaryReader(
 	binaryReaderMetrics *BinaryReaderMetrics,
 	onClosed func(*LazyBinaryReader),
 	lazyDownload bool,
+	binaryReaderOpts ...BinaryReaderOption,
 ) (*LazyBinaryReader, error) {
 	if dir != "" && !lazyDownload {
 		indexHeaderFile := filepath.Join(dir, id.String(), block.IndexHeaderFilename)
@@ -136,6 +139,7 @@ func NewLazyBinaryReader(
 		usedAt:                      atomic.NewInt64(time.Now().UnixNano()),
 		onClosed:                    onClosed,
 		lazyDownload:                lazyDownload,
+		binaryReaderOpts:            binaryReaderOpts,
 	}, nil
 }
 
@@ -150,6 +154,17 @@ func (r *LazyBinaryReader) Close() error {
 	return r.unloadIfIdleSince(0)
 }
 
+// MemoryUsage implements MemoryReporter. It does not load the index-header.
+func (r *LazyBinaryReader) MemoryUsage() (mapped, tables int64) {
+	r.readerMx.RLock()
+	defer r.readerMx.RUnlock()
+
+	if r.reader == nil {
+		return 0, 0
+	}
+	return r.reader.MemoryUsage()
+}
+
 // IndexVersion implements Reader.
 func (r *LazyBinaryReader) IndexVersion() (int, error) {
 	r.readerMx.RLock()
@@ -266,10 +281,13 @@ func (r *LazyBinaryReader) load() (returnErr error) {
 	r.metrics.loadCount.Inc()
 	startTime := time.Now()
 
-	reader, err := NewBinaryReader(r.ctx, r.logger, r.bkt, r.dir, r.id, r.postingOffsetsInMemSampling, r.binaryReaderMetrics)
+	reader, err := NewBinaryReader(r.ctx, r.logger, r.bkt, r.dir, r.id, r.postingOffsetsInMemSampling, r.binaryReaderMetrics, r.binaryReaderOpts...)
 	if err != nil {
 		r.metrics.loadFailedCount.Inc()
 		r.readerErr = err
+		if o := newBinaryReaderOptions(r.binaryReaderOpts); IsCorrupted(err) && o.onCorrupted != nil {
+			o.onCorrupted(r.id)
+		}
 		return errors.Wrapf(err, "lazy load index-header for block %s", r.id)
 	}
 
@@ -75,6 +75,11 @@ func TestNewLazyBinaryReader_ShouldBuildIndexHeaderFromBucket(t *testing.T) {
 			testutil.Equals(t, float64(0), promtestutil.ToFloat64(m.loadCount))
 			testutil.Equals(t, float64(0), promtestutil.ToFloat64(m.unloadCount))
 
+			// Reporting the memory usage does not load the index-header.
+			mapped, tables := r.MemoryUsage()
+			testutil.Equals(t, int64(0), mapped+tables)
+			testutil.Assert(t, r.reader == nil)
+
 			_, err = os.Stat(filepath.Join(r.dir, blockID.String(), block.IndexHeaderFilename))
 			// Index file shouldn't exist.
 			if lazyDownload {
@@ -97,6 +102,10 @@ func TestNewLazyBinaryReader_ShouldBuildIndexHeaderFromBucket(t *testing.T) {
 			testutil.Equals(t, []string{"a"}, labelNames)
 			testutil.Equals(t, float64(1), promtestutil.ToFloat64(m.loadCount))
 			testutil.Equals(t, float64(0), promtestutil.ToFloat64(m.unloadCount))
+
+			mapped, tables = r.MemoryUsage()
+			testutil.Assert(t, mapped > 0, "expected mapped index-header, got %d", mapped)
+			testutil.Assert(t, tables > 0, "expected lookup tables, got %d", tables)
 		})
 	}
 }
@@ -0,0 +1,12 @@
+// Copyright (c) The Thanos Authors.
+// Licensed under the Apache License 2.0.
+
+//go:build !linux
+// +build !linux
+
+package indexheader
+
+// madvise is a no-op on platforms other than Linux.
+func madvise(_ []byte, _ MmapAdvice) error {
+	return nil
+}
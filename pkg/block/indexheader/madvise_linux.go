@@ -0,0 +1,30 @@
+// Copyright (c) The Thanos Authors.
+// Licensed under the Apache License 2.0.
+
+package indexheader
+
+import (
+	"github.com/pkg/errors"
+	"golang.org/x/sys/unix"
+)
+
+func madvise(b []byte, advice MmapAdvice) error {
+	var flag int
+	switch advice {
+	case MmapAdviceNormal, "":
+		// The kernel default, nothing to advise.
+		return nil
+	case MmapAdviceRandom:
+		flag = unix.MADV_RANDOM
+	case MmapAdviceSequential:
+		flag = unix.MADV_SEQUENTIAL
+	case MmapAdviceWillNeed:
+		flag = unix.MADV_WILLNEED
+	default:
+		return errors.Errorf("unknown mmap advice %q", advice)
+	}
+	if len(b) == 0 {
+		return nil
+	}
+	return unix.Madvise(b, flag)
+}
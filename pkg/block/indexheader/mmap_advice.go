@@ -0,0 +1,68 @@
+// Copyright (c) The Thanos Authors.
+// Licensed under the Apache License 2.0.
+
+package indexheader
+
+import "github.com/oklog/ulid"
+
+// MmapAdvice is the access pattern advised to the kernel for the memory maps of index-header files.
+type MmapAdvice string
+
+const (
+	// MmapAdviceNormal gives no advice, leaving the default read-ahead of the kernel.
+	MmapAdviceNormal MmapAdvice = "normal"
+	// MmapAdviceRandom advises random accesses, disabling read-ahead. It reduces page cache thrashing
+	// when index-headers do not fit into the page cache.
+	MmapAdviceRandom MmapAdvice = "random"
+	// MmapAdviceSequential advises sequential accesses, with aggressive read-ahead.
+	MmapAdviceSequential MmapAdvice = "sequential"
+	// MmapAdviceWillNeed advises that the whole index-header will be accessed soon, reading it ahead.
+	MmapAdviceWillNeed MmapAdvice = "willneed"
+)
+
+// MmapAdvices are the supported advices.
+var MmapAdvices = []MmapAdvice{MmapAdviceNormal, MmapAdviceRandom, MmapAdviceSequential, MmapAdviceWillNeed}
+
+// BinaryReaderOption configures the binary readers of index-headers.
+type BinaryReaderOption func(o *binaryReaderOptions)
+
+type binaryReaderOptions struct {
+	mmapAdvice      MmapAdvice
+	progressiveLoad bool
+	onCorrupted     func(id ulid.ULID)
+}
+
+func newBinaryReaderOptions(opts []BinaryReaderOption) binaryReaderOptions {
+	o := binaryReaderOptions{mmapAdvice: MmapAdviceNormal}
+	for _, opt := range opts {
+		opt(&o)
+	}
+	return o
+}
+
+// WithMmapAdvice makes binary readers apply the given advice to the memory maps of index-header files.
+// The advice is ignored on platforms which do not support it.
+func WithMmapAdvice(advice MmapAdvice) BinaryReaderOption {
+	return func(o *binaryReaderOptions) {
+		o.mmapAdvice = advice
+	}
+}
+
+// WithProgressiveLoad makes binary readers load the postings offset table of index-headers in the background,
+// in the sorted order of label names, instead of before the reader is returned. Label names are usable as soon as
+// they are loaded; lookups of label names not loaded yet wait for them. Index-headers of the v1 index format are
+// always loaded fully.
+func WithProgressiveLoad(enabled bool) BinaryReaderOption {
+	return func(o *binaryReaderOptions) {
+		o.progressiveLoad = enabled
+	}
+}
+
+// WithCorruptedHandler makes lazy readers call f with the ID of the block once its index-header turned out to be
+// corrupted when loading it, after it was built again from the bucket once. Readers which are not lazy return the
+// error instead. f is called while the reader is being loaded, so it must not close the reader synchronously.
+func WithCorruptedHandler(f func(id ulid.ULID)) BinaryReaderOption {
+	return func(o *binaryReaderOptions) {
+		o.onCorrupted = f
+	}
+}
@@ -50,6 +50,7 @@ type ReaderPool struct {
 	lazyReaders   map[*LazyBinaryReader]struct{}
 
 	lazyDownloadFunc LazyDownloadIndexHeaderFunc
+	binaryReaderOpts []BinaryReaderOption
 }
 
 // IndexHeaderLazyDownloadStrategy specifies how to download index headers
@@ -87,8 +88,8 @@ func AlwaysLazyDownloadIndexHeader(meta *metadata.Meta) bool {
 	return true
 }
 
-// NewReaderPool makes a new ReaderPool.
-func NewReaderPool(logger log.Logger, lazyReaderEnabled bool, lazyReaderIdleTimeout time.Duration, metrics *ReaderPoolMetrics, lazyDownloadFunc LazyDownloadIndexHeaderFunc) *ReaderPool {
+// NewReaderPool makes a new ReaderPool. The given options are applied to all the binary readers of the pool.
+func NewReaderPool(logger log.Logger, lazyReaderEnabled bool, lazyReaderIdleTimeout time.Duration, metrics *ReaderPoolMetrics, lazyDownloadFunc LazyDownloadIndexHeaderFunc, binaryReaderOpts ...BinaryReaderOption) *ReaderPool {
 	p := &ReaderPool{
 		logger:                logger,
 		metrics:               metrics,
@@ -97,6 +98,7 @@ func NewReaderPool(logger log.Logger, lazyReaderEnabled bool, lazyReaderIdleTime
 		lazyReaders:           make(map[*LazyBinaryReader]struct{}),
 		close:                 make(chan struct{}),
 		lazyDownloadFunc:      lazyDownloadFunc,
+		binaryReaderOpts:      binaryReaderOpts,
 	}
 
 	// Start a goroutine to close idle readers (only if required).
@@ -126,9 +128,9 @@ func (p *ReaderPool) NewBinaryReader(ctx context.Context, logger log.Logger, bkt
 	var err error
 
 	if p.lazyReaderEnabled {
-		reader, err = NewLazyBinaryReader(ctx, logger, bkt, dir, id, postingOffsetsInMemSampling, p.metrics.lazyReader, p.metrics.binaryReader, p.onLazyReaderClosed, p.lazyDownloadFunc(meta))
+		reader, err = NewLazyBinaryReader(ctx, logger, bkt, dir, id, postingOffsetsInMemSampling, p.metrics.lazyReader, p.metrics.binaryReader, p.onLazyReaderClosed, p.lazyDownloadFunc(meta), p.binaryReaderOpts...)
 	} else {
-		reader, err = NewBinaryReader(ctx, logger, bkt, dir, id, postingOffsetsInMemSampling, p.metrics.binaryReader)
+		reader, err = NewBinaryReader(ctx, logger, bkt, dir, id, postingOffsetsInMemSampling, p.metrics.binaryReader, p.binaryReaderOpts...)
 	}
 
 	if err != nil {
@@ -0,0 +1,306 @@
+// Copyright (c) The Thanos Authors.
+// Licensed under the Apache License 2.0.
+
+// Package lifecycle notifies external systems, e.g. data catalogs, of blocks being created, compacted and deleted.
+package lifecycle
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/go-kit/log"
+	"github.com/go-kit/log/level"
+	"github.com/oklog/ulid"
+	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/common/model"
+	"gopkg.in/yaml.v2"
+
+	"github.com/thanos-io/thanos/pkg/block/metadata"
+	"github.com/thanos-io/thanos/pkg/clientconfig"
+)
+
+// EventType is the kind of change of a block described by an Event.
+type EventType string
+
+const (
+	// EventCreated is sent when a block is uploaded, e.g. by a shipper or a downsampling.
+	EventCreated EventType = "create"
+	// EventCompacted is sent when a block resulting from a compaction is uploaded. Its sources are listed in its meta.
+	EventCompacted EventType = "compact"
+	// EventDeleted is sent when a block is deleted from the bucket.
+	EventDeleted EventType = "delete"
+)
+
+// Event is a change of a block, sent as JSON.
+type Event struct {
+	// ID identifies the event. It only depends on the type and the block, so that the same change notified twice,
+	// e.g. when a deletion is retried, has the same ID and receivers can ignore duplicates.
+	ID    string    `json:"id"`
+	Type  EventType `json:"type"`
+	Time  time.Time `json:"time"`
+	Block ulid.ULID `json:"block"`
+	// Component is the component which made the change, e.g. compact or sidecar.
+	Component string `json:"component"`
+	// Meta is the metadata of the block, not set for deletions.
+	Meta *metadata.Meta `json:"meta,omitempty"`
+}
+
+// NewEvent returns the event of the given type for the block with the given ID.
+func NewEvent(typ EventType, id ulid.ULID, meta *metadata.Meta) Event {
+	return Event{ID: fmt.Sprintf("%s-%s", id, typ), Type: typ, Time: time.Now(), Block: id, Meta: meta}
+}
+
+// Notifier notifies external systems of block events. Notify must not block nor fail the operation which made
+// the change. Close stops accepting events and waits, for a bounded time, until the queued ones are sent.
+type Notifier interface {
+	Notify(e Event)
+	Close() error
+}
+
+// NopNotifier does not notify anyone.
+type NopNotifier struct{}
+
+func (NopNotifier) Notify(Event) {}
+
+func (NopNotifier) Close() error { return nil }
+
+// Config configures the webhook receiving block events.
+type Config struct {
+	// URL is the URL events are POSTed to.
+	URL              string                        `yaml:"url"`
+	HTTPClientConfig clientconfig.HTTPClientConfig `yaml:"http_config"`
+	// Timeout is the timeout of a single request.
+	Timeout model.Duration `yaml:"timeout"`
+	// MaxRetries is the number of times a failed request is retried before the event is dropped.
+	MaxRetries int `yaml:"max_retries"`
+	// QueueSize is the number of events waiting to be sent beyond which new events are dropped.
+	QueueSize int `yaml:"queue_size"`
+}
+
+// DefaultConfig returns the default webhook configuration, without URL.
+func DefaultConfig() Config {
+	return Config{
+		HTTPClientConfig: clientconfig.NewDefaultHTTPClientConfig(),
+		Timeout:          model.Duration(10 * time.Second),
+		MaxRetries:       3,
+		QueueSize:        1000,
+	}
+}
+
+// ParseConfig parses the webhook configuration from YAML.
+func ParseConfig(confYaml []byte) (*Config, error) {
+	conf := DefaultConfig()
+	if err := yaml.UnmarshalStrict(confYaml, &conf); err != nil {
+		return nil, errors.Wrap(err, "parse block events config")
+	}
+	if conf.URL == "" {
+		return nil, errors.New("url of the block events webhook is required")
+	}
+	if conf.Timeout <= 0 {
+		return nil, errors.New("timeout of the block events webhook must be positive")
+	}
+	if conf.MaxRetries < 0 {
+		return nil, errors.New("max_retries of the block events webhook must not be negative")
+	}
+	if conf.QueueSize <= 0 {
+		return nil, errors.New("queue_size of the block events webhook must be positive")
+	}
+	return &conf, nil
+}
+
+// Webhook POSTs block events as JSON to a URL. Events are sent asynchronously and in order by a single goroutine,
+// so that notifying never blocks the operation which made the change. Failed requests are retried with an
+// exponential backoff up to a maximum number of times, after which the event is dropped. The goroutine is only
+// started by the first event, so that a Webhook which is never closed, e.g. because the component failed to start,
+// does not leak it.
+type Webhook struct {
+	logger    log.Logger
+	client    *http.Client
+	conf      Config
+	component string
+
+	queue   chan Event
+	start   sync.Once
+	done    chan struct{}
+	closeMu sync.Mutex
+	closed  bool
+	// ctx is canceled once Close gave up waiting for the queued events, aborting the request being sent.
+	ctx    context.Context
+	cancel context.CancelFunc
+	// backoff is the delay before the first retry, doubled on every retry.
+	backoff time.Duration
+	// closeTimeout is how long Close waits for the queued events to be sent.
+	closeTimeout time.Duration
+
+	sent    *prometheus.CounterVec
+	failed  *prometheus.CounterVec
+	dropped prometheus.Counter
+}
+
+// NewNotifier returns a Webhook configured by the given YAML, or a NopNotifier if the configuration is empty.
+func NewNotifier(logger log.Logger, reg prometheus.Registerer, confYaml []byte, component string) (Notifier, error) {
+	if len(bytes.TrimSpace(confYaml)) == 0 {
+		return NopNotifier{}, nil
+	}
+	conf, err := ParseConfig(confYaml)
+	if err != nil {
+		return nil, err
+	}
+	return NewWebhook(logger, reg, *conf, component)
+}
+
+// NewWebhook returns a Webhook sending the events of the given component, and starts sending them.
+func NewWebhook(logger log.Logger, reg prometheus.Registerer, conf Config, component string) (*Webhook, error) {
+	client, err := clientconfig.NewHTTPClient(conf.HTTPClientConfig, "block-events")
+	if err != nil {
+		return nil, errors.Wrap(err, "create block events HTTP client")
+	}
+	client.Timeout = time.Duration(conf.Timeout)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	w := &Webhook{
+		logger:       log.With(logger, "component", "block-events"),
+		client:       client,
+		conf:         conf,
+		component:    component,
+		queue:        make(chan Event, conf.QueueSize),
+		done:         make(chan struct{}),
+		ctx:          ctx,
+		cancel:       cancel,
+		backoff:      time.Second,
+		closeTimeout: time.Duration(conf.Timeout),
+		sent: promauto.With(reg).NewCounterVec(prometheus.CounterOpts{
+			Name: "thanos_block_events_sent_total",
+			Help: "Total number of block events sent to the webhook.",
+		}, []string{"type"}),
+		failed: promauto.With(reg).NewCounterVec(prometheus.CounterOpts{
+			Name: "thanos_block_events_failed_total",
+			Help: "Total number of block events which could not be sent to the webhook after all retries.",
+		}, []string{"type"}),
+		dropped: promauto.With(reg).NewCounter(prometheus.CounterOpts{
+			Name: "thanos_block_events_dropped_total",
+			Help: "Total number of block events dropped because the queue of events to send was full, or because they were still queued when closing.",
+		}),
+	}
+	return w, nil
+}
+
+// Notify queues the event and starts sending the queued events if needed. If the queue is full, the event is
+// dropped.
+func (w *Webhook) Notify(e Event) {
+	e.Component = w.component
+
+	w.closeMu.Lock()
+	defer w.closeMu.Unlock()
+	if w.closed {
+		return
+	}
+	w.start.Do(func() { go w.run() })
+	select {
+	case w.queue <- e:
+	default:
+		w.dropped.Inc()
+		level.Warn(w.logger).Log("msg", "queue of block events full, dropping event", "id", e.ID)
+	}
+}
+
+// Close stops accepting events and waits until the queued ones are sent, for at most the timeout of a request, so
+// that an unavailable webhook does not delay the shutdown by its retries. The events still queued then are dropped.
+func (w *Webhook) Close() error {
+	w.closeMu.Lock()
+	if !w.closed {
+		w.closed = true
+		close(w.queue)
+	}
+	w.closeMu.Unlock()
+
+	// Nothing was sent if no event was ever notified.
+	w.start.Do(func() { close(w.done) })
+
+	timer := time.NewTimer(w.closeTimeout)
+	defer timer.Stop()
+	select {
+	case <-w.done:
+	case <-timer.C:
+		w.cancel()
+		<-w.done
+	}
+	w.cancel()
+	return nil
+}
+
+func (w *Webhook) run() {
+	defer close(w.done)
+
+	var dropped int
+	for e := range w.queue {
+		err := w.sendWithRetries(e)
+		switch {
+		case err == nil:
+			w.sent.WithLabelValues(string(e.Type)).Inc()
+		case w.ctx.Err() != nil:
+			w.dropped.Inc()
+			dropped++
+		default:
+			w.failed.WithLabelValues(string(e.Type)).Inc()
+			level.Warn(w.logger).Log("msg", "failed to send block event, dropping it", "id", e.ID, "retries", w.conf.MaxRetries, "err", err)
+		}
+	}
+	if dropped > 0 {
+		level.Warn(w.logger).Log("msg", "timed out sending the queued block events when closing, dropping them", "dropped", dropped, "timeout", w.closeTimeout)
+	}
+}
+
+// sendWithRetries sends the event, retrying failed requests until the webhook is closed.
+func (w *Webhook) sendWithRetries(e Event) (err error) {
+	for attempt, backoff := 0, w.backoff; attempt <= w.conf.MaxRetries; attempt, backoff = attempt+1, backoff*2 {
+		if attempt > 0 {
+			select {
+			case <-w.ctx.Done():
+			case <-time.After(backoff):
+			}
+		}
+		if w.ctx.Err() != nil {
+			return w.ctx.Err()
+		}
+		if err = w.send(e); err == nil {
+			return nil
+		}
+	}
+	return err
+}
+
+func (w *Webhook) send(e Event) error {
+	body, err := json.Marshal(e)
+	if err != nil {
+		return errors.Wrap(err, "marshal event")
+	}
+	ctx, cancel := context.WithTimeout(w.ctx, time.Duration(w.conf.Timeout))
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, w.conf.URL, bytes.NewReader(body))
+	if err != nil {
+		return errors.Wrap(err, "create request")
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := w.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	_, _ = io.Copy(io.Discard, resp.Body)
+
+	if resp.StatusCode/100 != 2 {
+		return errors.Errorf("unexpected status %s", resp.Status)
+	}
+	return nil
+}
@@ -0,0 +1,183 @@
+// Copyright (c) The Thanos Authors.
+// Licensed under the Apache License 2.0.
+
+package lifecycle
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/efficientgo/core/testutil"
+	"github.com/go-kit/log"
+	"github.com/oklog/ulid"
+	"github.com/prometheus/client_golang/prometheus"
+	promtest "github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/prometheus/common/model"
+
+	"github.com/thanos-io/thanos/pkg/block/metadata"
+	"github.com/thanos-io/thanos/pkg/testutil/custom"
+)
+
+func TestParseConfig(t *testing.T) {
+	conf, err := ParseConfig([]byte(`url: http://catalog/events`))
+	testutil.Ok(t, err)
+	testutil.Equals(t, "http://catalog/events", conf.URL)
+	testutil.Equals(t, model.Duration(10*time.Second), conf.Timeout)
+	testutil.Equals(t, 3, conf.MaxRetries)
+	testutil.Equals(t, 1000, conf.QueueSize)
+
+	for _, invalid := range []string{
+		`timeout: 5s`,
+		`{url: http://catalog/events, queue_size: 0}`,
+		`{url: http://catalog/events, max_retries: -1}`,
+		`{url: http://catalog/events, unknown: true}`,
+	} {
+		_, err := ParseConfig([]byte(invalid))
+		testutil.NotOk(t, err, invalid)
+	}
+
+	n, err := NewNotifier(log.NewNopLogger(), nil, []byte("  \n"), "compact")
+	testutil.Ok(t, err)
+	testutil.Equals(t, NopNotifier{}, n)
+}
+
+type receiver struct {
+	mtx      sync.Mutex
+	events   []Event
+	failures int
+}
+
+func (r *receiver) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+
+	if r.failures > 0 {
+		r.failures--
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	var e Event
+	if err := json.NewDecoder(req.Body).Decode(&e); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	r.events = append(r.events, e)
+}
+
+func newTestWebhook(t *testing.T, url string, maxRetries, queueSize int) *Webhook {
+	conf := DefaultConfig()
+	conf.URL = url
+	conf.MaxRetries = maxRetries
+	conf.QueueSize = queueSize
+
+	w, err := NewWebhook(log.NewNopLogger(), prometheus.NewRegistry(), conf, "compact")
+	testutil.Ok(t, err)
+	w.backoff = time.Millisecond
+	return w
+}
+
+func TestWebhook(t *testing.T) {
+	r := &receiver{failures: 2}
+	srv := httptest.NewServer(r)
+	defer srv.Close()
+
+	w := newTestWebhook(t, srv.URL, 2, 10)
+
+	created := ulid.MustNew(1, nil)
+	compacted := ulid.MustNew(2, nil)
+	meta := &metadata.Meta{Thanos: metadata.Thanos{Labels: map[string]string{"cluster": "eu"}}}
+	meta.ULID = compacted
+	meta.Compaction.Sources = []ulid.ULID{created}
+
+	w.Notify(NewEvent(EventCreated, created, nil))
+	w.Notify(NewEvent(EventCompacted, compacted, meta))
+	w.Notify(NewEvent(EventDeleted, created, nil))
+	testutil.Ok(t, w.Close())
+
+	// Events are not accepted anymore once closed.
+	w.Notify(NewEvent(EventDeleted, compacted, nil))
+
+	// The first event was sent after two failed attempts, and the order was kept.
+	testutil.Equals(t, 3, len(r.events))
+	testutil.Equals(t, created.String()+"-create", r.events[0].ID)
+	testutil.Equals(t, EventCompacted, r.events[1].Type)
+	testutil.Equals(t, compacted, r.events[1].Block)
+	testutil.Equals(t, "compact", r.events[1].Component)
+	testutil.Equals(t, []ulid.ULID{created}, r.events[1].Meta.Compaction.Sources)
+	testutil.Equals(t, "eu", r.events[1].Meta.Thanos.Labels["cluster"])
+	testutil.Equals(t, created.String()+"-delete", r.events[2].ID)
+	testutil.Assert(t, r.events[2].Meta == nil)
+	testutil.Equals(t, 1.0, promtest.ToFloat64(w.sent.WithLabelValues(string(EventCreated))))
+
+	// The same change notified twice has the same ID.
+	testutil.Equals(t, NewEvent(EventDeleted, created, nil).ID, r.events[2].ID)
+}
+
+func TestWebhook_FailuresAndFullQueue(t *testing.T) {
+	block := make(chan struct{})
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		<-block
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer srv.Close()
+
+	w := newTestWebhook(t, srv.URL, 1, 1)
+
+	// The first event is being sent and the second one fills the queue, so that the third one is dropped
+	// instead of blocking.
+	for i := 0; i < 3; i++ {
+		w.Notify(NewEvent(EventCreated, ulid.MustNew(uint64(i), nil), nil))
+		if i == 0 {
+			// Wait until the first event is taken from the queue.
+			for len(w.queue) > 0 {
+				time.Sleep(time.Millisecond)
+			}
+		}
+	}
+	testutil.Equals(t, 1.0, promtest.ToFloat64(w.dropped))
+
+	close(block)
+	testutil.Ok(t, w.Close())
+	testutil.Equals(t, 2.0, promtest.ToFloat64(w.failed.WithLabelValues(string(EventCreated))))
+	testutil.Equals(t, 0.0, promtest.ToFloat64(w.sent.WithLabelValues(string(EventCreated))))
+}
+
+func TestWebhook_CloseTimeout(t *testing.T) {
+	block := make(chan struct{})
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-block:
+		case <-r.Context().Done():
+		}
+	}))
+	defer srv.Close()
+	defer close(block)
+
+	w := newTestWebhook(t, srv.URL, 3, 10)
+	w.closeTimeout = 50 * time.Millisecond
+	for i := 0; i < 3; i++ {
+		w.Notify(NewEvent(EventCreated, ulid.MustNew(uint64(i), nil), nil))
+	}
+
+	// Close does not wait for the unavailable webhook beyond its timeout, and drops the queued events, including
+	// the one being sent.
+	start := time.Now()
+	testutil.Ok(t, w.Close())
+	testutil.Assert(t, time.Since(start) < 5*time.Second, "close took %v", time.Since(start))
+	testutil.Equals(t, 3.0, promtest.ToFloat64(w.dropped))
+	testutil.Equals(t, 0.0, promtest.ToFloat64(w.failed.WithLabelValues(string(EventCreated))))
+}
+
+func TestWebhook_NotStartedUntilNotified(t *testing.T) {
+	defer custom.TolerantVerifyLeak(t)
+
+	// A webhook which is never closed, e.g. because the component failed to start, does not leak its goroutine.
+	_ = newTestWebhook(t, "http://catalog/events", 3, 10)
+
+	// Closing a webhook without events returns straight away.
+	testutil.Ok(t, newTestWebhook(t, "http://catalog/events", 3, 10).Close())
+}
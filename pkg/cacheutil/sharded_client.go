@@ -0,0 +1,201 @@
+// Copyright (c) The Thanos Authors.
+// Licensed under the Apache License 2.0.
+
+package cacheutil
+
+import (
+	"context"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/cespare/xxhash/v2"
+	"github.com/go-kit/log"
+	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"gopkg.in/yaml.v2"
+)
+
+// MemcachedPoolConfig is the config of a memcached pool keys are sharded across.
+type MemcachedPoolConfig struct {
+	// Name identifies the pool. Keys are assigned to pools by name, so renaming a pool moves its keys.
+	Name                  string `yaml:"name"`
+	MemcachedClientConfig `yaml:",inline"`
+}
+
+// UnmarshalYAML implements yaml.Unmarshaler, setting the default memcached client config.
+func (c *MemcachedPoolConfig) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	c.MemcachedClientConfig = defaultMemcachedClientConfig
+	type plain MemcachedPoolConfig
+	return unmarshal((*plain)(c))
+}
+
+// ShardedMemcachedClientConfig is the config of memcached pools keys are sharded across.
+type ShardedMemcachedClientConfig struct {
+	Pools []MemcachedPoolConfig `yaml:"pools"`
+}
+
+// IsShardedMemcachedClientConfig returns whether the given memcached client config lists pools to shard keys
+// across, instead of the addresses of a single pool.
+func IsShardedMemcachedClientConfig(conf []byte) bool {
+	var c struct {
+		Pools []interface{} `yaml:"pools"`
+	}
+	return yaml.Unmarshal(conf, &c) == nil && len(c.Pools) > 0
+}
+
+// NewShardedMemcachedClient makes a new RemoteCacheClient sharding keys across the memcached pools of the given
+// config, see ShardedClient.
+func NewShardedMemcachedClient(logger log.Logger, name string, conf []byte, reg prometheus.Registerer) (*ShardedClient, error) {
+	var config ShardedMemcachedClientConfig
+	if err := yaml.UnmarshalStrict(conf, &config); err != nil {
+		return nil, errors.Wrap(err, "parse memcached pools config")
+	}
+
+	if len(config.Pools) == 0 {
+		return nil, errors.New("no memcached pool configured")
+	}
+	names := make(map[string]struct{}, len(config.Pools))
+	for _, p := range config.Pools {
+		if p.Name == "" {
+			return nil, errors.New("memcached pool without name")
+		}
+		if _, ok := names[p.Name]; ok {
+			return nil, errors.Errorf("duplicate memcached pool %s", p.Name)
+		}
+		names[p.Name] = struct{}{}
+	}
+
+	pools := make(map[string]RemoteCacheClient, len(config.Pools))
+	for _, p := range config.Pools {
+		var poolReg prometheus.Registerer
+		if reg != nil {
+			poolReg = prometheus.WrapRegistererWith(prometheus.Labels{"pool": p.Name}, reg)
+		}
+		client, err := NewMemcachedClientWithConfig(logger, name, p.MemcachedClientConfig, poolReg)
+		if err != nil {
+			for _, c := range pools {
+				c.Stop()
+			}
+			return nil, errors.Wrapf(err, "create client of memcached pool %s", p.Name)
+		}
+		pools[p.Name] = client
+	}
+	return NewShardedClient(name, pools, reg), nil
+}
+
+// ShardedClient is a RemoteCacheClient sharding keys across several named pools, e.g. memcached clusters, so that
+// the load is spread and a pool failing loses only its share of the keys. Keys are assigned to pools with
+// rendezvous hashing, so that adding or removing a pool only moves the keys assigned to it.
+type ShardedClient struct {
+	pools []shardedPool
+
+	requestedKeys *prometheus.CounterVec
+	hitKeys       *prometheus.CounterVec
+}
+
+type shardedPool struct {
+	name   string
+	seed   uint64
+	client RemoteCacheClient
+}
+
+// NewShardedClient returns a ShardedClient sharding keys across the given clients by pool name. There must be at
+// least one pool.
+func NewShardedClient(name string, pools map[string]RemoteCacheClient, reg prometheus.Registerer) *ShardedClient {
+	if reg != nil {
+		reg = prometheus.WrapRegistererWith(prometheus.Labels{"name": name}, reg)
+	}
+	c := &ShardedClient{
+		requestedKeys: promauto.With(reg).NewCounterVec(prometheus.CounterOpts{
+			Name: "thanos_cache_pool_requested_keys_total",
+			Help: "Total number of keys requested from each pool of a sharded cache.",
+		}, []string{"pool"}),
+		hitKeys: promauto.With(reg).NewCounterVec(prometheus.CounterOpts{
+			Name: "thanos_cache_pool_hit_keys_total",
+			Help: "Total number of keys requested from each pool of a sharded cache which were found.",
+		}, []string{"pool"}),
+	}
+	for poolName, client := range pools {
+		c.pools = append(c.pools, shardedPool{name: poolName, seed: xxhash.Sum64String(poolName), client: client})
+		c.requestedKeys.WithLabelValues(poolName)
+		c.hitKeys.WithLabelValues(poolName)
+	}
+	// Sort pools, so that keys are assigned the same way by all instances even in case of hash ties.
+	sort.Slice(c.pools, func(i, j int) bool { return c.pools[i].name < c.pools[j].name })
+	return c
+}
+
+// pool returns the index of the pool the key is assigned to, the one with the highest hash of the key and its name.
+func (c *ShardedClient) pool(key string) int {
+	keyHash := xxhash.Sum64String(key)
+	best, bestScore := 0, uint64(0)
+	for i, p := range c.pools {
+		if score := mix(keyHash ^ p.seed); score >= bestScore {
+			best, bestScore = i, score
+		}
+	}
+	return best
+}
+
+// mix is the finalizer of MurmurHash3, spreading the bits of combined hashes.
+func mix(h uint64) uint64 {
+	h ^= h >> 33
+	h *= 0xff51afd7ed558ccd
+	h ^= h >> 33
+	h *= 0xc4ceb9fe1a85ec53
+	h ^= h >> 33
+	return h
+}
+
+// GetMulti fetches the keys from their pools concurrently.
+func (c *ShardedClient) GetMulti(ctx context.Context, keys []string) map[string][]byte {
+	if len(keys) == 0 {
+		return nil
+	}
+	keysByPool := make([][]string, len(c.pools))
+	for _, key := range keys {
+		i := c.pool(key)
+		keysByPool[i] = append(keysByPool[i], key)
+	}
+
+	var (
+		wg   sync.WaitGroup
+		mtx  sync.Mutex
+		hits = make(map[string][]byte, len(keys))
+	)
+	for i, poolKeys := range keysByPool {
+		if len(poolKeys) == 0 {
+			continue
+		}
+		wg.Add(1)
+		go func(p shardedPool, poolKeys []string) {
+			defer wg.Done()
+
+			poolHits := p.client.GetMulti(ctx, poolKeys)
+			c.requestedKeys.WithLabelValues(p.name).Add(float64(len(poolKeys)))
+			c.hitKeys.WithLabelValues(p.name).Add(float64(len(poolHits)))
+
+			mtx.Lock()
+			defer mtx.Unlock()
+			for k, v := range poolHits {
+				hits[k] = v
+			}
+		}(c.pools[i], poolKeys)
+	}
+	wg.Wait()
+	return hits
+}
+
+// SetAsync stores the key into its pool.
+func (c *ShardedClient) SetAsync(key string, value []byte, ttl time.Duration) error {
+	return c.pools[c.pool(key)].client.SetAsync(key, value, ttl)
+}
+
+// Stop stops the clients of all pools.
+func (c *ShardedClient) Stop() {
+	for _, p := range c.pools {
+		p.client.Stop()
+	}
+}
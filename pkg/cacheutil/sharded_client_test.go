@@ -0,0 +1,134 @@
+// Copyright (c) The Thanos Authors.
+// Licensed under the Apache License 2.0.
+
+package cacheutil
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/efficientgo/core/testutil"
+	"github.com/go-kit/log"
+	"github.com/prometheus/client_golang/prometheus"
+	prom_testutil "github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+type mapCacheClient struct {
+	mtx   sync.Mutex
+	items map[string][]byte
+}
+
+func newMapCacheClient() *mapCacheClient {
+	return &mapCacheClient{items: map[string][]byte{}}
+}
+
+func (c *mapCacheClient) GetMulti(_ context.Context, keys []string) map[string][]byte {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+
+	hits := map[string][]byte{}
+	for _, k := range keys {
+		if v, ok := c.items[k]; ok {
+			hits[k] = v
+		}
+	}
+	return hits
+}
+
+func (c *mapCacheClient) SetAsync(key string, value []byte, _ time.Duration) error {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+
+	c.items[key] = value
+	return nil
+}
+
+func (c *mapCacheClient) Stop() {}
+
+func TestShardedClient(t *testing.T) {
+	pools := map[string]*mapCacheClient{"a": newMapCacheClient(), "b": newMapCacheClient(), "c": newMapCacheClient()}
+	clients := map[string]RemoteCacheClient{}
+	for name, p := range pools {
+		clients[name] = p
+	}
+	c := NewShardedClient("test", clients, prometheus.NewRegistry())
+
+	var keys []string
+	for i := 0; i < 3000; i++ {
+		key := fmt.Sprintf("key-%d", i)
+		keys = append(keys, key)
+		testutil.Ok(t, c.SetAsync(key, []byte(key), time.Hour))
+	}
+	// Keys are spread across pools.
+	for name, p := range pools {
+		testutil.Assert(t, len(p.items) > 800 && len(p.items) < 1200, "pool %s has %d keys", name, len(p.items))
+	}
+
+	hits := c.GetMulti(context.Background(), append(keys[:100:100], "missing"))
+	testutil.Equals(t, 100, len(hits))
+	testutil.Equals(t, []byte("key-42"), hits["key-42"])
+	requested, hit := 0.0, 0.0
+	for name := range pools {
+		requested += prom_testutil.ToFloat64(c.requestedKeys.WithLabelValues(name))
+		hit += prom_testutil.ToFloat64(c.hitKeys.WithLabelValues(name))
+	}
+	testutil.Equals(t, 101.0, requested)
+	testutil.Equals(t, 100.0, hit)
+
+	// Removing a pool only moves its keys, and adding it back moves them back.
+	delete(clients, "b")
+	withoutB := NewShardedClient("test", clients, nil)
+	clients["b"] = pools["b"]
+	clients["d"] = newMapCacheClient()
+	withD := NewShardedClient("test", clients, nil)
+
+	movedToD := 0
+	for _, key := range keys {
+		pool := c.pools[c.pool(key)].name
+		if pool != "b" {
+			testutil.Equals(t, pool, withoutB.pools[withoutB.pool(key)].name)
+		}
+		if newPool := withD.pools[withD.pool(key)].name; newPool != pool {
+			testutil.Equals(t, "d", newPool)
+			movedToD++
+		}
+	}
+	testutil.Assert(t, movedToD > 600 && movedToD < 900, "%d keys moved to the new pool", movedToD)
+}
+
+func TestNewShardedMemcachedClient(t *testing.T) {
+	testutil.Assert(t, !IsShardedMemcachedClientConfig([]byte(`addresses: [127.0.0.1:11211]`)))
+
+	conf := []byte(`
+pools:
+  - name: a
+    addresses: [127.0.0.1:11211]
+  - name: b
+    addresses: [127.0.0.2:11211]
+    timeout: 1s
+`)
+	testutil.Assert(t, IsShardedMemcachedClientConfig(conf))
+	c, err := NewShardedMemcachedClient(log.NewNopLogger(), "test", conf, prometheus.NewRegistry())
+	testutil.Ok(t, err)
+	defer c.Stop()
+
+	testutil.Equals(t, 2, len(c.pools))
+	a, b := c.pools[0].client.(*memcachedClient), c.pools[1].client.(*memcachedClient)
+	testutil.Equals(t, []string{"127.0.0.1:11211"}, a.config.Addresses)
+	testutil.Equals(t, defaultMemcachedClientConfig.Timeout, a.config.Timeout)
+	testutil.Equals(t, defaultMemcachedClientConfig.MaxAsyncConcurrency, a.config.MaxAsyncConcurrency)
+	testutil.Equals(t, 1*time.Second, b.config.Timeout)
+
+	for _, invalid := range []string{
+		`pools: [{addresses: [127.0.0.1:11211]}]`,
+		`pools: [{name: a, addresses: [127.0.0.1:11211]}, {name: a, addresses: [127.0.0.2:11211]}]`,
+		`pools: [{name: a}]`,
+		`pools: [{name: a, addresses: [127.0.0.1:11211], unknown: true}]`,
+	} {
+		_, err := NewShardedMemcachedClient(log.NewNopLogger(), "test", []byte(invalid), nil)
+		testutil.NotOk(t, err, invalid)
+	}
+}
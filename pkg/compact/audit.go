@@ -0,0 +1,112 @@
+// Copyright (c) The Thanos Authors.
+// Licensed under the Apache License 2.0.
+
+package compact
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/json"
+	"fmt"
+	"io"
+	"path"
+	"sync"
+	"time"
+
+	"github.com/go-kit/log"
+	"github.com/go-kit/log/level"
+	"github.com/oklog/ulid"
+	"github.com/pkg/errors"
+	"github.com/thanos-io/objstore"
+)
+
+// AuditDir is the directory in the bucket holding audit records.
+const AuditDir = "audit"
+
+// AuditAction is the kind of change of blocks described by an AuditRecord.
+type AuditAction string
+
+const (
+	// AuditActionCompaction records source blocks compacted into result blocks. The sources are marked for deletion afterwards.
+	AuditActionCompaction AuditAction = "compaction"
+	// AuditActionRetention records blocks marked for deletion because they exceeded the retention.
+	AuditActionRetention AuditAction = "retention"
+	// AuditActionDeletion records blocks deleted from the bucket after their deletion delay, and aborted partial uploads.
+	AuditActionDeletion AuditAction = "deletion"
+)
+
+// AuditRecord is a structured record of a change of blocks made by the compactor.
+type AuditRecord struct {
+	// ID identifies the record. IDs are ordered by the time the records were written.
+	ID     ulid.ULID   `json:"id"`
+	Time   time.Time   `json:"time"`
+	Action AuditAction `json:"action"`
+	// Instance is the compactor which made the change.
+	Instance string `json:"instance,omitempty"`
+	// Reason describes what triggered the change.
+	Reason string `json:"reason"`
+	// Group is the key of the compaction group, for compactions.
+	Group string `json:"group,omitempty"`
+	// Sources are the blocks the change was applied to.
+	Sources []ulid.ULID `json:"sources"`
+	// Results are the blocks produced by the change, for compactions.
+	Results []ulid.ULID `json:"results,omitempty"`
+}
+
+// AuditLog writes audit records of compactions and deletions to the log and, optionally, to the bucket,
+// so that the lineage of blocks can be reconstructed after their sources were deleted.
+type AuditLog struct {
+	logger   log.Logger
+	bkt      objstore.Bucket
+	instance string
+
+	mtx     sync.Mutex
+	entropy io.Reader
+	now     func() time.Time
+}
+
+// NewAuditLog returns an AuditLog writing records of the given compactor instance. If bkt is not nil,
+// each record is also uploaded to the bucket as AuditDir/<record ID>.json.
+func NewAuditLog(logger log.Logger, bkt objstore.Bucket, instance string) *AuditLog {
+	return &AuditLog{
+		logger:   log.With(logger, "component", "audit"),
+		bkt:      bkt,
+		instance: instance,
+		entropy:  ulid.Monotonic(rand.Reader, 0),
+		now:      time.Now,
+	}
+}
+
+// Record writes the record. A nil AuditLog records nothing. Records are logged before they are uploaded,
+// so a failed upload still leaves a trace in the log.
+func (a *AuditLog) Record(ctx context.Context, r AuditRecord) error {
+	if a == nil {
+		return nil
+	}
+
+	a.mtx.Lock()
+	r.Time = a.now()
+	id, err := ulid.New(ulid.Timestamp(r.Time), a.entropy)
+	a.mtx.Unlock()
+	if err != nil {
+		return errors.Wrap(err, "generate audit record ID")
+	}
+	r.ID = id
+	r.Instance = a.instance
+
+	level.Info(a.logger).Log("msg", "audit record", "id", r.ID, "action", r.Action, "instance", r.Instance,
+		"reason", r.Reason, "group", r.Group, "sources", fmt.Sprintf("%v", r.Sources), "results", fmt.Sprintf("%v", r.Results))
+
+	if a.bkt == nil {
+		return nil
+	}
+	b, err := json.Marshal(r)
+	if err != nil {
+		return errors.Wrap(err, "marshal audit record")
+	}
+	if err := a.bkt.Upload(ctx, path.Join(AuditDir, r.ID.String()+".json"), bytes.NewReader(b)); err != nil {
+		return errors.Wrapf(err, "upload audit record %s", r.ID)
+	}
+	return nil
+}
@@ -0,0 +1,89 @@
+// Copyright (c) The Thanos Authors.
+// Licensed under the Apache License 2.0.
+
+package compact_test
+
+import (
+	"context"
+	"encoding/json"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/go-kit/log"
+	"github.com/oklog/ulid"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/thanos-io/objstore"
+
+	"github.com/efficientgo/core/testutil"
+
+	"github.com/thanos-io/thanos/pkg/block"
+	"github.com/thanos-io/thanos/pkg/compact"
+)
+
+func TestAuditLog_RetentionAndDeletion(t *testing.T) {
+	ctx := context.Background()
+	logger := log.NewNopLogger()
+	bkt := objstore.WithNoopInstr(objstore.NewInMemBucket())
+	auditLog := compact.NewAuditLog(logger, bkt, "compactor-0")
+
+	const expired, recent = "01CPHBEX20729MJQZXE3W0BW48", "01CPHBEX20729MJQZXE3W0BW49"
+	uploadMockBlock(t, bkt, expired, time.Now().Add(-3*24*time.Hour), time.Now().Add(-2*24*time.Hour), int64(compact.ResolutionLevelRaw))
+	uploadMockBlock(t, bkt, recent, time.Now().Add(-time.Hour), time.Now(), int64(compact.ResolutionLevelRaw))
+
+	ignoreDeletionMarkFilter := block.NewIgnoreDeletionMarkFilter(logger, bkt, 0, 1)
+	metaFetcher, err := block.NewMetaFetcher(logger, 32, bkt, block.NewConcurrentLister(logger, bkt), "", nil, []block.MetadataFilter{ignoreDeletionMarkFilter})
+	testutil.Ok(t, err)
+
+	metas, _, err := metaFetcher.Fetch(ctx)
+	testutil.Ok(t, err)
+	counter := promauto.With(nil).NewCounter(prometheus.CounterOpts{})
+	testutil.Ok(t, compact.ApplyRetentionPolicyByResolution(ctx, logger, bkt, metas, map[compact.ResolutionLevel]time.Duration{compact.ResolutionLevelRaw: 24 * time.Hour}, counter, auditLog))
+
+	// Gather the deletion marks.
+	_, _, err = metaFetcher.Fetch(ctx)
+	testutil.Ok(t, err)
+	cleaner := compact.NewBlocksCleaner(logger, bkt, ignoreDeletionMarkFilter, 0, counter, counter)
+	cleaner.SetAuditLog(auditLog)
+	testutil.Ok(t, cleaner.DeleteMarkedBlocks(ctx))
+
+	var records []compact.AuditRecord
+	testutil.Ok(t, bkt.Iter(ctx, compact.AuditDir, func(name string) error {
+		r, err := bkt.Get(ctx, name)
+		if err != nil {
+			return err
+		}
+		defer r.Close()
+
+		var rec compact.AuditRecord
+		if err := json.NewDecoder(r).Decode(&rec); err != nil {
+			return err
+		}
+		testutil.Equals(t, compact.AuditDir+"/"+rec.ID.String()+".json", name)
+		records = append(records, rec)
+		return nil
+	}))
+
+	testutil.Equals(t, 2, len(records))
+	testutil.Equals(t, compact.AuditActionRetention, records[0].Action)
+	testutil.Equals(t, compact.AuditActionDeletion, records[1].Action)
+	for _, rec := range records {
+		testutil.Equals(t, "compactor-0", rec.Instance)
+		testutil.Equals(t, []ulid.ULID{ulid.MustParse(expired)}, rec.Sources)
+	}
+	testutil.Equals(t, "block exceeding retention of 24h0m0s", records[0].Reason)
+	testutil.Assert(t, strings.HasSuffix(records[1].Reason, ": block exceeding retention of 24h0m0s"), records[1].Reason)
+
+	// Audit records are not taken for blocks.
+	metas, _, err = metaFetcher.Fetch(ctx)
+	testutil.Ok(t, err)
+	testutil.Equals(t, 1, len(metas))
+	_, ok := metas[ulid.MustParse(recent)]
+	testutil.Assert(t, ok)
+}
+
+func TestAuditLog_Nil(t *testing.T) {
+	var auditLog *compact.AuditLog
+	testutil.Ok(t, auditLog.Record(context.Background(), compact.AuditRecord{Action: compact.AuditActionDeletion}))
+}
@@ -5,15 +5,18 @@ package compact
 
 import (
 	"context"
+	"fmt"
 	"time"
 
 	"github.com/go-kit/log"
 	"github.com/go-kit/log/level"
+	"github.com/oklog/ulid"
 	"github.com/pkg/errors"
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/thanos-io/objstore"
 
 	"github.com/thanos-io/thanos/pkg/block"
+	"github.com/thanos-io/thanos/pkg/block/lifecycle"
 )
 
 // BlocksCleaner is a struct that deletes blocks from bucket which are marked for deletion.
@@ -24,6 +27,8 @@ type BlocksCleaner struct {
 	deleteDelay              time.Duration
 	blocksCleaned            prometheus.Counter
 	blockCleanupFailures     prometheus.Counter
+	auditLog                 *AuditLog
+	blockEvents              lifecycle.Notifier
 }
 
 // NewBlocksCleaner creates a new BlocksCleaner.
@@ -35,9 +40,21 @@ func NewBlocksCleaner(logger log.Logger, bkt objstore.Bucket, ignoreDeletionMark
 		deleteDelay:              deleteDelay,
 		blocksCleaned:            blocksCleaned,
 		blockCleanupFailures:     blockCleanupFailures,
+		blockEvents:              lifecycle.NopNotifier{},
 	}
 }
 
+// SetAuditLog makes the cleaner write an audit record for each block before deleting it. If the deletion
+// fails, it is retried by the next cleanup with another record.
+func (s *BlocksCleaner) SetAuditLog(auditLog *AuditLog) {
+	s.auditLog = auditLog
+}
+
+// SetBlockEvents makes the cleaner notify the given notifier of the blocks it deletes.
+func (s *BlocksCleaner) SetBlockEvents(n lifecycle.Notifier) {
+	s.blockEvents = n
+}
+
 // DeleteMarkedBlocks uses ignoreDeletionMarkFilter to gather the blocks that are marked for deletion and deletes those
 // if older than given deleteDelay.
 func (s *BlocksCleaner) DeleteMarkedBlocks(ctx context.Context) error {
@@ -46,11 +63,17 @@ func (s *BlocksCleaner) DeleteMarkedBlocks(ctx context.Context) error {
 	deletionMarkMap := s.ignoreDeletionMarkFilter.DeletionMarkBlocks()
 	for _, deletionMark := range deletionMarkMap {
 		if time.Since(time.Unix(deletionMark.DeletionTime, 0)).Seconds() > s.deleteDelay.Seconds() {
+			// The record is written before deleting the block, so that no block is deleted without a record.
+			reason := fmt.Sprintf("marked for deletion at %s: %s", time.Unix(deletionMark.DeletionTime, 0).UTC().Format(time.RFC3339), deletionMark.Details)
+			if err := s.auditLog.Record(ctx, AuditRecord{Action: AuditActionDeletion, Reason: reason, Sources: []ulid.ULID{deletionMark.ID}}); err != nil {
+				return errors.Wrap(err, "write deletion audit record")
+			}
 			if err := block.Delete(ctx, s.logger, s.bkt, deletionMark.ID); err != nil {
 				s.blockCleanupFailures.Inc()
 				return errors.Wrap(err, "delete block")
 			}
 			s.blocksCleaned.Inc()
+			s.blockEvents.Notify(lifecycle.NewEvent(lifecycle.EventDeleted, deletionMark.ID, nil))
 			level.Info(s.logger).Log("msg", "deleted block marked for deletion", "block", deletionMark.ID)
 		}
 	}
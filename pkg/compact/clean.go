@@ -5,6 +5,7 @@ package compact
 
 import (
 	"context"
+	"fmt"
 	"time"
 
 	"github.com/go-kit/log"
@@ -22,6 +23,8 @@ const (
 	PartialUploadThresholdAge = 2 * 24 * time.Hour
 )
 
+// BestEffortCleanAbortedPartialUploads deletes partial blocks older than PartialUploadThresholdAge. If auditLog is not nil,
+// an audit record is written for each block before it is deleted.
 func BestEffortCleanAbortedPartialUploads(
 	ctx context.Context,
 	logger log.Logger,
@@ -30,6 +33,7 @@ func BestEffortCleanAbortedPartialUploads(
 	deleteAttempts prometheus.Counter,
 	blockCleanups prometheus.Counter,
 	blockCleanupFailures prometheus.Counter,
+	auditLog *AuditLog,
 ) {
 	level.Info(logger).Log("msg", "started cleaning of aborted partial uploads")
 
@@ -50,6 +54,12 @@ func BestEffortCleanAbortedPartialUploads(
 		// We don't gather any information about deletion marks for partial blocks, so let's simply remove it. We waited
 		// long PartialUploadThresholdAge already.
 		// TODO(bwplotka): Fix some edge cases: https://github.com/thanos-io/thanos/issues/2470 .
+		reason := fmt.Sprintf("aborted partial upload older than %v", PartialUploadThresholdAge)
+		if err := auditLog.Record(ctx, AuditRecord{Action: AuditActionDeletion, Reason: reason, Sources: []ulid.ULID{id}}); err != nil {
+			blockCleanupFailures.Inc()
+			level.Warn(logger).Log("msg", "failed to write audit record of aborted partial upload; will retry in next iteration", "block", id, "err", err)
+			continue
+		}
 		if err := block.Delete(ctx, logger, bkt, id); err != nil {
 			blockCleanupFailures.Inc()
 			level.Warn(logger).Log("msg", "failed to delete aborted partial upload; will retry in next iteration", "block", id, "thresholdAge", PartialUploadThresholdAge, "err", err)
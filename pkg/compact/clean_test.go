@@ -67,11 +67,21 @@ func TestBestEffortCleanAbortedPartialUploads(t *testing.T) {
 	_, partial, err := metaFetcher.Fetch(ctx)
 	testutil.Ok(t, err)
 
-	BestEffortCleanAbortedPartialUploads(ctx, logger, partial, bkt, deleteAttempts, blockCleanups, blockCleanupFailures)
+	auditBkt := objstore.NewInMemBucket()
+	BestEffortCleanAbortedPartialUploads(ctx, logger, partial, bkt, deleteAttempts, blockCleanups, blockCleanupFailures, NewAuditLog(logger, auditBkt, "compactor-0"))
 	testutil.Equals(t, 1.0, promtest.ToFloat64(deleteAttempts))
 	testutil.Equals(t, 1.0, promtest.ToFloat64(blockCleanups))
 	testutil.Equals(t, 0.0, promtest.ToFloat64(blockCleanupFailures))
 
+	testutil.Equals(t, 1, len(auditBkt.Objects()))
+	for _, b := range auditBkt.Objects() {
+		var rec AuditRecord
+		testutil.Ok(t, json.Unmarshal(b, &rec))
+		testutil.Equals(t, AuditActionDeletion, rec.Action)
+		testutil.Equals(t, []ulid.ULID{shouldDeleteID}, rec.Sources)
+		testutil.Equals(t, "aborted partial upload older than 48h0m0s", rec.Reason)
+	}
+
 	exists, err := bkt.Exists(ctx, path.Join(shouldDeleteID.String(), "chunks", "000001"))
 	testutil.Ok(t, err)
 	testutil.Equals(t, false, exists)
@@ -28,6 +28,7 @@ import (
 	"golang.org/x/sync/errgroup"
 
 	"github.com/thanos-io/thanos/pkg/block"
+	"github.com/thanos-io/thanos/pkg/block/lifecycle"
 	"github.com/thanos-io/thanos/pkg/block/metadata"
 	"github.com/thanos-io/thanos/pkg/compact/downsample"
 	"github.com/thanos-io/thanos/pkg/errutil"
@@ -252,6 +253,39 @@ type DefaultGrouper struct {
 	hashFunc                      metadata.HashFunc
 	blockFilesConcurrency         int
 	compactBlocksFetchConcurrency int
+
+	compactionVerificationFailures *prometheus.CounterVec
+	auditLog                       *AuditLog
+	blockEvents                    lifecycle.Notifier
+	markedCompactionsAborted       *prometheus.CounterVec
+}
+
+// EnableSafeMode makes the compaction groups verify compacted blocks after uploading them. Source blocks
+// are marked for deletion only if verification succeeds; otherwise the compacted blocks are deleted instead.
+func (g *DefaultGrouper) EnableSafeMode(reg prometheus.Registerer) {
+	g.compactionVerificationFailures = promauto.With(reg).NewCounterVec(prometheus.CounterOpts{
+		Name: "thanos_compact_group_compaction_verification_failures_total",
+		Help: "Total number of group compactions whose resulting blocks failed verification in safe mode.",
+	}, []string{"resolution"})
+}
+
+// EnableAuditLog makes the compaction groups write an audit record for each compaction to the given audit log.
+func (g *DefaultGrouper) EnableAuditLog(auditLog *AuditLog) {
+	g.auditLog = auditLog
+}
+
+// EnableBlockEvents makes the compaction groups notify the given notifier of the blocks resulting from compactions.
+func (g *DefaultGrouper) EnableBlockEvents(n lifecycle.Notifier) {
+	g.blockEvents = n
+}
+
+// EnableMarkerRecheck makes the compaction groups check that none of the planned blocks was marked for no
+// compaction in the meantime right before compacting them, closing the race with markers written after planning.
+func (g *DefaultGrouper) EnableMarkerRecheck(reg prometheus.Registerer) {
+	g.markedCompactionsAborted = promauto.With(reg).NewCounterVec(prometheus.CounterOpts{
+		Name: "thanos_compact_group_compactions_aborted_marked_total",
+		Help: "Total number of group compactions aborted because a planned block was marked for no compaction after planning.",
+	}, []string{"resolution"})
 }
 
 // NewDefaultGrouper makes a new DefaultGrouper.
@@ -372,6 +406,16 @@ func (g *DefaultGrouper) Groups(blocks map[ulid.ULID]*metadata.Meta) (res []*Gro
 			if err != nil {
 				return nil, errors.Wrap(err, "create compaction group")
 			}
+			if g.compactionVerificationFailures != nil {
+				group.SetSafeMode(g.compactionVerificationFailures.WithLabelValues(resolutionLabel))
+			}
+			group.SetAuditLog(g.auditLog)
+			if g.markedCompactionsAborted != nil {
+				group.SetMarkerRecheck(g.markedCompactionsAborted.WithLabelValues(resolutionLabel))
+			}
+			if g.blockEvents != nil {
+				group.SetBlockEvents(g.blockEvents)
+			}
 			groups[groupKey] = group
 			res = append(res, group)
 		}
@@ -409,6 +453,16 @@ type Group struct {
 	blockFilesConcurrency         int
 	compactBlocksFetchConcurrency int
 	extensions                    any
+
+	// Counter of compacted blocks failing verification in safe mode. Nil if safe mode is disabled.
+	compactionVerificationFailures prometheus.Counter
+	// Audit log of compactions. Nil if disabled.
+	auditLog *AuditLog
+	// Notifier of the blocks resulting from compactions.
+	blockEvents lifecycle.Notifier
+	// Counter of compactions aborted because a planned block was marked for no compaction. Nil if markers are not
+	// checked again before compacting.
+	markedCompactionsAborted prometheus.Counter
 }
 
 // NewGroup returns a new compaction group.
@@ -459,6 +513,7 @@ func NewGroup(
 		hashFunc:                      hashFunc,
 		blockFilesConcurrency:         blockFilesConcurrency,
 		compactBlocksFetchConcurrency: compactBlocksFetchConcurrency,
+		blockEvents:                   lifecycle.NopNotifier{},
 	}
 	return g, nil
 }
@@ -557,6 +612,29 @@ func (cg *Group) SetExtensions(extensions any) {
 	cg.extensions = extensions
 }
 
+// SetSafeMode enables the safe mode, in which compacted blocks are re-downloaded and verified
+// before their source blocks are marked for deletion. Failed verifications are counted with the given counter.
+func (cg *Group) SetSafeMode(verificationFailures prometheus.Counter) {
+	cg.compactionVerificationFailures = verificationFailures
+}
+
+// SetAuditLog makes the group write an audit record for each compaction before its source blocks are marked for deletion.
+func (cg *Group) SetAuditLog(auditLog *AuditLog) {
+	cg.auditLog = auditLog
+}
+
+// SetBlockEvents makes the group notify the given notifier of the blocks resulting from compactions, once their
+// source blocks are marked for deletion.
+func (cg *Group) SetBlockEvents(n lifecycle.Notifier) {
+	cg.blockEvents = n
+}
+
+// SetMarkerRecheck makes the group check that none of the planned blocks was marked for no compaction right before
+// compacting them, aborting the compaction otherwise. Aborted compactions are counted with the given counter.
+func (cg *Group) SetMarkerRecheck(aborted prometheus.Counter) {
+	cg.markedCompactionsAborted = aborted
+}
+
 // CompactProgressMetrics contains Prometheus metrics related to compaction progress.
 type CompactProgressMetrics struct {
 	NumberOfCompactionRuns   prometheus.Gauge
@@ -1146,6 +1224,21 @@ func (cg *Group) compact(ctx context.Context, dir string, planner Planner, comp
 
 	level.Info(cg.logger).Log("msg", "compaction available and planned", "plan", fmt.Sprintf("%v", toCompact))
 
+	if cg.markedCompactionsAborted != nil {
+		// The markers were read when the metas were synced, a block may have been marked since.
+		for _, m := range toCompact {
+			marked, err := block.IsMarked(ctx, cg.bkt, m.ULID, metadata.NoCompactMarkFilename)
+			if err != nil {
+				return false, nil, retry(err)
+			}
+			if marked {
+				level.Info(cg.logger).Log("msg", "planned block was marked for no compaction; aborting compaction", "block", m.ULID)
+				cg.markedCompactionsAborted.Inc()
+				return false, nil, nil
+			}
+		}
+	}
+
 	// Once we have a plan we need to download the actual data.
 	groupCompactionBegin := time.Now()
 	begin := groupCompactionBegin
@@ -1250,6 +1343,7 @@ func (cg *Group) compact(ctx context.Context, dir string, planner Planner, comp
 	level.Info(cg.logger).Log("msg", "compacted blocks", "new", compIDStrs,
 		"duration", time.Since(begin), "duration_ms", time.Since(begin).Milliseconds(), "overlapping_blocks", overlappingBlocks, "blocks", sourceBlockStr)
 
+	compMetas := make([]*metadata.Meta, 0, len(compIDs))
 	for _, compID := range compIDs {
 		bdir := filepath.Join(dir, compID.String())
 		index := filepath.Join(bdir, block.IndexFilename)
@@ -1310,6 +1404,7 @@ func (cg *Group) compact(ctx context.Context, dir string, planner Planner, comp
 			return false, nil, retry(errors.Wrapf(err, "upload of %s failed", compID))
 		}
 		level.Info(cg.logger).Log("msg", "uploaded block", "result_block", compID, "duration", time.Since(begin), "duration_ms", time.Since(begin).Milliseconds())
+		compMetas = append(compMetas, newMeta)
 		level.Info(cg.logger).Log("msg", "running post compaction callback", "result_block", compID)
 		if err := compactionLifecycleCallback.PostCompactionCallback(ctx, cg.logger, cg, compID); err != nil {
 			return false, nil, retry(errors.Wrapf(err, "failed to run post compaction callback for result block %s", compID))
@@ -1317,6 +1412,26 @@ func (cg *Group) compact(ctx context.Context, dir string, planner Planner, comp
 		level.Info(cg.logger).Log("msg", "finished running post compaction callback", "result_block", compID)
 	}
 
+	if cg.compactionVerificationFailures != nil {
+		if err := cg.verifyCompactedBlocks(ctx, dir, toCompact, compIDs, overlappingBlocks); err != nil {
+			return false, nil, err
+		}
+	}
+
+	sourceIDs := make([]ulid.ULID, 0, len(toCompact))
+	for _, meta := range toCompact {
+		sourceIDs = append(sourceIDs, meta.ULID)
+	}
+	if err := cg.auditLog.Record(ctx, AuditRecord{
+		Action:  AuditActionCompaction,
+		Reason:  "compaction plan",
+		Group:   cg.key,
+		Sources: sourceIDs,
+		Results: compIDs,
+	}); err != nil {
+		return false, nil, retry(errors.Wrap(err, "write compaction audit record"))
+	}
+
 	// Mark for deletion the blocks we just compacted from the group and bucket so they do not get included
 	// into the next planning cycle.
 	// Eventually the block we just uploaded should get synced into the group again (including sync-delay).
@@ -1328,6 +1443,9 @@ func (cg *Group) compact(ctx context.Context, dir string, planner Planner, comp
 		}
 		cg.groupGarbageCollectedBlocks.Inc()
 	}
+	for _, m := range compMetas {
+		cg.blockEvents.Notify(lifecycle.NewEvent(lifecycle.EventCompacted, m.ULID, m))
+	}
 
 	level.Info(cg.logger).Log("msg", "finished compacting blocks", "duration", time.Since(groupCompactionBegin),
 		"duration_ms", time.Since(groupCompactionBegin).Milliseconds(), "result_blocks", compIDStrs, "source_blocks", sourceBlockStr)
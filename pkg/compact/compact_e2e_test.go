@@ -29,7 +29,9 @@ import (
 	"github.com/efficientgo/core/testutil"
 
 	"github.com/thanos-io/thanos/pkg/block"
+	"github.com/thanos-io/thanos/pkg/block/lifecycle"
 	"github.com/thanos-io/thanos/pkg/block/metadata"
+	"github.com/thanos-io/thanos/pkg/compact/downsample"
 	"github.com/thanos-io/thanos/pkg/dedup"
 	"github.com/thanos-io/thanos/pkg/testutil/e2eutil"
 )
@@ -405,6 +407,308 @@ func testGroupCompactE2e(t *testing.T, mergeFunc storage.VerticalChunkSeriesMerg
 	})
 }
 
+// corruptingCompactor bumps the number of samples recorded in the meta.json of compacted blocks,
+// so that they do not match their content.
+type corruptingCompactor struct {
+	Compactor
+}
+
+func (c corruptingCompactor) CompactWithBlockPopulator(dest string, dirs []string, open []*tsdb.Block, blockPopulator tsdb.BlockPopulator) ([]ulid.ULID, error) {
+	ids, err := c.Compactor.CompactWithBlockPopulator(dest, dirs, open, blockPopulator)
+	if err != nil {
+		return nil, err
+	}
+	for _, id := range ids {
+		bdir := filepath.Join(dest, id.String())
+		meta, err := metadata.ReadFromDir(bdir)
+		if err != nil {
+			return nil, err
+		}
+		meta.Stats.NumSamples++
+		if err := meta.WriteToDir(log.NewNopLogger(), bdir); err != nil {
+			return nil, err
+		}
+	}
+	return ids, nil
+}
+
+func TestGroupCompactSafeModeE2E(t *testing.T) {
+	for _, tc := range []struct {
+		name       string
+		corrupt    bool
+		downsample bool
+	}{
+		{name: "valid compacted block"},
+		{name: "corrupted compacted block", corrupt: true},
+		{name: "valid compacted downsampled block", downsample: true},
+		{name: "corrupted compacted downsampled block", corrupt: true, downsample: true},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			ctx, cancel := context.WithTimeout(context.Background(), 120*time.Second)
+			defer cancel()
+
+			dir := t.TempDir()
+			logger := log.NewNopLogger()
+			reg := prometheus.NewRegistry()
+			bkt := objstore.NewInMemBucket()
+			insBkt := objstore.WithNoopInstr(bkt)
+
+			extLset := labels.FromStrings("e1", "1")
+			series := []labels.Labels{labels.FromStrings("a", "1"), labels.FromStrings("a", "2")}
+			specs := []blockgenSpec{
+				{numSamples: 100, mint: 0, maxt: 1000, extLset: extLset, series: series},
+				{numSamples: 100, mint: 1000, maxt: 2000, extLset: extLset, series: series},
+				{numSamples: 100, mint: 2000, maxt: 3000, extLset: extLset, series: series},
+				// Due to TSDB compaction delay (not compacting fresh block), we need one more block to be pushed to trigger compaction.
+				{numSamples: 100, mint: 3000, maxt: 4000, extLset: extLset, series: series},
+			}
+			var metas []*metadata.Meta
+			if tc.downsample {
+				metas = createAndUploadDownsampled(t, bkt, specs, 100)
+			} else {
+				metas = createAndUpload(t, bkt, specs)
+			}
+
+			ignoreDeletionMarkFilter := block.NewIgnoreDeletionMarkFilter(logger, insBkt, 48*time.Hour, fetcherConcurrency)
+			duplicateBlocksFilter := block.NewDeduplicateFilter(fetcherConcurrency)
+			noCompactMarkerFilter := NewGatherNoCompactionMarkFilter(logger, insBkt, 2)
+			metaFetcher, err := block.NewMetaFetcher(nil, 32, insBkt, block.NewConcurrentLister(logger, insBkt), "", nil, []block.MetadataFilter{
+				ignoreDeletionMarkFilter,
+				duplicateBlocksFilter,
+				noCompactMarkerFilter,
+			})
+			testutil.Ok(t, err)
+
+			blocksMarkedForDeletion := promauto.With(nil).NewCounter(prometheus.CounterOpts{})
+			blocksMarkedForNoCompact := promauto.With(nil).NewCounter(prometheus.CounterOpts{})
+			garbageCollectedBlocks := promauto.With(nil).NewCounter(prometheus.CounterOpts{})
+			sy, err := NewMetaSyncer(nil, nil, bkt, metaFetcher, duplicateBlocksFilter, ignoreDeletionMarkFilter, blocksMarkedForDeletion, garbageCollectedBlocks)
+			testutil.Ok(t, err)
+
+			var comp Compactor
+			comp, err = tsdb.NewLeveledCompactor(ctx, reg, logger, []int64{1000, 3000}, downsample.NewPool(), nil)
+			testutil.Ok(t, err)
+			if tc.corrupt {
+				comp = corruptingCompactor{Compactor: comp}
+			}
+
+			planner := NewPlanner(logger, []int64{1000, 3000}, noCompactMarkerFilter)
+			grouper := NewDefaultGrouper(logger, bkt, false, false, reg, blocksMarkedForDeletion, garbageCollectedBlocks, blocksMarkedForNoCompact, metadata.NoneFunc, 10, 10)
+			grouper.EnableSafeMode(reg)
+			bComp, err := NewBucketCompactor(logger, sy, grouper, planner, comp, dir, bkt, 1, true)
+			testutil.Ok(t, err)
+
+			err = bComp.Compact(ctx)
+			if !tc.corrupt {
+				testutil.Ok(t, err)
+				testutil.Equals(t, 0.0, promtest.ToFloat64(grouper.compactionVerificationFailures.WithLabelValues(metas[0].Thanos.ResolutionString())))
+				testutil.Assert(t, promtest.ToFloat64(blocksMarkedForDeletion) > 0, "expected source blocks to be marked for deletion")
+				return
+			}
+
+			testutil.NotOk(t, err)
+			testutil.Assert(t, IsHaltError(err), "expected halt error, got %v", err)
+			testutil.Equals(t, 1.0, promtest.ToFloat64(grouper.compactionVerificationFailures.WithLabelValues(metas[0].Thanos.ResolutionString())))
+			testutil.Equals(t, 0.0, promtest.ToFloat64(blocksMarkedForDeletion))
+
+			// Only the source blocks are left in the bucket, none of them marked for deletion.
+			var found []ulid.ULID
+			testutil.Ok(t, bkt.Iter(ctx, "", func(n string) error {
+				id, ok := block.IsBlockDir(n)
+				if !ok {
+					return nil
+				}
+				found = append(found, id)
+				ok, err := bkt.Exists(ctx, path.Join(id.String(), metadata.DeletionMarkFilename))
+				if err != nil {
+					return err
+				}
+				testutil.Assert(t, !ok, "source block %s marked for deletion", id)
+				return nil
+			}))
+			expected := make([]ulid.ULID, 0, len(metas))
+			for _, m := range metas {
+				expected = append(expected, m.ULID)
+			}
+			sort.Slice(found, func(i, j int) bool { return found[i].Compare(found[j]) < 0 })
+			sort.Slice(expected, func(i, j int) bool { return expected[i].Compare(expected[j]) < 0 })
+			testutil.Equals(t, expected, found)
+		})
+	}
+}
+
+// markingPlanner marks the first planned block for no compaction, as if the marker was written right after planning.
+type markingPlanner struct {
+	Planner
+	bkt objstore.Bucket
+}
+
+func (p markingPlanner) Plan(ctx context.Context, metasByMinTime []*metadata.Meta, errChan chan error, extensions any) ([]*metadata.Meta, error) {
+	plan, err := p.Planner.Plan(ctx, metasByMinTime, errChan, extensions)
+	if err != nil || len(plan) == 0 {
+		return plan, err
+	}
+	return plan, block.MarkForNoCompact(ctx, log.NewNopLogger(), p.bkt, plan[0].ULID, metadata.ManualNoCompactReason, "", promauto.With(nil).NewCounter(prometheus.CounterOpts{}))
+}
+
+func TestGroupCompactMarkerRecheckE2E(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 120*time.Second)
+	defer cancel()
+
+	dir := t.TempDir()
+	logger := log.NewNopLogger()
+	reg := prometheus.NewRegistry()
+	bkt := objstore.NewInMemBucket()
+	insBkt := objstore.WithNoopInstr(bkt)
+
+	extLset := labels.FromStrings("e1", "1")
+	series := []labels.Labels{labels.FromStrings("a", "1"), labels.FromStrings("a", "2")}
+	metas := createAndUpload(t, bkt, []blockgenSpec{
+		{numSamples: 100, mint: 0, maxt: 1000, extLset: extLset, series: series},
+		{numSamples: 100, mint: 1000, maxt: 2000, extLset: extLset, series: series},
+		{numSamples: 100, mint: 2000, maxt: 3000, extLset: extLset, series: series},
+		// Due to TSDB compaction delay (not compacting fresh block), we need one more block to be pushed to trigger compaction.
+		{numSamples: 100, mint: 3000, maxt: 4000, extLset: extLset, series: series},
+	})
+
+	ignoreDeletionMarkFilter := block.NewIgnoreDeletionMarkFilter(logger, insBkt, 48*time.Hour, fetcherConcurrency)
+	duplicateBlocksFilter := block.NewDeduplicateFilter(fetcherConcurrency)
+	noCompactMarkerFilter := NewGatherNoCompactionMarkFilter(logger, insBkt, 2)
+	metaFetcher, err := block.NewMetaFetcher(nil, 32, insBkt, block.NewConcurrentLister(logger, insBkt), "", nil, []block.MetadataFilter{
+		ignoreDeletionMarkFilter,
+		duplicateBlocksFilter,
+		noCompactMarkerFilter,
+	})
+	testutil.Ok(t, err)
+
+	blocksMarkedForDeletion := promauto.With(nil).NewCounter(prometheus.CounterOpts{})
+	garbageCollectedBlocks := promauto.With(nil).NewCounter(prometheus.CounterOpts{})
+	sy, err := NewMetaSyncer(nil, nil, bkt, metaFetcher, duplicateBlocksFilter, ignoreDeletionMarkFilter, blocksMarkedForDeletion, garbageCollectedBlocks)
+	testutil.Ok(t, err)
+
+	comp, err := tsdb.NewLeveledCompactor(ctx, reg, logger, []int64{1000, 3000}, nil, nil)
+	testutil.Ok(t, err)
+
+	planner := markingPlanner{Planner: NewPlanner(logger, []int64{1000, 3000}, noCompactMarkerFilter), bkt: bkt}
+	grouper := NewDefaultGrouper(logger, bkt, false, false, reg, blocksMarkedForDeletion, garbageCollectedBlocks, promauto.With(nil).NewCounter(prometheus.CounterOpts{}), metadata.NoneFunc, 10, 10)
+	grouper.EnableMarkerRecheck(reg)
+	bComp, err := NewBucketCompactor(logger, sy, grouper, planner, comp, dir, bkt, 1, true)
+	testutil.Ok(t, err)
+
+	// The compaction is aborted, leaving the source blocks untouched.
+	testutil.Ok(t, bComp.Compact(ctx))
+	testutil.Equals(t, 1.0, promtest.ToFloat64(grouper.markedCompactionsAborted.WithLabelValues(metas[0].Thanos.ResolutionString())))
+	testutil.Equals(t, 0.0, promtest.ToFloat64(blocksMarkedForDeletion))
+
+	blocks := 0
+	testutil.Ok(t, bkt.Iter(ctx, "", func(string) error {
+		blocks++
+		return nil
+	}))
+	testutil.Equals(t, len(metas), blocks)
+}
+
+func TestGroupCompactAuditLogE2E(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 120*time.Second)
+	defer cancel()
+
+	dir := t.TempDir()
+	logger := log.NewNopLogger()
+	reg := prometheus.NewRegistry()
+	bkt := objstore.NewInMemBucket()
+	insBkt := objstore.WithNoopInstr(bkt)
+
+	extLset := labels.FromStrings("e1", "1")
+	series := []labels.Labels{labels.FromStrings("a", "1"), labels.FromStrings("a", "2")}
+	metas := createAndUpload(t, bkt, []blockgenSpec{
+		{numSamples: 100, mint: 0, maxt: 1000, extLset: extLset, series: series},
+		{numSamples: 100, mint: 1000, maxt: 2000, extLset: extLset, series: series},
+		{numSamples: 100, mint: 2000, maxt: 3000, extLset: extLset, series: series},
+		// Due to TSDB compaction delay (not compacting fresh block), we need one more block to be pushed to trigger compaction.
+		{numSamples: 100, mint: 3000, maxt: 4000, extLset: extLset, series: series},
+	})
+
+	ignoreDeletionMarkFilter := block.NewIgnoreDeletionMarkFilter(logger, insBkt, 48*time.Hour, fetcherConcurrency)
+	duplicateBlocksFilter := block.NewDeduplicateFilter(fetcherConcurrency)
+	noCompactMarkerFilter := NewGatherNoCompactionMarkFilter(logger, insBkt, 2)
+	metaFetcher, err := block.NewMetaFetcher(nil, 32, insBkt, block.NewConcurrentLister(logger, insBkt), "", nil, []block.MetadataFilter{
+		ignoreDeletionMarkFilter,
+		duplicateBlocksFilter,
+		noCompactMarkerFilter,
+	})
+	testutil.Ok(t, err)
+
+	blocksMarkedForDeletion := promauto.With(nil).NewCounter(prometheus.CounterOpts{})
+	blocksMarkedForNoCompact := promauto.With(nil).NewCounter(prometheus.CounterOpts{})
+	garbageCollectedBlocks := promauto.With(nil).NewCounter(prometheus.CounterOpts{})
+	sy, err := NewMetaSyncer(nil, nil, bkt, metaFetcher, duplicateBlocksFilter, ignoreDeletionMarkFilter, blocksMarkedForDeletion, garbageCollectedBlocks)
+	testutil.Ok(t, err)
+
+	comp, err := tsdb.NewLeveledCompactor(ctx, reg, logger, []int64{1000, 3000}, nil, nil)
+	testutil.Ok(t, err)
+
+	planner := NewPlanner(logger, []int64{1000, 3000}, noCompactMarkerFilter)
+	grouper := NewDefaultGrouper(logger, bkt, false, false, reg, blocksMarkedForDeletion, garbageCollectedBlocks, blocksMarkedForNoCompact, metadata.NoneFunc, 10, 10)
+	grouper.EnableAuditLog(NewAuditLog(logger, bkt, "compactor-0"))
+	blockEvents := &recordingNotifier{}
+	grouper.EnableBlockEvents(blockEvents)
+	bComp, err := NewBucketCompactor(logger, sy, grouper, planner, comp, dir, bkt, 1, true)
+	testutil.Ok(t, err)
+	testutil.Ok(t, bComp.Compact(ctx))
+
+	var records []AuditRecord
+	testutil.Ok(t, bkt.Iter(ctx, AuditDir, func(name string) error {
+		r, err := bkt.Get(ctx, name)
+		if err != nil {
+			return err
+		}
+		defer r.Close()
+
+		var rec AuditRecord
+		if err := json.NewDecoder(r).Decode(&rec); err != nil {
+			return err
+		}
+		records = append(records, rec)
+		return nil
+	}))
+
+	// Every compaction is recorded with the blocks it was planned for and the blocks it produced.
+	testutil.Assert(t, len(records) > 0, "expected compaction audit records")
+	testutil.Equals(t, float64(len(records)), promtest.ToFloat64(grouper.compactions.WithLabelValues(metas[0].Thanos.ResolutionString())))
+	compacted := map[ulid.ULID]struct{}{}
+	testutil.Equals(t, len(records), len(blockEvents.events))
+	for i, rec := range records {
+		testutil.Equals(t, lifecycle.EventCompacted, blockEvents.events[i].Type)
+		testutil.Equals(t, rec.Results[0], blockEvents.events[i].Block)
+		testutil.Equals(t, rec.Sources, blockEvents.events[i].Meta.Compaction.Sources)
+
+		testutil.Equals(t, AuditActionCompaction, rec.Action)
+		testutil.Equals(t, "compactor-0", rec.Instance)
+		testutil.Equals(t, metas[0].Thanos.GroupKey(), rec.Group)
+		testutil.Equals(t, 1, len(rec.Results))
+		for _, id := range rec.Sources {
+			compacted[id] = struct{}{}
+		}
+
+		m, err := block.DownloadMeta(ctx, logger, bkt, rec.Results[0])
+		testutil.Ok(t, err)
+		var parents []ulid.ULID
+		for _, p := range m.Compaction.Parents {
+			parents = append(parents, p.ULID)
+		}
+		testutil.Equals(t, rec.Sources, parents)
+	}
+	testutil.Equals(t, float64(len(compacted)), promtest.ToFloat64(blocksMarkedForDeletion))
+}
+
+type recordingNotifier struct {
+	events []lifecycle.Event
+}
+
+func (n *recordingNotifier) Notify(e lifecycle.Event) { n.events = append(n.events, e) }
+
+func (n *recordingNotifier) Close() error { return nil }
+
 type blockgenSpec struct {
 	mint, maxt int64
 	series     []labels.Labels
@@ -427,6 +731,31 @@ func createAndUpload(t testing.TB, bkt objstore.Bucket, blocks []blockgenSpec) (
 
 	return metas
 }
+
+// createAndUploadDownsampled creates the given raw blocks and uploads them downsampled to the given resolution.
+func createAndUploadDownsampled(t testing.TB, bkt objstore.Bucket, blocks []blockgenSpec, resolution int64) (metas []*metadata.Meta) {
+	prepareDir := t.TempDir()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Second)
+	defer cancel()
+
+	for _, b := range blocks {
+		id, meta := createBlock(t, ctx, prepareDir, b)
+		raw, err := tsdb.OpenBlock(nil, filepath.Join(prepareDir, id.String()), downsample.NewPool())
+		testutil.Ok(t, err)
+		id, err = downsample.Downsample(ctx, log.NewNopLogger(), meta, raw, prepareDir, resolution)
+		testutil.Ok(t, err)
+		testutil.Ok(t, raw.Close())
+
+		meta, err = metadata.ReadFromDir(filepath.Join(prepareDir, id.String()))
+		testutil.Ok(t, err)
+		metas = append(metas, meta)
+		testutil.Ok(t, block.Upload(ctx, log.NewNopLogger(), bkt, filepath.Join(prepareDir, id.String()), metadata.NoneFunc))
+	}
+
+	return metas
+}
+
 func createBlock(t testing.TB, ctx context.Context, prepareDir string, b blockgenSpec) (id ulid.ULID, meta *metadata.Meta) {
 	var err error
 	if b.numSamples == 0 {
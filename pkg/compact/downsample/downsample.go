@@ -55,11 +55,17 @@ func Downsample(
 	b tsdb.BlockReader,
 	dir string,
 	resolution int64,
+	opts ...Option,
 ) (id ulid.ULID, err error) {
 	if origMeta.Thanos.Downsample.Resolution >= resolution {
 		return id, errors.New("target resolution not lower than existing one")
 	}
 
+	var o options
+	for _, opt := range opts {
+		opt(&o)
+	}
+
 	indexr, err := b.Index()
 	if err != nil {
 		return id, errors.Wrap(err, "open index reader")
@@ -156,7 +162,13 @@ func Downsample(
 					return id, errors.Wrapf(err, "expand chunk %d, series %d", c.Ref, postings.At())
 				}
 			}
-			if err := streamedBlockWriter.WriteSeries(lset, DownsampleRaw(all, resolution)); err != nil {
+			downsampledChunks := DownsampleRaw(all, resolution)
+			if n := o.significantFigures(lset); n > 0 {
+				if err := roundAggrChunks(downsampledChunks, n); err != nil {
+					return id, errors.Wrapf(err, "round downsampled data, series: %d", postings.At())
+				}
+			}
+			if err := streamedBlockWriter.WriteSeries(lset, downsampledChunks); err != nil {
 				return id, errors.Wrapf(err, "downsample raw data, series: %d", postings.At())
 			}
 		} else {
@@ -197,6 +209,11 @@ func Downsample(
 			if err != nil {
 				return id, errors.Wrapf(err, "downsample aggregate block, series: %d", postings.At())
 			}
+			if n := o.significantFigures(lset); n > 0 {
+				if err := roundAggrChunks(downsampledChunks, n); err != nil {
+					return id, errors.Wrapf(err, "round downsampled data, series: %d", postings.At())
+				}
+			}
 			if err := streamedBlockWriter.WriteSeries(lset, downsampledChunks); err != nil {
 				return id, errors.Wrapf(err, "write series: %d", postings.At())
 			}
@@ -0,0 +1,144 @@
+// Copyright (c) The Thanos Authors.
+// Licensed under the Apache License 2.0.
+
+package downsample
+
+import (
+	"math"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+	"github.com/prometheus/prometheus/model/labels"
+	"github.com/prometheus/prometheus/promql/parser"
+	"github.com/prometheus/prometheus/tsdb/chunkenc"
+	"github.com/prometheus/prometheus/tsdb/chunks"
+)
+
+// Option configures Downsample.
+type Option func(*options)
+
+type options struct {
+	rounding []Rounding
+}
+
+// WithRounding rounds the values of the sum, min and max aggregates of the series matching the given rules when
+// downsampling. The first matching rule applies. Count and counter aggregates are never rounded, and neither are
+// series named like counters, see Rounding.
+func WithRounding(rules ...Rounding) Option {
+	return func(o *options) {
+		o.rounding = append(o.rounding, rules...)
+	}
+}
+
+// Rounding rounds the values of the gauge aggregates of the series matching Matchers to SignificantFigures
+// significant decimal figures. The relative error of the rounded values is at most half a unit of the last
+// significant figure, i.e. 0.5% for 3 significant figures. Noisy low-order digits make consecutive values
+// differ in most of their bits, so rounding them makes XOR chunks much smaller.
+//
+// Series whose metric name ends with _total, _count, _sum or _bucket are counters, or the counters of histograms
+// and summaries, and are never rounded since functions like rate depend on their precision.
+type Rounding struct {
+	Matchers           []*labels.Matcher
+	SignificantFigures int
+}
+
+// ParseRounding parses a rounding rule in the <significant figures>:<series selector> format, e.g. 3:{job="node"}.
+func ParseRounding(s string) (Rounding, error) {
+	figures, selector, ok := strings.Cut(s, ":")
+	if !ok {
+		return Rounding{}, errors.Errorf("invalid rounding rule %q, expected <significant figures>:<series selector>", s)
+	}
+	n, err := strconv.Atoi(figures)
+	if err != nil || n < 1 || n > 17 {
+		return Rounding{}, errors.Errorf("invalid number of significant figures %q in rounding rule %q, expected an integer between 1 and 17", figures, s)
+	}
+	matchers, err := parser.ParseMetricSelector(selector)
+	if err != nil {
+		return Rounding{}, errors.Wrapf(err, "parse series selector of rounding rule %q", s)
+	}
+	return Rounding{Matchers: matchers, SignificantFigures: n}, nil
+}
+
+// counterSuffixes are the suffixes of the names of counters, including the counters of histograms and summaries.
+var counterSuffixes = []string{"_total", "_count", "_sum", "_bucket"}
+
+// significantFigures returns the number of significant figures to round the aggregates of the series with the
+// given labels to, 0 if they must not be rounded.
+func (o *options) significantFigures(lset labels.Labels) int {
+	if len(o.rounding) == 0 {
+		return 0
+	}
+	name := lset.Get(labels.MetricName)
+	for _, suffix := range counterSuffixes {
+		if strings.HasSuffix(name, suffix) {
+			return 0
+		}
+	}
+
+rules:
+	for _, r := range o.rounding {
+		for _, m := range r.Matchers {
+			if !m.Matches(lset.Get(m.Name)) {
+				continue rules
+			}
+		}
+		return r.SignificantFigures
+	}
+	return 0
+}
+
+// roundSignificantFigures rounds v to n significant decimal figures.
+func roundSignificantFigures(v float64, n int) float64 {
+	if v == 0 || math.IsNaN(v) || math.IsInf(v, 0) {
+		return v
+	}
+	r, err := strconv.ParseFloat(strconv.FormatFloat(v, 'g', n, 64), 64)
+	if err != nil {
+		return v
+	}
+	return r
+}
+
+// roundAggrChunks rounds the values of the sum, min and max aggregates of the given downsampled chunks to n
+// significant figures, in place.
+func roundAggrChunks(chks []chunks.Meta, n int) error {
+	var reuseIt chunkenc.Iterator
+	for i, c := range chks {
+		ac, ok := c.Chunk.(*AggrChunk)
+		if !ok {
+			return errors.Errorf("expected downsampled chunk (*downsample.AggrChunk), got %T", c.Chunk)
+		}
+
+		var aggrs [5]chunkenc.Chunk
+		for _, at := range []AggrType{AggrCount, AggrSum, AggrMin, AggrMax, AggrCounter} {
+			chk, err := ac.Get(at)
+			if err == ErrAggrNotExist {
+				continue
+			} else if err != nil {
+				return err
+			}
+			if at == AggrCount || at == AggrCounter {
+				aggrs[at] = chk
+				continue
+			}
+
+			rounded := chunkenc.NewXORChunk()
+			app, err := rounded.Appender()
+			if err != nil {
+				return err
+			}
+			reuseIt = chk.Iterator(reuseIt)
+			for reuseIt.Next() != chunkenc.ValNone {
+				t, v := reuseIt.At()
+				app.Append(t, roundSignificantFigures(v, n))
+			}
+			if err := reuseIt.Err(); err != nil {
+				return errors.Wrapf(err, "iterate %s aggregate", at)
+			}
+			aggrs[at] = rounded
+		}
+		chks[i].Chunk = EncodeAggrChunk(aggrs)
+	}
+	return nil
+}
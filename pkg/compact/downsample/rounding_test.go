@@ -0,0 +1,157 @@
+// Copyright (c) The Thanos Authors.
+// Licensed under the Apache License 2.0.
+
+package downsample
+
+import (
+	"context"
+	"math"
+	"path/filepath"
+	"testing"
+
+	"github.com/efficientgo/core/testutil"
+	"github.com/go-kit/log"
+	"github.com/prometheus/prometheus/model/labels"
+	"github.com/prometheus/prometheus/tsdb/chunks"
+	"github.com/prometheus/prometheus/tsdb/index"
+
+	"github.com/thanos-io/thanos/pkg/block"
+	"github.com/thanos-io/thanos/pkg/block/metadata"
+)
+
+func TestParseRounding(t *testing.T) {
+	r, err := ParseRounding(`3:{job="node", __name__=~"node_.*"}`)
+	testutil.Ok(t, err)
+	testutil.Equals(t, 3, r.SignificantFigures)
+	testutil.Equals(t, 2, len(r.Matchers))
+
+	r, err = ParseRounding(`4:node_load1`)
+	testutil.Ok(t, err)
+	testutil.Equals(t, 4, r.SignificantFigures)
+	testutil.Equals(t, `__name__="node_load1"`, r.Matchers[0].String())
+
+	for _, invalid := range []string{`{job="node"}`, `0:{job="node"}`, `18:{job="node"}`, `three:{job="node"}`, `3:{job=}`} {
+		_, err := ParseRounding(invalid)
+		testutil.NotOk(t, err, invalid)
+	}
+}
+
+func TestRoundSignificantFigures(t *testing.T) {
+	for _, c := range []struct {
+		v, expected float64
+		n           int
+	}{
+		{v: 1234.5678, n: 3, expected: 1230},
+		{v: 0.012345678, n: 2, expected: 0.012},
+		{v: -98.765, n: 4, expected: -98.77},
+		{v: 1e-300, n: 1, expected: 1e-300},
+		{v: 0, n: 3, expected: 0},
+		{v: math.Inf(1), n: 3, expected: math.Inf(1)},
+	} {
+		testutil.Equals(t, c.expected, roundSignificantFigures(c.v, c.n))
+	}
+	testutil.Assert(t, math.IsNaN(roundSignificantFigures(math.NaN(), 3)))
+}
+
+func TestDownsample_Rounding(t *testing.T) {
+	var (
+		ctx    = context.Background()
+		logger = log.NewNopLogger()
+		gauge  = labels.FromStrings("__name__", "node_load1", "job", "node")
+		other  = labels.FromStrings("__name__", "node_load1", "job", "other")
+		// Counters are never rounded, even when matching.
+		counter = labels.FromStrings("__name__", "node_cpu_seconds_total", "job", "node")
+	)
+
+	// Two hours of noisy samples every 15 seconds.
+	var raw []sample
+	for i := int64(0); i < 480; i++ {
+		raw = append(raw, sample{t: i * 15_000, v: 1000 + float64(i) + math.Sin(float64(i))/1000})
+	}
+	downsample := func(opts ...Option) map[string][]*AggrChunk {
+		mb := newMemBlock()
+		for _, lset := range []labels.Labels{gauge, other, counter} {
+			ser := chunksToSeriesIteratable(t, [][]sample{raw}, nil)
+			ser.lset = lset
+			mb.addSeries(ser)
+		}
+		dir := t.TempDir()
+		id, err := Downsample(ctx, logger, &metadata.Meta{}, mb, dir, ResLevel1, opts...)
+		testutil.Ok(t, err)
+		return readAggrChunks(t, filepath.Join(dir, id.String()))
+	}
+
+	exact := downsample()
+	rounded := downsample(WithRounding(Rounding{Matchers: []*labels.Matcher{labels.MustNewMatcher(labels.MatchEqual, "job", "node")}, SignificantFigures: 3}))
+
+	testutil.Equals(t, exact[other.String()], rounded[other.String()])
+	testutil.Equals(t, exact[counter.String()], rounded[counter.String()])
+
+	testutil.Equals(t, len(exact[gauge.String()]), len(rounded[gauge.String()]))
+	var exactSize, roundedSize int
+	for i, chk := range rounded[gauge.String()] {
+		for _, at := range []AggrType{AggrCount, AggrSum, AggrMin, AggrMax, AggrCounter} {
+			exactValues, exactLen := aggrSamples(t, exact[gauge.String()][i], at)
+			roundedValues, roundedLen := aggrSamples(t, chk, at)
+			exactSize += exactLen
+			roundedSize += roundedLen
+
+			if at == AggrCount || at == AggrCounter {
+				testutil.Equals(t, exactValues, roundedValues)
+				continue
+			}
+			testutil.Equals(t, len(exactValues), len(roundedValues))
+			for j, s := range exactValues {
+				testutil.Equals(t, sample{t: s.t, v: roundSignificantFigures(s.v, 3)}, roundedValues[j])
+			}
+		}
+	}
+	testutil.Assert(t, roundedSize < exactSize, "expected rounded chunks to be smaller, got %d bytes, exact %d bytes", roundedSize, exactSize)
+}
+
+// readAggrChunks returns the downsampled chunks of every series of the block in dir.
+func readAggrChunks(t *testing.T, dir string) map[string][]*AggrChunk {
+	t.Helper()
+
+	indexr, err := index.NewFileReader(filepath.Join(dir, block.IndexFilename))
+	testutil.Ok(t, err)
+	defer func() { testutil.Ok(t, indexr.Close()) }()
+
+	chunkr, err := chunks.NewDirReader(filepath.Join(dir, block.ChunksDirname), NewPool())
+	testutil.Ok(t, err)
+	defer func() { testutil.Ok(t, chunkr.Close()) }()
+
+	key, values := index.AllPostingsKey()
+	p, err := indexr.Postings(context.Background(), key, values)
+	testutil.Ok(t, err)
+
+	var (
+		builder labels.ScratchBuilder
+		chks    []chunks.Meta
+		res     = map[string][]*AggrChunk{}
+	)
+	for p.Next() {
+		testutil.Ok(t, indexr.Series(p.At(), &builder, &chks))
+		lset := builder.Labels().String()
+		for _, c := range chks {
+			chk, _, err := chunkr.ChunkOrIterable(c)
+			testutil.Ok(t, err)
+			// Chunks are only valid until the reader is closed.
+			ac := AggrChunk(append([]byte(nil), chk.Bytes()...))
+			res[lset] = append(res[lset], &ac)
+		}
+	}
+	testutil.Ok(t, p.Err())
+	return res
+}
+
+// aggrSamples returns the samples of the given aggregate of chk and the size of its encoding.
+func aggrSamples(t *testing.T, chk *AggrChunk, at AggrType) ([]sample, int) {
+	t.Helper()
+
+	c, err := chk.Get(at)
+	testutil.Ok(t, err)
+	var samples []sample
+	testutil.Ok(t, expandChunkIterator(c.Iterator(nil), &samples))
+	return samples, len(c.Bytes())
+}
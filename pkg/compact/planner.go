@@ -10,6 +10,7 @@ import (
 	"path/filepath"
 
 	"github.com/go-kit/log"
+	"github.com/go-kit/log/level"
 	"github.com/oklog/ulid"
 	"github.com/pkg/errors"
 	"github.com/prometheus/client_golang/prometheus"
@@ -17,12 +18,15 @@ import (
 
 	"github.com/thanos-io/thanos/pkg/block"
 	"github.com/thanos-io/thanos/pkg/block/metadata"
+	"github.com/thanos-io/thanos/pkg/compact/downsample"
 )
 
 type tsdbBasedPlanner struct {
 	logger log.Logger
 
 	ranges []int64
+	// Blocks smaller than minBlockSize bytes are merged together before level compaction, 0 disables it.
+	minBlockSize int64
 
 	noCompBlocksFunc func() map[ulid.ULID]*metadata.NoCompactMark
 }
@@ -48,6 +52,13 @@ func NewPlanner(logger log.Logger, ranges []int64, noCompBlocks *GatherNoCompact
 	return &tsdbBasedPlanner{logger: logger, ranges: ranges, noCompBlocksFunc: noCompBlocks.NoCompactMarkedBlocks}
 }
 
+// EnableDefragmentation makes the planner merge adjacent blocks smaller than minBlockSize bytes before level
+// compaction, e.g. the many tiny blocks uploaded by receivers cutting their heads often. Merged blocks stay within
+// the aligned time range of the second compaction level, so that they never cross level boundaries.
+func (p *tsdbBasedPlanner) EnableDefragmentation(minBlockSize int64) {
+	p.minBlockSize = minBlockSize
+}
+
 // TODO(bwplotka): Consider smarter algorithm, this prefers smaller iterative compactions vs big single one: https://github.com/thanos-io/thanos/issues/3405
 func (p *tsdbBasedPlanner) Plan(_ context.Context, metasByMinTime []*metadata.Meta, _ chan error, _ any) ([]*metadata.Meta, error) {
 	return p.plan(p.noCompBlocksFunc(), metasByMinTime)
@@ -74,6 +85,10 @@ func (p *tsdbBasedPlanner) plan(noCompactMarked map[ulid.ULID]*metadata.NoCompac
 		notExcludedMetasByMinTime = notExcludedMetasByMinTime[:len(notExcludedMetasByMinTime)-1]
 	}
 	metasByMinTime = metasByMinTime[:len(metasByMinTime)-1]
+	if res = selectTinyMetas(p.ranges, p.minBlockSize, noCompactMarked, metasByMinTime); len(res) > 0 {
+		level.Debug(p.logger).Log("msg", "planned defragmentation of tiny blocks", "blocks", len(res), "mint", res[0].MinTime, "maxt", res[len(res)-1].MaxTime)
+		return res, nil
+	}
 	res = append(res, selectMetas(p.ranges, noCompactMarked, metasByMinTime)...)
 	if len(res) > 0 {
 		return res, nil
@@ -152,6 +167,69 @@ func selectMetas(ranges []int64, noCompactMarked map[ulid.ULID]*metadata.NoCompa
 	return nil
 }
 
+// selectTinyMetas returns adjacent blocks smaller than minBlockSize bytes to merge together. Only blocks within the
+// same aligned time range of the second compaction level are merged, and the merged block never spans the range
+// from which blocks of its resolution are downsampled, so that it is not downsampled before its range is complete.
+// The result is nil if minBlockSize is 0 or only a single block range is configured.
+func selectTinyMetas(ranges []int64, minBlockSize int64, noCompactMarked map[ulid.ULID]*metadata.NoCompactMark, metasByMinTime []*metadata.Meta) []*metadata.Meta {
+	if minBlockSize <= 0 || len(ranges) < 2 {
+		return nil
+	}
+	isTiny := func(m *metadata.Meta) bool {
+		if _, excluded := noCompactMarked[m.ULID]; excluded || m.Compaction.Failed {
+			return false
+		}
+		size, ok := blockSize(m)
+		return ok && size < minBlockSize
+	}
+
+	for _, p := range splitByRange(metasByMinTime, ranges[1]) {
+		var tiny []*metadata.Meta
+		for _, m := range p {
+			if !isTiny(m) {
+				// Blocks are not overlapping, merging tiny blocks around this one would make them overlap.
+				if len(tiny) > 1 {
+					return tiny
+				}
+				tiny = nil
+				continue
+			}
+			if len(tiny) > 0 && m.MaxTime-tiny[0].MinTime >= downsampleRange(m.Thanos.Downsample.Resolution) {
+				if len(tiny) > 1 {
+					return tiny
+				}
+				tiny = nil
+			}
+			tiny = append(tiny, m)
+		}
+		if len(tiny) > 1 {
+			return tiny
+		}
+	}
+	return nil
+}
+
+// blockSize returns the total size of the files of the block, if its meta lists them.
+func blockSize(m *metadata.Meta) (int64, bool) {
+	var size int64
+	for _, f := range m.Thanos.Files {
+		size += f.SizeBytes
+	}
+	return size, len(m.Thanos.Files) > 0
+}
+
+// downsampleRange returns the minimum range of blocks of the resolution to be downsampled.
+func downsampleRange(resolution int64) int64 {
+	switch resolution {
+	case downsample.ResLevel0:
+		return downsample.ResLevel1DownsampleRange
+	case downsample.ResLevel1:
+		return downsample.ResLevel2DownsampleRange
+	default:
+		return math.MaxInt64
+	}
+}
+
 // selectOverlappingMetas returns all dirs with overlapping time ranges.
 // It expects sorted input by mint and returns the overlapping dirs in the same order as received.
 // Copied and adjusted from https://github.com/prometheus/prometheus/blob/3d8826a3d42566684283a9b7f7e812e412c24407/tsdb/compact.go#L268.
@@ -860,3 +860,95 @@ func TestLargeTotalIndexSizeFilter_Plan(t *testing.T) {
 		}
 	}
 }
+
+func TestTSDBBasedPlanner_PlanWithDefragmentation(t *testing.T) {
+	const hour = int64(60 * 60 * 1000)
+
+	meta := func(id uint64, mint, maxt, size int64) *metadata.Meta {
+		m := &metadata.Meta{BlockMeta: tsdb.BlockMeta{Version: 1, ULID: ulid.MustNew(id, nil), MinTime: mint, MaxTime: maxt}}
+		if size > 0 {
+			m.Thanos.Files = []metadata.File{
+				{RelPath: block.IndexFilename, SizeBytes: size / 2},
+				{RelPath: "chunks/000001", SizeBytes: size - size/2},
+			}
+		}
+		return m
+	}
+
+	for _, c := range []struct {
+		name           string
+		ranges         []int64
+		minBlockSize   int64
+		metas          []*metadata.Meta
+		noCompactMarks map[ulid.ULID]*metadata.NoCompactMark
+
+		expected []ulid.ULID
+	}{
+		{
+			name:         "Defragmentation disabled",
+			ranges:       []int64{20, 60, 180},
+			minBlockSize: 0,
+			metas:        []*metadata.Meta{meta(1, 0, 5, 10), meta(2, 5, 10, 10), meta(3, 10, 15, 10)},
+		},
+		{
+			name:         "Tiny blocks are merged before their range is complete",
+			ranges:       []int64{20, 60, 180},
+			minBlockSize: 100,
+			metas:        []*metadata.Meta{meta(1, 0, 5, 10), meta(2, 5, 10, 10), meta(3, 10, 15, 10)},
+			expected:     []ulid.ULID{ulid.MustNew(1, nil), ulid.MustNew(2, nil)},
+		},
+		{
+			name:         "Tiny blocks are not merged across a bigger block",
+			ranges:       []int64{20, 60, 180},
+			minBlockSize: 100,
+			metas:        []*metadata.Meta{meta(1, 0, 5, 10), meta(2, 5, 10, 1000), meta(3, 10, 15, 10), meta(4, 15, 20, 10), meta(5, 20, 25, 10)},
+			expected:     []ulid.ULID{ulid.MustNew(3, nil), ulid.MustNew(4, nil)},
+		},
+		{
+			name:         "Tiny blocks are not merged across a block with unknown size",
+			ranges:       []int64{20, 60, 180},
+			minBlockSize: 100,
+			metas:        []*metadata.Meta{meta(1, 0, 5, 10), meta(2, 5, 10, 0), meta(3, 10, 15, 10), meta(4, 15, 20, 10)},
+		},
+		{
+			name:           "Tiny blocks are not merged across an excluded block",
+			ranges:         []int64{20, 60, 180},
+			minBlockSize:   100,
+			metas:          []*metadata.Meta{meta(1, 0, 5, 10), meta(2, 5, 10, 10), meta(3, 10, 15, 10), meta(4, 15, 20, 10), meta(5, 20, 25, 10)},
+			noCompactMarks: map[ulid.ULID]*metadata.NoCompactMark{ulid.MustNew(2, nil): {}},
+			expected:       []ulid.ULID{ulid.MustNew(3, nil), ulid.MustNew(4, nil)},
+		},
+		{
+			name:         "Tiny blocks are not merged across time range boundaries",
+			ranges:       []int64{20, 60, 180},
+			minBlockSize: 100,
+			metas:        []*metadata.Meta{meta(1, 50, 60, 10), meta(2, 60, 70, 10), meta(3, 70, 75, 10)},
+		},
+		{
+			name:         "Merged tiny blocks do not reach the downsampling range",
+			ranges:       []int64{hour, 48 * hour},
+			minBlockSize: 100,
+			metas: []*metadata.Meta{
+				meta(1, 0, 10*hour, 10), meta(2, 10*hour, 20*hour, 10), meta(3, 20*hour, 30*hour, 10),
+				meta(4, 30*hour, 40*hour, 10), meta(5, 40*hour, 45*hour, 10), meta(6, 45*hour, 46*hour, 10),
+			},
+			expected: []ulid.ULID{ulid.MustNew(1, nil), ulid.MustNew(2, nil), ulid.MustNew(3, nil)},
+		},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			g := &GatherNoCompactionMarkFilter{}
+			g.noCompactMarkedMap = c.noCompactMarks
+			planner := NewPlanner(log.NewNopLogger(), c.ranges, g)
+			planner.EnableDefragmentation(c.minBlockSize)
+
+			plan, err := planner.Plan(context.Background(), c.metas, nil, nil)
+			testutil.Ok(t, err)
+
+			var ids []ulid.ULID
+			for _, m := range plan {
+				ids = append(ids, m.ULID)
+			}
+			testutil.Equals(t, c.expected, ids)
+		})
+	}
+}
@@ -20,7 +20,8 @@ import (
 )
 
 // ApplyRetentionPolicyByResolution removes blocks depending on the specified retentionByResolution based on blocks MaxTime.
-// A value of 0 disables the retention for its resolution.
+// A value of 0 disables the retention for its resolution. If auditLog is not nil, an audit record is written
+// for each block before it is marked for deletion.
 func ApplyRetentionPolicyByResolution(
 	ctx context.Context,
 	logger log.Logger,
@@ -28,6 +29,7 @@ func ApplyRetentionPolicyByResolution(
 	metas map[ulid.ULID]*metadata.Meta,
 	retentionByResolution map[ResolutionLevel]time.Duration,
 	blocksMarkedForDeletion prometheus.Counter,
+	auditLog *AuditLog,
 ) error {
 	level.Info(logger).Log("msg", "start optional retention")
 	for id, m := range metas {
@@ -39,7 +41,11 @@ func ApplyRetentionPolicyByResolution(
 		maxTime := time.Unix(m.MaxTime/1000, 0)
 		if time.Now().After(maxTime.Add(retentionDuration)) {
 			level.Info(logger).Log("msg", "applying retention: marking block for deletion", "id", id, "maxTime", maxTime.String())
-			if err := block.MarkForDeletion(ctx, logger, bkt, id, fmt.Sprintf("block exceeding retention of %v", retentionDuration), blocksMarkedForDeletion); err != nil {
+			reason := fmt.Sprintf("block exceeding retention of %v", retentionDuration)
+			if err := auditLog.Record(ctx, AuditRecord{Action: AuditActionRetention, Reason: reason, Sources: []ulid.ULID{id}}); err != nil {
+				return errors.Wrap(err, "write retention audit record")
+			}
+			if err := block.MarkForDeletion(ctx, logger, bkt, id, reason, blocksMarkedForDeletion); err != nil {
 				return errors.Wrap(err, "delete block")
 			}
 		}
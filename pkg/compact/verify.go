@@ -0,0 +1,150 @@
+// Copyright (c) The Thanos Authors.
+// Licensed under the Apache License 2.0.
+
+package compact
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/go-kit/log"
+	"github.com/go-kit/log/level"
+	"github.com/oklog/ulid"
+	"github.com/pkg/errors"
+	"github.com/prometheus/prometheus/model/labels"
+	"github.com/prometheus/prometheus/tsdb"
+	"github.com/prometheus/prometheus/tsdb/chunks"
+	"github.com/thanos-io/objstore"
+
+	"github.com/thanos-io/thanos/pkg/block"
+	"github.com/thanos-io/thanos/pkg/block/metadata"
+	"github.com/thanos-io/thanos/pkg/compact/downsample"
+	"github.com/thanos-io/thanos/pkg/runutil"
+)
+
+// verifyCompactedBlocks verifies the blocks resulting from compacting the given source blocks as stored in the bucket.
+// If any of them fails verification, all of them are deleted from the bucket and a halt error is returned, so the
+// source blocks are kept and compaction of the group does not proceed.
+func (cg *Group) verifyCompactedBlocks(ctx context.Context, dir string, sources []*metadata.Meta, compIDs []ulid.ULID, overlappingBlocks bool) error {
+	err := func() error {
+		var samples uint64
+		for _, compID := range compIDs {
+			meta, err := cg.verifyCompactedBlock(ctx, dir, compID)
+			if err != nil {
+				return errors.Wrapf(err, "verify compacted block %s", compID)
+			}
+			samples += meta.Stats.NumSamples
+		}
+
+		// Without overlaps no samples are merged, so all samples of the sources have to be present.
+		if overlappingBlocks {
+			return nil
+		}
+		var expected uint64
+		for _, m := range sources {
+			expected += m.Stats.NumSamples
+		}
+		if samples != expected {
+			return errors.Errorf("compacted blocks %v have %d samples, source blocks have %d", compIDs, samples, expected)
+		}
+		return nil
+	}()
+	if err == nil {
+		return nil
+	}
+
+	cg.compactionVerificationFailures.Inc()
+	level.Error(cg.logger).Log("msg", "compacted blocks failed verification; deleting them and keeping source blocks", "result_blocks", fmt.Sprintf("%v", compIDs), "err", err)
+
+	// Spawn a new context so we always delete the compacted blocks in full on shutdown.
+	delCtx, cancel := context.WithTimeout(context.Background(), 5*time.Minute)
+	defer cancel()
+	for _, compID := range compIDs {
+		if derr := block.Delete(delCtx, cg.logger, cg.bkt, compID); derr != nil {
+			level.Warn(cg.logger).Log("msg", "failed to delete compacted block which failed verification", "result_block", compID, "err", derr)
+		}
+	}
+	return halt(err)
+}
+
+// verifyCompactedBlock downloads the given compacted block from the bucket into dir, re-opens it and
+// checks that its index is healthy and that the series and samples it contains match its meta.json.
+// It returns the verified meta on success.
+func (cg *Group) verifyCompactedBlock(ctx context.Context, dir string, id ulid.ULID) (_ *metadata.Meta, err error) {
+	bdir := filepath.Join(dir, "verify", id.String())
+	defer func() {
+		if rerr := os.RemoveAll(bdir); rerr != nil && err == nil {
+			err = errors.Wrap(rerr, "remove verified block dir")
+		}
+	}()
+
+	if err := block.Download(ctx, cg.logger, cg.bkt, id, bdir, objstore.WithFetchConcurrency(cg.blockFilesConcurrency)); err != nil {
+		return nil, errors.Wrap(err, "download")
+	}
+	meta, err := metadata.ReadFromDir(bdir)
+	if err != nil {
+		return nil, errors.Wrap(err, "read meta")
+	}
+
+	stats, err := block.GatherIndexHealthStats(ctx, cg.logger, filepath.Join(bdir, block.IndexFilename), meta.MinTime, meta.MaxTime)
+	if err != nil {
+		return nil, errors.Wrap(err, "gather index issues")
+	}
+	if cg.acceptMalformedIndex {
+		err = stats.CriticalErr()
+	} else {
+		err = stats.AnyErr()
+	}
+	if err != nil {
+		return nil, errors.Wrap(err, "unhealthy index")
+	}
+	if uint64(stats.TotalSeries) != meta.Stats.NumSeries {
+		return nil, errors.Errorf("index has %d series, meta.json expects %d", stats.TotalSeries, meta.Stats.NumSeries)
+	}
+
+	series, samples, err := countSeriesAndSamples(ctx, cg.logger, bdir)
+	if err != nil {
+		return nil, errors.Wrap(err, "read block")
+	}
+	if series != meta.Stats.NumSeries {
+		return nil, errors.Errorf("read %d series, meta.json expects %d", series, meta.Stats.NumSeries)
+	}
+	if samples != meta.Stats.NumSamples {
+		return nil, errors.Errorf("read %d samples, meta.json expects %d", samples, meta.Stats.NumSamples)
+	}
+	return meta, nil
+}
+
+// countSeriesAndSamples reads all series of the block in bdir and returns the number of series and samples. Samples are
+// counted per chunk, as when the block was written, which counts the samples aggregated into downsampled chunks.
+func countSeriesAndSamples(ctx context.Context, logger log.Logger, bdir string) (series, samples uint64, err error) {
+	b, err := tsdb.OpenBlock(logger, bdir, downsample.NewPool())
+	if err != nil {
+		return 0, 0, errors.Wrap(err, "open block")
+	}
+	defer runutil.CloseWithErrCapture(&err, b, "block")
+
+	q, err := tsdb.NewBlockChunkQuerier(b, math.MinInt64, math.MaxInt64)
+	if err != nil {
+		return 0, 0, errors.Wrap(err, "create querier")
+	}
+	defer runutil.CloseWithErrCapture(&err, q, "querier")
+
+	ss := q.Select(ctx, false, nil, labels.MustNewMatcher(labels.MatchRegexp, labels.MetricName, ".*"))
+	var it chunks.Iterator
+	for ss.Next() {
+		series++
+		it = ss.At().Iterator(it)
+		for it.Next() {
+			samples += uint64(it.At().Chunk.NumSamples())
+		}
+		if err := it.Err(); err != nil {
+			return 0, 0, errors.Wrapf(err, "iterate series %s", ss.At().Labels())
+		}
+	}
+	return series, samples, ss.Err()
+}
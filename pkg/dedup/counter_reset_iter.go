@@ -0,0 +1,182 @@
+// Copyright (c) The Thanos Authors.
+// Licensed under the Apache License 2.0.
+
+package dedup
+
+import (
+	"math"
+
+	"github.com/prometheus/prometheus/model/histogram"
+	"github.com/prometheus/prometheus/tsdb/chunkenc"
+)
+
+// counterResetDedupSeriesIterator deduplicates replicas of a counter like dedupSeriesIterator, but avoids
+// counter resets introduced by replicas restarting at different times.
+//
+// When the next sample of the selected replica is lower than the last returned value, the iterator looks for
+// another replica having a sample within the window which continues the counter monotonically, and switches
+// to it instead of returning the reset. Let's consider the following example:
+//
+// Replica 1 counter scrapes: 20    30    40    0     10    20
+// Replica 2 counter scrapes:    25    35    45    55    65    75
+//
+// The original algorithm keeps returning replica 1, so rate() sees the reset and accounts for it as an
+// increase by 40 which never happened in replica 2. With a window of at least one scrape interval, this iterator
+// switches to replica 2 instead when replica 1 restarts. Resets seen by all replicas within the window are
+// returned as is.
+//
+// This is heuristic and more expensive than dedupSeriesIterator as all replicas are advanced together, so it
+// is only used if enabled, see WithCounterResetWindow.
+type counterResetDedupSeriesIterator struct {
+	replicas []adjustableSeriesIterator
+	vals     []chunkenc.ValueType
+	// pens are the penalties added to the next seek against every replica, see dedupSeriesIterator.
+	pens   []int64
+	window int64
+
+	// cur is the index of the replica of the current sample, -1 before the first sample.
+	cur       int
+	lastT     int64
+	lastV     float64
+	lastFloat bool
+}
+
+func newCounterResetDedupSeriesIterator(window int64, replicas ...adjustableSeriesIterator) *counterResetDedupSeriesIterator {
+	it := &counterResetDedupSeriesIterator{
+		replicas: replicas,
+		vals:     make([]chunkenc.ValueType, len(replicas)),
+		pens:     make([]int64, len(replicas)),
+		window:   window,
+		cur:      -1,
+		lastT:    math.MinInt64,
+	}
+	for i, r := range replicas {
+		it.vals[i] = r.Next()
+	}
+	return it
+}
+
+func (it *counterResetDedupSeriesIterator) Next() chunkenc.ValueType {
+	for i, r := range it.replicas {
+		if it.vals[i] != chunkenc.ValNone {
+			it.vals[i] = r.Seek(it.lastT + 1)
+		}
+	}
+
+	pick := -1
+	if it.cur != -1 && it.lastFloat && it.vals[it.cur] == chunkenc.ValFloat {
+		if _, v := it.replicas[it.cur].At(); v < it.lastV {
+			// The current replica reset. Look for another one continuing the counter before applying
+			// penalties, as they could skip the samples we are looking for.
+			if alt := it.monotonicReplica(it.cur); alt != it.cur {
+				pick = alt
+			}
+		}
+	}
+	if pick == -1 {
+		// Advance all replicas to at least the next highest timestamp plus their penalty and pick
+		// the one with the smallest timestamp, preferring the current one on ties.
+		for i, r := range it.replicas {
+			if it.vals[i] != chunkenc.ValNone {
+				it.vals[i] = r.Seek(it.lastT + 1 + it.pens[i])
+			}
+		}
+		for i, r := range it.replicas {
+			if it.vals[i] == chunkenc.ValNone {
+				continue
+			}
+			if pick == -1 || r.AtT() < it.replicas[pick].AtT() || (r.AtT() == it.replicas[pick].AtT() && i == it.cur) {
+				pick = i
+			}
+		}
+		if pick == -1 {
+			return chunkenc.ValNone
+		}
+	}
+
+	t := it.replicas[pick].AtT()
+	if pick != it.cur && it.lastFloat && it.vals[pick] == chunkenc.ValFloat {
+		// We switched replicas, make sure the new one does not continue with an obsolete value.
+		it.replicas[pick].adjustAtValue(it.lastV)
+	}
+
+	// For the replicas we didn't pick, add a penalty twice as high as the delta of the last two samples
+	// to the next seek against them, like dedupSeriesIterator does.
+	const initialPenalty = 5000
+	for i := range it.pens {
+		switch {
+		case i == pick:
+			it.pens[i] = 0
+		case it.lastT != math.MinInt64:
+			it.pens[i] = 2 * (t - it.lastT)
+		default:
+			it.pens[i] = initialPenalty
+		}
+	}
+
+	it.cur = pick
+	it.lastT = t
+	it.lastFloat = it.vals[pick] == chunkenc.ValFloat
+	if it.lastFloat {
+		_, it.lastV = it.replicas[pick].At()
+	}
+	return it.vals[pick]
+}
+
+// monotonicReplica returns the replica with the earliest sample within the window after the sample of the
+// resetting replica which does not go below the last returned value, or the resetting replica if none does.
+func (it *counterResetDedupSeriesIterator) monotonicReplica(resetting int) int {
+	maxT := it.replicas[resetting].AtT() + it.window
+	pick := resetting
+	for i, r := range it.replicas {
+		if i == resetting || it.vals[i] != chunkenc.ValFloat {
+			continue
+		}
+		t, v := r.At()
+		if t > maxT || v < it.lastV {
+			continue
+		}
+		if pick == resetting || t < it.replicas[pick].AtT() {
+			pick = i
+		}
+	}
+	return pick
+}
+
+func (it *counterResetDedupSeriesIterator) Seek(t int64) chunkenc.ValueType {
+	// Don't use underlying Seek, but iterate over next to not miss gaps.
+	if it.cur == -1 && it.Next() == chunkenc.ValNone {
+		return chunkenc.ValNone
+	}
+	for it.AtT() < t {
+		if it.Next() == chunkenc.ValNone {
+			return chunkenc.ValNone
+		}
+	}
+	return it.vals[it.cur]
+}
+
+func (it *counterResetDedupSeriesIterator) At() (int64, float64) {
+	return it.replicas[it.cur].At()
+}
+
+func (it *counterResetDedupSeriesIterator) AtHistogram(h *histogram.Histogram) (int64, *histogram.Histogram) {
+	return it.replicas[it.cur].AtHistogram(h)
+}
+
+func (it *counterResetDedupSeriesIterator) AtFloatHistogram(fh *histogram.FloatHistogram) (int64, *histogram.FloatHistogram) {
+	return it.replicas[it.cur].AtFloatHistogram(fh)
+}
+
+func (it *counterResetDedupSeriesIterator) AtT() int64 {
+	return it.replicas[it.cur].AtT()
+}
+
+func (it *counterResetDedupSeriesIterator) Err() error {
+	for _, r := range it.replicas {
+		if err := r.Err(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
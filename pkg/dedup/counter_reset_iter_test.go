@@ -0,0 +1,105 @@
+// Copyright (c) The Thanos Authors.
+// Licensed under the Apache License 2.0.
+
+package dedup
+
+import (
+	"testing"
+	"time"
+
+	"github.com/prometheus/prometheus/model/labels"
+
+	"github.com/efficientgo/core/testutil"
+)
+
+func TestCounterResetDedupSeriesIterator(t *testing.T) {
+	for _, tcase := range []struct {
+		name     string
+		replicas [][]sample
+		window   int64
+		exp      []sample
+	}{
+		{
+			name: "prefer the replica continuing the counter",
+			replicas: [][]sample{
+				{{0, 20}, {10000, 30}, {20000, 40}, {30000, 0}, {40000, 10}, {50000, 20}},
+				{{5000, 25}, {15000, 35}, {25000, 45}, {35000, 55}, {45000, 65}, {55000, 75}},
+			},
+			window: 10000,
+			exp:    []sample{{0, 20}, {10000, 30}, {20000, 40}, {25000, 45}, {35000, 55}, {45000, 65}, {55000, 75}},
+		},
+		{
+			name: "resets of all replicas are kept",
+			replicas: [][]sample{
+				{{0, 20}, {10000, 30}, {20000, 40}, {30000, 0}, {40000, 10}},
+				{{5000, 25}, {15000, 35}, {25000, 0}, {35000, 5}, {45000, 15}},
+			},
+			window: 10000,
+			exp:    []sample{{0, 20}, {10000, 30}, {20000, 40}, {30000, 0}, {40000, 10}},
+		},
+		{
+			name: "replicas continuing the counter out of the window are ignored",
+			replicas: [][]sample{
+				{{0, 20}, {10000, 30}, {20000, 40}, {30000, 0}, {40000, 10}},
+				{{0, 20}, {10000, 30}, {50000, 70}},
+			},
+			window: 10000,
+			exp:    []sample{{0, 20}, {10000, 30}, {20000, 40}, {30000, 0}, {40000, 10}},
+		},
+		{
+			name: "switch to the replica with the earliest continuing sample",
+			replicas: [][]sample{
+				{{10000, 10}, {20000, 20}, {30000, 0}, {40000, 10}},
+				{{10000, 10}, {20000, 20}, {38000, 40}, {48000, 50}},
+				{{10000, 10}, {20000, 20}, {33000, 30}, {43000, 40}},
+			},
+			window: 10000,
+			exp:    []sample{{10000, 10}, {20000, 20}, {33000, 30}, {43000, 40}},
+		},
+		{
+			name: "adjust obsolete values when switching replicas on gaps",
+			replicas: [][]sample{
+				{{10000, 10}, {20000, 20}, {30000, 30}},
+				{{10100, 5}, {20100, 10}, {30100, 15}, {40100, 20}, {50100, 25}, {60100, 35}},
+			},
+			window: 10000,
+			exp:    []sample{{10000, 10}, {20000, 20}, {30000, 30}, {50100, 30}, {60100, 40}},
+		},
+	} {
+		t.Run(tcase.name, func(t *testing.T) {
+			replicas := make([]adjustableSeriesIterator, 0, len(tcase.replicas))
+			for _, r := range tcase.replicas {
+				replicas = append(replicas, &counterErrAdjustSeriesIterator{Iterator: newMockedSeriesIterator(r)})
+			}
+			it := newCounterResetDedupSeriesIterator(tcase.window, replicas...)
+			testutil.Equals(t, tcase.exp, expandSeries(t, noopAdjustableSeriesIterator{it}))
+		})
+	}
+}
+
+func TestDedupSeriesSet_CounterResetWindow(t *testing.T) {
+	input := []series{
+		{
+			lset:    labels.FromStrings("a", "1"),
+			samples: []sample{{0, 20}, {10000, 30}, {20000, 40}, {30000, 0}, {40000, 10}},
+		}, {
+			lset:    labels.FromStrings("a", "1"),
+			samples: []sample{{5000, 25}, {15000, 35}, {25000, 45}, {35000, 55}, {45000, 65}},
+		},
+	}
+	dedupSamples := func(f string, opts ...SeriesSetOption) []sample {
+		dedupSet := NewSeriesSet(&mockedSeriesSet{series: input}, f, opts...)
+		testutil.Assert(t, dedupSet.Next())
+		res := expandSeries(t, dedupSet.At().Iterator(nil))
+		testutil.Assert(t, !dedupSet.Next())
+		return res
+	}
+
+	smoothed := []sample{{0, 20}, {10000, 30}, {20000, 40}, {25000, 45}, {35000, 55}, {45000, 65}}
+	testutil.Equals(t, smoothed, dedupSamples("rate", WithCounterResetWindow(10*time.Second)))
+
+	// Only counters are affected, and only when enabled.
+	reset := []sample{{0, 20}, {10000, 30}, {20000, 40}, {30000, 0}, {40000, 10}}
+	testutil.Equals(t, reset, dedupSamples("", WithCounterResetWindow(10*time.Second)))
+	testutil.Equals(t, reset, dedupSamples("rate"))
+}
@@ -5,6 +5,7 @@ package dedup
 
 import (
 	"math"
+	"time"
 
 	"github.com/prometheus/prometheus/model/histogram"
 	"github.com/prometheus/prometheus/model/labels"
@@ -26,6 +27,13 @@ type dedupSeriesSet struct {
 	ok   bool
 
 	f string
+	// policy deduplicates the replicas of a series.
+	policy Policy
+
+	counterResetWindow int64
+
+	// strict is nil unless the consistency of replicas is checked.
+	strict *strictDedup
 }
 
 // isCounter deduces whether a counter metric has been passed. There must be
@@ -100,11 +108,30 @@ func (o *overlapSplitSet) Err() error {
 	return o.set.Err()
 }
 
+// SeriesSetOption configures the deduplication done by the series set returned by NewSeriesSet.
+type SeriesSetOption func(s *dedupSeriesSet)
+
+// WithCounterResetWindow makes the deduplication of counters avoid counter resets seen by a single replica,
+// by switching to another replica continuing the counter within the given window, see
+// counterResetDedupSeriesIterator. 0 disables it.
+func WithCounterResetWindow(window time.Duration) SeriesSetOption {
+	return func(s *dedupSeriesSet) {
+		s.counterResetWindow = window.Milliseconds()
+	}
+}
+
 // NewSeriesSet returns seriesSet that deduplicates the same series.
 // The series in series set are expected be sorted by all labels.
-func NewSeriesSet(set storage.SeriesSet, f string) storage.SeriesSet {
+func NewSeriesSet(set storage.SeriesSet, f string, opts ...SeriesSetOption) storage.SeriesSet {
+	return newSeriesSet(set, f, PolicyPenalty, opts...)
+}
+
+func newSeriesSet(set storage.SeriesSet, f string, policy Policy, opts ...SeriesSetOption) storage.SeriesSet {
 	// TODO: remove dependency on knowing whether it is a counter.
-	s := &dedupSeriesSet{set: set, isCounter: isCounter(f), f: f}
+	s := &dedupSeriesSet{set: set, isCounter: isCounter(f), f: f, policy: policy}
+	for _, opt := range opts {
+		opt(s)
+	}
 	s.ok = s.set.Next()
 	if s.ok {
 		s.peek = s.set.At()
@@ -122,7 +149,13 @@ func (s *dedupSeriesSet) Next() bool {
 	s.lset = s.peek.Labels()
 	s.replicas = append(s.replicas[:0], s.peek)
 
-	return s.next()
+	if !s.next() {
+		return false
+	}
+	if s.strict != nil && len(s.replicas) > 1 {
+		s.strict.check(s.lset, s.replicas)
+	}
+	return true
 }
 
 func (s *dedupSeriesSet) next() bool {
@@ -154,7 +187,12 @@ func (s *dedupSeriesSet) At() storage.Series {
 	repl := make([]storage.Series, len(s.replicas))
 	copy(repl, s.replicas)
 
-	return newDedupSeries(s.lset, repl, s.f)
+	if s.policy == PolicyChain {
+		return &chainSeries{lset: s.lset, replicas: repl}
+	}
+	ds := newDedupSeries(s.lset, repl, s.f)
+	ds.counterResetWindow = s.counterResetWindow
+	return ds
 }
 
 func (s *dedupSeriesSet) Err() error {
@@ -162,7 +200,11 @@ func (s *dedupSeriesSet) Err() error {
 }
 
 func (s *dedupSeriesSet) Warnings() annotations.Annotations {
-	return s.set.Warnings()
+	if s.strict == nil || s.strict.inconsistent == 0 {
+		return s.set.Warnings()
+	}
+	warns := annotations.New().Merge(s.set.Warnings())
+	return warns.Add(s.strict.warning())
 }
 
 type seriesWithLabels struct {
@@ -178,6 +220,10 @@ type dedupSeries struct {
 
 	isCounter bool
 	f         string
+
+	// counterResetWindow is the window within which another replica can continue a counter resetting in
+	// the current replica, 0 if counters are deduplicated like other series.
+	counterResetWindow int64
 }
 
 func newDedupSeries(lset labels.Labels, replicas []storage.Series, f string) *dedupSeries {
@@ -189,6 +235,10 @@ func (s *dedupSeries) Labels() labels.Labels {
 }
 
 func (s *dedupSeries) Iterator(_ chunkenc.Iterator) chunkenc.Iterator {
+	if s.isCounter && s.counterResetWindow > 0 {
+		return s.counterResetIterator()
+	}
+
 	var it adjustableSeriesIterator
 	if s.isCounter {
 		it = &counterErrAdjustSeriesIterator{Iterator: s.replicas[0].Iterator(nil)}
@@ -209,6 +259,14 @@ func (s *dedupSeries) Iterator(_ chunkenc.Iterator) chunkenc.Iterator {
 	return it
 }
 
+func (s *dedupSeries) counterResetIterator() chunkenc.Iterator {
+	replicas := make([]adjustableSeriesIterator, 0, len(s.replicas))
+	for _, o := range s.replicas {
+		replicas = append(replicas, &counterErrAdjustSeriesIterator{Iterator: o.Iterator(nil)})
+	}
+	return newCounterResetDedupSeriesIterator(s.counterResetWindow, replicas...)
+}
+
 // adjustableSeriesIterator iterates over the data of a time series and allows to adjust current value based on
 // given lastValue iterated.
 type adjustableSeriesIterator interface {
@@ -0,0 +1,278 @@
+// Copyright (c) The Thanos Authors.
+// Licensed under the Apache License 2.0.
+
+package dedup
+
+import (
+	"sort"
+	"strings"
+
+	"github.com/pkg/errors"
+	"github.com/prometheus/prometheus/model/histogram"
+	"github.com/prometheus/prometheus/model/labels"
+	"github.com/prometheus/prometheus/storage"
+	"github.com/prometheus/prometheus/tsdb/chunkenc"
+	"github.com/prometheus/prometheus/util/annotations"
+)
+
+// Policy is the algorithm deduplicating the replicas of a series within a Scope.
+type Policy string
+
+const (
+	// PolicyPenalty picks the samples of a single replica at a time, switching to another replica when the current
+	// one has a gap. It suits replicas ingesting the same data independently, e.g. Prometheus HA pairs, and is the
+	// deduplication done by queries without scopes.
+	PolicyPenalty Policy = "penalty"
+	// PolicyChain merges the samples of all replicas, keeping the sample of the first replica in label order for
+	// timestamps present in several replicas. It suits exact copies of the same data, e.g. copies kept for disaster
+	// recovery, for which it fills the gaps of every copy.
+	PolicyChain Policy = "chain"
+)
+
+// Scope is a group of replica labels deduplicated together with the same policy.
+type Scope struct {
+	Policy        Policy
+	ReplicaLabels []string
+}
+
+// ParseScope parses a scope in the <policy>:<replica label>[,<replica label>...] format, e.g. chain:source_cluster.
+func ParseScope(s string) (Scope, error) {
+	policy, names, ok := strings.Cut(s, ":")
+	if !ok {
+		return Scope{}, errors.Errorf("invalid deduplication scope %q, expected <policy>:<replica label>[,<replica label>...]", s)
+	}
+	scope := Scope{Policy: Policy(policy)}
+	switch scope.Policy {
+	case PolicyPenalty, PolicyChain:
+	default:
+		return Scope{}, errors.Errorf("invalid policy %q of deduplication scope %q, expected %s or %s", policy, s, PolicyPenalty, PolicyChain)
+	}
+	for _, name := range strings.Split(names, ",") {
+		if name = strings.TrimSpace(name); name == "" {
+			return Scope{}, errors.Errorf("empty replica label in deduplication scope %q", s)
+		}
+		scope.ReplicaLabels = append(scope.ReplicaLabels, name)
+	}
+	return scope, nil
+}
+
+// ValidateScopes checks that the replica labels of scopes are replica labels, and that no replica label belongs to
+// several scopes.
+func ValidateScopes(scopes []Scope, replicaLabels []string) error {
+	scoped := map[string]struct{}{}
+	for _, s := range scopes {
+		for _, name := range s.ReplicaLabels {
+			if !contains(replicaLabels, name) {
+				return errors.Errorf("label %s of deduplication scope %s is not a replica label", name, s)
+			}
+			if _, ok := scoped[name]; ok {
+				return errors.Errorf("replica label %s belongs to several deduplication scopes", name)
+			}
+			scoped[name] = struct{}{}
+		}
+	}
+	return nil
+}
+
+func (s Scope) String() string {
+	return string(s.Policy) + ":" + strings.Join(s.ReplicaLabels, ",")
+}
+
+// EffectiveScopes returns the scopes deduplicating series along replicaLabels, in the order they are applied.
+//
+// Replica labels not belonging to any scope are deduplicated first, together and with PolicyPenalty as without
+// scopes, followed by scopes in order. Scopes are restricted to replicaLabels, which can be overridden per query, and
+// scopes without any of them are skipped. The first scope is the one whose replica labels stores are asked to remove,
+// see storepb.SeriesRequest.WithoutReplicaLabels.
+func EffectiveScopes(scopes []Scope, replicaLabels []string) []Scope {
+	if len(replicaLabels) == 0 {
+		return nil
+	}
+	var (
+		effective = []Scope{{Policy: PolicyPenalty}}
+		scoped    = map[string]struct{}{}
+	)
+	for _, s := range scopes {
+		restricted := Scope{Policy: s.Policy}
+		for _, name := range s.ReplicaLabels {
+			scoped[name] = struct{}{}
+			if contains(replicaLabels, name) {
+				restricted.ReplicaLabels = append(restricted.ReplicaLabels, name)
+			}
+		}
+		if len(restricted.ReplicaLabels) > 0 {
+			effective = append(effective, restricted)
+		}
+	}
+	for _, name := range replicaLabels {
+		if _, ok := scoped[name]; !ok {
+			effective[0].ReplicaLabels = append(effective[0].ReplicaLabels, name)
+		}
+	}
+	if len(effective[0].ReplicaLabels) == 0 {
+		return effective[1:]
+	}
+	return effective
+}
+
+func contains(names []string, name string) bool {
+	for _, n := range names {
+		if n == name {
+			return true
+		}
+	}
+	return false
+}
+
+// NewScopedSeriesSet returns a series set deduplicating the series of set scope by scope. The replicas of every
+// scope are deduplicated with the policy of the scope, and the result is deduplicated along the next scope.
+//
+// The series of set are expected to be sorted by labels, without the replica labels of the first scope, as returned by
+// stores for storepb.SeriesRequest.WithoutReplicaLabels. The series are buffered and sorted again for every other
+// scope, and the replicas of a series are always deduplicated in the order of their labels, so the result is
+// deterministic.
+func NewScopedSeriesSet(set storage.SeriesSet, f string, scopes []Scope, opts ...SeriesSetOption) storage.SeriesSet {
+	if len(scopes) == 0 {
+		return NewSeriesSet(set, f, opts...)
+	}
+	set = newSeriesSet(set, f, scopes[0].Policy, opts...)
+	for _, s := range scopes[1:] {
+		set = newSeriesSet(&withoutLabelsSeriesSet{set: set, names: s.ReplicaLabels}, f, s.Policy, opts...)
+	}
+	return set
+}
+
+// withoutLabelsSeriesSet removes the given labels from the series of set, and sorts them again. Series are sorted
+// stably, so the replicas of a series keep the order of their labels.
+type withoutLabelsSeriesSet struct {
+	set   storage.SeriesSet
+	names []string
+
+	loaded bool
+	series []storage.Series
+	curr   int
+}
+
+func (s *withoutLabelsSeriesSet) load() {
+	s.loaded = true
+	for s.set.Next() {
+		series := s.set.At()
+		s.series = append(s.series, seriesWithLabels{Series: series, lset: labels.NewBuilder(series.Labels()).Del(s.names...).Labels()})
+	}
+	sort.SliceStable(s.series, func(i, j int) bool {
+		return labels.Compare(s.series[i].Labels(), s.series[j].Labels()) < 0
+	})
+	s.curr = -1
+}
+
+func (s *withoutLabelsSeriesSet) Next() bool {
+	if !s.loaded {
+		s.load()
+	}
+	if s.curr+1 >= len(s.series) {
+		return false
+	}
+	s.curr++
+	return true
+}
+
+func (s *withoutLabelsSeriesSet) At() storage.Series { return s.series[s.curr] }
+
+func (s *withoutLabelsSeriesSet) Err() error { return s.set.Err() }
+
+func (s *withoutLabelsSeriesSet) Warnings() annotations.Annotations { return s.set.Warnings() }
+
+// chainSeries merges the samples of its replicas, see PolicyChain.
+type chainSeries struct {
+	lset     labels.Labels
+	replicas []storage.Series
+}
+
+func (s *chainSeries) Labels() labels.Labels { return s.lset }
+
+func (s *chainSeries) Iterator(_ chunkenc.Iterator) chunkenc.Iterator {
+	it := &chainSeriesIterator{
+		iters: make([]chunkenc.Iterator, 0, len(s.replicas)),
+		vals:  make([]chunkenc.ValueType, len(s.replicas)),
+		curr:  -1,
+	}
+	for _, r := range s.replicas {
+		it.iters = append(it.iters, r.Iterator(nil))
+	}
+	return it
+}
+
+// chainSeriesIterator iterates over the samples of all replicas in timestamp order. Of the samples of several replicas
+// with the same timestamp, the sample of the first replica is returned, and the others are skipped.
+type chainSeriesIterator struct {
+	iters []chunkenc.Iterator
+	// vals are the value types of the current samples of iters, chunkenc.ValNone once exhausted.
+	vals []chunkenc.ValueType
+	// curr is the index of the iterator of the current sample, -1 before the first sample.
+	curr  int
+	lastT int64
+}
+
+func (it *chainSeriesIterator) Next() chunkenc.ValueType {
+	for i, iter := range it.iters {
+		if it.curr < 0 || (it.vals[i] != chunkenc.ValNone && iter.AtT() == it.lastT) {
+			it.vals[i] = iter.Next()
+		}
+	}
+	return it.pick()
+}
+
+func (it *chainSeriesIterator) Seek(t int64) chunkenc.ValueType {
+	if it.curr >= 0 && it.vals[it.curr] != chunkenc.ValNone && it.lastT >= t {
+		return it.vals[it.curr]
+	}
+	for i, iter := range it.iters {
+		if it.curr < 0 || (it.vals[i] != chunkenc.ValNone && iter.AtT() < t) {
+			it.vals[i] = iter.Seek(t)
+		}
+	}
+	return it.pick()
+}
+
+// pick makes the earliest sample of all iterators the current one.
+func (it *chainSeriesIterator) pick() chunkenc.ValueType {
+	it.curr = 0
+	for i, iter := range it.iters {
+		if it.vals[i] == chunkenc.ValNone {
+			continue
+		}
+		if it.vals[it.curr] == chunkenc.ValNone || iter.AtT() < it.iters[it.curr].AtT() {
+			it.curr = i
+		}
+	}
+	if it.vals[it.curr] == chunkenc.ValNone {
+		return chunkenc.ValNone
+	}
+	it.lastT = it.iters[it.curr].AtT()
+	return it.vals[it.curr]
+}
+
+func (it *chainSeriesIterator) At() (int64, float64) {
+	return it.iters[it.curr].At()
+}
+
+func (it *chainSeriesIterator) AtHistogram(h *histogram.Histogram) (int64, *histogram.Histogram) {
+	return it.iters[it.curr].AtHistogram(h)
+}
+
+func (it *chainSeriesIterator) AtFloatHistogram(fh *histogram.FloatHistogram) (int64, *histogram.FloatHistogram) {
+	return it.iters[it.curr].AtFloatHistogram(fh)
+}
+
+func (it *chainSeriesIterator) AtT() int64 {
+	return it.iters[it.curr].AtT()
+}
+
+func (it *chainSeriesIterator) Err() error {
+	for _, iter := range it.iters {
+		if err := iter.Err(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,144 @@
+// Copyright (c) The Thanos Authors.
+// Licensed under the Apache License 2.0.
+
+package dedup
+
+import (
+	"testing"
+
+	"github.com/efficientgo/core/testutil"
+	"github.com/prometheus/prometheus/model/labels"
+	"github.com/prometheus/prometheus/tsdb/chunkenc"
+)
+
+func TestParseScope(t *testing.T) {
+	s, err := ParseScope("chain:source_cluster, region")
+	testutil.Ok(t, err)
+	testutil.Equals(t, Scope{Policy: PolicyChain, ReplicaLabels: []string{"source_cluster", "region"}}, s)
+	testutil.Equals(t, "chain:source_cluster,region", s.String())
+
+	for _, invalid := range []string{"source_cluster", "merge:source_cluster", "penalty:", "penalty:a,,b"} {
+		_, err := ParseScope(invalid)
+		testutil.NotOk(t, err, invalid)
+	}
+}
+
+func TestValidateScopes(t *testing.T) {
+	replicaLabels := []string{"prometheus_replica", "source_cluster", "rule_replica"}
+
+	testutil.Ok(t, ValidateScopes([]Scope{{Policy: PolicyChain, ReplicaLabels: []string{"source_cluster"}}}, replicaLabels))
+	testutil.NotOk(t, ValidateScopes([]Scope{{Policy: PolicyChain, ReplicaLabels: []string{"cluster"}}}, replicaLabels))
+	testutil.NotOk(t, ValidateScopes([]Scope{
+		{Policy: PolicyPenalty, ReplicaLabels: []string{"prometheus_replica", "source_cluster"}},
+		{Policy: PolicyChain, ReplicaLabels: []string{"source_cluster"}},
+	}, replicaLabels))
+}
+
+func TestEffectiveScopes(t *testing.T) {
+	scopes := []Scope{
+		{Policy: PolicyPenalty, ReplicaLabels: []string{"prometheus_replica"}},
+		{Policy: PolicyChain, ReplicaLabels: []string{"source_cluster"}},
+	}
+
+	for _, tcase := range []struct {
+		name          string
+		scopes        []Scope
+		replicaLabels []string
+		expected      []Scope
+	}{
+		{
+			name:          "no scopes",
+			replicaLabels: []string{"prometheus_replica", "rule_replica"},
+			expected:      []Scope{{Policy: PolicyPenalty, ReplicaLabels: []string{"prometheus_replica", "rule_replica"}}},
+		},
+		{
+			name:          "all replica labels scoped",
+			scopes:        scopes,
+			replicaLabels: []string{"prometheus_replica", "source_cluster"},
+			expected:      scopes,
+		},
+		{
+			name:          "unscoped replica labels first",
+			scopes:        scopes,
+			replicaLabels: []string{"source_cluster", "rule_replica", "prometheus_replica"},
+			expected: []Scope{
+				{Policy: PolicyPenalty, ReplicaLabels: []string{"rule_replica"}},
+				{Policy: PolicyPenalty, ReplicaLabels: []string{"prometheus_replica"}},
+				{Policy: PolicyChain, ReplicaLabels: []string{"source_cluster"}},
+			},
+		},
+		{
+			name:          "scopes restricted to the replica labels of the query",
+			scopes:        scopes,
+			replicaLabels: []string{"source_cluster"},
+			expected:      []Scope{{Policy: PolicyChain, ReplicaLabels: []string{"source_cluster"}}},
+		},
+		{
+			name:   "no replica labels",
+			scopes: scopes,
+		},
+	} {
+		t.Run(tcase.name, func(t *testing.T) {
+			testutil.Equals(t, tcase.expected, EffectiveScopes(tcase.scopes, tcase.replicaLabels))
+		})
+	}
+}
+
+func TestScopedSeriesSet(t *testing.T) {
+	// Series are replicated by Prometheus HA pairs, whose replica label is removed by stores, and copied to another
+	// cluster for disaster recovery.
+	input := []series{
+		{
+			lset:    labels.FromStrings("a", "1", "source_cluster", "dc1"),
+			samples: []sample{{10000, 1}, {20000, 2}, {30000, 3}},
+		}, {
+			lset:    labels.FromStrings("a", "1", "source_cluster", "dc1"),
+			samples: []sample{{12000, 1}, {22000, 2}},
+		}, {
+			// Sorted between the copies of {a="1"} before removing source_cluster.
+			lset:    labels.FromStrings("a", "1", "source_cluster", "dc1", "z", "1"),
+			samples: []sample{{10000, 1}},
+		}, {
+			lset:    labels.FromStrings("a", "1", "source_cluster", "dc2"),
+			samples: []sample{{20000, 20}, {30000, 30}, {40000, 4}, {50000, 5}},
+		}, {
+			lset:    labels.FromStrings("a", "2", "source_cluster", "dc2"),
+			samples: []sample{{10000, 1}},
+		},
+	}
+	scopes := []Scope{
+		{Policy: PolicyPenalty, ReplicaLabels: []string{"prometheus_replica"}},
+		{Policy: PolicyChain, ReplicaLabels: []string{"source_cluster"}},
+	}
+
+	set := NewScopedSeriesSet(&mockedSeriesSet{series: input}, "", scopes)
+	var res []series
+	for set.Next() {
+		res = append(res, series{lset: set.At().Labels(), samples: expandSeries(t, set.At().Iterator(nil))})
+
+		if labels.Equal(set.At().Labels(), labels.FromStrings("a", "1")) {
+			it := set.At().Iterator(nil)
+			testutil.Equals(t, chunkenc.ValFloat, it.Seek(25000))
+			ts, v := it.At()
+			testutil.Equals(t, sample{30000, 3}, sample{ts, v})
+			testutil.Equals(t, chunkenc.ValFloat, it.Seek(20000))
+			testutil.Equals(t, int64(30000), it.AtT())
+			testutil.Equals(t, chunkenc.ValFloat, it.Next())
+			testutil.Equals(t, int64(40000), it.AtT())
+		}
+	}
+	testutil.Ok(t, set.Err())
+	testutil.Equals(t, []series{
+		{
+			// The copy in dc2 fills the gap of the HA pair of dc1, which wins where both have samples as it sorts first.
+			lset:    labels.FromStrings("a", "1"),
+			samples: []sample{{10000, 1}, {20000, 2}, {30000, 3}, {40000, 4}, {50000, 5}},
+		}, {
+			lset:    labels.FromStrings("a", "1", "z", "1"),
+			samples: []sample{{10000, 1}},
+		}, {
+			lset:    labels.FromStrings("a", "2"),
+			samples: []sample{{10000, 1}},
+		},
+	}, res)
+}
@@ -0,0 +1,124 @@
+// Copyright (c) The Thanos Authors.
+// Licensed under the Apache License 2.0.
+
+package dedup
+
+import (
+	"fmt"
+	"math"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/prometheus/prometheus/model/labels"
+	"github.com/prometheus/prometheus/storage"
+	"github.com/prometheus/prometheus/tsdb/chunkenc"
+)
+
+// maxStrictDedupGap is the longest time between two samples of a replica for which a sample of another replica in
+// between is checked against them. Longer gaps mean that the replica missed data, which is not an inconsistency.
+const maxStrictDedupGap = int64(5 * time.Minute / time.Millisecond)
+
+// WithStrictDedup makes the deduplication report series whose replicas disagree as a warning of the series set,
+// instead of silently picking the samples of one replica.
+//
+// Replicas rarely ingest samples at the same timestamps, e.g. because they scrape at different offsets, so a float
+// sample of a replica is considered consistent if its value is within the values of the samples of another replica
+// directly before and after it, allowing a difference of tolerance relative to those values. Samples at the same
+// timestamp must be equal within the tolerance.
+func WithStrictDedup(tolerance float64) SeriesSetOption {
+	return func(s *dedupSeriesSet) {
+		s.strict = &strictDedup{tolerance: tolerance}
+	}
+}
+
+// strictDedup checks the consistency of the replicas of the series of a series set.
+type strictDedup struct {
+	tolerance float64
+
+	// inconsistent is the number of series whose replicas disagree.
+	inconsistent int
+	// example describes the first disagreement found.
+	example string
+}
+
+// check checks whether the replicas of the series lset agree with each other.
+func (s *strictDedup) check(lset labels.Labels, replicas []storage.Series) {
+	for i := range replicas {
+		for j := range replicas {
+			if i == j {
+				continue
+			}
+			t, v, other, ok := s.disagreement(replicas[i].Iterator(nil), replicas[j].Iterator(nil))
+			if !ok {
+				continue
+			}
+			if s.inconsistent == 0 {
+				s.example = fmt.Sprintf("%s at %s: %g on one replica, %g on another", lset, time.UnixMilli(t).UTC().Format(time.RFC3339Nano), v, other)
+			}
+			s.inconsistent++
+			return
+		}
+	}
+}
+
+// disagreement returns the first float sample of a which is inconsistent with the samples of b around it, along with
+// the value of the next sample of b.
+func (s *strictDedup) disagreement(a, b chunkenc.Iterator) (t int64, v, other float64, ok bool) {
+	var (
+		prevT = int64(math.MinInt64)
+		prevV float64
+	)
+	bval := b.Next()
+	for aval := a.Next(); aval != chunkenc.ValNone; aval = a.Next() {
+		if aval != chunkenc.ValFloat {
+			continue
+		}
+		at, av := a.At()
+		// Stale markers are NaNs as well.
+		if math.IsNaN(av) {
+			continue
+		}
+
+		// Advance b to its first sample at or after the sample of a, remembering the previous float sample.
+		for bval != chunkenc.ValNone && b.AtT() < at {
+			prevT = math.MinInt64
+			if bval == chunkenc.ValFloat {
+				if bt, bv := b.At(); !math.IsNaN(bv) {
+					prevT, prevV = bt, bv
+				}
+			}
+			bval = b.Next()
+		}
+		if bval != chunkenc.ValFloat {
+			continue
+		}
+		nextT, nextV := b.At()
+		if math.IsNaN(nextV) {
+			continue
+		}
+
+		if nextT == at {
+			if !s.within(av, nextV, nextV) {
+				return at, av, nextV, true
+			}
+			continue
+		}
+		if prevT == math.MinInt64 || nextT-prevT > maxStrictDedupGap {
+			continue
+		}
+		if !s.within(av, math.Min(prevV, nextV), math.Max(prevV, nextV)) {
+			return at, av, nextV, true
+		}
+	}
+	return 0, 0, 0, false
+}
+
+// within returns true if v is between lo and hi, allowing a difference of the tolerance relative to them.
+func (s *strictDedup) within(v, lo, hi float64) bool {
+	d := s.tolerance * math.Max(math.Abs(lo), math.Abs(hi))
+	return v >= lo-d && v <= hi+d
+}
+
+func (s *strictDedup) warning() error {
+	return errors.Errorf("strict deduplication: replicas of %d series disagree beyond the tolerance of %g, e.g. %s", s.inconsistent, s.tolerance, s.example)
+}
@@ -0,0 +1,106 @@
+// Copyright (c) The Thanos Authors.
+// Licensed under the Apache License 2.0.
+
+package dedup
+
+import (
+	"math"
+	"testing"
+
+	"github.com/efficientgo/core/testutil"
+	"github.com/prometheus/prometheus/model/labels"
+	"github.com/prometheus/prometheus/model/value"
+)
+
+func TestDedupSeriesSet_StrictDedup(t *testing.T) {
+	for _, tcase := range []struct {
+		name     string
+		replicas [][]sample
+		warning  string
+	}{
+		{
+			name: "equal samples",
+			replicas: [][]sample{
+				{{0, 10}, {15000, 20}, {30000, 30}},
+				{{0, 10}, {15000, 20}, {30000, 30}},
+			},
+		},
+		{
+			name: "offset timestamps of increasing counter",
+			replicas: [][]sample{
+				{{0, 10}, {15000, 20}, {30000, 30}, {45000, 40}},
+				{{4000, 12}, {19000, 23}, {34000, 33}, {49000, 42}},
+			},
+		},
+		{
+			name: "offset timestamps of changing gauge",
+			replicas: [][]sample{
+				{{0, 1}, {15000, 1}, {30000, 0}, {45000, 5}},
+				{{4000, 1}, {19000, 1}, {34000, 0}, {49000, 5}},
+			},
+		},
+		{
+			name: "differences within tolerance",
+			replicas: [][]sample{
+				{{0, 1000}, {15000, 1000}, {30000, 1000}},
+				{{0, 1005}, {15000, 995}, {30000, 1000}},
+			},
+		},
+		{
+			name: "gaps and stale markers are not inconsistencies",
+			replicas: [][]sample{
+				{{0, 10}, {15000, 20}, {30000, math.Float64frombits(value.StaleNaN)}, {400000, 1000}},
+				{{0, 10}, {15000, 20}, {30000, 30}, {45000, 40}, {600000, 0}},
+			},
+		},
+		{
+			name: "different values at the same timestamp",
+			replicas: [][]sample{
+				{{0, 10}, {15000, 20}, {30000, 30}},
+				{{0, 10}, {15000, 25}, {30000, 30}},
+			},
+			warning: `strict deduplication: replicas of 1 series disagree beyond the tolerance of 0.01, e.g. {a="1"} at 1970-01-01T00:00:15Z: 20 on one replica, 25 on another`,
+		},
+		{
+			name: "offset timestamps of diverging replicas",
+			replicas: [][]sample{
+				{{0, 10}, {15000, 20}, {30000, 30}, {45000, 40}},
+				{{4000, 12}, {19000, 23}, {34000, 50}, {49000, 60}},
+			},
+			warning: `strict deduplication: replicas of 1 series disagree beyond the tolerance of 0.01, e.g. {a="1"} at 1970-01-01T00:00:45Z: 40 on one replica, 60 on another`,
+		},
+	} {
+		t.Run(tcase.name, func(t *testing.T) {
+			var input []series
+			for _, r := range tcase.replicas {
+				input = append(input, series{lset: labels.FromStrings("a", "1"), samples: r})
+			}
+			// A series without replicas is never inconsistent.
+			input = append(input, series{lset: labels.FromStrings("a", "2"), samples: []sample{{0, 1}}})
+
+			dedupSet := NewSeriesSet(&mockedSeriesSet{series: input}, "", WithStrictDedup(0.01))
+			for dedupSet.Next() {
+			}
+			testutil.Ok(t, dedupSet.Err())
+
+			warns := dedupSet.Warnings().AsErrors()
+			if tcase.warning == "" {
+				testutil.Equals(t, 0, len(warns))
+				return
+			}
+			testutil.Equals(t, 1, len(warns))
+			testutil.Equals(t, tcase.warning, warns[0].Error())
+		})
+	}
+}
+
+func TestDedupSeriesSet_StrictDedupDisabled(t *testing.T) {
+	input := []series{
+		{lset: labels.FromStrings("a", "1"), samples: []sample{{0, 10}}},
+		{lset: labels.FromStrings("a", "1"), samples: []sample{{0, 20}}},
+	}
+	dedupSet := NewSeriesSet(&mockedSeriesSet{series: input}, "")
+	for dedupSet.Next() {
+	}
+	testutil.Equals(t, 0, len(dedupSet.Warnings()))
+}
@@ -4,6 +4,7 @@
 package extannotations
 
 import (
+	"errors"
 	"strings"
 
 	"github.com/prometheus/prometheus/util/annotations"
@@ -13,3 +14,26 @@ func IsPromQLAnnotation(s string) bool {
 	// We cannot use "errors.Is(w, annotations.PromQLInfo)" here because of gRPC so we use a string as argument
 	return strings.HasPrefix(s, annotations.PromQLInfo.Error()) || strings.HasPrefix(s, annotations.PromQLWarning.Error())
 }
+
+// annotation is a PromQL annotation received as a string, e.g. from a StoreAPI.
+type annotation struct {
+	msg  string
+	kind error
+}
+
+func (a annotation) Error() string { return a.msg }
+
+func (a annotation) Unwrap() error { return a.kind }
+
+// FromString returns the warning received as s over gRPC as an error. PromQL annotations are returned as errors
+// wrapping annotations.PromQLInfo or annotations.PromQLWarning, so that they can be told apart like annotations
+// of the local engine.
+func FromString(s string) error {
+	switch {
+	case strings.HasPrefix(s, annotations.PromQLInfo.Error()):
+		return annotation{msg: s, kind: annotations.PromQLInfo}
+	case strings.HasPrefix(s, annotations.PromQLWarning.Error()):
+		return annotation{msg: s, kind: annotations.PromQLWarning}
+	}
+	return errors.New(s)
+}
@@ -0,0 +1,35 @@
+// Copyright (c) The Thanos Authors.
+// Licensed under the Apache License 2.0.
+
+package extannotations
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/efficientgo/core/testutil"
+	"github.com/prometheus/prometheus/promql/parser/posrange"
+	"github.com/prometheus/prometheus/util/annotations"
+)
+
+func TestFromString(t *testing.T) {
+	info := annotations.NewPossibleNonCounterInfo("up", posrange.PositionRange{})
+	err := FromString(info.Error())
+	testutil.Equals(t, info.Error(), err.Error())
+	testutil.Assert(t, errors.Is(err, annotations.PromQLInfo))
+
+	warning := annotations.NewMixedFloatsHistogramsWarning("up", posrange.PositionRange{})
+	err = FromString(warning.Error())
+	testutil.Equals(t, warning.Error(), err.Error())
+	testutil.Assert(t, errors.Is(err, annotations.PromQLWarning))
+
+	err = FromString("receive series from store: unavailable")
+	testutil.Assert(t, !errors.Is(err, annotations.PromQLInfo) && !errors.Is(err, annotations.PromQLWarning))
+
+	// Annotations received from several stores are deduplicated.
+	var annots annotations.Annotations
+	annots.Add(FromString(info.Error()))
+	annots.Add(FromString(info.Error()))
+	annots.Add(FromString(warning.Error()))
+	testutil.Equals(t, 2, len(annots))
+}
@@ -89,3 +89,14 @@ func StoreClientGRPCOpts(logger log.Logger, reg prometheus.Registerer, tracer op
 	}
 	return append(dialOpts, grpc.WithTransportCredentials(credentials.NewTLS(tlsCfg))), nil
 }
+
+// StoreClientServerNameGRPCOpts creates gRPC dial options connecting to a single store client over TLS with the given
+// server name instead of the one passed to StoreClientGRPCOpts. They have to be applied after the options created by
+// StoreClientGRPCOpts with the same TLS settings.
+func StoreClientServerNameGRPCOpts(logger log.Logger, skipVerify bool, cert, key, caCert, serverName string) ([]grpc.DialOption, error) {
+	tlsCfg, err := tls.NewClientConfig(logger, cert, key, caCert, serverName, skipVerify)
+	if err != nil {
+		return nil, err
+	}
+	return []grpc.DialOption{grpc.WithTransportCredentials(credentials.NewTLS(tlsCfg))}, nil
+}
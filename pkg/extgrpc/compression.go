@@ -0,0 +1,149 @@
+// Copyright (c) The Thanos Authors.
+// Licensed under the Apache License 2.0.
+
+package extgrpc
+
+import (
+	"io"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"google.golang.org/grpc/encoding"
+	"google.golang.org/grpc/encoding/gzip"
+
+	"github.com/thanos-io/thanos/pkg/extgrpc/snappy"
+	"github.com/thanos-io/thanos/pkg/extgrpc/zstd"
+)
+
+// Compressors are the names of the compressors gRPC clients can use. They are registered in every Thanos process, so
+// that servers decompress requests and compress their responses with the compressor chosen by clients.
+var Compressors = []string{gzip.Name, snappy.Name, zstd.Name}
+
+type compressionMetrics struct {
+	uncompressedBytes *prometheus.CounterVec
+	compressedBytes   *prometheus.CounterVec
+	seconds           *prometheus.CounterVec
+}
+
+// InstrumentCompressors replaces the registered Compressors by ones measuring the bytes they compress and
+// decompress, and the time they spend doing so, to evaluate the trade-off between network and CPU usage.
+// It must be called once per process, before any gRPC call.
+func InstrumentCompressors(reg prometheus.Registerer) {
+	m := &compressionMetrics{
+		uncompressedBytes: promauto.With(reg).NewCounterVec(prometheus.CounterOpts{
+			Name: "thanos_grpc_compression_uncompressed_bytes_total",
+			Help: "Total number of bytes of gRPC messages before compression or after decompression, by compressor and operation.",
+		}, []string{"compressor", "operation"}),
+		compressedBytes: promauto.With(reg).NewCounterVec(prometheus.CounterOpts{
+			Name: "thanos_grpc_compression_compressed_bytes_total",
+			Help: "Total number of bytes of gRPC messages after compression or before decompression, by compressor and operation.",
+		}, []string{"compressor", "operation"}),
+		seconds: promauto.With(reg).NewCounterVec(prometheus.CounterOpts{
+			Name: "thanos_grpc_compression_seconds_total",
+			Help: "Total time spent compressing or decompressing gRPC messages, by compressor and operation.",
+		}, []string{"compressor", "operation"}),
+	}
+	for _, name := range Compressors {
+		if c := encoding.GetCompressor(name); c != nil {
+			encoding.RegisterCompressor(newInstrumentedCompressor(c, m))
+		}
+	}
+}
+
+type instrumentedCompressor struct {
+	encoding.Compressor
+
+	compressUncompressed, compressCompressed, compressSeconds       prometheus.Counter
+	decompressUncompressed, decompressCompressed, decompressSeconds prometheus.Counter
+}
+
+func newInstrumentedCompressor(c encoding.Compressor, m *compressionMetrics) *instrumentedCompressor {
+	name := c.Name()
+	return &instrumentedCompressor{
+		Compressor:             c,
+		compressUncompressed:   m.uncompressedBytes.WithLabelValues(name, "compress"),
+		compressCompressed:     m.compressedBytes.WithLabelValues(name, "compress"),
+		compressSeconds:        m.seconds.WithLabelValues(name, "compress"),
+		decompressUncompressed: m.uncompressedBytes.WithLabelValues(name, "decompress"),
+		decompressCompressed:   m.compressedBytes.WithLabelValues(name, "decompress"),
+		decompressSeconds:      m.seconds.WithLabelValues(name, "decompress"),
+	}
+}
+
+func (c *instrumentedCompressor) Compress(w io.Writer) (io.WriteCloser, error) {
+	cw := &countingWriter{Writer: w, counter: c.compressCompressed}
+	start := time.Now()
+	wc, err := c.Compressor.Compress(cw)
+	c.compressSeconds.Add(time.Since(start).Seconds())
+	if err != nil {
+		return nil, err
+	}
+	return &instrumentedWriteCloser{WriteCloser: wc, c: c}, nil
+}
+
+func (c *instrumentedCompressor) Decompress(r io.Reader) (io.Reader, error) {
+	cr := &countingReader{Reader: r, counter: c.decompressCompressed}
+	start := time.Now()
+	dr, err := c.Compressor.Decompress(cr)
+	c.decompressSeconds.Add(time.Since(start).Seconds())
+	if err != nil {
+		return nil, err
+	}
+	return &instrumentedReader{Reader: dr, c: c}, nil
+}
+
+type instrumentedWriteCloser struct {
+	io.WriteCloser
+	c *instrumentedCompressor
+}
+
+func (w *instrumentedWriteCloser) Write(p []byte) (int, error) {
+	start := time.Now()
+	n, err := w.WriteCloser.Write(p)
+	w.c.compressSeconds.Add(time.Since(start).Seconds())
+	w.c.compressUncompressed.Add(float64(n))
+	return n, err
+}
+
+func (w *instrumentedWriteCloser) Close() error {
+	start := time.Now()
+	err := w.WriteCloser.Close()
+	w.c.compressSeconds.Add(time.Since(start).Seconds())
+	return err
+}
+
+type instrumentedReader struct {
+	io.Reader
+	c *instrumentedCompressor
+}
+
+func (r *instrumentedReader) Read(p []byte) (int, error) {
+	start := time.Now()
+	n, err := r.Reader.Read(p)
+	r.c.decompressSeconds.Add(time.Since(start).Seconds())
+	r.c.decompressUncompressed.Add(float64(n))
+	return n, err
+}
+
+type countingWriter struct {
+	io.Writer
+	counter prometheus.Counter
+}
+
+func (w *countingWriter) Write(p []byte) (int, error) {
+	n, err := w.Writer.Write(p)
+	w.counter.Add(float64(n))
+	return n, err
+}
+
+type countingReader struct {
+	io.Reader
+	counter prometheus.Counter
+}
+
+func (r *countingReader) Read(p []byte) (int, error) {
+	n, err := r.Reader.Read(p)
+	r.counter.Add(float64(n))
+	return n, err
+}
@@ -0,0 +1,101 @@
+// Copyright (c) The Thanos Authors.
+// Licensed under the Apache License 2.0.
+
+package extgrpc
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net"
+	"strings"
+	"testing"
+
+	"github.com/efficientgo/core/testutil"
+	"github.com/prometheus/client_golang/prometheus"
+	promtestutil "github.com/prometheus/client_golang/prometheus/testutil"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/encoding"
+	"google.golang.org/grpc/health"
+	"google.golang.org/grpc/health/grpc_health_v1"
+	"google.golang.org/grpc/test/bufconn"
+)
+
+func TestInstrumentedCompressor(t *testing.T) {
+	input := strings.Repeat(`{__name__="up", job="api"}`, 1000)
+	for _, name := range Compressors {
+		t.Run(name, func(t *testing.T) {
+			m := &compressionMetrics{
+				uncompressedBytes: prometheus.NewCounterVec(prometheus.CounterOpts{Name: "uncompressed"}, []string{"compressor", "operation"}),
+				compressedBytes:   prometheus.NewCounterVec(prometheus.CounterOpts{Name: "compressed"}, []string{"compressor", "operation"}),
+				seconds:           prometheus.NewCounterVec(prometheus.CounterOpts{Name: "seconds"}, []string{"compressor", "operation"}),
+			}
+			c := newInstrumentedCompressor(encoding.GetCompressor(name), m)
+			testutil.Equals(t, name, c.Name())
+
+			var buf bytes.Buffer
+			w, err := c.Compress(&buf)
+			testutil.Ok(t, err)
+			_, err = io.WriteString(w, input)
+			testutil.Ok(t, err)
+			testutil.Ok(t, w.Close())
+			compressed := buf.Len()
+			testutil.Assert(t, compressed < len(input)/10, "%d bytes compressed to %d", len(input), compressed)
+
+			r, err := c.Decompress(&buf)
+			testutil.Ok(t, err)
+			out, err := io.ReadAll(r)
+			testutil.Ok(t, err)
+			testutil.Equals(t, input, string(out))
+
+			for _, op := range []string{"compress", "decompress"} {
+				testutil.Equals(t, float64(len(input)), promtestutil.ToFloat64(m.uncompressedBytes.WithLabelValues(name, op)))
+				testutil.Equals(t, float64(compressed), promtestutil.ToFloat64(m.compressedBytes.WithLabelValues(name, op)))
+				testutil.Assert(t, promtestutil.ToFloat64(m.seconds.WithLabelValues(name, op)) > 0)
+			}
+		})
+	}
+}
+
+func TestInstrumentCompressors_ServerUsesClientCompressor(t *testing.T) {
+	reg := prometheus.NewRegistry()
+	InstrumentCompressors(reg)
+
+	lis := bufconn.Listen(1 << 20)
+	srv := grpc.NewServer()
+	grpc_health_v1.RegisterHealthServer(srv, health.NewServer())
+	go func() { _ = srv.Serve(lis) }()
+	t.Cleanup(srv.Stop)
+
+	conn, err := grpc.NewClient("passthrough:///bufnet",
+		grpc.WithContextDialer(func(ctx context.Context, _ string) (net.Conn, error) { return lis.DialContext(ctx) }),
+		grpc.WithTransportCredentials(insecure.NewCredentials()),
+		grpc.WithDefaultCallOptions(grpc.UseCompressor("zstd")),
+	)
+	testutil.Ok(t, err)
+	t.Cleanup(func() { testutil.Ok(t, conn.Close()) })
+
+	_, err = grpc_health_v1.NewHealthClient(conn).Check(context.Background(), &grpc_health_v1.HealthCheckRequest{})
+	testutil.Ok(t, err)
+
+	// Both the request and the response were compressed and decompressed with zstd.
+	metrics, err := reg.Gather()
+	testutil.Ok(t, err)
+	ops := map[string]float64{}
+	for _, mf := range metrics {
+		if mf.GetName() != "thanos_grpc_compression_uncompressed_bytes_total" {
+			continue
+		}
+		for _, m := range mf.GetMetric() {
+			lbls := map[string]string{}
+			for _, l := range m.GetLabel() {
+				lbls[l.GetName()] = l.GetValue()
+			}
+			if lbls["compressor"] == "zstd" {
+				ops[lbls["operation"]] = m.GetCounter().GetValue()
+			}
+		}
+	}
+	testutil.Assert(t, ops["compress"] > 0 && ops["decompress"] > 0, "unexpected zstd operations %v", ops)
+}
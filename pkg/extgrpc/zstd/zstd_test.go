@@ -0,0 +1,37 @@
+// Copyright (c) The Thanos Authors.
+// Licensed under the Apache License 2.0.
+
+package zstd
+
+import (
+	"bytes"
+	"io"
+	"strings"
+	"testing"
+
+	"github.com/efficientgo/core/testutil"
+)
+
+func TestZstd(t *testing.T) {
+	c := newCompressor()
+	testutil.Equals(t, "zstd", c.Name())
+
+	for _, input := range []string{"", "hello world", strings.Repeat("123456789", 1024)} {
+		// Pooled writers and readers are reused across iterations.
+		for i := 0; i < 2; i++ {
+			var buf bytes.Buffer
+			w, err := c.Compress(&buf)
+			testutil.Ok(t, err)
+			n, err := w.Write([]byte(input))
+			testutil.Ok(t, err)
+			testutil.Equals(t, len(input), n)
+			testutil.Ok(t, w.Close())
+
+			r, err := c.Decompress(&buf)
+			testutil.Ok(t, err)
+			out, err := io.ReadAll(r)
+			testutil.Ok(t, err)
+			testutil.Equals(t, input, string(out))
+		}
+	}
+}
@@ -7,6 +7,7 @@ import (
 	"fmt"
 	"os"
 	"sort"
+	"strings"
 	"text/template"
 
 	"github.com/go-kit/log"
@@ -111,6 +112,25 @@ func (a *App) Parse() (cmd string, setup SetupFunc) {
 	return cmd, a.setups[cmd]
 }
 
+// CommandFlags returns the flags of the application and of the command, including the flags of its parent commands.
+func (a *App) CommandFlags(cmd string) []*kingpin.FlagModel {
+	flags := append([]*kingpin.FlagModel{}, a.app.Model().Flags...)
+
+	var c *kingpin.CmdClause
+	for _, name := range strings.Fields(cmd) {
+		if c == nil {
+			c = a.app.GetCommand(name)
+		} else {
+			c = c.GetCommand(name)
+		}
+		if c == nil {
+			break
+		}
+		flags = append(flags, c.Model().Flags...)
+	}
+	return flags
+}
+
 func (a *App) Command(cmd, help string) AppClause {
 	c := a.app.Command(cmd, help)
 	return &appClause{
@@ -0,0 +1,108 @@
+// Copyright (c) The Thanos Authors.
+// Licensed under the Apache License 2.0.
+
+// Package extobjstore extends the object storage clients provided by github.com/thanos-io/objstore
+// with Thanos specific options that are applied on top of any provider.
+package extobjstore
+
+import (
+	"github.com/go-kit/log"
+	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus"
+	"gopkg.in/yaml.v2"
+
+	"github.com/thanos-io/objstore"
+	"github.com/thanos-io/objstore/client"
+)
+
+// BucketConfig is the object storage configuration. On top of the provider
+// configuration understood by the objstore client it accepts options applied
+// to any provider.
+type BucketConfig struct {
+	client.BucketConfig `yaml:",inline"`
+
+	Compression CompressionConfig `yaml:"compression"`
+	Retry       RetryConfig       `yaml:"retry"`
+	Timeouts    TimeoutConfig     `yaml:"timeouts"`
+	Failover    FailoverConfig    `yaml:"failover"`
+	// PrefixRewrite rewrites the prefix of object keys, e.g. during the migration of objects under a new prefix.
+	PrefixRewrite PrefixRewriteConfig `yaml:"prefix_rewrite"`
+}
+
+// ParseBucketConfig parses the object storage configuration from YAML.
+func ParseBucketConfig(confContentYaml []byte) (*BucketConfig, error) {
+	conf := &BucketConfig{}
+	if err := yaml.UnmarshalStrict(confContentYaml, conf); err != nil {
+		return nil, errors.Wrap(err, "parsing config YAML file")
+	}
+	if err := conf.Compression.validate(); err != nil {
+		return nil, errors.Wrap(err, "validate compression config")
+	}
+	if err := conf.Retry.validate(); err != nil {
+		return nil, errors.Wrap(err, "validate retry config")
+	}
+	if err := conf.Timeouts.validate(); err != nil {
+		return nil, errors.Wrap(err, "validate timeouts config")
+	}
+	if err := conf.Failover.validate(); err != nil {
+		return nil, errors.Wrap(err, "validate failover config")
+	}
+	if err := conf.PrefixRewrite.validate(); err != nil {
+		return nil, errors.Wrap(err, "validate prefix rewrite config")
+	}
+	return conf, nil
+}
+
+// NewBucket initializes and returns a new object storage client for the given configuration.
+// It replaces client.NewBucket, supporting the options of BucketConfig and secret references,
+// which are resolved once. Metrics of the options are registered in reg.
+func NewBucket(logger log.Logger, reg prometheus.Registerer, confContentYaml []byte, component string) (objstore.Bucket, error) {
+	confContentYaml, err := ResolveSecrets(confContentYaml, DefaultSecretResolvers)
+	if err != nil {
+		return nil, errors.Wrap(err, "resolve secrets of bucket config")
+	}
+	conf, err := ParseBucketConfig(confContentYaml)
+	if err != nil {
+		return nil, err
+	}
+
+	bkt, err := newClientBucket(logger, reg, conf, conf.BucketConfig, component)
+	if err != nil {
+		return nil, err
+	}
+	if len(conf.Failover.Secondaries) == 0 {
+		return bkt, nil
+	}
+
+	secondaries := make([]objstore.Bucket, 0, len(conf.Failover.Secondaries))
+	for i, sconf := range conf.Failover.Secondaries {
+		sbkt, err := newClientBucket(logger, reg, conf, sconf, component)
+		if err != nil {
+			for _, s := range append(secondaries, bkt) {
+				_ = s.Close()
+			}
+			return nil, errors.Wrapf(err, "create secondary bucket %d", i)
+		}
+		secondaries = append(secondaries, sbkt)
+	}
+	return NewFailoverBucket(logger, reg, bkt, secondaries, conf.Failover.PrimaryCooldown), nil
+}
+
+// newClientBucket creates the client of the provider configured in clientConf, applying the options of conf.
+func newClientBucket(logger log.Logger, reg prometheus.Registerer, conf *BucketConfig, clientConf client.BucketConfig, component string) (objstore.Bucket, error) {
+	clientConfYaml, err := yaml.Marshal(clientConf)
+	if err != nil {
+		return nil, errors.Wrap(err, "marshal client bucket configuration")
+	}
+	bkt, err := client.NewBucket(logger, clientConfYaml, component)
+	if err != nil {
+		return nil, err
+	}
+
+	bkt, err = wrapWithCopy(bkt, clientConf, component)
+	if err != nil {
+		return nil, err
+	}
+	bkt = wrapWithRetry(wrapWithCompression(wrapWithTimeouts(bkt, conf.Timeouts), conf.Compression), reg, conf.Retry)
+	return wrapWithPrefixRewrite(logger, bkt, conf.PrefixRewrite), nil
+}
@@ -0,0 +1,169 @@
+// Copyright (c) The Thanos Authors.
+// Licensed under the Apache License 2.0.
+
+package extobjstore
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"io"
+	"path"
+
+	"github.com/klauspost/compress/zstd"
+	"github.com/pkg/errors"
+
+	"github.com/thanos-io/objstore"
+)
+
+// ZstdCompression compresses objects using zstd.
+const ZstdCompression = "zstd"
+
+// zstdMagic is the magic number starting every zstd frame.
+var zstdMagic = []byte{0x28, 0xb5, 0x2f, 0xfd}
+
+// CompressionConfig configures transparent compression of whole objects at rest.
+//
+// Objects are compressed on upload and decompressed on download, so that the
+// components reading or writing them do not need to be aware of it. Only the listed
+// objects are decompressed on download, and only if they start with a zstd frame
+// header, so uncompressed objects uploaded before enabling compression can still be
+// read, and other objects are never altered, whatever their content.
+//
+// Compression applies to whole objects: range reads and object attributes are
+// passed through untouched, so only objects which are always fetched whole must
+// be listed (e.g. meta.json). Block files accessed with range reads such as chunks
+// or the index read by Store Gateway must not be compressed.
+// All components sharing a bucket must use the same configuration.
+type CompressionConfig struct {
+	// Type is the compression algorithm. Empty disables compression.
+	Type string `yaml:"type"`
+	// Objects is a list of object base names (e.g. meta.json) to compress on upload.
+	Objects []string `yaml:"objects"`
+}
+
+func (c CompressionConfig) validate() error {
+	switch c.Type {
+	case "":
+		return nil
+	case ZstdCompression:
+	default:
+		return errors.Errorf("unsupported compression type %q", c.Type)
+	}
+	if len(c.Objects) == 0 {
+		return errors.New("no objects to compress specified")
+	}
+	return nil
+}
+
+// CompressedBucket is a bucket compressing the configured objects on upload and
+// decompressing them on download.
+type CompressedBucket struct {
+	objstore.Bucket
+
+	objects map[string]struct{}
+}
+
+func wrapWithCompression(bkt objstore.Bucket, conf CompressionConfig) objstore.Bucket {
+	if conf.Type == "" {
+		return bkt
+	}
+	return NewCompressedBucket(bkt, conf.Objects)
+}
+
+// NewCompressedBucket returns a bucket compressing objects with the given base names using zstd.
+func NewCompressedBucket(bkt objstore.Bucket, objects []string) *CompressedBucket {
+	cb := &CompressedBucket{
+		Bucket:  bkt,
+		objects: make(map[string]struct{}, len(objects)),
+	}
+	for _, o := range objects {
+		cb.objects[o] = struct{}{}
+	}
+	return cb
+}
+
+// Upload the contents of the reader as an object into the bucket, compressing it if configured.
+func (cb *CompressedBucket) Upload(ctx context.Context, name string, r io.Reader) error {
+	if _, ok := cb.objects[path.Base(name)]; !ok {
+		return cb.Bucket.Upload(ctx, name, r)
+	}
+
+	pr, pw := io.Pipe()
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+
+		enc, err := zstd.NewWriter(pw)
+		if err != nil {
+			pw.CloseWithError(err)
+			return
+		}
+		if _, err := io.Copy(enc, r); err != nil {
+			enc.Close()
+			pw.CloseWithError(err)
+			return
+		}
+		pw.CloseWithError(enc.Close())
+	}()
+
+	err := cb.Bucket.Upload(ctx, name, pr)
+	// Unblock the compressing goroutine in case the upload returned early.
+	pr.CloseWithError(errors.New("upload finished"))
+	<-done
+	return err
+}
+
+// Get returns a reader for the given object name, decompressing it if it is one of the configured objects
+// and was stored compressed.
+func (cb *CompressedBucket) Get(ctx context.Context, name string) (io.ReadCloser, error) {
+	rc, err := cb.Bucket.Get(ctx, name)
+	if err != nil {
+		return nil, err
+	}
+	if _, ok := cb.objects[path.Base(name)]; !ok {
+		return rc, nil
+	}
+
+	br := bufio.NewReader(rc)
+	header, err := br.Peek(len(zstdMagic))
+	if err != nil && err != io.EOF {
+		_ = rc.Close()
+		return nil, errors.Wrapf(err, "read header of %s", name)
+	}
+	if !bytes.Equal(header, zstdMagic) {
+		return &readCloser{Reader: br, closer: rc.Close}, nil
+	}
+
+	dec, err := zstd.NewReader(br)
+	if err != nil {
+		_ = rc.Close()
+		return nil, errors.Wrapf(err, "create zstd reader for %s", name)
+	}
+	return &readCloser{Reader: dec, closer: func() error {
+		dec.Close()
+		return rc.Close()
+	}}, nil
+}
+
+// ReaderWithExpectedErrs implements objstore.InstrumentedBucket.
+func (cb *CompressedBucket) ReaderWithExpectedErrs(fn objstore.IsOpFailureExpectedFunc) objstore.BucketReader {
+	return cb.WithExpectedErrs(fn)
+}
+
+// WithExpectedErrs implements objstore.InstrumentedBucket.
+func (cb *CompressedBucket) WithExpectedErrs(fn objstore.IsOpFailureExpectedFunc) objstore.Bucket {
+	if ib, ok := cb.Bucket.(objstore.InstrumentedBucket); ok {
+		return &CompressedBucket{Bucket: ib.WithExpectedErrs(fn), objects: cb.objects}
+	}
+	return cb
+}
+
+type readCloser struct {
+	io.Reader
+	closer func() error
+}
+
+func (r *readCloser) Close() error {
+	return r.closer()
+}
@@ -0,0 +1,89 @@
+// Copyright (c) The Thanos Authors.
+// Licensed under the Apache License 2.0.
+
+package extobjstore
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"strings"
+	"testing"
+
+	"github.com/efficientgo/core/testutil"
+	"github.com/klauspost/compress/zstd"
+
+	"github.com/thanos-io/objstore"
+)
+
+func TestCompressedBucket(t *testing.T) {
+	ctx := context.Background()
+	content := strings.Repeat(`{"ulid":"01ARZ3NDEKTSV4RRFFQ69G5FAV","version":1}`, 100)
+
+	inmem := objstore.NewInMemBucket()
+	bkt := NewCompressedBucket(inmem, []string{"meta.json"})
+
+	testutil.Ok(t, bkt.Upload(ctx, "01ARZ3NDEKTSV4RRFFQ69G5FAV/meta.json", strings.NewReader(content)))
+	testutil.Ok(t, bkt.Upload(ctx, "01ARZ3NDEKTSV4RRFFQ69G5FAV/index", strings.NewReader(content)))
+
+	// Only the configured objects are compressed at rest.
+	raw := inmem.Objects()
+	testutil.Assert(t, bytes.HasPrefix(raw["01ARZ3NDEKTSV4RRFFQ69G5FAV/meta.json"], zstdMagic), "expected meta.json to be compressed")
+	testutil.Assert(t, len(raw["01ARZ3NDEKTSV4RRFFQ69G5FAV/meta.json"]) < len(content), "expected meta.json to be smaller than the original")
+	testutil.Equals(t, content, string(raw["01ARZ3NDEKTSV4RRFFQ69G5FAV/index"]))
+
+	for _, name := range []string{"01ARZ3NDEKTSV4RRFFQ69G5FAV/meta.json", "01ARZ3NDEKTSV4RRFFQ69G5FAV/index"} {
+		rc, err := bkt.Get(ctx, name)
+		testutil.Ok(t, err)
+		b, err := io.ReadAll(rc)
+		testutil.Ok(t, err)
+		testutil.Ok(t, rc.Close())
+		testutil.Equals(t, content, string(b))
+	}
+
+	// Uncompressed objects written before enabling compression are still readable.
+	testutil.Ok(t, inmem.Upload(ctx, "01BX6V6TY06G5MFQ0GPH7EMXRH/meta.json", strings.NewReader("{}")))
+	rc, err := bkt.Get(ctx, "01BX6V6TY06G5MFQ0GPH7EMXRH/meta.json")
+	testutil.Ok(t, err)
+	b, err := io.ReadAll(rc)
+	testutil.Ok(t, err)
+	testutil.Ok(t, rc.Close())
+	testutil.Equals(t, "{}", string(b))
+
+	// Objects which are not configured are returned as they are stored, even if they look compressed.
+	var compressed bytes.Buffer
+	enc, err := zstd.NewWriter(&compressed)
+	testutil.Ok(t, err)
+	_, err = enc.Write([]byte(content))
+	testutil.Ok(t, err)
+	testutil.Ok(t, enc.Close())
+	testutil.Ok(t, inmem.Upload(ctx, "01BX6V6TY06G5MFQ0GPH7EMXRH/chunks/000001", bytes.NewReader(compressed.Bytes())))
+	rc, err = bkt.Get(ctx, "01BX6V6TY06G5MFQ0GPH7EMXRH/chunks/000001")
+	testutil.Ok(t, err)
+	b, err = io.ReadAll(rc)
+	testutil.Ok(t, err)
+	testutil.Ok(t, rc.Close())
+	testutil.Equals(t, compressed.Bytes(), b)
+}
+
+func TestParseBucketConfig(t *testing.T) {
+	conf, err := ParseBucketConfig([]byte(`type: FILESYSTEM
+config:
+  directory: /tmp/thanos
+prefix: tenant
+compression:
+  type: zstd
+  objects: [meta.json]
+`))
+	testutil.Ok(t, err)
+	testutil.Equals(t, "tenant", conf.Prefix)
+	testutil.Equals(t, ZstdCompression, conf.Compression.Type)
+	testutil.Equals(t, []string{"meta.json"}, conf.Compression.Objects)
+
+	_, err = ParseBucketConfig([]byte(`type: FILESYSTEM
+compression:
+  type: lz4
+  objects: [meta.json]
+`))
+	testutil.NotOk(t, err)
+}
@@ -0,0 +1,229 @@
+// Copyright (c) The Thanos Authors.
+// Licensed under the Apache License 2.0.
+
+package extobjstore
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"os"
+	"runtime"
+
+	"github.com/minio/minio-go/v7"
+	"github.com/minio/minio-go/v7/pkg/credentials"
+	"github.com/minio/minio-go/v7/pkg/encrypt"
+	"github.com/pkg/errors"
+	"github.com/prometheus/common/version"
+	"github.com/thanos-io/objstore"
+	"github.com/thanos-io/objstore/client"
+	"github.com/thanos-io/objstore/exthttp"
+	"github.com/thanos-io/objstore/providers/gcs"
+	"github.com/thanos-io/objstore/providers/s3"
+	"gopkg.in/yaml.v2"
+
+	"github.com/thanos-io/thanos/pkg/extobjstore/objcopy"
+)
+
+// Copy copies the object src to dst as is. Objects are copied without being decompressed
+// and compressed again, since src and dst are compressed the same way.
+func (cb *CompressedBucket) Copy(ctx context.Context, src, dst string) error {
+	return objcopy.Copy(ctx, cb.Bucket, src, dst)
+}
+
+// gcsBucket adds server-side copy to the GCS bucket.
+type gcsBucket struct {
+	*gcs.Bucket
+}
+
+// Copy copies src to dst using the GCS rewrite API.
+func (b *gcsBucket) Copy(ctx context.Context, src, dst string) error {
+	h := b.Handle()
+	if _, err := h.Object(dst).CopierFrom(h.Object(src)).Run(ctx); err != nil {
+		return errors.Wrapf(err, "copy %s to %s", src, dst)
+	}
+	return nil
+}
+
+// maxCopyObjectSize is the largest object S3 copies with a single CopyObject request.
+const maxCopyObjectSize = 5 << 30
+
+// s3Bucket adds server-side copy to the S3 bucket. The objstore S3 bucket does not expose
+// its minio client, so copies use a client built from the same configuration.
+type s3Bucket struct {
+	*s3.Bucket
+
+	client *minio.Client
+	sse    encrypt.ServerSide
+	// meta holds the metadata and storage class the bucket sets on uploaded objects.
+	meta map[string]string
+}
+
+func newS3Bucket(bkt *s3.Bucket, conf s3.Config, component string) (*s3Bucket, error) {
+	creds := newS3Credentials(conf)
+	rt := conf.HTTPConfig.Transport
+	if rt == nil {
+		t, err := exthttp.DefaultTransport(conf.HTTPConfig)
+		if err != nil {
+			return nil, err
+		}
+		rt = t
+	}
+	client, err := minio.New(conf.Endpoint, &minio.Options{
+		Creds:        creds,
+		Secure:       !conf.Insecure,
+		Region:       conf.Region,
+		Transport:    rt,
+		BucketLookup: conf.BucketLookupType.MinioType(),
+	})
+	if err != nil {
+		return nil, errors.Wrap(err, "initialize s3 client")
+	}
+	client.SetAppInfo(fmt.Sprintf("thanos-%s", component), fmt.Sprintf("%s (%s)", version.Version, runtime.Version()))
+	if conf.DisableDualstack {
+		client.SetS3EnableDualstack(false)
+	}
+
+	sse, err := newS3ServerSideEncryption(conf.SSEConfig)
+	if err != nil {
+		return nil, err
+	}
+
+	meta := make(map[string]string, len(conf.PutUserMetadata))
+	for k, v := range conf.PutUserMetadata {
+		meta[k] = v
+	}
+	return &s3Bucket{Bucket: bkt, client: client, sse: sse, meta: meta}, nil
+}
+
+// newS3Credentials returns the credentials the objstore S3 client uses for conf.
+func newS3Credentials(conf s3.Config) *credentials.Credentials {
+	wrap := func(p credentials.Provider) credentials.Provider { return p }
+	if conf.SignatureV2 {
+		wrap = func(p credentials.Provider) credentials.Provider {
+			return &signatureV2Provider{Provider: p}
+		}
+	}
+
+	var chain []credentials.Provider
+	switch {
+	case conf.AWSSDKAuth:
+		chain = []credentials.Provider{wrap(&s3.AWSSDKAuth{Region: conf.Region})}
+	case conf.AccessKey != "":
+		chain = []credentials.Provider{wrap(&credentials.Static{
+			Value: credentials.Value{
+				AccessKeyID:     conf.AccessKey,
+				SecretAccessKey: conf.SecretKey,
+				SessionToken:    conf.SessionToken,
+				SignerType:      credentials.SignatureV4,
+			},
+		})}
+	default:
+		chain = []credentials.Provider{
+			wrap(&credentials.EnvAWS{}),
+			wrap(&credentials.FileAWSCredentials{}),
+			wrap(&credentials.IAM{
+				Client:   &http.Client{Transport: http.DefaultTransport},
+				Endpoint: conf.STSEndpoint,
+			}),
+		}
+	}
+	return credentials.NewChainCredentials(chain)
+}
+
+// signatureV2Provider signs requests with signature version 2 unless they are anonymous.
+type signatureV2Provider struct {
+	credentials.Provider
+}
+
+func (p *signatureV2Provider) Retrieve() (credentials.Value, error) {
+	v, err := p.Provider.Retrieve()
+	if err != nil {
+		return v, err
+	}
+	if !v.SignerType.IsAnonymous() {
+		v.SignerType = credentials.SignatureV2
+	}
+	return v, nil
+}
+
+// newS3ServerSideEncryption returns the server-side encryption the objstore S3 client applies for conf.
+func newS3ServerSideEncryption(conf s3.SSEConfig) (encrypt.ServerSide, error) {
+	switch conf.Type {
+	case "":
+		return nil, nil
+	case s3.SSEKMS:
+		kmsContext := conf.KMSEncryptionContext
+		if kmsContext == nil {
+			kmsContext = map[string]string{}
+		}
+		sse, err := encrypt.NewSSEKMS(conf.KMSKeyID, kmsContext)
+		return sse, errors.Wrap(err, "initialize s3 client SSE-KMS")
+	case s3.SSEC:
+		key, err := os.ReadFile(conf.EncryptionKey)
+		if err != nil {
+			return nil, err
+		}
+		sse, err := encrypt.NewSSEC(key)
+		return sse, errors.Wrap(err, "initialize s3 client SSE-C")
+	case s3.SSES3:
+		return encrypt.NewSSE(), nil
+	default:
+		return nil, errors.Errorf("unsupported SSE type %q", conf.Type)
+	}
+}
+
+// Copy copies src to dst using the S3 CopyObject API, or a multipart copy for objects larger
+// than S3 copies in a single request. The metadata of dst is replaced with the one set on
+// upload, since S3 does not keep the storage class of copied objects. The server-side
+// encryption of the bucket configuration is used; SSE configured through the context with
+// s3.ContextWithSSEConfig is not applied.
+func (b *s3Bucket) Copy(ctx context.Context, src, dst string) error {
+	srcOpts := minio.CopySrcOptions{Bucket: b.Name(), Object: src}
+	if b.sse != nil && b.sse.Type() == encrypt.SSEC {
+		srcOpts.Encryption = b.sse
+	}
+	dstOpts := minio.CopyDestOptions{
+		Bucket:          b.Name(),
+		Object:          dst,
+		Encryption:      b.sse,
+		UserMetadata:    b.meta,
+		ReplaceMetadata: true,
+	}
+
+	info, err := b.client.StatObject(ctx, b.Name(), src, minio.StatObjectOptions{ServerSideEncryption: srcOpts.Encryption})
+	if err != nil {
+		return errors.Wrapf(err, "stat %s", src)
+	}
+	if info.Size <= maxCopyObjectSize {
+		_, err = b.client.CopyObject(ctx, dstOpts, srcOpts)
+	} else {
+		_, err = b.client.ComposeObject(ctx, dstOpts, srcOpts)
+	}
+	if err != nil {
+		return errors.Wrapf(err, "copy %s to %s", src, dst)
+	}
+	return nil
+}
+
+// wrapWithCopy adds server-side copy to the providers supporting it in a way which is not
+// exposed by the objstore client. Other buckets are returned as is.
+func wrapWithCopy(bkt objstore.Bucket, clientConf client.BucketConfig, component string) (objstore.Bucket, error) {
+	switch b := bkt.(type) {
+	case *gcs.Bucket:
+		return &gcsBucket{Bucket: b}, nil
+	case *s3.Bucket:
+		confYaml, err := yaml.Marshal(clientConf.Config)
+		if err != nil {
+			return nil, errors.Wrap(err, "marshal s3 bucket configuration")
+		}
+		conf := s3.DefaultConfig
+		// The map of the default configuration is shared, do not unmarshal into it.
+		conf.PutUserMetadata = map[string]string{}
+		if err := yaml.UnmarshalStrict(confYaml, &conf); err != nil {
+			return nil, errors.Wrap(err, "parse s3 bucket configuration")
+		}
+		return newS3Bucket(b, conf, component)
+	}
+	return bkt, nil
+}
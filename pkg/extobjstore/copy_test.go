@@ -0,0 +1,141 @@
+// Copyright (c) The Thanos Authors.
+// Licensed under the Apache License 2.0.
+
+package extobjstore
+
+import (
+	"bytes"
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/efficientgo/core/testutil"
+	"github.com/go-kit/log"
+
+	"github.com/thanos-io/objstore"
+	"github.com/thanos-io/objstore/client"
+	"github.com/thanos-io/objstore/providers/s3"
+	"gopkg.in/yaml.v2"
+
+	"github.com/thanos-io/thanos/pkg/extobjstore/objcopy"
+)
+
+type copyingBucket struct {
+	*objstore.InMemBucket
+
+	copies int
+}
+
+func (b *copyingBucket) Copy(ctx context.Context, src, dst string) error {
+	b.copies++
+	rc, err := b.Get(ctx, src)
+	if err != nil {
+		return err
+	}
+	defer rc.Close()
+	return b.Upload(ctx, dst, rc)
+}
+
+func TestCompressedBucket_Copy(t *testing.T) {
+	ctx := context.Background()
+
+	// Compressed objects are copied as is.
+	inner := &copyingBucket{InMemBucket: objstore.NewInMemBucket()}
+	bkt := NewCompressedBucket(inner, []string{"meta.json"})
+	testutil.Ok(t, bkt.Upload(ctx, "a/meta.json", strings.NewReader("{}")))
+	testutil.Ok(t, objcopy.Copy(ctx, bkt, "a/meta.json", "b/meta.json"))
+	testutil.Equals(t, 1, inner.copies)
+
+	raw := inner.Objects()
+	testutil.Assert(t, bytes.HasPrefix(raw["b/meta.json"], zstdMagic), "expected copy to stay compressed")
+	testutil.Equals(t, raw["a/meta.json"], raw["b/meta.json"])
+}
+
+func TestS3Bucket_Copy(t *testing.T) {
+	for _, tc := range []struct {
+		name      string
+		size      int64
+		multipart bool
+	}{
+		{name: "single request", size: 1024},
+		{name: "multipart above 5GiB", size: 6 << 30, multipart: true},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			var (
+				mtx                                      sync.Mutex
+				copies, parts, completed                 int
+				gotSource, gotStorageClass, gotDirective string
+			)
+			srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				mtx.Lock()
+				defer mtx.Unlock()
+
+				q := r.URL.Query()
+				switch {
+				case r.Method == http.MethodHead:
+					w.Header().Set("Content-Length", strconv.FormatInt(tc.size, 10))
+					w.Header().Set("ETag", `"src"`)
+					w.Header().Set("Last-Modified", "Mon, 01 Jan 2024 00:00:00 GMT")
+				case r.Method == http.MethodPost && q.Has("uploads"):
+					gotStorageClass = r.Header.Get("X-Amz-Storage-Class")
+					_, _ = w.Write([]byte(`<InitiateMultipartUploadResult><Bucket>test</Bucket><Key>b/index</Key><UploadId>1</UploadId></InitiateMultipartUploadResult>`))
+				case r.Method == http.MethodPut && q.Has("uploadId"):
+					parts++
+					gotSource = r.Header.Get("X-Amz-Copy-Source")
+					_, _ = w.Write([]byte(`<CopyPartResult><ETag>"part"</ETag><LastModified>2024-01-01T00:00:00.000Z</LastModified></CopyPartResult>`))
+				case r.Method == http.MethodPost && q.Has("uploadId"):
+					completed++
+					_, _ = w.Write([]byte(`<CompleteMultipartUploadResult><Bucket>test</Bucket><Key>b/index</Key><ETag>"dst"</ETag></CompleteMultipartUploadResult>`))
+				case r.Method == http.MethodPut:
+					copies++
+					gotSource = r.Header.Get("X-Amz-Copy-Source")
+					gotDirective = r.Header.Get("X-Amz-Metadata-Directive")
+					gotStorageClass = r.Header.Get("X-Amz-Storage-Class")
+					_, _ = w.Write([]byte(`<CopyObjectResult><ETag>"dst"</ETag><LastModified>2024-01-01T00:00:00.000Z</LastModified></CopyObjectResult>`))
+				default:
+					w.WriteHeader(http.StatusNotImplemented)
+				}
+			}))
+			defer srv.Close()
+
+			clientConf := client.BucketConfig{
+				Type: client.S3,
+				Config: s3.Config{
+					Bucket:           "test",
+					Endpoint:         strings.TrimPrefix(srv.URL, "http://"),
+					Insecure:         true,
+					AccessKey:        "key",
+					SecretKey:        "secret",
+					Region:           "us-east-1",
+					BucketLookupType: s3.PathLookup,
+					PutUserMetadata:  map[string]string{"X-Amz-Storage-Class": "STANDARD_IA"},
+				},
+			}
+			confYaml, err := yaml.Marshal(clientConf)
+			testutil.Ok(t, err)
+			b, err := client.NewBucket(log.NewNopLogger(), confYaml, "test")
+			testutil.Ok(t, err)
+
+			bkt, err := wrapWithCopy(b, clientConf, "test")
+			testutil.Ok(t, err)
+			_, ok := bkt.(objcopy.Copier)
+			testutil.Assert(t, ok, "expected the S3 bucket to copy server-side")
+
+			testutil.Ok(t, objcopy.Copy(context.Background(), bkt, "a/index", "b/index"))
+			testutil.Equals(t, "test/a/index", gotSource)
+			testutil.Equals(t, "STANDARD_IA", gotStorageClass)
+			if tc.multipart {
+				testutil.Equals(t, 0, copies)
+				testutil.Assert(t, parts > 1, "expected several parts, got %d", parts)
+				testutil.Equals(t, 1, completed)
+				return
+			}
+			testutil.Equals(t, 1, copies)
+			testutil.Equals(t, "REPLACE", gotDirective)
+		})
+	}
+}
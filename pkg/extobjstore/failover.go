@@ -0,0 +1,289 @@
+// Copyright (c) The Thanos Authors.
+// Licensed under the Apache License 2.0.
+
+package extobjstore
+
+import (
+	"context"
+	"io"
+	"sync"
+	"time"
+
+	"github.com/go-kit/log"
+	"github.com/go-kit/log/level"
+	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus"
+
+	"github.com/thanos-io/objstore"
+	"github.com/thanos-io/objstore/client"
+
+	"github.com/thanos-io/thanos/pkg/errutil"
+	"github.com/thanos-io/thanos/pkg/extobjstore/objcopy"
+)
+
+// FailoverConfig configures secondary buckets which reads fail over to when they fail on the primary bucket,
+// e.g. replicas of the primary bucket in other regions.
+//
+// Writes only go to the primary bucket, so that the buckets never diverge from their replication source.
+type FailoverConfig struct {
+	// Secondaries are the buckets reads fail over to, in order. They are configured like the primary bucket
+	// and use the same compression, retry and timeouts options.
+	Secondaries []client.BucketConfig `yaml:"secondaries"`
+	// PrimaryCooldown is how long reads go to the secondaries first after a read failed on the primary bucket,
+	// so that reads do not wait for the primary bucket to fail again during an incident. 0 always tries the
+	// primary bucket first.
+	PrimaryCooldown time.Duration `yaml:"primary_cooldown"`
+}
+
+func (c FailoverConfig) validate() error {
+	if c.PrimaryCooldown < 0 {
+		return errors.New("primary cooldown must not be negative")
+	}
+	for i, s := range c.Secondaries {
+		if s.Type == "" {
+			return errors.Errorf("no type specified for secondary bucket %d", i)
+		}
+	}
+	return nil
+}
+
+// FailoverBucket is a bucket reading from secondary buckets when reads fail on the primary bucket.
+// Reads are not failed over if the object does not exist in the primary bucket or the request was canceled.
+type FailoverBucket struct {
+	objstore.Bucket
+
+	logger      log.Logger
+	secondaries []objstore.Bucket
+	cooldown    time.Duration
+	failovers   *prometheus.CounterVec
+
+	mtx *sync.Mutex
+	// primaryDownUntil is the time until which reads go to the secondaries first.
+	primaryDownUntil *time.Time
+}
+
+// NewFailoverBucket returns a bucket writing to primary and reading from the secondaries, in order,
+// when reads fail on primary. Reads skip primary for cooldown after it failed.
+func NewFailoverBucket(logger log.Logger, reg prometheus.Registerer, primary objstore.Bucket, secondaries []objstore.Bucket, cooldown time.Duration) *FailoverBucket {
+	return &FailoverBucket{
+		Bucket:           primary,
+		logger:           logger,
+		secondaries:      secondaries,
+		cooldown:         cooldown,
+		failovers:        registerFailoversMetric(reg),
+		mtx:              &sync.Mutex{},
+		primaryDownUntil: &time.Time{},
+	}
+}
+
+// registerFailoversMetric registers the failovers metric, reusing the one of another bucket of the same
+// process if any, e.g. the source and target buckets of a replication.
+func registerFailoversMetric(reg prometheus.Registerer) *prometheus.CounterVec {
+	failovers := prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "thanos_objstore_bucket_failovers_total",
+		Help: "Total number of bucket read operations sent to a secondary bucket because they failed on the primary bucket or the primary bucket is cooling down.",
+	}, []string{"bucket", "operation"})
+	if reg == nil {
+		return failovers
+	}
+	if err := reg.Register(failovers); err != nil {
+		if are, ok := err.(prometheus.AlreadyRegisteredError); ok {
+			return are.ExistingCollector.(*prometheus.CounterVec)
+		}
+		panic(err)
+	}
+	return failovers
+}
+
+// readers returns the buckets in the order reads should try them.
+func (fb *FailoverBucket) readers() []objstore.Bucket {
+	fb.mtx.Lock()
+	down := time.Now().Before(*fb.primaryDownUntil)
+	fb.mtx.Unlock()
+
+	if down {
+		return append(append([]objstore.Bucket{}, fb.secondaries...), fb.Bucket)
+	}
+	return append([]objstore.Bucket{fb.Bucket}, fb.secondaries...)
+}
+
+// errMissingInSecondary is returned by reads to a secondary bucket which found that an object does not exist
+// without failing, e.g. Exists returning false.
+var errMissingInSecondary = errors.New("object does not exist in secondary bucket")
+
+// read calls f with the buckets in order until it succeeds or fails with an error which should not be failed
+// over. retry is called before failing over and aborts failing over if it returns false.
+//
+// Only the primary bucket tells that an object does not exist, as secondary buckets may lag behind their
+// replication source. If a secondary bucket does not have the object, the error of the primary bucket is
+// returned if it failed, and the primary bucket is tried otherwise, e.g. when it is cooling down.
+func (fb *FailoverBucket) read(ctx context.Context, op string, f func(objstore.Bucket) error, retry func() bool) error {
+	var (
+		errs       errutil.MultiError
+		primaryErr error
+		lastErr    error
+	)
+	for _, bkt := range fb.readers() {
+		if bkt != fb.Bucket {
+			fb.failovers.WithLabelValues(fb.Name(), op).Inc()
+		}
+		err := f(bkt)
+		if err == nil || ctx.Err() != nil {
+			return err
+		}
+		if err == errMissingInSecondary || bkt.IsObjNotFoundErr(err) {
+			if bkt == fb.Bucket {
+				return err
+			}
+			if primaryErr != nil {
+				return primaryErr
+			}
+			continue
+		}
+		errs.Add(errors.Wrapf(err, "bucket %s", bkt.Name()))
+		lastErr = err
+		if bkt == fb.Bucket {
+			primaryErr = err
+			fb.primaryFailed(op, err)
+		}
+		if retry != nil && !retry() {
+			break
+		}
+	}
+	if len(errs) == 1 {
+		return lastErr
+	}
+	return errs.Err()
+}
+
+// primaryFailed makes reads go to the secondaries first for the cooldown.
+func (fb *FailoverBucket) primaryFailed(op string, err error) {
+	if fb.cooldown <= 0 {
+		return
+	}
+	fb.mtx.Lock()
+	defer fb.mtx.Unlock()
+
+	if now := time.Now(); now.After(*fb.primaryDownUntil) {
+		level.Warn(fb.logger).Log("msg", "read failed on primary bucket, reading from secondary buckets first", "bucket", fb.Name(), "operation", op, "cooldown", fb.cooldown, "err", err)
+		*fb.primaryDownUntil = now.Add(fb.cooldown)
+	}
+}
+
+// Iter calls f for each entry in the given directory. Listing only fails over if it failed before f was called,
+// so that no entry is passed twice to f.
+func (fb *FailoverBucket) Iter(ctx context.Context, dir string, f func(string) error, options ...objstore.IterOption) error {
+	called := false
+	return fb.read(ctx, objstore.OpIter, func(bkt objstore.Bucket) error {
+		return bkt.Iter(ctx, dir, func(name string) error {
+			called = true
+			return f(name)
+		}, options...)
+	}, func() bool {
+		return !called
+	})
+}
+
+// Get returns a reader for the given object name. Errors while reading the object are not failed over.
+func (fb *FailoverBucket) Get(ctx context.Context, name string) (rc io.ReadCloser, err error) {
+	err = fb.read(ctx, objstore.OpGet, func(bkt objstore.Bucket) error {
+		rc, err = bkt.Get(ctx, name)
+		return err
+	}, nil)
+	return rc, err
+}
+
+// GetRange returns a new range reader for the given object name and range. Errors while reading the range
+// are not failed over.
+func (fb *FailoverBucket) GetRange(ctx context.Context, name string, off, length int64) (rc io.ReadCloser, err error) {
+	err = fb.read(ctx, objstore.OpGetRange, func(bkt objstore.Bucket) error {
+		rc, err = bkt.GetRange(ctx, name, off, length)
+		return err
+	}, nil)
+	return rc, err
+}
+
+// Exists checks if the given object exists in the bucket.
+func (fb *FailoverBucket) Exists(ctx context.Context, name string) (exists bool, err error) {
+	err = fb.read(ctx, objstore.OpExists, func(bkt objstore.Bucket) error {
+		exists, err = bkt.Exists(ctx, name)
+		if err == nil && !exists && bkt != fb.Bucket {
+			return errMissingInSecondary
+		}
+		return err
+	}, nil)
+	return exists, err
+}
+
+// Attributes returns information about the specified object.
+func (fb *FailoverBucket) Attributes(ctx context.Context, name string) (attrs objstore.ObjectAttributes, err error) {
+	err = fb.read(ctx, objstore.OpAttributes, func(bkt objstore.Bucket) error {
+		attrs, err = bkt.Attributes(ctx, name)
+		return err
+	}, nil)
+	return attrs, err
+}
+
+// IsObjNotFoundErr returns true if err means that the object is not found in any of the buckets.
+func (fb *FailoverBucket) IsObjNotFoundErr(err error) bool {
+	if fb.Bucket.IsObjNotFoundErr(err) {
+		return true
+	}
+	for _, s := range fb.secondaries {
+		if s.IsObjNotFoundErr(err) {
+			return true
+		}
+	}
+	return false
+}
+
+// IsAccessDeniedErr returns true if access to the object is denied in any of the buckets.
+func (fb *FailoverBucket) IsAccessDeniedErr(err error) bool {
+	if fb.Bucket.IsAccessDeniedErr(err) {
+		return true
+	}
+	for _, s := range fb.secondaries {
+		if s.IsAccessDeniedErr(err) {
+			return true
+		}
+	}
+	return false
+}
+
+// Copy copies the object src to dst in the primary bucket.
+func (fb *FailoverBucket) Copy(ctx context.Context, src, dst string) error {
+	return objcopy.Copy(ctx, fb.Bucket, src, dst)
+}
+
+// Close closes all buckets.
+func (fb *FailoverBucket) Close() error {
+	var errs errutil.MultiError
+	errs.Add(fb.Bucket.Close())
+	for _, s := range fb.secondaries {
+		errs.Add(s.Close())
+	}
+	return errs.Err()
+}
+
+// ReaderWithExpectedErrs implements objstore.InstrumentedBucket.
+func (fb *FailoverBucket) ReaderWithExpectedErrs(fn objstore.IsOpFailureExpectedFunc) objstore.BucketReader {
+	return fb.WithExpectedErrs(fn)
+}
+
+// WithExpectedErrs implements objstore.InstrumentedBucket.
+func (fb *FailoverBucket) WithExpectedErrs(fn objstore.IsOpFailureExpectedFunc) objstore.Bucket {
+	withExpectedErrs := func(bkt objstore.Bucket) objstore.Bucket {
+		if ib, ok := bkt.(objstore.InstrumentedBucket); ok {
+			return ib.WithExpectedErrs(fn)
+		}
+		return bkt
+	}
+	secondaries := make([]objstore.Bucket, 0, len(fb.secondaries))
+	for _, s := range fb.secondaries {
+		secondaries = append(secondaries, withExpectedErrs(s))
+	}
+	c := *fb
+	c.Bucket = withExpectedErrs(fb.Bucket)
+	c.secondaries = secondaries
+	return &c
+}
@@ -0,0 +1,211 @@
+// Copyright (c) The Thanos Authors.
+// Licensed under the Apache License 2.0.
+
+package extobjstore
+
+import (
+	"context"
+	"io"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/efficientgo/core/testutil"
+	"github.com/go-kit/log"
+	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus"
+	promtest "github.com/prometheus/client_golang/prometheus/testutil"
+
+	"github.com/thanos-io/objstore"
+)
+
+func readAll(t *testing.T, bkt objstore.Bucket, name string) string {
+	t.Helper()
+
+	rc, err := bkt.Get(context.Background(), name)
+	testutil.Ok(t, err)
+	defer func() { testutil.Ok(t, rc.Close()) }()
+	b, err := io.ReadAll(rc)
+	testutil.Ok(t, err)
+	return string(b)
+}
+
+func TestFailoverBucket(t *testing.T) {
+	ctx := context.Background()
+	unavailable := errors.New("region unavailable")
+
+	primary := &flakyBucket{InMemBucket: objstore.NewInMemBucket(), err: unavailable}
+	secondary := objstore.NewInMemBucket()
+	testutil.Ok(t, primary.Upload(ctx, "a", strings.NewReader("primary")))
+	testutil.Ok(t, secondary.Upload(ctx, "a", strings.NewReader("secondary")))
+	primary.calls = 0
+
+	reg := prometheus.NewRegistry()
+	fb := NewFailoverBucket(log.NewNopLogger(), reg, primary, []objstore.Bucket{secondary}, 0)
+	failovers := fb.failovers.WithLabelValues(fb.Name(), objstore.OpGet)
+
+	// Reads go to the primary bucket while it is available.
+	testutil.Equals(t, "primary", readAll(t, fb, "a"))
+	testutil.Equals(t, 0.0, promtest.ToFloat64(failovers))
+
+	// Reads failing on the primary bucket fail over.
+	primary.failures = 1
+	testutil.Equals(t, "secondary", readAll(t, fb, "a"))
+	testutil.Equals(t, 1.0, promtest.ToFloat64(failovers))
+
+	// Without cooldown, the next read goes to the primary bucket again.
+	testutil.Equals(t, "primary", readAll(t, fb, "a"))
+	testutil.Equals(t, 1.0, promtest.ToFloat64(failovers))
+
+	// Objects missing in the primary bucket are not read from the secondary bucket.
+	testutil.Ok(t, secondary.Upload(ctx, "b", strings.NewReader("secondary")))
+	_, err := fb.Get(ctx, "b")
+	testutil.Assert(t, fb.IsObjNotFoundErr(err), "expected not found error, got %v", err)
+
+	// Canceled reads do not fail over.
+	cctx, cancel := context.WithCancel(ctx)
+	cancel()
+	primary.failures = 1
+	_, err = fb.Get(cctx, "a")
+	testutil.Equals(t, unavailable, err)
+	testutil.Equals(t, 1.0, promtest.ToFloat64(failovers))
+
+	// Objects missing in the secondary bucket after failing over return the error of the primary bucket,
+	// so that unavailable objects are not taken for deleted ones.
+	primary.failures = 1
+	_, err = fb.Get(ctx, "c")
+	testutil.Equals(t, unavailable, err)
+	testutil.Assert(t, !fb.IsObjNotFoundErr(err), "expected error of primary bucket, got %v", err)
+
+	primary.failures = 1
+	_, err = fb.Attributes(ctx, "c")
+	testutil.Equals(t, unavailable, err)
+
+	primary.failures = 1
+	exists, err := fb.Exists(ctx, "c")
+	testutil.Equals(t, unavailable, err)
+	testutil.Assert(t, !exists, "expected object not to exist")
+
+	// Writes only go to the primary bucket.
+	testutil.Ok(t, fb.Upload(ctx, "d", strings.NewReader("d")))
+	testutil.Ok(t, fb.Copy(ctx, "d", "e"))
+	testutil.Ok(t, fb.Delete(ctx, "a"))
+	testutil.Equals(t, []string{"d", "e"}, names(t, primary))
+	testutil.Equals(t, []string{"a", "b"}, names(t, secondary))
+
+	// Listings only fail over if they failed before listing any object.
+	primary.failures = 1
+	var listed []string
+	err = fb.Iter(ctx, "", func(name string) error {
+		listed = append(listed, name)
+		return nil
+	})
+	testutil.Equals(t, unavailable, errors.Cause(err))
+	testutil.Equals(t, []string{"d"}, listed)
+}
+
+func TestFailoverBucket_PrimaryCooldown(t *testing.T) {
+	ctx := context.Background()
+	unavailable := errors.New("region unavailable")
+
+	primary := &flakyBucket{InMemBucket: objstore.NewInMemBucket(), err: unavailable}
+	secondary := objstore.NewInMemBucket()
+	testutil.Ok(t, primary.Upload(ctx, "a", strings.NewReader("primary")))
+	testutil.Ok(t, secondary.Upload(ctx, "a", strings.NewReader("secondary")))
+	primary.calls = 0
+
+	fb := NewFailoverBucket(log.NewNopLogger(), nil, primary, []objstore.Bucket{secondary}, time.Hour)
+
+	primary.failures = 1
+	testutil.Equals(t, "secondary", readAll(t, fb, "a"))
+	testutil.Equals(t, 1, primary.calls)
+
+	// During the cooldown, reads go to the secondary bucket first.
+	testutil.Equals(t, "secondary", readAll(t, fb, "a"))
+	testutil.Equals(t, 1, primary.calls)
+	testutil.Equals(t, 2.0, promtest.ToFloat64(fb.failovers.WithLabelValues(fb.Name(), objstore.OpGet)))
+
+	// Objects missing in the secondary bucket are read from the primary bucket during the cooldown.
+	testutil.Ok(t, primary.Upload(ctx, "b", strings.NewReader("primary")))
+	calls := primary.calls
+	testutil.Equals(t, "primary", readAll(t, fb, "b"))
+	testutil.Equals(t, calls+1, primary.calls)
+
+	exists, err := fb.Exists(ctx, "b")
+	testutil.Ok(t, err)
+	testutil.Assert(t, exists, "expected object of primary bucket to exist")
+
+	_, err = fb.Get(ctx, "c")
+	testutil.Assert(t, fb.IsObjNotFoundErr(err), "expected not found error of primary bucket, got %v", err)
+
+	primary.failures = 1
+	_, err = fb.Get(ctx, "c")
+	testutil.Equals(t, unavailable, errors.Cause(err))
+
+	// Once the cooldown is over, reads go to the primary bucket again.
+	*fb.primaryDownUntil = time.Now()
+	calls = primary.calls
+	testutil.Equals(t, "primary", readAll(t, fb, "a"))
+	testutil.Equals(t, calls+1, primary.calls)
+}
+
+func names(t *testing.T, bkt objstore.Bucket) []string {
+	t.Helper()
+
+	var names []string
+	testutil.Ok(t, bkt.Iter(context.Background(), "", func(name string) error {
+		names = append(names, name)
+		return nil
+	}))
+	return names
+}
+
+func TestParseBucketConfig_Failover(t *testing.T) {
+	conf, err := ParseBucketConfig([]byte(`type: FILESYSTEM
+config:
+  directory: /tmp/primary
+failover:
+  secondaries:
+  - type: FILESYSTEM
+    config:
+      directory: /tmp/secondary
+  primary_cooldown: 5m
+`))
+	testutil.Ok(t, err)
+	testutil.Equals(t, 1, len(conf.Failover.Secondaries))
+	testutil.Equals(t, 5*time.Minute, conf.Failover.PrimaryCooldown)
+
+	_, err = ParseBucketConfig([]byte(`type: FILESYSTEM
+failover:
+  secondaries:
+  - config:
+      directory: /tmp/secondary
+`))
+	testutil.NotOk(t, err)
+}
+
+func TestNewBucket_Failover(t *testing.T) {
+	ctx := context.Background()
+	primaryDir, secondaryDir := t.TempDir(), t.TempDir()
+
+	bkt, err := NewBucket(log.NewNopLogger(), prometheus.NewRegistry(), []byte(`type: FILESYSTEM
+config:
+  directory: `+primaryDir+`
+failover:
+  secondaries:
+  - type: FILESYSTEM
+    config:
+      directory: `+secondaryDir+`
+`), "test")
+	testutil.Ok(t, err)
+	defer func() { testutil.Ok(t, bkt.Close()) }()
+
+	testutil.Ok(t, bkt.Upload(ctx, "a", strings.NewReader("a")))
+	exists, err := bkt.Exists(ctx, "a")
+	testutil.Ok(t, err)
+	testutil.Assert(t, exists)
+
+	fb, ok := bkt.(*FailoverBucket)
+	testutil.Assert(t, ok, "expected failover bucket, got %T", bkt)
+	testutil.Equals(t, 0, len(names(t, fb.secondaries[0])))
+}
@@ -0,0 +1,44 @@
+// Copyright (c) The Thanos Authors.
+// Licensed under the Apache License 2.0.
+
+// Package objcopy copies objects within a bucket. It is kept apart from extobjstore, so that packages copying objects
+// do not depend on the objstore client and all the provider SDKs it imports.
+package objcopy
+
+import (
+	"context"
+
+	"github.com/pkg/errors"
+	"github.com/thanos-io/objstore"
+
+	"github.com/thanos-io/thanos/pkg/runutil"
+)
+
+// Copier is implemented by buckets able to copy objects within the bucket on the
+// provider side, without downloading and uploading their content.
+type Copier interface {
+	// Copy copies the object src to dst, overwriting dst if it exists.
+	Copy(ctx context.Context, src, dst string) error
+}
+
+// Copy copies the object src to dst within bkt. It uses server-side copy if bkt implements
+// Copier and falls back to downloading and uploading the object otherwise.
+//
+// Buckets wrapped for instrumentation do not implement Copier, so the bucket returned by
+// extobjstore.NewBucket should be passed to benefit from server-side copy.
+func Copy(ctx context.Context, bkt objstore.Bucket, src, dst string) (err error) {
+	if c, ok := bkt.(Copier); ok {
+		return c.Copy(ctx, src, dst)
+	}
+
+	rc, err := bkt.Get(ctx, src)
+	if err != nil {
+		return errors.Wrapf(err, "get %s", src)
+	}
+	defer runutil.CloseWithErrCapture(&err, rc, "close %s", src)
+
+	if err := bkt.Upload(ctx, dst, rc); err != nil {
+		return errors.Wrapf(err, "upload %s", dst)
+	}
+	return nil
+}
@@ -0,0 +1,53 @@
+// Copyright (c) The Thanos Authors.
+// Licensed under the Apache License 2.0.
+
+package objcopy
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/efficientgo/core/testutil"
+
+	"github.com/thanos-io/objstore"
+)
+
+type copyingBucket struct {
+	*objstore.InMemBucket
+
+	copies int
+}
+
+func (b *copyingBucket) Copy(ctx context.Context, src, dst string) error {
+	b.copies++
+	rc, err := b.Get(ctx, src)
+	if err != nil {
+		return err
+	}
+	defer rc.Close()
+	return b.Upload(ctx, dst, rc)
+}
+
+func TestCopy(t *testing.T) {
+	ctx := context.Background()
+
+	t.Run("fallback", func(t *testing.T) {
+		bkt := objstore.NewInMemBucket()
+		testutil.Ok(t, bkt.Upload(ctx, "a/index", strings.NewReader("index")))
+		testutil.Ok(t, Copy(ctx, bkt, "a/index", "b/index"))
+		testutil.Equals(t, "index", string(bkt.Objects()["b/index"]))
+
+		err := Copy(ctx, bkt, "c/index", "d/index")
+		testutil.NotOk(t, err)
+		testutil.Assert(t, bkt.IsObjNotFoundErr(err), "expected not found error, got %v", err)
+	})
+
+	t.Run("server-side copy", func(t *testing.T) {
+		bkt := &copyingBucket{InMemBucket: objstore.NewInMemBucket()}
+		testutil.Ok(t, bkt.Upload(ctx, "a/index", strings.NewReader("index")))
+		testutil.Ok(t, Copy(ctx, bkt, "a/index", "b/index"))
+		testutil.Equals(t, 1, bkt.copies)
+		testutil.Equals(t, "index", string(bkt.Objects()["b/index"]))
+	})
+}
@@ -0,0 +1,144 @@
+// Copyright (c) The Thanos Authors.
+// Licensed under the Apache License 2.0.
+
+package extobjstore
+
+import (
+	"context"
+	"io"
+	"strings"
+
+	"github.com/go-kit/log"
+	"github.com/go-kit/log/level"
+	"github.com/pkg/errors"
+
+	"github.com/thanos-io/objstore"
+
+	"github.com/thanos-io/thanos/pkg/extobjstore/objcopy"
+)
+
+// PrefixRewriteConfig configures rewriting the prefix of object keys, e.g. to keep accessing objects by their old
+// keys while they are migrated under a new prefix.
+type PrefixRewriteConfig struct {
+	// Rules are tried in order, the first rule whose From prefix matches a key rewrites it.
+	Rules []PrefixRewriteRule `yaml:"rules"`
+	// ReadOnly only rewrites the keys of reads, so that uploads, deletes and copy destinations keep using
+	// the original keys.
+	ReadOnly bool `yaml:"read_only"`
+}
+
+// PrefixRewriteRule rewrites keys starting with From to start with To instead.
+type PrefixRewriteRule struct {
+	From string `yaml:"from"`
+	To   string `yaml:"to"`
+}
+
+func (c PrefixRewriteConfig) validate() error {
+	for i, r := range c.Rules {
+		if r.From == "" {
+			return errors.Errorf("no prefix to rewrite specified for rule %d, use the prefix of the bucket configuration to move all objects", i)
+		}
+		if r.From == r.To {
+			return errors.Errorf("rule %d rewrites prefix %q to itself", i, r.From)
+		}
+	}
+	return nil
+}
+
+// PrefixRewriteBucket is a bucket rewriting the prefix of object keys according to rules before passing them to
+// the underlying bucket. Rewrites are logged at debug level.
+type PrefixRewriteBucket struct {
+	objstore.Bucket
+
+	logger log.Logger
+	conf   PrefixRewriteConfig
+}
+
+func wrapWithPrefixRewrite(logger log.Logger, bkt objstore.Bucket, conf PrefixRewriteConfig) objstore.Bucket {
+	if len(conf.Rules) == 0 {
+		return bkt
+	}
+	return NewPrefixRewriteBucket(logger, bkt, conf)
+}
+
+// NewPrefixRewriteBucket returns a bucket rewriting the keys of the operations of bkt according to conf.
+func NewPrefixRewriteBucket(logger log.Logger, bkt objstore.Bucket, conf PrefixRewriteConfig) *PrefixRewriteBucket {
+	return &PrefixRewriteBucket{Bucket: bkt, logger: logger, conf: conf}
+}
+
+// rewrite returns the key of name in the underlying bucket and the rule which rewrote it, if any.
+func (b *PrefixRewriteBucket) rewrite(op, name string) (string, *PrefixRewriteRule) {
+	for i, r := range b.conf.Rules {
+		if !strings.HasPrefix(name, r.From) {
+			continue
+		}
+		rewritten := r.To + strings.TrimPrefix(name, r.From)
+		level.Debug(b.logger).Log("msg", "rewrote object key prefix", "bucket", b.Name(), "operation", op, "key", name, "rewritten_key", rewritten)
+		return rewritten, &b.conf.Rules[i]
+	}
+	return name, nil
+}
+
+// rewriteWrite returns the key of name in the underlying bucket for writes.
+func (b *PrefixRewriteBucket) rewriteWrite(op, name string) string {
+	if b.conf.ReadOnly {
+		return name
+	}
+	rewritten, _ := b.rewrite(op, name)
+	return rewritten
+}
+
+// Iter calls f for each entry in the given directory. Entries of a rewritten directory are passed to f with the
+// prefix of the directory before the rewrite, so that they can be accessed by the same keys.
+func (b *PrefixRewriteBucket) Iter(ctx context.Context, dir string, f func(string) error, options ...objstore.IterOption) error {
+	rewritten, rule := b.rewrite(objstore.OpIter, dir)
+	if rule == nil {
+		return b.Bucket.Iter(ctx, dir, f, options...)
+	}
+	return b.Bucket.Iter(ctx, rewritten, func(name string) error {
+		if strings.HasPrefix(name, rule.To) {
+			name = rule.From + strings.TrimPrefix(name, rule.To)
+		}
+		return f(name)
+	}, options...)
+}
+
+// Get returns a reader for the given object name.
+func (b *PrefixRewriteBucket) Get(ctx context.Context, name string) (io.ReadCloser, error) {
+	name, _ = b.rewrite(objstore.OpGet, name)
+	return b.Bucket.Get(ctx, name)
+}
+
+// GetRange returns a new range reader for the given object name and range.
+func (b *PrefixRewriteBucket) GetRange(ctx context.Context, name string, off, length int64) (io.ReadCloser, error) {
+	name, _ = b.rewrite(objstore.OpGetRange, name)
+	return b.Bucket.GetRange(ctx, name, off, length)
+}
+
+// Exists checks if the given object exists in the bucket.
+func (b *PrefixRewriteBucket) Exists(ctx context.Context, name string) (bool, error) {
+	name, _ = b.rewrite(objstore.OpExists, name)
+	return b.Bucket.Exists(ctx, name)
+}
+
+// Attributes returns information about the specified object.
+func (b *PrefixRewriteBucket) Attributes(ctx context.Context, name string) (objstore.ObjectAttributes, error) {
+	name, _ = b.rewrite(objstore.OpAttributes, name)
+	return b.Bucket.Attributes(ctx, name)
+}
+
+// Upload the contents of the reader as an object into the bucket. The key is not rewritten in read-only mode.
+func (b *PrefixRewriteBucket) Upload(ctx context.Context, name string, r io.Reader) error {
+	return b.Bucket.Upload(ctx, b.rewriteWrite(objstore.OpUpload, name), r)
+}
+
+// Delete removes the object with the given name. The key is not rewritten in read-only mode.
+func (b *PrefixRewriteBucket) Delete(ctx context.Context, name string) error {
+	return b.Bucket.Delete(ctx, b.rewriteWrite(objstore.OpDelete, name))
+}
+
+// Copy copies the object src to dst. The key of dst is not rewritten in read-only mode.
+func (b *PrefixRewriteBucket) Copy(ctx context.Context, src, dst string) error {
+	src, _ = b.rewrite(opCopy, src)
+	return objcopy.Copy(ctx, b.Bucket, src, b.rewriteWrite(opCopy, dst))
+}
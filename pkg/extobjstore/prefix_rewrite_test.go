@@ -0,0 +1,128 @@
+// Copyright (c) The Thanos Authors.
+// Licensed under the Apache License 2.0.
+
+package extobjstore
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"strings"
+	"testing"
+
+	"github.com/efficientgo/core/testutil"
+	"github.com/go-kit/log"
+
+	"github.com/thanos-io/objstore"
+)
+
+func TestPrefixRewriteBucket(t *testing.T) {
+	ctx := context.Background()
+
+	newBucket := func(readOnly bool) (*objstore.InMemBucket, *PrefixRewriteBucket) {
+		inmem := objstore.NewInMemBucket()
+		testutil.Ok(t, inmem.Upload(ctx, "new/01A/meta.json", strings.NewReader("meta")))
+		testutil.Ok(t, inmem.Upload(ctx, "new/01A/chunks/000001", strings.NewReader("chunks")))
+		testutil.Ok(t, inmem.Upload(ctx, "other/01B/meta.json", strings.NewReader("other")))
+		return inmem, NewPrefixRewriteBucket(log.NewNopLogger(), inmem, PrefixRewriteConfig{
+			Rules: []PrefixRewriteRule{
+				{From: "old/", To: "new/"},
+				{From: "old", To: "unused"},
+			},
+			ReadOnly: readOnly,
+		})
+	}
+	read := func(t *testing.T, bkt objstore.Bucket, name string) string {
+		rc, err := bkt.Get(ctx, name)
+		testutil.Ok(t, err)
+		defer rc.Close()
+		b, err := io.ReadAll(rc)
+		testutil.Ok(t, err)
+		return string(b)
+	}
+
+	t.Run("reads", func(t *testing.T) {
+		_, bkt := newBucket(false)
+
+		testutil.Equals(t, "meta", read(t, bkt, "old/01A/meta.json"))
+		testutil.Equals(t, "other", read(t, bkt, "other/01B/meta.json"))
+
+		rc, err := bkt.GetRange(ctx, "old/01A/chunks/000001", 1, 2)
+		testutil.Ok(t, err)
+		b, err := io.ReadAll(rc)
+		testutil.Ok(t, err)
+		testutil.Ok(t, rc.Close())
+		testutil.Equals(t, "hu", string(b))
+
+		exists, err := bkt.Exists(ctx, "old/01A/meta.json")
+		testutil.Ok(t, err)
+		testutil.Assert(t, exists)
+
+		attrs, err := bkt.Attributes(ctx, "old/01A/meta.json")
+		testutil.Ok(t, err)
+		testutil.Equals(t, int64(4), attrs.Size)
+
+		// Entries are listed by their keys before the rewrite.
+		var names []string
+		testutil.Ok(t, bkt.Iter(ctx, "old/01A/", func(name string) error {
+			names = append(names, name)
+			return nil
+		}, objstore.WithRecursiveIter))
+		testutil.Equals(t, []string{"old/01A/chunks/000001", "old/01A/meta.json"}, names)
+
+		names = nil
+		testutil.Ok(t, bkt.Iter(ctx, "", func(name string) error {
+			names = append(names, name)
+			return nil
+		}))
+		testutil.Equals(t, []string{"new/", "other/"}, names)
+	})
+
+	t.Run("writes", func(t *testing.T) {
+		inmem, bkt := newBucket(false)
+
+		testutil.Ok(t, bkt.Upload(ctx, "old/01C/meta.json", strings.NewReader("uploaded")))
+		testutil.Equals(t, "uploaded", read(t, inmem, "new/01C/meta.json"))
+
+		testutil.Ok(t, bkt.Copy(ctx, "old/01C/meta.json", "old/01D/meta.json"))
+		testutil.Equals(t, "uploaded", read(t, inmem, "new/01D/meta.json"))
+
+		testutil.Ok(t, bkt.Delete(ctx, "old/01A/meta.json"))
+		exists, err := inmem.Exists(ctx, "new/01A/meta.json")
+		testutil.Ok(t, err)
+		testutil.Assert(t, !exists)
+	})
+
+	t.Run("read only", func(t *testing.T) {
+		inmem, bkt := newBucket(true)
+
+		testutil.Equals(t, "meta", read(t, bkt, "old/01A/meta.json"))
+
+		testutil.Ok(t, bkt.Upload(ctx, "old/01C/meta.json", bytes.NewReader([]byte("uploaded"))))
+		testutil.Equals(t, "uploaded", read(t, inmem, "old/01C/meta.json"))
+
+		testutil.Ok(t, bkt.Copy(ctx, "old/01A/meta.json", "old/01D/meta.json"))
+		testutil.Equals(t, "meta", read(t, inmem, "old/01D/meta.json"))
+
+		testutil.Ok(t, bkt.Delete(ctx, "old/01C/meta.json"))
+		exists, err := inmem.Exists(ctx, "old/01C/meta.json")
+		testutil.Ok(t, err)
+		testutil.Assert(t, !exists)
+	})
+}
+
+func TestPrefixRewriteConfigValidate(t *testing.T) {
+	for _, tc := range []struct {
+		conf PrefixRewriteConfig
+		err  bool
+	}{
+		{conf: PrefixRewriteConfig{}},
+		{conf: PrefixRewriteConfig{Rules: []PrefixRewriteRule{{From: "old/", To: "new/"}}}},
+		{conf: PrefixRewriteConfig{Rules: []PrefixRewriteRule{{From: "old/", To: ""}}}},
+		{conf: PrefixRewriteConfig{Rules: []PrefixRewriteRule{{From: "", To: "new/"}}}, err: true},
+		{conf: PrefixRewriteConfig{Rules: []PrefixRewriteRule{{From: "old/", To: "old/"}}}, err: true},
+	} {
+		err := tc.conf.validate()
+		testutil.Equals(t, tc.err, err != nil, "%v", err)
+	}
+}
@@ -0,0 +1,280 @@
+// Copyright (c) The Thanos Authors.
+// Licensed under the Apache License 2.0.
+
+package extobjstore
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"time"
+
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore"
+	"github.com/jpillora/backoff"
+	"github.com/minio/minio-go/v7"
+	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus"
+	"google.golang.org/api/googleapi"
+
+	"github.com/thanos-io/objstore"
+
+	"github.com/thanos-io/thanos/pkg/extobjstore/objcopy"
+)
+
+// opCopy is the operation label of server-side copies, which are not an objstore operation.
+const opCopy = "copy"
+
+// RetryConfig configures retries of bucket operations failing with a retriable status code.
+//
+// Retries happen on top of the ones done by the provider clients, so that transient errors can
+// be retried for longer, e.g. during regional incidents. Uploads are only retried if their content
+// can be read again from the start, which is the case for files uploaded from disk.
+type RetryConfig struct {
+	// MaxAttempts is the maximum number of attempts of an operation, including the first one.
+	// 0 or 1 disables retries.
+	MaxAttempts int `yaml:"max_attempts"`
+	// MinBackoff is the delay before the first retry, doubled for every following retry.
+	MinBackoff time.Duration `yaml:"min_backoff"`
+	// MaxBackoff is the maximum delay between retries.
+	MaxBackoff time.Duration `yaml:"max_backoff"`
+	// RetriableStatusCodes are the HTTP status codes of errors which are retried. They are
+	// recognized for the S3, GCS and Azure providers.
+	RetriableStatusCodes []int `yaml:"retriable_status_codes"`
+}
+
+var defaultRetriableStatusCodes = []int{
+	http.StatusInternalServerError,
+	http.StatusBadGateway,
+	http.StatusServiceUnavailable,
+	http.StatusGatewayTimeout,
+}
+
+func (c *RetryConfig) applyDefaults() {
+	if c.MinBackoff == 0 {
+		c.MinBackoff = 100 * time.Millisecond
+	}
+	if c.MaxBackoff == 0 {
+		c.MaxBackoff = max(10*time.Second, c.MinBackoff)
+	}
+	if len(c.RetriableStatusCodes) == 0 {
+		c.RetriableStatusCodes = defaultRetriableStatusCodes
+	}
+}
+
+func (c RetryConfig) validate() error {
+	if c.MaxAttempts < 0 {
+		return errors.New("max attempts must not be negative")
+	}
+	if c.MinBackoff < 0 || c.MaxBackoff < 0 {
+		return errors.New("backoff must not be negative")
+	}
+	if c.MaxBackoff != 0 && c.MaxBackoff < c.MinBackoff {
+		return errors.New("max backoff must not be lower than min backoff")
+	}
+	return nil
+}
+
+// RetryBucket is a bucket retrying operations failing with a retriable status code.
+type RetryBucket struct {
+	objstore.Bucket
+
+	conf      RetryConfig
+	retriable map[int]struct{}
+	retries   *prometheus.CounterVec
+}
+
+func wrapWithRetry(bkt objstore.Bucket, reg prometheus.Registerer, conf RetryConfig) objstore.Bucket {
+	if conf.MaxAttempts <= 1 {
+		return bkt
+	}
+	return NewRetryBucket(bkt, reg, conf)
+}
+
+// NewRetryBucket returns a bucket retrying the operations of bkt according to conf.
+func NewRetryBucket(bkt objstore.Bucket, reg prometheus.Registerer, conf RetryConfig) *RetryBucket {
+	conf.applyDefaults()
+	rb := &RetryBucket{
+		Bucket:    bkt,
+		conf:      conf,
+		retriable: make(map[int]struct{}, len(conf.RetriableStatusCodes)),
+		retries:   registerRetriesMetric(reg),
+	}
+	for _, code := range conf.RetriableStatusCodes {
+		rb.retriable[code] = struct{}{}
+	}
+	return rb
+}
+
+// registerRetriesMetric registers the retries metric, reusing the one of another bucket of the same
+// process if any, e.g. the source and target buckets of a replication.
+func registerRetriesMetric(reg prometheus.Registerer) *prometheus.CounterVec {
+	retries := prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "thanos_objstore_bucket_operation_retries_total",
+		Help: "Total number of bucket operations retried after failing with a retriable error.",
+	}, []string{"bucket", "operation"})
+	if reg == nil {
+		return retries
+	}
+	if err := reg.Register(retries); err != nil {
+		if are, ok := err.(prometheus.AlreadyRegisteredError); ok {
+			return are.ExistingCollector.(*prometheus.CounterVec)
+		}
+		panic(err)
+	}
+	return retries
+}
+
+// isRetriable returns true if err was caused by a response with a retriable status code.
+func (rb *RetryBucket) isRetriable(err error) bool {
+	var (
+		s3Err    minio.ErrorResponse
+		gcsErr   *googleapi.Error
+		azureErr *azcore.ResponseError
+		code     int
+	)
+	switch {
+	case errors.As(err, &s3Err):
+		code = s3Err.StatusCode
+	case errors.As(err, &gcsErr):
+		code = gcsErr.Code
+	case errors.As(err, &azureErr):
+		code = azureErr.StatusCode
+	default:
+		return false
+	}
+	_, ok := rb.retriable[code]
+	return ok
+}
+
+// do calls f until it succeeds, fails with an error which is not retriable or the maximum number
+// of attempts is reached. retry is called before every retry and aborts retrying if it returns false.
+func (rb *RetryBucket) do(ctx context.Context, op string, f func() error, retry func() bool) error {
+	bo := backoff.Backoff{Min: rb.conf.MinBackoff, Max: rb.conf.MaxBackoff, Factor: 2, Jitter: true}
+	for attempt := 1; ; attempt++ {
+		err := f()
+		if err == nil || attempt >= rb.conf.MaxAttempts || !rb.isRetriable(err) {
+			return err
+		}
+		if retry != nil && !retry() {
+			return err
+		}
+
+		select {
+		case <-ctx.Done():
+			return err
+		case <-time.After(bo.Duration()):
+		}
+		rb.retries.WithLabelValues(rb.Name(), op).Inc()
+	}
+}
+
+// Upload the contents of the reader as an object into the bucket. Failed uploads are only retried
+// if r is an io.Seeker, since the content already read by a failed attempt cannot be read again otherwise.
+func (rb *RetryBucket) Upload(ctx context.Context, name string, r io.Reader) error {
+	seeker, ok := r.(io.Seeker)
+	if !ok {
+		return rb.Bucket.Upload(ctx, name, r)
+	}
+	start, err := seeker.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return rb.Bucket.Upload(ctx, name, r)
+	}
+
+	var seekErr error
+	err = rb.do(ctx, objstore.OpUpload, func() error {
+		return rb.Bucket.Upload(ctx, name, r)
+	}, func() bool {
+		_, seekErr = seeker.Seek(start, io.SeekStart)
+		return seekErr == nil
+	})
+	if seekErr != nil {
+		return errors.Wrapf(err, "rewind content of %s to retry upload: %v", name, seekErr)
+	}
+	return err
+}
+
+// Delete removes the object with the given name. If a failed attempt deleted the object anyway,
+// the retries succeed.
+func (rb *RetryBucket) Delete(ctx context.Context, name string) error {
+	retried := false
+	return rb.do(ctx, objstore.OpDelete, func() error {
+		err := rb.Bucket.Delete(ctx, name)
+		if retried && rb.IsObjNotFoundErr(err) {
+			return nil
+		}
+		return err
+	}, func() bool {
+		retried = true
+		return true
+	})
+}
+
+// Iter calls f for each entry in the given directory. The iteration is only retried if it failed
+// before f was called, so that no entry is passed twice to f.
+func (rb *RetryBucket) Iter(ctx context.Context, dir string, f func(string) error, options ...objstore.IterOption) error {
+	called := false
+	return rb.do(ctx, objstore.OpIter, func() error {
+		return rb.Bucket.Iter(ctx, dir, func(name string) error {
+			called = true
+			return f(name)
+		}, options...)
+	}, func() bool {
+		return !called
+	})
+}
+
+// Get returns a reader for the given object name.
+func (rb *RetryBucket) Get(ctx context.Context, name string) (rc io.ReadCloser, err error) {
+	err = rb.do(ctx, objstore.OpGet, func() error {
+		rc, err = rb.Bucket.Get(ctx, name)
+		return err
+	}, nil)
+	return rc, err
+}
+
+// GetRange returns a new range reader for the given object name and range.
+func (rb *RetryBucket) GetRange(ctx context.Context, name string, off, length int64) (rc io.ReadCloser, err error) {
+	err = rb.do(ctx, objstore.OpGetRange, func() error {
+		rc, err = rb.Bucket.GetRange(ctx, name, off, length)
+		return err
+	}, nil)
+	return rc, err
+}
+
+// Exists checks if the given object exists in the bucket.
+func (rb *RetryBucket) Exists(ctx context.Context, name string) (exists bool, err error) {
+	err = rb.do(ctx, objstore.OpExists, func() error {
+		exists, err = rb.Bucket.Exists(ctx, name)
+		return err
+	}, nil)
+	return exists, err
+}
+
+// Attributes returns information about the specified object.
+func (rb *RetryBucket) Attributes(ctx context.Context, name string) (attrs objstore.ObjectAttributes, err error) {
+	err = rb.do(ctx, objstore.OpAttributes, func() error {
+		attrs, err = rb.Bucket.Attributes(ctx, name)
+		return err
+	}, nil)
+	return attrs, err
+}
+
+// Copy copies the object src to dst, using server-side copy if the wrapped bucket supports it.
+func (rb *RetryBucket) Copy(ctx context.Context, src, dst string) error {
+	return rb.do(ctx, opCopy, func() error {
+		return objcopy.Copy(ctx, rb.Bucket, src, dst)
+	}, nil)
+}
+
+// ReaderWithExpectedErrs implements objstore.InstrumentedBucket.
+func (rb *RetryBucket) ReaderWithExpectedErrs(fn objstore.IsOpFailureExpectedFunc) objstore.BucketReader {
+	return rb.WithExpectedErrs(fn)
+}
+
+// WithExpectedErrs implements objstore.InstrumentedBucket.
+func (rb *RetryBucket) WithExpectedErrs(fn objstore.IsOpFailureExpectedFunc) objstore.Bucket {
+	if ib, ok := rb.Bucket.(objstore.InstrumentedBucket); ok {
+		return &RetryBucket{Bucket: ib.WithExpectedErrs(fn), conf: rb.conf, retriable: rb.retriable, retries: rb.retries}
+	}
+	return rb
+}
@@ -0,0 +1,185 @@
+// Copyright (c) The Thanos Authors.
+// Licensed under the Apache License 2.0.
+
+package extobjstore
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/efficientgo/core/testutil"
+	"github.com/minio/minio-go/v7"
+	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus"
+	promtest "github.com/prometheus/client_golang/prometheus/testutil"
+	"google.golang.org/api/googleapi"
+
+	"github.com/thanos-io/objstore"
+)
+
+// flakyBucket fails the first operations with the given error.
+type flakyBucket struct {
+	*objstore.InMemBucket
+
+	failures int
+	err      error
+	calls    int
+}
+
+func (b *flakyBucket) fail() error {
+	b.calls++
+	if b.failures > 0 {
+		b.failures--
+		return b.err
+	}
+	return nil
+}
+
+func (b *flakyBucket) Upload(ctx context.Context, name string, r io.Reader) error {
+	if err := b.fail(); err != nil {
+		// Consume part of the content like a failed upload would.
+		_, _ = io.CopyN(io.Discard, r, 2)
+		return err
+	}
+	return b.InMemBucket.Upload(ctx, name, r)
+}
+
+func (b *flakyBucket) Delete(ctx context.Context, name string) error {
+	err := b.InMemBucket.Delete(ctx, name)
+	if ferr := b.fail(); ferr != nil {
+		// The object was deleted, but the response was lost.
+		return ferr
+	}
+	return err
+}
+
+func (b *flakyBucket) Get(ctx context.Context, name string) (io.ReadCloser, error) {
+	if err := b.fail(); err != nil {
+		return nil, err
+	}
+	return b.InMemBucket.Get(ctx, name)
+}
+
+func (b *flakyBucket) Exists(ctx context.Context, name string) (bool, error) {
+	if err := b.fail(); err != nil {
+		return false, err
+	}
+	return b.InMemBucket.Exists(ctx, name)
+}
+
+func (b *flakyBucket) Attributes(ctx context.Context, name string) (objstore.ObjectAttributes, error) {
+	if err := b.fail(); err != nil {
+		return objstore.ObjectAttributes{}, err
+	}
+	return b.InMemBucket.Attributes(ctx, name)
+}
+
+func (b *flakyBucket) Iter(ctx context.Context, dir string, f func(string) error, options ...objstore.IterOption) error {
+	return b.InMemBucket.Iter(ctx, dir, func(name string) error {
+		if err := f(name); err != nil {
+			return err
+		}
+		return b.fail()
+	}, options...)
+}
+
+func TestRetryBucket(t *testing.T) {
+	ctx := context.Background()
+	unavailable := errors.Wrap(minio.ErrorResponse{StatusCode: http.StatusServiceUnavailable}, "upload")
+	conf := RetryConfig{MaxAttempts: 3, MinBackoff: time.Millisecond, MaxBackoff: time.Millisecond}
+
+	newBucket := func(failures int, err error) (*flakyBucket, *RetryBucket) {
+		inner := &flakyBucket{InMemBucket: objstore.NewInMemBucket(), failures: failures, err: err}
+		return inner, NewRetryBucket(inner, prometheus.NewRegistry(), conf)
+	}
+
+	t.Run("seekable uploads are retried from the start", func(t *testing.T) {
+		inner, bkt := newBucket(2, unavailable)
+		testutil.Ok(t, bkt.Upload(ctx, "a", strings.NewReader("content")))
+		testutil.Equals(t, 3, inner.calls)
+		testutil.Equals(t, "content", string(inner.Objects()["a"]))
+		testutil.Equals(t, 2.0, promtest.ToFloat64(bkt.retries.WithLabelValues(bkt.Name(), objstore.OpUpload)))
+	})
+
+	t.Run("non seekable uploads are not retried", func(t *testing.T) {
+		inner, bkt := newBucket(1, unavailable)
+		testutil.NotOk(t, bkt.Upload(ctx, "a", io.LimitReader(strings.NewReader("content"), 7)))
+		testutil.Equals(t, 1, inner.calls)
+	})
+
+	t.Run("attempts are limited", func(t *testing.T) {
+		inner, bkt := newBucket(3, unavailable)
+		testutil.Ok(t, inner.InMemBucket.Upload(ctx, "a", strings.NewReader("content")))
+		_, err := bkt.Get(ctx, "a")
+		testutil.NotOk(t, err)
+		testutil.Equals(t, 3, inner.calls)
+	})
+
+	t.Run("only retriable status codes are retried", func(t *testing.T) {
+		for _, err := range []error{
+			errors.New("not a provider error"),
+			minio.ErrorResponse{StatusCode: http.StatusForbidden},
+			&googleapi.Error{Code: http.StatusNotImplemented},
+		} {
+			inner, bkt := newBucket(1, err)
+			testutil.NotOk(t, bkt.Upload(ctx, "a", strings.NewReader("content")))
+			testutil.Equals(t, 1, inner.calls)
+		}
+
+		inner, bkt := newBucket(1, &googleapi.Error{Code: http.StatusBadGateway})
+		testutil.Ok(t, bkt.Upload(ctx, "a", strings.NewReader("content")))
+		testutil.Equals(t, 2, inner.calls)
+	})
+
+	t.Run("deletes succeed if a failed attempt deleted the object", func(t *testing.T) {
+		inner, bkt := newBucket(1, unavailable)
+		testutil.Ok(t, inner.InMemBucket.Upload(ctx, "a", strings.NewReader("content")))
+		testutil.Ok(t, bkt.Delete(ctx, "a"))
+		testutil.Equals(t, 2, inner.calls)
+
+		// Deleting a missing object still fails.
+		testutil.NotOk(t, bkt.Delete(ctx, "a"))
+	})
+
+	t.Run("iterations are not retried once entries were passed", func(t *testing.T) {
+		inner, bkt := newBucket(1, unavailable)
+		testutil.Ok(t, inner.InMemBucket.Upload(ctx, "a", strings.NewReader("content")))
+		var names []string
+		testutil.NotOk(t, bkt.Iter(ctx, "", func(name string) error {
+			names = append(names, name)
+			return nil
+		}))
+		testutil.Equals(t, []string{"a"}, names)
+	})
+}
+
+func TestParseBucketConfig_Retry(t *testing.T) {
+	conf, err := ParseBucketConfig([]byte(`type: FILESYSTEM
+config:
+  directory: /tmp/thanos
+retry:
+  max_attempts: 5
+  min_backoff: 1s
+  max_backoff: 1m
+  retriable_status_codes: [429, 503]
+`))
+	testutil.Ok(t, err)
+	testutil.Equals(t, RetryConfig{
+		MaxAttempts:          5,
+		MinBackoff:           time.Second,
+		MaxBackoff:           time.Minute,
+		RetriableStatusCodes: []int{429, 503},
+	}, conf.Retry)
+
+	_, err = ParseBucketConfig([]byte(`type: FILESYSTEM
+retry:
+  max_attempts: 5
+  min_backoff: 1m
+  max_backoff: 1s
+`))
+	testutil.NotOk(t, err)
+}
@@ -0,0 +1,252 @@
+// Copyright (c) The Thanos Authors.
+// Licensed under the Apache License 2.0.
+
+package extobjstore
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/secretsmanager"
+	"github.com/pkg/errors"
+	yamlv3 "gopkg.in/yaml.v3"
+)
+
+// secretResolveTimeout bounds the time spent resolving all secret references of a configuration.
+const secretResolveTimeout = time.Minute
+
+// secretReferenceRe matches references to secrets of a secret manager, e.g. ${vault:secret/data/thanos#secret_key}
+// or ${aws-sm:thanos/objstore#secret_key}. The key is the field of the secret to use, and can be omitted for secrets
+// of AWS Secrets Manager which are plain strings.
+var secretReferenceRe = regexp.MustCompile(`\$\{(vault|aws-sm):([^}#]+)(?:#([^}]+))?\}`)
+
+// SecretResolver resolves secrets of a secret manager.
+type SecretResolver interface {
+	// Resolve returns the value of the field key of the secret at path. key is empty if the reference has no key.
+	Resolve(ctx context.Context, path, key string) (string, error)
+}
+
+// DefaultSecretResolvers are the secret managers supported in secret references, by reference scheme.
+// Their clients are configured from the environment, see NewVaultSecretResolver and NewAWSSecretsManagerResolver.
+var DefaultSecretResolvers = map[string]func() (SecretResolver, error){
+	"vault":  NewVaultSecretResolver,
+	"aws-sm": NewAWSSecretsManagerResolver,
+}
+
+// ResolveSecrets replaces the secret references in the string values of the YAML configuration with the secrets
+// they refer to. Configurations without secret references are returned as is. Errors only name the failing
+// reference, never the value of a secret.
+func ResolveSecrets(confContentYaml []byte, resolvers map[string]func() (SecretResolver, error)) ([]byte, error) {
+	if !secretReferenceRe.Match(confContentYaml) {
+		return confContentYaml, nil
+	}
+
+	var root yamlv3.Node
+	if err := yamlv3.Unmarshal(confContentYaml, &root); err != nil {
+		return nil, errors.Wrap(err, "parsing config YAML file")
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), secretResolveTimeout)
+	defer cancel()
+
+	var (
+		clients  = map[string]SecretResolver{}
+		resolved = map[string]string{}
+	)
+	resolve := func(ref string) (string, error) {
+		if v, ok := resolved[ref]; ok {
+			return v, nil
+		}
+		m := secretReferenceRe.FindStringSubmatch(ref)
+		scheme, path, key := m[1], m[2], m[3]
+		client, ok := clients[scheme]
+		if !ok {
+			newResolver, ok := resolvers[scheme]
+			if !ok {
+				return "", errors.Errorf("unsupported secret manager %s", scheme)
+			}
+			var err error
+			if client, err = newResolver(); err != nil {
+				return "", errors.Wrapf(err, "create %s client", scheme)
+			}
+			clients[scheme] = client
+		}
+		v, err := client.Resolve(ctx, path, key)
+		if err != nil {
+			return "", err
+		}
+		resolved[ref] = v
+		return v, nil
+	}
+
+	if err := resolveSecretsInNode(&root, resolve); err != nil {
+		return nil, err
+	}
+
+	var b bytes.Buffer
+	enc := yamlv3.NewEncoder(&b)
+	if err := enc.Encode(&root); err != nil {
+		return nil, errors.Wrap(err, "marshal config with resolved secrets")
+	}
+	if err := enc.Close(); err != nil {
+		return nil, errors.Wrap(err, "marshal config with resolved secrets")
+	}
+	return b.Bytes(), nil
+}
+
+func resolveSecretsInNode(n *yamlv3.Node, resolve func(string) (string, error)) error {
+	if n.Kind == yamlv3.ScalarNode {
+		if !secretReferenceRe.MatchString(n.Value) {
+			return nil
+		}
+		var err error
+		n.Value = secretReferenceRe.ReplaceAllStringFunc(n.Value, func(ref string) string {
+			if err != nil {
+				return ""
+			}
+			var v string
+			if v, err = resolve(ref); err != nil {
+				err = errors.Wrapf(err, "resolve secret reference %s", ref)
+			}
+			return v
+		})
+		// Secrets are strings, even if they look like numbers or booleans.
+		n.Tag, n.Style = "!!str", yamlv3.DoubleQuotedStyle
+		return err
+	}
+	for _, c := range n.Content {
+		if err := resolveSecretsInNode(c, resolve); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// secretField returns the field key of a secret stored as JSON object, or the whole secret if key is empty.
+func secretField(secret, key string) (string, error) {
+	if key == "" {
+		return secret, nil
+	}
+	var fields map[string]interface{}
+	if err := json.Unmarshal([]byte(secret), &fields); err != nil {
+		return "", errors.Errorf("secret is not a JSON object, cannot get key %s", key)
+	}
+	return secretFieldOf(fields, key)
+}
+
+func secretFieldOf(fields map[string]interface{}, key string) (string, error) {
+	v, ok := fields[key]
+	if !ok {
+		return "", errors.Errorf("secret has no key %s", key)
+	}
+	s, ok := v.(string)
+	if !ok {
+		return "", errors.Errorf("key %s of secret is not a string", key)
+	}
+	return s, nil
+}
+
+// VaultSecretResolver resolves secrets of the key/value secrets engines of HashiCorp Vault.
+type VaultSecretResolver struct {
+	addr      string
+	token     string
+	namespace string
+	client    *http.Client
+}
+
+// NewVaultSecretResolver returns a resolver of secrets of the Vault server at VAULT_ADDR, authenticating with
+// VAULT_TOKEN and using the namespace VAULT_NAMESPACE, if set.
+func NewVaultSecretResolver() (SecretResolver, error) {
+	addr, token := os.Getenv("VAULT_ADDR"), os.Getenv("VAULT_TOKEN")
+	if addr == "" || token == "" {
+		return nil, errors.New("VAULT_ADDR and VAULT_TOKEN must be set to resolve Vault secrets")
+	}
+	return &VaultSecretResolver{
+		addr:      strings.TrimSuffix(addr, "/"),
+		token:     token,
+		namespace: os.Getenv("VAULT_NAMESPACE"),
+		client:    &http.Client{},
+	}, nil
+}
+
+// Resolve reads the secret at the API path of the secret, e.g. secret/data/thanos for a secret of a KV version 2
+// engine mounted at secret/, and returns the field key of its data. The key is required.
+func (r *VaultSecretResolver) Resolve(ctx context.Context, path, key string) (string, error) {
+	if key == "" {
+		return "", errors.New("the key of Vault secrets is required")
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, fmt.Sprintf("%s/v1/%s", r.addr, strings.TrimPrefix(path, "/")), nil)
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("X-Vault-Token", r.token)
+	if r.namespace != "" {
+		req.Header.Set("X-Vault-Namespace", r.namespace)
+	}
+	resp, err := r.client.Do(req)
+	if err != nil {
+		return "", errors.Wrap(err, "read secret")
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return "", errors.Wrap(err, "read secret")
+	}
+	if resp.StatusCode != http.StatusOK {
+		// Error responses of Vault do not contain secrets.
+		return "", errors.Errorf("read secret: unexpected status %s: %s", resp.Status, strings.TrimSpace(string(body)))
+	}
+
+	var secret struct {
+		Data map[string]interface{} `json:"data"`
+	}
+	if err := json.Unmarshal(body, &secret); err != nil {
+		return "", errors.Wrap(err, "decode secret")
+	}
+	// Secrets of KV version 2 engines nest their data along with their metadata.
+	if data, ok := secret.Data["data"].(map[string]interface{}); ok {
+		if _, ok := secret.Data["metadata"]; ok {
+			return secretFieldOf(data, key)
+		}
+	}
+	return secretFieldOf(secret.Data, key)
+}
+
+// AWSSecretsManagerResolver resolves secrets of AWS Secrets Manager.
+type AWSSecretsManagerResolver struct {
+	client *secretsmanager.SecretsManager
+}
+
+// NewAWSSecretsManagerResolver returns a resolver of secrets of AWS Secrets Manager, configured like the AWS CLI,
+// e.g. with AWS_REGION and the default credential chain.
+func NewAWSSecretsManagerResolver() (SecretResolver, error) {
+	sess, err := session.NewSessionWithOptions(session.Options{SharedConfigState: session.SharedConfigEnable})
+	if err != nil {
+		return nil, err
+	}
+	return &AWSSecretsManagerResolver{client: secretsmanager.New(sess)}, nil
+}
+
+// Resolve returns the current value of the secret with the name or ARN path. If key is set, the secret must be
+// a JSON object and the value of its field key is returned.
+func (r *AWSSecretsManagerResolver) Resolve(ctx context.Context, path, key string) (string, error) {
+	out, err := r.client.GetSecretValueWithContext(ctx, &secretsmanager.GetSecretValueInput{SecretId: aws.String(path)})
+	if err != nil {
+		return "", errors.Wrap(err, "get secret value")
+	}
+	if out.SecretString == nil {
+		return "", errors.New("secret is binary, only string secrets are supported")
+	}
+	return secretField(*out.SecretString, key)
+}
@@ -0,0 +1,140 @@
+// Copyright (c) The Thanos Authors.
+// Licensed under the Apache License 2.0.
+
+package extobjstore
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/efficientgo/core/testutil"
+	"github.com/pkg/errors"
+	"gopkg.in/yaml.v2"
+)
+
+type fakeSecretResolver map[string]string
+
+func (r fakeSecretResolver) Resolve(_ context.Context, path, key string) (string, error) {
+	v, ok := r[path+"#"+key]
+	if !ok {
+		return "", errors.Errorf("secret %s not found", path)
+	}
+	return v, nil
+}
+
+func TestResolveSecrets(t *testing.T) {
+	calls := 0
+	resolvers := map[string]func() (SecretResolver, error){
+		"vault": func() (SecretResolver, error) {
+			calls++
+			return fakeSecretResolver{
+				"secret/data/thanos#access_key": "AKIA",
+				"secret/data/thanos#secret_key": "s3cr3t: #not a comment",
+				"secret/data/thanos#port":       "1234",
+			}, nil
+		},
+	}
+
+	// Configurations without references are returned as is.
+	conf := []byte("type: S3\nconfig:\n  bucket: thanos\n")
+	resolved, err := ResolveSecrets(conf, resolvers)
+	testutil.Ok(t, err)
+	testutil.Equals(t, string(conf), string(resolved))
+	testutil.Equals(t, 0, calls)
+
+	resolved, err = ResolveSecrets([]byte(`type: S3
+config:
+  bucket: thanos
+  access_key: ${vault:secret/data/thanos#access_key}
+  secret_key: "${vault:secret/data/thanos#secret_key}"
+  endpoint: minio:${vault:secret/data/thanos#port}
+  http_config:
+    # Secrets are strings.
+    tls_config:
+      server_name: ${vault:secret/data/thanos#port}
+`), resolvers)
+	testutil.Ok(t, err)
+	testutil.Equals(t, 1, calls)
+
+	var parsed struct {
+		Config map[string]interface{} `yaml:"config"`
+	}
+	testutil.Ok(t, yaml.Unmarshal(resolved, &parsed))
+	testutil.Equals(t, "AKIA", parsed.Config["access_key"])
+	testutil.Equals(t, "s3cr3t: #not a comment", parsed.Config["secret_key"])
+	testutil.Equals(t, "minio:1234", parsed.Config["endpoint"])
+	testutil.Equals(t, map[interface{}]interface{}{"tls_config": map[interface{}]interface{}{"server_name": "1234"}}, parsed.Config["http_config"])
+
+	// Failures name the reference, but not the secrets.
+	_, err = ResolveSecrets([]byte("config:\n  access_key: ${vault:secret/data/thanos#access_key}\n  secret_key: ${vault:secret/data/other#secret_key}\n"), resolvers)
+	testutil.NotOk(t, err)
+	testutil.Assert(t, strings.Contains(err.Error(), "${vault:secret/data/other#secret_key}"), "unexpected error %v", err)
+	testutil.Assert(t, !strings.Contains(err.Error(), "AKIA"), "error contains secret: %v", err)
+
+	_, err = ResolveSecrets([]byte("config:\n  access_key: ${aws-sm:thanos}\n"), resolvers)
+	testutil.NotOk(t, err)
+	testutil.Assert(t, strings.Contains(err.Error(), "unsupported secret manager aws-sm"), "unexpected error %v", err)
+}
+
+func TestVaultSecretResolver(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("X-Vault-Token") != "token" {
+			w.WriteHeader(http.StatusForbidden)
+			_, _ = w.Write([]byte(`{"errors":["permission denied"]}`))
+			return
+		}
+		switch r.URL.Path {
+		case "/v1/secret/data/thanos":
+			_, _ = w.Write([]byte(`{"data":{"data":{"secret_key":"v2"},"metadata":{"version":3}}}`))
+		case "/v1/kv/thanos":
+			_, _ = w.Write([]byte(`{"data":{"secret_key":"v1"}}`))
+		default:
+			w.WriteHeader(http.StatusNotFound)
+			_, _ = w.Write([]byte(`{"errors":[]}`))
+		}
+	}))
+	defer srv.Close()
+
+	t.Setenv("VAULT_ADDR", srv.URL+"/")
+	t.Setenv("VAULT_TOKEN", "token")
+	r, err := NewVaultSecretResolver()
+	testutil.Ok(t, err)
+
+	ctx := context.Background()
+	v, err := r.Resolve(ctx, "secret/data/thanos", "secret_key")
+	testutil.Ok(t, err)
+	testutil.Equals(t, "v2", v)
+
+	v, err = r.Resolve(ctx, "kv/thanos", "secret_key")
+	testutil.Ok(t, err)
+	testutil.Equals(t, "v1", v)
+
+	_, err = r.Resolve(ctx, "kv/thanos", "access_key")
+	testutil.NotOk(t, err)
+	_, err = r.Resolve(ctx, "kv/missing", "secret_key")
+	testutil.NotOk(t, err)
+	_, err = r.Resolve(ctx, "kv/thanos", "")
+	testutil.NotOk(t, err)
+
+	t.Setenv("VAULT_TOKEN", "")
+	_, err = NewVaultSecretResolver()
+	testutil.NotOk(t, err)
+}
+
+func TestSecretField(t *testing.T) {
+	v, err := secretField("plain", "")
+	testutil.Ok(t, err)
+	testutil.Equals(t, "plain", v)
+
+	v, err = secretField(`{"secret_key":"json"}`, "secret_key")
+	testutil.Ok(t, err)
+	testutil.Equals(t, "json", v)
+
+	_, err = secretField("plain", "secret_key")
+	testutil.NotOk(t, err)
+	_, err = secretField(`{"secret_key":1}`, "secret_key")
+	testutil.NotOk(t, err)
+}
@@ -0,0 +1,182 @@
+// Copyright (c) The Thanos Authors.
+// Licensed under the Apache License 2.0.
+
+package extobjstore
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/pkg/errors"
+
+	"github.com/thanos-io/objstore"
+
+	"github.com/thanos-io/thanos/pkg/extobjstore/objcopy"
+)
+
+// TimeoutConfig configures timeouts of bucket operations by type, on top of the timeouts of the
+// provider HTTP client. Each timeout applies to a single attempt of an operation, so that retries
+// get a fresh timeout. Zero disables the timeout of an operation type.
+type TimeoutConfig struct {
+	// List is the timeout of listing objects, including the calls of the iteration function.
+	List time.Duration `yaml:"list"`
+	// Get is the timeout of downloading a whole object, including reading its content.
+	Get time.Duration `yaml:"get"`
+	// GetRange is the timeout of downloading a range of an object, including reading its content.
+	GetRange time.Duration `yaml:"get_range"`
+	// Put is the timeout of uploading an object.
+	Put time.Duration `yaml:"put"`
+}
+
+func (c TimeoutConfig) validate() error {
+	if c.List < 0 || c.Get < 0 || c.GetRange < 0 || c.Put < 0 {
+		return errors.New("timeouts must not be negative")
+	}
+	return nil
+}
+
+func (c TimeoutConfig) enabled() bool {
+	return c.List > 0 || c.Get > 0 || c.GetRange > 0 || c.Put > 0
+}
+
+// TimeoutError is returned by operations exceeding their configured timeout.
+type TimeoutError struct {
+	// Op is the objstore operation which timed out, e.g. objstore.OpGetRange.
+	Op      string
+	Name    string
+	Timeout time.Duration
+	Err     error
+}
+
+func (e *TimeoutError) Error() string {
+	return fmt.Sprintf("%s %s exceeded timeout of %s: %v", e.Op, e.Name, e.Timeout, e.Err)
+}
+
+func (e *TimeoutError) Unwrap() error { return e.Err }
+
+// IsTimeoutErr returns true if err was caused by an operation exceeding its configured timeout.
+func IsTimeoutErr(err error) bool {
+	var terr *TimeoutError
+	return errors.As(err, &terr)
+}
+
+// TimeoutBucket is a bucket canceling operations which exceed their configured timeout.
+type TimeoutBucket struct {
+	objstore.Bucket
+
+	conf TimeoutConfig
+}
+
+func wrapWithTimeouts(bkt objstore.Bucket, conf TimeoutConfig) objstore.Bucket {
+	if !conf.enabled() {
+		return bkt
+	}
+	return NewTimeoutBucket(bkt, conf)
+}
+
+// NewTimeoutBucket returns a bucket applying the timeouts of conf to the operations of bkt.
+func NewTimeoutBucket(bkt objstore.Bucket, conf TimeoutConfig) *TimeoutBucket {
+	return &TimeoutBucket{Bucket: bkt, conf: conf}
+}
+
+// withTimeout returns the context of an operation with the given timeout.
+func withTimeout(ctx context.Context, timeout time.Duration) (context.Context, context.CancelFunc) {
+	if timeout <= 0 {
+		return ctx, func() {}
+	}
+	return context.WithTimeout(ctx, timeout)
+}
+
+// wrapErr returns err as a TimeoutError if the operation context timed out while the parent context did not.
+func wrapErr(parent, ctx context.Context, op, name string, timeout time.Duration, err error) error {
+	if err == nil || timeout <= 0 || parent.Err() != nil || !errors.Is(ctx.Err(), context.DeadlineExceeded) {
+		return err
+	}
+	return &TimeoutError{Op: op, Name: name, Timeout: timeout, Err: err}
+}
+
+// Iter calls f for each entry in the given directory, canceling the listing once it exceeds the list timeout.
+func (tb *TimeoutBucket) Iter(ctx context.Context, dir string, f func(string) error, options ...objstore.IterOption) error {
+	tctx, cancel := withTimeout(ctx, tb.conf.List)
+	defer cancel()
+	return wrapErr(ctx, tctx, objstore.OpIter, dir, tb.conf.List, tb.Bucket.Iter(tctx, dir, f, options...))
+}
+
+// Upload the contents of the reader as an object into the bucket, canceling the upload once it exceeds the put timeout.
+func (tb *TimeoutBucket) Upload(ctx context.Context, name string, r io.Reader) error {
+	tctx, cancel := withTimeout(ctx, tb.conf.Put)
+	defer cancel()
+	return wrapErr(ctx, tctx, objstore.OpUpload, name, tb.conf.Put, tb.Bucket.Upload(tctx, name, r))
+}
+
+// Get returns a reader for the given object name. The download, including reading the object, is canceled
+// once it exceeds the get timeout.
+func (tb *TimeoutBucket) Get(ctx context.Context, name string) (io.ReadCloser, error) {
+	return tb.get(ctx, objstore.OpGet, name, tb.conf.Get, func(ctx context.Context) (io.ReadCloser, error) {
+		return tb.Bucket.Get(ctx, name)
+	})
+}
+
+// GetRange returns a new range reader for the given object name and range. The download, including reading
+// the range, is canceled once it exceeds the get range timeout.
+func (tb *TimeoutBucket) GetRange(ctx context.Context, name string, off, length int64) (io.ReadCloser, error) {
+	return tb.get(ctx, objstore.OpGetRange, name, tb.conf.GetRange, func(ctx context.Context) (io.ReadCloser, error) {
+		return tb.Bucket.GetRange(ctx, name, off, length)
+	})
+}
+
+func (tb *TimeoutBucket) get(ctx context.Context, op, name string, timeout time.Duration, get func(context.Context) (io.ReadCloser, error)) (io.ReadCloser, error) {
+	if timeout <= 0 {
+		return get(ctx)
+	}
+	tctx, cancel := context.WithTimeout(ctx, timeout)
+	rc, err := get(tctx)
+	if err != nil {
+		cancel()
+		return nil, wrapErr(ctx, tctx, op, name, timeout, err)
+	}
+	return &timeoutReader{ReadCloser: rc, parent: ctx, ctx: tctx, cancel: cancel, op: op, name: name, timeout: timeout}, nil
+}
+
+// Copy copies the object src to dst, using server-side copy if the wrapped bucket supports it.
+func (tb *TimeoutBucket) Copy(ctx context.Context, src, dst string) error {
+	return objcopy.Copy(ctx, tb.Bucket, src, dst)
+}
+
+// ReaderWithExpectedErrs implements objstore.InstrumentedBucket.
+func (tb *TimeoutBucket) ReaderWithExpectedErrs(fn objstore.IsOpFailureExpectedFunc) objstore.BucketReader {
+	return tb.WithExpectedErrs(fn)
+}
+
+// WithExpectedErrs implements objstore.InstrumentedBucket.
+func (tb *TimeoutBucket) WithExpectedErrs(fn objstore.IsOpFailureExpectedFunc) objstore.Bucket {
+	if ib, ok := tb.Bucket.(objstore.InstrumentedBucket); ok {
+		return &TimeoutBucket{Bucket: ib.WithExpectedErrs(fn), conf: tb.conf}
+	}
+	return tb
+}
+
+// timeoutReader reads an object downloaded with a timeout, releasing the timeout on Close.
+type timeoutReader struct {
+	io.ReadCloser
+
+	parent, ctx context.Context
+	cancel      context.CancelFunc
+	op, name    string
+	timeout     time.Duration
+}
+
+func (r *timeoutReader) Read(p []byte) (int, error) {
+	n, err := r.ReadCloser.Read(p)
+	if err == io.EOF {
+		return n, err
+	}
+	return n, wrapErr(r.parent, r.ctx, r.op, r.name, r.timeout, err)
+}
+
+func (r *timeoutReader) Close() error {
+	defer r.cancel()
+	return r.ReadCloser.Close()
+}
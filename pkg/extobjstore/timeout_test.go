@@ -0,0 +1,144 @@
+// Copyright (c) The Thanos Authors.
+// Licensed under the Apache License 2.0.
+
+package extobjstore
+
+import (
+	"context"
+	"io"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/efficientgo/core/testutil"
+
+	"github.com/thanos-io/objstore"
+)
+
+// slowBucket blocks operations on objects with the given name until their context is done.
+type slowBucket struct {
+	*objstore.InMemBucket
+
+	slow string
+}
+
+func (b *slowBucket) wait(ctx context.Context, name string) error {
+	if name != b.slow {
+		return nil
+	}
+	<-ctx.Done()
+	return ctx.Err()
+}
+
+func (b *slowBucket) Upload(ctx context.Context, name string, r io.Reader) error {
+	if err := b.wait(ctx, name); err != nil {
+		return err
+	}
+	return b.InMemBucket.Upload(ctx, name, r)
+}
+
+func (b *slowBucket) Iter(ctx context.Context, dir string, f func(string) error, options ...objstore.IterOption) error {
+	if err := b.wait(ctx, dir); err != nil {
+		return err
+	}
+	return b.InMemBucket.Iter(ctx, dir, f, options...)
+}
+
+func (b *slowBucket) GetRange(ctx context.Context, name string, off, length int64) (io.ReadCloser, error) {
+	if err := b.wait(ctx, name); err != nil {
+		return nil, err
+	}
+	return b.InMemBucket.GetRange(ctx, name, off, length)
+}
+
+// Get returns a reader whose content is blocked until the context is done for slow objects.
+func (b *slowBucket) Get(ctx context.Context, name string) (io.ReadCloser, error) {
+	rc, err := b.InMemBucket.Get(ctx, name)
+	if err != nil || name != b.slow {
+		return rc, err
+	}
+	return &slowReader{ReadCloser: rc, ctx: ctx}, nil
+}
+
+type slowReader struct {
+	io.ReadCloser
+	ctx context.Context
+}
+
+func (r *slowReader) Read([]byte) (int, error) {
+	<-r.ctx.Done()
+	return 0, r.ctx.Err()
+}
+
+func TestTimeoutBucket(t *testing.T) {
+	ctx := context.Background()
+	const timeout = 50 * time.Millisecond
+
+	bkt := &slowBucket{InMemBucket: objstore.NewInMemBucket(), slow: "slow"}
+	testutil.Ok(t, bkt.Upload(ctx, "fast", strings.NewReader("fast")))
+	testutil.Ok(t, bkt.InMemBucket.Upload(ctx, "slow", strings.NewReader("slow")))
+
+	tb := NewTimeoutBucket(bkt, TimeoutConfig{List: timeout, Get: timeout, GetRange: timeout, Put: timeout})
+
+	// Fast operations are not affected.
+	testutil.Ok(t, tb.Upload(ctx, "fast", strings.NewReader("fast")))
+	rc, err := tb.Get(ctx, "fast")
+	testutil.Ok(t, err)
+	b, err := io.ReadAll(rc)
+	testutil.Ok(t, err)
+	testutil.Ok(t, rc.Close())
+	testutil.Equals(t, "fast", string(b))
+	testutil.Ok(t, tb.Iter(ctx, "", func(string) error { return nil }))
+
+	// Slow operations fail with a timeout error.
+	err = tb.Upload(ctx, "slow", strings.NewReader("slow"))
+	testutil.Assert(t, IsTimeoutErr(err), "unexpected error %v", err)
+	testutil.Equals(t, "upload slow exceeded timeout of 50ms: context deadline exceeded", err.Error())
+
+	err = tb.Iter(ctx, "slow", func(string) error { return nil })
+	testutil.Assert(t, IsTimeoutErr(err), "unexpected error %v", err)
+
+	_, err = tb.GetRange(ctx, "slow", 0, 1)
+	testutil.Assert(t, IsTimeoutErr(err), "unexpected error %v", err)
+
+	// The timeout of downloads covers reading the object.
+	rc, err = tb.Get(ctx, "slow")
+	testutil.Ok(t, err)
+	_, err = io.ReadAll(rc)
+	testutil.Assert(t, IsTimeoutErr(err), "unexpected error %v", err)
+	testutil.Ok(t, rc.Close())
+
+	// Canceled operations are not reported as timeouts.
+	cctx, cancel := context.WithCancel(ctx)
+	cancel()
+	err = tb.Upload(cctx, "slow", strings.NewReader("slow"))
+	testutil.NotOk(t, err)
+	testutil.Assert(t, !IsTimeoutErr(err), "unexpected timeout error %v", err)
+
+	// Operations without timeout are not affected.
+	tb = NewTimeoutBucket(bkt, TimeoutConfig{Put: timeout})
+	rc, err = tb.GetRange(ctx, "fast", 0, 2)
+	testutil.Ok(t, err)
+	b, err = io.ReadAll(rc)
+	testutil.Ok(t, err)
+	testutil.Equals(t, "fa", string(b))
+}
+
+func TestParseBucketConfig_Timeouts(t *testing.T) {
+	conf, err := ParseBucketConfig([]byte(`type: FILESYSTEM
+config:
+  directory: /tmp/thanos
+timeouts:
+  list: 30s
+  get: 10m
+  get_range: 1m
+`))
+	testutil.Ok(t, err)
+	testutil.Equals(t, TimeoutConfig{List: 30 * time.Second, Get: 10 * time.Minute, GetRange: time.Minute}, conf.Timeouts)
+
+	_, err = ParseBucketConfig([]byte(`type: FILESYSTEM
+timeouts:
+  put: -1s
+`))
+	testutil.NotOk(t, err)
+}
@@ -67,6 +67,7 @@ const (
 	Gets          OperationName = "gets"
 	Sets          OperationName = "sets"
 	WriteRequests OperationName = "write_requests"
+	ChunkDecodes  OperationName = "chunk_decodes"
 )
 
 type GateFactory interface {
@@ -155,14 +156,19 @@ func NewGateFactory(reg prometheus.Registerer, maxConcurrent int, opName Operati
 // It can be called several times but not with the same registerer otherwise it
 // will panic when trying to register the same metric multiple times.
 func New(reg prometheus.Registerer, maxConcurrent int, opName OperationName) Gate {
-	promauto.With(reg).NewGauge(maxGaugeOpts(opName)).Set(float64(maxConcurrent))
-
 	var gate Gate
 	if maxConcurrent <= 0 {
 		gate = NewNoop()
 	} else {
 		gate = promgate.New(maxConcurrent)
 	}
+	return instrument(reg, maxConcurrent, opName, gate)
+}
+
+// instrument registers the metrics of the gate limiting operations opName to maxConcurrent
+// and wraps gate to update them.
+func instrument(reg prometheus.Registerer, maxConcurrent int, opName OperationName, gate Gate) Gate {
+	promauto.With(reg).NewGauge(maxGaugeOpts(opName)).Set(float64(maxConcurrent))
 
 	return InstrumentGateDuration(
 		promauto.With(reg).NewHistogram(durationHistogramOpts(opName)),
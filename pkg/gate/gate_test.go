@@ -6,6 +6,7 @@ package gate
 import (
 	"context"
 	"testing"
+	"time"
 
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/stretchr/testify/require"
@@ -17,3 +18,86 @@ func TestGateAllowsDisablingLimits(t *testing.T) {
 
 	require.NoError(t, g.Start(context.Background()))
 }
+
+type testPriorityKey struct{}
+
+func testPriority(ctx context.Context) int {
+	p, _ := ctx.Value(testPriorityKey{}).(int)
+	return p
+}
+
+func withTestPriority(p int) context.Context {
+	return context.WithValue(context.Background(), testPriorityKey{}, p)
+}
+
+func TestPriorityGate(t *testing.T) {
+	now := time.Unix(0, 0)
+	g := newPriorityGate(1, testPriority, time.Minute)
+	g.now = func() time.Time { return now }
+
+	require.NoError(t, g.Start(withTestPriority(0)))
+
+	// startWaiting starts a request with the given priority and waits until it is queued.
+	admitted := make(chan int, 10)
+	startWaiting := func(p int) {
+		g.mtx.Lock()
+		queued := len(g.waiters) + 1
+		g.mtx.Unlock()
+		go func() {
+			require.NoError(t, g.Start(withTestPriority(p)))
+			admitted <- p
+		}()
+		require.Eventually(t, func() bool {
+			g.mtx.Lock()
+			defer g.mtx.Unlock()
+			return len(g.waiters) == queued
+		}, time.Second, time.Millisecond)
+	}
+	next := func() int {
+		g.Done()
+		select {
+		case p := <-admitted:
+			return p
+		case <-time.After(time.Second):
+			t.Fatal("no request admitted")
+			return 0
+		}
+	}
+
+	// Higher priorities are admitted first, equal priorities in order of arrival.
+	startWaiting(0)
+	startWaiting(2)
+	startWaiting(1)
+	startWaiting(2)
+	require.Equal(t, 2, next())
+	require.Equal(t, 2, next())
+	require.Equal(t, 1, next())
+	require.Equal(t, 0, next())
+
+	// Requests waiting for longer than the maximum wait are admitted first.
+	startWaiting(0)
+	now = now.Add(30 * time.Second)
+	startWaiting(1)
+	startWaiting(2)
+	require.Equal(t, 2, next())
+	now = now.Add(30 * time.Second)
+	require.Equal(t, 0, next())
+	require.Equal(t, 1, next())
+
+	g.Done()
+	require.Equal(t, 0, g.inflight)
+}
+
+func TestPriorityGate_Canceled(t *testing.T) {
+	g := newPriorityGate(1, testPriority, 0)
+	require.NoError(t, g.Start(context.Background()))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	require.ErrorIs(t, g.Start(ctx), context.Canceled)
+	require.Empty(t, g.waiters)
+
+	g.Done()
+	require.Equal(t, 0, g.inflight)
+	require.NoError(t, g.Start(context.Background()))
+}
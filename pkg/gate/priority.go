@@ -0,0 +1,116 @@
+// Copyright (c) The Thanos Authors.
+// Licensed under the Apache License 2.0.
+
+package gate
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// PriorityFunc returns the priority of the request with the given context. Requests with higher priority are admitted first.
+type PriorityFunc func(ctx context.Context) int
+
+// NewPriority returns an instrumented gate limiting the number of requests being executed concurrently,
+// like New. When all slots are taken, waiting requests are admitted in order of their priority and,
+// within the same priority, in order of arrival. To bound starvation, a request which has waited for
+// maxWait or longer is admitted before any request with higher priority. A maxWait of 0 disables the bound.
+func NewPriority(reg prometheus.Registerer, maxConcurrent int, opName OperationName, priority PriorityFunc, maxWait time.Duration) Gate {
+	var gate Gate
+	if maxConcurrent <= 0 {
+		gate = NewNoop()
+	} else {
+		gate = newPriorityGate(maxConcurrent, priority, maxWait)
+	}
+	return instrument(reg, maxConcurrent, opName, gate)
+}
+
+type priorityWaiter struct {
+	priority int
+	since    time.Time
+	// admitted is closed once the waiter was handed a slot.
+	admitted chan struct{}
+}
+
+type priorityGate struct {
+	maxConcurrent int
+	priority      PriorityFunc
+	maxWait       time.Duration
+	now           func() time.Time
+
+	mtx      sync.Mutex
+	inflight int
+	// waiters are ordered by arrival.
+	waiters []*priorityWaiter
+}
+
+func newPriorityGate(maxConcurrent int, priority PriorityFunc, maxWait time.Duration) *priorityGate {
+	return &priorityGate{
+		maxConcurrent: maxConcurrent,
+		priority:      priority,
+		maxWait:       maxWait,
+		now:           time.Now,
+	}
+}
+
+// Start implements the Gate interface.
+func (g *priorityGate) Start(ctx context.Context) error {
+	g.mtx.Lock()
+	if g.inflight < g.maxConcurrent {
+		g.inflight++
+		g.mtx.Unlock()
+		return nil
+	}
+	w := &priorityWaiter{priority: g.priority(ctx), since: g.now(), admitted: make(chan struct{})}
+	g.waiters = append(g.waiters, w)
+	g.mtx.Unlock()
+
+	select {
+	case <-w.admitted:
+		return nil
+	case <-ctx.Done():
+	}
+
+	g.mtx.Lock()
+	defer g.mtx.Unlock()
+	for i, o := range g.waiters {
+		if o == w {
+			g.waiters = append(g.waiters[:i], g.waiters[i+1:]...)
+			return ctx.Err()
+		}
+	}
+	// The slot was handed over while the context was canceled, pass it on.
+	g.release()
+	return ctx.Err()
+}
+
+// Done implements the Gate interface.
+func (g *priorityGate) Done() {
+	g.mtx.Lock()
+	defer g.mtx.Unlock()
+	g.release()
+}
+
+// release hands the slot of a finished request over to the next waiter, if any. It must be called with g.mtx held.
+func (g *priorityGate) release() {
+	if len(g.waiters) == 0 {
+		g.inflight--
+		return
+	}
+
+	next := 0
+	// Waiters are ordered by arrival, so the first one has waited the longest.
+	if g.maxWait <= 0 || g.now().Sub(g.waiters[0].since) < g.maxWait {
+		for i, w := range g.waiters {
+			if w.priority > g.waiters[next].priority {
+				next = i
+			}
+		}
+	}
+	w := g.waiters[next]
+	g.waiters = append(g.waiters[:next], g.waiters[next+1:]...)
+	close(w.admitted)
+}
@@ -16,6 +16,7 @@ import (
 	"github.com/go-kit/log/level"
 
 	httputil "github.com/thanos-io/thanos/pkg/server/http"
+	"github.com/thanos-io/thanos/pkg/tracing"
 )
 
 type HTTPServerMiddleware struct {
@@ -24,7 +25,7 @@ type HTTPServerMiddleware struct {
 }
 
 func (m *HTTPServerMiddleware) preCall(name string, start time.Time, r *http.Request) {
-	logger := m.opts.filterLog(m.logger)
+	logger := m.opts.filterLog(withTraceID(m.logger, r))
 	level.Debug(logger).Log(
 		"http.start_time", start.String(),
 		"http.method", fmt.Sprintf("%s %s", r.Method, r.URL),
@@ -43,7 +44,7 @@ func (m *HTTPServerMiddleware) postCall(name string, start time.Time, wrapped *h
 		remoteAddr = r.RemoteAddr
 	}
 
-	logger := log.With(m.logger,
+	logger := log.With(withTraceID(m.logger, r),
 		"http.method", fmt.Sprintf("%s %s", r.Method, r.URL),
 		"http.request_id", r.Header.Get("X-Request-ID"),
 		"http.user_agent", r.Header.Get("User-Agent"),
@@ -99,6 +100,14 @@ func (m *HTTPServerMiddleware) HTTPMiddleware(name string, next http.Handler) ht
 	}
 }
 
+// withTraceID adds the trace ID of the sampled span of the request to the logger, if any.
+func withTraceID(logger log.Logger, r *http.Request) log.Logger {
+	if traceID, ok := tracing.TraceIDFromContext(r.Context()); ok {
+		return log.With(logger, "traceID", traceID)
+	}
+	return logger
+}
+
 // NewHTTPServerMiddleware returns an http middleware.
 func NewHTTPServerMiddleware(logger log.Logger, opts ...Option) *HTTPServerMiddleware {
 	o := evaluateOpt(opts)
@@ -5,16 +5,23 @@ package logging
 
 import (
 	"bytes"
+	"context"
 	"io"
 	"net/http"
 	"net/http/httptest"
 	"net/url"
+	"strconv"
 	"strings"
 	"testing"
 
 	"github.com/go-kit/log"
+	grpc_logging "github.com/grpc-ecosystem/go-grpc-middleware/v2/interceptors/logging"
+	"github.com/opentracing/opentracing-go"
+	"github.com/opentracing/opentracing-go/mocktracer"
 
 	"github.com/efficientgo/core/testutil"
+
+	"github.com/thanos-io/thanos/pkg/tracing"
 )
 
 func TestHTTPServerMiddleware(t *testing.T) {
@@ -80,3 +87,38 @@ func TestHTTPServerMiddleware(t *testing.T) {
 	testutil.Equals(t, "Test Works", string(body))
 	testutil.Assert(t, !strings.Contains(b.String(), "err="))
 }
+
+type mockTracer struct {
+	*mocktracer.MockTracer
+}
+
+func (t mockTracer) GetTraceIDFromSpanContext(ctx opentracing.SpanContext) (string, bool) {
+	return strconv.Itoa(ctx.(mocktracer.MockSpanContext).TraceID), true
+}
+
+func TestRequestLogsTraceID(t *testing.T) {
+	tracer := mockTracer{mocktracer.New()}
+	span := tracer.StartSpan("test")
+	traceID := strconv.Itoa(span.Context().(mocktracer.MockSpanContext).TraceID)
+	spanCtx := opentracing.ContextWithSpan(tracing.ContextWithTracer(context.Background(), tracer), span)
+
+	b := bytes.Buffer{}
+	m := NewHTTPServerMiddleware(log.NewLogfmtLogger(&b), WithDecider(func(_ string, _ error) Decision {
+		return LogStartAndFinishCall
+	}))
+	hm := m.HTTPMiddleware("test", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+
+	hm(httptest.NewRecorder(), httptest.NewRequest("GET", "http://example.com/foo", nil).WithContext(spanCtx))
+	testutil.Equals(t, 2, strings.Count(b.String(), "traceID="+traceID))
+
+	// Without an active span the field is omitted.
+	b.Reset()
+	hm(httptest.NewRecorder(), httptest.NewRequest("GET", "http://example.com/foo", nil))
+	testutil.Assert(t, !strings.Contains(b.String(), "traceID"), b.String())
+
+	fields := GetTraceIDAndRequestIDAsField(spanCtx)
+	testutil.Equals(t, grpc_logging.Fields{"traceID", traceID}, fields[:2])
+	fields = GetTraceIDAndRequestIDAsField(context.Background())
+	testutil.Equals(t, 2, len(fields))
+	testutil.Equals(t, "requestID", fields[0])
+}
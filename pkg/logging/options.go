@@ -10,15 +10,13 @@ import (
 	"time"
 
 	"github.com/oklog/ulid"
-	"github.com/opentracing/opentracing-go"
-	"go.opentelemetry.io/otel/trace"
 
 	extflag "github.com/efficientgo/tools/extkingpin"
 	"github.com/go-kit/log"
 	"github.com/go-kit/log/level"
 	grpc_logging "github.com/grpc-ecosystem/go-grpc-middleware/v2/interceptors/logging"
 	middleware "github.com/thanos-io/thanos/pkg/server/http/middleware"
-	"github.com/thanos-io/thanos/pkg/tracing/migration"
+	"github.com/thanos-io/thanos/pkg/tracing"
 	"google.golang.org/grpc/codes"
 )
 
@@ -169,10 +167,8 @@ func GetTraceIDAndRequestIDAsField(ctx context.Context) grpc_logging.Fields {
 	logFields := grpc_logging.Fields{}
 
 	//get traceID from context
-	span := opentracing.SpanFromContext(ctx)
-	TraceID, _ := migration.GetTraceIDFromBridgeSpan(span)
-	if span := trace.SpanContextFromContext(ctx); span.IsSampled() {
-		logFields = logFields.AppendUnique(grpc_logging.Fields{"traceID", TraceID})
+	if traceID, ok := tracing.TraceIDFromContext(ctx); ok {
+		logFields = logFields.AppendUnique(grpc_logging.Fields{"traceID", traceID})
 	}
 	//get requestID from context
 	reqID, ok := middleware.RequestIDFromContext(ctx)
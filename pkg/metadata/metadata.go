@@ -5,6 +5,7 @@ package metadata
 
 import (
 	"context"
+	"sort"
 	"sync"
 
 	"github.com/pkg/errors"
@@ -38,25 +39,104 @@ func (rr *GRPCClient) MetricMetadata(ctx context.Context, req *metadatapb.Metric
 	span, ctx := tracing.StartSpan(ctx, "metadata_grpc_request")
 	defer span.Finish()
 
-	srv := &metadataServer{ctx: ctx, metric: req.Metric, limit: int(req.Limit)}
+	srv := &metadataServer{ctx: ctx, metric: req.Metric, limit: int(req.Limit), metadataMap: map[string][]*metadatapb.Meta{}}
+	if err := rr.proxy.MetricMetadata(req, srv); err != nil {
+		return nil, nil, errors.Wrap(err, "proxy MetricMetadata")
+	}
 
-	if req.Limit >= 0 {
-		if req.Metric != "" {
-			srv.metadataMap = make(map[string][]*metadatapb.Meta, 1)
-		} else if req.Limit <= 100 {
-			srv.metadataMap = make(map[string][]*metadatapb.Meta, req.Limit)
-		} else {
-			srv.metadataMap = make(map[string][]*metadatapb.Meta)
+	return mergeMetadata(srv.metadataMap, srv.limit), srv.warnings, nil
+}
+
+// mergeMetadata merges the metadata of every metric and applies the limit to the merged metrics.
+// Metrics are sorted by name before applying the limit, so that the result does not depend on
+// the order in which stores responded.
+func mergeMetadata(metadataMap map[string][]*metadatapb.Meta, limit int) map[string][]*metadatapb.Meta {
+	for k, metas := range metadataMap {
+		metadataMap[k] = mergeMetas(metas)
+	}
+	if limit < 0 || len(metadataMap) <= limit {
+		return metadataMap
+	}
+
+	names := make([]string, 0, len(metadataMap))
+	for k := range metadataMap {
+		names = append(names, k)
+	}
+	sort.Strings(names)
+	for _, k := range names[limit:] {
+		delete(metadataMap, k)
+	}
+	return metadataMap
+}
+
+// mergeMetas merges the metadata of one metric returned by different stores. Metadata only differing
+// by fields missing in one of them, e.g. a help text not known by some Prometheus, are merged into
+// the most complete one. Remaining conflicting metadata are all returned, sorted by type, help and unit.
+func mergeMetas(metas []*metadatapb.Meta) []*metadatapb.Meta {
+	if len(metas) <= 1 {
+		return metas
+	}
+
+	sorted := make([]*metadatapb.Meta, len(metas))
+	copy(sorted, metas)
+	sort.Slice(sorted, func(i, j int) bool {
+		if ci, cj := completeness(sorted[i]), completeness(sorted[j]); ci != cj {
+			return ci > cj
 		}
-	} else {
-		srv.metadataMap = make(map[string][]*metadatapb.Meta)
+		return lessMeta(sorted[i], sorted[j])
+	})
+
+	merged := make([]*metadatapb.Meta, 0, len(sorted))
+Outer:
+	for _, meta := range sorted {
+		for _, m := range merged {
+			if covers(m, meta) {
+				continue Outer
+			}
+		}
+		merged = append(merged, meta)
 	}
+	sort.Slice(merged, func(i, j int) bool { return lessMeta(merged[i], merged[j]) })
+	return merged
+}
 
-	if err := rr.proxy.MetricMetadata(req, srv); err != nil {
-		return nil, nil, errors.Wrap(err, "proxy MetricMetadata")
+// metricTypeUnknown is the type reported by Prometheus for metrics without a TYPE line.
+const metricTypeUnknown = "unknown"
+
+func hasType(m *metadatapb.Meta) bool {
+	return m.Type != "" && m.Type != metricTypeUnknown
+}
+
+// completeness returns the number of known fields of m.
+func completeness(m *metadatapb.Meta) int {
+	n := 0
+	if hasType(m) {
+		n++
+	}
+	if m.Help != "" {
+		n++
 	}
+	if m.Unit != "" {
+		n++
+	}
+	return n
+}
 
-	return srv.metadataMap, srv.warnings, nil
+// covers returns true if every known field of o is equal in m.
+func covers(m, o *metadatapb.Meta) bool {
+	return (!hasType(o) || o.Type == m.Type) &&
+		(o.Help == "" || o.Help == m.Help) &&
+		(o.Unit == "" || o.Unit == m.Unit)
+}
+
+func lessMeta(a, b *metadatapb.Meta) bool {
+	if a.Type != b.Type {
+		return a.Type < b.Type
+	}
+	if a.Help != b.Help {
+		return a.Help < b.Help
+	}
+	return a.Unit < b.Unit
 }
 
 type metadataServer struct {
@@ -91,12 +171,10 @@ func (srv *metadataServer) Send(res *metadatapb.MetricMetadataResponse) error {
 
 	srv.mu.Lock()
 	defer srv.mu.Unlock()
+	// The limit is applied once all metadata were merged, see mergeMetadata.
 	for k, v := range res.GetMetadata().Metadata {
 		if metadata, ok := srv.metadataMap[k]; !ok {
-			// If limit is set and it is positive, we limit the size of the map.
-			if srv.limit < 0 || srv.limit > 0 && len(srv.metadataMap) < srv.limit {
-				srv.metadataMap[k] = v.Metas
-			}
+			srv.metadataMap[k] = v.Metas
 		} else {
 			// There shouldn't be many metadata for one single metric.
 		Outer:
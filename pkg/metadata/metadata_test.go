@@ -0,0 +1,119 @@
+// Copyright (c) The Thanos Authors.
+// Licensed under the Apache License 2.0.
+
+package metadata
+
+import (
+	"context"
+	"testing"
+
+	"github.com/efficientgo/core/testutil"
+	"github.com/go-kit/log"
+	"google.golang.org/grpc/metadata"
+
+	"github.com/thanos-io/thanos/pkg/metadata/metadatapb"
+	"github.com/thanos-io/thanos/pkg/store/storepb"
+	"github.com/thanos-io/thanos/pkg/tenancy"
+)
+
+func TestGRPCClient_MetricMetadata(t *testing.T) {
+	stores := []map[string][]*metadatapb.Meta{
+		{
+			"http_requests_total": {{Type: "counter", Help: "Number of HTTP requests."}},
+			"up":                  {{Type: "gauge"}},
+			"go_goroutines":       {{Type: "gauge", Help: "Number of goroutines."}},
+		},
+		{
+			"http_requests_total": {{Type: "unknown", Help: "Number of HTTP requests."}},
+			"up":                  {{Type: "gauge", Help: "Whether the target is up."}},
+			"go_goroutines":       {{Type: "gauge", Help: "Number of goroutines that currently exist."}},
+		},
+		{
+			"http_requests_total":     {{Type: "counter"}},
+			"request_latency_seconds": {{Type: "histogram", Help: "Latency of requests.", Unit: "seconds"}},
+		},
+	}
+	newClient := func(order ...int) *GRPCClient {
+		return NewGRPCClient(NewProxy(log.NewNopLogger(), func() []metadatapb.MetadataClient {
+			clients := make([]metadatapb.MetadataClient, 0, len(order))
+			for _, i := range order {
+				clients = append(clients, &testMetadataClient{
+					response: metadatapb.NewMetricMetadataResponse(metadatapb.FromMetadataMap(stores[i])),
+				})
+			}
+			return clients
+		}))
+	}
+
+	for _, tcase := range []struct {
+		name  string
+		limit int32
+		exp   map[string][]*metadatapb.Meta
+	}{
+		{
+			name:  "merge metadata of all stores",
+			limit: -1,
+			exp: map[string][]*metadatapb.Meta{
+				"http_requests_total": {{Type: "counter", Help: "Number of HTTP requests."}},
+				"up":                  {{Type: "gauge", Help: "Whether the target is up."}},
+				"go_goroutines": {
+					{Type: "gauge", Help: "Number of goroutines that currently exist."},
+					{Type: "gauge", Help: "Number of goroutines."},
+				},
+				"request_latency_seconds": {{Type: "histogram", Help: "Latency of requests.", Unit: "seconds"}},
+			},
+		},
+		{
+			name:  "limit merged metrics",
+			limit: 2,
+			exp: map[string][]*metadatapb.Meta{
+				"http_requests_total": {{Type: "counter", Help: "Number of HTTP requests."}},
+				"go_goroutines": {
+					{Type: "gauge", Help: "Number of goroutines that currently exist."},
+					{Type: "gauge", Help: "Number of goroutines."},
+				},
+			},
+		},
+		{
+			name:  "no metadata with zero limit",
+			limit: 0,
+			exp:   map[string][]*metadatapb.Meta{},
+		},
+	} {
+		t.Run(tcase.name, func(t *testing.T) {
+			// The result must not depend on the order in which stores respond.
+			for _, order := range [][]int{{0, 1, 2}, {2, 1, 0}, {1, 2, 0}} {
+				md, warns, err := newClient(order...).MetricMetadata(context.Background(), &metadatapb.MetricMetadataRequest{
+					Limit:                   tcase.limit,
+					PartialResponseStrategy: storepb.PartialResponseStrategy_ABORT,
+				})
+				testutil.Ok(t, err)
+				testutil.Equals(t, 0, len(warns))
+				testutil.Equals(t, len(tcase.exp), len(md))
+				for k, metas := range tcase.exp {
+					testutil.Equals(t, len(metas), len(md[k]), "metric %s", k)
+					for i, m := range metas {
+						testutil.Assert(t, m.Equal(md[k][i]), "metric %s: expected %v, got %v", k, m, md[k][i])
+					}
+				}
+			}
+		})
+	}
+}
+
+func TestMultiTSDB_MetricMetadata(t *testing.T) {
+	var tenants []string
+	client := NewGRPCClient(NewMultiTSDB(func(tenant, metric string, limit int) map[string][]*metadatapb.Meta {
+		tenants = append(tenants, tenant)
+		return map[string][]*metadatapb.Meta{"up": {{Type: "gauge"}}}
+	}))
+	req := &metadatapb.MetricMetadataRequest{Limit: -1, PartialResponseStrategy: storepb.PartialResponseStrategy_ABORT}
+
+	_, _, err := client.MetricMetadata(context.Background(), req)
+	testutil.Ok(t, err)
+	_, _, err = client.MetricMetadata(metadata.NewIncomingContext(context.Background(), metadata.Pairs(tenancy.DefaultTenantHeader, "team-a")), req)
+	testutil.Ok(t, err)
+
+	// Metadata is merged across tenants unless the request has a tenant.
+	testutil.Equals(t, []string{"", "team-a"}, tenants)
+}
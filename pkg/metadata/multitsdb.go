@@ -0,0 +1,34 @@
+// Copyright (c) The Thanos Authors.
+// Licensed under the Apache License 2.0.
+
+package metadata
+
+import (
+	"github.com/thanos-io/thanos/pkg/metadata/metadatapb"
+	"github.com/thanos-io/thanos/pkg/tenancy"
+)
+
+// MultiTSDB implements metadatapb.MetadataServer that allows to fetch the metric metadata stored by a MultiTSDB instance.
+type MultiTSDB struct {
+	metadata func(tenant, metric string, limit int) map[string][]*metadatapb.Meta
+
+	metadatapb.UnimplementedMetadataServer
+}
+
+// NewMultiTSDB creates new metadata.MultiTSDB.
+func NewMultiTSDB(metadata func(tenant, metric string, limit int) map[string][]*metadatapb.Meta) *MultiTSDB {
+	return &MultiTSDB{
+		metadata: metadata,
+	}
+}
+
+// MetricMetadata returns all specified metric metadata from a MultiTSDB instance, of the tenant of the request
+// only if set in the gRPC metadata, merged across tenants otherwise.
+func (m *MultiTSDB) MetricMetadata(r *metadatapb.MetricMetadataRequest, s metadatapb.Metadata_MetricMetadataServer) error {
+	tenant, ok := tenancy.GetTenantFromGRPCMetadata(s.Context())
+	if !ok {
+		tenant = ""
+	}
+	return s.Send(&metadatapb.MetricMetadataResponse{Result: &metadatapb.MetricMetadataResponse_Metadata{
+		Metadata: metadatapb.FromMetadataMap(m.metadata(tenant, r.Metric, int(r.Limit)))}})
+}
@@ -13,10 +13,12 @@ import (
 	"golang.org/x/sync/errgroup"
 	"google.golang.org/grpc"
 	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
 	"google.golang.org/grpc/status"
 
 	"github.com/thanos-io/thanos/pkg/metadata/metadatapb"
 	"github.com/thanos-io/thanos/pkg/store/storepb"
+	"github.com/thanos-io/thanos/pkg/tenancy"
 	"github.com/thanos-io/thanos/pkg/tracing"
 )
 
@@ -46,6 +48,11 @@ func (s *Proxy) MetricMetadata(req *metadatapb.MetricMetadataRequest, srv metada
 	span, ctx := tracing.StartSpan(srv.Context(), "proxy_metadata")
 	defer span.Finish()
 
+	// Forward the tenant, so that stores holding the metadata of several tenants only return the tenant's one.
+	if tenant, ok := tenancy.GetTenantFromGRPCMetadata(ctx); ok {
+		ctx = metadata.AppendToOutgoingContext(ctx, tenancy.DefaultTenantHeader, tenant)
+	}
+
 	var (
 		g, gctx  = errgroup.WithContext(ctx)
 		respChan = make(chan *metadatapb.MetricMetadata, 10)
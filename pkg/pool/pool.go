@@ -35,6 +35,7 @@ type BucketedPool[T any] struct {
 	sizes     []int
 	maxTotal  uint64
 	usedTotal uint64
+	stats     BucketedPoolStats
 	mtx       sync.RWMutex
 
 	new func(s int) *[]T
@@ -61,6 +62,9 @@ func NewBucketedPool[T any](minSize, maxSize int, factor float64, maxTotal uint6
 	if maxSize < 1 {
 		return nil, errors.New("invalid maximum pool size")
 	}
+	if minSize > maxSize {
+		return nil, errors.Errorf("minimum pool size %d is greater than maximum pool size %d", minSize, maxSize)
+	}
 	if factor < 1 {
 		return nil, errors.New("invalid factor")
 	}
@@ -91,6 +95,7 @@ func (p *BucketedPool[T]) Get(sz int) (*[]T, error) {
 	defer p.mtx.Unlock()
 
 	if p.maxTotal > 0 && p.usedTotal+uint64(sz) > p.maxTotal {
+		p.stats.Exhausted++
 		return nil, ErrPoolExhausted
 	}
 
@@ -99,7 +104,10 @@ func (p *BucketedPool[T]) Get(sz int) (*[]T, error) {
 			continue
 		}
 		b, ok := p.buckets[i].Get().(*[]T)
-		if !ok {
+		if ok {
+			p.stats.Hits++
+		} else {
+			p.stats.Misses++
 			b = p.new(bktSize)
 		}
 
@@ -108,6 +116,7 @@ func (p *BucketedPool[T]) Get(sz int) (*[]T, error) {
 	}
 
 	// The requested size exceeds that of our highest bucket, allocate it directly.
+	p.stats.Misses++
 	p.usedTotal += uint64(sz)
 	return p.new(sz), nil
 }
@@ -119,17 +128,22 @@ func (p *BucketedPool[T]) Put(b *[]T) {
 	}
 
 	sz := cap(*b)
+	returned := false
 	for i, bktSize := range p.sizes {
 		if sz > bktSize {
 			continue
 		}
 		*b = (*b)[:0]
 		p.buckets[i].Put(b)
+		returned = true
 		break
 	}
 
 	p.mtx.Lock()
 	defer p.mtx.Unlock()
+	if returned {
+		p.stats.Returned++
+	}
 	// We could assume here that our users will not make the slices larger
 	// but lets be on the safe side to avoid an underflow of p.usedTotal.
 	if uint64(sz) >= p.usedTotal {
@@ -145,3 +159,25 @@ func (p *BucketedPool[T]) UsedBytes() uint64 {
 
 	return p.usedTotal
 }
+
+// BucketedPoolStats holds cumulative counters describing how well a BucketedPool
+// reuses its slices.
+type BucketedPoolStats struct {
+	// Hits is the number of Get calls served by a previously returned slice.
+	Hits uint64
+	// Misses is the number of Get calls that had to allocate a new slice, either
+	// because the size class was empty or because the size exceeded all classes.
+	Misses uint64
+	// Exhausted is the number of Get calls rejected with ErrPoolExhausted.
+	Exhausted uint64
+	// Returned is the number of Put calls that handed a slice back to a size class.
+	Returned uint64
+}
+
+// Stats returns a snapshot of the pool counters.
+func (p *BucketedPool[T]) Stats() BucketedPoolStats {
+	p.mtx.RLock()
+	defer p.mtx.RUnlock()
+
+	return p.stats
+}
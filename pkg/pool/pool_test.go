@@ -128,3 +128,37 @@ func TestRacePutGet(t *testing.T) {
 	default:
 	}
 }
+
+func TestBucketedPoolInvalidSizes(t *testing.T) {
+	_, err := NewBucketedPool[byte](100, 10, 2, 0)
+	testutil.NotOk(t, err)
+
+	_, err = NewBucketedPool[byte](10, 10, 2, 0)
+	testutil.Ok(t, err)
+}
+
+func TestBucketedPoolStats(t *testing.T) {
+	chunkPool, err := NewBucketedPool[byte](10, 100, 2, 1000)
+	testutil.Ok(t, err)
+
+	for i := 0; i < 2; i++ {
+		b, err := chunkPool.Get(15)
+		testutil.Ok(t, err)
+		chunkPool.Put(b)
+	}
+
+	// Oversized slices are allocated directly and not returned to any size class.
+	b, err := chunkPool.Get(500)
+	testutil.Ok(t, err)
+	chunkPool.Put(b)
+
+	_, err = chunkPool.Get(2000)
+	testutil.Equals(t, ErrPoolExhausted, err)
+
+	stats := chunkPool.Stats()
+	// Whether the second Get is a hit depends on sync.Pool keeping the returned slice.
+	testutil.Equals(t, uint64(3), stats.Hits+stats.Misses)
+	testutil.Assert(t, stats.Misses >= 2)
+	testutil.Equals(t, uint64(1), stats.Exhausted)
+	testutil.Equals(t, uint64(2), stats.Returned)
+}
@@ -0,0 +1,76 @@
+// Copyright (c) The Thanos Authors.
+// Licensed under the Apache License 2.0.
+
+package query
+
+import (
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/prometheus/common/model"
+)
+
+// AutoDownsamplingPolicy selects the maximum resolution of the data read by range queries with automatic
+// downsampling, from their step. The zero value fits at least 5 samples in each step, i.e. selects step / 5.
+type AutoDownsamplingPolicy struct {
+	// rules are sorted by increasing minimum step.
+	rules []autoDownsamplingRule
+}
+
+type autoDownsamplingRule struct {
+	minStep    time.Duration
+	resolution time.Duration
+}
+
+// ParseAutoDownsamplingPolicy parses rules of the form "<min step>:<max source resolution>", e.g. "5m:5m", allowing
+// queries with a step of at least 5m to read data downsampled to 5m. Queries with a step smaller than the minimum step
+// of all rules read raw data. A resolution must not be coarser than the minimum step of its rule, so that the
+// selected resolution is never coarser than the step of a query. Without rules, the zero value policy is returned.
+func ParseAutoDownsamplingPolicy(rules []string) (AutoDownsamplingPolicy, error) {
+	var p AutoDownsamplingPolicy
+	seen := map[time.Duration]struct{}{}
+	for _, rule := range rules {
+		step, resolution, ok := strings.Cut(rule, ":")
+		if !ok {
+			return AutoDownsamplingPolicy{}, errors.Errorf("rule %q must be of the form <min step>:<max source resolution>", rule)
+		}
+		minStep, err := model.ParseDuration(step)
+		if err != nil {
+			return AutoDownsamplingPolicy{}, errors.Wrapf(err, "parse minimum step of rule %q", rule)
+		}
+		res, err := model.ParseDuration(resolution)
+		if err != nil {
+			return AutoDownsamplingPolicy{}, errors.Wrapf(err, "parse resolution of rule %q", rule)
+		}
+		if minStep <= 0 {
+			return AutoDownsamplingPolicy{}, errors.Errorf("minimum step of rule %q must be positive", rule)
+		}
+		if res > minStep {
+			return AutoDownsamplingPolicy{}, errors.Errorf("resolution of rule %q must not be coarser than its minimum step", rule)
+		}
+		if _, ok := seen[time.Duration(minStep)]; ok {
+			return AutoDownsamplingPolicy{}, errors.Errorf("duplicate rule for minimum step %s", minStep)
+		}
+		seen[time.Duration(minStep)] = struct{}{}
+		p.rules = append(p.rules, autoDownsamplingRule{minStep: time.Duration(minStep), resolution: time.Duration(res)})
+	}
+	sort.Slice(p.rules, func(i, j int) bool { return p.rules[i].minStep < p.rules[j].minStep })
+	return p, nil
+}
+
+// MaxSourceResolution returns the maximum resolution of the data to read for a range query with the given step.
+func (p AutoDownsamplingPolicy) MaxSourceResolution(step time.Duration) time.Duration {
+	if len(p.rules) == 0 {
+		return step / 5
+	}
+	var res time.Duration
+	for _, r := range p.rules {
+		if r.minStep > step {
+			break
+		}
+		res = r.resolution
+	}
+	return res
+}
@@ -0,0 +1,40 @@
+// Copyright (c) The Thanos Authors.
+// Licensed under the Apache License 2.0.
+
+package query
+
+import (
+	"testing"
+	"time"
+
+	"github.com/efficientgo/core/testutil"
+)
+
+func TestAutoDownsamplingPolicy(t *testing.T) {
+	var p AutoDownsamplingPolicy
+	testutil.Equals(t, 3*time.Minute, p.MaxSourceResolution(15*time.Minute))
+
+	p, err := ParseAutoDownsamplingPolicy([]string{"2h:1h", "5m:5m"})
+	testutil.Ok(t, err)
+	for step, res := range map[time.Duration]time.Duration{
+		time.Minute:      0,
+		5 * time.Minute:  5 * time.Minute,
+		time.Hour:        5 * time.Minute,
+		2 * time.Hour:    time.Hour,
+		24 * time.Hour:   time.Hour,
+		30 * time.Second: 0,
+	} {
+		testutil.Equals(t, res, p.MaxSourceResolution(step), "step %s", step)
+	}
+
+	for _, invalid := range [][]string{
+		{"5m"},
+		{"5m:1h"},
+		{"0s:0s"},
+		{"5m:5m", "5m:1m"},
+		{"5x:5m"},
+	} {
+		_, err := ParseAutoDownsamplingPolicy(invalid)
+		testutil.NotOk(t, err, "%v", invalid)
+	}
+}
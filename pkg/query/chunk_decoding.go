@@ -0,0 +1,382 @@
+// Copyright (c) The Thanos Authors.
+// Licensed under the Apache License 2.0.
+
+package query
+
+import (
+	"context"
+	"encoding/binary"
+	"sync"
+
+	"github.com/prometheus/prometheus/model/histogram"
+	"github.com/prometheus/prometheus/storage"
+	"github.com/prometheus/prometheus/tsdb/chunkenc"
+	"github.com/prometheus/prometheus/util/annotations"
+	"go.uber.org/atomic"
+
+	"github.com/thanos-io/thanos/pkg/gate"
+	"github.com/thanos-io/thanos/pkg/store/storepb"
+)
+
+// decodeBatchSize is the number of series decoded by a goroutine holding the decode gate. Series sets fitting in a
+// single batch are decoded inline, as the consumer would only wait for the batch.
+const decodeBatchSize = 64
+
+// decodeReadAhead is the number of batches decoded ahead of the last series iterated by the consumer. It bounds the
+// samples buffered by a query.
+const decodeReadAhead = 4
+
+// decodingSeriesSet implements the SeriesSet interface of the Prometheus storage package on top of our storepb
+// SeriesSet, like promSeriesSet, but decodes the chunks of the series ahead of the consumer, in order, in goroutines
+// limited by the decode gate, which is shared by all queries. At most decodeReadAhead batches past the last series
+// iterated by the consumer are decoded. The samples of a series are buffered until the series is iterated, and
+// released by it. The consumer decodes the series it iterates before any goroutine claimed them itself, so it never
+// waits for the gate. Once the context of the query is done, no more series are decoded and buffered samples are
+// released.
+type decodingSeriesSet struct {
+	series []storage.Series
+	i      int
+	err    error
+
+	warns annotations.Annotations
+}
+
+// newDecodingSeriesSet drains seriesSet and starts decoding its series with the given gate until ctx is done.
+func newDecodingSeriesSet(ctx context.Context, decodeGate gate.Gate, seriesSet storepb.SeriesSet, mint, maxt int64, aggrs []storepb.Aggr, warns annotations.Annotations) storage.SeriesSet {
+	s := &decodingSeriesSet{i: -1, warns: warns}
+	var chunkSeries []*chunkSeries
+	for seriesSet.Next() {
+		lset, chks := seriesSet.At()
+		chunkSeries = append(chunkSeries, newChunkSeries(lset, chks, mint, maxt, aggrs))
+	}
+	if err := seriesSet.Err(); err != nil {
+		s.err = err
+		return s
+	}
+
+	s.series = make([]storage.Series, 0, len(chunkSeries))
+	if len(chunkSeries) <= decodeBatchSize {
+		for _, cs := range chunkSeries {
+			s.series = append(s.series, cs)
+		}
+		return s
+	}
+	progress := &decodeProgress{notify: make(chan struct{}, 1)}
+	decoded := make([]*decodedSeries, 0, len(chunkSeries))
+	for i, cs := range chunkSeries {
+		ds := &decodedSeries{chunkSeries: cs, ctx: ctx, idx: i, progress: progress, done: make(chan struct{})}
+		decoded = append(decoded, ds)
+		s.series = append(s.series, ds)
+	}
+	context.AfterFunc(ctx, func() {
+		for _, ds := range decoded {
+			ds.release()
+		}
+	})
+	go decodeSeries(ctx, decodeGate, progress, decoded)
+	return s
+}
+
+// decodeProgress tracks the series iterated by the consumer, to bound decoding ahead of it.
+type decodeProgress struct {
+	// iterated is the index of the last series iterated by the consumer, plus one.
+	iterated atomic.Int64
+	// notify wakes up the decoding waiting for the consumer.
+	notify chan struct{}
+}
+
+func (p *decodeProgress) iterate(i int) {
+	for n := p.iterated.Load(); int64(i) >= n; n = p.iterated.Load() {
+		if p.iterated.CompareAndSwap(n, int64(i)+1) {
+			break
+		}
+	}
+	select {
+	case p.notify <- struct{}{}:
+	default:
+	}
+}
+
+// wait waits until the series at index i is within the read-ahead window of the consumer, or ctx is done.
+func (p *decodeProgress) wait(ctx context.Context, i int) error {
+	for int64(i) >= p.iterated.Load()+decodeReadAhead*decodeBatchSize {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-p.notify:
+		}
+	}
+	return nil
+}
+
+// decodeSeries decodes the series not claimed by the consumer yet, in order, in batches decoded by as many goroutines
+// as allowed by the gate, until ctx is done. Batches are only decoded once they are within the read-ahead window.
+func decodeSeries(ctx context.Context, decodeGate gate.Gate, progress *decodeProgress, series []*decodedSeries) {
+	for start := 0; start < len(series); start += decodeBatchSize {
+		batch := series[start:min(len(series), start+decodeBatchSize)]
+		if batch[len(batch)-1].claimed.Load() {
+			// The consumer is already past the batch.
+			continue
+		}
+
+		if err := progress.wait(ctx, start); err != nil {
+			// The query is done, series left are released.
+			return
+		}
+		if err := decodeGate.Start(ctx); err != nil {
+			// The query is done, series left are released.
+			return
+		}
+		go func() {
+			defer decodeGate.Done()
+			for _, ds := range batch {
+				if ctx.Err() != nil {
+					return
+				}
+				if ds.claimed.CompareAndSwap(false, true) {
+					ds.decode()
+				}
+			}
+		}()
+	}
+}
+
+func (s *decodingSeriesSet) Next() bool {
+	if s.err != nil || s.i >= len(s.series)-1 {
+		return false
+	}
+	s.i++
+	return true
+}
+
+func (s *decodingSeriesSet) At() storage.Series {
+	return s.series[s.i]
+}
+
+func (s *decodingSeriesSet) Err() error {
+	return s.err
+}
+
+func (s *decodingSeriesSet) Warnings() annotations.Annotations {
+	return s.warns
+}
+
+// decodedSeries is a series whose samples are decoded once, by the decoding goroutines or by the consumer.
+type decodedSeries struct {
+	*chunkSeries
+
+	ctx      context.Context
+	idx      int
+	progress *decodeProgress
+	claimed  atomic.Bool
+	done     chan struct{}
+
+	mtx      sync.Mutex
+	samples  decodedSamples
+	err      error
+	iterated bool
+}
+
+// decode decodes the samples of the series, which must have been claimed. Samples are not buffered if the context of
+// the query is done in the meantime.
+func (s *decodedSeries) decode() {
+	defer close(s.done)
+
+	n := s.estimateSamples()
+	samples := decodedSamples{ts: make([]int64, 0, n), fs: make([]float64, 0, n)}
+	it := s.chunkSeries.Iterator(nil)
+	for vt := it.Next(); vt != chunkenc.ValNone; vt = it.Next() {
+		switch vt {
+		case chunkenc.ValFloat:
+			samples.appendFloat(it.At())
+		case chunkenc.ValHistogram:
+			t, h := it.AtHistogram(nil)
+			samples.appendHistogram(t, h, n)
+		case chunkenc.ValFloatHistogram:
+			t, fh := it.AtFloatHistogram(nil)
+			samples.appendFloatHistogram(t, fh, n)
+		}
+	}
+
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	if err := s.ctx.Err(); err != nil {
+		s.err = err
+		return
+	}
+	s.samples, s.err = samples, it.Err()
+}
+
+// estimateSamples estimates the number of samples of the series within the time range of the query from the number
+// of samples of its chunks, read from their headers, assuming samples are evenly spread over the chunks.
+func (s *decodedSeries) estimateSamples() int {
+	n := 0
+	for _, c := range s.chunks {
+		overlap := min(s.maxt, c.MaxTime) - max(s.mint, c.MinTime) + 1
+		if overlap <= 0 {
+			continue
+		}
+		// Chunks of all encodings start with their number of samples, and downsampled aggregates have the same number
+		// of samples.
+		for _, a := range []*storepb.Chunk{c.Raw, c.Count, c.Sum, c.Min, c.Max, c.Counter} {
+			if a != nil && len(a.Data) >= 2 {
+				n += int(int64(binary.BigEndian.Uint16(a.Data)) * overlap / (c.MaxTime - c.MinTime + 1))
+				break
+			}
+		}
+	}
+	return n
+}
+
+// release releases the buffered samples of the series, or prevents it from being decoded, once the context of the
+// query is done.
+func (s *decodedSeries) release() {
+	if s.claimed.CompareAndSwap(false, true) {
+		s.err = s.ctx.Err()
+		close(s.done)
+		return
+	}
+
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	s.samples = decodedSamples{}
+	if s.err == nil {
+		s.err = s.ctx.Err()
+	}
+}
+
+// Iterator returns an iterator over the decoded samples, which are released by the series. Iterating the series again
+// decodes its chunks inline.
+func (s *decodedSeries) Iterator(it chunkenc.Iterator) chunkenc.Iterator {
+	if s.claimed.CompareAndSwap(false, true) {
+		s.decode()
+	}
+	<-s.done
+	s.progress.iterate(s.idx)
+
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	if s.iterated {
+		return s.chunkSeries.Iterator(it)
+	}
+	s.iterated = true
+	samples := s.samples
+	s.samples = decodedSamples{}
+	return &decodedSeriesIterator{samples: samples, i: -1, err: s.err}
+}
+
+// decodedSamples holds decoded float, histogram or float histogram samples by column, so that float samples, the most
+// common ones, take 16 bytes. The histogram columns are only allocated once a histogram sample is decoded, and hold
+// nil for the other samples.
+type decodedSamples struct {
+	ts  []int64
+	fs  []float64
+	hs  []*histogram.Histogram
+	fhs []*histogram.FloatHistogram
+}
+
+func (s *decodedSamples) appendFloat(t int64, f float64) {
+	s.ts, s.fs = append(s.ts, t), append(s.fs, f)
+	if s.hs != nil {
+		s.hs = append(s.hs, nil)
+	}
+	if s.fhs != nil {
+		s.fhs = append(s.fhs, nil)
+	}
+}
+
+// appendHistogram appends a histogram sample, allocating the histogram column for n samples if it is the first one.
+func (s *decodedSamples) appendHistogram(t int64, h *histogram.Histogram, n int) {
+	if s.hs == nil {
+		s.hs = make([]*histogram.Histogram, len(s.ts), max(n, len(s.ts)+1))
+	}
+	s.appendFloat(t, 0)
+	s.hs[len(s.hs)-1] = h
+}
+
+// appendFloatHistogram appends a float histogram sample, allocating the float histogram column for n samples if it is
+// the first one.
+func (s *decodedSamples) appendFloatHistogram(t int64, fh *histogram.FloatHistogram, n int) {
+	if s.fhs == nil {
+		s.fhs = make([]*histogram.FloatHistogram, len(s.ts), max(n, len(s.ts)+1))
+	}
+	s.appendFloat(t, 0)
+	s.fhs[len(s.fhs)-1] = fh
+}
+
+func (s *decodedSamples) valueType(i int) chunkenc.ValueType {
+	switch {
+	case s.hs != nil && s.hs[i] != nil:
+		return chunkenc.ValHistogram
+	case s.fhs != nil && s.fhs[i] != nil:
+		return chunkenc.ValFloatHistogram
+	default:
+		return chunkenc.ValFloat
+	}
+}
+
+// decodedSeriesIterator iterates over decoded samples. Decoding errors are returned once all samples decoded before
+// them are iterated.
+type decodedSeriesIterator struct {
+	samples decodedSamples
+	i       int
+	err     error
+}
+
+func (it *decodedSeriesIterator) Next() chunkenc.ValueType {
+	if it.i >= len(it.samples.ts)-1 {
+		it.i = len(it.samples.ts)
+		return chunkenc.ValNone
+	}
+	it.i++
+	return it.samples.valueType(it.i)
+}
+
+func (it *decodedSeriesIterator) Seek(t int64) chunkenc.ValueType {
+	if it.i < 0 {
+		it.i = 0
+	}
+	for ; it.i < len(it.samples.ts); it.i++ {
+		if it.samples.ts[it.i] >= t {
+			return it.samples.valueType(it.i)
+		}
+	}
+	return chunkenc.ValNone
+}
+
+func (it *decodedSeriesIterator) At() (int64, float64) {
+	return it.samples.ts[it.i], it.samples.fs[it.i]
+}
+
+func (it *decodedSeriesIterator) AtHistogram(h *histogram.Histogram) (int64, *histogram.Histogram) {
+	t, sh := it.samples.ts[it.i], it.samples.hs[it.i]
+	if h == nil {
+		return t, sh.Copy()
+	}
+	sh.CopyTo(h)
+	return t, h
+}
+
+func (it *decodedSeriesIterator) AtFloatHistogram(fh *histogram.FloatHistogram) (int64, *histogram.FloatHistogram) {
+	t := it.samples.ts[it.i]
+	if it.samples.hs != nil && it.samples.hs[it.i] != nil {
+		return t, it.samples.hs[it.i].ToFloat(fh)
+	}
+	sfh := it.samples.fhs[it.i]
+	if fh == nil {
+		return t, sfh.Copy()
+	}
+	sfh.CopyTo(fh)
+	return t, fh
+}
+
+func (it *decodedSeriesIterator) AtT() int64 {
+	return it.samples.ts[it.i]
+}
+
+func (it *decodedSeriesIterator) Err() error {
+	if it.i >= len(it.samples.ts) {
+		return it.err
+	}
+	return nil
+}
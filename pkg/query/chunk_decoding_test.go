@@ -0,0 +1,240 @@
+// Copyright (c) The Thanos Authors.
+// Licensed under the Apache License 2.0.
+
+package query
+
+import (
+	"context"
+	"fmt"
+	"math/rand"
+	"testing"
+	"time"
+
+	"github.com/efficientgo/core/testutil"
+	"github.com/prometheus/prometheus/model/histogram"
+	"github.com/prometheus/prometheus/storage"
+	"github.com/prometheus/prometheus/tsdb/chunkenc"
+	"github.com/prometheus/prometheus/util/gate"
+
+	"github.com/thanos-io/thanos/pkg/store/storepb"
+	storetestutil "github.com/thanos-io/thanos/pkg/store/storepb/testutil"
+)
+
+func createDecodingTestSeries(t testing.TB, numSeries, samplesPerSeries int, sampleType chunkenc.ValueType) []storepb.Series {
+	head, created := storetestutil.CreateHeadWithSeries(t, 0, storetestutil.HeadGenOptions{
+		TSDBDir:          t.TempDir(),
+		SamplesPerSeries: samplesPerSeries,
+		Series:           numSeries,
+		SampleType:       sampleType,
+		Random:           rand.New(rand.NewSource(120)),
+	})
+	testutil.Ok(t, head.Close())
+
+	series := make([]storepb.Series, 0, len(created))
+	for _, s := range created {
+		series = append(series, storepb.Series{Labels: s.Labels, Chunks: s.Chunks})
+	}
+	return series
+}
+
+func TestDecodingSeriesSet(t *testing.T) {
+	for _, sampleType := range []chunkenc.ValueType{chunkenc.ValFloat, chunkenc.ValHistogram, chunkenc.ValFloatHistogram} {
+		t.Run(sampleType.String(), func(t *testing.T) {
+			series := createDecodingTestSeries(t, 4*decodeBatchSize, 200, sampleType)
+			// Samples of the series follow each other, the first and last series are cut by the time range.
+			mint, maxt := int64(100), int64(4*decodeBatchSize*200-100)
+			expected := NewPromSeriesSet(newStoreSeriesSet(series), mint, maxt, []storepb.Aggr{storepb.Aggr_COUNT, storepb.Aggr_SUM}, nil)
+			got := newDecodingSeriesSet(context.Background(), gate.New(4), newStoreSeriesSet(series), mint, maxt, []storepb.Aggr{storepb.Aggr_COUNT, storepb.Aggr_SUM}, nil)
+
+			// Gather all series first, as PromQL does, while they are decoded.
+			var gotSeries []storage.Series
+			for got.Next() {
+				gotSeries = append(gotSeries, got.At())
+			}
+			testutil.Ok(t, got.Err())
+
+			for _, s := range gotSeries {
+				testutil.Assert(t, expected.Next())
+				exp := expected.At()
+				testutil.Equals(t, exp.Labels(), s.Labels())
+
+				expIt, it := exp.Iterator(nil), s.Iterator(nil)
+				for vt := expIt.Next(); vt != chunkenc.ValNone; vt = expIt.Next() {
+					testutil.Equals(t, vt, it.Next())
+					switch vt {
+					case chunkenc.ValFloat:
+						expT, expV := expIt.At()
+						gotT, gotV := it.At()
+						testutil.Equals(t, expT, gotT)
+						testutil.Equals(t, expV, gotV)
+					case chunkenc.ValHistogram:
+						expT, expH := expIt.AtHistogram(nil)
+						gotT, gotH := it.AtHistogram(nil)
+						testutil.Equals(t, expT, gotT)
+						testutil.Equals(t, expH, gotH)
+					case chunkenc.ValFloatHistogram:
+						expT, expFH := expIt.AtFloatHistogram(nil)
+						gotT, gotFH := it.AtFloatHistogram(nil)
+						testutil.Equals(t, expT, gotT)
+						testutil.Equals(t, expFH, gotFH)
+					}
+				}
+				testutil.Equals(t, chunkenc.ValNone, it.Next())
+				testutil.Ok(t, it.Err())
+			}
+			testutil.Assert(t, !expected.Next())
+		})
+	}
+
+	t.Run("seek", func(t *testing.T) {
+		set := newDecodingSeriesSet(context.Background(), gate.New(2), newStoreSeriesSet(createDecodingTestSeries(t, 2*decodeBatchSize, 500, chunkenc.ValFloat)), 0, 499, []storepb.Aggr{storepb.Aggr_COUNT, storepb.Aggr_SUM}, nil)
+		testutil.Assert(t, set.Next())
+		it := set.At().Iterator(nil)
+
+		testutil.Equals(t, chunkenc.ValFloat, it.Seek(100))
+		testutil.Equals(t, int64(100), it.AtT())
+		// Seeking backwards does not move the iterator.
+		testutil.Equals(t, chunkenc.ValFloat, it.Seek(50))
+		testutil.Equals(t, int64(100), it.AtT())
+		testutil.Equals(t, chunkenc.ValFloat, it.Next())
+		testutil.Equals(t, int64(101), it.AtT())
+		testutil.Equals(t, chunkenc.ValNone, it.Seek(500))
+		testutil.Ok(t, it.Err())
+	})
+
+	t.Run("bounded read-ahead", func(t *testing.T) {
+		// The decoding waits for the consumer until the query is done.
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+
+		window := decodeReadAhead * decodeBatchSize
+		set := newDecodingSeriesSet(ctx, gate.New(4), newStoreSeriesSet(createDecodingTestSeries(t, window+2*decodeBatchSize, 100, chunkenc.ValFloat)), 0, 99, []storepb.Aggr{storepb.Aggr_COUNT, storepb.Aggr_SUM}, nil)
+		var series []*decodedSeries
+		for set.Next() {
+			series = append(series, set.At().(*decodedSeries))
+		}
+		testutil.Ok(t, set.Err())
+
+		// Series past the window are not decoded until the consumer iterates series.
+		<-series[window-1].done
+		time.Sleep(50 * time.Millisecond)
+		testutil.Assert(t, !series[window].claimed.Load(), "series past the read-ahead window decoded")
+
+		it := series[0].Iterator(nil)
+		<-series[window].done
+		time.Sleep(50 * time.Millisecond)
+		testutil.Assert(t, !series[window+decodeBatchSize].claimed.Load(), "series past the read-ahead window decoded")
+
+		// Iterated series release their samples, iterating them again decodes their chunks.
+		series[0].mtx.Lock()
+		testutil.Equals(t, 0, len(series[0].samples.ts))
+		series[0].mtx.Unlock()
+		for range 2 {
+			var samples int
+			for it.Next() != chunkenc.ValNone {
+				samples++
+			}
+			testutil.Ok(t, it.Err())
+			testutil.Equals(t, 100, samples)
+			it = series[0].Iterator(nil)
+		}
+	})
+
+	t.Run("canceled query", func(t *testing.T) {
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+
+		decodeGate := gate.New(1)
+		set := newDecodingSeriesSet(ctx, decodeGate, newStoreSeriesSet(createDecodingTestSeries(t, 4*decodeBatchSize, 100, chunkenc.ValFloat)), 0, 99, nil, nil)
+		for set.Next() {
+			it := set.At().Iterator(nil)
+			testutil.Equals(t, chunkenc.ValNone, it.Next())
+			testutil.Equals(t, context.Canceled, it.Err())
+		}
+		testutil.Ok(t, set.Err())
+
+		// Decoding goroutines give their slots back.
+		testutil.Ok(t, decodeGate.Start(context.Background()))
+		decodeGate.Done()
+	})
+}
+
+func TestDecodedSamples(t *testing.T) {
+	h := &histogram.Histogram{Count: 1, Sum: 1}
+	fh := &histogram.FloatHistogram{Count: 2, Sum: 2}
+
+	var samples decodedSamples
+	samples.appendFloat(1, 1)
+	samples.appendHistogram(2, h, 4)
+	samples.appendFloat(3, 3)
+	samples.appendFloatHistogram(4, fh, 4)
+
+	it := &decodedSeriesIterator{samples: samples, i: -1}
+	testutil.Equals(t, chunkenc.ValFloat, it.Next())
+	ts, v := it.At()
+	testutil.Equals(t, int64(1), ts)
+	testutil.Equals(t, 1.0, v)
+	testutil.Equals(t, chunkenc.ValHistogram, it.Next())
+	ts, gotH := it.AtHistogram(nil)
+	testutil.Equals(t, int64(2), ts)
+	testutil.Equals(t, h, gotH)
+	ts, gotFH := it.AtFloatHistogram(nil)
+	testutil.Equals(t, int64(2), ts)
+	testutil.Equals(t, h.ToFloat(nil), gotFH)
+	testutil.Equals(t, chunkenc.ValFloatHistogram, it.Seek(4))
+	ts, gotFH = it.AtFloatHistogram(nil)
+	testutil.Equals(t, int64(4), ts)
+	testutil.Equals(t, fh, gotFH)
+	testutil.Equals(t, chunkenc.ValNone, it.Next())
+	testutil.Ok(t, it.Err())
+}
+
+// BenchmarkDecodingSeriesSet compares decoding chunks inline during evaluation with decoding them ahead of it, for
+// small queries and queries selecting few and many series. Series are iterated as PromQL does, gathering all of them
+// first.
+func BenchmarkDecodingSeriesSet(b *testing.B) {
+	aggrs := []storepb.Aggr{storepb.Aggr_COUNT, storepb.Aggr_SUM}
+
+	for _, tc := range []struct {
+		numSeries, numSamples int
+	}{
+		{numSeries: 1, numSamples: 10},
+		{numSeries: 10, numSamples: 480},
+		{numSeries: 2 * decodeBatchSize, numSamples: 10},
+		{numSeries: 10000, numSamples: 480},
+	} {
+		series := createDecodingTestSeries(b, tc.numSeries, tc.numSamples, chunkenc.ValFloat)
+		// Samples of the series follow each other.
+		maxt := int64(tc.numSeries * tc.numSamples)
+
+		for _, workers := range []int{0, 4} {
+			b.Run(fmt.Sprintf("series=%d,samples=%d,workers=%d", tc.numSeries, tc.numSamples, workers), func(b *testing.B) {
+				b.ReportAllocs()
+				decodeGate := gate.New(max(workers, 1))
+
+				for i := 0; i < b.N; i++ {
+					var set storage.SeriesSet
+					if workers == 0 {
+						set = NewPromSeriesSet(newStoreSeriesSet(series), 0, maxt, aggrs, nil)
+					} else {
+						set = newDecodingSeriesSet(context.Background(), decodeGate, newStoreSeriesSet(series), 0, maxt, aggrs, nil)
+					}
+
+					var gathered []storage.Series
+					for set.Next() {
+						gathered = append(gathered, set.At())
+					}
+					testutil.Ok(b, set.Err())
+
+					for _, s := range gathered {
+						it := s.Iterator(nil)
+						for it.Next() != chunkenc.ValNone {
+							testT, testV = it.At()
+						}
+						testutil.Ok(b, it.Err())
+					}
+				}
+			})
+		}
+	}
+}
@@ -0,0 +1,415 @@
+// Copyright (c) The Thanos Authors.
+// Licensed under the Apache License 2.0.
+
+package query
+
+import (
+	"context"
+	"math"
+	"sort"
+	"strconv"
+
+	"github.com/pkg/errors"
+	"github.com/prometheus/prometheus/model/histogram"
+	"github.com/prometheus/prometheus/model/labels"
+	"github.com/prometheus/prometheus/storage"
+	"github.com/prometheus/prometheus/tsdb/chunkenc"
+	"github.com/prometheus/prometheus/tsdb/chunks"
+	"github.com/prometheus/prometheus/util/annotations"
+	"gopkg.in/yaml.v2"
+)
+
+// HistogramMergeConfig configures which classic histograms are merged with native histograms by queries run with
+// ContextWithHistogramMerge.
+type HistogramMergeConfig struct {
+	// Mappings map native histograms to the classic histograms they replace. Only native histograms with a mapping
+	// are merged.
+	Mappings []HistogramMapping `yaml:"mappings"`
+}
+
+// HistogramMapping maps a native histogram to the classic histogram it replaces.
+type HistogramMapping struct {
+	// Native is the metric name of the native histogram.
+	Native string `yaml:"native"`
+	// Classic is the metric name of the classic histogram, without the _bucket, _sum and _count suffixes. It defaults
+	// to the name of the native histogram.
+	Classic string `yaml:"classic"`
+}
+
+// HistogramMerger merges classic histograms into the native histograms they are mapped to.
+type HistogramMerger struct {
+	classicByNative map[string]string
+}
+
+// NewHistogramMerger parses the YAML HistogramMergeConfig and returns a HistogramMerger applying it.
+func NewHistogramMerger(content []byte) (*HistogramMerger, error) {
+	var conf HistogramMergeConfig
+	if err := yaml.UnmarshalStrict(content, &conf); err != nil {
+		return nil, errors.Wrap(err, "parse histogram merge config")
+	}
+	m := &HistogramMerger{classicByNative: make(map[string]string, len(conf.Mappings))}
+	for _, mapping := range conf.Mappings {
+		if mapping.Native == "" {
+			return nil, errors.New("histogram mapping without native metric name")
+		}
+		if _, ok := m.classicByNative[mapping.Native]; ok {
+			return nil, errors.Errorf("duplicate histogram mapping of %s", mapping.Native)
+		}
+		if mapping.Classic == "" {
+			mapping.Classic = mapping.Native
+		}
+		m.classicByNative[mapping.Native] = mapping.Classic
+	}
+	return m, nil
+}
+
+// classicName returns the metric name of the classic histogram merged into the given native histogram, if any.
+func (m *HistogramMerger) classicName(native string) (string, bool) {
+	classic, ok := m.classicByNative[native]
+	return classic, ok
+}
+
+type histogramMergerKey struct{}
+
+// ContextWithHistogramMerge returns a context making the queries run with it merge classic histograms into the native
+// histograms they are mapped to by m.
+func ContextWithHistogramMerge(ctx context.Context, m *HistogramMerger) context.Context {
+	return context.WithValue(ctx, histogramMergerKey{}, m)
+}
+
+func histogramMergerFromContext(ctx context.Context) *HistogramMerger {
+	m, _ := ctx.Value(histogramMergerKey{}).(*HistogramMerger)
+	return m
+}
+
+// nativeHistogramName returns the metric name selected by the matchers, if it is selected by equality.
+func nativeHistogramName(ms []*labels.Matcher) (string, bool) {
+	for _, m := range ms {
+		if m.Name == labels.MetricName && m.Type == labels.MatchEqual && m.Value != "" {
+			return m.Value, true
+		}
+	}
+	return "", false
+}
+
+// withMetricName returns the matchers with the metric name matcher replaced by one selecting the given name.
+func withMetricName(ms []*labels.Matcher, name string) []*labels.Matcher {
+	res := make([]*labels.Matcher, 0, len(ms))
+	for _, m := range ms {
+		if m.Name == labels.MetricName {
+			m = labels.MustNewMatcher(labels.MatchEqual, labels.MetricName, name)
+		}
+		res = append(res, m)
+	}
+	return res
+}
+
+// fSample is a float sample.
+type fSample struct {
+	t int64
+	f float64
+}
+
+// floatSamples holds the samples of a float series in time order.
+type floatSamples []fSample
+
+// at returns the value of the sample at t, starting the search at the sample *i and moving *i past the samples
+// before t, so that the samples are walked once for increasing t.
+func (s floatSamples) at(i *int, t int64) (float64, bool) {
+	for *i < len(s) && s[*i].t < t {
+		*i++
+	}
+	if *i < len(s) && s[*i].t == t {
+		return s[*i].f, true
+	}
+	return 0, false
+}
+
+// classicSeries is a classic histogram, converted into native histograms with custom buckets when iterated.
+type classicSeries struct {
+	lset       labels.Labels
+	buckets    map[float64]*floatSamples
+	sum, count floatSamples
+}
+
+// classicHistogramSeriesSet holds the classic histograms merged into a native histogram.
+type classicHistogramSeriesSet struct {
+	histogramSeriesSet
+
+	// bounds holds the upper bounds of the buckets of the classic histograms by labels, and their union.
+	bounds    map[string][]float64
+	allBounds []float64
+}
+
+// customBounds returns the upper bounds of the buckets of the classic histogram with the given labels, or of all
+// classic histograms if there is none with these labels.
+func (s *classicHistogramSeriesSet) customBounds(lset labels.Labels) []float64 {
+	if b, ok := s.bounds[lset.String()]; ok {
+		return b
+	}
+	return s.allBounds
+}
+
+// classicToNativeSeriesSet converts the series of the _bucket, _sum and _count series sets of a classic histogram
+// into native histograms with custom buckets, named after the native histogram they are merged into. Samples at
+// which the buckets are incomplete, e.g. lack the +Inf bucket, are skipped.
+func classicToNativeSeriesSet(native string, buckets, sum, count storage.SeriesSet) (*classicHistogramSeriesSet, error) {
+	var (
+		warns  annotations.Annotations
+		series = map[string]*classicSeries{}
+	)
+	get := func(lset labels.Labels) *classicSeries {
+		lb := labels.NewBuilder(lset).Set(labels.MetricName, native).Del(labels.BucketLabel)
+		lset = lb.Labels()
+		key := lset.String()
+		s, ok := series[key]
+		if !ok {
+			s = &classicSeries{lset: lset, buckets: map[float64]*floatSamples{}}
+			series[key] = s
+		}
+		return s
+	}
+	read := func(set storage.SeriesSet, add func(s storage.Series) *floatSamples) error {
+		var it chunkenc.Iterator
+		for set.Next() {
+			s := set.At()
+			samples := add(s)
+			if samples == nil {
+				continue
+			}
+			it = s.Iterator(it)
+			for vt := it.Next(); vt != chunkenc.ValNone; vt = it.Next() {
+				if vt != chunkenc.ValFloat {
+					continue
+				}
+				t, v := it.At()
+				*samples = append(*samples, fSample{t: t, f: v})
+			}
+			if err := it.Err(); err != nil {
+				return err
+			}
+		}
+		warns.Merge(set.Warnings())
+		return set.Err()
+	}
+
+	if err := read(buckets, func(s storage.Series) *floatSamples {
+		le, err := strconv.ParseFloat(s.Labels().Get(labels.BucketLabel), 64)
+		if err != nil {
+			return nil
+		}
+		cs := get(s.Labels())
+		if cs.buckets[le] == nil {
+			cs.buckets[le] = &floatSamples{}
+		}
+		return cs.buckets[le]
+	}); err != nil {
+		return nil, errors.Wrap(err, "read classic histogram buckets")
+	}
+	if err := read(sum, func(s storage.Series) *floatSamples { return &get(s.Labels()).sum }); err != nil {
+		return nil, errors.Wrap(err, "read classic histogram sums")
+	}
+	if err := read(count, func(s storage.Series) *floatSamples { return &get(s.Labels()).count }); err != nil {
+		return nil, errors.Wrap(err, "read classic histogram counts")
+	}
+
+	res := &classicHistogramSeriesSet{
+		histogramSeriesSet: histogramSeriesSet{series: make([]storage.Series, 0, len(series)), i: -1, warns: warns},
+		bounds:             make(map[string][]float64, len(series)),
+	}
+	all := map[float64]struct{}{}
+	for key, cs := range series {
+		if _, ok := cs.buckets[math.Inf(1)]; !ok {
+			continue
+		}
+		bounds := cs.bounds()
+		for _, b := range bounds {
+			all[b] = struct{}{}
+		}
+		res.bounds[key] = bounds
+		res.series = append(res.series, &classicHistogramSeries{classicSeries: cs, bounds: bounds})
+	}
+	if len(all) > 0 {
+		res.allBounds = make([]float64, 0, len(all))
+		for b := range all {
+			res.allBounds = append(res.allBounds, b)
+		}
+		sort.Float64s(res.allBounds)
+	}
+	sort.Slice(res.series, func(i, j int) bool { return labels.Compare(res.series[i].Labels(), res.series[j].Labels()) < 0 })
+	return res, nil
+}
+
+// bounds returns the sorted upper bounds of the buckets of the classic histogram.
+func (cs *classicSeries) bounds() []float64 {
+	bounds := make([]float64, 0, len(cs.buckets))
+	for le := range cs.buckets {
+		bounds = append(bounds, le)
+	}
+	sort.Float64s(bounds)
+	return bounds
+}
+
+// classicHistogramSeries is a classic histogram, converted into native histograms with custom buckets when iterated.
+type classicHistogramSeries struct {
+	*classicSeries
+	bounds []float64
+}
+
+func (s *classicHistogramSeries) Labels() labels.Labels { return s.lset }
+
+func (s *classicHistogramSeries) Iterator(it chunkenc.Iterator) chunkenc.Iterator {
+	return storage.NewListSeries(s.lset, s.histograms()).Iterator(it)
+}
+
+// histograms returns the samples of the classic histogram as native histograms with custom buckets.
+func (s *classicHistogramSeries) histograms() []chunks.Sample {
+	var (
+		inf        = *s.buckets[math.Inf(1)]
+		samples    = make([]chunks.Sample, 0, len(inf))
+		bucketIdx  = make([]int, len(s.bounds))
+		sumIdx     int
+		countIdx   int
+		customVals = s.bounds[:len(s.bounds)-1]
+	)
+next:
+	for _, infSample := range inf {
+		t := infSample.t
+		fh := &histogram.FloatHistogram{
+			Schema:          histogram.CustomBucketsSchema,
+			Count:           infSample.f,
+			PositiveSpans:   []histogram.Span{{Offset: 0, Length: uint32(len(s.bounds))}},
+			PositiveBuckets: make([]float64, 0, len(s.bounds)),
+			CustomValues:    customVals,
+		}
+		fh.Sum, _ = s.sum.at(&sumIdx, t)
+		if count, ok := s.count.at(&countIdx, t); ok {
+			fh.Count = count
+		}
+		prev := 0.0
+		for i, le := range s.bounds {
+			cumulative, ok := s.buckets[le].at(&bucketIdx[i], t)
+			if !ok {
+				continue next
+			}
+			// Buckets scraped non-atomically can decrease, which cannot be represented by native histograms.
+			fh.PositiveBuckets = append(fh.PositiveBuckets, math.Max(cumulative-prev, 0))
+			prev = math.Max(cumulative, prev)
+		}
+		samples = append(samples, histogramSample{t: t, fh: fh})
+	}
+	return samples
+}
+
+// customBucketsSeriesSet converts the exponential native histograms of its series into native histograms with the
+// custom buckets of the classic histograms they are merged with, so that functions like rate can be applied across
+// samples of both, e.g. at the boundary of the migration from classic to native histograms.
+type customBucketsSeriesSet struct {
+	storage.SeriesSet
+	bounds func(labels.Labels) []float64
+}
+
+func (s *customBucketsSeriesSet) At() storage.Series {
+	series := s.SeriesSet.At()
+	bounds := s.bounds(series.Labels())
+	if len(bounds) == 0 {
+		return series
+	}
+	return &customBucketsSeries{Series: series, bounds: bounds}
+}
+
+type customBucketsSeries struct {
+	storage.Series
+	bounds []float64
+}
+
+func (s *customBucketsSeries) Iterator(it chunkenc.Iterator) chunkenc.Iterator {
+	if cit, ok := it.(*customBucketsIterator); ok {
+		cit.Iterator = s.Series.Iterator(cit.Iterator)
+		cit.bounds = s.bounds
+		return cit
+	}
+	return &customBucketsIterator{Iterator: s.Series.Iterator(it), bounds: s.bounds}
+}
+
+// customBucketsIterator returns the histograms of the underlying iterator as float histograms with custom buckets.
+type customBucketsIterator struct {
+	chunkenc.Iterator
+	bounds []float64
+}
+
+func (it *customBucketsIterator) valueType(vt chunkenc.ValueType) chunkenc.ValueType {
+	if vt == chunkenc.ValHistogram {
+		return chunkenc.ValFloatHistogram
+	}
+	return vt
+}
+
+func (it *customBucketsIterator) Next() chunkenc.ValueType { return it.valueType(it.Iterator.Next()) }
+
+func (it *customBucketsIterator) Seek(t int64) chunkenc.ValueType {
+	return it.valueType(it.Iterator.Seek(t))
+}
+
+func (it *customBucketsIterator) AtFloatHistogram(*histogram.FloatHistogram) (int64, *histogram.FloatHistogram) {
+	t, fh := it.Iterator.AtFloatHistogram(nil)
+	if fh.UsesCustomBuckets() {
+		return t, fh
+	}
+	return t, toCustomBuckets(fh, it.bounds)
+}
+
+// toCustomBuckets returns the exponential histogram fh with its observations counted in custom buckets of the given
+// upper bounds, the last of which is +Inf. Each bucket of fh is counted in the custom bucket holding its upper
+// bound, which is exact for bounds at the boundaries of the buckets of fh and otherwise attributes the observations
+// of a bucket of fh to the upper one of the custom buckets it overlaps.
+func toCustomBuckets(fh *histogram.FloatHistogram, bounds []float64) *histogram.FloatHistogram {
+	res := &histogram.FloatHistogram{
+		CounterResetHint: fh.CounterResetHint,
+		Schema:           histogram.CustomBucketsSchema,
+		Count:            fh.Count,
+		Sum:              fh.Sum,
+		PositiveSpans:    []histogram.Span{{Offset: 0, Length: uint32(len(bounds))}},
+		PositiveBuckets:  make([]float64, len(bounds)),
+		CustomValues:     bounds[:len(bounds)-1],
+	}
+	it := fh.AllBucketIterator()
+	for it.Next() {
+		b := it.At()
+		if b.Count == 0 {
+			continue
+		}
+		i := sort.SearchFloat64s(bounds, b.Upper)
+		if i == len(bounds) {
+			i--
+		}
+		res.PositiveBuckets[i] += b.Count
+	}
+	return res
+}
+
+type histogramSample struct {
+	t  int64
+	fh *histogram.FloatHistogram
+}
+
+func (s histogramSample) T() int64                      { return s.t }
+func (s histogramSample) F() float64                    { return 0 }
+func (s histogramSample) H() *histogram.Histogram       { return nil }
+func (s histogramSample) FH() *histogram.FloatHistogram { return s.fh }
+func (s histogramSample) Type() chunkenc.ValueType      { return chunkenc.ValFloatHistogram }
+
+type histogramSeriesSet struct {
+	series []storage.Series
+	i      int
+	warns  annotations.Annotations
+}
+
+func (s *histogramSeriesSet) Next() bool {
+	s.i++
+	return s.i < len(s.series)
+}
+
+func (s *histogramSeriesSet) At() storage.Series                { return s.series[s.i] }
+func (s *histogramSeriesSet) Err() error                        { return nil }
+func (s *histogramSeriesSet) Warnings() annotations.Annotations { return s.warns }
@@ -0,0 +1,174 @@
+// Copyright (c) The Thanos Authors.
+// Licensed under the Apache License 2.0.
+
+package query
+
+import (
+	"context"
+	"math"
+	"testing"
+	"time"
+
+	"github.com/efficientgo/core/testutil"
+	"github.com/prometheus/prometheus/model/histogram"
+	"github.com/prometheus/prometheus/model/labels"
+	"github.com/prometheus/prometheus/promql"
+	"github.com/prometheus/prometheus/storage"
+	"github.com/prometheus/prometheus/tsdb/chunkenc"
+	"github.com/prometheus/prometheus/util/gate"
+
+	"github.com/thanos-io/thanos/pkg/component"
+	"github.com/thanos-io/thanos/pkg/store"
+	"github.com/thanos-io/thanos/pkg/testutil/e2eutil"
+)
+
+func TestQuerier_Select_MergeHistograms(t *testing.T) {
+	db, err := e2eutil.NewTSDB()
+	testutil.Ok(t, err)
+	t.Cleanup(func() { testutil.Ok(t, db.Close()) })
+	db.EnableNativeHistograms()
+
+	app := db.Appender(context.Background())
+	for _, ts := range []int64{0, 15000, 30000} {
+		for le, v := range map[string]float64{"0.1": 1, "1": 3, "+Inf": 4} {
+			_, err := app.Append(0, labels.FromStrings("__name__", "legacy_duration_seconds_bucket", "job", "api", "le", le), ts, v*float64(ts/15000+1))
+			testutil.Ok(t, err)
+		}
+		_, err := app.Append(0, labels.FromStrings("__name__", "legacy_duration_seconds_sum", "job", "api"), ts, 2)
+		testutil.Ok(t, err)
+	}
+	// The +Inf bucket is missing, so the classic histogram of this job is skipped.
+	_, err = app.Append(0, labels.FromStrings("__name__", "legacy_duration_seconds_bucket", "job", "web", "le", "1"), 0, 1)
+	testutil.Ok(t, err)
+	// Samples of the native histogram take precedence over the ones of the classic histogram at the same timestamp.
+	native := &histogram.FloatHistogram{
+		Schema:          0,
+		Count:           10,
+		Sum:             5,
+		PositiveSpans:   []histogram.Span{{Offset: 0, Length: 1}},
+		PositiveBuckets: []float64{10},
+	}
+	for _, ts := range []int64{30000, 45000} {
+		_, err = app.AppendHistogram(0, labels.FromStrings("__name__", "duration_seconds", "job", "api"), ts, nil, native)
+		testutil.Ok(t, err)
+	}
+	testutil.Ok(t, app.Commit())
+
+	q := newQuerier(nil, 0, 45000, nil, nil, newProxyStore(store.NewTSDBStore(nil, db, component.Rule, labels.EmptyLabels())), false, 0, true, false, gate.New(2), 10*time.Second, nil, NoopSeriesStatsReporter, 0, 0, 0, nil, nil)
+	t.Cleanup(func() { testutil.Ok(t, q.Close()) })
+
+	merger, err := NewHistogramMerger([]byte(`mappings: [{native: duration_seconds, classic: legacy_duration_seconds}]`))
+	testutil.Ok(t, err)
+	selectHistograms := func(ctx context.Context) map[int64]*histogram.FloatHistogram {
+		res := q.Select(ctx, false, nil, labels.MustNewMatcher(labels.MatchEqual, "__name__", "duration_seconds"))
+		samples := map[int64]*histogram.FloatHistogram{}
+		for res.Next() {
+			testutil.Equals(t, labels.FromStrings("__name__", "duration_seconds", "job", "api"), res.At().Labels())
+			it := res.At().Iterator(nil)
+			for it.Next() != chunkenc.ValNone {
+				ts, fh := it.AtFloatHistogram(nil)
+				samples[ts] = fh
+			}
+			testutil.Ok(t, it.Err())
+		}
+		testutil.Ok(t, res.Err())
+		return samples
+	}
+
+	// Classic histograms are only merged for queries opting in.
+	testutil.Equals(t, 2, len(selectHistograms(context.Background())))
+
+	samples := selectHistograms(ContextWithHistogramMerge(context.Background(), merger))
+	testutil.Equals(t, 4, len(samples))
+	testutil.Equals(t, int32(histogram.CustomBucketsSchema), samples[15000].Schema)
+	testutil.Equals(t, []float64{0.1, 1}, samples[15000].CustomValues)
+	testutil.Equals(t, []float64{2, 4, 2}, samples[15000].PositiveBuckets)
+	testutil.Equals(t, 8.0, samples[15000].Count)
+	testutil.Equals(t, 2.0, samples[15000].Sum)
+	testutil.Equals(t, native.Count, samples[30000].Count)
+	// Exponential native histograms get the buckets of the classic histogram.
+	testutil.Equals(t, int32(histogram.CustomBucketsSchema), samples[45000].Schema)
+	testutil.Equals(t, []float64{0.1, 1}, samples[45000].CustomValues)
+	testutil.Equals(t, []float64{0, 10, 0}, samples[45000].PositiveBuckets)
+	testutil.Equals(t, native.Count, samples[45000].Count)
+
+	// Native histograms without mapping are not merged.
+	samples = selectHistograms(ContextWithHistogramMerge(context.Background(), &HistogramMerger{}))
+	testutil.Equals(t, 2, len(samples))
+	testutil.Equals(t, int32(0), samples[45000].Schema)
+
+	// Mappings without classic name merge the classic histogram of the same name.
+	merger, err = NewHistogramMerger([]byte(`mappings: [{native: legacy_duration_seconds}]`))
+	testutil.Ok(t, err)
+	res := q.Select(ContextWithHistogramMerge(context.Background(), merger), false, nil, labels.MustNewMatcher(labels.MatchEqual, "__name__", "legacy_duration_seconds"))
+	testutil.Assert(t, res.Next(), "expected merged classic histogram")
+	testutil.Equals(t, labels.FromStrings("__name__", "legacy_duration_seconds", "job", "api"), res.At().Labels())
+	testutil.Assert(t, !res.Next(), "expected a single series")
+	testutil.Ok(t, res.Err())
+
+	for _, invalid := range []string{
+		`mappings: [{classic: a}]`,
+		`mappings: [{native: a, classic: b}, {native: a, classic: c}]`,
+		`mappings: [{native: a, classic: b, unknown: c}]`,
+	} {
+		_, err := NewHistogramMerger([]byte(invalid))
+		testutil.NotOk(t, err, invalid)
+	}
+}
+
+func TestQuerier_MergeHistograms_PromQL(t *testing.T) {
+	db, err := e2eutil.NewTSDB()
+	testutil.Ok(t, err)
+	t.Cleanup(func() { testutil.Ok(t, db.Close()) })
+	db.EnableNativeHistograms()
+
+	// The histogram is migrated from classic to exponential native histograms at 5m, with the same observations:
+	// one up to 0.1, two in (0.1, 1] and one above 1 every 15s.
+	app := db.Appender(context.Background())
+	for k := 0; k < 40; k++ {
+		ts, n := int64(k)*15000, float64(k+1)
+		if k < 20 {
+			for le, v := range map[string]float64{"0.1": n, "1": 3 * n, "+Inf": 4 * n} {
+				_, err := app.Append(0, labels.FromStrings("__name__", "duration_seconds_bucket", "job", "api", "le", le), ts, v)
+				testutil.Ok(t, err)
+			}
+			_, err := app.Append(0, labels.FromStrings("__name__", "duration_seconds_sum", "job", "api"), ts, 2*n)
+			testutil.Ok(t, err)
+			_, err = app.Append(0, labels.FromStrings("__name__", "duration_seconds_count", "job", "api"), ts, 4*n)
+			testutil.Ok(t, err)
+			continue
+		}
+		_, err := app.AppendHistogram(0, labels.FromStrings("__name__", "duration_seconds", "job", "api"), ts, nil, &histogram.FloatHistogram{
+			Count:           4 * n,
+			Sum:             2 * n,
+			PositiveSpans:   []histogram.Span{{Offset: -4, Length: 1}, {Offset: 3, Length: 2}},
+			PositiveBuckets: []float64{n, 2 * n, n},
+		})
+		testutil.Ok(t, err)
+	}
+	testutil.Ok(t, app.Commit())
+
+	merger, err := NewHistogramMerger([]byte(`mappings: [{native: duration_seconds}]`))
+	testutil.Ok(t, err)
+	queryable := &mockedQueryable{Creator: func(mint, maxt int64) storage.Querier {
+		return newQuerier(nil, mint, maxt, nil, nil, newProxyStore(store.NewTSDBStore(nil, db, component.Rule, labels.EmptyLabels())), false, 0, true, false, gate.New(2), 10*time.Second, nil, NoopSeriesStatsReporter, 0, 0, 0, nil, nil)
+	}}
+	e := promql.NewEngine(promql.EngineOpts{Timeout: time.Minute, MaxSamples: math.MaxInt64})
+
+	ctx := ContextWithHistogramMerge(context.Background(), merger)
+	qry, err := e.NewRangeQuery(ctx, queryable, nil, `histogram_quantile(0.5, rate(duration_seconds[1m]))`, time.Unix(60, 0), time.Unix(585, 0), 15*time.Second)
+	testutil.Ok(t, err)
+	t.Cleanup(qry.Close)
+	res := qry.Exec(ctx)
+	testutil.Ok(t, res.Err)
+	testutil.Equals(t, 0, len(res.Warnings))
+
+	m, err := res.Matrix()
+	testutil.Ok(t, err)
+	testutil.Equals(t, 1, len(m))
+	// Every step has a result, including the ones whose window holds both classic and native histograms.
+	testutil.Equals(t, 36, len(m[0].Floats))
+	for _, p := range m[0].Floats {
+		testutil.Assert(t, math.Abs(p.F-0.55) < 1e-9, "unexpected quantile %v at %d", p.F, p.T)
+	}
+}
@@ -5,11 +5,13 @@ package query
 
 import (
 	"context"
+	"runtime"
 	"strings"
 	"sync"
 	"time"
 
 	"github.com/go-kit/log"
+	"github.com/go-kit/log/level"
 	"github.com/opentracing/opentracing-go"
 	"github.com/pkg/errors"
 
@@ -17,8 +19,11 @@ import (
 	"github.com/prometheus/prometheus/model/labels"
 	"github.com/prometheus/prometheus/storage"
 	"github.com/prometheus/prometheus/util/annotations"
+	"go.uber.org/atomic"
+	"golang.org/x/sync/errgroup"
 
 	"github.com/thanos-io/thanos/pkg/dedup"
+	"github.com/thanos-io/thanos/pkg/extannotations"
 	"github.com/thanos-io/thanos/pkg/extprom"
 	"github.com/thanos-io/thanos/pkg/gate"
 	"github.com/thanos-io/thanos/pkg/store"
@@ -58,6 +63,13 @@ type QueryableCreator func(
 ) storage.Queryable
 
 // NewQueryableCreator creates QueryableCreator.
+// seriesSoftLimit is the number of series a single query can touch before a warning is added to its response, 0 means no limit.
+// dedupCounterResetWindow enables the counter reset aware deduplication of counters if not 0, see dedup.WithCounterResetWindow.
+// strictDedupTolerance is the tolerance of the strict deduplication of queries run with ContextWithStrictDedup, see dedup.WithStrictDedup.
+// dedupScopes group replica labels deduplicated with their own policy, in sequence, see dedup.EffectiveScopes.
+// chunkDecodeWorkers is the number of goroutines decoding chunks ahead of query evaluation, shared by all queries, 0 to
+// decode chunks inline during evaluation. Chunks are always decoded inline if a single CPU is available, as decoding
+// ahead would not run in parallel with the evaluation.
 // NOTE(bwplotka): Proxy assumes to be replica_aware, see thanos.store.info.StoreInfo.replica_aware field.
 func NewQueryableCreator(
 	logger log.Logger,
@@ -65,8 +77,21 @@ func NewQueryableCreator(
 	proxy storepb.StoreServer,
 	maxConcurrentSelects int,
 	selectTimeout time.Duration,
+	seriesSoftLimit uint64,
+	dedupCounterResetWindow time.Duration,
+	strictDedupTolerance float64,
+	dedupScopes []dedup.Scope,
+	chunkDecodeWorkers int,
 ) QueryableCreator {
 	gf := gate.NewGateFactory(extprom.WrapRegistererWithPrefix("concurrent_selects_", reg), maxConcurrentSelects, gate.Selects)
+	var decodeGate gate.Gate
+	if chunkDecodeWorkers > 0 {
+		if runtime.GOMAXPROCS(0) > 1 {
+			decodeGate = gate.New(reg, chunkDecodeWorkers, gate.ChunkDecodes)
+		} else {
+			level.Info(logger).Log("msg", "decoding chunks inline, as a single CPU is available", "chunk_decode_workers", chunkDecodeWorkers)
+		}
+	}
 
 	return func(
 		deduplicate bool,
@@ -94,6 +119,12 @@ func NewQueryableCreator(
 			selectTimeout:        selectTimeout,
 			shardInfo:            shardInfo,
 			seriesStatsReporter:  seriesStatsReporter,
+			seriesSoftLimit:      seriesSoftLimit,
+
+			dedupCounterResetWindow: dedupCounterResetWindow,
+			strictDedupTolerance:    strictDedupTolerance,
+			dedupScopes:             dedupScopes,
+			decodeGate:              decodeGate,
 		}
 	}
 }
@@ -112,11 +143,17 @@ type queryable struct {
 	selectTimeout        time.Duration
 	shardInfo            *storepb.ShardInfo
 	seriesStatsReporter  seriesStatsReporter
+	seriesSoftLimit      uint64
+
+	dedupCounterResetWindow time.Duration
+	strictDedupTolerance    float64
+	dedupScopes             []dedup.Scope
+	decodeGate              gate.Gate
 }
 
 // Querier returns a new storage querier against the underlying proxy store API.
 func (q *queryable) Querier(mint, maxt int64) (storage.Querier, error) {
-	return newQuerier(q.logger, mint, maxt, q.replicaLabels, q.storeDebugMatchers, q.proxy, q.deduplicate, q.maxResolutionMillis, q.partialResponse, q.skipChunks, q.gateProviderFn(), q.selectTimeout, q.shardInfo, q.seriesStatsReporter), nil
+	return newQuerier(q.logger, mint, maxt, q.replicaLabels, q.storeDebugMatchers, q.proxy, q.deduplicate, q.maxResolutionMillis, q.partialResponse, q.skipChunks, q.gateProviderFn(), q.selectTimeout, q.shardInfo, q.seriesStatsReporter, q.seriesSoftLimit, q.dedupCounterResetWindow, q.strictDedupTolerance, q.dedupScopes, q.decodeGate), nil
 }
 
 type querier struct {
@@ -133,6 +170,17 @@ type querier struct {
 	selectTimeout           time.Duration
 	shardInfo               *storepb.ShardInfo
 	seriesStatsReporter     seriesStatsReporter
+	seriesSoftLimit         uint64
+	dedupCounterResetWindow time.Duration
+	strictDedupTolerance    float64
+	// dedupScopes are the deduplication scopes effective for replicaLabels, in the order they are applied.
+	dedupScopes []dedup.Scope
+	// decodeGate limits the goroutines decoding chunks ahead of query evaluation, nil to decode them inline.
+	decodeGate gate.Gate
+
+	// touchedSeries is the number of series returned by all Select calls of the querier so far, used for the soft
+	// series limit if the context of the query does not carry a counter, see ContextWithTouchedSeries.
+	touchedSeries atomic.Uint64
 }
 
 // newQuerier creates implementation of storage.Querier that fetches data from the proxy
@@ -152,6 +200,11 @@ func newQuerier(
 	selectTimeout time.Duration,
 	shardInfo *storepb.ShardInfo,
 	seriesStatsReporter seriesStatsReporter,
+	seriesSoftLimit uint64,
+	dedupCounterResetWindow time.Duration,
+	strictDedupTolerance float64,
+	dedupScopes []dedup.Scope,
+	decodeGate gate.Gate,
 ) *querier {
 	if logger == nil {
 		logger = log.NewNopLogger()
@@ -181,9 +234,41 @@ func newQuerier(
 		skipChunks:              skipChunks,
 		shardInfo:               shardInfo,
 		seriesStatsReporter:     seriesStatsReporter,
+		seriesSoftLimit:         seriesSoftLimit,
+		dedupCounterResetWindow: dedupCounterResetWindow,
+		strictDedupTolerance:    strictDedupTolerance,
+		dedupScopes:             dedup.EffectiveScopes(dedupScopes, replicaLabels),
+		decodeGate:              decodeGate,
 	}
 }
 
+type strictDedupKey struct{}
+
+// ContextWithStrictDedup returns a context making the deduplication of the queries run with it report series whose
+// replicas disagree as a warning, see dedup.WithStrictDedup.
+func ContextWithStrictDedup(ctx context.Context) context.Context {
+	return context.WithValue(ctx, strictDedupKey{}, true)
+}
+
+func strictDedupFromContext(ctx context.Context) bool {
+	strict, _ := ctx.Value(strictDedupKey{}).(bool)
+	return strict
+}
+
+type touchedSeriesKey struct{}
+
+// ContextWithTouchedSeries returns a context counting the series touched by the queries run with it across all
+// queriers. The engines create a querier per selector, so the soft series limit applies to the whole query only if
+// it is run with such a context.
+func ContextWithTouchedSeries(ctx context.Context) context.Context {
+	return context.WithValue(ctx, touchedSeriesKey{}, atomic.NewUint64(0))
+}
+
+func touchedSeriesFromContext(ctx context.Context) *atomic.Uint64 {
+	touched, _ := ctx.Value(touchedSeriesKey{}).(*atomic.Uint64)
+	return touched
+}
+
 func (q *querier) isDedupEnabled() bool {
 	return q.deduplicate && len(q.replicaLabels) > 0
 }
@@ -200,7 +285,7 @@ type seriesServer struct {
 
 func (s *seriesServer) Send(r *storepb.SeriesResponse) error {
 	if r.GetWarning() != "" {
-		s.warnings.Add(errors.New(r.GetWarning()))
+		s.warnings.Add(extannotations.FromString(r.GetWarning()))
 		return nil
 	}
 
@@ -241,6 +326,17 @@ func aggrsFromFunc(f string) []storepb.Aggr {
 	return []storepb.Aggr{storepb.Aggr_COUNT, storepb.Aggr_SUM}
 }
 
+// storeHintsFromPromHints passes the function wrapping a series selection down to stores, letting them
+// skip data the function does not need.
+func storeHintsFromPromHints(hints *storage.SelectHints) *storepb.QueryHints {
+	return &storepb.QueryHints{
+		StepMillis: hints.Step,
+		Func:       &storepb.Func{Name: hints.Func},
+		Grouping:   &storepb.Grouping{By: hints.By, Labels: hints.Grouping},
+		Range:      &storepb.Range{Millis: hints.Range},
+	}
+}
+
 func (q *querier) Select(ctx context.Context, _ bool, hints *storage.SelectHints, ms ...*labels.Matcher) storage.SeriesSet {
 	if hints == nil {
 		hints = &storage.SelectHints{
@@ -261,11 +357,39 @@ func (q *querier) Select(ctx context.Context, _ bool, hints *storage.SelectHints
 		matchers[i] = m.String()
 	}
 	tenant := ctx.Value(tenancy.TenantKey)
+	priority := store.PriorityFromContext(ctx)
+	originTracker := store.OriginTrackerFromContext(ctx)
+	timeRangeTracker := store.SeriesTimeRangeTrackerFromContext(ctx)
+	metricNameStatsTracker := store.MetricNameStatsTrackerFromContext(ctx)
+	strictDedup := strictDedupFromContext(ctx)
+	histogramMerger := histogramMergerFromContext(ctx)
+	touchedSeries := touchedSeriesFromContext(ctx)
+	// Chunks are decoded ahead of evaluation only until the query is done.
+	queryCtx := ctx
 	// The context gets canceled as soon as query evaluation is completed by the engine.
 	// We want to prevent this from happening for the async store API calls we make while preserving tracing context.
 	// TODO(bwplotka): Does the above still is true? It feels weird to leave unfinished calls behind query API.
 	ctx = tracing.CopyTraceContext(context.Background(), ctx)
 	ctx = context.WithValue(ctx, tenancy.TenantKey, tenant)
+	ctx = store.ContextWithPriority(ctx, priority)
+	if originTracker != nil {
+		ctx = store.WithOriginTracker(ctx, originTracker)
+	}
+	if timeRangeTracker != nil {
+		ctx = store.WithSeriesTimeRangeTracker(ctx, timeRangeTracker)
+	}
+	if metricNameStatsTracker != nil {
+		ctx = store.WithMetricNameStatsTracker(ctx, metricNameStatsTracker)
+	}
+	if strictDedup {
+		ctx = ContextWithStrictDedup(ctx)
+	}
+	if histogramMerger != nil {
+		ctx = ContextWithHistogramMerge(ctx, histogramMerger)
+	}
+	if touchedSeries != nil {
+		ctx = context.WithValue(ctx, touchedSeriesKey{}, touchedSeries)
+	}
 	ctx, cancel := context.WithTimeout(ctx, q.selectTimeout)
 	span, ctx := tracing.StartSpan(ctx, "querier_select", opentracing.Tags{
 		"minTime":  hints.Start,
@@ -290,12 +414,27 @@ func (q *querier) Select(ctx context.Context, _ bool, hints *storage.SelectHints
 		span, ctx := tracing.StartSpan(ctx, "querier_select_select_fn")
 		defer span.Finish()
 
-		set, stats, err := q.selectFn(ctx, hints, ms...)
+		var (
+			set             storage.SeriesSet
+			native, classic string
+			merge           bool
+		)
+		if histogramMerger != nil && !q.skipChunks {
+			if native, merge = nativeHistogramName(ms); merge {
+				classic, merge = histogramMerger.classicName(native)
+			}
+		}
+		if merge {
+			set, err = q.selectMergedHistograms(ctx, queryCtx, hints, native, classic, ms)
+		} else {
+			var stats storepb.SeriesStatsCounter
+			set, stats, err = q.selectFn(ctx, queryCtx, hints, ms...)
+			q.seriesStatsReporter(stats)
+		}
 		if err != nil {
 			promise <- storage.ErrSeriesSet(err)
 			return
 		}
-		q.seriesStatsReporter(stats)
 
 		promise <- set
 	}()
@@ -313,7 +452,16 @@ func (q *querier) Select(ctx context.Context, _ bool, hints *storage.SelectHints
 	}}
 }
 
-func (q *querier) selectFn(ctx context.Context, hints *storage.SelectHints, ms ...*labels.Matcher) (storage.SeriesSet, storepb.SeriesStatsCounter, error) {
+// newPromSeriesSet returns the series of the set, whose chunks are decoded ahead of query evaluation if the querier has
+// a decode gate, until queryCtx is done.
+func (q *querier) newPromSeriesSet(queryCtx context.Context, set storepb.SeriesSet, aggrs []storepb.Aggr, warns annotations.Annotations) storage.SeriesSet {
+	if q.decodeGate == nil || q.skipChunks {
+		return NewPromSeriesSet(set, q.mint, q.maxt, aggrs, warns)
+	}
+	return newDecodingSeriesSet(queryCtx, q.decodeGate, set, q.mint, q.maxt, aggrs, warns)
+}
+
+func (q *querier) selectFn(ctx, queryCtx context.Context, hints *storage.SelectHints, ms ...*labels.Matcher) (storage.SeriesSet, storepb.SeriesStatsCounter, error) {
 	sms, err := storepb.PromMatchersToMatchers(ms...)
 	if err != nil {
 		return nil, storepb.SeriesStatsCounter{}, errors.Wrap(err, "convert matchers")
@@ -339,38 +487,81 @@ func (q *querier) selectFn(ctx context.Context, hints *storage.SelectHints, ms .
 		PartialResponseStrategy: q.partialResponseStrategy,
 		SkipChunks:              q.skipChunks,
 	}
+	if hints.Func != "" {
+		req.QueryHints = storeHintsFromPromHints(hints)
+	}
 	if q.isDedupEnabled() {
-		// Soft ask to sort without replica labels and push them at the end of labelset.
-		req.WithoutReplicaLabels = q.replicaLabels
+		// Soft ask to sort without the replica labels of the first deduplication scope and push them at the end of labelset.
+		// The other scopes are deduplicated in sequence below.
+		req.WithoutReplicaLabels = q.dedupScopes[0].ReplicaLabels
 	}
 
 	if err := q.proxy.Series(&req, resp); err != nil {
 		return nil, storepb.SeriesStatsCounter{}, errors.Wrap(err, "proxy Series()")
 	}
 	warns := annotations.New().Merge(resp.warnings)
+	if q.seriesSoftLimit > 0 {
+		// Warn only once per query, for the Select call which crossed the soft limit.
+		n := uint64(len(resp.seriesSet))
+		touched := touchedSeriesFromContext(ctx)
+		if touched == nil {
+			touched = &q.touchedSeries
+		}
+		if total := touched.Add(n); total > q.seriesSoftLimit && total-n <= q.seriesSoftLimit {
+			warns.Add(errors.Errorf("query touched %d series, exceeding the soft limit of %d", total, q.seriesSoftLimit))
+		}
+	}
 
 	if !q.isDedupEnabled() {
-		return NewPromSeriesSet(
-			newStoreSeriesSet(resp.seriesSet),
-			q.mint,
-			q.maxt,
-			aggrs,
-			warns,
-		), resp.seriesSetStats, nil
+		return q.newPromSeriesSet(queryCtx, newStoreSeriesSet(resp.seriesSet), aggrs, warns), resp.seriesSetStats, nil
 	}
 
 	// TODO(bwplotka): Move to deduplication on chunk level inside promSeriesSet, similar to what we have in dedup.NewDedupChunkMerger().
 	// This however require big refactor, caring about correct AggrChunk to iterator conversion and counter reset apply.
 	// For now we apply simple logic that splits potential overlapping chunks into separate replica series, so we can split the work.
-	set := NewPromSeriesSet(
-		dedup.NewOverlapSplit(newStoreSeriesSet(resp.seriesSet)),
-		q.mint,
-		q.maxt,
-		aggrs,
-		warns,
+	set := q.newPromSeriesSet(queryCtx, dedup.NewOverlapSplit(newStoreSeriesSet(resp.seriesSet)), aggrs, warns)
+
+	opts := []dedup.SeriesSetOption{dedup.WithCounterResetWindow(q.dedupCounterResetWindow)}
+	if strictDedupFromContext(ctx) {
+		opts = append(opts, dedup.WithStrictDedup(q.strictDedupTolerance))
+	}
+	return dedup.NewScopedSeriesSet(set, hints.Func, q.dedupScopes, opts...), resp.seriesSetStats, nil
+}
+
+// selectMergedHistograms selects the series of the native histogram along with the ones of the classic histogram
+// mapped to it, converted into native histograms with custom buckets. Exponential native histograms are converted
+// to the custom buckets of the classic histograms, so that both can be used together, e.g. by rate. Samples present
+// in both are taken from the native histogram.
+func (q *querier) selectMergedHistograms(ctx, queryCtx context.Context, hints *storage.SelectHints, native, classic string, ms []*labels.Matcher) (storage.SeriesSet, error) {
+	var (
+		names = []string{native, classic + "_bucket", classic + "_sum", classic + "_count"}
+		sets  = make([]storage.SeriesSet, len(names))
+		g     errgroup.Group
 	)
+	for i, name := range names {
+		g.Go(func() error {
+			set, stats, err := q.selectFn(ctx, queryCtx, hints, withMetricName(ms, name)...)
+			if err != nil {
+				return err
+			}
+			q.seriesStatsReporter(stats)
+			sets[i] = set
+			return nil
+		})
+	}
+	if err := g.Wait(); err != nil {
+		return nil, err
+	}
 
-	return dedup.NewSeriesSet(set, hints.Func), resp.seriesSetStats, nil
+	classicSet, err := classicToNativeSeriesSet(native, sets[1], sets[2], sets[3])
+	if err != nil {
+		return nil, err
+	}
+	nativeSet := sets[0]
+	if len(classicSet.allBounds) > 0 {
+		nativeSet = &customBucketsSeriesSet{SeriesSet: nativeSet, bounds: classicSet.customBounds}
+	}
+	return storage.NewMergeSeriesSet([]storage.SeriesSet{nativeSet, classicSet}, storage.ChainedSeriesMerge), nil
 }
 
 // LabelValues returns all potential values for a label name.
@@ -29,8 +29,10 @@ import (
 	"github.com/prometheus/prometheus/tsdb/chunkenc"
 	"github.com/prometheus/prometheus/util/annotations"
 	"github.com/prometheus/prometheus/util/gate"
+	"github.com/thanos-io/promql-engine/engine"
 
 	"github.com/thanos-io/thanos/pkg/component"
+	"github.com/thanos-io/thanos/pkg/dedup"
 	"github.com/thanos-io/thanos/pkg/store"
 	"github.com/thanos-io/thanos/pkg/store/labelpb"
 	"github.com/thanos-io/thanos/pkg/store/storepb"
@@ -44,7 +46,7 @@ type sample struct {
 
 func TestQueryableCreator_MaxResolution(t *testing.T) {
 	testProxy := &testStoreServer{resps: []*storepb.SeriesResponse{}}
-	queryableCreator := NewQueryableCreator(nil, nil, newProxyStore(testProxy), 2, 5*time.Second)
+	queryableCreator := NewQueryableCreator(nil, nil, newProxyStore(testProxy), 2, 5*time.Second, 0, 0, 0, nil, 0)
 
 	oneHourMillis := int64(1*time.Hour) / int64(time.Millisecond)
 	queryable := queryableCreator(
@@ -89,6 +91,11 @@ func TestQuerier_DownsampledData(t *testing.T) {
 		newProxyStore(testProxy),
 		2,
 		timeout,
+		0,
+		0,
+		0,
+		nil,
+		0,
 	)(false,
 		nil,
 		nil,
@@ -392,7 +399,7 @@ func TestQuerier_Select_AfterPromQL(t *testing.T) {
 						g := gate.New(2)
 						mq := &mockedQueryable{
 							Creator: func(mint, maxt int64) storage.Querier {
-								return newQuerier(nil, mint, maxt, tcase.replicaLabels, nil, tcase.storeAPI, sc.dedup, 0, true, false, g, timeout, nil, NoopSeriesStatsReporter)
+								return newQuerier(nil, mint, maxt, tcase.replicaLabels, nil, tcase.storeAPI, sc.dedup, 0, true, false, g, timeout, nil, NoopSeriesStatsReporter, 0, 0, 0, nil, nil)
 							},
 						}
 						t.Cleanup(func() {
@@ -764,10 +771,14 @@ func TestQuerier_Select(t *testing.T) {
 		t.Run(tcase.name, func(t *testing.T) {
 			for _, sc := range []struct {
 				dedup    bool
+				decode   bool
 				expected []series
 			}{
 				{dedup: false, expected: tcase.expected},
+				{dedup: false, decode: true, expected: tcase.expected},
+				// Deduplication strips the replica labels of the responses of the stores in place, run it last.
 				{dedup: true, expected: tcase.expectedAfterDedup},
+				{dedup: true, decode: true, expected: tcase.expectedAfterDedup},
 			} {
 				g := gate.New(2)
 				q := newQuerier(
@@ -785,10 +796,18 @@ func TestQuerier_Select(t *testing.T) {
 					timeout,
 					nil,
 					NoopSeriesStatsReporter,
+					0,
+					0,
+					0,
+					nil,
+					nil,
 				)
+				if sc.decode {
+					q.decodeGate = gate.New(2)
+				}
 				t.Cleanup(func() { testutil.Ok(t, q.Close()) })
 
-				t.Run(fmt.Sprintf("dedup=%v", sc.dedup), func(t *testing.T) {
+				t.Run(fmt.Sprintf("dedup=%v,decode=%v", sc.dedup, sc.decode), func(t *testing.T) {
 					t.Run("querier.Select", func(t *testing.T) {
 						res := q.Select(context.Background(), false, tcase.hints, tcase.matchers...)
 						testSelectResponse(t, sc.expected, res)
@@ -1064,7 +1083,7 @@ func TestQuerierWithDedupUnderstoodByPromQL_Rate(t *testing.T) {
 
 		timeout := 100 * time.Second
 		g := gate.New(2)
-		q := newQuerier(logger, realSeriesWithStaleMarkerMint, realSeriesWithStaleMarkerMaxt, []string{"replica"}, nil, newProxyStore(s), false, 0, true, false, g, timeout, nil, NoopSeriesStatsReporter)
+		q := newQuerier(logger, realSeriesWithStaleMarkerMint, realSeriesWithStaleMarkerMaxt, []string{"replica"}, nil, newProxyStore(s), false, 0, true, false, g, timeout, nil, NoopSeriesStatsReporter, 0, 0, 0, nil, nil)
 		t.Cleanup(func() {
 			testutil.Ok(t, q.Close())
 		})
@@ -1134,7 +1153,7 @@ func TestQuerierWithDedupUnderstoodByPromQL_Rate(t *testing.T) {
 
 		timeout := 5 * time.Second
 		g := gate.New(2)
-		q := newQuerier(logger, realSeriesWithStaleMarkerMint, realSeriesWithStaleMarkerMaxt, []string{"replica"}, nil, newProxyStore(s), true, 0, true, false, g, timeout, nil, NoopSeriesStatsReporter)
+		q := newQuerier(logger, realSeriesWithStaleMarkerMint, realSeriesWithStaleMarkerMaxt, []string{"replica"}, nil, newProxyStore(s), true, 0, true, false, g, timeout, nil, NoopSeriesStatsReporter, 0, 0, 0, nil, nil)
 		t.Cleanup(func() {
 			testutil.Ok(t, q.Close())
 		})
@@ -1206,6 +1225,132 @@ func expandSeries(t testing.TB, it chunkenc.Iterator) (res []sample) {
 	return res
 }
 
+func TestQuerier_SeriesSoftLimit(t *testing.T) {
+	s := &testStoreServer{
+		resps: []*storepb.SeriesResponse{
+			storeSeriesResponse(t, labels.FromStrings("a", "1"), []sample{{0, 0}}),
+			storeSeriesResponse(t, labels.FromStrings("a", "2"), []sample{{0, 0}}),
+		},
+	}
+	q := newQuerier(nil, 0, 10, nil, nil, newProxyStore(s), false, 0, true, false, gate.New(2), 10*time.Second, nil, NoopSeriesStatsReporter, 3, 0, 0, nil, nil)
+	t.Cleanup(func() { testutil.Ok(t, q.Close()) })
+
+	selectWarnings := func() []error {
+		res := q.Select(context.Background(), false, nil, labels.MustNewMatcher(labels.MatchEqual, "a", "1"))
+		for res.Next() {
+		}
+		testutil.Ok(t, res.Err())
+		return res.Warnings().AsErrors()
+	}
+
+	// The soft limit is applied to all series touched by the query and results are still returned.
+	testutil.Equals(t, 0, len(selectWarnings()))
+	warns := selectWarnings()
+	testutil.Equals(t, 1, len(warns))
+	testutil.Equals(t, "query touched 4 series, exceeding the soft limit of 3", warns[0].Error())
+
+	// The warning is only returned once per query.
+	testutil.Equals(t, 0, len(selectWarnings()))
+}
+
+func TestQuerier_SeriesSoftLimit_PromQL(t *testing.T) {
+	s := &testStoreServer{
+		resps: []*storepb.SeriesResponse{
+			storeSeriesResponse(t, labels.FromStrings("a", "1"), []sample{{0, 0}}),
+			storeSeriesResponse(t, labels.FromStrings("a", "2"), []sample{{0, 0}}),
+		},
+	}
+	queryable := &mockedQueryable{Creator: func(mint, maxt int64) storage.Querier {
+		return newQuerier(nil, mint, maxt, nil, nil, newProxyStore(s), false, 0, true, false, gate.New(2), 10*time.Second, nil, NoopSeriesStatsReporter, 3, 0, 0, nil, nil)
+	}}
+	opts := promql.EngineOpts{Timeout: time.Minute, MaxSamples: math.MaxInt64}
+
+	for name, e := range map[string]promql.QueryEngine{
+		"prometheus": promql.NewEngine(opts),
+		// The Thanos engine creates a querier per selector.
+		"thanos": engine.New(engine.Opts{EngineOpts: opts}),
+	} {
+		t.Run(name, func(t *testing.T) {
+			// Each selector touches 2 series, the query 4.
+			ctx := ContextWithTouchedSeries(context.Background())
+			qry, err := e.NewInstantQuery(ctx, queryable, nil, `count(x) + count(y)`, time.Unix(0, 0))
+			testutil.Ok(t, err)
+			t.Cleanup(qry.Close)
+			res := qry.Exec(ctx)
+			testutil.Ok(t, res.Err)
+
+			warns := res.Warnings.AsErrors()
+			testutil.Equals(t, 1, len(warns))
+			testutil.Equals(t, "query touched 4 series, exceeding the soft limit of 3", warns[0].Error())
+		})
+	}
+}
+
+func TestQuerier_Select_OriginTracker(t *testing.T) {
+	s := &testStoreServer{
+		resps: []*storepb.SeriesResponse{
+			storeSeriesResponse(t, labels.FromStrings("a", "1"), []sample{{0, 0}}),
+		},
+	}
+	q := newQuerier(nil, 0, 10, nil, nil, newProxyStore(s), false, 0, true, false, gate.New(2), 10*time.Second, nil, NoopSeriesStatsReporter, 0, 0, 0, nil, nil)
+	t.Cleanup(func() { testutil.Ok(t, q.Close()) })
+
+	// The tracker of the query is passed to the proxy, although Select does not use the context of the query.
+	tracker := store.NewOriginTracker()
+	res := q.Select(store.WithOriginTracker(context.Background(), tracker), false, nil, labels.MustNewMatcher(labels.MatchEqual, "a", "1"))
+	for res.Next() {
+	}
+	testutil.Ok(t, res.Err())
+	testutil.Equals(t, 1, len(tracker.Origins()))
+}
+
+func TestQuerier_Select_StrictDedup(t *testing.T) {
+	s := &testStoreServer{
+		resps: []*storepb.SeriesResponse{
+			storeSeriesResponse(t, labels.FromStrings("a", "1", "replica", "1"), []sample{{0, 1}, {15000, 2}, {30000, 3}}),
+			storeSeriesResponse(t, labels.FromStrings("a", "1", "replica", "2"), []sample{{0, 1}, {15000, 5}, {30000, 3}}),
+		},
+	}
+	q := newQuerier(nil, 0, 30000, []string{"replica"}, nil, newProxyStore(s), true, 0, true, false, gate.New(2), 10*time.Second, nil, NoopSeriesStatsReporter, 0, 0, 0.01, nil, nil)
+	t.Cleanup(func() { testutil.Ok(t, q.Close()) })
+
+	selectWarnings := func(ctx context.Context) []error {
+		res := q.Select(ctx, false, nil, labels.MustNewMatcher(labels.MatchEqual, "a", "1"))
+		for res.Next() {
+		}
+		testutil.Ok(t, res.Err())
+		return res.Warnings().AsErrors()
+	}
+
+	// Replicas disagreeing are only reported for queries opting in.
+	testutil.Equals(t, 0, len(selectWarnings(context.Background())))
+	warns := selectWarnings(ContextWithStrictDedup(context.Background()))
+	testutil.Equals(t, 1, len(warns))
+	testutil.Equals(t, `strict deduplication: replicas of 1 series disagree beyond the tolerance of 0.01, e.g. {a="1"} at 1970-01-01T00:00:15Z: 5 on one replica, 2 on another`, warns[0].Error())
+}
+
+func TestQuerier_Select_DedupScopes(t *testing.T) {
+	s := &testStoreServer{
+		resps: []*storepb.SeriesResponse{
+			storeSeriesResponse(t, labels.FromStrings("a", "1", "prometheus_replica", "0", "source_cluster", "dc1"), []sample{{0, 1}, {15000, 2}, {30000, 3}}),
+			storeSeriesResponse(t, labels.FromStrings("a", "1", "prometheus_replica", "0", "source_cluster", "dc2"), []sample{{0, 1}, {15000, 2}, {30000, 30}, {45000, 4}}),
+			storeSeriesResponse(t, labels.FromStrings("a", "1", "prometheus_replica", "1", "source_cluster", "dc1"), []sample{{1000, 1}, {16000, 2}}),
+		},
+	}
+	scopes := []dedup.Scope{
+		{Policy: dedup.PolicyPenalty, ReplicaLabels: []string{"prometheus_replica"}},
+		{Policy: dedup.PolicyChain, ReplicaLabels: []string{"source_cluster"}},
+	}
+	q := newQuerier(nil, 0, 45000, []string{"prometheus_replica", "source_cluster"}, nil, newProxyStore(s), true, 0, true, false, gate.New(2), 10*time.Second, nil, NoopSeriesStatsReporter, 0, 0, 0, scopes, nil)
+	t.Cleanup(func() { testutil.Ok(t, q.Close()) })
+
+	res := q.Select(context.Background(), false, nil, labels.MustNewMatcher(labels.MatchEqual, "a", "1"))
+	testSelectResponse(t, []series{{
+		lset:    labels.FromStrings("a", "1"),
+		samples: []sample{{0, 1}, {15000, 2}, {30000, 3}, {45000, 4}},
+	}}, res)
+}
+
 type testStoreServer struct {
 	// This field just exist to pseudo-implement the unused methods of the interface.
 	storepb.StoreServer
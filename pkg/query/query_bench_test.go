@@ -98,6 +98,11 @@ func benchQuerySelect(t testutil.TB, totalSamples, totalSeries int, dedup bool)
 		10*time.Second,
 		nil,
 		NoopSeriesStatsReporter,
+		0,
+		0,
+		0,
+		nil,
+		nil,
 	)
 	testSelect(t, q, expectedSeries)
 }
@@ -13,7 +13,6 @@ import (
 
 	"github.com/go-kit/log"
 	"github.com/go-kit/log/level"
-	"github.com/pkg/errors"
 	"github.com/prometheus/prometheus/model/labels"
 	"github.com/prometheus/prometheus/promql"
 	"github.com/prometheus/prometheus/promql/parser"
@@ -24,6 +23,7 @@ import (
 
 	"github.com/opentracing/opentracing-go"
 	"github.com/thanos-io/thanos/pkg/api/query/querypb"
+	"github.com/thanos-io/thanos/pkg/extannotations"
 	"github.com/thanos-io/thanos/pkg/info/infopb"
 	"github.com/thanos-io/thanos/pkg/server/http/middleware"
 	"github.com/thanos-io/thanos/pkg/store/labelpb"
@@ -38,6 +38,9 @@ type Opts struct {
 	PartitionLabels       []string
 	Timeout               time.Duration
 	EnablePartialResponse bool
+
+	// AutoDownsamplingPolicy selects the maximum source resolution from the step when AutoDownsample is enabled.
+	AutoDownsamplingPolicy AutoDownsamplingPolicy
 }
 
 // Client is a query client that executes PromQL queries.
@@ -274,7 +277,7 @@ func (r *remoteQuery) Exec(ctx context.Context) *promql.Result {
 
 	var maxResolution int64
 	if r.opts.AutoDownsample {
-		maxResolution = int64(r.interval.Seconds() / 5)
+		maxResolution = int64(r.opts.AutoDownsamplingPolicy.MaxSourceResolution(r.interval).Seconds())
 	}
 	plan, err := querypb.NewJSONEncodedPlan(r.plan)
 	if err != nil {
@@ -318,7 +321,7 @@ func (r *remoteQuery) Exec(ctx context.Context) *promql.Result {
 			}
 
 			if warn := msg.GetWarnings(); warn != "" {
-				warnings.Add(errors.New(warn))
+				warnings.Add(extannotations.FromString(warn))
 				continue
 			}
 			if s := msg.GetStats(); s != nil {
@@ -389,7 +392,7 @@ func (r *remoteQuery) Exec(ctx context.Context) *promql.Result {
 		}
 
 		if warn := msg.GetWarnings(); warn != "" {
-			warnings.Add(errors.New(warn))
+			warnings.Add(extannotations.FromString(warn))
 			continue
 		}
 		if s := msg.GetStats(); s != nil {
@@ -5,9 +5,13 @@ package queryfrontend
 
 import (
 	"fmt"
+	"strconv"
+	"strings"
+	"time"
 
 	"github.com/thanos-io/thanos/internal/cortex/querier/queryrange"
 	"github.com/thanos-io/thanos/pkg/compact/downsample"
+	"github.com/thanos-io/thanos/pkg/tenancy"
 )
 
 // thanosCacheKeyGenerator is a utility for using split interval when determining cache keys.
@@ -27,19 +31,120 @@ func newThanosCacheKeyGenerator(intervalFn queryrange.IntervalFn) thanosCacheKey
 // TODO(yeya24): Add other request params as request key.
 func (t thanosCacheKeyGenerator) GenerateCacheKey(userID string, r queryrange.Request) string {
 	currentInterval := r.GetStart() / t.interval(r).Milliseconds()
+	userID = cacheKeyTenant(userID, r)
 	switch tr := r.(type) {
 	case *ThanosQueryRangeRequest:
 		i := 0
 		for ; i < len(t.resolutions) && t.resolutions[i] > tr.MaxSourceResolution; i++ {
 		}
 		shardInfoKey := generateShardInfoKey(tr)
-		return fmt.Sprintf("fe:%s:%s:%d:%d:%d:%s:%d:%s", userID, tr.Query, tr.Step, currentInterval, i, shardInfoKey, tr.LookbackDelta, tr.Engine)
+		key := fmt.Sprintf("fe:%s:%s:%s:%d:%d:%s:%d:%s", userID, cacheKeyQuery(tr), generateStepKey(tr), currentInterval, i, shardInfoKey, tr.LookbackDelta, tr.Engine)
+		// Keys of requests without merged histograms stay the same, so existing cache entries stay valid.
+		if tr.MergeHistograms {
+			key += ":merge_histograms"
+		}
+		return key
 	case *ThanosLabelsRequest:
 		return fmt.Sprintf("fe:%s:%s:%s:%d", userID, tr.Label, tr.Matchers, currentInterval)
 	case *ThanosSeriesRequest:
 		return fmt.Sprintf("fe:%s:%s:%d", userID, tr.Matchers, currentInterval)
 	}
-	return fmt.Sprintf("fe:%s:%s:%d:%d", userID, r.GetQuery(), r.GetStep(), currentInterval)
+	return fmt.Sprintf("fe:%s:%s:%d:%d", userID, cacheKeyQuery(r), r.GetStep(), currentInterval)
+}
+
+// cacheKeyEscaper escapes the parts of cache keys which could otherwise contain the ':' separator.
+var cacheKeyEscaper = strings.NewReplacer("%", "%25", ":", "%3A", "|", "%7C")
+
+// cacheKeyTenant returns the tenant part of the cache key of r. The org ID of the request is extended by the
+// tenant resolved by the query frontend if the two differ, e.g. when the tenant comes from a client certificate,
+// so that results of one tenant are never served to another. Requests without a tenant, and requests whose org ID
+// is their tenant, keep the keys used before the tenant was part of them, so existing cache entries stay valid.
+func cacheKeyTenant(userID string, r queryrange.Request) string {
+	key := cacheKeyEscaper.Replace(userID)
+	if t := requestTenant(r); t != "" && t != tenancy.DefaultTenant && t != userID {
+		key += "|" + cacheKeyEscaper.Replace(t)
+	}
+	return key
+}
+
+// requestTenant returns the tenant of r as set in the tenant header by the query frontend, or an empty string.
+func requestTenant(r queryrange.Request) string {
+	var headers []*RequestHeader
+	switch tr := r.(type) {
+	case *ThanosQueryRangeRequest:
+		headers = tr.Headers
+	case *ThanosQueryInstantRequest:
+		headers = tr.Headers
+	case *ThanosLabelsRequest:
+		headers = tr.Headers
+	case *ThanosSeriesRequest:
+		headers = tr.Headers
+	}
+	for _, h := range headers {
+		if strings.EqualFold(h.Name, tenancy.DefaultTenantHeader) && len(h.Values) > 0 {
+			return h.Values[0]
+		}
+	}
+	return ""
+}
+
+// cacheKeyQuery returns the query of the request to be used in its cache key. For queries with @ modifiers
+// or offsets, `start()` and `end()` are resolved against the request time range, since the result depends on
+// it, and the query is formatted canonically, so that equivalent queries share cache entries while queries
+// only differing in @ timestamps or offsets of some selectors do not.
+func cacheKeyQuery(r queryrange.Request) string {
+	query := r.GetQuery()
+	if !strings.Contains(query, "@") && !strings.Contains(query, "offset") {
+		return query
+	}
+	normalized, err := queryrange.EvaluateAtModifierFunction(query, r.GetStart(), r.GetEnd())
+	if err != nil {
+		return query
+	}
+	return normalized
+}
+
+// recentCacheKeyGenerator wraps thanosCacheKeyGenerator and makes the cache keys of requests
+// ending within the last split interval change every ttl. This way results covering recent
+// time ranges are only reused for ttl, while older results are kept as long as the cache allows.
+type recentCacheKeyGenerator struct {
+	thanosCacheKeyGenerator
+	ttl time.Duration
+	now func() time.Time
+}
+
+func newRecentCacheKeyGenerator(intervalFn queryrange.IntervalFn, ttl time.Duration) recentCacheKeyGenerator {
+	return recentCacheKeyGenerator{
+		thanosCacheKeyGenerator: newThanosCacheKeyGenerator(intervalFn),
+		ttl:                     ttl,
+		now:                     time.Now,
+	}
+}
+
+// GenerateCacheKey generates a cache key based on the Request, interval and, for recent requests, the current time.
+func (t recentCacheKeyGenerator) GenerateCacheKey(userID string, r queryrange.Request) string {
+	key := t.thanosCacheKeyGenerator.GenerateCacheKey(userID, r)
+	if t.ttl <= 0 {
+		return key
+	}
+	now := t.now()
+	if r.GetEnd() < now.Add(-t.interval(r)).UnixMilli() {
+		return key
+	}
+	return fmt.Sprintf("%s:%d", key, now.UnixMilli()/t.ttl.Milliseconds())
+}
+
+// generateStepKey returns the step of the request, followed by the offset of its start from the step grid
+// if it is not aligned. Requests with different offsets evaluate at different timestamps, so their results
+// must not be mixed.
+func generateStepKey(r *ThanosQueryRangeRequest) string {
+	if r.Step <= 0 {
+		return strconv.FormatInt(r.Step, 10)
+	}
+	if offset := r.Start % r.Step; offset != 0 {
+		return fmt.Sprintf("%d+%d", r.Step, offset)
+	}
+	return strconv.FormatInt(r.Step, 10)
 }
 
 func generateShardInfoKey(r *ThanosQueryRangeRequest) string {
@@ -0,0 +1,84 @@
+// Copyright (c) The Thanos Authors.
+// Licensed under the Apache License 2.0.
+
+package queryfrontend
+
+import (
+	"context"
+	"net/http"
+
+	"github.com/go-kit/log"
+	"github.com/go-kit/log/level"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/weaveworks/common/httpgrpc"
+
+	"github.com/thanos-io/thanos/internal/cortex/querier/queryrange"
+	"github.com/thanos-io/thanos/internal/cortex/tenant"
+)
+
+const (
+	// NoCacheParam is the range query parameter asking for the results cache not to be read.
+	NoCacheParam = "no_cache"
+	// Value of cacheControlHeader in requests asking for the results cache not to be read.
+	noCacheValue = "no-cache"
+)
+
+// CacheBypassLimits are the per-tenant limits enforced by CacheBypassMiddleware.
+type CacheBypassLimits interface {
+	// AllowCacheBypass returns whether queries can ask to bypass reading the results cache.
+	AllowCacheBypass(userID string) bool
+}
+
+// CacheBypassMiddleware creates a new Middleware letting range queries which ask for it, with the no_cache
+// parameter or a Cache-Control: no-cache header, bypass reading the results cache only if all of their tenants
+// are allowed to. Otherwise the request is served as usual, so that untrusted users cannot skip the cache at will.
+func CacheBypassMiddleware(limits CacheBypassLimits, logger log.Logger, registerer prometheus.Registerer) queryrange.Middleware {
+	requests := promauto.With(registerer).NewCounterVec(prometheus.CounterOpts{
+		Namespace: "thanos",
+		Name:      "frontend_cache_bypass_requests_total",
+		Help:      "Total number of range queries asking to bypass the results cache, by whether they were allowed to.",
+	}, []string{"result"})
+	bypassed, ignored := requests.WithLabelValues("bypassed"), requests.WithLabelValues("ignored")
+
+	return queryrange.MiddlewareFunc(func(next queryrange.Handler) queryrange.Handler {
+		return cacheBypassLimiter{next: next, limits: limits, logger: logger, bypassed: bypassed, ignored: ignored}
+	})
+}
+
+type cacheBypassLimiter struct {
+	next   queryrange.Handler
+	limits CacheBypassLimits
+	logger log.Logger
+
+	bypassed prometheus.Counter
+	ignored  prometheus.Counter
+}
+
+func (c cacheBypassLimiter) Do(ctx context.Context, r queryrange.Request) (queryrange.Response, error) {
+	tqrr, ok := r.(*ThanosQueryRangeRequest)
+	if !ok || !tqrr.BypassCache {
+		return c.next.Do(ctx, r)
+	}
+
+	// Limits are looked up by the tenant resolved by the query frontend, falling back to the org ID.
+	tenantIDs := []string{requestTenant(r)}
+	if tenantIDs[0] == "" {
+		var err error
+		if tenantIDs, err = tenant.TenantIDs(ctx); err != nil {
+			return nil, httpgrpc.Errorf(http.StatusBadRequest, err.Error())
+		}
+	}
+	for _, id := range tenantIDs {
+		if !c.limits.AllowCacheBypass(id) {
+			c.ignored.Inc()
+			level.Debug(c.logger).Log("msg", "ignoring request to bypass the results cache", "tenant", id, "query", tqrr.Query)
+
+			q := *tqrr
+			q.BypassCache = false
+			return c.next.Do(ctx, &q)
+		}
+	}
+	c.bypassed.Inc()
+	return c.next.Do(ctx, r)
+}
@@ -0,0 +1,364 @@
+// Copyright (c) The Thanos Authors.
+// Licensed under the Apache License 2.0.
+
+package queryfrontend
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-kit/log"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/prometheus/model/labels"
+	"github.com/prometheus/prometheus/promql/parser"
+
+	cortexcache "github.com/thanos-io/thanos/internal/cortex/chunk/cache"
+	"github.com/thanos-io/thanos/internal/cortex/querier/queryrange"
+)
+
+const (
+	// cacheStatsMaxKeys is the maximum number of cache keys whose accesses are counted per results cache.
+	cacheStatsMaxKeys = 1000
+	// defaultCacheStatsTopKeys is the default number of most accessed cache keys reported per results cache.
+	defaultCacheStatsTopKeys = 20
+)
+
+// cacheStatsWindows are the time windows over which hits and misses are reported, in minutes.
+var cacheStatsWindows = []int64{1, 5, 15, 60}
+
+// CacheStats collects usage statistics of the results caches of the query frontend, which are
+// reported as JSON when serving HTTP requests.
+type CacheStats struct {
+	mtx    sync.Mutex
+	caches []*resultsCacheStats
+	now    func() time.Time
+}
+
+// NewCacheStats returns new, empty CacheStats.
+func NewCacheStats() *CacheStats {
+	return &CacheStats{now: time.Now}
+}
+
+// ResultsCacheStats are the statistics of the results cache of a tripperware.
+type ResultsCacheStats struct {
+	Tripperware string `json:"tripperware"`
+	// Provider is empty if the cache was injected.
+	Provider ResponseCacheProvider `json:"provider"`
+	// Items and SizeBytes are only known for in-memory caches.
+	Items     *int               `json:"items,omitempty"`
+	SizeBytes *uint64            `json:"sizeBytes,omitempty"`
+	Windows   []CacheWindowStats `json:"windows"`
+	TopKeys   []CacheKeyStats    `json:"topKeys"`
+}
+
+// CacheWindowStats are the hits and misses of a cache over a recent time window.
+type CacheWindowStats struct {
+	Window   string  `json:"window"`
+	Hits     uint64  `json:"hits"`
+	Misses   uint64  `json:"misses"`
+	HitRatio float64 `json:"hitRatio"`
+}
+
+// CacheKeyStats are the accesses of the cache keys of a query, across all its split intervals.
+// Label values and strings of the query are replaced by a hash, so that they are not leaked.
+type CacheKeyStats struct {
+	Tenant   string `json:"tenant"`
+	Query    string `json:"query"`
+	Step     int64  `json:"step,omitempty"`
+	Accesses uint64 `json:"accesses"`
+}
+
+type cacheKeyID struct {
+	tenant string
+	query  string
+	step   int64
+}
+
+type hitsBucket struct {
+	minute       int64
+	hits, misses uint64
+}
+
+// resultsCacheStats collects the statistics of a results cache.
+type resultsCacheStats struct {
+	tripperware string
+	provider    ResponseCacheProvider
+	// size returns the number of items and size of the cache, nil if unknown.
+	size func() (int, uint64)
+	now  func() time.Time
+
+	mtx sync.Mutex
+	// buckets are the hits and misses of the last hour, per minute.
+	buckets [60]hitsBucket
+	keys    map[cacheKeyID]uint64
+}
+
+func (s *resultsCacheStats) record(hits, misses int) {
+	minute := s.now().Unix() / 60
+
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	b := &s.buckets[minute%int64(len(s.buckets))]
+	if b.minute != minute {
+		*b = hitsBucket{minute: minute}
+	}
+	b.hits += uint64(hits)
+	b.misses += uint64(misses)
+}
+
+// access counts an access of the given key. Once the maximum number of keys is tracked, the least accessed
+// key is replaced and its count is inherited, so that frequently accessed keys eventually get tracked.
+func (s *resultsCacheStats) access(id cacheKeyID) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	if _, ok := s.keys[id]; ok || len(s.keys) < cacheStatsMaxKeys {
+		s.keys[id]++
+		return
+	}
+
+	var (
+		minID    cacheKeyID
+		minCount uint64 = math.MaxUint64
+	)
+	for k, c := range s.keys {
+		if c < minCount {
+			minID, minCount = k, c
+		}
+	}
+	delete(s.keys, minID)
+	s.keys[id] = minCount + 1
+}
+
+func (s *resultsCacheStats) snapshot(topKeys int) ResultsCacheStats {
+	res := ResultsCacheStats{
+		Tripperware: s.tripperware,
+		Provider:    s.provider,
+		TopKeys:     []CacheKeyStats{},
+	}
+	if s.size != nil {
+		items, size := s.size()
+		res.Items, res.SizeBytes = &items, &size
+	}
+
+	minute := s.now().Unix() / 60
+
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	for _, w := range cacheStatsWindows {
+		ws := CacheWindowStats{Window: (time.Duration(w) * time.Minute).String()}
+		for _, b := range s.buckets {
+			if minute-b.minute < w {
+				ws.Hits += b.hits
+				ws.Misses += b.misses
+			}
+		}
+		if total := ws.Hits + ws.Misses; total > 0 {
+			ws.HitRatio = float64(ws.Hits) / float64(total)
+		}
+		res.Windows = append(res.Windows, ws)
+	}
+
+	for id, c := range s.keys {
+		res.TopKeys = append(res.TopKeys, CacheKeyStats{Tenant: id.tenant, Query: id.query, Step: id.step, Accesses: c})
+	}
+	sort.Slice(res.TopKeys, func(i, j int) bool {
+		if res.TopKeys[i].Accesses != res.TopKeys[j].Accesses {
+			return res.TopKeys[i].Accesses > res.TopKeys[j].Accesses
+		}
+		return res.TopKeys[i].Query < res.TopKeys[j].Query
+	})
+	if len(res.TopKeys) > topKeys {
+		res.TopKeys = res.TopKeys[:topKeys]
+	}
+	return res
+}
+
+// instrument returns the config and splitter of a results cache changed to collect the statistics of the
+// cache under the given tripperware name. They are returned unchanged if s is nil.
+func (s *CacheStats) instrument(
+	tripperware string,
+	cfg queryrange.ResultsCacheConfig,
+	splitter queryrange.CacheSplitter,
+	reg prometheus.Registerer,
+	logger log.Logger,
+) (queryrange.ResultsCacheConfig, queryrange.CacheSplitter, error) {
+	if s == nil {
+		return cfg, splitter, nil
+	}
+
+	stats := &resultsCacheStats{tripperware: tripperware, now: s.now, keys: map[cacheKeyID]uint64{}}
+	cc := cfg.CacheConfig
+
+	var c cortexcache.Cache
+	switch {
+	case cc.Cache != nil:
+		c = cc.Cache
+	case cc.EnableFifoCache:
+		// The in-memory cache is created here rather than by cortexcache.New to report its size.
+		if cc.Fifocache.Validity == 0 && cc.DefaultValidity != 0 {
+			cc.Fifocache.Validity = cc.DefaultValidity
+		}
+		fifo := cortexcache.NewFifoCache(cc.Prefix+"fifocache", cc.Fifocache, reg, logger)
+		if fifo == nil {
+			return cfg, splitter, nil
+		}
+		stats.provider = INMEMORY
+		stats.size = fifo.Size
+		c = cortexcache.Instrument(cc.Prefix+"fifocache", fifo, reg)
+	default:
+		if cc.Redis.Endpoint != "" {
+			stats.provider = REDIS
+		} else {
+			stats.provider = MEMCACHED
+		}
+		var err error
+		if c, err = cortexcache.New(cc, reg, logger); err != nil {
+			return cfg, splitter, err
+		}
+	}
+	cfg.CacheConfig.Cache = &statsCache{Cache: c, stats: stats}
+
+	s.mtx.Lock()
+	s.caches = append(s.caches, stats)
+	s.mtx.Unlock()
+
+	return cfg, &statsCacheSplitter{CacheSplitter: splitter, stats: stats}, nil
+}
+
+// ServeHTTP reports the statistics of all results caches as JSON. The number of most accessed
+// cache keys reported per cache can be set with the limit parameter.
+func (s *CacheStats) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	topKeys := defaultCacheStatsTopKeys
+	if l := r.FormValue("limit"); l != "" {
+		n, err := strconv.Atoi(l)
+		if err != nil || n < 0 {
+			http.Error(w, fmt.Sprintf("invalid limit %q", l), http.StatusBadRequest)
+			return
+		}
+		topKeys = n
+	}
+
+	s.mtx.Lock()
+	caches := make([]ResultsCacheStats, 0, len(s.caches))
+	for _, c := range s.caches {
+		caches = append(caches, c.snapshot(topKeys))
+	}
+	s.mtx.Unlock()
+
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(struct {
+		Caches []ResultsCacheStats `json:"caches"`
+	}{Caches: caches})
+}
+
+// statsCache records the hits and misses of the wrapped cache.
+type statsCache struct {
+	cortexcache.Cache
+	stats *resultsCacheStats
+}
+
+func (c *statsCache) Fetch(ctx context.Context, keys []string) (found []string, bufs [][]byte, missing []string) {
+	found, bufs, missing = c.Cache.Fetch(ctx, keys)
+	c.stats.record(len(found), len(missing))
+	return found, bufs, missing
+}
+
+// statsCacheSplitter counts the accesses of the cache keys it generates.
+type statsCacheSplitter struct {
+	queryrange.CacheSplitter
+	stats *resultsCacheStats
+}
+
+func (s *statsCacheSplitter) GenerateCacheKey(userID string, r queryrange.Request) string {
+	s.stats.access(cacheKeyID{tenant: userID, query: redactRequest(r), step: r.GetStep()})
+	return s.CacheSplitter.GenerateCacheKey(userID, r)
+}
+
+// redactRequest returns the query of the request with its label values and strings replaced by a hash.
+func redactRequest(r queryrange.Request) string {
+	switch tr := r.(type) {
+	case *ThanosLabelsRequest:
+		if tr.Label != "" {
+			return fmt.Sprintf("label_values(%s)%s", tr.Label, redactMatcherSets(tr.Matchers))
+		}
+		return "labels" + redactMatcherSets(tr.Matchers)
+	case *ThanosSeriesRequest:
+		return "series" + redactMatcherSets(tr.Matchers)
+	}
+
+	expr, err := parser.ParseExpr(r.GetQuery())
+	if err != nil {
+		return redactValue(r.GetQuery())
+	}
+	parser.Inspect(expr, func(node parser.Node, _ []parser.Node) error {
+		switch n := node.(type) {
+		case *parser.VectorSelector:
+			n.LabelMatchers = redactMatchers(n.LabelMatchers)
+		case *parser.StringLiteral:
+			n.Val = redactValue(n.Val)
+		}
+		return nil
+	})
+	return expr.String()
+}
+
+func redactMatcherSets(sets [][]*labels.Matcher) string {
+	res := make([]string, 0, len(sets))
+	for _, ms := range sets {
+		redacted := make([]string, 0, len(ms))
+		for _, m := range redactMatchers(ms) {
+			redacted = append(redacted, m.String())
+		}
+		res = append(res, "{"+strings.Join(redacted, ", ")+"}")
+	}
+	return strings.Join(res, ", ")
+}
+
+// redactMatchers returns the matchers with their values replaced by a hash, except metric names.
+func redactMatchers(ms []*labels.Matcher) []*labels.Matcher {
+	res := make([]*labels.Matcher, 0, len(ms))
+	for _, m := range ms {
+		if m.Name == labels.MetricName && m.Type == labels.MatchEqual {
+			res = append(res, m)
+			continue
+		}
+		res = append(res, &labels.Matcher{Type: m.Type, Name: m.Name, Value: redactValue(m.Value)})
+	}
+	return res
+}
+
+// redactKey is the key of the HMAC of redacted values. It is random per process, so that redacted values cannot be
+// recovered by hashing guessed values, e.g. all the values of a label.
+var redactKey = func() []byte {
+	key := make([]byte, 32)
+	if _, err := rand.Read(key); err != nil {
+		panic(fmt.Sprintf("generate key of redacted values: %v", err))
+	}
+	return key
+}()
+
+// redactValue returns a short HMAC of v, so that equal values can still be told apart from different ones within
+// the process.
+func redactValue(v string) string {
+	if v == "" {
+		return v
+	}
+	mac := hmac.New(sha256.New, redactKey)
+	_, _ = mac.Write([]byte(v))
+	return "redacted:" + hex.EncodeToString(mac.Sum(nil)[:8])
+}
@@ -0,0 +1,159 @@
+// Copyright (c) The Thanos Authors.
+// Licensed under the Apache License 2.0.
+
+package queryfrontend
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/efficientgo/core/testutil"
+	"github.com/go-kit/log"
+	"github.com/prometheus/prometheus/model/labels"
+	"github.com/weaveworks/common/user"
+
+	cortexcache "github.com/thanos-io/thanos/internal/cortex/chunk/cache"
+	"github.com/thanos-io/thanos/internal/cortex/querier/queryrange"
+)
+
+func TestRedactRequest(t *testing.T) {
+	for _, tc := range []struct {
+		name     string
+		req      queryrange.Request
+		hidden   []string
+		expected []string
+	}{
+		{
+			name:     "range query",
+			req:      &ThanosQueryRangeRequest{Query: `sum(rate(http_requests_total{job="api",path=~"/secret.*"}[5m]))`},
+			hidden:   []string{"api", "secret"},
+			expected: []string{"sum(rate(http_requests_total{", `job="redacted:`, `path=~"redacted:`},
+		},
+		{
+			name:     "string literals",
+			req:      &ThanosQueryRangeRequest{Query: `label_replace(up, "dst", "secret", "src", "(.*)")`},
+			hidden:   []string{"secret"},
+			expected: []string{"label_replace(up, "},
+		},
+		{
+			name: "label values",
+			req: &ThanosLabelsRequest{
+				Label:    "job",
+				Matchers: [][]*labels.Matcher{{labels.MustNewMatcher(labels.MatchEqual, "env", "secret")}},
+			},
+			hidden:   []string{"secret"},
+			expected: []string{"label_values(job){env=\"redacted:"},
+		},
+		{
+			name: "series",
+			req: &ThanosSeriesRequest{
+				Matchers: [][]*labels.Matcher{{labels.MustNewMatcher(labels.MatchEqual, labels.MetricName, "up")}},
+			},
+			expected: []string{`series{__name__="up"}`},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			res := redactRequest(tc.req)
+			for _, h := range tc.hidden {
+				testutil.Assert(t, !strings.Contains(res, h), "%q leaked in %q", h, res)
+			}
+			for _, e := range tc.expected {
+				testutil.Assert(t, strings.Contains(res, e), "%q not found in %q", e, res)
+			}
+		})
+	}
+}
+
+func TestRedactValue(t *testing.T) {
+	testutil.Equals(t, "", redactValue(""))
+	testutil.Equals(t, redactValue("secret"), redactValue("secret"))
+	testutil.Assert(t, redactValue("secret") != redactValue("secret2"), "different values redacted the same way")
+
+	// Values are not redacted to their plain hash, which could be recovered by hashing guessed values.
+	h := sha256.Sum256([]byte("secret"))
+	testutil.Assert(t, !strings.Contains(redactValue("secret"), hex.EncodeToString(h[:4])), "value redacted to its plain hash")
+}
+
+func TestCacheStats(t *testing.T) {
+	stats := NewCacheStats()
+	tpw, err := NewTripperware(
+		Config{
+			QueryRangeConfig: QueryRangeConfig{
+				Limits: defaultLimits,
+				ResultsCacheConfig: &queryrange.ResultsCacheConfig{
+					CacheConfig: cortexcache.Config{
+						EnableFifoCache: true,
+						Fifocache: cortexcache.FifoCacheConfig{
+							MaxSizeBytes: "1MiB",
+							MaxSizeItems: 1000,
+							Validity:     time.Hour,
+						},
+					},
+				},
+				SplitQueriesByInterval: day,
+			},
+			CacheStats: stats,
+		}, nil, log.NewNopLogger(),
+	)
+	testutil.Ok(t, err)
+
+	rt, err := newFakeRoundTripper()
+	testutil.Ok(t, err)
+	defer rt.Close()
+	_, handler := promqlResults(false)
+	rt.setHandler(handler)
+
+	req := &ThanosQueryRangeRequest{
+		Path:  "/api/v1/query_range",
+		Start: 0,
+		End:   2 * hour,
+		Step:  10 * seconds,
+		Dedup: true,
+		Query: `foo{job="secret"}`,
+	}
+	for i := 0; i < 2; i++ {
+		ctx := user.InjectOrgID(context.Background(), "1")
+		httpReq, err := NewThanosQueryRangeCodec(true, 0).EncodeRequest(ctx, req)
+		testutil.Ok(t, err)
+		_, err = tpw(rt).RoundTrip(httpReq)
+		testutil.Ok(t, err)
+	}
+
+	rec := httptest.NewRecorder()
+	stats.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/frontend/cache/stats?limit=1", nil))
+	testutil.Equals(t, http.StatusOK, rec.Code)
+
+	var res struct {
+		Caches []ResultsCacheStats `json:"caches"`
+	}
+	testutil.Ok(t, json.NewDecoder(rec.Body).Decode(&res))
+	testutil.Equals(t, 1, len(res.Caches))
+
+	c := res.Caches[0]
+	testutil.Equals(t, "query_range", c.Tripperware)
+	testutil.Equals(t, INMEMORY, c.Provider)
+	testutil.Equals(t, 1, *c.Items)
+	testutil.Assert(t, *c.SizeBytes > 0, "expected non-empty cache")
+	testutil.Equals(t, 4, len(c.Windows))
+	testutil.Equals(t, "1h0m0s", c.Windows[3].Window)
+	testutil.Equals(t, uint64(1), c.Windows[3].Hits)
+	testutil.Equals(t, uint64(1), c.Windows[3].Misses)
+	testutil.Equals(t, 0.5, c.Windows[3].HitRatio)
+
+	testutil.Equals(t, 1, len(c.TopKeys))
+	testutil.Equals(t, "1", c.TopKeys[0].Tenant)
+	testutil.Equals(t, int64(10*seconds), c.TopKeys[0].Step)
+	testutil.Assert(t, c.TopKeys[0].Accesses >= 2, "expected at least 2 accesses, got %d", c.TopKeys[0].Accesses)
+	testutil.Assert(t, !strings.Contains(c.TopKeys[0].Query, "secret"), "label value leaked in %q", c.TopKeys[0].Query)
+
+	rec = httptest.NewRecorder()
+	stats.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/frontend/cache/stats?limit=foo", nil))
+	testutil.Equals(t, http.StatusBadRequest, rec.Code)
+}
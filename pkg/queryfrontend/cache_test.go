@@ -12,6 +12,8 @@ import (
 	"github.com/thanos-io/thanos/internal/cortex/querier/queryrange"
 
 	"github.com/efficientgo/core/testutil"
+
+	"github.com/thanos-io/thanos/pkg/tenancy"
 )
 
 func TestGenerateCacheKey(t *testing.T) {
@@ -50,6 +52,16 @@ func TestGenerateCacheKey(t *testing.T) {
 			},
 			expected: "fe::up:10000:0:2:-:0:",
 		},
+		{
+			name: "merged histograms",
+			req: &ThanosQueryRangeRequest{
+				Query:           "up",
+				Start:           0,
+				Step:            10 * seconds,
+				MergeHistograms: true,
+			},
+			expected: "fe::up:10000:0:2:-:0::merge_histograms",
+		},
 		{
 			name: "1m downsampling resolution",
 			req: &ThanosQueryRangeRequest{
@@ -153,3 +165,110 @@ func TestGenerateCacheKey(t *testing.T) {
 		})
 	}
 }
+
+func TestGenerateCacheKeyRecentTTL(t *testing.T) {
+	intervalFn := func(r queryrange.Request) time.Duration { return time.Hour }
+	splitter := newRecentCacheKeyGenerator(intervalFn, 5*time.Minute)
+
+	now := time.Unix(0, 0).Add(10 * time.Hour)
+	splitter.now = func() time.Time { return now }
+
+	// Requests ending before the last split interval keep their key.
+	old := &ThanosLabelsRequest{Start: 7 * hour, End: 8 * hour, Label: "up"}
+	testutil.Equals(t, "fe::up:[]:7", splitter.GenerateCacheKey("", old))
+
+	// Recent requests get a key changing every ttl.
+	recent := &ThanosLabelsRequest{Start: 9 * hour, End: 10 * hour, Label: "up"}
+	key := splitter.GenerateCacheKey("", recent)
+	testutil.Equals(t, "fe::up:[]:9:120", key)
+
+	now = now.Add(4 * time.Minute)
+	testutil.Equals(t, key, splitter.GenerateCacheKey("", recent))
+
+	now = now.Add(time.Minute)
+	testutil.Equals(t, "fe::up:[]:9:121", splitter.GenerateCacheKey("", recent))
+
+	// Disabled ttl keeps the key.
+	splitter.ttl = 0
+	testutil.Equals(t, "fe::up:[]:9", splitter.GenerateCacheKey("", recent))
+}
+
+func TestGenerateCacheKeyAtModifierAndOffset(t *testing.T) {
+	intervalFn := func(r queryrange.Request) time.Duration { return hour }
+	splitter := newThanosCacheKeyGenerator(intervalFn)
+
+	key := func(query string, start, end int64) string {
+		return splitter.GenerateCacheKey("", &ThanosQueryRangeRequest{Query: query, Start: start, End: end, Step: 60 * seconds})
+	}
+
+	for _, tc := range []struct {
+		name   string
+		a, b   string
+		sameAs bool
+	}{
+		{name: "@ on one selector only", a: "rate(foo[5m] @ 100) + rate(foo[5m])", b: "rate(foo[5m]) + rate(foo[5m])"},
+		{name: "@ on different selectors", a: "foo @ 100 + bar", b: "foo + bar @ 100"},
+		{name: "different @ timestamps", a: "foo @ 100 + bar", b: "foo @ 200 + bar"},
+		{name: "offset on one selector only", a: "foo offset 5m + bar", b: "foo + bar"},
+		{name: "offset on different selectors", a: "foo offset 5m + bar", b: "foo + bar offset 5m"},
+		{name: "@ and offset combined", a: "foo @ 100 offset 5m + bar", b: "foo @ 100 + bar offset 5m"},
+		{name: "@ on subquery", a: "max_over_time(foo[10m:1m] @ 100) + bar", b: "max_over_time(foo[10m:1m]) + bar"},
+		{name: "equivalent @ timestamps", a: "foo @ 100 + bar", b: "foo @ 100.000 + bar", sameAs: true},
+		{name: "equivalent offsets", a: "foo offset 5m + bar", b: "foo offset 300s + bar", sameAs: true},
+		{name: "start() resolved to the same timestamp", a: "foo @ start() + bar", b: "foo @ 60.000 + bar", sameAs: true},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			testutil.Equals(t, tc.sameAs, key(tc.a, 60*seconds, 120*seconds) == key(tc.b, 60*seconds, 120*seconds))
+		})
+	}
+
+	t.Run("start() and end() depend on the request time range", func(t *testing.T) {
+		// Both requests are within the same split interval, but the selectors are evaluated at different times.
+		testutil.Assert(t, key("foo @ start() + bar", 0, 120*seconds) != key("foo @ start() + bar", 60*seconds, 120*seconds))
+		testutil.Assert(t, key("max_over_time(foo[10m:1m] @ end())", 0, 60*seconds) != key("max_over_time(foo[10m:1m] @ end())", 0, 120*seconds))
+		testutil.Equals(t, key("foo + bar", 0, 60*seconds), key("foo + bar", 0, 120*seconds))
+	})
+}
+
+func TestGenerateCacheKeyStepOffset(t *testing.T) {
+	intervalFn := func(r queryrange.Request) time.Duration { return time.Hour }
+	splitter := newThanosCacheKeyGenerator(intervalFn)
+
+	key := func(start int64) string {
+		return splitter.GenerateCacheKey("", &ThanosQueryRangeRequest{Query: "up", Start: start, End: start + 10*60*seconds, Step: 60 * seconds})
+	}
+
+	// Requests aligned to the step grid share cache entries.
+	testutil.Equals(t, "fe::up:60000:0:2:-:0:", key(0))
+	testutil.Equals(t, key(0), key(5*60*seconds))
+	// Requests evaluated at other timestamps must not reuse their results.
+	testutil.Equals(t, "fe::up:60000+15000:0:2:-:0:", key(15*seconds))
+	testutil.Equals(t, key(15*seconds), key(75*seconds))
+}
+
+func TestGenerateCacheKeyTenant(t *testing.T) {
+	intervalFn := func(r queryrange.Request) time.Duration { return time.Hour }
+	splitter := newThanosCacheKeyGenerator(intervalFn)
+
+	key := func(userID, tenant string) string {
+		r := &ThanosSeriesRequest{Matchers: [][]*labels.Matcher{{labels.MustNewMatcher(labels.MatchEqual, "__name__", "up")}}}
+		if tenant != "" {
+			r.Headers = []*RequestHeader{{Name: "Thanos-Tenant", Values: []string{tenant}}}
+		}
+		return splitter.GenerateCacheKey(userID, r)
+	}
+
+	// Single tenant deployments and org IDs matching the tenant keep their keys.
+	testutil.Equals(t, `fe:anonymous:[[__name__="up"]]:0`, key("anonymous", ""))
+	testutil.Equals(t, `fe:anonymous:[[__name__="up"]]:0`, key("anonymous", tenancy.DefaultTenant))
+	testutil.Equals(t, `fe:team-a:[[__name__="up"]]:0`, key("team-a", "team-a"))
+
+	// Tenants differing from the org ID, e.g. taken from client certificates, are part of the key.
+	testutil.Equals(t, `fe:anonymous|team-a:[[__name__="up"]]:0`, key("anonymous", "team-a"))
+	testutil.Assert(t, key("anonymous", "team-a") != key("anonymous", "team-b"))
+
+	// Separators within tenants are escaped, so that keys of different tenants cannot collide.
+	testutil.Equals(t, `fe:a%3Ab:[[__name__="up"]]:0`, key("a:b", "a:b"))
+	testutil.Assert(t, key("a|b", "") != key("a", "b"))
+	testutil.Assert(t, key("a:b", "") != key("a", "") && key("a:b", "") != key("a%3Ab", ""))
+}
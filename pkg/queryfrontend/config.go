@@ -7,6 +7,7 @@ import (
 	"strings"
 	"time"
 
+	"github.com/alecthomas/units"
 	extflag "github.com/efficientgo/tools/extkingpin"
 	"github.com/go-kit/log"
 	"github.com/go-kit/log/level"
@@ -180,6 +181,26 @@ func NewCacheConfig(logger log.Logger, confContentYaml []byte) (*cortexcache.Con
 	}
 }
 
+// NewTenantLimits parses per-tenant overrides of the given limits, keyed by tenant. Limits not set
+// for a tenant default to the given ones.
+func NewTenantLimits(defaults cortexvalidation.Limits, confContentYaml []byte) (map[string]*cortexvalidation.Limits, error) {
+	cortexvalidation.SetDefaultLimitsForYAMLUnmarshalling(defaults)
+
+	tenantLimits := map[string]*cortexvalidation.Limits{}
+	if err := yaml.UnmarshalStrict(confContentYaml, &tenantLimits); err != nil {
+		return nil, errors.Wrap(err, "parsing tenant limits YAML")
+	}
+	for tenant, limits := range tenantLimits {
+		if limits == nil {
+			return nil, errors.Errorf("no limits set for tenant %q", tenant)
+		}
+		if limits.RequireMetricNameForQueriesLongerThan < 0 {
+			return nil, errors.Errorf("require_metric_name_for_queries_longer_than of tenant %q cannot be negative", tenant)
+		}
+	}
+	return tenantLimits, nil
+}
+
 // DownstreamTripperConfig stores the http.Transport configuration for query-frontend's HTTP downstream tripper.
 type DownstreamTripperConfig struct {
 	IdleConnTimeout       prommodel.Duration `yaml:"idle_conn_timeout"`
@@ -202,7 +223,9 @@ type Config struct {
 
 	CortexHandlerConfig    *transport.HandlerConfig
 	CompressResponses      bool
+	BrotliCompressionLevel int
 	CacheCompression       string
+	CacheChecksum          bool
 	RequestLoggingDecision string
 	DownstreamURL          string
 	ForwardHeaders         []string
@@ -211,6 +234,10 @@ type Config struct {
 	DefaultTenant          string
 	TenantCertField        string
 	EnableXFunctions       bool
+	// CacheStats collects statistics of the results caches if not nil.
+	CacheStats *CacheStats
+	// InstantQuerySplitInterval is the interval instant queries aggregating longer ranges over time are split by, 0 disables it.
+	InstantQuerySplitInterval time.Duration
 }
 
 // QueryRangeConfig holds the config for query range tripperware.
@@ -228,8 +255,16 @@ type QueryRangeConfig struct {
 	MinQuerySplitInterval  time.Duration
 	MaxQuerySplitInterval  time.Duration
 	HorizontalShards       int64
-	MaxRetries             int
-	Limits                 *cortexvalidation.Limits
+	AlignSplitsWithStep    bool
+	// SplitTargetSamples is the estimated number of samples split requests should select, 0 means splitting by time only.
+	SplitTargetSamples int64
+	MaxRetries         int
+	// MaxResponseBytes is the maximum size of encoded responses, 0 means no limit.
+	MaxResponseBytes units.Base2Bytes
+	Limits           *cortexvalidation.Limits
+	// TenantLimits overrides Limits for the tenants it contains.
+	TenantLimits              map[string]*cortexvalidation.Limits
+	TenantLimitsPathOrContent extflag.PathOrContent
 }
 
 // LabelsConfig holds the config for labels tripperware.
@@ -241,6 +276,8 @@ type LabelsConfig struct {
 
 	ResultsCacheConfig *queryrange.ResultsCacheConfig
 	CachePathOrContent extflag.PathOrContent
+	// RecentCacheTTL is how long cached results of requests ending within the last split interval are reused.
+	RecentCacheTTL time.Duration
 
 	SplitQueriesByInterval time.Duration
 	MaxRetries             int
@@ -270,6 +307,24 @@ func (cfg *Config) Validate() error {
 		}
 	}
 
+	if cfg.QueryRangeConfig.SplitTargetSamples < 0 {
+		return errors.New("split target samples cannot be negative")
+	}
+	if cfg.QueryRangeConfig.SplitTargetSamples > 0 && !cfg.isStaticSplitSet() && !cfg.isDynamicSplitSet() {
+		return errors.New("splitting by samples requires a split interval to fall back to")
+	}
+
+	if cfg.InstantQuerySplitInterval < 0 {
+		return errors.New("instant query split interval cannot be negative")
+	}
+	if cfg.InstantQuerySplitInterval > 0 && cfg.InstantQuerySplitInterval < time.Second {
+		return errors.New("instant query split interval must be at least 1s")
+	}
+
+	if cfg.QueryRangeConfig.Limits != nil && cfg.QueryRangeConfig.Limits.RequireMetricNameForQueriesLongerThan < 0 {
+		return errors.New("query-range.require-metric-name-for-queries-longer-than cannot be negative")
+	}
+
 	if cfg.LabelsConfig.ResultsCacheConfig != nil {
 		if cfg.LabelsConfig.SplitQueriesByInterval <= 0 {
 			return errors.New("split queries interval should be greater than 0  when caching is enabled")
@@ -277,6 +332,9 @@ func (cfg *Config) Validate() error {
 		if err := cfg.LabelsConfig.ResultsCacheConfig.Validate(querier.Config{}); err != nil {
 			return errors.Wrap(err, "invalid ResultsCache config for labels tripperware")
 		}
+		if cfg.LabelsConfig.RecentCacheTTL < 0 {
+			return errors.New("labels.response-cache-recent-ttl cannot be negative")
+		}
 	}
 
 	if cfg.LabelsConfig.DefaultTimeRange == 0 {
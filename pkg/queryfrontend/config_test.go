@@ -72,6 +72,22 @@ func TestConfig_Validate(t *testing.T) {
 			},
 			err: "min query split interval should be greater than 0 when query split threshold is enabled",
 		},
+		{
+			name: "split by samples without fallback interval",
+			config: Config{
+				QueryRangeConfig: QueryRangeConfig{
+					SplitTargetSamples: 1000,
+				},
+			},
+			err: "splitting by samples requires a split interval to fall back to",
+		},
+		{
+			name: "instant query split interval below 1s",
+			config: Config{
+				InstantQuerySplitInterval: time.Millisecond,
+			},
+			err: "instant query split interval must be at least 1s",
+		},
 		{
 			name: "valid config with caching",
 			config: Config{
@@ -0,0 +1,131 @@
+// Copyright (c) The Thanos Authors.
+// Licensed under the Apache License 2.0.
+
+package queryfrontend
+
+import (
+	"context"
+	"net/http"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/common/model"
+	"github.com/prometheus/prometheus/model/labels"
+	"github.com/prometheus/prometheus/promql/parser"
+	"github.com/weaveworks/common/httpgrpc"
+
+	"github.com/thanos-io/thanos/internal/cortex/querier/queryrange"
+	"github.com/thanos-io/thanos/internal/cortex/tenant"
+	"github.com/thanos-io/thanos/internal/cortex/util/validation"
+	"github.com/thanos-io/thanos/pkg/extpromql"
+)
+
+// MetricNameLimits are the per-tenant limits enforced by MetricNameMiddleware.
+type MetricNameLimits interface {
+	// RequireMetricNameForQueriesLongerThan returns the time range above which query selectors must have a metric name.
+	RequireMetricNameForQueriesLongerThan(userID string) time.Duration
+}
+
+// MetricNameMiddleware creates a new Middleware rejecting queries with selectors without a metric name,
+// like {job="x"}, which select data over a time range longer than the limit of the tenant. The time range
+// of a selector is the range of the query plus the ranges of the range selectors and subqueries enclosing it.
+func MetricNameMiddleware(limits MetricNameLimits, registerer prometheus.Registerer) queryrange.Middleware {
+	rejected := promauto.With(registerer).NewCounter(prometheus.CounterOpts{
+		Namespace: "thanos",
+		Name:      "frontend_queries_without_metric_name_rejected_total",
+		Help:      "Total number of queries rejected because of selectors without a metric name over a too long time range.",
+	})
+	return queryrange.MiddlewareFunc(func(next queryrange.Handler) queryrange.Handler {
+		return metricNameLimiter{next: next, limits: limits, rejected: rejected}
+	})
+}
+
+type metricNameLimiter struct {
+	next   queryrange.Handler
+	limits MetricNameLimits
+
+	rejected prometheus.Counter
+}
+
+func (m metricNameLimiter) Do(ctx context.Context, r queryrange.Request) (queryrange.Response, error) {
+	// Limits are looked up by the tenant resolved by the query frontend, falling back to the org ID.
+	tenantIDs := []string{requestTenant(r)}
+	if tenantIDs[0] == "" {
+		var err error
+		if tenantIDs, err = tenant.TenantIDs(ctx); err != nil {
+			return nil, httpgrpc.Errorf(http.StatusBadRequest, err.Error())
+		}
+	}
+
+	limit := validation.SmallestPositiveNonZeroDurationPerTenant(tenantIDs, m.limits.RequireMetricNameForQueriesLongerThan)
+	if limit <= 0 {
+		return m.next.Do(ctx, r)
+	}
+
+	expr, err := extpromql.ParseExpr(r.GetQuery())
+	if err != nil {
+		// Leave reporting invalid queries to the queriers.
+		return m.next.Do(ctx, r)
+	}
+
+	queryRange := time.Duration(r.GetEnd()-r.GetStart()) * time.Millisecond
+	if sel, selRange := longestSelectorWithoutMetricName(expr, queryRange); sel != nil && selRange > limit {
+		m.rejected.Inc()
+		return nil, httpgrpc.Errorf(http.StatusUnprocessableEntity,
+			"the selector %s has no metric name and would select data over %s, exceeding the limit of %s for selectors without a metric name; add a metric name to the selector or reduce the time range of the query",
+			sel, model.Duration(selRange), model.Duration(limit))
+	}
+	return m.next.Do(ctx, r)
+}
+
+// longestSelectorWithoutMetricName returns the selector without a metric name of expr which selects data over the
+// longest time range, along with that time range, or nil if all selectors of expr have a metric name.
+func longestSelectorWithoutMetricName(expr parser.Expr, queryRange time.Duration) (*parser.VectorSelector, time.Duration) {
+	var (
+		longest      *parser.VectorSelector
+		longestRange time.Duration
+	)
+	parser.Inspect(expr, func(node parser.Node, path []parser.Node) error {
+		vs, ok := node.(*parser.VectorSelector)
+		if !ok || hasMetricName(vs) {
+			return nil
+		}
+
+		selRange := queryRange
+		for _, n := range path {
+			switch n := n.(type) {
+			case *parser.MatrixSelector:
+				selRange += n.Range
+			case *parser.SubqueryExpr:
+				selRange += n.Range
+			}
+		}
+		if longest == nil || selRange > longestRange {
+			longest, longestRange = vs, selRange
+		}
+		return nil
+	})
+	return longest, longestRange
+}
+
+// hasMetricName returns true if vs selects series of a fixed set of metric names, either by an equality
+// matcher or by a regular expression matching a list of names, like __name__=~"up|scrape_duration_seconds".
+func hasMetricName(vs *parser.VectorSelector) bool {
+	for _, m := range vs.LabelMatchers {
+		if m.Name != labels.MetricName {
+			continue
+		}
+		switch m.Type {
+		case labels.MatchEqual:
+			if m.Value != "" {
+				return true
+			}
+		case labels.MatchRegexp:
+			if len(m.SetMatches()) > 0 && !m.Matches("") {
+				return true
+			}
+		}
+	}
+	return false
+}
@@ -0,0 +1,148 @@
+// Copyright (c) The Thanos Authors.
+// Licensed under the Apache License 2.0.
+
+package queryfrontend
+
+import (
+	"context"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/efficientgo/core/testutil"
+	"github.com/prometheus/client_golang/prometheus"
+	promtest "github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/prometheus/common/model"
+	"github.com/weaveworks/common/httpgrpc"
+	"github.com/weaveworks/common/user"
+
+	"github.com/thanos-io/thanos/internal/cortex/querier/queryrange"
+	"github.com/thanos-io/thanos/internal/cortex/util/validation"
+	"github.com/thanos-io/thanos/pkg/tenancy"
+)
+
+func TestMetricNameMiddleware(t *testing.T) {
+	defaults := *defaultLimits
+	defaults.RequireMetricNameForQueriesLongerThan = model.Duration(24 * time.Hour)
+	tenantLimits, err := NewTenantLimits(defaults, []byte(`
+strict:
+  require_metric_name_for_queries_longer_than: 1h
+lenient:
+  require_metric_name_for_queries_longer_than: 0s
+`))
+	testutil.Ok(t, err)
+	limits, err := validation.NewOverrides(defaults, staticTenantLimits(tenantLimits))
+	testutil.Ok(t, err)
+
+	const hour = int64(time.Hour / time.Millisecond)
+	for _, tc := range []struct {
+		name     string
+		tenant   string
+		req      queryrange.Request
+		rejected bool
+	}{
+		{
+			name:   "metric name over long range",
+			tenant: "default",
+			req:    &ThanosQueryRangeRequest{Start: 0, End: 48 * hour, Query: `up{job="x"}`},
+		},
+		{
+			name:   "regular expression of metric names over long range",
+			tenant: "default",
+			req:    &ThanosQueryRangeRequest{Start: 0, End: 48 * hour, Query: `{__name__=~"up|scrape_duration_seconds", job="x"}`},
+		},
+		{
+			name:   "no metric name over short range",
+			tenant: "default",
+			req:    &ThanosQueryRangeRequest{Start: 0, End: 2 * hour, Query: `{job="x"}`},
+		},
+		{
+			name:     "no metric name over long range",
+			tenant:   "default",
+			req:      &ThanosQueryRangeRequest{Start: 0, End: 48 * hour, Query: `sum(up) / count({job="x"})`},
+			rejected: true,
+		},
+		{
+			name:     "metric name matching all series over long range",
+			tenant:   "default",
+			req:      &ThanosQueryRangeRequest{Start: 0, End: 48 * hour, Query: `{__name__=~".+", job="x"}`},
+			rejected: true,
+		},
+		{
+			name:     "no metric name with range selector over long range",
+			tenant:   "default",
+			req:      &ThanosQueryRangeRequest{Start: 0, End: 20 * hour, Query: `rate({job="x"}[5h])`},
+			rejected: true,
+		},
+		{
+			name:     "no metric name in subquery of instant query",
+			tenant:   "default",
+			req:      &ThanosQueryInstantRequest{Query: `max_over_time(rate({job="x"}[5m])[2d:1m])`},
+			rejected: true,
+		},
+		{
+			name:   "no metric name in instant query",
+			tenant: "default",
+			req:    &ThanosQueryInstantRequest{Query: `{job="x"}`},
+		},
+		{
+			name:     "no metric name over short range for strict tenant",
+			tenant:   "strict",
+			req:      &ThanosQueryRangeRequest{Start: 0, End: 2 * hour, Query: `{job="x"}`},
+			rejected: true,
+		},
+		{
+			name:   "no metric name over short range for strict tenant from tenant header",
+			tenant: "default",
+			req: &ThanosQueryRangeRequest{Start: 0, End: 2 * hour, Query: `{job="x"}`, Headers: []*RequestHeader{
+				{Name: tenancy.DefaultTenantHeader, Values: []string{"strict"}},
+			}},
+			rejected: true,
+		},
+		{
+			name:   "no metric name over long range for lenient tenant",
+			tenant: "lenient",
+			req:    &ThanosQueryRangeRequest{Start: 0, End: 48 * hour, Query: `{job="x"}`},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			var calls int
+			next := queryrange.HandlerFunc(func(context.Context, queryrange.Request) (queryrange.Response, error) {
+				calls++
+				return &queryrange.PrometheusResponse{Status: queryrange.StatusSuccess}, nil
+			})
+			m := MetricNameMiddleware(limits, prometheus.NewRegistry()).Wrap(next).(metricNameLimiter)
+
+			_, err := m.Do(user.InjectOrgID(context.Background(), tc.tenant), tc.req)
+			if !tc.rejected {
+				testutil.Ok(t, err)
+				testutil.Equals(t, 1, calls)
+				return
+			}
+			testutil.NotOk(t, err)
+			resp, ok := httpgrpc.HTTPResponseFromError(err)
+			testutil.Assert(t, ok, "expected HTTP error, got %v", err)
+			testutil.Equals(t, int32(http.StatusUnprocessableEntity), resp.Code)
+			testutil.Equals(t, 0, calls)
+			testutil.Equals(t, 1.0, promtest.ToFloat64(m.rejected))
+		})
+	}
+}
+
+func TestMetricNameMiddleware_ErrorMessage(t *testing.T) {
+	defaults := *defaultLimits
+	defaults.RequireMetricNameForQueriesLongerThan = model.Duration(24 * time.Hour)
+	limits, err := validation.NewOverrides(defaults, nil)
+	testutil.Ok(t, err)
+
+	next := queryrange.HandlerFunc(func(context.Context, queryrange.Request) (queryrange.Response, error) {
+		return nil, nil
+	})
+	_, err = MetricNameMiddleware(limits, nil).Wrap(next).Do(
+		user.InjectOrgID(context.Background(), "1"),
+		&ThanosQueryRangeRequest{Start: 0, End: int64(30 * time.Hour / time.Millisecond), Query: `rate({job="x"}[5m])`},
+	)
+	resp, ok := httpgrpc.HTTPResponseFromError(err)
+	testutil.Assert(t, ok, "expected HTTP error, got %v", err)
+	testutil.Equals(t, `the selector {job="x"} has no metric name and would select data over 1d6h5m, exceeding the limit of 1d for selectors without a metric name; add a metric name to the selector or reduce the time range of the query`, string(resp.Body))
+}
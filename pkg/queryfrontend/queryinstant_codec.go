@@ -128,6 +128,16 @@ func (c queryInstantCodec) DecodeRequest(_ context.Context, r *http.Request, for
 		return nil, err
 	}
 
+	result.StrictDedup, err = parseStrictDedupParam(r.FormValue(queryv1.StrictDedupParam))
+	if err != nil {
+		return nil, err
+	}
+
+	result.MergeHistograms, err = parseMergeHistogramsParam(r.FormValue(queryv1.MergeHistogramsParam))
+	if err != nil {
+		return nil, err
+	}
+
 	if r.FormValue(queryv1.MaxSourceResolutionParam) == "auto" {
 		result.AutoDownsampling = true
 	} else {
@@ -190,6 +200,12 @@ func (c queryInstantCodec) EncodeRequest(ctx context.Context, r queryrange.Reque
 		queryv1.EngineParam:          []string{thanosReq.Engine},
 		queryv1.ReplicaLabelsParam:   thanosReq.ReplicaLabels,
 	}
+	if thanosReq.StrictDedup {
+		params[queryv1.StrictDedupParam] = []string{"true"}
+	}
+	if thanosReq.MergeHistograms {
+		params[queryv1.MergeHistogramsParam] = []string{"true"}
+	}
 
 	if thanosReq.Time > 0 {
 		params["time"] = []string{encodeTime(thanosReq.Time)}
@@ -7,6 +7,7 @@ import (
 	"bytes"
 	"context"
 	"encoding/json"
+	"io"
 	"math"
 	"net/http"
 	"net/url"
@@ -44,13 +45,16 @@ var (
 type queryRangeCodec struct {
 	queryrange.Codec
 	partialResponse bool
+	// maxResponseBytes is the maximum size of encoded responses, 0 means no limit.
+	maxResponseBytes int64
 }
 
 // NewThanosQueryRangeCodec initializes a queryRangeCodec.
-func NewThanosQueryRangeCodec(partialResponse bool) *queryRangeCodec {
+func NewThanosQueryRangeCodec(partialResponse bool, maxResponseBytes int64) *queryRangeCodec {
 	return &queryRangeCodec{
-		Codec:           queryrange.PrometheusCodec,
-		partialResponse: partialResponse,
+		Codec:            queryrange.PrometheusCodec,
+		partialResponse:  partialResponse,
+		maxResponseBytes: maxResponseBytes,
 	}
 }
 
@@ -93,6 +97,16 @@ func (c queryRangeCodec) DecodeRequest(_ context.Context, r *http.Request, forwa
 		return nil, err
 	}
 
+	result.StrictDedup, err = parseStrictDedupParam(r.FormValue(queryv1.StrictDedupParam))
+	if err != nil {
+		return nil, err
+	}
+
+	result.MergeHistograms, err = parseMergeHistogramsParam(r.FormValue(queryv1.MergeHistogramsParam))
+	if err != nil {
+		return nil, err
+	}
+
 	if r.FormValue(queryv1.MaxSourceResolutionParam) == "auto" {
 		result.AutoDownsampling = true
 		result.MaxSourceResolution = result.Step / 5
@@ -137,11 +151,32 @@ func (c queryRangeCodec) DecodeRequest(_ context.Context, r *http.Request, forwa
 	result.Engine = r.FormValue(queryv1.EngineParam)
 	result.Path = r.URL.Path
 
+	if len(r.FormValue(PadStepsParam)) > 0 {
+		result.PadSteps, err = strconv.ParseBool(r.FormValue(PadStepsParam))
+		if err != nil {
+			return nil, httpgrpc.Errorf(http.StatusBadRequest, errCannotParse, PadStepsParam)
+		}
+	}
+
+	if len(r.FormValue(NoCacheParam)) > 0 {
+		result.BypassCache, err = strconv.ParseBool(r.FormValue(NoCacheParam))
+		if err != nil {
+			return nil, httpgrpc.Errorf(http.StatusBadRequest, errCannotParse, NoCacheParam)
+		}
+	}
+
 	for _, value := range r.Header.Values(cacheControlHeader) {
 		if strings.Contains(value, noStoreValue) {
-			result.CachingOptions.Disabled = true
+			result.CachingOptions = &queryrange.CachingOptions{Disabled: true}
 			break
 		}
+		if strings.Contains(value, noCacheValue) {
+			result.BypassCache = true
+		}
+	}
+	// Cached results do not tell whether the replicas of their series agree.
+	if result.StrictDedup {
+		result.CachingOptions = &queryrange.CachingOptions{Disabled: true}
 	}
 
 	for _, header := range forwardHeaders {
@@ -171,6 +206,12 @@ func (c queryRangeCodec) EncodeRequest(ctx context.Context, r queryrange.Request
 		queryv1.PartialResponseParam: []string{strconv.FormatBool(thanosReq.PartialResponse)},
 		queryv1.ReplicaLabelsParam:   thanosReq.ReplicaLabels,
 	}
+	if thanosReq.StrictDedup {
+		params[queryv1.StrictDedupParam] = []string{"true"}
+	}
+	if thanosReq.MergeHistograms {
+		params[queryv1.MergeHistogramsParam] = []string{"true"}
+	}
 
 	if thanosReq.AutoDownsampling {
 		params[queryv1.MaxSourceResolutionParam] = []string{"auto"}
@@ -209,6 +250,65 @@ func (c queryRangeCodec) EncodeRequest(ctx context.Context, r queryrange.Request
 	return req.WithContext(ctx), nil
 }
 
+// EncodeResponse encodes the response like the Prometheus codec. With a maximum response size, encoding is
+// aborted as soon as the encoded response exceeds it, so that oversized responses are never fully buffered.
+// Responses marked by StepPaddingMiddleware are padded while being encoded.
+func (c queryRangeCodec) EncodeResponse(ctx context.Context, res queryrange.Response) (*http.Response, error) {
+	padded, isPadded := res.(*paddedResponse)
+	if c.maxResponseBytes <= 0 && !isPadded {
+		return c.Codec.EncodeResponse(ctx, res)
+	}
+
+	var v interface{}
+	if isPadded {
+		v = padded.jsonResponse()
+	} else {
+		a, ok := res.(*queryrange.PrometheusResponse)
+		if !ok {
+			return nil, httpgrpc.Errorf(http.StatusInternalServerError, "invalid response format")
+		}
+		v = a
+	}
+	maxBytes := c.maxResponseBytes
+	if maxBytes <= 0 {
+		maxBytes = math.MaxInt64
+	}
+	b, err := encodeWithLimit(v, maxBytes)
+	if err == errResponseTooLarge {
+		return nil, responseTooLargeError(c.maxResponseBytes)
+	}
+	if err != nil {
+		return nil, httpgrpc.Errorf(http.StatusInternalServerError, "error encoding response: %v", err)
+	}
+
+	return &http.Response{
+		Header: http.Header{
+			"Content-Type": []string{"application/json"},
+		},
+		Body:          io.NopCloser(bytes.NewReader(b)),
+		StatusCode:    http.StatusOK,
+		ContentLength: int64(len(b)),
+	}, nil
+}
+
+// DecodeResponse decodes the response like the Prometheus codec. With a maximum response size, reading the body
+// is aborted as soon as it exceeds the size left of the limit of the query, see ResponseSizeLimitMiddleware.
+func (c queryRangeCodec) DecodeResponse(ctx context.Context, r *http.Response, req queryrange.Request) (queryrange.Response, error) {
+	if c.maxResponseBytes <= 0 || r.StatusCode/100 != 2 {
+		return c.Codec.DecodeResponse(ctx, r, req)
+	}
+
+	b, err := readBodyWithLimit(ctx, r, c.maxResponseBytes)
+	if err == errResponseTooLarge {
+		return nil, responseTooLargeError(c.maxResponseBytes)
+	}
+	if err != nil {
+		return nil, httpgrpc.Errorf(http.StatusInternalServerError, "error decoding response: %v", err)
+	}
+	r.Body = bufferedBody{Buffer: bytes.NewBuffer(b)}
+	return c.Codec.DecodeResponse(ctx, r, req)
+}
+
 func parseDurationMillis(s string) (int64, error) {
 	if d, err := strconv.ParseFloat(s, 64); err == nil {
 		ts := d * float64(time.Second/time.Millisecond)
@@ -223,6 +323,28 @@ func parseDurationMillis(s string) (int64, error) {
 	return 0, httpgrpc.Errorf(http.StatusBadRequest, "cannot parse %q to a valid duration", s)
 }
 
+func parseStrictDedupParam(s string) (bool, error) {
+	if s == "" {
+		return false, nil
+	}
+	strict, err := strconv.ParseBool(s)
+	if err != nil {
+		return false, httpgrpc.Errorf(http.StatusBadRequest, errCannotParse, queryv1.StrictDedupParam)
+	}
+	return strict, nil
+}
+
+func parseMergeHistogramsParam(s string) (bool, error) {
+	if s == "" {
+		return false, nil
+	}
+	merge, err := strconv.ParseBool(s)
+	if err != nil {
+		return false, httpgrpc.Errorf(http.StatusBadRequest, errCannotParse, queryv1.MergeHistogramsParam)
+	}
+	return merge, nil
+}
+
 func parseEnableDedupParam(s string) (bool, error) {
 	enableDeduplication := true // Deduplication is enabled by default.
 	if s != "" {
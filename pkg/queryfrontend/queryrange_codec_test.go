@@ -6,7 +6,10 @@ package queryfrontend
 
 import (
 	"context"
+	"io"
 	"net/http"
+	"strconv"
+	"strings"
 	"testing"
 
 	"github.com/prometheus/prometheus/model/labels"
@@ -15,6 +18,7 @@ import (
 	"github.com/thanos-io/thanos/internal/cortex/querier/queryrange"
 
 	"github.com/efficientgo/core/testutil"
+	"github.com/thanos-io/thanos/internal/cortex/cortexpb"
 	queryv1 "github.com/thanos-io/thanos/pkg/api/query"
 	"github.com/thanos-io/thanos/pkg/compact"
 )
@@ -181,12 +185,47 @@ func TestQueryRangeCodec_DecodeRequest(t *testing.T) {
 				StoreMatchers: [][]*labels.Matcher{},
 			},
 		},
+		{
+			name:            "cannot parse strict_dedup",
+			url:             `/api/v1/query_range?start=123&end=456&step=1&strict_dedup=maybe`,
+			partialResponse: false,
+			expectedError:   httpgrpc.Errorf(http.StatusBadRequest, "cannot parse parameter strict_dedup"),
+		},
+		{
+			name:            "strict_dedup disables caching",
+			url:             `/api/v1/query_range?start=123&end=456&step=1&strict_dedup=true`,
+			partialResponse: false,
+			expectedRequest: &ThanosQueryRangeRequest{
+				Path:           "/api/v1/query_range",
+				Start:          123000,
+				End:            456000,
+				Step:           1000,
+				Dedup:          true,
+				StrictDedup:    true,
+				StoreMatchers:  [][]*labels.Matcher{},
+				CachingOptions: &queryrange.CachingOptions{Disabled: true},
+			},
+		},
+		{
+			name:            "merge_histograms",
+			url:             `/api/v1/query_range?start=123&end=456&step=1&merge_histograms=true`,
+			partialResponse: false,
+			expectedRequest: &ThanosQueryRangeRequest{
+				Path:            "/api/v1/query_range",
+				Start:           123000,
+				End:             456000,
+				Step:            1000,
+				Dedup:           true,
+				MergeHistograms: true,
+				StoreMatchers:   [][]*labels.Matcher{},
+			},
+		},
 	} {
 		t.Run(tc.name, func(t *testing.T) {
 			r, err := http.NewRequest(http.MethodGet, tc.url, nil)
 			testutil.Ok(t, err)
 
-			codec := NewThanosQueryRangeCodec(tc.partialResponse)
+			codec := NewThanosQueryRangeCodec(tc.partialResponse, 0)
 			req, err := codec.DecodeRequest(context.Background(), r, nil)
 			if tc.expectedError != nil {
 				testutil.Equals(t, err, tc.expectedError)
@@ -298,10 +337,34 @@ func TestQueryRangeCodec_EncodeRequest(t *testing.T) {
 					r.FormValue(queryv1.LookbackDeltaParam) == "1"
 			},
 		},
+		{
+			name: "Strict dedup enabled",
+			req: &ThanosQueryRangeRequest{
+				Start:       123000,
+				End:         456000,
+				Step:        1000,
+				StrictDedup: true,
+			},
+			checkFunc: func(r *http.Request) bool {
+				return r.FormValue(queryv1.StrictDedupParam) == "true"
+			},
+		},
+		{
+			name: "Merge histograms enabled",
+			req: &ThanosQueryRangeRequest{
+				Start:           123000,
+				End:             456000,
+				Step:            1000,
+				MergeHistograms: true,
+			},
+			checkFunc: func(r *http.Request) bool {
+				return r.FormValue(queryv1.MergeHistogramsParam) == "true"
+			},
+		},
 	} {
 		t.Run(tc.name, func(t *testing.T) {
 			// Default partial response value doesn't matter when encoding requests.
-			codec := NewThanosQueryRangeCodec(false)
+			codec := NewThanosQueryRangeCodec(false, 0)
 			r, err := codec.EncodeRequest(context.TODO(), tc.req)
 			if tc.expectedError != nil {
 				testutil.Equals(t, err, tc.expectedError)
@@ -313,8 +376,116 @@ func TestQueryRangeCodec_EncodeRequest(t *testing.T) {
 	}
 }
 
+func TestQueryRangeCodec_EncodeResponse(t *testing.T) {
+	ctx := context.Background()
+	resp := &queryrange.PrometheusResponse{
+		Status: queryrange.StatusSuccess,
+		Data: &queryrange.PrometheusData{
+			ResultType: "matrix",
+		},
+		Warnings: []string{"partial response"},
+	}
+	for i := 0; i < 100; i++ {
+		resp.Data.Result = append(resp.Data.Result, &queryrange.SampleStream{
+			Labels:  []*cortexpb.LabelPair{{Name: []byte("series"), Value: []byte(strconv.Itoa(i))}},
+			Samples: []*cortexpb.Sample{{TimestampMs: 1000, Value: 1}, {TimestampMs: 2000, Value: 2}},
+		})
+	}
+
+	expected, err := queryrange.PrometheusCodec.EncodeResponse(ctx, resp)
+	testutil.Ok(t, err)
+	expectedBody, err := io.ReadAll(expected.Body)
+	testutil.Ok(t, err)
+
+	t.Run("response within the limit", func(t *testing.T) {
+		r, err := NewThanosQueryRangeCodec(true, int64(len(expectedBody))).EncodeResponse(ctx, resp)
+		testutil.Ok(t, err)
+		body, err := io.ReadAll(r.Body)
+		testutil.Ok(t, err)
+		testutil.Equals(t, string(expectedBody), string(body))
+		testutil.Equals(t, int64(len(body)), r.ContentLength)
+	})
+	t.Run("response exceeding the limit", func(t *testing.T) {
+		_, err := NewThanosQueryRangeCodec(true, int64(len(expectedBody))-1).EncodeResponse(ctx, resp)
+		testutil.NotOk(t, err)
+		httpResp, ok := httpgrpc.HTTPResponseFromError(err)
+		testutil.Assert(t, ok)
+		testutil.Equals(t, int32(http.StatusRequestEntityTooLarge), httpResp.Code)
+	})
+	t.Run("encoding stops at the limit", func(t *testing.T) {
+		buf := &limitedBuffer{limit: 1024}
+		stream := limitedJSON.BorrowStream(buf)
+		defer limitedJSON.ReturnStream(stream)
+
+		stream.WriteVal(resp)
+		testutil.NotOk(t, stream.Flush())
+		testutil.Assert(t, buf.exceeded)
+		// Series following the one exceeding the limit are not encoded.
+		testutil.Assert(t, stream.Buffered() < 1024, "unexpected buffered bytes %d", stream.Buffered())
+	})
+}
+
+type countingReader struct {
+	io.Reader
+	n int
+}
+
+func (r *countingReader) Read(p []byte) (int, error) {
+	n, err := r.Reader.Read(p)
+	r.n += n
+	return n, err
+}
+
+func TestQueryRangeCodec_DecodeResponse(t *testing.T) {
+	body := `{"status":"success","data":{"resultType":"matrix","result":[{"metric":{"series":"1"},"values":[[1,"1"],[2,"2"]]}]}}`
+	downstream := func(body string) (*http.Response, *countingReader) {
+		r := &countingReader{Reader: strings.NewReader(body)}
+		return &http.Response{StatusCode: http.StatusOK, Body: io.NopCloser(r), ContentLength: int64(len(body))}, r
+	}
+	expectTooLarge := func(t *testing.T, err error) {
+		t.Helper()
+		testutil.NotOk(t, err)
+		httpResp, ok := httpgrpc.HTTPResponseFromError(err)
+		testutil.Assert(t, ok)
+		testutil.Equals(t, int32(http.StatusRequestEntityTooLarge), httpResp.Code)
+	}
+
+	t.Run("response within the limit", func(t *testing.T) {
+		r, _ := downstream(body)
+		resp, err := NewThanosQueryRangeCodec(true, int64(len(body))).DecodeResponse(context.Background(), r, nil)
+		testutil.Ok(t, err)
+		testutil.Equals(t, 1, len(resp.(*queryrange.PrometheusResponse).Data.Result))
+	})
+	t.Run("response exceeding the limit", func(t *testing.T) {
+		large := body + strings.Repeat(" ", 1<<20)
+		r, read := downstream(large)
+		_, err := NewThanosQueryRangeCodec(true, int64(len(body))).DecodeResponse(context.Background(), r, nil)
+		expectTooLarge(t, err)
+		// Reading stops at the limit.
+		testutil.Assert(t, read.n < len(large)/2, "unexpected bytes read %d", read.n)
+	})
+	t.Run("responses of a query exceeding the limit together", func(t *testing.T) {
+		codec := NewThanosQueryRangeCodec(true, int64(2*len(body)+1))
+		var calls int
+		handler := ResponseSizeLimitMiddleware(int64(2*len(body) + 1)).Wrap(queryrange.HandlerFunc(func(ctx context.Context, req queryrange.Request) (queryrange.Response, error) {
+			// The query is split into three requests, each within the limit.
+			for i := 0; i < 3; i++ {
+				r, _ := downstream(body)
+				if _, err := codec.DecodeResponse(ctx, r, req); err != nil {
+					return nil, err
+				}
+				calls++
+			}
+			return nil, nil
+		}))
+		_, err := handler.Do(context.Background(), &ThanosQueryRangeRequest{})
+		expectTooLarge(t, err)
+		testutil.Equals(t, 2, calls)
+	})
+}
+
 func BenchmarkQueryRangeCodecEncodeAndDecodeRequest(b *testing.B) {
-	codec := NewThanosQueryRangeCodec(true)
+	codec := NewThanosQueryRangeCodec(true, 0)
 	ctx := context.TODO()
 
 	req := &ThanosQueryRangeRequest{
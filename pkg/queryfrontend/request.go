@@ -45,6 +45,8 @@ type ThanosQueryRangeRequest struct {
 	Timeout             time.Duration
 	Query               string
 	Dedup               bool
+	StrictDedup         bool
+	MergeHistograms     bool
 	PartialResponse     bool
 	AutoDownsampling    bool
 	MaxSourceResolution int64
@@ -57,6 +59,10 @@ type ThanosQueryRangeRequest struct {
 	LookbackDelta       int64
 	Analyze             bool
 	Engine              string
+	// PadSteps requests a value, or null, at every step of every float series of the response.
+	PadSteps bool
+	// BypassCache requests the results cache not to be read. Fresh results are still written to it.
+	BypassCache bool
 }
 
 func (tqrr *ThanosQueryRangeRequest) Clone() *ThanosQueryRangeRequest {
@@ -68,6 +74,8 @@ func (tqrr *ThanosQueryRangeRequest) Clone() *ThanosQueryRangeRequest {
 		Timeout:             tqrr.Timeout,
 		Query:               tqrr.Query,
 		Dedup:               tqrr.Dedup,
+		StrictDedup:         tqrr.StrictDedup,
+		MergeHistograms:     tqrr.MergeHistograms,
 		PartialResponse:     tqrr.PartialResponse,
 		AutoDownsampling:    tqrr.AutoDownsampling,
 		MaxSourceResolution: tqrr.MaxSourceResolution,
@@ -80,6 +88,8 @@ func (tqrr *ThanosQueryRangeRequest) Clone() *ThanosQueryRangeRequest {
 		LookbackDelta:       tqrr.LookbackDelta,
 		Analyze:             tqrr.Analyze,
 		Engine:              tqrr.Engine,
+		PadSteps:            tqrr.PadSteps,
+		BypassCache:         tqrr.BypassCache,
 	}
 }
 
@@ -107,6 +117,9 @@ func (r *ThanosQueryRangeRequest) GetCachingOptions() *queryrange.CachingOptions
 
 func (r *ThanosQueryRangeRequest) GetStats() string { return r.Stats }
 
+// GetBypassCache returns true if the results cache must not be read for this request.
+func (r *ThanosQueryRangeRequest) GetBypassCache() bool { return r.BypassCache }
+
 func (r *ThanosQueryRangeRequest) WithStats(stats string) queryrange.Request {
 	q := *r
 	q.Stats = stats
@@ -171,6 +184,8 @@ type ThanosQueryInstantRequest struct {
 	Timeout             time.Duration
 	Query               string
 	Dedup               bool
+	StrictDedup         bool
+	MergeHistograms     bool
 	PartialResponse     bool
 	AutoDownsampling    bool
 	MaxSourceResolution int64
@@ -0,0 +1,151 @@
+// Copyright (c) The Thanos Authors.
+// Licensed under the Apache License 2.0.
+
+package queryfrontend
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net/http"
+	"reflect"
+	"unsafe"
+
+	jsoniter "github.com/json-iterator/go"
+	"github.com/modern-go/reflect2"
+	"github.com/pkg/errors"
+	"github.com/weaveworks/common/httpgrpc"
+	"go.uber.org/atomic"
+
+	"github.com/thanos-io/thanos/internal/cortex/querier/queryrange"
+)
+
+var errResponseTooLarge = errors.New("response too large")
+
+// limitedJSON encodes responses like the Prometheus codec does, writing the encoded series
+// one by one to the output so that its size can be checked during encoding.
+var limitedJSON = func() jsoniter.API {
+	api := jsoniter.Config{
+		EscapeHTML:             false,
+		SortMapKeys:            true,
+		ValidateJsonRawMessage: true,
+	}.Froze()
+	api.RegisterExtension(&seriesFlushingExtension{})
+	return api
+}()
+
+var (
+	sampleStreamType = reflect.TypeOf(&queryrange.SampleStream{})
+	paddedSeriesType = reflect.TypeOf(paddedSeries{})
+)
+
+// seriesFlushingExtension flushes the encoded response after each series.
+type seriesFlushingExtension struct {
+	jsoniter.DummyExtension
+}
+
+func (*seriesFlushingExtension) DecorateEncoder(typ reflect2.Type, encoder jsoniter.ValEncoder) jsoniter.ValEncoder {
+	if t := typ.Type1(); t != sampleStreamType && t != paddedSeriesType {
+		return encoder
+	}
+	return seriesFlushingEncoder{ValEncoder: encoder}
+}
+
+type seriesFlushingEncoder struct {
+	jsoniter.ValEncoder
+}
+
+func (e seriesFlushingEncoder) Encode(ptr unsafe.Pointer, stream *jsoniter.Stream) {
+	// Once the output failed, e.g. the limit was exceeded, the remaining series are skipped.
+	if stream.Error != nil {
+		return
+	}
+	e.ValEncoder.Encode(ptr, stream)
+	_ = stream.Flush()
+}
+
+// limitedBuffer is a buffer failing with errResponseTooLarge on writes which would make it exceed its limit.
+type limitedBuffer struct {
+	bytes.Buffer
+	limit    int64
+	exceeded bool
+}
+
+func (b *limitedBuffer) Write(p []byte) (int, error) {
+	if int64(b.Len()+len(p)) > b.limit {
+		b.exceeded = true
+		return 0, errResponseTooLarge
+	}
+	return b.Buffer.Write(p)
+}
+
+// encodeWithLimit encodes the response as JSON, failing with errResponseTooLarge as soon as the encoded
+// response exceeds maxBytes. At most maxBytes of the response are buffered.
+func encodeWithLimit(resp interface{}, maxBytes int64) ([]byte, error) {
+	buf := &limitedBuffer{limit: maxBytes}
+	stream := limitedJSON.BorrowStream(buf)
+	defer limitedJSON.ReturnStream(stream)
+
+	stream.WriteVal(resp)
+	if err := stream.Flush(); err != nil {
+		// The encoder wraps the errors of the output.
+		if buf.exceeded {
+			return nil, errResponseTooLarge
+		}
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func responseTooLargeError(maxBytes int64) error {
+	return httpgrpc.Errorf(http.StatusRequestEntityTooLarge,
+		"the response exceeds the maximum size of %d bytes. Try increasing the query resolution step (?step=XX) or reducing the time range of the query", maxBytes)
+}
+
+type responseBytesKey struct{}
+
+// ResponseSizeLimitMiddleware limits the total size of the downstream responses of a range query to maxBytes.
+// The responses of the split and sharded requests are decoded and merged before the merged response is encoded,
+// so the query fails as soon as the downstream responses read so far exceed the limit, instead of only once all of
+// them were buffered.
+func ResponseSizeLimitMiddleware(maxBytes int64) queryrange.Middleware {
+	return queryrange.MiddlewareFunc(func(next queryrange.Handler) queryrange.Handler {
+		return queryrange.HandlerFunc(func(ctx context.Context, r queryrange.Request) (queryrange.Response, error) {
+			return next.Do(context.WithValue(ctx, responseBytesKey{}, atomic.NewInt64(maxBytes)), r)
+		})
+	})
+}
+
+// readBodyWithLimit reads the body of a downstream response, failing with errResponseTooLarge as soon as it
+// exceeds maxBytes, or the bytes left of the limit of the query set by ResponseSizeLimitMiddleware.
+func readBodyWithLimit(ctx context.Context, r *http.Response, maxBytes int64) ([]byte, error) {
+	left, _ := ctx.Value(responseBytesKey{}).(*atomic.Int64)
+	limit := maxBytes
+	if left != nil && left.Load() < limit {
+		limit = left.Load()
+	}
+	if limit < 0 {
+		return nil, errResponseTooLarge
+	}
+
+	buf := bytes.NewBuffer(make([]byte, 0, min(r.ContentLength, limit)+bytes.MinRead))
+	// One byte more than the limit is read to tell whether the body exceeds it.
+	if _, err := buf.ReadFrom(io.LimitReader(r.Body, limit+1)); err != nil {
+		return nil, err
+	}
+	n := int64(buf.Len())
+	if n > limit {
+		return nil, errResponseTooLarge
+	}
+	if left != nil && left.Sub(n) < 0 {
+		return nil, errResponseTooLarge
+	}
+	return buf.Bytes(), nil
+}
+
+// bufferedBody is a response body which was already read, see queryrange.BodyBuffer.
+type bufferedBody struct {
+	*bytes.Buffer
+}
+
+func (bufferedBody) Close() error { return nil }
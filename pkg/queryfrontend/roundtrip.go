@@ -40,7 +40,11 @@ func NewTripperware(config Config, reg prometheus.Registerer, logger log.Logger)
 		err                            error
 	)
 	if config.QueryRangeConfig.Limits != nil {
-		queryRangeLimits, err = validation.NewOverrides(*config.QueryRangeConfig.Limits, nil)
+		var tenantLimits validation.TenantLimits
+		if config.QueryRangeConfig.TenantLimits != nil {
+			tenantLimits = staticTenantLimits(config.QueryRangeConfig.TenantLimits)
+		}
+		queryRangeLimits, err = validation.NewOverrides(*config.QueryRangeConfig.Limits, tenantLimits)
 		if err != nil {
 			return nil, errors.Wrap(err, "initialize query range limits")
 		}
@@ -53,7 +57,7 @@ func NewTripperware(config Config, reg prometheus.Registerer, logger log.Logger)
 		}
 	}
 
-	queryRangeCodec := NewThanosQueryRangeCodec(config.QueryRangeConfig.PartialResponseStrategy)
+	queryRangeCodec := NewThanosQueryRangeCodec(config.QueryRangeConfig.PartialResponseStrategy, int64(config.QueryRangeConfig.MaxResponseBytes))
 	labelsCodec := NewThanosLabelsCodec(config.LabelsConfig.PartialResponseStrategy, config.DefaultTimeRange)
 	queryInstantCodec := NewThanosQueryInstantCodec(config.QueryRangeConfig.PartialResponseStrategy)
 
@@ -62,18 +66,19 @@ func NewTripperware(config Config, reg prometheus.Registerer, logger log.Logger)
 		queryRangeLimits,
 		queryRangeCodec,
 		config.NumShards,
-		prometheus.WrapRegistererWith(prometheus.Labels{"tripperware": "query_range"}, reg), logger, config.ForwardHeaders)
+		prometheus.WrapRegistererWith(prometheus.Labels{"tripperware": "query_range"}, reg), logger, config.ForwardHeaders, config.CacheStats)
 	if err != nil {
 		return nil, err
 	}
 
 	labelsTripperware, err := newLabelsTripperware(config.LabelsConfig, labelsLimits, labelsCodec,
-		prometheus.WrapRegistererWith(prometheus.Labels{"tripperware": "labels"}, reg), logger, config.ForwardHeaders)
+		prometheus.WrapRegistererWith(prometheus.Labels{"tripperware": "labels"}, reg), logger, config.ForwardHeaders, config.CacheStats)
 	if err != nil {
 		return nil, err
 	}
 	queryInstantTripperware := newInstantQueryTripperware(
 		config.NumShards,
+		config.InstantQuerySplitInterval,
 		queryRangeLimits,
 		queryInstantCodec,
 		prometheus.WrapRegistererWith(prometheus.Labels{"tripperware": "query_instant"}, reg),
@@ -91,6 +96,13 @@ func NewTripperware(config Config, reg prometheus.Registerer, logger log.Logger)
 	}, nil
 }
 
+// staticTenantLimits are per-tenant overrides of limits loaded at startup.
+type staticTenantLimits map[string]*validation.Limits
+
+func (l staticTenantLimits) ByUserID(userID string) *validation.Limits { return l[userID] }
+
+func (l staticTenantLimits) AllByUserID() map[string]*validation.Limits { return l }
+
 type roundTripper struct {
 	next, queryInstant, queryRange, labels http.RoundTripper
 
@@ -156,7 +168,7 @@ func getOperation(r *http.Request) string {
 }
 
 // newQueryRangeTripperware returns a Tripperware for range queries configured with middlewares of
-// limit, step align, downsampled, split by interval, cache requests and retry.
+// limit, metric name limit, cache bypass limit, step align, downsampled, split by interval, cache requests and retry.
 func newQueryRangeTripperware(
 	config QueryRangeConfig,
 	limits queryrange.Limits,
@@ -165,10 +177,29 @@ func newQueryRangeTripperware(
 	reg prometheus.Registerer,
 	logger log.Logger,
 	forwardHeaders []string,
+	cacheStats *CacheStats,
 ) (queryrange.Tripperware, error) {
 	queryRangeMiddleware := []queryrange.Middleware{queryrange.NewLimitsMiddleware(limits)}
 	m := queryrange.NewInstrumentMiddlewareMetrics(reg)
 
+	// The downstream responses of a query are limited in total, before it is split.
+	if config.MaxResponseBytes > 0 {
+		queryRangeMiddleware = append(queryRangeMiddleware, ResponseSizeLimitMiddleware(int64(config.MaxResponseBytes)))
+	}
+
+	if metricNameLimits, ok := limits.(MetricNameLimits); ok {
+		queryRangeMiddleware = append(
+			queryRangeMiddleware,
+			queryrange.InstrumentMiddleware("metric_name", m),
+			MetricNameMiddleware(metricNameLimits, reg),
+		)
+	}
+
+	// Requests to bypass the cache are checked once, before being split.
+	if cacheBypassLimits, ok := limits.(CacheBypassLimits); ok && config.ResultsCacheConfig != nil {
+		queryRangeMiddleware = append(queryRangeMiddleware, CacheBypassMiddleware(cacheBypassLimits, logger, reg))
+	}
+
 	// step align middleware.
 	if config.AlignRangeWithStep {
 		queryRangeMiddleware = append(
@@ -178,6 +209,9 @@ func newQueryRangeTripperware(
 		)
 	}
 
+	// Padding is requested per request, and applies to the steps of the aligned request.
+	queryRangeMiddleware = append(queryRangeMiddleware, StepPaddingMiddleware())
+
 	if config.RequestDownsampled {
 		queryRangeMiddleware = append(
 			queryRangeMiddleware,
@@ -189,10 +223,14 @@ func newQueryRangeTripperware(
 	if config.SplitQueriesByInterval != 0 || config.MinQuerySplitInterval != 0 {
 		queryIntervalFn := dynamicIntervalFn(config)
 
+		splitMiddleware := SplitByIntervalMiddleware(queryIntervalFn, limits, codec, reg)
+		if config.SplitTargetSamples > 0 {
+			splitMiddleware = SplitBySamplesMiddleware(config.SplitTargetSamples, queryIntervalFn, limits, codec, logger, reg)
+		}
 		queryRangeMiddleware = append(
 			queryRangeMiddleware,
 			queryrange.InstrumentMiddleware("split_by_interval", m),
-			SplitByIntervalMiddleware(queryIntervalFn, limits, codec, reg),
+			splitMiddleware,
 		)
 	}
 
@@ -205,10 +243,14 @@ func newQueryRangeTripperware(
 	}
 
 	if config.ResultsCacheConfig != nil {
+		cacheConfig, keyGenerator, err := cacheStats.instrument("query_range", *config.ResultsCacheConfig, newThanosCacheKeyGenerator(dynamicIntervalFn(config)), reg, logger)
+		if err != nil {
+			return nil, errors.Wrap(err, "create results cache")
+		}
 		queryCacheMiddleware, _, err := queryrange.NewResultsCacheMiddleware(
 			logger,
-			*config.ResultsCacheConfig,
-			newThanosCacheKeyGenerator(dynamicIntervalFn(config)),
+			cacheConfig,
+			keyGenerator,
 			limits,
 			codec,
 			queryrange.PrometheusResponseExtractor{},
@@ -258,13 +300,33 @@ func dynamicIntervalFn(config QueryRangeConfig) queryrange.IntervalFn {
 
 		if queryInterval > config.MinQuerySplitInterval {
 			// If the query duration is less than max interval, we split it equally in HorizontalShards.
-			return time.Duration(queryInterval.Milliseconds()/config.HorizontalShards) * time.Millisecond
+			interval := time.Duration(queryInterval.Milliseconds()/config.HorizontalShards) * time.Millisecond
+			if config.AlignSplitsWithStep {
+				return alignSplitInterval(interval, config.MinQuerySplitInterval, config.MaxQuerySplitInterval, r.GetStep())
+			}
+			return interval
 		}
 
 		return config.MinQuerySplitInterval
 	}
 }
 
+// alignSplitInterval rounds interval up to minInterval times a power of two, capped at maxInterval,
+// and then up to a multiple of the step. The result only changes when the query range changes
+// considerably, so consecutive requests of a dashboard are split at the same boundaries.
+func alignSplitInterval(interval, minInterval, maxInterval time.Duration, step int64) time.Duration {
+	aligned := minInterval
+	for aligned < interval && aligned < maxInterval {
+		aligned *= 2
+	}
+	aligned = min(aligned, maxInterval)
+
+	if stepDuration := time.Duration(step) * time.Millisecond; stepDuration > 0 && aligned%stepDuration != 0 {
+		aligned = (aligned/stepDuration + 1) * stepDuration
+	}
+	return aligned
+}
+
 // newLabelsTripperware returns a Tripperware for labels and series requests
 // configured with middlewares of split by interval and retry.
 func newLabelsTripperware(
@@ -274,6 +336,7 @@ func newLabelsTripperware(
 	reg prometheus.Registerer,
 	logger log.Logger,
 	forwardHeaders []string,
+	cacheStats *CacheStats,
 ) (queryrange.Tripperware, error) {
 	labelsMiddleware := []queryrange.Middleware{}
 	m := queryrange.NewInstrumentMiddlewareMetrics(reg)
@@ -292,10 +355,14 @@ func newLabelsTripperware(
 
 	if config.ResultsCacheConfig != nil {
 		staticIntervalFn := func(_ queryrange.Request) time.Duration { return config.SplitQueriesByInterval }
+		cacheConfig, keyGenerator, err := cacheStats.instrument("labels", *config.ResultsCacheConfig, newRecentCacheKeyGenerator(staticIntervalFn, config.RecentCacheTTL), reg, logger)
+		if err != nil {
+			return nil, errors.Wrap(err, "create results cache")
+		}
 		queryCacheMiddleware, _, err := queryrange.NewResultsCacheMiddleware(
 			logger,
-			*config.ResultsCacheConfig,
-			newThanosCacheKeyGenerator(staticIntervalFn),
+			cacheConfig,
+			keyGenerator,
 			limits,
 			codec,
 			ThanosResponseExtractor{},
@@ -331,6 +398,7 @@ func newLabelsTripperware(
 
 func newInstantQueryTripperware(
 	numShards int,
+	splitInterval time.Duration,
 	limits queryrange.Limits,
 	codec queryrange.Codec,
 	reg prometheus.Registerer,
@@ -338,6 +406,20 @@ func newInstantQueryTripperware(
 ) queryrange.Tripperware {
 	instantQueryMiddlewares := []queryrange.Middleware{}
 	m := queryrange.NewInstrumentMiddlewareMetrics(reg)
+	if metricNameLimits, ok := limits.(MetricNameLimits); ok {
+		instantQueryMiddlewares = append(
+			instantQueryMiddlewares,
+			queryrange.InstrumentMiddleware("metric_name", m),
+			MetricNameMiddleware(metricNameLimits, reg),
+		)
+	}
+	if splitInterval > 0 {
+		instantQueryMiddlewares = append(
+			instantQueryMiddlewares,
+			queryrange.InstrumentMiddleware("split_by_interval", m),
+			SplitInstantQueryByIntervalMiddleware(splitInterval, limits, reg),
+		)
+	}
 	if numShards > 0 {
 		analyzer := querysharding.NewQueryAnalyzer()
 		instantQueryMiddlewares = append(
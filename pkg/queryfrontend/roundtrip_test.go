@@ -88,7 +88,7 @@ func TestRoundTripRetryMiddleware(t *testing.T) {
 		Matchers: [][]*labels.Matcher{{labels.MustNewMatcher(labels.MatchEqual, "foo", "bar")}},
 	}
 
-	queryRangeCodec := NewThanosQueryRangeCodec(true)
+	queryRangeCodec := NewThanosQueryRangeCodec(true, 0)
 	labelsCodec := NewThanosLabelsCodec(true, 2*time.Hour)
 
 	for _, tc := range []struct {
@@ -241,7 +241,7 @@ func TestRoundTripSplitIntervalMiddleware(t *testing.T) {
 		Matchers: [][]*labels.Matcher{{labels.MustNewMatcher(labels.MatchEqual, "foo", "bar")}},
 	}
 
-	queryRangeCodec := NewThanosQueryRangeCodec(true)
+	queryRangeCodec := NewThanosQueryRangeCodec(true, 0)
 	labelsCodec := NewThanosLabelsCodec(true, 2*time.Hour)
 
 	for _, tc := range []struct {
@@ -515,7 +515,7 @@ func TestRoundTripQueryRangeCacheMiddleware(t *testing.T) {
 	} {
 		if !t.Run(tc.name, func(t *testing.T) {
 			ctx := user.InjectOrgID(context.Background(), "1")
-			httpReq, err := NewThanosQueryRangeCodec(true).EncodeRequest(ctx, tc.req)
+			httpReq, err := NewThanosQueryRangeCodec(true, 0).EncodeRequest(ctx, tc.req)
 			testutil.Ok(t, err)
 
 			_, err = tpw(rt).RoundTrip(httpReq)
@@ -528,6 +528,84 @@ func TestRoundTripQueryRangeCacheMiddleware(t *testing.T) {
 	}
 }
 
+func TestRoundTripQueryRangeCacheBypass(t *testing.T) {
+	limits := *defaultLimits
+	teamALimits := limits
+	teamALimits.AllowCacheBypass = true
+
+	tpw, err := NewTripperware(
+		Config{
+			QueryRangeConfig: QueryRangeConfig{
+				Limits:       &limits,
+				TenantLimits: map[string]*cortexvalidation.Limits{"team-a": &teamALimits},
+				ResultsCacheConfig: &queryrange.ResultsCacheConfig{
+					CacheConfig: cortexcache.Config{
+						EnableFifoCache: true,
+						Fifocache: cortexcache.FifoCacheConfig{
+							MaxSizeBytes: "1MiB",
+							MaxSizeItems: 1000,
+							Validity:     time.Hour,
+						},
+					},
+				},
+				SplitQueriesByInterval: day,
+			},
+		}, nil, log.NewNopLogger(),
+	)
+	testutil.Ok(t, err)
+
+	rt, err := newFakeRoundTripper()
+	testutil.Ok(t, err)
+	defer rt.Close()
+	res, handler := promqlResults(false)
+	rt.setHandler(handler)
+
+	req := &ThanosQueryRangeRequest{
+		Path:  "/api/v1/query_range",
+		Start: 0,
+		End:   2 * hour,
+		Step:  10 * seconds,
+		Dedup: true,
+		Query: "foo",
+	}
+	for _, tc := range []struct {
+		name     string
+		tenant   string
+		param    string
+		header   string
+		expected int
+	}{
+		{name: "first request", tenant: "team-b", expected: 1},
+		{name: "tenant not allowed to bypass the cache", tenant: "team-b", param: "true", expected: 1},
+		{name: "first request of another tenant", tenant: "team-a", expected: 2},
+		{name: "same request served from the cache", tenant: "team-a", param: "false", expected: 2},
+		{name: "bypass the cache with the parameter", tenant: "team-a", param: "true", expected: 3},
+		{name: "bypass the cache with the header", tenant: "team-a", header: "no-cache", expected: 4},
+		{name: "fresh results were cached", tenant: "team-a", expected: 4},
+	} {
+		if !t.Run(tc.name, func(t *testing.T) {
+			ctx := user.InjectOrgID(context.Background(), tc.tenant)
+			httpReq, err := NewThanosQueryRangeCodec(true, 0).EncodeRequest(ctx, req)
+			testutil.Ok(t, err)
+			if tc.param != "" {
+				q := httpReq.URL.Query()
+				q.Set(NoCacheParam, tc.param)
+				httpReq.URL.RawQuery = q.Encode()
+			}
+			if tc.header != "" {
+				httpReq.Header.Set("Cache-Control", tc.header)
+			}
+
+			_, err = tpw(rt).RoundTrip(httpReq)
+			testutil.Ok(t, err)
+
+			testutil.Equals(t, tc.expected, *res)
+		}) {
+			break
+		}
+	}
+}
+
 func TestRoundTripQueryCacheWithShardingMiddleware(t *testing.T) {
 	testRequest := &ThanosQueryRangeRequest{
 		Path:    "/api/v1/query_range",
@@ -601,7 +679,7 @@ func TestRoundTripQueryCacheWithShardingMiddleware(t *testing.T) {
 	} {
 		if !t.Run(tc.name, func(t *testing.T) {
 			ctx := user.InjectOrgID(context.Background(), "1")
-			httpReq, err := NewThanosQueryRangeCodec(true).EncodeRequest(ctx, tc.req)
+			httpReq, err := NewThanosQueryRangeCodec(true, 0).EncodeRequest(ctx, tc.req)
 			testutil.Ok(t, err)
 
 			_, err = tpw(rt).RoundTrip(httpReq)
@@ -967,3 +1045,36 @@ func seriesResults(fail bool) (*int, http.Handler) {
 		count++
 	})
 }
+
+func TestDynamicIntervalFnAlignSplitsWithStep(t *testing.T) {
+	config := QueryRangeConfig{
+		MinQuerySplitInterval: time.Hour,
+		MaxQuerySplitInterval: day,
+		HorizontalShards:      4,
+		AlignSplitsWithStep:   true,
+	}
+	intervalFn := dynamicIntervalFn(config)
+	request := func(start, end, step int64) queryrange.Request {
+		return &ThanosQueryRangeRequest{Start: start, End: end, Step: step}
+	}
+
+	// Ranges of slightly different length, like consecutive dashboard refreshes, use the same interval.
+	testutil.Equals(t, 4*time.Hour, intervalFn(request(0, 12*hour, 60*seconds)))
+	testutil.Equals(t, 4*time.Hour, intervalFn(request(0, 12*hour+7*seconds, 60*seconds)))
+	testutil.Equals(t, 4*time.Hour, intervalFn(request(5*seconds, 12*hour, 60*seconds)))
+
+	// The interval is a multiple of the step.
+	testutil.Equals(t, 4*time.Hour+5*time.Minute, intervalFn(request(0, 12*hour, 7*60*seconds)))
+
+	testutil.Equals(t, 16*time.Hour, intervalFn(request(0, 40*hour, 60*seconds)))
+
+	// The interval never exceeds the maximum split interval.
+	capped := config
+	capped.MaxQuerySplitInterval = 6 * time.Hour
+	capped.HorizontalShards = 2
+	testutil.Equals(t, 6*time.Hour, dynamicIntervalFn(capped)(request(0, 11*hour, 60*seconds)))
+
+	// Without alignment, the interval follows the range.
+	config.AlignSplitsWithStep = false
+	testutil.Equals(t, 3*time.Hour+1750*time.Millisecond, dynamicIntervalFn(config)(request(0, 12*hour+7*seconds, 60*seconds)))
+}
@@ -79,7 +79,7 @@ func splitQuery(r queryrange.Request, interval time.Duration) ([]queryrange.Requ
 			return nil, err
 		}
 		if start := r.GetStart(); start == r.GetEnd() {
-			reqs = append(reqs, r.WithStartEnd(start, start))
+			reqs = append(reqs, r.WithQuery(query).WithStartEnd(start, start))
 		} else {
 			for ; start < r.GetEnd(); start = nextIntervalBoundary(start, r.GetStep(), interval) + r.GetStep() {
 				end := nextIntervalBoundary(start, r.GetStep(), interval)
@@ -4,15 +4,22 @@
 package queryfrontend
 
 import (
+	"context"
 	"encoding/json"
 	"strconv"
 	"testing"
 	"time"
 
+	"github.com/prometheus/common/model"
+	"github.com/prometheus/prometheus/model/timestamp"
+	"github.com/prometheus/prometheus/promql/promqltest"
 	"github.com/weaveworks/common/httpgrpc"
+	"github.com/weaveworks/common/user"
 
 	"github.com/stretchr/testify/require"
+	"github.com/thanos-io/thanos/internal/cortex/cortexpb"
 	"github.com/thanos-io/thanos/internal/cortex/querier/queryrange"
+	"github.com/thanos-io/thanos/internal/cortex/util/validation"
 )
 
 func TestSplitQuery(t *testing.T) {
@@ -258,3 +265,97 @@ func TestSplitQuery_PromQLErrorReturnsJson(t *testing.T) {
 
 	require.True(t, json.Valid(resp.Body), "error message is not valid JSON: %s", resp.Body)
 }
+
+// TestSplitQuery_SelectorsAcrossSplits checks that splitting does not change the results of queries
+// selecting series, since range queries evaluate topk, bottomk and sort at each step independently.
+func TestSplitQuery_SelectorsAcrossSplits(t *testing.T) {
+	// The ranking of the series changes over time, so that each split selects different series.
+	storage := promqltest.LoadedStorage(t, `
+load 1m
+  http_requests{job="api", instance="1", code="200"} 0+1x360
+  http_requests{job="api", instance="2", code="200"} 360-1x360
+  http_requests{job="api", instance="3", code="500"} 180+0x360
+  http_requests{job="db", instance="1", code="200"} 0+2x180 360-2x180
+  http_requests{job="db", instance="2", code="500"} 90+0x360
+`)
+	t.Cleanup(func() { require.NoError(t, storage.Close()) })
+	engine := promqltest.NewTestEngine(false, 0, promqltest.DefaultMaxSamplesPerQuery)
+
+	handler := queryrange.HandlerFunc(func(ctx context.Context, r queryrange.Request) (queryrange.Response, error) {
+		q, err := engine.NewRangeQuery(ctx, storage, nil, r.GetQuery(), timestamp.Time(r.GetStart()), timestamp.Time(r.GetEnd()), time.Duration(r.GetStep())*time.Millisecond)
+		if err != nil {
+			return nil, err
+		}
+		defer q.Close()
+
+		res := q.Exec(ctx)
+		if res.Err != nil {
+			return nil, res.Err
+		}
+		m, err := res.Matrix()
+		if err != nil {
+			return nil, err
+		}
+
+		streams := make([]*queryrange.SampleStream, 0, len(m))
+		for _, s := range m {
+			stream := &queryrange.SampleStream{Labels: cortexpb.LabelMapToCortexMetric(s.Metric.Map())}
+			for _, p := range s.Floats {
+				stream.Samples = append(stream.Samples, &cortexpb.Sample{Value: p.F, TimestampMs: p.T})
+			}
+			streams = append(streams, stream)
+		}
+		return &queryrange.PrometheusResponse{
+			Status: queryrange.StatusSuccess,
+			Data:   &queryrange.PrometheusData{ResultType: model.ValMatrix.String(), Result: streams},
+		}, nil
+	})
+
+	limits, err := validation.NewOverrides(*defaultLimits, nil)
+	require.NoError(t, err)
+	codec := NewThanosQueryRangeCodec(true, 0)
+	split := SplitByIntervalMiddleware(func(_ queryrange.Request) time.Duration { return time.Hour }, limits, codec, nil).Wrap(handler)
+	ctx := user.InjectOrgID(context.Background(), "1")
+
+	for _, query := range []string{
+		`topk(2, http_requests)`,
+		`bottomk(2, http_requests)`,
+		`topk by (job) (1, http_requests)`,
+		`sum by (job) (topk by (job) (2, http_requests))`,
+		`sum(bottomk(2, rate(http_requests[5m])))`,
+		`count(topk(3, http_requests) > 100)`,
+		`max by (code) (topk by (code) (1, http_requests) * on (job, instance, code) group_left bottomk(3, http_requests))`,
+		`sort(topk(2, http_requests))`,
+		`sort_desc(sum by (job) (http_requests))`,
+		`topk(1, http_requests @ end())`,
+	} {
+		t.Run(query, func(t *testing.T) {
+			req := &ThanosQueryRangeRequest{
+				Start: 0,
+				End:   6 * 3600 * seconds,
+				Step:  60 * seconds,
+				Query: query,
+			}
+
+			expected, err := handler.Do(ctx, req)
+			require.NoError(t, err)
+			got, err := split.Do(ctx, req)
+			require.NoError(t, err)
+
+			require.NotEmpty(t, matrixSamples(expected))
+			require.Equal(t, matrixSamples(expected), matrixSamples(got))
+		})
+	}
+}
+
+// matrixSamples returns the samples of a range query response by series.
+func matrixSamples(r queryrange.Response) map[string][]string {
+	res := map[string][]string{}
+	for _, s := range r.(*queryrange.PrometheusResponse).Data.Result {
+		metric := cortexpb.LabelPairToModelMetric(s.Labels).String()
+		for _, p := range s.Samples {
+			res[metric] = append(res[metric], strconv.FormatFloat(p.Value, 'g', -1, 64)+"@"+strconv.FormatInt(p.TimestampMs, 10))
+		}
+	}
+	return res
+}
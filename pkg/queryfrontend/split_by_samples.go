@@ -0,0 +1,145 @@
+// Copyright (c) The Thanos Authors.
+// Licensed under the Apache License 2.0.
+
+package queryfrontend
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/go-kit/log"
+	"github.com/go-kit/log/level"
+	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/common/model"
+	"github.com/prometheus/prometheus/promql/parser"
+
+	"github.com/thanos-io/thanos/internal/cortex/querier/queryrange"
+)
+
+const (
+	// samplesProbeWindow is the time range before the end of a query over which its samples are counted.
+	samplesProbeWindow = 5 * time.Minute
+	// minSamplesSplitInterval is the shortest interval queries are split by based on their samples.
+	minSamplesSplitInterval = 15 * time.Minute
+	// maxSamplesSplits is the maximum number of requests a query is split into based on its samples. The interval is
+	// raised above the estimation for longer queries, so that a dense query does not fan out to thousands of requests.
+	maxSamplesSplits = 64
+)
+
+// SplitBySamplesMiddleware creates a new Middleware that splits range queries so that each split request selects
+// about targetSamples samples. The number of samples is estimated with a probe query counting the samples of the
+// selectors of the query over the last minutes before its end. Queries are split by the given interval instead
+// if the probe fails or does not find any samples.
+func SplitBySamplesMiddleware(targetSamples int64, interval queryrange.IntervalFn, limits queryrange.Limits, merger queryrange.Merger, logger log.Logger, registerer prometheus.Registerer) queryrange.Middleware {
+	split := SplitByIntervalMiddleware(interval, limits, merger, registerer)
+	fallbacks := promauto.With(registerer).NewCounter(prometheus.CounterOpts{
+		Namespace: "thanos",
+		Name:      "frontend_split_samples_fallbacks_total",
+		Help:      "Total number of range queries split by time because their number of samples could not be estimated.",
+	})
+
+	return queryrange.MiddlewareFunc(func(next queryrange.Handler) queryrange.Handler {
+		s := split.Wrap(next).(splitByInterval)
+		e := &samplesEstimator{
+			next:          next,
+			targetSamples: targetSamples,
+			logger:        logger,
+		}
+		return samplesSplitter{splitByInterval: s, estimator: e, fallbacks: fallbacks}
+	})
+}
+
+type samplesSplitter struct {
+	splitByInterval
+
+	estimator *samplesEstimator
+	fallbacks prometheus.Counter
+}
+
+func (s samplesSplitter) Do(ctx context.Context, r queryrange.Request) (queryrange.Response, error) {
+	interval, err := s.estimator.interval(ctx, r)
+	if err != nil {
+		level.Debug(s.estimator.logger).Log("msg", "failed to estimate samples of query; splitting by time", "query", r.GetQuery(), "err", err)
+		s.fallbacks.Inc()
+		interval = s.splitByInterval.interval(r)
+	}
+
+	split := s.splitByInterval
+	split.interval = func(queryrange.Request) time.Duration { return interval }
+	return split.Do(ctx, r)
+}
+
+// samplesEstimator estimates the split interval of queries from the density of the samples they select.
+type samplesEstimator struct {
+	next          queryrange.Handler
+	targetSamples int64
+	logger        log.Logger
+}
+
+// interval returns the interval splitting the query in requests of about the target number of samples each.
+func (e *samplesEstimator) interval(ctx context.Context, r queryrange.Request) (time.Duration, error) {
+	probe, err := samplesProbeQuery(r.GetQuery())
+	if err != nil {
+		return 0, err
+	}
+
+	resp, err := e.next.Do(ctx, r.WithQuery(probe).WithStartEnd(r.GetEnd(), r.GetEnd()))
+	if err != nil {
+		return 0, errors.Wrap(err, "probe query")
+	}
+	promResp, ok := resp.(*queryrange.PrometheusResponse)
+	if !ok || promResp.Data == nil || len(promResp.Data.Result) == 0 || len(promResp.Data.Result[0].Samples) == 0 {
+		return 0, errors.New("empty probe query response")
+	}
+	samples := promResp.Data.Result[0].Samples[0].Value
+	if samples <= 0 {
+		return 0, errors.New("no samples found")
+	}
+
+	estimated := float64(e.targetSamples) / samples * float64(samplesProbeWindow)
+	return samplesSplitInterval(estimated, time.Duration(r.GetEnd()-r.GetStart())*time.Millisecond), nil
+}
+
+// samplesSplitInterval rounds the estimated interval down to minSamplesSplitInterval times a power of two,
+// so that queries with similar estimations are split at the same boundaries. It is raised until the query
+// is split into at most maxSamplesSplits requests, and stops growing once it covers the query range.
+func samplesSplitInterval(estimated float64, queryRange time.Duration) time.Duration {
+	interval := minSamplesSplitInterval
+	for interval < queryRange && (float64(interval*2) <= estimated || queryRange > maxSamplesSplits*interval) {
+		interval *= 2
+	}
+	return interval
+}
+
+// samplesProbeQuery returns a query counting the samples of all selectors of the query within samplesProbeWindow.
+func samplesProbeQuery(query string) (string, error) {
+	expr, err := parser.ParseExpr(query)
+	if err != nil {
+		return "", err
+	}
+
+	seen := map[string]struct{}{}
+	var counts []string
+	parser.Inspect(expr, func(node parser.Node, _ []parser.Node) error {
+		vs, ok := node.(*parser.VectorSelector)
+		if !ok {
+			return nil
+		}
+		// Offset and @ modifiers are dropped, only the density of samples matters.
+		sel := (&parser.VectorSelector{Name: vs.Name, LabelMatchers: vs.LabelMatchers}).String()
+		if _, ok := seen[sel]; ok {
+			return nil
+		}
+		seen[sel] = struct{}{}
+		counts = append(counts, fmt.Sprintf("(sum(count_over_time(%s[%s])) or vector(0))", sel, model.Duration(samplesProbeWindow)))
+		return nil
+	})
+	if len(counts) == 0 {
+		return "", errors.New("no selectors in query")
+	}
+	return strings.Join(counts, " + "), nil
+}
@@ -0,0 +1,161 @@
+// Copyright (c) The Thanos Authors.
+// Licensed under the Apache License 2.0.
+
+package queryfrontend
+
+import (
+	"context"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/efficientgo/core/testutil"
+	"github.com/go-kit/log"
+	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus"
+	promtest "github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/weaveworks/common/user"
+
+	"github.com/thanos-io/thanos/internal/cortex/cortexpb"
+	"github.com/thanos-io/thanos/internal/cortex/querier/queryrange"
+	"github.com/thanos-io/thanos/internal/cortex/util/validation"
+)
+
+func TestSamplesProbeQuery(t *testing.T) {
+	for _, tc := range []struct {
+		query    string
+		expected string
+		err      bool
+	}{
+		{
+			query:    `sum(rate(http_requests_total{job="api"}[5m]))`,
+			expected: `(sum(count_over_time(http_requests_total{job="api"}[5m])) or vector(0))`,
+		},
+		{
+			query:    `up offset 1h / up @ 100 + on() group_left() node_load1{instance=~"a.*"}`,
+			expected: `(sum(count_over_time(up[5m])) or vector(0)) + (sum(count_over_time(node_load1{instance=~"a.*"}[5m])) or vector(0))`,
+		},
+		{
+			query: `vector(1)`,
+			err:   true,
+		},
+		{
+			query: `sum(`,
+			err:   true,
+		},
+	} {
+		t.Run(tc.query, func(t *testing.T) {
+			probe, err := samplesProbeQuery(tc.query)
+			if tc.err {
+				testutil.NotOk(t, err)
+				return
+			}
+			testutil.Ok(t, err)
+			testutil.Equals(t, tc.expected, probe)
+		})
+	}
+}
+
+func TestSamplesSplitInterval(t *testing.T) {
+	for _, tc := range []struct {
+		estimated  time.Duration
+		queryRange time.Duration
+		expected   time.Duration
+	}{
+		{estimated: time.Minute, queryRange: 8 * time.Hour, expected: 15 * time.Minute},
+		{estimated: 50 * time.Minute, queryRange: 8 * time.Hour, expected: 30 * time.Minute},
+		// The interval is raised to split queries into at most 64 requests.
+		{estimated: time.Minute, queryRange: 24 * time.Hour, expected: 30 * time.Minute},
+		{estimated: time.Minute, queryRange: 30 * 24 * time.Hour, expected: 16 * time.Hour},
+		{estimated: 3 * time.Hour, queryRange: 24 * time.Hour, expected: 2 * time.Hour},
+		{estimated: 1000 * time.Hour, queryRange: 24 * time.Hour, expected: 32 * time.Hour},
+		{estimated: 1000 * time.Hour, queryRange: 5 * time.Minute, expected: 15 * time.Minute},
+	} {
+		testutil.Equals(t, tc.expected, samplesSplitInterval(float64(tc.estimated), tc.queryRange))
+	}
+}
+
+func TestSplitBySamplesMiddleware(t *testing.T) {
+	limits, err := validation.NewOverrides(*defaultLimits, nil)
+	testutil.Ok(t, err)
+	ctx := user.InjectOrgID(context.Background(), "1")
+
+	req := &ThanosQueryRangeRequest{
+		Start: 0,
+		End:   8 * 3600 * seconds,
+		Step:  60 * seconds,
+		Query: `sum(rate(http_requests_total[5m]))`,
+	}
+
+	for _, tc := range []struct {
+		name string
+		// probe returns the result of the probe query.
+		probe             func() (float64, error)
+		expectedRequests  int
+		expectedFallbacks float64
+	}{
+		{
+			// 6000 samples over 5m, the target of 72000 samples is selected over an hour.
+			name:             "dense query",
+			probe:            func() (float64, error) { return 6000, nil },
+			expectedRequests: 8,
+		},
+		{
+			name:             "sparse query",
+			probe:            func() (float64, error) { return 10, nil },
+			expectedRequests: 1,
+		},
+		{
+			name:              "failed probe",
+			probe:             func() (float64, error) { return 0, errors.New("unavailable") },
+			expectedRequests:  2,
+			expectedFallbacks: 1,
+		},
+		{
+			name:              "no samples",
+			probe:             func() (float64, error) { return 0, nil },
+			expectedRequests:  2,
+			expectedFallbacks: 1,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			var (
+				mtx  sync.Mutex
+				reqs []queryrange.Request
+			)
+			next := queryrange.HandlerFunc(func(_ context.Context, r queryrange.Request) (queryrange.Response, error) {
+				if strings.Contains(r.GetQuery(), "count_over_time") {
+					testutil.Equals(t, req.GetEnd(), r.GetStart())
+					testutil.Equals(t, req.GetEnd(), r.GetEnd())
+
+					v, err := tc.probe()
+					if err != nil {
+						return nil, err
+					}
+					return &queryrange.PrometheusResponse{
+						Status: queryrange.StatusSuccess,
+						Data: &queryrange.PrometheusData{
+							ResultType: "matrix",
+							Result:     []*queryrange.SampleStream{{Samples: []*cortexpb.Sample{{Value: v, TimestampMs: r.GetEnd()}}}},
+						},
+					}, nil
+				}
+
+				mtx.Lock()
+				reqs = append(reqs, r)
+				mtx.Unlock()
+				return queryrange.NewEmptyPrometheusResponse(), nil
+			})
+
+			reg := prometheus.NewRegistry()
+			fallbackInterval := func(queryrange.Request) time.Duration { return 6 * time.Hour }
+			h := SplitBySamplesMiddleware(72000, fallbackInterval, limits, NewThanosQueryRangeCodec(true, 0), log.NewNopLogger(), reg).Wrap(next)
+
+			_, err := h.Do(ctx, req)
+			testutil.Ok(t, err)
+			testutil.Equals(t, tc.expectedRequests, len(reqs))
+			testutil.Equals(t, tc.expectedFallbacks, promtest.ToFloat64(h.(samplesSplitter).fallbacks))
+		})
+	}
+}
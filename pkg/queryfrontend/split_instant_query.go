@@ -0,0 +1,219 @@
+// Copyright (c) The Thanos Authors.
+// Licensed under the Apache License 2.0.
+
+package queryfrontend
+
+import (
+	"context"
+	"math"
+	"sort"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/common/model"
+	"github.com/prometheus/prometheus/promql/parser"
+
+	"github.com/thanos-io/thanos/internal/cortex/cortexpb"
+	"github.com/thanos-io/thanos/internal/cortex/querier/queryrange"
+	"github.com/thanos-io/thanos/pkg/extpromql"
+)
+
+// overTimeCombiners combine the results of the functions aggregating over time evaluated over adjacent ranges into
+// their result over the whole range.
+var overTimeCombiners = map[string]func(a, b float64) float64{
+	"sum_over_time":   func(a, b float64) float64 { return a + b },
+	"count_over_time": func(a, b float64) float64 { return a + b },
+	"max_over_time": func(a, b float64) float64 {
+		if b > a || math.IsNaN(a) {
+			return b
+		}
+		return a
+	},
+	"min_over_time": func(a, b float64) float64 {
+		if b < a || math.IsNaN(a) {
+			return b
+		}
+		return a
+	},
+}
+
+// SplitInstantQueryByIntervalMiddleware creates a new Middleware that splits instant queries aggregating a range
+// selector or a subquery longer than the interval with sum_over_time, count_over_time, max_over_time or
+// min_over_time into queries over adjacent ranges of at most the interval, and combines their results.
+// Other queries are passed through.
+func SplitInstantQueryByIntervalMiddleware(interval time.Duration, limits queryrange.Limits, registerer prometheus.Registerer) queryrange.Middleware {
+	return queryrange.MiddlewareFunc(func(next queryrange.Handler) queryrange.Handler {
+		queriesTotal := promauto.With(registerer).NewCounterVec(prometheus.CounterOpts{
+			Namespace: "thanos",
+			Name:      "frontend_split_instant_queries_total",
+			Help:      "Total number of instant queries analyzed by the instant query splitting middleware",
+		}, []string{"split"})
+
+		queriesTotal.WithLabelValues("true")
+		queriesTotal.WithLabelValues("false")
+
+		return instantQuerySplitter{
+			next:         next,
+			limits:       limits,
+			interval:     interval,
+			queriesTotal: queriesTotal,
+		}
+	})
+}
+
+type instantQuerySplitter struct {
+	next     queryrange.Handler
+	limits   queryrange.Limits
+	interval time.Duration
+
+	// Metrics
+	queriesTotal *prometheus.CounterVec
+}
+
+func (s instantQuerySplitter) Do(ctx context.Context, r queryrange.Request) (queryrange.Response, error) {
+	combine, queries, ok := s.splitQuery(r.GetQuery())
+	if !ok {
+		s.queriesTotal.WithLabelValues("false").Inc()
+		return s.next.Do(ctx, r)
+	}
+
+	s.queriesTotal.WithLabelValues("true").Inc()
+	reqs := make([]queryrange.Request, 0, len(queries))
+	for _, q := range queries {
+		reqs = append(reqs, r.WithQuery(q))
+	}
+
+	reqResps, err := queryrange.DoRequests(ctx, s.next, reqs, s.limits)
+	if err != nil {
+		return nil, err
+	}
+
+	resps := make([]queryrange.Response, 0, len(reqResps))
+	for _, reqResp := range reqResps {
+		resps = append(resps, reqResp.Response)
+	}
+
+	response, ok := combineSplitInstantQueryResponses(combine, resps)
+	if !ok {
+		// Native histograms are not combined, evaluate the query over the whole range instead.
+		return s.next.Do(ctx, r)
+	}
+	return response, nil
+}
+
+// splitQuery returns the queries evaluating the aggregation over time of the query over adjacent ranges of at most
+// the split interval, covering the range of the query, and the function combining their results. It returns false
+// if the query cannot be split.
+func (s instantQuerySplitter) splitQuery(query string) (func(a, b float64) float64, []string, bool) {
+	expr, err := extpromql.ParseExpr(query)
+	if err != nil {
+		return nil, nil, false
+	}
+	call, ok := expr.(*parser.Call)
+	if !ok || len(call.Args) != 1 {
+		return nil, nil, false
+	}
+	combine, ok := overTimeCombiners[call.Func.Name]
+	if !ok {
+		return nil, nil, false
+	}
+
+	// The range and the offset of the argument are modified in place to generate the split queries.
+	var rng, offset *time.Duration
+	switch arg := call.Args[0].(type) {
+	case *parser.MatrixSelector:
+		vs, ok := arg.VectorSelector.(*parser.VectorSelector)
+		if !ok {
+			return nil, nil, false
+		}
+		rng, offset = &arg.Range, &vs.OriginalOffset
+	case *parser.SubqueryExpr:
+		rng, offset = &arg.Range, &arg.OriginalOffset
+	default:
+		return nil, nil, false
+	}
+	total, originalOffset := *rng, *offset
+	if total <= s.interval {
+		return nil, nil, false
+	}
+
+	// Range selectors and subqueries select the samples at both ends of their range, so all ranges but the most
+	// recent one end 1ms before the start of the next one to not select the same samples twice.
+	var queries []string
+	for i := 0; ; i++ {
+		start := time.Duration(i) * s.interval
+		if i > 0 {
+			start += time.Millisecond
+		}
+		end := time.Duration(i+1) * s.interval
+		last := total-end < 2*time.Millisecond
+		if last {
+			end = total
+		}
+		*rng = end - start
+		*offset = originalOffset + start
+		queries = append(queries, expr.String())
+		if last {
+			return combine, queries, true
+		}
+	}
+}
+
+// combineSplitInstantQueryResponses combines the vectors of the responses of split queries by series, and merges their
+// warnings. It returns false if the responses contain native histograms or are not vectors.
+func combineSplitInstantQueryResponses(combine func(a, b float64) float64, resps []queryrange.Response) (queryrange.Response, bool) {
+	var (
+		output   = map[string]*queryrange.Sample{}
+		warnings []string
+		seen     = map[string]struct{}{}
+	)
+	for _, resp := range resps {
+		promResp, ok := resp.(*queryrange.PrometheusInstantQueryResponse)
+		if !ok || promResp.GetData().GetResultType() != model.ValVector.String() {
+			return nil, false
+		}
+		for _, w := range promResp.Warnings {
+			if _, ok := seen[w]; ok {
+				continue
+			}
+			seen[w] = struct{}{}
+			warnings = append(warnings, w)
+		}
+		for _, s := range promResp.GetData().GetResult().GetVector().GetSamples() {
+			if s.Histogram != nil {
+				return nil, false
+			}
+			metric := cortexpb.LabelPairToModelMetric(s.Labels).String()
+			if existing, ok := output[metric]; ok {
+				existing.SampleValue = combine(existing.SampleValue, s.SampleValue)
+				continue
+			}
+			output[metric] = &queryrange.Sample{Labels: s.Labels, SampleValue: s.SampleValue, Timestamp: s.Timestamp}
+		}
+	}
+
+	metrics := make([]string, 0, len(output))
+	for metric := range output {
+		metrics = append(metrics, metric)
+	}
+	sort.Strings(metrics)
+	vector := &queryrange.Vector{Samples: make([]*queryrange.Sample, 0, len(output))}
+	for _, metric := range metrics {
+		vector.Samples = append(vector.Samples, output[metric])
+	}
+
+	return &queryrange.PrometheusInstantQueryResponse{
+		Status: queryrange.StatusSuccess,
+		Data: &queryrange.PrometheusInstantQueryData{
+			ResultType: model.ValVector.String(),
+			Result: &queryrange.PrometheusInstantQueryResult{
+				Result: &queryrange.PrometheusInstantQueryResult_Vector{
+					Vector: vector,
+				},
+			},
+			Stats: queryrange.StatsMerge(resps),
+		},
+		Warnings: warnings,
+	}, true
+}
@@ -0,0 +1,172 @@
+// Copyright (c) The Thanos Authors.
+// Licensed under the Apache License 2.0.
+
+package queryfrontend
+
+import (
+	"context"
+	"math"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/efficientgo/core/testutil"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/prometheus/promql"
+	"github.com/prometheus/prometheus/promql/promqltest"
+	"github.com/weaveworks/common/user"
+	"go.uber.org/atomic"
+
+	"github.com/thanos-io/thanos/internal/cortex/cortexpb"
+	"github.com/thanos-io/thanos/internal/cortex/querier/queryrange"
+	"github.com/thanos-io/thanos/internal/cortex/util/validation"
+)
+
+func TestSplitInstantQueryByIntervalMiddleware(t *testing.T) {
+	// Samples every 15s, so that the ranges of the split queries start and end on samples.
+	storage := promqltest.LoadedStorage(t, `
+load 15s
+  foo{job="a"} 0+1x2000
+  foo{job="b"} 5-2x500 NaN 3+7x500 _x500 -10+0.5x500
+  foo{job="c"} _x1500 1+1x500
+`)
+	t.Cleanup(func() { testutil.Ok(t, storage.Close()) })
+	engine := promql.NewEngine(promql.EngineOpts{MaxSamples: 1e6, Timeout: time.Minute, EnableAtModifier: true, EnableNegativeOffset: true})
+
+	var requests atomic.Int64
+	evaluate := queryrange.HandlerFunc(func(ctx context.Context, r queryrange.Request) (queryrange.Response, error) {
+		requests.Inc()
+		req := r.(*ThanosQueryInstantRequest)
+		qry, err := engine.NewInstantQuery(ctx, storage, nil, req.Query, time.UnixMilli(req.Time))
+		if err != nil {
+			return nil, err
+		}
+		defer qry.Close()
+		res := qry.Exec(ctx)
+		if res.Err != nil {
+			return nil, res.Err
+		}
+		vector, err := res.Vector()
+		if err != nil {
+			return nil, err
+		}
+		samples := make([]*queryrange.Sample, 0, len(vector))
+		for _, s := range vector {
+			samples = append(samples, &queryrange.Sample{Labels: cortexpb.LabelMapToCortexMetric(s.Metric.Map()), SampleValue: s.F, Timestamp: s.T})
+		}
+		return &queryrange.PrometheusInstantQueryResponse{
+			Status: queryrange.StatusSuccess,
+			Data: &queryrange.PrometheusInstantQueryData{
+				ResultType: "vector",
+				Result: &queryrange.PrometheusInstantQueryResult{
+					Result: &queryrange.PrometheusInstantQueryResult_Vector{Vector: &queryrange.Vector{Samples: samples}},
+				},
+			},
+		}, nil
+	})
+
+	limits, err := validation.NewOverrides(*defaultLimits, nil)
+	testutil.Ok(t, err)
+	split := SplitInstantQueryByIntervalMiddleware(time.Hour, limits, prometheus.NewRegistry()).Wrap(evaluate)
+	ctx := user.InjectOrgID(context.Background(), "1")
+
+	for _, tc := range []struct {
+		query    string
+		requests int64
+	}{
+		{query: `sum_over_time(foo[6h])`, requests: 6},
+		{query: `count_over_time(foo[5h30m])`, requests: 6},
+		{query: `max_over_time(foo[7h] offset 10m)`, requests: 7},
+		{query: `min_over_time(foo{job="b"}[150m])`, requests: 3},
+		{query: `max_over_time(rate(foo[5m])[6h:1m])`, requests: 6},
+		{query: `sum_over_time(foo[8h] @ 20000)`, requests: 8},
+		// Not split.
+		{query: `sum_over_time(foo[1h])`, requests: 1},
+		{query: `rate(foo[6h])`, requests: 1},
+		{query: `quantile_over_time(0.5, foo[6h])`, requests: 1},
+		{query: `sum(sum_over_time(foo[6h]))`, requests: 1},
+		{query: `sum_over_time(foo[6h]) > 10`, requests: 1},
+	} {
+		t.Run(tc.query, func(t *testing.T) {
+			req := &ThanosQueryInstantRequest{Query: tc.query, Time: (30000 * time.Second).Milliseconds()}
+
+			expected, err := evaluate.Do(ctx, req)
+			testutil.Ok(t, err)
+			requests.Store(0)
+			res, err := split.Do(ctx, req)
+			testutil.Ok(t, err)
+			testutil.Equals(t, tc.requests, requests.Load())
+
+			expectedSamples := expected.(*queryrange.PrometheusInstantQueryResponse).Data.Result.GetVector().Samples
+			samples := res.(*queryrange.PrometheusInstantQueryResponse).Data.Result.GetVector().Samples
+			testutil.Assert(t, len(expectedSamples) > 0)
+			// The results of split queries are ordered by labels, those of queries which are not split are not.
+			for _, samples := range [][]*queryrange.Sample{expectedSamples, samples} {
+				sort.Slice(samples, func(i, j int) bool {
+					return cortexpb.LabelPairToModelMetric(samples[i].Labels).String() < cortexpb.LabelPairToModelMetric(samples[j].Labels).String()
+				})
+			}
+			testutil.Equals(t, len(expectedSamples), len(samples))
+			for i := range expectedSamples {
+				testutil.Equals(t, expectedSamples[i].Labels, samples[i].Labels)
+				testutil.Equals(t, expectedSamples[i].Timestamp, samples[i].Timestamp)
+				if math.IsNaN(expectedSamples[i].SampleValue) {
+					testutil.Assert(t, math.IsNaN(samples[i].SampleValue))
+					continue
+				}
+				testutil.Equals(t, expectedSamples[i].SampleValue, samples[i].SampleValue)
+			}
+		})
+	}
+}
+
+func TestSplitInstantQuery(t *testing.T) {
+	s := instantQuerySplitter{interval: time.Hour}
+
+	_, queries, ok := s.splitQuery(`max_over_time(foo[150m] offset -5m)`)
+	testutil.Assert(t, ok)
+	testutil.Equals(t, []string{
+		`max_over_time(foo[1h] offset -5m)`,
+		`max_over_time(foo[59m59s999ms] offset 55m1ms)`,
+		`max_over_time(foo[29m59s999ms] offset 1h55m1ms)`,
+	}, queries)
+
+	_, queries, ok = s.splitQuery(`sum_over_time(rate(foo[5m])[2h:1m])`)
+	testutil.Assert(t, ok)
+	testutil.Equals(t, []string{
+		`sum_over_time(rate(foo[5m])[1h:1m])`,
+		`sum_over_time(rate(foo[5m])[59m59s999ms:1m] offset 1h1ms)`,
+	}, queries)
+}
+
+func TestCombineSplitInstantQueryResponses_Warnings(t *testing.T) {
+	response := func(value float64, warnings ...string) queryrange.Response {
+		return &queryrange.PrometheusInstantQueryResponse{
+			Status: queryrange.StatusSuccess,
+			Data: &queryrange.PrometheusInstantQueryData{
+				ResultType: "vector",
+				Result: &queryrange.PrometheusInstantQueryResult{
+					Result: &queryrange.PrometheusInstantQueryResult_Vector{Vector: &queryrange.Vector{Samples: []*queryrange.Sample{
+						{Labels: cortexpb.LabelMapToCortexMetric(map[string]string{"job": "a"}), SampleValue: value, Timestamp: 1},
+					}}},
+				},
+			},
+			Warnings: warnings,
+		}
+	}
+
+	res, ok := combineSplitInstantQueryResponses(func(a, b float64) float64 { return a + b }, []queryrange.Response{
+		response(1, "partial response", "store a unavailable"),
+		response(2),
+		response(3, "store a unavailable", "store b unavailable"),
+	})
+	testutil.Assert(t, ok)
+	promRes := res.(*queryrange.PrometheusInstantQueryResponse)
+	testutil.Equals(t, []string{"partial response", "store a unavailable", "store b unavailable"}, promRes.Warnings)
+	testutil.Equals(t, 6.0, promRes.Data.Result.GetVector().Samples[0].SampleValue)
+
+	// Responses without warnings are combined without any.
+	res, ok = combineSplitInstantQueryResponses(func(a, b float64) float64 { return a + b }, []queryrange.Response{response(1), response(2)})
+	testutil.Assert(t, ok)
+	testutil.Equals(t, 0, len(res.(*queryrange.PrometheusInstantQueryResponse).Warnings))
+}
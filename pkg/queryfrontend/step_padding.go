@@ -0,0 +1,138 @@
+// Copyright (c) The Thanos Authors.
+// Licensed under the Apache License 2.0.
+
+package queryfrontend
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+
+	"github.com/prometheus/common/model"
+
+	"github.com/thanos-io/thanos/internal/cortex/cortexpb"
+	"github.com/thanos-io/thanos/internal/cortex/querier/queryrange"
+)
+
+// PadStepsParam is the range query parameter requesting a value, or null, at every step of every series.
+const PadStepsParam = "pad_steps"
+
+// StepPaddingMiddleware marks the matrix responses of range queries with PadSteps set to be padded by the codec,
+// so that each float series has a point at every step from the start to the end of the request. Steps without a
+// value are encoded as null. Responses are padded only when encoded, so cached results are never padded.
+func StepPaddingMiddleware() queryrange.Middleware {
+	return queryrange.MiddlewareFunc(func(next queryrange.Handler) queryrange.Handler {
+		return queryrange.HandlerFunc(func(ctx context.Context, r queryrange.Request) (queryrange.Response, error) {
+			res, err := next.Do(ctx, r)
+			req, ok := r.(*ThanosQueryRangeRequest)
+			if err != nil || !ok || !req.PadSteps {
+				return res, err
+			}
+			pr, ok := res.(*queryrange.PrometheusResponse)
+			if !ok || pr.Data == nil || pr.Data.ResultType != model.ValMatrix.String() {
+				return res, nil
+			}
+			return &paddedResponse{PrometheusResponse: pr, start: req.Start, end: req.End, step: req.Step}, nil
+		})
+	})
+}
+
+// paddedResponse is a range query response to pad when encoding it.
+type paddedResponse struct {
+	*queryrange.PrometheusResponse
+	start, end, step int64
+}
+
+// jsonResponse returns the response to encode, with the same fields as the encoded PrometheusResponse.
+func (r *paddedResponse) jsonResponse() interface{} {
+	series := make([]paddedSeries, 0, len(r.Data.Result))
+	for _, s := range r.Data.Result {
+		series = append(series, paddedSeries{SampleStream: s, start: r.start, end: r.end, step: r.step})
+	}
+
+	type data struct {
+		ResultType string                              `json:"resultType"`
+		Result     []paddedSeries                      `json:"result"`
+		Stats      *queryrange.PrometheusResponseStats `json:"stats,omitempty"`
+		Analysis   *queryrange.Analysis                `json:"analysis"`
+	}
+	return &struct {
+		Status    string   `json:"status"`
+		Data      *data    `json:"data,omitempty"`
+		ErrorType string   `json:"errorType,omitempty"`
+		Error     string   `json:"error,omitempty"`
+		Warnings  []string `json:"warnings,omitempty"`
+	}{
+		Status:    r.Status,
+		Data:      &data{ResultType: r.Data.ResultType, Result: series, Stats: r.Data.Stats, Analysis: r.Data.Analysis},
+		ErrorType: r.ErrorType,
+		Error:     r.Error,
+		Warnings:  r.Warnings,
+	}
+}
+
+// paddedSeries is a series encoded with a point at every step from start to end.
+type paddedSeries struct {
+	*queryrange.SampleStream
+	start, end, step int64
+}
+
+// MarshalJSON encodes the series like SampleStream, adding a null point at every step without a sample. Samples are
+// never modified, so NaN values returned by the query stay "NaN" and are not confused with missing steps. Series with
+// native histograms are not padded.
+func (s paddedSeries) MarshalJSON() ([]byte, error) {
+	if len(s.Histograms) > 0 || s.step <= 0 {
+		return s.SampleStream.MarshalJSON()
+	}
+
+	var b bytes.Buffer
+	metric, err := json.Marshal(cortexpb.LabelPairToModelMetric(s.Labels))
+	if err != nil {
+		return nil, err
+	}
+	b.WriteString(`{"metric":`)
+	b.Write(metric)
+	b.WriteString(`,"values":[`)
+
+	first := true
+	point := func(p []byte) {
+		if !first {
+			b.WriteByte(',')
+		}
+		first = false
+		b.Write(p)
+	}
+	sample := func(smpl *cortexpb.Sample) error {
+		p, err := model.SamplePair{Timestamp: model.Time(smpl.TimestampMs), Value: model.SampleValue(smpl.Value)}.MarshalJSON()
+		if err != nil {
+			return err
+		}
+		point(p)
+		return nil
+	}
+
+	i := 0
+	for t := s.start; t <= s.end; t += s.step {
+		// Samples off the steps, e.g. of requests not aligned by the queriers, are kept as is.
+		for ; i < len(s.Samples) && s.Samples[i].TimestampMs < t; i++ {
+			if err := sample(s.Samples[i]); err != nil {
+				return nil, err
+			}
+		}
+		if i < len(s.Samples) && s.Samples[i].TimestampMs == t {
+			if err := sample(s.Samples[i]); err != nil {
+				return nil, err
+			}
+			i++
+			continue
+		}
+		point([]byte("[" + model.Time(t).String() + ",null]"))
+	}
+	for ; i < len(s.Samples); i++ {
+		if err := sample(s.Samples[i]); err != nil {
+			return nil, err
+		}
+	}
+	b.WriteString("]}")
+	return b.Bytes(), nil
+}
@@ -0,0 +1,105 @@
+// Copyright (c) The Thanos Authors.
+// Licensed under the Apache License 2.0.
+
+package queryfrontend
+
+import (
+	"context"
+	"io"
+	"math"
+	"net/http"
+	"testing"
+
+	"github.com/efficientgo/core/testutil"
+	"github.com/weaveworks/common/httpgrpc"
+
+	"github.com/thanos-io/thanos/internal/cortex/cortexpb"
+	"github.com/thanos-io/thanos/internal/cortex/querier/queryrange"
+)
+
+func TestStepPaddingMiddleware(t *testing.T) {
+	ctx := context.Background()
+	resp := &queryrange.PrometheusResponse{
+		Status: queryrange.StatusSuccess,
+		Data: &queryrange.PrometheusData{
+			ResultType: "matrix",
+			Result: []*queryrange.SampleStream{
+				{
+					Labels:  []*cortexpb.LabelPair{{Name: []byte("series"), Value: []byte("sparse")}},
+					Samples: []*cortexpb.Sample{{TimestampMs: 15000, Value: 1}, {TimestampMs: 45000, Value: math.NaN()}},
+				},
+				{
+					Labels:  []*cortexpb.LabelPair{{Name: []byte("series"), Value: []byte("empty")}},
+					Samples: []*cortexpb.Sample{},
+				},
+			},
+		},
+	}
+	next := queryrange.HandlerFunc(func(context.Context, queryrange.Request) (queryrange.Response, error) {
+		return resp, nil
+	})
+	handler := StepPaddingMiddleware().Wrap(next)
+	codec := NewThanosQueryRangeCodec(true, 0)
+
+	encode := func(t *testing.T, codec *queryRangeCodec, req *ThanosQueryRangeRequest) string {
+		res, err := handler.Do(ctx, req)
+		testutil.Ok(t, err)
+		r, err := codec.EncodeResponse(ctx, res)
+		testutil.Ok(t, err)
+		body, err := io.ReadAll(r.Body)
+		testutil.Ok(t, err)
+		testutil.Equals(t, int64(len(body)), r.ContentLength)
+		return string(body)
+	}
+
+	t.Run("padding disabled", func(t *testing.T) {
+		expected, err := queryrange.PrometheusCodec.EncodeResponse(ctx, resp)
+		testutil.Ok(t, err)
+		expectedBody, err := io.ReadAll(expected.Body)
+		testutil.Ok(t, err)
+
+		testutil.Equals(t, string(expectedBody), encode(t, codec, &ThanosQueryRangeRequest{Start: 0, End: 60000, Step: 15000}))
+	})
+	t.Run("padding enabled", func(t *testing.T) {
+		req := &ThanosQueryRangeRequest{Start: 0, End: 60000, Step: 15000, PadSteps: true}
+		// Missing steps are null, while NaN values returned by the query are kept.
+		expected := `{"status":"success","data":{"resultType":"matrix","result":[` +
+			`{"metric":{"series":"sparse"},"values":[[0,null],[15,"1"],[30,null],[45,"NaN"],[60,null]]},` +
+			`{"metric":{"series":"empty"},"values":[[0,null],[15,null],[30,null],[45,null],[60,null]]}` +
+			`],"analysis":null}}`
+		testutil.Equals(t, expected, encode(t, codec, req))
+
+		// Padding counts towards the response size limit.
+		testutil.Equals(t, expected, encode(t, NewThanosQueryRangeCodec(true, int64(len(expected))), req))
+		res, err := handler.Do(ctx, req)
+		testutil.Ok(t, err)
+		_, err = NewThanosQueryRangeCodec(true, int64(len(expected))-1).EncodeResponse(ctx, res)
+		httpResp, ok := httpgrpc.HTTPResponseFromError(err)
+		testutil.Assert(t, ok)
+		testutil.Equals(t, int32(http.StatusRequestEntityTooLarge), httpResp.Code)
+	})
+}
+
+func TestQueryRangeCodec_DecodePadSteps(t *testing.T) {
+	codec := NewThanosQueryRangeCodec(true, 0)
+	for _, c := range []struct {
+		param    string
+		expected bool
+		err      bool
+	}{
+		{param: "", expected: false},
+		{param: "true", expected: true},
+		{param: "false", expected: false},
+		{param: "maybe", err: true},
+	} {
+		r, err := http.NewRequest(http.MethodGet, "/api/v1/query_range?start=0&end=60&step=15&query=up&pad_steps="+c.param, nil)
+		testutil.Ok(t, err)
+		req, err := codec.DecodeRequest(context.Background(), r, nil)
+		if c.err {
+			testutil.NotOk(t, err)
+			continue
+		}
+		testutil.Ok(t, err)
+		testutil.Equals(t, c.expected, req.(*ThanosQueryRangeRequest).PadSteps)
+	}
+}
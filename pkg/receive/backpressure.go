@@ -0,0 +1,145 @@
+// Copyright (c) The Thanos Authors.
+// Licensed under the Apache License 2.0.
+
+package receive
+
+import (
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"go.uber.org/atomic"
+)
+
+const (
+	// BackpressureHeader is set on the responses of write requests while the receiver is under pressure, to the
+	// cause of the pressure, either "write-queue" or "compaction-lag".
+	BackpressureHeader = "THANOS-BACKPRESSURE"
+	// BackpressureDelayHeader is set along with BackpressureHeader to the delay, in seconds, clients are advised
+	// to wait before sending their next request.
+	BackpressureDelayHeader = "THANOS-BACKPRESSURE-DELAY"
+
+	backpressureCauseWriteQueue    = "write-queue"
+	backpressureCauseCompactionLag = "compaction-lag"
+
+	// compactionLagRefreshInterval is how long the compaction lag is reused before being computed again.
+	compactionLagRefreshInterval = time.Second
+)
+
+// HeadCompactionLagSource reports how far behind the compaction of the heads of local TSDBs is.
+type HeadCompactionLagSource interface {
+	// HeadCompactionLag returns the range of data held by the most lagging head beyond the point it should have
+	// been compacted at, relative to the block duration.
+	HeadCompactionLag() float64
+}
+
+// BackpressureOptions configures the hints advising clients to slow down while the write path is under pressure.
+// Hints are purely advisory, clients are free to ignore them.
+type BackpressureOptions struct {
+	// MaxDelay is the delay advised to clients at full pressure. Advised delays are proportional to the pressure.
+	MaxDelay time.Duration
+	// Threshold is the pressure, between 0 and 1, from which hints are added to responses.
+	Threshold float64
+	// CompactionLag reports the compaction lag of the local TSDBs. Leave nil if the receiver does not ingest.
+	CompactionLag HeadCompactionLagSource
+}
+
+// backpressure estimates the pressure on the write path from the number of write requests queued behind the write
+// concurrency limit and from the compaction lag of the local TSDBs, each normalized between 0 and 1.
+type backpressure struct {
+	opts BackpressureOptions
+
+	// pending is the number of write requests being handled, including the ones waiting for the write gate.
+	pending atomic.Int64
+
+	mtx              sync.Mutex
+	lag              float64
+	lagComputedUntil time.Time
+
+	pressure prometheus.Gauge
+	hints    *prometheus.CounterVec
+}
+
+func newBackpressure(reg prometheus.Registerer, opts BackpressureOptions) *backpressure {
+	b := &backpressure{
+		opts: opts,
+		pressure: promauto.With(reg).NewGauge(prometheus.GaugeOpts{
+			Name: "thanos_receive_backpressure",
+			Help: "Pressure on the write path between 0 and 1, as estimated for the last write request.",
+		}),
+		hints: promauto.With(reg).NewCounterVec(prometheus.CounterOpts{
+			Name: "thanos_receive_backpressure_hints_total",
+			Help: "Number of write responses advising clients to slow down, by cause of the pressure.",
+		}, []string{"cause"}),
+	}
+	b.hints.WithLabelValues(backpressureCauseWriteQueue)
+	b.hints.WithLabelValues(backpressureCauseCompactionLag)
+	return b
+}
+
+// compactionLag returns the compaction lag, computed at most once per refresh interval as it iterates all tenants.
+func (b *backpressure) compactionLag() float64 {
+	if b.opts.CompactionLag == nil {
+		return 0
+	}
+	b.mtx.Lock()
+	defer b.mtx.Unlock()
+
+	if now := time.Now(); now.After(b.lagComputedUntil) {
+		b.lag = b.opts.CompactionLag.HeadCompactionLag()
+		b.lagComputedUntil = now.Add(compactionLagRefreshInterval)
+	}
+	return b.lag
+}
+
+// setHeaders adds the backpressure hints to the response if the pressure is above the threshold. maxConcurrency
+// is the write concurrency limit, 0 if there is none.
+func (b *backpressure) setHeaders(w http.ResponseWriter, maxConcurrency int) {
+	cause, pressure := backpressureCauseCompactionLag, min(b.compactionLag(), 1)
+	if maxConcurrency > 0 {
+		// A queue as long as the concurrency limit is full pressure.
+		queued := float64(b.pending.Load()-int64(maxConcurrency)) / float64(maxConcurrency)
+		if queued = min(max(queued, 0), 1); queued > pressure {
+			cause, pressure = backpressureCauseWriteQueue, queued
+		}
+	}
+	b.pressure.Set(pressure)
+	if pressure == 0 || pressure < b.opts.Threshold {
+		return
+	}
+
+	b.hints.WithLabelValues(cause).Inc()
+	delay := time.Duration(pressure * float64(b.opts.MaxDelay))
+	w.Header().Set(BackpressureHeader, cause)
+	w.Header().Set(BackpressureDelayHeader, strconv.FormatFloat(delay.Seconds(), 'f', -1, 64))
+}
+
+// HeadCompactionLag returns the range of data held by the most lagging head of the tenants beyond the point it should
+// have been compacted at, relative to the block duration. Heads are compacted once they hold 1.5 times the block
+// duration, so a lag of 1 means that a whole block is waiting to be compacted.
+func (t *MultiTSDB) HeadCompactionLag() float64 {
+	t.mtx.RLock()
+	defer t.mtx.RUnlock()
+
+	blockDuration := float64(t.tsdbOpts.MinBlockDuration)
+	if blockDuration <= 0 {
+		return 0
+	}
+	var lag float64
+	for _, tenant := range t.tenants {
+		db := tenant.readyS.Get()
+		if db == nil {
+			continue
+		}
+		head := db.Head()
+		if head.MaxTime() < head.MinTime() {
+			// The head is empty.
+			continue
+		}
+		lag = max(lag, (float64(head.MaxTime()-head.MinTime())-1.5*blockDuration)/blockDuration)
+	}
+	return lag
+}
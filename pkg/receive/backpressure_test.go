@@ -0,0 +1,118 @@
+// Copyright (c) The Thanos Authors.
+// Licensed under the Apache License 2.0.
+
+package receive
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/efficientgo/core/testutil"
+	"github.com/go-kit/log"
+	"github.com/prometheus/client_golang/prometheus"
+	promtestutil "github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/prometheus/prometheus/model/labels"
+	"github.com/prometheus/prometheus/tsdb"
+
+	"github.com/thanos-io/thanos/pkg/block/metadata"
+	"github.com/thanos-io/thanos/pkg/store/labelpb"
+	"github.com/thanos-io/thanos/pkg/store/storepb/prompb"
+)
+
+type fakeCompactionLag float64
+
+func (l fakeCompactionLag) HeadCompactionLag() float64 { return float64(l) }
+
+func TestBackpressureHeaders(t *testing.T) {
+	lag := fakeCompactionLag(0)
+	b := newBackpressure(prometheus.NewRegistry(), BackpressureOptions{MaxDelay: 10 * time.Second, Threshold: 0.5, CompactionLag: &lag})
+
+	for _, tc := range []struct {
+		name           string
+		pending        int64
+		maxConcurrency int
+		lag            float64
+		cause, delay   string
+	}{
+		{name: "no pressure", pending: 4, maxConcurrency: 4},
+		{name: "no concurrency limit", pending: 100},
+		{name: "write queue below threshold", pending: 5, maxConcurrency: 4},
+		{name: "write queue", pending: 7, maxConcurrency: 4, cause: "write-queue", delay: "7.5"},
+		{name: "full write queue", pending: 20, maxConcurrency: 4, lag: 0.7, cause: "write-queue", delay: "10"},
+		{name: "compaction lag", pending: 7, maxConcurrency: 4, lag: 0.9, cause: "compaction-lag", delay: "9"},
+		{name: "compaction lag above 1", lag: 3, cause: "compaction-lag", delay: "10"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			lag = fakeCompactionLag(tc.lag)
+			b.lagComputedUntil = time.Time{}
+			b.pending.Store(tc.pending)
+
+			w := httptest.NewRecorder()
+			b.setHeaders(w, tc.maxConcurrency)
+			testutil.Equals(t, tc.cause, w.Header().Get(BackpressureHeader))
+			testutil.Equals(t, tc.delay, w.Header().Get(BackpressureDelayHeader))
+		})
+	}
+	testutil.Equals(t, 2.0, promtestutil.ToFloat64(b.hints.WithLabelValues("write-queue")))
+	testutil.Equals(t, 2.0, promtestutil.ToFloat64(b.hints.WithLabelValues("compaction-lag")))
+}
+
+func TestMultiTSDBHeadCompactionLag(t *testing.T) {
+	m := NewMultiTSDB(t.TempDir(), log.NewNopLogger(), prometheus.NewRegistry(),
+		&tsdb.Options{
+			MinBlockDuration:  (2 * time.Hour).Milliseconds(),
+			MaxBlockDuration:  (2 * time.Hour).Milliseconds(),
+			RetentionDuration: (6 * time.Hour).Milliseconds(),
+		},
+		labels.FromStrings("replica", "test"),
+		"tenant_id",
+		nil,
+		false,
+		metadata.NoneFunc,
+	)
+	defer func() { testutil.Ok(t, m.Close()) }()
+
+	testutil.Equals(t, 0.0, m.HeadCompactionLag())
+
+	start := time.Now().Add(-6 * time.Hour)
+	testutil.Ok(t, appendSample(m, "on-time", start))
+	testutil.Ok(t, appendSample(m, "on-time", start.Add(2*time.Hour)))
+	testutil.Ok(t, appendSample(m, "lagging", start))
+	testutil.Equals(t, 0.0, m.HeadCompactionLag())
+
+	// Keep the head of the lagging tenant from being compacted.
+	m.mtx.RLock()
+	m.tenants["lagging"].readyS.Get().DisableCompactions()
+	m.mtx.RUnlock()
+	testutil.Ok(t, appendSample(m, "lagging", start.Add(5*time.Hour)))
+	testutil.Equals(t, 1.0, m.HeadCompactionLag())
+}
+
+func TestReceiveHTTPBackpressure(t *testing.T) {
+	handlers, _, err := newTestHandlerHashring([]*fakeAppendable{{appender: newFakeAppender(nil, nil, nil)}}, 1, AlgorithmHashmod)
+	testutil.Ok(t, err)
+	handler := handlers[0]
+
+	lag := fakeCompactionLag(0)
+	handler.backpressure = newBackpressure(prometheus.NewRegistry(), BackpressureOptions{MaxDelay: 4 * time.Second, Threshold: 0.5, CompactionLag: &lag})
+	wreq := &prompb.WriteRequest{Timeseries: []*prompb.TimeSeries{{
+		Labels:  []*labelpb.Label{{Name: "__name__", Value: "up"}},
+		Samples: []*prompb.Sample{{Value: 1, Timestamp: 1}},
+	}}}
+
+	rec, err := makeRequest(handler, "tenant", wreq)
+	testutil.Ok(t, err)
+	testutil.Equals(t, http.StatusOK, rec.Code)
+	testutil.Equals(t, "", rec.Header().Get(BackpressureHeader))
+
+	// Hints are advisory, the request is still accepted.
+	lag = 0.5
+	handler.backpressure.lagComputedUntil = time.Time{}
+	rec, err = makeRequest(handler, "tenant", wreq)
+	testutil.Ok(t, err)
+	testutil.Equals(t, http.StatusOK, rec.Code)
+	testutil.Equals(t, "compaction-lag", rec.Header().Get(BackpressureHeader))
+	testutil.Equals(t, "2", rec.Header().Get(BackpressureDelayHeader))
+}
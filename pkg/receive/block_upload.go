@@ -0,0 +1,196 @@
+// Copyright (c) The Thanos Authors.
+// Licensed under the Apache License 2.0.
+
+package receive
+
+import (
+	"context"
+	"crypto/subtle"
+	"io"
+	"net/http"
+	"regexp"
+	"strings"
+
+	"github.com/go-kit/log"
+	"github.com/go-kit/log/level"
+	"github.com/oklog/ulid"
+	"github.com/pkg/errors"
+	"github.com/prometheus/common/route"
+
+	"github.com/thanos-io/thanos/pkg/block"
+	"github.com/thanos-io/thanos/pkg/block/metadata"
+	"github.com/thanos-io/thanos/pkg/tenancy"
+)
+
+var (
+	// errInvalidBlock is returned when an uploaded block or its meta fails validation.
+	errInvalidBlock = errors.New("invalid block")
+	// errBlockConflict is returned when an uploaded block already exists or overlaps with the blocks of the tenant.
+	errBlockConflict = errors.New("block conflicts with existing data")
+	// errBlockUploadNotStarted is returned when uploading files of a block whose upload was not started.
+	errBlockUploadNotStarted = errors.New("block upload not started")
+	// errBlockTooLarge is returned when an uploaded file or block exceeds the size limits of uploads.
+	errBlockTooLarge = errors.New("block too large")
+)
+
+// BlockUploadOptions configures the block upload endpoints.
+type BlockUploadOptions struct {
+	// BearerToken is the token requests have to carry in their Authorization header. Leave empty to rely on TLS
+	// client authentication only.
+	BearerToken string
+	// MaxFileSize is the maximum size in bytes of a single file of a block. 0 means no limit.
+	MaxFileSize int64
+	// MaxBlockSize is the maximum size in bytes of the index and chunk files of a block. 0 means no limit.
+	MaxBlockSize int64
+}
+
+// blockFileRe matches the paths of the files of a block which can be uploaded, relative to the block directory.
+var blockFileRe = regexp.MustCompile(`^(` + block.IndexFilename + `|` + block.ChunksDirname + `/\d{6})$`)
+
+// TenantBlockUploader accepts blocks uploaded into the local storage of tenants, e.g. to backfill
+// historical data. Uploaded blocks are shipped to object storage along with the blocks of the TSDB.
+type TenantBlockUploader interface {
+	// StartBlockUpload validates the meta of a block to upload for the given tenant and prepares its upload.
+	// Starting the upload of a block again discards the files uploaded so far.
+	StartBlockUpload(ctx context.Context, tenantID string, meta *metadata.Meta) error
+	// UploadBlockFile writes a file of the block at the given path, relative to the block directory. It returns
+	// errBlockTooLarge if the index and chunk files of the block would exceed maxBlockSize bytes, unless it is 0.
+	UploadBlockFile(tenantID string, id ulid.ULID, name string, r io.Reader, maxBlockSize int64) error
+	// FinishBlockUpload validates the uploaded block and adds it to the local storage of the tenant.
+	FinishBlockUpload(ctx context.Context, tenantID string, id ulid.ULID) error
+}
+
+// blockUploadHandler serves the block upload API. A block is uploaded by starting its upload with its
+// meta file, uploading its index and chunk files and finishing the upload, which validates the block.
+type blockUploadHandler struct {
+	logger log.Logger
+	opts   *Options
+}
+
+func newBlockUploadHandler(logger log.Logger, o *Options) *blockUploadHandler {
+	return &blockUploadHandler{logger: logger, opts: o}
+}
+
+// register registers the endpoints of the API on r, wrapping their handlers with wrap.
+func (h *blockUploadHandler) register(r *route.Router, wrap func(name string, next http.HandlerFunc) http.HandlerFunc) {
+	r.Post("/api/v1/upload/block/:block/start", wrap("upload_block_start", h.authenticate(h.start)))
+	r.Post("/api/v1/upload/block/:block/files", wrap("upload_block_files", h.authenticate(h.files)))
+	r.Post("/api/v1/upload/block/:block/finish", wrap("upload_block_finish", h.authenticate(h.finish)))
+}
+
+// authenticate rejects requests not carrying the bearer token of uploads, if any.
+func (h *blockUploadHandler) authenticate(next http.HandlerFunc) http.HandlerFunc {
+	return bearerTokenAuth(h.opts.BlockUpload.BearerToken, next)
+}
+
+// bearerTokenAuth rejects requests not carrying the given bearer token in their Authorization header.
+// An empty token leaves authentication to TLS client certificates.
+func bearerTokenAuth(token string, next http.HandlerFunc) http.HandlerFunc {
+	if token == "" {
+		return next
+	}
+	return func(w http.ResponseWriter, r *http.Request) {
+		got, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if !ok || subtle.ConstantTimeCompare([]byte(got), []byte(token)) != 1 {
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			http.Error(w, "invalid or missing bearer token", http.StatusUnauthorized)
+			return
+		}
+		next(w, r)
+	}
+}
+
+// parseRequest returns the tenant and the block of the request. It writes an error response if they are invalid.
+func (h *blockUploadHandler) parseRequest(w http.ResponseWriter, r *http.Request) (string, ulid.ULID, bool) {
+	tenantHTTP, err := tenancy.GetTenantFromHTTP(r, h.opts.TenantHeader, h.opts.DefaultTenantID, h.opts.TenantField)
+	if err != nil {
+		level.Error(h.logger).Log("msg", "error getting tenant from HTTP", "err", err)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return "", ulid.ULID{}, false
+	}
+	id, err := ulid.Parse(route.Param(r.Context(), "block"))
+	if err != nil {
+		http.Error(w, errors.Wrap(err, "parse block ID").Error(), http.StatusBadRequest)
+		return "", ulid.ULID{}, false
+	}
+	return tenantHTTP, id, true
+}
+
+func (h *blockUploadHandler) start(w http.ResponseWriter, r *http.Request) {
+	tenantHTTP, id, ok := h.parseRequest(w, r)
+	if !ok {
+		return
+	}
+	meta, err := metadata.Read(r.Body)
+	if err != nil {
+		http.Error(w, errors.Wrap(err, "read meta").Error(), http.StatusBadRequest)
+		return
+	}
+	if meta.ULID != id {
+		http.Error(w, errors.Errorf("block ID %s of the meta does not match %s", meta.ULID, id).Error(), http.StatusBadRequest)
+		return
+	}
+	h.respond(w, tenantHTTP, id, h.opts.BlockUploader.StartBlockUpload(r.Context(), tenantHTTP, meta))
+}
+
+func (h *blockUploadHandler) files(w http.ResponseWriter, r *http.Request) {
+	tenantHTTP, id, ok := h.parseRequest(w, r)
+	if !ok {
+		return
+	}
+	name := r.URL.Query().Get("path")
+	if !blockFileRe.MatchString(name) {
+		http.Error(w, errors.Errorf("invalid block file path %q", name).Error(), http.StatusBadRequest)
+		return
+	}
+	body := r.Body
+	if limit := h.opts.BlockUpload.MaxFileSize; limit > 0 {
+		if r.ContentLength > limit {
+			h.respond(w, tenantHTTP, id, errors.Wrapf(errBlockTooLarge, "file %s exceeds %d bytes", name, limit))
+			return
+		}
+		body = http.MaxBytesReader(w, r.Body, limit)
+	}
+	err := h.opts.BlockUploader.UploadBlockFile(tenantHTTP, id, name, body, h.opts.BlockUpload.MaxBlockSize)
+	var maxBytesErr *http.MaxBytesError
+	if errors.As(err, &maxBytesErr) {
+		err = errors.Wrapf(errBlockTooLarge, "file %s exceeds %d bytes", name, maxBytesErr.Limit)
+	}
+	h.respond(w, tenantHTTP, id, err)
+}
+
+func (h *blockUploadHandler) finish(w http.ResponseWriter, r *http.Request) {
+	tenantHTTP, id, ok := h.parseRequest(w, r)
+	if !ok {
+		return
+	}
+	err := h.opts.BlockUploader.FinishBlockUpload(r.Context(), tenantHTTP, id)
+	if err == nil {
+		level.Info(h.logger).Log("msg", "uploaded block added", "tenant", tenantHTTP, "block", id)
+	}
+	h.respond(w, tenantHTTP, id, err)
+}
+
+func (h *blockUploadHandler) respond(w http.ResponseWriter, tenantID string, id ulid.ULID, err error) {
+	if err == nil {
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+
+	status := http.StatusInternalServerError
+	switch errors.Cause(err) {
+	case errInvalidBlock:
+		status = http.StatusBadRequest
+	case errBlockConflict:
+		status = http.StatusConflict
+	case errBlockUploadNotStarted:
+		status = http.StatusNotFound
+	case errBlockTooLarge:
+		status = http.StatusRequestEntityTooLarge
+	case ErrNotReady:
+		status = http.StatusServiceUnavailable
+	default:
+		level.Error(h.logger).Log("msg", "block upload failed", "tenant", tenantID, "block", id, "err", err)
+	}
+	http.Error(w, err.Error(), status)
+}
@@ -0,0 +1,256 @@
+// Copyright (c) The Thanos Authors.
+// Licensed under the Apache License 2.0.
+
+package receive
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/efficientgo/core/testutil"
+	"github.com/go-kit/log"
+	"github.com/oklog/ulid"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/common/route"
+	"github.com/prometheus/prometheus/model/labels"
+	"github.com/prometheus/prometheus/tsdb"
+	"github.com/thanos-io/objstore"
+
+	"github.com/thanos-io/thanos/pkg/block"
+	"github.com/thanos-io/thanos/pkg/block/metadata"
+	"github.com/thanos-io/thanos/pkg/tenancy"
+	"github.com/thanos-io/thanos/pkg/testutil/e2eutil"
+)
+
+// blockUploadTest is a receiver serving the block upload API for tests.
+type blockUploadTest struct {
+	t         *testing.T
+	m         *MultiTSDB
+	bkt       objstore.Bucket
+	router    *route.Router
+	opts      *Options
+	blocksDir string
+	token     string
+}
+
+func newBlockUploadTest(t *testing.T, opts BlockUploadOptions) *blockUploadTest {
+	bkt := objstore.NewInMemBucket()
+	m := NewMultiTSDB(t.TempDir(), log.NewNopLogger(), prometheus.NewRegistry(),
+		&tsdb.Options{
+			MinBlockDuration:  (2 * time.Hour).Milliseconds(),
+			MaxBlockDuration:  (2 * time.Hour).Milliseconds(),
+			RetentionDuration: (6 * time.Hour).Milliseconds(),
+		},
+		labels.FromStrings("replica", "test"),
+		"tenant_id",
+		bkt,
+		false,
+		metadata.NoneFunc,
+	)
+	t.Cleanup(func() { testutil.Ok(t, m.Close()) })
+
+	router := route.New()
+	o := &Options{
+		TenantHeader:    tenancy.DefaultTenantHeader,
+		DefaultTenantID: tenancy.DefaultTenant,
+		BlockUploader:   m,
+		BlockUpload:     opts,
+	}
+	newBlockUploadHandler(log.NewNopLogger(), o).register(router, func(_ string, next http.HandlerFunc) http.HandlerFunc { return next })
+
+	return &blockUploadTest{t: t, m: m, bkt: bkt, router: router, opts: o, blocksDir: t.TempDir(), token: opts.BearerToken}
+}
+
+func (b *blockUploadTest) post(id ulid.ULID, op string, body io.Reader) *httptest.ResponseRecorder {
+	r := httptest.NewRequest(http.MethodPost, "/api/v1/upload/block/"+id.String()+"/"+op, body)
+	r.Header.Set(tenancy.DefaultTenantHeader, "foo")
+	if b.token != "" {
+		r.Header.Set("Authorization", "Bearer "+b.token)
+	}
+	w := httptest.NewRecorder()
+	b.router.ServeHTTP(w, r)
+	return w
+}
+
+func (b *blockUploadTest) createBlock(mint, maxt int64, extLset labels.Labels) ulid.ULID {
+	id, err := e2eutil.CreateBlock(context.Background(), b.blocksDir, []labels.Labels{
+		labels.FromStrings("a", "1"),
+		labels.FromStrings("a", "2"),
+	}, 100, mint, maxt, extLset, 0, metadata.NoneFunc)
+	testutil.Ok(b.t, err)
+	return id
+}
+
+func (b *blockUploadTest) readFile(id ulid.ULID, name string) io.Reader {
+	f, err := os.ReadFile(filepath.Join(b.blocksDir, id.String(), name))
+	testutil.Ok(b.t, err)
+	return bytes.NewReader(f)
+}
+
+// upload uploads the block and returns the status code of the first failed request, if any.
+func (b *blockUploadTest) upload(id ulid.ULID) int {
+	if w := b.post(id, "start", b.readFile(id, block.MetaFilename)); w.Code != http.StatusOK {
+		return w.Code
+	}
+	for _, name := range []string{block.IndexFilename, "chunks/000001"} {
+		if w := b.post(id, "files?path="+name, b.readFile(id, name)); w.Code != http.StatusOK {
+			return w.Code
+		}
+	}
+	return b.post(id, "finish", nil).Code
+}
+
+func TestBlockUploadHandler(t *testing.T) {
+	ctx := context.Background()
+	b := newBlockUploadTest(t, BlockUploadOptions{})
+	m, bkt, post, readFile, upload := b.m, b.bkt, b.post, b.readFile, b.upload
+	createBlock := func(mint, maxt int64) ulid.ULID {
+		return b.createBlock(mint, maxt, labels.FromStrings("tenant_id", "bar"))
+	}
+
+	b1 := createBlock(0, 1000)
+	testutil.Equals(t, http.StatusOK, upload(b1))
+
+	// The block is shipped when the upload finishes, with the external labels of the tenant only.
+	meta, err := block.DownloadMeta(ctx, log.NewNopLogger(), bkt, b1)
+	testutil.Ok(t, err)
+	testutil.Equals(t, map[string]string{"replica": "test", "tenant_id": "foo"}, meta.Thanos.Labels)
+	testutil.Equals(t, metadata.ReceiveSource, meta.Thanos.Source)
+	uploaded, err := m.Sync(ctx)
+	testutil.Ok(t, err)
+	testutil.Equals(t, 0, uploaded)
+
+	t.Run("duplicate block", func(t *testing.T) {
+		testutil.Equals(t, http.StatusConflict, post(b1, "start", readFile(b1, block.MetaFilename)).Code)
+	})
+	t.Run("overlapping block", func(t *testing.T) {
+		testutil.Equals(t, http.StatusConflict, upload(createBlock(500, 1500)))
+	})
+	t.Run("overlapping block in object storage", func(t *testing.T) {
+		// Blocks of the tenant which are only in object storage, e.g. after the local ones were deleted.
+		inBucket := b.createBlock(4000, 5000, labels.FromStrings("replica", "test", "tenant_id", "foo"))
+		testutil.Ok(t, block.Upload(ctx, log.NewNopLogger(), bkt, filepath.Join(b.blocksDir, inBucket.String()), metadata.NoneFunc))
+		testutil.Equals(t, http.StatusConflict, upload(createBlock(4500, 5500)))
+
+		// Blocks of other tenants or receivers do not conflict.
+		other := b.createBlock(6000, 7000, labels.FromStrings("replica", "other", "tenant_id", "foo"))
+		testutil.Ok(t, block.Upload(ctx, log.NewNopLogger(), bkt, filepath.Join(b.blocksDir, other.String()), metadata.NoneFunc))
+		testutil.Equals(t, http.StatusOK, upload(createBlock(6500, 7500)))
+	})
+	t.Run("block in the future", func(t *testing.T) {
+		now := time.Now().UnixMilli()
+		testutil.Equals(t, http.StatusBadRequest, upload(createBlock(now+time.Hour.Milliseconds(), now+2*time.Hour.Milliseconds())))
+	})
+	t.Run("block ID mismatch", func(t *testing.T) {
+		b2 := createBlock(2000, 3000)
+		testutil.Equals(t, http.StatusBadRequest, post(ulid.MustNew(1, nil), "start", readFile(b2, block.MetaFilename)).Code)
+	})
+	t.Run("invalid file path", func(t *testing.T) {
+		b2 := createBlock(2000, 3000)
+		testutil.Equals(t, http.StatusOK, post(b2, "start", readFile(b2, block.MetaFilename)).Code)
+		testutil.Equals(t, http.StatusBadRequest, post(b2, "files?path=../../meta.json", readFile(b2, block.MetaFilename)).Code)
+	})
+	t.Run("incomplete block", func(t *testing.T) {
+		b2 := createBlock(2000, 3000)
+		testutil.Equals(t, http.StatusOK, post(b2, "start", readFile(b2, block.MetaFilename)).Code)
+		testutil.Equals(t, http.StatusOK, post(b2, "files?path=chunks/000001", readFile(b2, "chunks/000001")).Code)
+		testutil.Equals(t, http.StatusBadRequest, post(b2, "finish", nil).Code)
+	})
+	t.Run("upload not started", func(t *testing.T) {
+		testutil.Equals(t, http.StatusNotFound, post(createBlock(2000, 3000), "finish", nil).Code)
+	})
+}
+
+func TestBlockUploadHandler_Auth(t *testing.T) {
+	b := newBlockUploadTest(t, BlockUploadOptions{BearerToken: "secret"})
+	id := b.createBlock(0, 1000, labels.EmptyLabels())
+
+	b.token = ""
+	w := b.post(id, "start", b.readFile(id, block.MetaFilename))
+	testutil.Equals(t, http.StatusUnauthorized, w.Code)
+	testutil.Equals(t, "Bearer", w.Header().Get("WWW-Authenticate"))
+
+	b.token = "wrong"
+	testutil.Equals(t, http.StatusUnauthorized, b.upload(id))
+
+	b.token = "secret"
+	testutil.Equals(t, http.StatusOK, b.upload(id))
+}
+
+func TestBlockUploadHandler_SizeLimits(t *testing.T) {
+	b := newBlockUploadTest(t, BlockUploadOptions{})
+	fileSize := func(id ulid.ULID, name string) int64 {
+		fi, err := os.Stat(filepath.Join(b.blocksDir, id.String(), name))
+		testutil.Ok(t, err)
+		return fi.Size()
+	}
+
+	t.Run("file too large", func(t *testing.T) {
+		id := b.createBlock(0, 1000, labels.EmptyLabels())
+		large, small := block.IndexFilename, "chunks/000001"
+		if fileSize(id, large) < fileSize(id, small) {
+			large, small = small, large
+		}
+		b.opts.BlockUpload = BlockUploadOptions{MaxFileSize: fileSize(id, large) - 1}
+
+		testutil.Equals(t, http.StatusOK, b.post(id, "start", b.readFile(id, block.MetaFilename)).Code)
+		testutil.Equals(t, http.StatusRequestEntityTooLarge, b.post(id, "files?path="+large, b.readFile(id, large)).Code)
+		// Without a content length, the size is only known once the body was read.
+		testutil.Equals(t, http.StatusRequestEntityTooLarge, b.post(id, "files?path="+large, io.MultiReader(b.readFile(id, large))).Code)
+		if fileSize(id, small) < fileSize(id, large) {
+			testutil.Equals(t, http.StatusOK, b.post(id, "files?path="+small, b.readFile(id, small)).Code)
+		}
+	})
+	t.Run("block too large", func(t *testing.T) {
+		id := b.createBlock(2000, 3000, labels.EmptyLabels())
+		b.opts.BlockUpload = BlockUploadOptions{MaxBlockSize: fileSize(id, block.IndexFilename) + fileSize(id, "chunks/000001") - 1}
+
+		testutil.Equals(t, http.StatusOK, b.post(id, "start", b.readFile(id, block.MetaFilename)).Code)
+		testutil.Equals(t, http.StatusOK, b.post(id, "files?path="+block.IndexFilename, b.readFile(id, block.IndexFilename)).Code)
+		// Uploading a file again replaces it.
+		testutil.Equals(t, http.StatusOK, b.post(id, "files?path="+block.IndexFilename, b.readFile(id, block.IndexFilename)).Code)
+		testutil.Equals(t, http.StatusRequestEntityTooLarge, b.post(id, "files?path=chunks/000001", b.readFile(id, "chunks/000001")).Code)
+
+		b.opts.BlockUpload.MaxBlockSize++
+		testutil.Equals(t, http.StatusOK, b.upload(id))
+	})
+}
+
+func TestBlockUploadHandler_BeyondRetention(t *testing.T) {
+	ctx := context.Background()
+	b := newBlockUploadTest(t, BlockUploadOptions{})
+
+	old := b.createBlock(0, 1000, labels.EmptyLabels())
+	testutil.Equals(t, http.StatusOK, b.upload(old))
+
+	// Recent samples are compacted into a block, which reloads the blocks of the TSDB before the shipper runs
+	// and deletes the uploaded block, which is beyond the retention.
+	tenant, err := b.m.getOrLoadTenant("foo", true)
+	testutil.Ok(t, err)
+	db := tenant.readyStorage().Get()
+	now := time.Now().UnixMilli()
+	app := db.Appender(ctx)
+	for _, ts := range []int64{now - 4*time.Hour.Milliseconds(), now} {
+		_, err := app.Append(0, labels.FromStrings("a", "1"), ts, 1)
+		testutil.Ok(t, err)
+	}
+	testutil.Ok(t, app.Commit())
+	testutil.Ok(t, db.Compact(ctx))
+
+	_, err = os.Stat(filepath.Join(b.m.defaultTenantDataDir("foo"), old.String()))
+	testutil.Assert(t, os.IsNotExist(err), "expected block beyond retention to be deleted, got %v", err)
+
+	_, err = b.m.Sync(ctx)
+	testutil.Ok(t, err)
+	ok, err := b.bkt.Exists(ctx, path.Join(old.String(), block.MetaFilename))
+	testutil.Ok(t, err)
+	testutil.Assert(t, ok, "expected block beyond retention to be shipped")
+}
@@ -85,6 +85,29 @@ func isExactMatcher(m tenantMatcher) bool {
 	return m == TenantMatcherTypeExact || m == ""
 }
 
+// matchesTenant returns true if the hashring handles the given tenant, following
+// the same rules as write routing. A hashring without tenants is a default
+// hashring and matches every tenant.
+func (c HashringConfig) matchesTenant(tenant string) bool {
+	if len(c.Tenants) == 0 {
+		return true
+	}
+	for _, t := range c.Tenants {
+		if isExactMatcher(c.TenantMatcherType) {
+			if t == tenant {
+				return true
+			}
+			continue
+		}
+		if c.TenantMatcherType == TenantMatcherGlob {
+			if ok, err := filepath.Match(t, tenant); err == nil && ok {
+				return true
+			}
+		}
+	}
+	return false
+}
+
 // ConfigWatcher is able to watch a file containing a hashring configuration
 // for updates.
 type ConfigWatcher struct {
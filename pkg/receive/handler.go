@@ -15,6 +15,7 @@ import (
 	"net/http"
 	"sort"
 	"strconv"
+	"strings"
 	"sync"
 	"time"
 
@@ -34,13 +35,16 @@ import (
 	"github.com/prometheus/prometheus/tsdb"
 	"go.opentelemetry.io/otel/attribute"
 	"go.opentelemetry.io/otel/trace"
+	"go.uber.org/atomic"
 	"google.golang.org/grpc"
 	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/connectivity"
 	"google.golang.org/grpc/status"
 	"google.golang.org/protobuf/proto"
 
 	"github.com/thanos-io/thanos/pkg/api"
 	statusapi "github.com/thanos-io/thanos/pkg/api/status"
+	"github.com/thanos-io/thanos/pkg/errutil"
 	"github.com/thanos-io/thanos/pkg/logging"
 
 	extpromhttp "github.com/thanos-io/thanos/pkg/extprom/http"
@@ -105,6 +109,46 @@ type Options struct {
 	TSDBStats               TSDBStats
 	Limiter                 *Limiter
 	AsyncForwardWorkerCount uint
+	// ForwardConnectionsPerPeer is the number of gRPC connections kept to each peer. Forwarded requests are
+	// spread across them in a round-robin fashion. Defaults to 1.
+	ForwardConnectionsPerPeer int
+	// ForwardIdleTimeout is the duration after which an unused connection to a peer is closed. It is reopened
+	// on the next forwarded request. Zero keeps connections open.
+	ForwardIdleTimeout time.Duration
+
+	// TenantReader enables the remote read endpoint serving the local TSDBs of tenants. Leave nil to disable it.
+	TenantReader TenantReader
+	// RemoteReadSampleLimit is the maximum number of samples returned by a single non-streamed remote read request.
+	RemoteReadSampleLimit int
+	// RemoteReadConcurrencyLimit is the maximum number of concurrent remote read requests. Must be greater than 0.
+	RemoteReadConcurrencyLimit int
+	// RemoteReadMaxBytesInFrame is the maximum number of bytes in a single frame of streamed remote read responses.
+	RemoteReadMaxBytesInFrame int
+
+	// BlockUploader enables the block upload endpoints adding blocks to the local storage of tenants. Leave nil to disable it.
+	BlockUploader TenantBlockUploader
+	// BlockUpload configures the authentication and size limits of the block upload endpoints.
+	BlockUpload BlockUploadOptions
+
+	// TenantOverrides enables the API moving tenants to other nodes. Writes are routed according to the overrides
+	// only if the hashring of the handler is wrapped with TenantOverrides.Hashring. Leave nil to disable it.
+	TenantOverrides *TenantOverrides
+	// TenantOverridesBearerToken is the token requests to the tenant overrides API have to carry in their
+	// Authorization header. Leave empty to rely on TLS client authentication only.
+	TenantOverridesBearerToken string
+	// TenantDrainer flushes and uploads the data of tenants moved away from this node. Leave nil if it does not ingest.
+	TenantDrainer TenantDrainer
+
+	// SeriesValidator rejects the series of write requests violating the validation rules of their tenant. Leave nil
+	// to accept all series.
+	SeriesValidator *SeriesValidator
+
+	// MetadataAppender stores the metric metadata of write requests. Leave nil to ignore metadata.
+	MetadataAppender MetricMetadataAppender
+
+	// Backpressure adds hints advising clients to slow down to write responses while the write path is under
+	// pressure. Leave nil to disable it.
+	Backpressure *BackpressureOptions
 }
 
 // Handler serves a Prometheus remote write receiving HTTP endpoint.
@@ -130,6 +174,8 @@ type Handler struct {
 
 	Limiter *Limiter
 
+	backpressure *backpressure
+
 	storepb.UnimplementedWriteableStoreServer
 }
 
@@ -149,6 +195,12 @@ func NewHandler(logger log.Logger, o *Options) *Handler {
 	}
 	level.Info(logger).Log("msg", "Starting receive handler with async forward workers", "workers", workers)
 
+	connsPerPeer := o.ForwardConnectionsPerPeer
+	if connsPerPeer <= 0 {
+		connsPerPeer = 1
+	}
+	dialOpts := append(o.DialOpts[:len(o.DialOpts):len(o.DialOpts)], grpc.WithIdleTimeout(o.ForwardIdleTimeout))
+
 	h := &Handler{
 		logger:               logger,
 		writer:               o.Writer,
@@ -156,6 +208,7 @@ func NewHandler(logger log.Logger, o *Options) *Handler {
 		options:              o,
 		splitTenantLabelName: o.SplitTenantLabelName,
 		peers: newPeerGroup(
+			registerer,
 			backoff.Backoff{
 				Factor: 2,
 				Min:    100 * time.Millisecond,
@@ -170,7 +223,8 @@ func NewHandler(logger log.Logger, o *Options) *Handler {
 				},
 			),
 			workers,
-			o.DialOpts...),
+			connsPerPeer,
+			dialOpts...),
 		receiverMode: o.ReceiverMode,
 		Limiter:      o.Limiter,
 		forwardRequests: promauto.With(registerer).NewCounterVec(
@@ -222,6 +276,10 @@ func NewHandler(logger log.Logger, o *Options) *Handler {
 		h.replicationFactor.Set(1)
 	}
 
+	if o.Backpressure != nil {
+		h.backpressure = newBackpressure(registerer, *o.Backpressure)
+	}
+
 	ins := extpromhttp.NewNopInstrumentationMiddleware()
 	if o.Registry != nil {
 		var buckets = []float64{0.001, 0.005, 0.01, 0.02, 0.03, 0.04, 0.05, 0.06, 0.07, 0.08, 0.09, 0.1, 0.25, 0.5, 0.75, 1, 2, 3, 4, 5}
@@ -264,6 +322,32 @@ func NewHandler(logger log.Logger, o *Options) *Handler {
 		),
 	)
 
+	if o.TenantReader != nil {
+		h.router.Post(
+			"/api/v1/read",
+			instrf(
+				"read",
+				readyf(
+					middleware.RequestID(
+						newRemoteReadHandler(logger, o),
+					),
+				),
+			),
+		)
+	}
+
+	if o.BlockUploader != nil {
+		newBlockUploadHandler(logger, o).register(h.router, func(name string, next http.HandlerFunc) http.HandlerFunc {
+			return instrf(name, readyf(middleware.RequestID(next)))
+		})
+	}
+
+	if o.TenantOverrides != nil {
+		newTenantMoveHandler(logger, o, h.hashringNodes).register(h.router, func(name string, next http.HandlerFunc) http.HandlerFunc {
+			return instrf(name, readyf(middleware.RequestID(next)))
+		})
+	}
+
 	statusAPI := statusapi.New(statusapi.Options{
 		GetStats: h.getStats,
 		Registry: h.options.Registry,
@@ -305,6 +389,21 @@ func (h *Handler) Hashring(hashring Hashring) {
 	h.peers.reset()
 }
 
+// hashringNodes returns the nodes of the configured hashring, without the nodes of tenant overrides.
+func (h *Handler) hashringNodes() []string {
+	h.mtx.RLock()
+	defer h.mtx.RUnlock()
+
+	switch hr := h.hashring.(type) {
+	case nil:
+		return nil
+	case *overrideHashring:
+		return hr.hashring.Nodes()
+	default:
+		return hr.Nodes()
+	}
+}
+
 // getSortedStringSliceDiff returns items which are in slice1 but not in slice2.
 // The returned slice also only contains unique items i.e. it is a set.
 func getSortedStringSliceDiff(slice1, slice2 []string) []string {
@@ -474,8 +573,16 @@ func (h *Handler) receiveHTTP(w http.ResponseWriter, r *http.Request) {
 	}
 
 	tLogger := log.With(h.logger, "tenant", tenantHTTP)
+	if traceID, ok := tracing.TraceIDFromContext(ctx); ok {
+		tLogger = log.With(tLogger, "traceID", traceID)
+	}
 	span.SetTag("tenant", tenantHTTP)
 
+	if h.backpressure != nil {
+		h.backpressure.pending.Inc()
+		defer h.backpressure.pending.Dec()
+	}
+
 	writeGate := h.Limiter.WriteGate()
 	tracing.DoInSpan(r.Context(), "receive_write_gate_ismyturn", func(ctx context.Context) {
 		err = writeGate.Start(r.Context())
@@ -487,6 +594,11 @@ func (h *Handler) receiveHTTP(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	// Hints are added to all responses from here on, they are advisory and do not change the outcome of the request.
+	if h.backpressure != nil {
+		h.backpressure.setHeaders(w, h.Limiter.MaxWriteConcurrency())
+	}
+
 	under, err := h.Limiter.HeadSeriesLimiter().isUnderLimit(tenantHTTP)
 	if err != nil {
 		level.Error(tLogger).Log("msg", "error while limiting", "err", err.Error())
@@ -543,13 +655,18 @@ func (h *Handler) receiveHTTP(w http.ResponseWriter, r *http.Request) {
 		}
 	}
 
-	// Exit early if the request contained no data. We don't support metadata yet. We also cannot fail here, because
-	// this would mean lack of forward compatibility for remote write proto.
+	// Metadata is stored by the receiver the client sent it to, it is not forwarded to other receivers.
+	if len(wreq.Metadata) > 0 && h.options.MetadataAppender != nil {
+		h.options.MetadataAppender.AppendMetricMetadata(tenantHTTP, wreq.Metadata)
+	}
+
+	// Exit early if the request contained no series. We cannot fail here, because this would mean lack of forward
+	// compatibility for remote write proto.
 	if len(wreq.Timeseries) == 0 {
-		// TODO(yeya24): Handle remote write metadata.
 		if len(wreq.Metadata) > 0 {
-			// TODO(bwplotka): Do we need this error message?
-			level.Debug(tLogger).Log("msg", "only metadata from client; metadata ingestion not supported; skipping")
+			if h.options.MetadataAppender == nil {
+				level.Debug(tLogger).Log("msg", "only metadata from client; metadata ingestion not enabled; skipping")
+			}
 			return
 		}
 		level.Debug(tLogger).Log("msg", "empty remote write request; client bug or newer remote write protocol used?; skipping")
@@ -577,8 +694,23 @@ func (h *Handler) receiveHTTP(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	// Drop the series violating validation rules, which are reported once the valid ones are written.
+	var validationErr error
+	if h.options.SeriesValidator != nil {
+		validationErr = h.options.SeriesValidator.Filter(tenantHTTP, h.splitTenantLabelName, &wreq)
+		if len(wreq.Timeseries) == 0 {
+			http.Error(w, validationErr.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+
 	responseStatusCode := http.StatusOK
 	tenantStats, err := h.handleRequest(ctx, rep, tenantHTTP, &wreq)
+	if err == nil && validationErr != nil {
+		level.Debug(tLogger).Log("msg", "series rejected by validation rules", "err", validationErr)
+		responseStatusCode = http.StatusBadRequest
+		http.Error(w, validationErr.Error(), responseStatusCode)
+	}
 	if err != nil {
 		level.Debug(tLogger).Log("msg", "failed to handle request", "err", err.Error())
 		switch errors.Cause(err) {
@@ -586,6 +718,8 @@ func (h *Handler) receiveHTTP(w http.ResponseWriter, r *http.Request) {
 			responseStatusCode = http.StatusServiceUnavailable
 		case errUnavailable:
 			responseStatusCode = http.StatusServiceUnavailable
+		case errTenantQuarantined:
+			responseStatusCode = http.StatusServiceUnavailable
 		case errConflict:
 			responseStatusCode = http.StatusConflict
 		case errBadReplica:
@@ -736,6 +870,9 @@ func (h *Handler) fanoutForward(ctx context.Context, params remoteWriteParams) (
 	if id, ok := middleware.RequestIDFromContext(ctx); ok {
 		logTags = append(logTags, "request-id", id)
 	}
+	if traceID, ok := tracing.TraceIDFromContext(ctx); ok {
+		logTags = append(logTags, "traceID", traceID)
+	}
 	requestLogger := log.With(h.logger, logTags...)
 
 	localWrites, remoteWrites, err := h.distributeTimeseriesToReplicas(params.tenant, params.replicas, params.writeRequest.Timeseries)
@@ -1032,6 +1169,9 @@ func (h *Handler) RemoteWrite(ctx context.Context, r *storepb.WriteRequest) (*st
 		return nil, status.Error(codes.Unavailable, err.Error())
 	case errUnavailable:
 		return nil, status.Error(codes.Unavailable, err.Error())
+	case errTenantQuarantined:
+		// Not Unavailable, so that peers keep forwarding writes of other tenants to this receiver.
+		return nil, status.Error(codes.FailedPrecondition, err.Error())
 	case errConflict:
 		return nil, status.Error(codes.AlreadyExists, err.Error())
 	case errBadReplica:
@@ -1103,6 +1243,13 @@ func isNotReady(err error) bool {
 		status.Code(err) == codes.Unavailable
 }
 
+// isTenantQuarantined returns whether or not the given error represents a write rejected because the tenant
+// is quarantined.
+func isTenantQuarantined(err error) bool {
+	return err == errTenantQuarantined ||
+		status.Code(err) == codes.FailedPrecondition
+}
+
 // isUnavailable returns whether or not the given error represents an unavailable error.
 func isUnavailable(err error) bool {
 	return err == errUnavailable ||
@@ -1219,6 +1366,7 @@ func (es *writeErrors) Cause() error {
 		{err: errUnavailable, cause: isUnavailable},
 		{err: errNotReady, cause: isNotReady},
 		{err: errConflict, cause: isConflict},
+		{err: errTenantQuarantined, cause: isTenantQuarantined},
 	}
 
 	var (
@@ -1269,6 +1417,7 @@ func (es *replicationErrors) Cause() error {
 		{err: errConflict, cause: isConflict},
 		{err: errNotReady, cause: isNotReady},
 		{err: errUnavailable, cause: isUnavailable},
+		{err: errTenantQuarantined, cause: isTenantQuarantined},
 	}
 	for _, exp := range expErrs {
 		exp.count = 0
@@ -1300,27 +1449,46 @@ func newReplicationErrors(threshold, numErrors int) []*replicationErrors {
 	return errs
 }
 
-func newPeerWorker(cc *grpc.ClientConn, forwardDelay prometheus.Histogram, asyncWorkerCount uint) *peerWorker {
+func newPeerWorker(ccs []*grpc.ClientConn, forwardDelay prometheus.Histogram, asyncWorkerCount uint) *peerWorker {
 	return &peerWorker{
-		cc:           cc,
+		ccs:          ccs,
 		wp:           pool.NewWorkerPool(asyncWorkerCount),
 		forwardDelay: forwardDelay,
 	}
 }
 
 func (pw *peerWorker) RemoteWrite(ctx context.Context, in *storepb.WriteRequest, opts ...grpc.CallOption) (*storepb.WriteResponse, error) {
-	return storepb.NewWriteableStoreClient(pw.cc).RemoteWrite(ctx, in)
+	return storepb.NewWriteableStoreClient(pw.conn()).RemoteWrite(ctx, in)
 }
 
 type peerWorker struct {
-	cc *grpc.ClientConn
-	wp pool.WorkerPool
+	ccs  []*grpc.ClientConn
+	next atomic.Uint64
+	wp   pool.WorkerPool
 
 	forwardDelay prometheus.Histogram
 }
 
-func newPeerGroup(backoff backoff.Backoff, forwardDelay prometheus.Histogram, asyncForwardWorkersCount uint, dialOpts ...grpc.DialOption) peersContainer {
-	return &peerGroup{
+// conn returns the next connection to the peer in a round-robin fashion.
+func (pw *peerWorker) conn() *grpc.ClientConn {
+	if len(pw.ccs) == 1 {
+		return pw.ccs[0]
+	}
+	return pw.ccs[(pw.next.Inc()-1)%uint64(len(pw.ccs))]
+}
+
+func (pw *peerWorker) close() error {
+	pw.wp.Close()
+
+	var merr errutil.MultiError
+	for _, cc := range pw.ccs {
+		merr.Add(cc.Close())
+	}
+	return merr.Err()
+}
+
+func newPeerGroup(reg prometheus.Registerer, backoff backoff.Backoff, forwardDelay prometheus.Histogram, asyncForwardWorkersCount uint, connectionsPerPeer int, dialOpts ...grpc.DialOption) peersContainer {
+	p := &peerGroup{
 		dialOpts:                 dialOpts,
 		connections:              map[string]*peerWorker{},
 		m:                        sync.RWMutex{},
@@ -1329,6 +1497,56 @@ func newPeerGroup(backoff backoff.Backoff, forwardDelay prometheus.Histogram, as
 		expBackoff:               backoff,
 		forwardDelay:             forwardDelay,
 		asyncForwardWorkersCount: asyncForwardWorkersCount,
+		connectionsPerPeer:       connectionsPerPeer,
+		connectionsOpened: promauto.With(reg).NewCounter(prometheus.CounterOpts{
+			Name: "thanos_receive_forward_connections_opened_total",
+			Help: "The number of gRPC connections opened to peers for forwarding requests.",
+		}),
+		connectionsClosed: promauto.With(reg).NewCounter(prometheus.CounterOpts{
+			Name: "thanos_receive_forward_connections_closed_total",
+			Help: "The number of gRPC connections to peers closed because the peer left the hashring.",
+		}),
+	}
+	if reg != nil {
+		reg.MustRegister(&peerConnectionsCollector{
+			p: p,
+			desc: prometheus.NewDesc(
+				"thanos_receive_forward_connections",
+				"The number of gRPC connections to peers used for forwarding requests, by connectivity state. Idle connections hold no transport.",
+				[]string{"state"}, nil,
+			),
+		})
+	}
+	return p
+}
+
+// peerConnectionsCollector exposes the number of pooled peer connections by connectivity state.
+type peerConnectionsCollector struct {
+	p    *peerGroup
+	desc *prometheus.Desc
+}
+
+func (c *peerConnectionsCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- c.desc
+}
+
+func (c *peerConnectionsCollector) Collect(ch chan<- prometheus.Metric) {
+	states := map[connectivity.State]int{
+		connectivity.Idle:             0,
+		connectivity.Connecting:       0,
+		connectivity.Ready:            0,
+		connectivity.TransientFailure: 0,
+	}
+	c.p.m.RLock()
+	for _, pw := range c.p.connections {
+		for _, cc := range pw.ccs {
+			states[cc.GetState()]++
+		}
+	}
+	c.p.m.RUnlock()
+
+	for state, n := range states {
+		ch <- prometheus.MustNewConstMetric(c.desc, prometheus.GaugeValue, float64(n), strings.ToLower(state.String()))
 	}
 }
 
@@ -1346,7 +1564,7 @@ func (p *peerWorker) RemoteWriteAsync(ctx context.Context, req *storepb.WriteReq
 		p.forwardDelay.Observe(time.Since(now).Seconds())
 
 		tracing.DoInSpan(ctx, "receive_forward", func(ctx context.Context) {
-			_, err := storepb.NewWriteableStoreClient(p.cc).RemoteWrite(ctx, req)
+			_, err := storepb.NewWriteableStoreClient(p.conn()).RemoteWrite(ctx, req)
 			responseWriter <- newWriteResponse(
 				seriesIDs,
 				errors.Wrapf(err, "forwarding request to endpoint %v", er.endpoint),
@@ -1372,6 +1590,10 @@ type peerGroup struct {
 	expBackoff               backoff.Backoff
 	forwardDelay             prometheus.Histogram
 	asyncForwardWorkersCount uint
+	connectionsPerPeer       int
+
+	connectionsOpened prometheus.Counter
+	connectionsClosed prometheus.Counter
 
 	m sync.RWMutex
 
@@ -1390,9 +1612,9 @@ func (p *peerGroup) close(addr string) error {
 		return nil
 	}
 
-	p.connections[addr].wp.Close()
 	delete(p.connections, addr)
-	if err := c.cc.Close(); err != nil {
+	p.connectionsClosed.Add(float64(len(c.ccs)))
+	if err := c.close(); err != nil {
 		return fmt.Errorf("closing connection for %s", addr)
 	}
 
@@ -1419,14 +1641,22 @@ func (p *peerGroup) getConnection(ctx context.Context, addr string) (WriteableSt
 	if ok {
 		return c, nil
 	}
-	conn, err := p.dialer(addr, p.dialOpts...)
-	if err != nil {
-		p.markPeerUnavailableUnlocked(addr)
-		dialError := errors.Wrap(err, "failed to dial peer")
-		return nil, errors.Wrap(dialError, errUnavailable.Error())
+	ccs := make([]*grpc.ClientConn, 0, p.connectionsPerPeer)
+	for i := 0; i < max(p.connectionsPerPeer, 1); i++ {
+		conn, err := p.dialer(addr, p.dialOpts...)
+		if err != nil {
+			for _, cc := range ccs {
+				_ = cc.Close()
+			}
+			p.markPeerUnavailableUnlocked(addr)
+			dialError := errors.Wrap(err, "failed to dial peer")
+			return nil, errors.Wrap(dialError, errUnavailable.Error())
+		}
+		ccs = append(ccs, conn)
 	}
+	p.connectionsOpened.Add(float64(len(ccs)))
 
-	p.connections[addr] = newPeerWorker(conn, p.forwardDelay, p.asyncForwardWorkersCount)
+	p.connections[addr] = newPeerWorker(ccs, p.forwardDelay, p.asyncForwardWorkersCount)
 	return p.connections[addr], nil
 }
 
@@ -23,13 +23,16 @@ import (
 	"time"
 
 	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials/insecure"
 	"gopkg.in/yaml.v3"
 
 	"github.com/alecthomas/units"
 	"github.com/go-kit/log"
 	"github.com/golang/snappy"
+	"github.com/jpillora/backoff"
 	"github.com/pkg/errors"
 	"github.com/prometheus/client_golang/prometheus"
+	promtestutil "github.com/prometheus/client_golang/prometheus/testutil"
 	"github.com/prometheus/common/model"
 	"github.com/prometheus/prometheus/model/exemplar"
 	"github.com/prometheus/prometheus/model/histogram"
@@ -1651,6 +1654,45 @@ func TestHashringChangeCallsClose(t *testing.T) {
 	testutil.Assert(t, len(pg.closeCalled) > 0)
 }
 
+func TestPeerGroupConnectionPool(t *testing.T) {
+	reg := prometheus.NewRegistry()
+	pg := newPeerGroup(
+		reg,
+		backoff.Backoff{Min: time.Second, Max: time.Second},
+		prometheus.NewHistogram(prometheus.HistogramOpts{Name: "forward_delay"}),
+		1,
+		3,
+		grpc.WithTransportCredentials(insecure.NewCredentials()),
+	).(*peerGroup)
+
+	c, err := pg.getConnection(context.Background(), "localhost:19391")
+	testutil.Ok(t, err)
+	pw := c.(*peerWorker)
+	testutil.Equals(t, 3, len(pw.ccs))
+
+	// Requests are spread across all connections of the peer.
+	for i := 0; i < 6; i++ {
+		testutil.Equals(t, pw.ccs[i%3], pw.conn())
+	}
+
+	// Connections are reused for subsequent requests.
+	c2, err := pg.getConnection(context.Background(), "localhost:19391")
+	testutil.Ok(t, err)
+	testutil.Equals(t, c, c2)
+	testutil.Equals(t, 3.0, promtestutil.ToFloat64(pg.connectionsOpened))
+	testutil.Ok(t, promtestutil.GatherAndCompare(reg, strings.NewReader(`
+# HELP thanos_receive_forward_connections The number of gRPC connections to peers used for forwarding requests, by connectivity state. Idle connections hold no transport.
+# TYPE thanos_receive_forward_connections gauge
+thanos_receive_forward_connections{state="connecting"} 0
+thanos_receive_forward_connections{state="idle"} 3
+thanos_receive_forward_connections{state="ready"} 0
+thanos_receive_forward_connections{state="transient_failure"} 0
+`), "thanos_receive_forward_connections"))
+
+	testutil.Ok(t, pg.close("localhost:19391"))
+	testutil.Equals(t, 3.0, promtestutil.ToFloat64(pg.connectionsClosed))
+}
+
 func TestHandlerEarlyStop(t *testing.T) {
 	h := NewHandler(nil, &Options{})
 	h.Close()
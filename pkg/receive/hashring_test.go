@@ -572,6 +572,62 @@ func TestKetamaHashringEvenNodeSpread(t *testing.T) {
 	}
 }
 
+func TestHashringSeriesMovementOnResize(t *testing.T) {
+	series := makeSeries()
+
+	nodes := func(n int) []Endpoint {
+		endpoints := make([]Endpoint, 0, n)
+		for i := 1; i <= n; i++ {
+			endpoints = append(endpoints, Endpoint{Address: fmt.Sprintf("node-%d", i)})
+		}
+		return endpoints
+	}
+	// movedFraction returns the fraction of series whose owner differs between the two hashrings.
+	movedFraction := func(t *testing.T, algorithm HashringAlgorithm, before, after []Endpoint) float64 {
+		hBefore, err := newHashring(algorithm, before, 1, "", nil)
+		require.NoError(t, err)
+		hAfter, err := newHashring(algorithm, after, 1, "", nil)
+		require.NoError(t, err)
+
+		var moved int
+		for _, ts := range series {
+			a, err := hBefore.Get("tenant", ts)
+			require.NoError(t, err)
+			b, err := hAfter.Get("tenant", ts)
+			require.NoError(t, err)
+			if a != b {
+				moved++
+			}
+		}
+		return float64(moved) / float64(len(series))
+	}
+
+	for _, tc := range []struct {
+		name          string
+		before, after []Endpoint
+		// Fraction of series which have to move at least, i.e. the share of the added or removed node.
+		optimal float64
+	}{
+		{name: "add node to 3 nodes", before: nodes(3), after: nodes(4), optimal: 1.0 / 4},
+		{name: "add node to 9 nodes", before: nodes(9), after: nodes(10), optimal: 1.0 / 10},
+		{name: "remove node from 4 nodes", before: nodes(4), after: nodes(3), optimal: 1.0 / 4},
+		{name: "remove node from 10 nodes", before: nodes(10), after: nodes(9), optimal: 1.0 / 10},
+		{name: "remove node in the middle", before: nodes(5), after: append(nodes(2), nodes(5)[3:]...), optimal: 1.0 / 5},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			ketama := movedFraction(t, AlgorithmKetama, tc.before, tc.after)
+			hashmod := movedFraction(t, AlgorithmHashmod, tc.before, tc.after)
+			t.Logf("moved series: ketama %.1f%%, hashmod %.1f%%, optimal %.1f%%", 100*ketama, 100*hashmod, 100*tc.optimal)
+
+			// The consistent hashing ring only moves the series of the added or removed node,
+			// give or take the imbalance of the ring.
+			require.InDelta(t, tc.optimal, ketama, 0.25*tc.optimal)
+			// Hashmod reshuffles most of the series.
+			require.Greater(t, hashmod, 0.5)
+		})
+	}
+}
+
 func TestInvalidAZHashringCfg(t *testing.T) {
 	for _, tt := range []struct {
 		cfg           []HashringConfig
@@ -0,0 +1,210 @@
+// Copyright (c) The Thanos Authors.
+// Licensed under the Apache License 2.0.
+
+package receive
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/go-kit/log"
+	"github.com/go-kit/log/level"
+	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/prometheus/tsdb"
+
+	"github.com/thanos-io/thanos/pkg/errutil"
+)
+
+// EarlyHeadCompactionOptions configures the compaction of the heads of tenants with many series, or
+// with a WAL to checkpoint, before the head spans a block range.
+type EarlyHeadCompactionOptions struct {
+	// SeriesThreshold is the number of head series of a tenant above which its head is compacted
+	// early. 0 disables early head compaction for tenants without a threshold of their own.
+	SeriesThreshold uint64
+	// TenantSeriesThresholds overrides SeriesThreshold per tenant. 0 disables early head compaction
+	// for the tenant.
+	TenantSeriesThresholds map[string]uint64
+	// KeepDuration is the duration of the most recent head data kept in the head, so that samples
+	// arriving late are not rejected as out of bounds. It is also the minimum duration of the
+	// blocks compacted early.
+	KeepDuration time.Duration
+	// WALCheckpointInterval is the duration of head data older than KeepDuration from which on the
+	// head of a tenant is compacted early. Compacting the head checkpoints the WAL, which bounds the
+	// WAL replayed after a crash to about KeepDuration+WALCheckpointInterval of data. It must be at
+	// least KeepDuration, the minimum duration of the blocks compacted early. 0 disables it for
+	// tenants without an interval of their own.
+	WALCheckpointInterval time.Duration
+	// TenantWALCheckpointIntervals overrides WALCheckpointInterval per tenant. 0 disables it for the
+	// tenant.
+	TenantWALCheckpointIntervals map[string]time.Duration
+}
+
+func (o EarlyHeadCompactionOptions) threshold(tenantID string) uint64 {
+	if threshold, ok := o.TenantSeriesThresholds[tenantID]; ok {
+		return threshold
+	}
+	return o.SeriesThreshold
+}
+
+func (o EarlyHeadCompactionOptions) walCheckpointInterval(tenantID string) time.Duration {
+	if interval, ok := o.TenantWALCheckpointIntervals[tenantID]; ok {
+		return interval
+	}
+	return o.WALCheckpointInterval
+}
+
+// Enabled returns true if the head of any tenant may be compacted early.
+func (o EarlyHeadCompactionOptions) Enabled() bool {
+	if o.SeriesThreshold > 0 || o.WALCheckpointInterval > 0 {
+		return true
+	}
+	for _, threshold := range o.TenantSeriesThresholds {
+		if threshold > 0 {
+			return true
+		}
+	}
+	for _, interval := range o.TenantWALCheckpointIntervals {
+		if interval > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// Validate returns an error if a WAL checkpoint interval is shorter than the keep duration, as the
+// head would not be compacted before its data older than the keep duration spans the keep duration.
+func (o EarlyHeadCompactionOptions) Validate() error {
+	if o.WALCheckpointInterval > 0 && o.WALCheckpointInterval < o.KeepDuration {
+		return errors.Errorf("WAL checkpoint interval %v is shorter than the early head compaction keep duration %v", o.WALCheckpointInterval, o.KeepDuration)
+	}
+	for tenant, interval := range o.TenantWALCheckpointIntervals {
+		if interval > 0 && interval < o.KeepDuration {
+			return errors.Errorf("WAL checkpoint interval %v of tenant %s is shorter than the early head compaction keep duration %v", interval, tenant, o.KeepDuration)
+		}
+	}
+	return nil
+}
+
+// WithEarlyHeadCompaction makes MultiTSDB compact the heads of tenants exceeding their series
+// threshold or their WAL checkpoint interval on CompactHeadsEarly, bounding the memory used by high
+// cardinality tenants and the WAL replay time between the regular head compactions.
+func WithEarlyHeadCompaction(opts EarlyHeadCompactionOptions) MultiTSDBOption {
+	return func(t *MultiTSDB) {
+		if opts.Enabled() {
+			t.earlyHeadCompaction = newEarlyHeadCompaction(t.reg, opts)
+		}
+	}
+}
+
+type earlyHeadCompaction struct {
+	opts EarlyHeadCompactionOptions
+
+	compactions *prometheus.CounterVec
+}
+
+func newEarlyHeadCompaction(reg prometheus.Registerer, opts EarlyHeadCompactionOptions) *earlyHeadCompaction {
+	return &earlyHeadCompaction{
+		opts: opts,
+		compactions: promauto.With(reg).NewCounterVec(prometheus.CounterOpts{
+			Name: "thanos_receive_early_head_compactions_total",
+			Help: "Number of early head compactions of tenants, by reason: their number of head series exceeding the threshold (series) or their head data exceeding the WAL checkpoint interval (wal_checkpoint).",
+		}, []string{"tenant", "reason"}),
+	}
+}
+
+// CompactHeadsEarly compacts the heads of the tenants whose number of head series exceeds their
+// threshold, or whose head data older than the keep duration spans their WAL checkpoint interval.
+// Only the head data older than the keep duration is compacted, into blocks aligned to the block
+// range, so that the blocks neither overlap nor conflict with the blocks of the regular head
+// compaction. It is a no-op if early head compaction is disabled.
+func (t *MultiTSDB) CompactHeadsEarly(ctx context.Context) error {
+	if t.earlyHeadCompaction == nil {
+		return nil
+	}
+
+	var (
+		wg   sync.WaitGroup
+		merr errutil.SyncMultiError
+	)
+	keep := t.earlyHeadCompaction.opts.KeepDuration.Milliseconds()
+	t.mtx.RLock()
+	for tenantID, tenantInstance := range t.tenants {
+		threshold := t.earlyHeadCompaction.opts.threshold(tenantID)
+		interval := t.earlyHeadCompaction.opts.walCheckpointInterval(tenantID)
+		if threshold == 0 && interval == 0 {
+			continue
+		}
+		db := tenantInstance.readyStorage().Get()
+		if db == nil {
+			continue
+		}
+		var reason string
+		if head := db.Head(); threshold > 0 && head.NumSeries() > threshold {
+			reason = "series"
+		} else if interval > 0 && head.MaxTime()-keep-head.MinTime() >= interval.Milliseconds() {
+			reason = "wal_checkpoint"
+		} else {
+			continue
+		}
+		// The compactions of quarantined tenants are stopped.
+		if t.quarantine != nil && t.checkQuarantine(tenantID, tenantInstance) != nil {
+			continue
+		}
+
+		wg.Add(1)
+		go func(tenantID, reason string, db *tsdb.DB) {
+			defer wg.Done()
+			tlog := log.With(t.logger, "tenant", tenantID)
+			compacted, err := t.compactHeadEarly(ctx, db)
+			if err != nil {
+				merr.Add(errors.Wrapf(err, "compact head of tenant %s", tenantID))
+				return
+			}
+			if compacted {
+				t.earlyHeadCompaction.compactions.WithLabelValues(tenantID, reason).Inc()
+				level.Info(tlog).Log("msg", "compacted head early", "reason", reason, "series_threshold", threshold, "wal_checkpoint_interval", interval, "head_series", db.Head().NumSeries())
+			}
+		}(tenantID, reason, db)
+	}
+	t.mtx.RUnlock()
+	wg.Wait()
+
+	return merr.Err()
+}
+
+// compactHeadEarly compacts the head data older than the keep duration, split at the block range
+// boundaries. It returns false if there was not enough head data to compact.
+func (t *MultiTSDB) compactHeadEarly(ctx context.Context, db *tsdb.DB) (bool, error) {
+	head := db.Head()
+	if head.MinTime() > head.MaxTime() {
+		return false, nil
+	}
+	keep := t.earlyHeadCompaction.opts.KeepDuration.Milliseconds()
+	cutoff := head.MaxTime() - keep
+	if cutoff <= head.MinTime() || cutoff-head.MinTime() < keep {
+		return false, nil
+	}
+
+	blockRange := t.tsdbOpts.MinBlockDuration
+	for mint := head.MinTime(); mint < cutoff; mint = head.MinTime() {
+		if err := ctx.Err(); err != nil {
+			return true, err
+		}
+		maxt := mint - mint%blockRange + blockRange
+		if maxt > cutoff {
+			maxt = cutoff
+		}
+		// The max time of the range head is inclusive.
+		if err := db.CompactHead(tsdb.NewRangeHead(head, mint, maxt-1)); err != nil {
+			return true, err
+		}
+		// Guard against looping if the head was not truncated.
+		if head.MinTime() <= mint {
+			break
+		}
+	}
+	return true, nil
+}
@@ -0,0 +1,133 @@
+// Copyright (c) The Thanos Authors.
+// Licensed under the Apache License 2.0.
+
+package receive
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/efficientgo/core/testutil"
+	"github.com/go-kit/log"
+	"github.com/prometheus/client_golang/prometheus"
+	promtest "github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/prometheus/prometheus/model/labels"
+	"github.com/prometheus/prometheus/tsdb"
+
+	"github.com/thanos-io/thanos/pkg/block/metadata"
+)
+
+func TestMultiTSDBCompactHeadsEarly(t *testing.T) {
+	m := NewMultiTSDB(t.TempDir(), log.NewNopLogger(), prometheus.NewRegistry(), &tsdb.Options{
+		MinBlockDuration:  (2 * time.Hour).Milliseconds(),
+		MaxBlockDuration:  (2 * time.Hour).Milliseconds(),
+		RetentionDuration: (6 * time.Hour).Milliseconds(),
+		NoLockfile:        true,
+	}, labels.FromStrings("replica", "test"), "tenant_id", nil, false, metadata.NoneFunc,
+		WithEarlyHeadCompaction(EarlyHeadCompactionOptions{
+			SeriesThreshold:        10,
+			TenantSeriesThresholds: map[string]uint64{"large": 100, "unlimited": 0},
+			KeepDuration:           15 * time.Minute,
+		}),
+	)
+	defer func() { testutil.Ok(t, m.Close()) }()
+
+	// Every tenant gets 20 series with samples from 1h30m to 2h45m, crossing a block range boundary.
+	start := time.UnixMilli(0).Add(90 * time.Minute)
+	for _, tenant := range []string{"small", "large", "unlimited"} {
+		for ts := start; !ts.After(start.Add(75 * time.Minute)); ts = ts.Add(time.Minute) {
+			for i := 0; i < 20; i++ {
+				testutil.Ok(t, appendSampleWithLabels(m, tenant, labels.FromStrings("series", fmt.Sprint(i)), ts))
+			}
+		}
+	}
+
+	testutil.Ok(t, m.CompactHeadsEarly(context.Background()))
+
+	blocks := func(tenant string) [][2]int64 {
+		var ranges [][2]int64
+		for _, b := range m.tenants[tenant].readyStorage().Get().Blocks() {
+			ranges = append(ranges, [2]int64{b.Meta().MinTime, b.Meta().MaxTime})
+		}
+		return ranges
+	}
+	// Only the head of the tenant exceeding its threshold is compacted, up to the keep duration and
+	// split at the block range boundary.
+	testutil.Equals(t, [][2]int64{
+		{start.UnixMilli(), (2 * time.Hour).Milliseconds()},
+		{(2 * time.Hour).Milliseconds(), start.Add(60 * time.Minute).UnixMilli()},
+	}, blocks("small"))
+	testutil.Equals(t, 0, len(blocks("large")))
+	testutil.Equals(t, 0, len(blocks("unlimited")))
+	testutil.Equals(t, start.Add(60*time.Minute).UnixMilli(), m.tenants["small"].readyStorage().Get().Head().MinTime())
+	testutil.Equals(t, 1.0, promtest.ToFloat64(m.earlyHeadCompaction.compactions.WithLabelValues("small", "series")))
+
+	// Samples within the keep duration are still accepted.
+	testutil.Ok(t, appendSampleWithLabels(m, "small", labels.FromStrings("series", "late"), start.Add(65*time.Minute)))
+
+	// Heads spanning less than twice the keep duration are not compacted again, to not create tiny blocks.
+	testutil.Ok(t, m.CompactHeadsEarly(context.Background()))
+	testutil.Equals(t, 2, len(blocks("small")))
+	testutil.Equals(t, 1.0, promtest.ToFloat64(m.earlyHeadCompaction.compactions.WithLabelValues("small", "series")))
+}
+
+func TestEarlyHeadCompactionOptions_Validate(t *testing.T) {
+	testutil.Ok(t, EarlyHeadCompactionOptions{KeepDuration: 15 * time.Minute}.Validate())
+	testutil.Ok(t, EarlyHeadCompactionOptions{
+		KeepDuration:                 15 * time.Minute,
+		WALCheckpointInterval:        15 * time.Minute,
+		TenantWALCheckpointIntervals: map[string]time.Duration{"disabled": 0, "rare": 2 * time.Hour},
+	}.Validate())
+
+	// Heads would only be compacted once their data older than the keep duration spans the keep duration.
+	testutil.NotOk(t, EarlyHeadCompactionOptions{KeepDuration: 15 * time.Minute, WALCheckpointInterval: 5 * time.Minute}.Validate())
+	testutil.NotOk(t, EarlyHeadCompactionOptions{
+		KeepDuration:                 15 * time.Minute,
+		WALCheckpointInterval:        30 * time.Minute,
+		TenantWALCheckpointIntervals: map[string]time.Duration{"frequent": 5 * time.Minute},
+	}.Validate())
+}
+
+func TestMultiTSDBCompactHeadsEarly_WALCheckpoint(t *testing.T) {
+	reg := prometheus.NewRegistry()
+	m := NewMultiTSDB(t.TempDir(), log.NewNopLogger(), reg, &tsdb.Options{
+		MinBlockDuration:  (2 * time.Hour).Milliseconds(),
+		MaxBlockDuration:  (2 * time.Hour).Milliseconds(),
+		RetentionDuration: (6 * time.Hour).Milliseconds(),
+		NoLockfile:        true,
+	}, labels.FromStrings("replica", "test"), "tenant_id", nil, false, metadata.NoneFunc,
+		WithEarlyHeadCompaction(EarlyHeadCompactionOptions{
+			KeepDuration:                 15 * time.Minute,
+			WALCheckpointInterval:        30 * time.Minute,
+			TenantWALCheckpointIntervals: map[string]time.Duration{"rare": 2 * time.Hour},
+		}),
+	)
+	defer func() { testutil.Ok(t, m.Close()) }()
+
+	// Every tenant gets a few series with samples from 1h30m to 2h15m.
+	start := time.UnixMilli(0).Add(90 * time.Minute)
+	for _, tenant := range []string{"frequent", "rare"} {
+		for ts := start; !ts.After(start.Add(45 * time.Minute)); ts = ts.Add(time.Minute) {
+			for i := 0; i < 3; i++ {
+				testutil.Ok(t, appendSampleWithLabels(m, tenant, labels.FromStrings("series", fmt.Sprint(i)), ts))
+			}
+		}
+	}
+
+	// Only the head data older than the keep duration spanning the checkpoint interval of the tenant is compacted.
+	testutil.Ok(t, m.CompactHeadsEarly(context.Background()))
+	testutil.Equals(t, 0, len(m.tenants["rare"].readyStorage().Get().Blocks()))
+	testutil.Equals(t, 1.0, promtest.ToFloat64(m.earlyHeadCompaction.compactions.WithLabelValues("frequent", "wal_checkpoint")))
+	testutil.Equals(t, start.Add(30*time.Minute).UnixMilli(), m.tenants["frequent"].readyStorage().Get().Head().MinTime())
+
+	// The head does not span the interval anymore.
+	testutil.Ok(t, m.CompactHeadsEarly(context.Background()))
+	testutil.Equals(t, 1.0, promtest.ToFloat64(m.earlyHeadCompaction.compactions.WithLabelValues("frequent", "wal_checkpoint")))
+
+	// The replay duration of the WAL is exposed per tenant.
+	n, err := promtest.GatherAndCount(reg, "prometheus_tsdb_data_replay_duration_seconds")
+	testutil.Ok(t, err)
+	testutil.Equals(t, 2, n)
+}
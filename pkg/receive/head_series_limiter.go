@@ -31,6 +31,12 @@ type headSeriesLimit struct {
 	metaMonitoringClient *http.Client
 	metaMonitoringQuery  string
 
+	// metaMonitoringUnavailable is true if the last meta-monitoring query failed. Before the first query,
+	// meta-monitoring is not known to be unavailable, so writes are not limited by the unavailable policy.
+	metaMonitoringUnavailable bool
+	unavailablePolicy         UnavailablePolicy
+	localHeadSeries           LocalHeadSeriesSource
+
 	configuredTenantLimit *prometheus.GaugeVec
 	limitedRequests       *prometheus.CounterVec
 	metaMonitoringErr     prometheus.Counter
@@ -42,6 +48,7 @@ func NewHeadSeriesLimit(w WriteLimitsConfig, registerer prometheus.Registerer, l
 	limit := &headSeriesLimit{
 		metaMonitoringURL:   w.GlobalLimits.metaMonitoringURL,
 		metaMonitoringQuery: w.GlobalLimits.MetaMonitoringLimitQuery,
+		unavailablePolicy:   w.GlobalLimits.MetaMonitoringUnavailablePolicy,
 		defaultLimit:        w.DefaultLimits.HeadSeriesLimit,
 		configuredTenantLimit: promauto.With(registerer).NewGaugeVec(
 			prometheus.GaugeOpts{
@@ -110,6 +117,9 @@ func (h *headSeriesLimit) QueryMetaMonitoring(ctx context.Context) error {
 	vectorRes, _, _, err := c.QueryInstant(ctx, h.metaMonitoringURL, h.metaMonitoringQuery, time.Now(), promclient.QueryOptions{Deduplicate: true})
 	if err != nil {
 		h.metaMonitoringErr.Inc()
+		h.mtx.Lock()
+		h.metaMonitoringUnavailable = true
+		h.mtx.Unlock()
 		return err
 	}
 
@@ -117,6 +127,7 @@ func (h *headSeriesLimit) QueryMetaMonitoring(ctx context.Context) error {
 
 	h.mtx.Lock()
 	defer h.mtx.Unlock()
+	h.metaMonitoringUnavailable = false
 	// Construct map of tenant name and current head series.
 	for _, e := range vectorRes {
 		for k, v := range e.Metric {
@@ -130,8 +141,29 @@ func (h *headSeriesLimit) QueryMetaMonitoring(ctx context.Context) error {
 	return nil
 }
 
+// inheritMetaMonitoring carries over the meta-monitoring state of the limiter replaced on a limits reload, so that a
+// reload neither forgets the active series nor a failure of meta-monitoring.
+func (h *headSeriesLimit) inheritMetaMonitoring(prev *headSeriesLimit) {
+	prev.mtx.RLock()
+	defer prev.mtx.RUnlock()
+	h.mtx.Lock()
+	defer h.mtx.Unlock()
+
+	h.metaMonitoringUnavailable = prev.metaMonitoringUnavailable
+	for tenant, v := range prev.tenantCurrentSeriesMap {
+		h.tenantCurrentSeriesMap[tenant] = v
+	}
+}
+
+// setLocalHeadSeries sets the source of the head series of tenants on the local instance.
+func (h *headSeriesLimit) setLocalHeadSeries(s LocalHeadSeriesSource) {
+	h.mtx.Lock()
+	defer h.mtx.Unlock()
+	h.localHeadSeries = s
+}
+
 // isUnderLimit ensures that the current number of active series for a tenant does not exceed given limit.
-// It does so in a best-effort way, i.e, in case meta-monitoring is unreachable, it does not impose limits.
+// While meta-monitoring cannot be queried, limits are imposed according to the configured UnavailablePolicy.
 func (h *headSeriesLimit) isUnderLimit(tenant string) (bool, error) {
 	h.mtx.RLock()
 	defer h.mtx.RUnlock()
@@ -139,18 +171,7 @@ func (h *headSeriesLimit) isUnderLimit(tenant string) (bool, error) {
 		return true, nil
 	}
 
-	// In such limiting flow, we ingest the first remote write request
-	// and then check meta-monitoring metric to ascertain current active
-	// series. As such metric is updated in intervals, it is possible
-	// that Receive ingests more series than the limit, before detecting that
-	// a tenant has exceeded the set limits.
-	v, ok := h.tenantCurrentSeriesMap[tenant]
-	if !ok {
-		return true, errors.Newf("tenant not in current series map")
-	}
-
-	var limit uint64
-	limit, ok = h.limitsPerTenant[tenant]
+	limit, ok := h.limitsPerTenant[tenant]
 	if !ok {
 		// Tenant has not been defined in config, so fallback to default.
 		limit = h.defaultLimit
@@ -161,6 +182,33 @@ func (h *headSeriesLimit) isUnderLimit(tenant string) (bool, error) {
 		return true, nil
 	}
 
+	var v float64
+	switch {
+	case h.metaMonitoringUnavailable && h.unavailablePolicy == UnavailablePolicyReject:
+		level.Error(h.logger).Log("msg", "rejecting request of limited tenant as meta-monitoring is unavailable", "tenant", tenant, "limit", limit)
+		h.limitedRequests.WithLabelValues(tenant).Inc()
+		return false, nil
+	case h.metaMonitoringUnavailable && h.unavailablePolicy == UnavailablePolicyLocal:
+		if h.localHeadSeries == nil {
+			return true, errors.Newf("no local head series to limit tenant while meta-monitoring is unavailable")
+		}
+		n, ok := h.localHeadSeries.TenantHeadSeries(tenant)
+		if !ok {
+			return true, nil
+		}
+		v = float64(n)
+	default:
+		// In such limiting flow, we ingest the first remote write request
+		// and then check meta-monitoring metric to ascertain current active
+		// series. As such metric is updated in intervals, it is possible
+		// that Receive ingests more series than the limit, before detecting that
+		// a tenant has exceeded the set limits.
+		v, ok = h.tenantCurrentSeriesMap[tenant]
+		if !ok {
+			return true, errors.Newf("tenant not in current series map")
+		}
+	}
+
 	if v >= float64(limit) {
 		level.Error(h.logger).Log("msg", "tenant above limit", "tenant", tenant, "currentSeries", v, "limit", limit)
 		h.limitedRequests.WithLabelValues(tenant).Inc()
@@ -0,0 +1,104 @@
+// Copyright (c) The Thanos Authors.
+// Licensed under the Apache License 2.0.
+
+package receive
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/prometheus/model/labels"
+	"github.com/prometheus/prometheus/storage"
+)
+
+// WithIdleTenantEviction makes MultiTSDB evict the TSDBs of tenants which have not received any
+// write for longer than ttl on Prune. 0 disables it.
+func WithIdleTenantEviction(ttl time.Duration) MultiTSDBOption {
+	return func(t *MultiTSDB) {
+		if ttl > 0 {
+			t.idleEviction = newIdleTenantEviction(t.reg, ttl)
+		}
+	}
+}
+
+type idleTenantEviction struct {
+	ttl time.Duration
+
+	evictions prometheus.Counter
+}
+
+func newIdleTenantEviction(reg prometheus.Registerer, ttl time.Duration) *idleTenantEviction {
+	return &idleTenantEviction{
+		ttl: ttl,
+		evictions: promauto.With(reg).NewCounter(prometheus.CounterOpts{
+			Name: "thanos_receive_idle_tenant_evictions_total",
+			Help: "Number of TSDBs of tenants evicted because they did not receive any write for longer than the idle tenant TTL.",
+		}),
+	}
+}
+
+// isIdle returns true if the TSDB of the tenant is evicted by Prune because it has not received any
+// write for longer than the idle tenant TTL. TSDBs are never evicted without object storage, as the
+// data of evicted tenants is only queryable once shipped.
+func (t *MultiTSDB) isIdle(tenantInstance *tenant) bool {
+	if t.idleEviction == nil || t.bucket == nil {
+		return false
+	}
+	return time.Since(time.UnixMilli(tenantInstance.lastWrite.Load())) > t.idleEviction.ttl
+}
+
+// evictableAppendable records the writes of a tenant whose TSDB is evicted when idle, and keeps it
+// from being evicted while appenders are in flight.
+type evictableAppendable struct {
+	Appendable
+
+	multiTSDB *MultiTSDB
+	tenantID  string
+	tenant    *tenant
+}
+
+func (a *evictableAppendable) Appender(ctx context.Context) (storage.Appender, error) {
+	a.tenant.writeMtx.RLock()
+	if a.tenant.pruned {
+		a.tenant.writeMtx.RUnlock()
+		// The TSDB was pruned since the tenant was looked up, the write opens a new one.
+		app, err := a.multiTSDB.TenantAppendable(a.tenantID)
+		if err != nil {
+			return nil, err
+		}
+		return app.Appender(ctx)
+	}
+	a.tenant.lastWrite.Store(time.Now().UnixMilli())
+
+	app, err := a.Appendable.Appender(ctx)
+	if err != nil {
+		a.tenant.writeMtx.RUnlock()
+		return nil, err
+	}
+	return &evictableAppender{Appender: app, release: a.tenant.writeMtx.RUnlock}, nil
+}
+
+// evictableAppender releases the tenant for eviction once its transaction is committed or rolled back.
+type evictableAppender struct {
+	storage.Appender
+
+	once    sync.Once
+	release func()
+}
+
+func (a *evictableAppender) GetRef(lset labels.Labels, hash uint64) (storage.SeriesRef, labels.Labels) {
+	return a.Appender.(storage.GetRef).GetRef(lset, hash)
+}
+
+func (a *evictableAppender) Commit() error {
+	defer a.once.Do(a.release)
+	return a.Appender.Commit()
+}
+
+func (a *evictableAppender) Rollback() error {
+	defer a.once.Do(a.release)
+	return a.Appender.Rollback()
+}
@@ -0,0 +1,135 @@
+// Copyright (c) The Thanos Authors.
+// Licensed under the Apache License 2.0.
+
+package receive
+
+import (
+	"context"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/efficientgo/core/testutil"
+	"github.com/go-kit/log"
+	"github.com/prometheus/client_golang/prometheus"
+	promtest "github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/prometheus/prometheus/model/labels"
+	"github.com/prometheus/prometheus/tsdb"
+	"github.com/thanos-io/objstore"
+
+	"github.com/thanos-io/thanos/pkg/block/metadata"
+	"github.com/thanos-io/thanos/pkg/runutil"
+)
+
+func TestMultiTSDBEvictIdleTenants(t *testing.T) {
+	ctx := context.Background()
+	bkt := objstore.NewInMemBucket()
+	m := NewMultiTSDB(t.TempDir(), log.NewNopLogger(), prometheus.NewRegistry(), &tsdb.Options{
+		MinBlockDuration:  (2 * time.Hour).Milliseconds(),
+		MaxBlockDuration:  (2 * time.Hour).Milliseconds(),
+		RetentionDuration: (6 * time.Hour).Milliseconds(),
+		NoLockfile:        true,
+	}, labels.FromStrings("replica", "test"), "tenant_id", bkt, false, metadata.NoneFunc,
+		WithIdleTenantEviction(time.Hour),
+	)
+	defer func() { testutil.Ok(t, m.Close()) }()
+
+	now := time.Now()
+	for _, tenant := range []string{"idle", "active"} {
+		testutil.Ok(t, appendSample(m, tenant, now))
+	}
+	testutil.Equals(t, 2, len(m.TSDBLocalClients()))
+	idleDir := m.tenants["idle"].readyStorage().Get().Dir()
+
+	// An in-flight appender of the idle tenant delays its eviction.
+	app, err := m.TenantAppendable("idle")
+	testutil.Ok(t, err)
+	a, err := app.Appender(ctx)
+	testutil.Ok(t, err)
+	_, err = a.Append(0, labels.FromStrings("foo", "bar"), now.Add(time.Second).UnixMilli(), 10)
+	testutil.Ok(t, err)
+	m.tenants["idle"].lastWrite.Store(now.Add(-2 * time.Hour).UnixMilli())
+
+	evicted := make(chan error)
+	go func() { evicted <- m.Prune(ctx) }()
+	select {
+	case err := <-evicted:
+		t.Fatalf("eviction did not wait for the in-flight appender: %v", err)
+	case <-time.After(100 * time.Millisecond):
+	}
+	testutil.Ok(t, a.Commit())
+	testutil.Ok(t, <-evicted)
+
+	// The head of the idle tenant was shipped before its TSDB was removed.
+	testutil.Equals(t, 1.0, promtest.ToFloat64(m.idleEviction.evictions))
+	testutil.Equals(t, 1, len(m.TSDBLocalClients()))
+	_, err = os.Stat(idleDir)
+	testutil.Assert(t, os.IsNotExist(err), "unexpected error %v", err)
+	var shipped int
+	testutil.Ok(t, bkt.Iter(ctx, "", func(string) error {
+		shipped++
+		return nil
+	}))
+	testutil.Equals(t, 1, shipped)
+
+	// Writes to the tenant looked up before the eviction open a new TSDB.
+	testutil.Ok(t, runutil.Retry(100*time.Millisecond, ctx.Done(), func() error {
+		var err error
+		a, err = app.Appender(ctx)
+		return err
+	}))
+	_, err = a.Append(0, labels.FromStrings("foo", "bar"), now.Add(time.Minute).UnixMilli(), 10)
+	testutil.Ok(t, err)
+	testutil.Ok(t, a.Commit())
+	testutil.Equals(t, 2, len(m.TSDBLocalClients()))
+
+	// Active tenants are not evicted.
+	testutil.Ok(t, m.Prune(ctx))
+	testutil.Equals(t, 1.0, promtest.ToFloat64(m.idleEviction.evictions))
+}
+
+func TestMultiTSDBEvictIdleTenants_WithoutBucket(t *testing.T) {
+	m := NewMultiTSDB(t.TempDir(), log.NewNopLogger(), prometheus.NewRegistry(), &tsdb.Options{
+		MinBlockDuration:  (2 * time.Hour).Milliseconds(),
+		MaxBlockDuration:  (2 * time.Hour).Milliseconds(),
+		RetentionDuration: (6 * time.Hour).Milliseconds(),
+		NoLockfile:        true,
+	}, labels.FromStrings("replica", "test"), "tenant_id", nil, false, metadata.NoneFunc,
+		WithIdleTenantEviction(time.Hour),
+	)
+	defer func() { testutil.Ok(t, m.Close()) }()
+
+	testutil.Ok(t, appendSample(m, "idle", time.Now()))
+	m.tenants["idle"].lastWrite.Store(time.Now().Add(-2 * time.Hour).UnixMilli())
+
+	// The data of the tenant would not be queryable anymore.
+	testutil.Ok(t, m.Prune(context.Background()))
+	testutil.Equals(t, 1, len(m.TSDBLocalClients()))
+	testutil.Equals(t, 0.0, promtest.ToFloat64(m.idleEviction.evictions))
+}
+
+func TestMultiTSDBEvictIdleTenants_InfiniteRetention(t *testing.T) {
+	ctx := context.Background()
+	bkt := objstore.NewInMemBucket()
+	m := NewMultiTSDB(t.TempDir(), log.NewNopLogger(), prometheus.NewRegistry(), &tsdb.Options{
+		MinBlockDuration: (2 * time.Hour).Milliseconds(),
+		MaxBlockDuration: (2 * time.Hour).Milliseconds(),
+		NoLockfile:       true,
+	}, labels.FromStrings("replica", "test"), "tenant_id", bkt, false, metadata.NoneFunc,
+		WithIdleTenantEviction(time.Hour),
+	)
+	defer func() { testutil.Ok(t, m.Close()) }()
+
+	// Tenants whose head is past the compaction threshold are kept with infinite retention.
+	old := time.Now().Add(-5 * time.Hour)
+	for _, tenant := range []string{"idle", "active"} {
+		testutil.Ok(t, appendSample(m, tenant, old))
+	}
+	m.tenants["idle"].lastWrite.Store(time.Now().Add(-2 * time.Hour).UnixMilli())
+
+	testutil.Ok(t, m.Prune(ctx))
+	testutil.Equals(t, 1.0, promtest.ToFloat64(m.idleEviction.evictions))
+	testutil.Equals(t, 1, len(m.TSDBLocalClients()))
+	_, ok := m.tenants["active"]
+	testutil.Assert(t, ok, "active tenant was pruned")
+}
@@ -27,7 +27,9 @@ type Limiter struct {
 	requestLimiter            requestLimiter
 	headSeriesLimiterMtx      sync.Mutex
 	headSeriesLimiter         headSeriesLimiter
+	localHeadSeries           LocalHeadSeriesSource
 	writeGate                 gate.Gate
+	maxWriteConcurrency       int
 	registerer                prometheus.Registerer
 	configPathOrContent       fileContent
 	logger                    log.Logger
@@ -43,6 +45,12 @@ type headSeriesLimiter interface {
 	isUnderLimit(tenant string) (bool, error)
 }
 
+// LocalHeadSeriesSource provides the head series of tenants on the local instance.
+type LocalHeadSeriesSource interface {
+	// TenantHeadSeries returns the number of head series of the tenant and false if the tenant has no local TSDB.
+	TenantHeadSeries(tenantID string) (uint64, bool)
+}
+
 type requestLimiter interface {
 	AllowSizeBytes(tenant string, contentLengthBytes int64) bool
 	AllowSeries(tenant string, amount int64) bool
@@ -62,6 +70,18 @@ func (l *Limiter) HeadSeriesLimiter() headSeriesLimiter {
 	return l.headSeriesLimiter
 }
 
+// SetLocalHeadSeries sets the source of the head series of tenants on the local instance, which are
+// limited while meta-monitoring is unavailable with the local unavailable policy.
+func (l *Limiter) SetLocalHeadSeries(s LocalHeadSeriesSource) {
+	l.headSeriesLimiterMtx.Lock()
+	defer l.headSeriesLimiterMtx.Unlock()
+
+	l.localHeadSeries = s
+	if h, ok := l.headSeriesLimiter.(*headSeriesLimit); ok {
+		h.setLocalHeadSeries(s)
+	}
+}
+
 // NewLimiter creates a new *Limiter given a configuration and prometheus
 // registerer.
 func NewLimiter(configFile fileContent, reg prometheus.Registerer, r ReceiverMode, logger log.Logger, configReloadTimer time.Duration) (*Limiter, error) {
@@ -144,6 +164,9 @@ func (l *Limiter) loadConfig() error {
 	if err != nil {
 		return err
 	}
+	if l.receiverMode == RouterOnly && config.WriteLimits.GlobalLimits.MetaMonitoringUnavailablePolicy == UnavailablePolicyLocal {
+		return errors.Errorf("meta-monitoring unavailable policy %s requires the receiver to ingest series", UnavailablePolicyLocal)
+	}
 	l.Lock()
 	defer l.Unlock()
 	maxWriteConcurrency := config.WriteLimits.GlobalLimits.MaxConcurrency
@@ -156,6 +179,7 @@ func (l *Limiter) loadConfig() error {
 			int(maxWriteConcurrency),
 			gate.WriteRequests,
 		)
+		l.maxWriteConcurrency = int(maxWriteConcurrency)
 	}
 	l.requestLimiter = newConfigRequestLimiter(
 		l.registerer,
@@ -174,7 +198,12 @@ func (l *Limiter) loadConfig() error {
 	}
 	if (l.receiverMode == RouterOnly || l.receiverMode == RouterIngestor) && seriesLimitIsActivated() {
 		l.headSeriesLimiterMtx.Lock()
-		l.headSeriesLimiter = NewHeadSeriesLimit(config.WriteLimits, l.registerer, l.logger)
+		h := NewHeadSeriesLimit(config.WriteLimits, l.registerer, l.logger)
+		h.localHeadSeries = l.localHeadSeries
+		if prev, ok := l.headSeriesLimiter.(*headSeriesLimit); ok {
+			h.inheritMetaMonitoring(prev)
+		}
+		l.headSeriesLimiter = h
 		l.headSeriesLimiterMtx.Unlock()
 	}
 	return nil
@@ -194,6 +223,13 @@ func (l *Limiter) WriteGate() gate.Gate {
 	return l.writeGate
 }
 
+// MaxWriteConcurrency is a safe getter for the maximum number of concurrent write requests, 0 if it is not limited.
+func (l *Limiter) MaxWriteConcurrency() int {
+	l.RLock()
+	defer l.RUnlock()
+	return l.maxWriteConcurrency
+}
+
 // ParseLimitConfigContent parses the limit configuration from the path or
 // content.
 func ParseLimitConfigContent(limitsConfig fileContent) (*RootLimitsConfig, error) {
@@ -45,6 +45,15 @@ func ParseRootLimitConfig(content []byte) (*RootLimitsConfig, error) {
 		root.WriteLimits.GlobalLimits.MetaMonitoringLimitQuery = "sum(prometheus_tsdb_head_series) by (tenant)"
 	}
 
+	switch root.WriteLimits.GlobalLimits.MetaMonitoringUnavailablePolicy {
+	case "":
+		root.WriteLimits.GlobalLimits.MetaMonitoringUnavailablePolicy = UnavailablePolicyBestEffort
+	case UnavailablePolicyBestEffort, UnavailablePolicyReject, UnavailablePolicyLocal:
+	default:
+		return nil, errors.Newf("unknown meta-monitoring unavailable policy %q, expected one of %s, %s or %s",
+			root.WriteLimits.GlobalLimits.MetaMonitoringUnavailablePolicy, UnavailablePolicyBestEffort, UnavailablePolicyReject, UnavailablePolicyLocal)
+	}
+
 	return &root, nil
 }
 
@@ -68,10 +77,26 @@ type GlobalLimitsConfig struct {
 	MetaMonitoringURL        string                         `yaml:"meta_monitoring_url"`
 	MetaMonitoringHTTPClient *clientconfig.HTTPClientConfig `yaml:"meta_monitoring_http_client"`
 	MetaMonitoringLimitQuery string                         `yaml:"meta_monitoring_limit_query"`
+	// MetaMonitoringUnavailablePolicy specifies how head series are limited while meta-monitoring cannot be queried.
+	MetaMonitoringUnavailablePolicy UnavailablePolicy `yaml:"meta_monitoring_unavailable_policy"`
 
 	metaMonitoringURL *url.URL
 }
 
+// UnavailablePolicy specifies how head series are limited while the active series of
+// tenants across the whole cluster cannot be retrieved from meta-monitoring.
+type UnavailablePolicy string
+
+const (
+	// UnavailablePolicyBestEffort keeps limiting head series with the active series last retrieved
+	// from meta-monitoring, if any. Tenants without known active series are not limited.
+	UnavailablePolicyBestEffort UnavailablePolicy = "best-effort"
+	// UnavailablePolicyReject rejects all remote write requests of tenants with a head series limit.
+	UnavailablePolicyReject UnavailablePolicy = "reject"
+	// UnavailablePolicyLocal enforces head series limits against the head series of tenants on the local instance.
+	UnavailablePolicyLocal UnavailablePolicy = "local"
+)
+
 type DefaultLimitsConfig struct {
 	// RequestLimits holds the difficult per-request limits.
 	RequestLimits requestLimitsConfig `yaml:"request"`
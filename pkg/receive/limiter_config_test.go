@@ -26,9 +26,10 @@ func TestParseLimiterConfig(t *testing.T) {
 			want: &RootLimitsConfig{
 				WriteLimits: WriteLimitsConfig{
 					GlobalLimits: GlobalLimitsConfig{
-						MaxConcurrency:           30,
-						MetaMonitoringURL:        "http://localhost:9090",
-						MetaMonitoringLimitQuery: "sum(prometheus_tsdb_head_series) by (tenant)",
+						MaxConcurrency:                  30,
+						MetaMonitoringURL:               "http://localhost:9090",
+						MetaMonitoringLimitQuery:        "sum(prometheus_tsdb_head_series) by (tenant)",
+						MetaMonitoringUnavailablePolicy: UnavailablePolicyBestEffort,
 						metaMonitoringURL: &url.URL{
 							Scheme: "http",
 							Host:   "localhost:9090",
@@ -5,6 +5,10 @@ package receive
 
 import (
 	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
 	"os"
 	"path"
 	"testing"
@@ -14,6 +18,8 @@ import (
 
 	"github.com/efficientgo/core/testutil"
 	"github.com/go-kit/log"
+	"github.com/prometheus/client_golang/prometheus"
+	"go.uber.org/atomic"
 )
 
 func TestLimiter_StartConfigReloader(t *testing.T) {
@@ -98,3 +104,116 @@ func TestLimiter_CanReload(t *testing.T) {
 		})
 	}
 }
+
+type fakeLocalHeadSeries map[string]uint64
+
+func (f fakeLocalHeadSeries) TenantHeadSeries(tenantID string) (uint64, bool) {
+	n, ok := f[tenantID]
+	return n, ok
+}
+
+func TestHeadSeriesLimit_UnavailablePolicy(t *testing.T) {
+	newLimit := func(policy UnavailablePolicy, state string) *headSeriesLimit {
+		h := NewHeadSeriesLimit(WriteLimitsConfig{
+			GlobalLimits:  GlobalLimitsConfig{MetaMonitoringUnavailablePolicy: policy},
+			DefaultLimits: DefaultLimitsConfig{HeadSeriesLimit: 10},
+			TenantsLimits: TenantsWriteLimitsConfig{"unlimited": NewEmptyWriteLimitConfig().SetHeadSeriesLimit(0)},
+		}, prometheus.NewRegistry(), log.NewNopLogger())
+		h.setLocalHeadSeries(fakeLocalHeadSeries{"above": 5, "below": 20})
+		if state == "unknown" {
+			// Meta-monitoring was not queried yet.
+			return h
+		}
+		h.metaMonitoringUnavailable = state == "unavailable"
+		h.tenantCurrentSeriesMap = map[string]float64{"above": 20, "below": 5}
+		return h
+	}
+
+	for _, tc := range []struct {
+		policy   UnavailablePolicy
+		state    string
+		expected map[string]bool
+	}{
+		{policy: UnavailablePolicyBestEffort, state: "available", expected: map[string]bool{"above": false, "below": true, "unlimited": true, "unknown": true}},
+		{policy: UnavailablePolicyReject, state: "available", expected: map[string]bool{"above": false, "below": true, "unlimited": true, "unknown": true}},
+		{policy: UnavailablePolicyBestEffort, state: "unavailable", expected: map[string]bool{"above": false, "below": true, "unlimited": true, "unknown": true}},
+		{policy: UnavailablePolicyReject, state: "unavailable", expected: map[string]bool{"above": false, "below": false, "unlimited": true, "unknown": false}},
+		{policy: UnavailablePolicyLocal, state: "unavailable", expected: map[string]bool{"above": true, "below": false, "unlimited": true, "unknown": true}},
+		{policy: UnavailablePolicyReject, state: "unknown", expected: map[string]bool{"above": true, "below": true, "unlimited": true, "unknown": true}},
+		{policy: UnavailablePolicyLocal, state: "unknown", expected: map[string]bool{"above": true, "below": true, "unlimited": true, "unknown": true}},
+	} {
+		t.Run(fmt.Sprintf("%s,state=%s", tc.policy, tc.state), func(t *testing.T) {
+			h := newLimit(tc.policy, tc.state)
+			for tenant, expected := range tc.expected {
+				under, _ := h.isUnderLimit(tenant)
+				testutil.Equals(t, expected, under, "tenant %s", tenant)
+			}
+		})
+	}
+}
+
+func TestHeadSeriesLimit_MetaMonitoringFailure(t *testing.T) {
+	var fail atomic.Bool
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if fail.Load() {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		_, _ = w.Write([]byte(`{"status":"success","data":{"resultType":"vector","result":[{"metric":{"tenant":"below"},"value":[0,"5"]}]}}`))
+	}))
+	defer srv.Close()
+	u, err := url.Parse(srv.URL)
+	testutil.Ok(t, err)
+
+	newLimit := func() *headSeriesLimit {
+		return NewHeadSeriesLimit(WriteLimitsConfig{
+			GlobalLimits: GlobalLimitsConfig{
+				MetaMonitoringLimitQuery:        "sum(prometheus_tsdb_head_series) by (tenant)",
+				MetaMonitoringUnavailablePolicy: UnavailablePolicyReject,
+				metaMonitoringURL:               u,
+			},
+			DefaultLimits: DefaultLimitsConfig{HeadSeriesLimit: 10},
+		}, prometheus.NewRegistry(), log.NewNopLogger())
+	}
+	isUnderLimit := func(h *headSeriesLimit) bool {
+		under, _ := h.isUnderLimit("below")
+		return under
+	}
+
+	// Writes are accepted before meta-monitoring is queried.
+	h := newLimit()
+	testutil.Assert(t, isUnderLimit(h))
+	testutil.Ok(t, h.QueryMetaMonitoring(context.Background()))
+	testutil.Assert(t, isUnderLimit(h))
+
+	// Writes are only rejected once a query failed, also after a limits reload.
+	fail.Store(true)
+	testutil.NotOk(t, h.QueryMetaMonitoring(context.Background()))
+	testutil.Assert(t, !isUnderLimit(h))
+	reloaded := newLimit()
+	reloaded.inheritMetaMonitoring(h)
+	testutil.Assert(t, !isUnderLimit(reloaded))
+
+	fail.Store(false)
+	testutil.Ok(t, reloaded.QueryMetaMonitoring(context.Background()))
+	testutil.Assert(t, isUnderLimit(reloaded))
+}
+
+func TestLimiter_LocalUnavailablePolicyRequiresIngestion(t *testing.T) {
+	limitsPath := path.Join(t.TempDir(), "limits.yaml")
+	testutil.Ok(t, os.WriteFile(limitsPath, []byte(`write:
+  global:
+    meta_monitoring_url: "http://localhost:9090"
+    meta_monitoring_unavailable_policy: local
+  default:
+    head_series_limit: 10
+`), 0666))
+	config, err := extkingpin.NewStaticPathContent(limitsPath)
+	testutil.Ok(t, err)
+
+	_, err = NewLimiter(config, nil, RouterOnly, log.NewNopLogger(), 0)
+	testutil.NotOk(t, err)
+
+	_, err = NewLimiter(config, nil, RouterIngestor, log.NewNopLogger(), 0)
+	testutil.Ok(t, err)
+}
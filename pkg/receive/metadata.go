@@ -0,0 +1,214 @@
+// Copyright (c) The Thanos Authors.
+// Licensed under the Apache License 2.0.
+
+package receive
+
+import (
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+
+	"github.com/thanos-io/thanos/pkg/metadata/metadatapb"
+	"github.com/thanos-io/thanos/pkg/store/storepb/prompb"
+)
+
+// MetricMetadataAppender stores the metric metadata of tenants.
+type MetricMetadataAppender interface {
+	AppendMetricMetadata(tenantID string, mds []*prompb.MetricMetadata)
+}
+
+// MetricMetadataOptions configures how the metric metadata received with remote write requests is stored.
+type MetricMetadataOptions struct {
+	// Limit is the maximum number of metadata entries stored per tenant. Metadata is not stored if it is 0.
+	Limit int
+	// TTL is the time after which the metadata of a metric is removed if it was not received again.
+	TTL time.Duration
+}
+
+// WithMetricMetadata stores the metric metadata received with remote write requests in memory, to be served by
+// the metadata API.
+func WithMetricMetadata(opts MetricMetadataOptions) MultiTSDBOption {
+	return func(t *MultiTSDB) {
+		if opts.Limit > 0 {
+			t.metadata = newMetricMetadataStore(t.reg, opts, time.Now)
+		}
+	}
+}
+
+type metadataEntry struct {
+	typ, help, unit string
+}
+
+// metricMetadataStore stores the metadata of the metrics of each tenant, with the last time it was received.
+type metricMetadataStore struct {
+	opts MetricMetadataOptions
+	now  func() time.Time
+
+	mtx sync.Mutex
+	// tenants maps tenants to metric names to metadata.
+	tenants map[string]map[string]map[metadataEntry]time.Time
+	// entries is the number of metadata entries of each tenant.
+	entries map[string]int
+
+	discarded *prometheus.CounterVec
+}
+
+func newMetricMetadataStore(reg prometheus.Registerer, opts MetricMetadataOptions, now func() time.Time) *metricMetadataStore {
+	return &metricMetadataStore{
+		opts:    opts,
+		now:     now,
+		tenants: map[string]map[string]map[metadataEntry]time.Time{},
+		entries: map[string]int{},
+		discarded: promauto.With(reg).NewCounterVec(prometheus.CounterOpts{
+			Name: "thanos_receive_metric_metadata_discarded_total",
+			Help: "Number of metric metadata entries discarded because the tenant reached the metadata limit.",
+		}, []string{"tenant"}),
+	}
+}
+
+// append stores the given metadata of the tenant. New entries are discarded once the tenant reached the limit.
+func (s *metricMetadataStore) append(tenant string, mds []*prompb.MetricMetadata) {
+	now := s.now()
+
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	metrics, ok := s.tenants[tenant]
+	if !ok {
+		metrics = map[string]map[metadataEntry]time.Time{}
+		s.tenants[tenant] = metrics
+	}
+	expired := false
+	discarded := 0
+	for _, md := range mds {
+		if md.MetricFamilyName == "" {
+			continue
+		}
+		e := metadataEntry{typ: strings.ToLower(md.Type.String()), help: md.Help, unit: md.Unit}
+		if _, ok := metrics[md.MetricFamilyName][e]; !ok && s.entries[tenant] >= s.opts.Limit {
+			if !expired {
+				// Make room by removing the expired entries first, at most once per request.
+				s.expire(tenant, now)
+				expired = true
+			}
+			if s.entries[tenant] >= s.opts.Limit {
+				discarded++
+				continue
+			}
+		}
+		entries, ok := metrics[md.MetricFamilyName]
+		if !ok {
+			entries = map[metadataEntry]time.Time{}
+			metrics[md.MetricFamilyName] = entries
+		}
+		if _, ok := entries[e]; !ok {
+			s.entries[tenant]++
+		}
+		entries[e] = now
+	}
+	if discarded > 0 {
+		s.discarded.WithLabelValues(tenant).Add(float64(discarded))
+	}
+	s.removeIfEmpty(tenant)
+}
+
+// expire removes the entries of the tenant which were not received within the TTL.
+func (s *metricMetadataStore) expire(tenant string, now time.Time) {
+	metrics := s.tenants[tenant]
+	for name, entries := range metrics {
+		for e, ts := range entries {
+			if now.Sub(ts) > s.opts.TTL {
+				delete(entries, e)
+				s.entries[tenant]--
+			}
+		}
+		if len(entries) == 0 {
+			delete(metrics, name)
+		}
+	}
+}
+
+// removeIfEmpty removes the tenant if it has no metadata left.
+func (s *metricMetadataStore) removeIfEmpty(tenant string) {
+	if len(s.tenants[tenant]) == 0 {
+		delete(s.tenants, tenant)
+		delete(s.entries, tenant)
+	}
+}
+
+// metadata returns the metadata of the given tenant, or of all tenants if empty, of the given metric only if not
+// empty. At most limit metrics are returned if limit is positive.
+func (s *metricMetadataStore) metadata(tenantID, metric string, limit int) map[string][]*metadatapb.Meta {
+	now := s.now()
+
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	merged := map[string]map[metadataEntry]struct{}{}
+	for tenant := range s.tenants {
+		if tenantID != "" && tenant != tenantID {
+			continue
+		}
+		s.expire(tenant, now)
+		s.removeIfEmpty(tenant)
+		for name, entries := range s.tenants[tenant] {
+			if metric != "" && name != metric {
+				continue
+			}
+			if _, ok := merged[name]; !ok {
+				merged[name] = map[metadataEntry]struct{}{}
+			}
+			for e := range entries {
+				merged[name][e] = struct{}{}
+			}
+		}
+	}
+
+	names := make([]string, 0, len(merged))
+	for name := range merged {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	if limit > 0 && len(names) > limit {
+		names = names[:limit]
+	}
+	res := make(map[string][]*metadatapb.Meta, len(names))
+	for _, name := range names {
+		metas := make([]*metadatapb.Meta, 0, len(merged[name]))
+		for e := range merged[name] {
+			metas = append(metas, &metadatapb.Meta{Type: e.typ, Help: e.help, Unit: e.unit})
+		}
+		sort.Slice(metas, func(i, j int) bool {
+			if metas[i].Type != metas[j].Type {
+				return metas[i].Type < metas[j].Type
+			}
+			if metas[i].Help != metas[j].Help {
+				return metas[i].Help < metas[j].Help
+			}
+			return metas[i].Unit < metas[j].Unit
+		})
+		res[name] = metas
+	}
+	return res
+}
+
+// AppendMetricMetadata stores the metric metadata of the tenant, if storing metadata is enabled.
+func (t *MultiTSDB) AppendMetricMetadata(tenantID string, mds []*prompb.MetricMetadata) {
+	if t.metadata == nil || len(mds) == 0 {
+		return
+	}
+	t.metadata.append(tenantID, mds)
+}
+
+// MetricMetadata returns the metric metadata stored for the given tenant, or merged across all tenants if empty,
+// of the given metric only if not empty. At most limit metrics are returned if limit is positive.
+func (t *MultiTSDB) MetricMetadata(tenantID, metric string, limit int) map[string][]*metadatapb.Meta {
+	if t.metadata == nil {
+		return map[string][]*metadatapb.Meta{}
+	}
+	return t.metadata.metadata(tenantID, metric, limit)
+}
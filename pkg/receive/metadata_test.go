@@ -0,0 +1,91 @@
+// Copyright (c) The Thanos Authors.
+// Licensed under the Apache License 2.0.
+
+package receive
+
+import (
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/efficientgo/core/testutil"
+	"github.com/prometheus/client_golang/prometheus"
+	promtestutil "github.com/prometheus/client_golang/prometheus/testutil"
+
+	"github.com/thanos-io/thanos/pkg/metadata/metadatapb"
+	"github.com/thanos-io/thanos/pkg/store/storepb/prompb"
+)
+
+func TestMetricMetadataStore(t *testing.T) {
+	now := time.Unix(0, 0)
+	s := newMetricMetadataStore(prometheus.NewRegistry(), MetricMetadataOptions{Limit: 3, TTL: 10 * time.Minute}, func() time.Time { return now })
+
+	s.append("a", []*prompb.MetricMetadata{
+		{Type: prompb.MetricMetadata_COUNTER, MetricFamilyName: "http_requests_total", Help: "Requests."},
+		{Type: prompb.MetricMetadata_GAUGE, MetricFamilyName: "up", Help: "Up."},
+		{Type: prompb.MetricMetadata_HISTOGRAM, MetricFamilyName: "duration_seconds", Help: "Duration.", Unit: "seconds"},
+		// Discarded, the tenant reached its limit.
+		{Type: prompb.MetricMetadata_GAUGE, MetricFamilyName: "temperature", Help: "Temperature."},
+	})
+	s.append("b", []*prompb.MetricMetadata{
+		{Type: prompb.MetricMetadata_GAUGE, MetricFamilyName: "up", Help: "Up."},
+		{Type: prompb.MetricMetadata_GAUGE, MetricFamilyName: "temperature", Help: "Temperature."},
+	})
+	testutil.Equals(t, 1.0, promtestutil.ToFloat64(s.discarded.WithLabelValues("a")))
+
+	// Metadata of all tenants is merged.
+	testutil.Equals(t, map[string][]*metadatapb.Meta{
+		"duration_seconds":    {{Type: "histogram", Help: "Duration.", Unit: "seconds"}},
+		"http_requests_total": {{Type: "counter", Help: "Requests."}},
+		"temperature":         {{Type: "gauge", Help: "Temperature."}},
+		"up":                  {{Type: "gauge", Help: "Up."}},
+	}, s.metadata("", "", 0))
+	testutil.Equals(t, map[string][]*metadatapb.Meta{"up": {{Type: "gauge", Help: "Up."}}}, s.metadata("", "up", 0))
+	testutil.Equals(t, 2, len(s.metadata("", "", 2)))
+
+	// Metadata of a single tenant.
+	testutil.Equals(t, map[string][]*metadatapb.Meta{
+		"temperature": {{Type: "gauge", Help: "Temperature."}},
+		"up":          {{Type: "gauge", Help: "Up."}},
+	}, s.metadata("b", "", 0))
+	testutil.Equals(t, map[string][]*metadatapb.Meta{}, s.metadata("b", "http_requests_total", 0))
+	testutil.Equals(t, map[string][]*metadatapb.Meta{}, s.metadata("unknown", "", 0))
+
+	// Metadata which is not received again expires, making room for other metadata.
+	now = now.Add(6 * time.Minute)
+	s.append("a", []*prompb.MetricMetadata{
+		{Type: prompb.MetricMetadata_COUNTER, MetricFamilyName: "http_requests_total", Help: "Requests."},
+		{Type: prompb.MetricMetadata_GAUGE, MetricFamilyName: "up", Help: "Up."},
+	})
+	now = now.Add(6 * time.Minute)
+	s.append("a", []*prompb.MetricMetadata{{Type: prompb.MetricMetadata_GAUGE, MetricFamilyName: "temperature", Help: "Temperature, changed."}})
+	testutil.Equals(t, map[string][]*metadatapb.Meta{
+		"http_requests_total": {{Type: "counter", Help: "Requests."}},
+		"temperature":         {{Type: "gauge", Help: "Temperature, changed."}},
+		"up":                  {{Type: "gauge", Help: "Up."}},
+	}, s.metadata("", "", 0))
+	testutil.Equals(t, 3, s.entries["a"])
+	testutil.Equals(t, 1, len(s.tenants))
+
+	now = now.Add(time.Hour)
+	testutil.Equals(t, map[string][]*metadatapb.Meta{}, s.metadata("", "", 0))
+	testutil.Equals(t, 0, len(s.tenants))
+}
+
+func TestReceiveHTTPMetricMetadata(t *testing.T) {
+	handlers, _, err := newTestHandlerHashring([]*fakeAppendable{{appender: newFakeAppender(nil, nil, nil)}}, 1, AlgorithmHashmod)
+	testutil.Ok(t, err)
+	handler := handlers[0]
+
+	m := NewMultiTSDB(t.TempDir(), nil, prometheus.NewRegistry(), nil, nil, "tenant_id", nil, false, "", WithMetricMetadata(MetricMetadataOptions{Limit: 10, TTL: time.Minute}))
+	handler.options.MetadataAppender = m
+
+	// Metadata only requests are accepted and stored.
+	rec, err := makeRequest(handler, "team-a", &prompb.WriteRequest{Metadata: []*prompb.MetricMetadata{
+		{Type: prompb.MetricMetadata_COUNTER, MetricFamilyName: "http_requests_total", Help: "Requests."},
+	}})
+	testutil.Ok(t, err)
+	testutil.Equals(t, http.StatusOK, rec.Code)
+	testutil.Equals(t, map[string][]*metadatapb.Meta{"http_requests_total": {{Type: "counter", Help: "Requests."}}}, m.MetricMetadata("team-a", "", 0))
+	testutil.Equals(t, map[string][]*metadatapb.Meta{}, m.MetricMetadata("team-b", "", 0))
+}
@@ -19,7 +19,6 @@ import (
 	"github.com/oklog/ulid"
 	"github.com/pkg/errors"
 	"go.uber.org/atomic"
-	"golang.org/x/exp/slices"
 	"golang.org/x/sync/errgroup"
 	gmetadata "google.golang.org/grpc/metadata"
 
@@ -33,6 +32,8 @@ import (
 	"github.com/thanos-io/objstore"
 
 	"github.com/thanos-io/thanos/pkg/api/status"
+	"github.com/thanos-io/thanos/pkg/block"
+	"github.com/thanos-io/thanos/pkg/block/lifecycle"
 	"github.com/thanos-io/thanos/pkg/block/metadata"
 	"github.com/thanos-io/thanos/pkg/component"
 	"github.com/thanos-io/thanos/pkg/errutil"
@@ -64,6 +65,33 @@ type MultiTSDB struct {
 	allowOutOfOrderUpload bool
 	hashFunc              metadata.HashFunc
 	hashringConfigs       []HashringConfig
+
+	// quarantine is nil if tenants are never quarantined.
+	quarantine *tenantQuarantine
+	// earlyHeadCompaction is nil if heads are only compacted by the TSDBs.
+	earlyHeadCompaction *earlyHeadCompaction
+	// idleEviction is nil if the TSDBs of idle tenants are kept open.
+	idleEviction *idleTenantEviction
+	// metadata is nil if the metric metadata received with remote write requests is not stored.
+	metadata *metricMetadataStore
+	// blockEvents is notified of the blocks uploaded by the shippers of the tenants.
+	blockEvents lifecycle.Notifier
+
+	// tenantRemovedFns are called with the ID of every tenant removed from tenants, with mtx held.
+	tenantRemovedFns []func(tenantID string)
+
+	// blockUploadMtx serializes the conflict checks of uploaded blocks with adding them to the tenants' storage.
+	blockUploadMtx sync.Mutex
+}
+
+// MultiTSDBOption is a functional option for MultiTSDB.
+type MultiTSDBOption func(t *MultiTSDB)
+
+// WithBlockEvents makes the shippers of the tenants notify n of the blocks they upload.
+func WithBlockEvents(n lifecycle.Notifier) MultiTSDBOption {
+	return func(t *MultiTSDB) {
+		t.blockEvents = n
+	}
 }
 
 // NewMultiTSDB creates new MultiTSDB.
@@ -78,12 +106,13 @@ func NewMultiTSDB(
 	bucket objstore.Bucket,
 	allowOutOfOrderUpload bool,
 	hashFunc metadata.HashFunc,
+	options ...MultiTSDBOption,
 ) *MultiTSDB {
 	if l == nil {
 		l = log.NewNopLogger()
 	}
 
-	return &MultiTSDB{
+	mt := &MultiTSDB{
 		dataDir:               dataDir,
 		logger:                log.With(l, "component", "multi-tsdb"),
 		reg:                   reg,
@@ -95,7 +124,12 @@ func NewMultiTSDB(
 		bucket:                bucket,
 		allowOutOfOrderUpload: allowOutOfOrderUpload,
 		hashFunc:              hashFunc,
+		blockEvents:           lifecycle.NopNotifier{},
 	}
+	for _, option := range options {
+		option(mt)
+	}
+	return mt
 }
 
 type localClient struct {
@@ -224,6 +258,17 @@ type tenant struct {
 	mtx  *sync.RWMutex
 	tsdb *tsdb.DB
 
+	// failedCompactions tracks the failed compactions of the TSDB if tenants can be quarantined.
+	failedCompactions *failedCompactionsRegisterer
+
+	// writeMtx is held for reading by the in-flight appenders of the tenant if idle tenants are
+	// evicted, and for writing while its TSDB is pruned.
+	writeMtx sync.RWMutex
+	// pruned is true once the TSDB of the tenant was pruned. Writes go to a new tenant instead.
+	pruned bool
+	// lastWrite is the time of the last appender of the tenant in Unix milliseconds.
+	lastWrite atomic.Int64
+
 	// For tests.
 	blocksToDeleteFn func(db *tsdb.DB) tsdb.BlocksToDeleteFunc
 }
@@ -252,10 +297,12 @@ func (t *tenant) blocksToDelete(blocks []*tsdb.Block) map[ulid.ULID]struct{} {
 }
 
 func newTenant() *tenant {
-	return &tenant{
+	t := &tenant{
 		readyS: &ReadyStorage{},
 		mtx:    &sync.RWMutex{},
 	}
+	t.lastWrite.Store(time.Now().UnixMilli())
+	return t
 }
 
 func (t *tenant) readyStorage() *ReadyStorage {
@@ -287,10 +334,12 @@ func (t *tenant) shipper() *shipper.Shipper {
 }
 
 func (t *tenant) set(storeTSDB *store.TSDBStore, tenantTSDB *tsdb.DB, ship *shipper.Shipper, exemplarsTSDB *exemplars.TSDB) {
-	t.readyS.Set(tenantTSDB)
+	// Expose the TSDB on the StoreAPI before accepting writes, so that every
+	// acknowledged sample is visible to queries right away.
 	t.mtx.Lock()
 	t.setComponents(storeTSDB, ship, exemplarsTSDB, tenantTSDB)
 	t.mtx.Unlock()
+	t.readyS.Set(tenantTSDB)
 }
 
 func (t *tenant) setComponents(storeTSDB *store.TSDBStore, ship *shipper.Shipper, exemplarsTSDB *exemplars.TSDB, tenantTSDB *tsdb.DB) {
@@ -355,6 +404,35 @@ func (t *MultiTSDB) Flush() error {
 	return merr.Err()
 }
 
+// DrainTenant flushes the head of the tenant and uploads its blocks, if uploads are enabled.
+func (t *MultiTSDB) DrainTenant(ctx context.Context, tenantID string) (int, error) {
+	t.mtx.RLock()
+	tenant, ok := t.tenants[tenantID]
+	t.mtx.RUnlock()
+	if !ok {
+		return 0, nil
+	}
+
+	db := tenant.readyStorage().Get()
+	if db == nil {
+		return 0, ErrNotReady
+	}
+	level.Info(t.logger).Log("msg", "flushing TSDB", "tenant", tenantID)
+	if err := t.flushHead(db); err != nil {
+		return 0, errors.Wrap(err, "flush head")
+	}
+
+	s := tenant.shipper()
+	if s == nil {
+		return 0, nil
+	}
+	uploaded, err := s.Sync(ctx)
+	if err != nil {
+		return uploaded, errors.Wrap(err, "upload")
+	}
+	return uploaded, nil
+}
+
 func (t *MultiTSDB) flushHead(db *tsdb.DB) error {
 	head := db.Head()
 	if head.MinTime() == head.MaxTime() {
@@ -390,7 +468,7 @@ func (t *MultiTSDB) Close() error {
 // any new samples for longer than the TSDB retention period.
 func (t *MultiTSDB) Prune(ctx context.Context) error {
 	// Retention of 0 means infinite retention.
-	if t.tsdbOpts.RetentionDuration == 0 {
+	if t.tsdbOpts.RetentionDuration == 0 && t.idleEviction == nil {
 		return nil
 	}
 	level.Info(t.logger).Log("msg", "Running pruning job")
@@ -398,9 +476,6 @@ func (t *MultiTSDB) Prune(ctx context.Context) error {
 	var (
 		wg   sync.WaitGroup
 		merr errutil.SyncMultiError
-
-		prunedTenants []string
-		pmtx          sync.Mutex
 	)
 	t.mtx.RLock()
 	for tenantID, tenantInstance := range t.tenants {
@@ -408,40 +483,45 @@ func (t *MultiTSDB) Prune(ctx context.Context) error {
 		go func(tenantID string, tenantInstance *tenant) {
 			defer wg.Done()
 			tlog := log.With(t.logger, "tenant", tenantID)
+
+			// Writes of the tenant wait for it to be pruned and removed, then go to a new tenant.
+			tenantInstance.writeMtx.Lock()
+			defer tenantInstance.writeMtx.Unlock()
+
 			pruned, err := t.pruneTSDB(ctx, tlog, tenantInstance)
 			if err != nil {
 				merr.Add(err)
 				return
 			}
+			if !pruned {
+				return
+			}
 
-			if pruned {
-				pmtx.Lock()
-				defer pmtx.Unlock()
-				prunedTenants = append(prunedTenants, tenantID)
+			t.mtx.Lock()
+			// Check that the tenant hasn't been reinitialized in-between locks.
+			if t.tenants[tenantID] == tenantInstance && tenantInstance.readyStorage().get() == nil {
+				level.Info(t.logger).Log("msg", "Pruned tenant", "tenant", tenantID)
+				t.removeTenant(tenantID)
 			}
+			t.mtx.Unlock()
+			tenantInstance.pruned = true
 		}(tenantID, tenantInstance)
 	}
-	wg.Wait()
 	t.mtx.RUnlock()
-
-	t.mtx.Lock()
-	defer t.mtx.Unlock()
-	for _, tenantID := range prunedTenants {
-		// Check that the tenant hasn't been reinitialized in-between locks.
-		if t.tenants[tenantID].readyStorage().get() != nil {
-			continue
-		}
-
-		level.Info(t.logger).Log("msg", "Pruned tenant", "tenant", tenantID)
-		delete(t.tenants, tenantID)
-	}
+	wg.Wait()
 
 	return merr.Err()
 }
 
-// pruneTSDB removes a TSDB if its past the retention period.
+// pruneTSDB removes a TSDB if its past the retention period, or if the tenant is idle.
 // It compacts the TSDB head, sends all remaining blocks to S3 and removes the TSDB from disk.
 func (t *MultiTSDB) pruneTSDB(ctx context.Context, logger log.Logger, tenantInstance *tenant) (pruned bool, rerr error) {
+	idle := t.isIdle(tenantInstance)
+	// Retention of 0 means infinite retention.
+	if t.tsdbOpts.RetentionDuration == 0 && !idle {
+		return false, nil
+	}
+
 	tenantTSDB := tenantInstance.readyStorage()
 	if tenantTSDB == nil {
 		return false, nil
@@ -454,14 +534,14 @@ func (t *MultiTSDB) pruneTSDB(ctx context.Context, logger log.Logger, tenantInst
 
 	tdb := tenantTSDB.a.db
 	head := tdb.Head()
-	if head.MaxTime() < 0 {
+	if head.MaxTime() < 0 && !idle {
 		tenantTSDB.mtx.RUnlock()
 		return false, nil
 	}
 
 	sinceLastAppendMillis := time.Since(time.UnixMilli(head.MaxTime())).Milliseconds()
 	compactThreshold := int64(1.5 * float64(t.tsdbOpts.MaxBlockDuration))
-	if sinceLastAppendMillis <= compactThreshold {
+	if sinceLastAppendMillis <= compactThreshold && !idle {
 		tenantTSDB.mtx.RUnlock()
 		return false, nil
 	}
@@ -488,19 +568,24 @@ func (t *MultiTSDB) pruneTSDB(ctx context.Context, logger log.Logger, tenantInst
 	}()
 
 	sinceLastAppendMillis = time.Since(time.UnixMilli(head.MaxTime())).Milliseconds()
-	if sinceLastAppendMillis <= compactThreshold {
+	if sinceLastAppendMillis <= compactThreshold && !idle {
 		return false, nil
 	}
 
-	level.Info(logger).Log("msg", "Compacting tenant")
-	if err := t.flushHead(tdb); err != nil {
-		return false, err
+	if head.MinTime() <= head.MaxTime() {
+		level.Info(logger).Log("msg", "Compacting tenant")
+		if err := t.flushHead(tdb); err != nil {
+			return false, err
+		}
 	}
 
-	if sinceLastAppendMillis <= t.tsdbOpts.RetentionDuration {
+	if sinceLastAppendMillis <= t.tsdbOpts.RetentionDuration && !idle {
 		return false, nil
 	}
 
+	if idle {
+		level.Info(logger).Log("msg", "Evicting idle tenant", "ttl", t.idleEviction.ttl)
+	}
 	level.Info(logger).Log("msg", "Pruning tenant")
 	if shipper != nil {
 		// No other code can reach this shipper anymore so enable it again to be able to sync manually.
@@ -527,6 +612,9 @@ func (t *MultiTSDB) pruneTSDB(ctx context.Context, logger log.Logger, tenantInst
 	tenantInstance.setComponents(nil, nil, nil, nil)
 	tenantInstance.mtx.Unlock()
 
+	if idle {
+		t.idleEviction.evictions.Inc()
+	}
 	return true, nil
 }
 
@@ -593,6 +681,8 @@ func (t *MultiTSDB) RemoveLockFilesIfAny() error {
 	return merr.Err()
 }
 
+// TSDBLocalClients returns the StoreAPI clients of the tenants whose TSDB has started. Tenants whose TSDB is
+// still being opened, e.g. while replaying its WAL, are skipped rather than waited for.
 func (t *MultiTSDB) TSDBLocalClients() []store.Client {
 	t.mtx.RLock()
 	defer t.mtx.RUnlock()
@@ -622,6 +712,22 @@ func (t *MultiTSDB) TSDBExemplars() map[string]*exemplars.TSDB {
 	return res
 }
 
+// TenantHeadSeries returns the number of head series of the tenant. It returns false if the TSDB of
+// the tenant is not open.
+func (t *MultiTSDB) TenantHeadSeries(tenantID string) (uint64, bool) {
+	t.mtx.RLock()
+	tenantInstance, ok := t.tenants[tenantID]
+	t.mtx.RUnlock()
+	if !ok {
+		return 0, false
+	}
+	db := tenantInstance.readyS.Get()
+	if db == nil {
+		return 0, false
+	}
+	return db.Head().NumSeries(), true
+}
+
 func (t *MultiTSDB) TenantStats(limit int, statsByLabelName string, tenantIDs ...string) []status.TenantStats {
 	t.mtx.RLock()
 	defer t.mtx.RUnlock()
@@ -670,6 +776,13 @@ func (t *MultiTSDB) TenantStats(limit int, statsByLabelName string, tenantIDs ..
 func (t *MultiTSDB) startTSDB(logger log.Logger, tenantID string, tenant *tenant) error {
 	reg := prometheus.WrapRegistererWith(prometheus.Labels{"tenant": tenantID}, t.reg)
 	reg = NewUnRegisterer(reg)
+	if t.quarantine != nil {
+		failedCompactions := &failedCompactionsRegisterer{innerReg: reg}
+		tenant.mtx.Lock()
+		tenant.failedCompactions = failedCompactions
+		tenant.mtx.Unlock()
+		reg = failedCompactions
+	}
 
 	initialLset := labelpb.ExtendSortedLabels(t.labels, labels.FromStrings(t.tenantLabelName, tenantID))
 	lset := t.extractTenantsLabels(tenantID, initialLset)
@@ -694,7 +807,7 @@ func (t *MultiTSDB) startTSDB(logger log.Logger, tenantID string, tenant *tenant
 	)
 	if err != nil {
 		t.mtx.Lock()
-		delete(t.tenants, tenantID)
+		t.removeTenant(tenantID)
 		t.mtx.Unlock()
 		return err
 	}
@@ -712,6 +825,7 @@ func (t *MultiTSDB) startTSDB(logger log.Logger, tenantID string, tenant *tenant
 			t.hashFunc,
 			shipper.DefaultMetaFilename,
 		)
+		ship.SetBlockEvents(t.blockEvents)
 	}
 	tenant.set(store.NewTSDBStore(logger, s, component.Receive, lset), s, ship, exemplars.NewTSDB(s, lset))
 	level.Info(logger).Log("msg", "TSDB is now ready")
@@ -762,36 +876,369 @@ func (t *MultiTSDB) TenantAppendable(tenantID string) (Appendable, error) {
 	if err != nil {
 		return nil, err
 	}
-	return tenant.readyStorage(), nil
+	var app Appendable = tenant.readyStorage()
+	if t.quarantine != nil {
+		if err := t.checkQuarantine(tenantID, tenant); err != nil {
+			return nil, err
+		}
+		app = &quarantineAppendable{
+			Appendable: app,
+			report: func(err error) {
+				t.reportTSDBError(tenantID, tenant, err)
+			},
+		}
+	}
+	if t.idleEviction != nil {
+		app = &evictableAppendable{Appendable: app, multiTSDB: t, tenantID: tenantID, tenant: tenant}
+	}
+	return app, nil
+}
+
+// checkQuarantine returns errTenantQuarantined if the tenant is quarantined. Compaction failures of
+// the tenant since the last check are accounted for first.
+func (t *MultiTSDB) checkQuarantine(tenantID string, tenant *tenant) error {
+	tenant.mtx.RLock()
+	failedCompactions := tenant.failedCompactions
+	tenant.mtx.RUnlock()
+	if failedCompactions != nil {
+		for n := failedCompactions.newFailures(); n > 0; n-- {
+			t.reportTSDBError(tenantID, tenant, errors.New("head compaction failed"))
+		}
+	}
+
+	quarantined, released := t.quarantine.check(tenantID)
+	if released {
+		if db := tenant.readyStorage().Get(); db != nil {
+			db.EnableCompactions()
+		}
+	}
+	if quarantined {
+		return errTenantQuarantined
+	}
+	return nil
+}
+
+// reportTSDBError accounts for a TSDB error of the tenant, and stops its compactions if the tenant
+// gets quarantined.
+func (t *MultiTSDB) reportTSDBError(tenantID string, tenant *tenant, err error) {
+	if !t.quarantine.recordError(tenantID, err) {
+		return
+	}
+	if db := tenant.readyStorage().Get(); db != nil {
+		db.DisableCompactions()
+	}
+}
+
+// OnTenantRemoved registers f to be called with the ID of every tenant removed, i.e. pruned or failing to start.
+// f must not call MultiTSDB.
+func (t *MultiTSDB) OnTenantRemoved(f func(tenantID string)) {
+	t.mtx.Lock()
+	defer t.mtx.Unlock()
+
+	t.tenantRemovedFns = append(t.tenantRemovedFns, f)
+}
+
+// removeTenant removes the tenant from the tenants. It must be called with mtx held.
+func (t *MultiTSDB) removeTenant(tenantID string) {
+	delete(t.tenants, tenantID)
+	for _, f := range t.tenantRemovedFns {
+		f(tenantID)
+	}
+}
+
+// TenantQueryable returns the queryable storage of the given tenant along with
+// the external labels of its TSDB.
+func (t *MultiTSDB) TenantQueryable(tenantID string) (storage.SampleAndChunkQueryable, labels.Labels, error) {
+	t.mtx.RLock()
+	tenant, ok := t.tenants[tenantID]
+	t.mtx.RUnlock()
+	if !ok {
+		return nil, labels.EmptyLabels(), errUnknownTenant
+	}
+
+	tenant.mtx.RLock()
+	db, storeTSDB := tenant.tsdb, tenant.storeTSDB
+	tenant.mtx.RUnlock()
+	if db == nil || storeTSDB == nil {
+		return nil, labels.EmptyLabels(), ErrNotReady
+	}
+
+	lset := labels.EmptyLabels()
+	if lsets := newLocalClient(storeTSDB).LabelSets(); len(lsets) > 0 {
+		lset = lsets[0]
+	}
+	return db, lset, nil
+}
+
+// blockUploadDirSuffix is the suffix of the directories in which the files of uploaded blocks are staged.
+// It is the one of the temporary block directories of the TSDB, so that leftovers are removed when it is opened.
+const blockUploadDirSuffix = ".tmp-for-creation"
+
+func (t *MultiTSDB) blockUploadDir(tenantID string, id ulid.ULID) string {
+	return filepath.Join(t.defaultTenantDataDir(tenantID), id.String()+blockUploadDirSuffix)
+}
+
+// StartBlockUpload validates the meta of a block to upload for the given tenant and prepares its upload.
+// The meta is rewritten so that the block is shipped like the blocks of the tenant's TSDB.
+func (t *MultiTSDB) StartBlockUpload(ctx context.Context, tenantID string, meta *metadata.Meta) error {
+	if err := block.VerifyMeta(meta); err != nil {
+		return errors.Wrap(errInvalidBlock, err.Error())
+	}
+	if meta.MaxTime > time.Now().UnixMilli() {
+		return errors.Wrapf(errInvalidBlock, "block ends in the future at %d", meta.MaxTime)
+	}
+	if meta.Thanos.Downsample.Resolution != 0 {
+		return errors.Wrap(errInvalidBlock, "downsampled blocks cannot be uploaded")
+	}
+	if meta.Stats.NumSamples == 0 {
+		return errors.Wrap(errInvalidBlock, "empty blocks cannot be uploaded")
+	}
+
+	tenant, err := t.getOrLoadTenant(tenantID, true)
+	if err != nil {
+		return err
+	}
+	db := tenant.readyStorage().Get()
+	if db == nil {
+		return ErrNotReady
+	}
+
+	t.blockUploadMtx.Lock()
+	defer t.blockUploadMtx.Unlock()
+
+	if err := t.checkBlockConflicts(ctx, tenantID, tenant, db, meta); err != nil {
+		return err
+	}
+
+	// The shipper only uploads blocks of the first compaction level and attaches the external labels of
+	// the tenant, the ones of the uploaded meta must not be trusted.
+	meta.Compaction.Level = 1
+	meta.Thanos = metadata.Thanos{
+		Labels: map[string]string{},
+		Source: metadata.ReceiveSource,
+		Files:  meta.Thanos.Files,
+	}
+
+	dir := t.blockUploadDir(tenantID, meta.ULID)
+	if err := os.RemoveAll(dir); err != nil {
+		return errors.Wrap(err, "clean block upload dir")
+	}
+	if err := os.MkdirAll(filepath.Join(dir, block.ChunksDirname), 0750); err != nil {
+		return errors.Wrap(err, "create block upload dir")
+	}
+	return meta.WriteToDir(t.logger, dir)
+}
+
+// UploadBlockFile writes a file of the block at the given path, relative to the block directory. It returns
+// errBlockTooLarge if the index and chunk files of the block would exceed maxBlockSize bytes, unless it is 0.
+func (t *MultiTSDB) UploadBlockFile(tenantID string, id ulid.ULID, name string, r io.Reader, maxBlockSize int64) error {
+	dir := t.blockUploadDir(tenantID, id)
+	if _, err := os.Stat(dir); err != nil {
+		if os.IsNotExist(err) {
+			return errBlockUploadNotStarted
+		}
+		return err
+	}
+
+	path := filepath.Join(dir, filepath.FromSlash(name))
+	var size int64
+	if maxBlockSize > 0 {
+		var err error
+		// The file being uploaded again replaces its previous upload.
+		if size, err = uploadedFilesSize(dir, path); err != nil {
+			return errors.Wrap(err, "get size of uploaded files")
+		}
+		// Read one byte more than allowed, to tell files reaching the limit from files exceeding it.
+		r = io.LimitReader(r, maxBlockSize-size+1)
+	}
+
+	f, err := os.Create(path)
+	if err != nil {
+		return errors.Wrap(err, "create block file")
+	}
+	// The file is closed explicitly, so that the causes of write errors, e.g. the size limits of the request body,
+	// are kept for the caller.
+	n, err := io.Copy(f, r)
+	if err == nil {
+		err = f.Sync()
+	}
+	if cerr := f.Close(); err == nil && cerr != nil {
+		err = cerr
+	}
+	if err != nil {
+		return errors.Wrap(err, "write block file")
+	}
+	if maxBlockSize > 0 && size+n > maxBlockSize {
+		if err := os.Remove(path); err != nil {
+			return errors.Wrap(err, "remove block file")
+		}
+		return errors.Wrapf(errBlockTooLarge, "block exceeds %d bytes", maxBlockSize)
+	}
+	return nil
+}
+
+// uploadedFilesSize returns the size of the index and chunk files uploaded into dir, except the file at the given path.
+func uploadedFilesSize(dir, except string) (int64, error) {
+	var size int64
+	err := filepath.WalkDir(dir, func(path string, d os.DirEntry, err error) error {
+		if err != nil || d.IsDir() || path == except || path == filepath.Join(dir, block.MetaFilename) {
+			return err
+		}
+		fi, err := d.Info()
+		if err != nil {
+			return err
+		}
+		size += fi.Size()
+		return nil
+	})
+	return size, err
+}
+
+// FinishBlockUpload validates the uploaded block, ships it to object storage and moves it into the TSDB
+// directory of the tenant, from which it is loaded by the TSDB. The block is shipped first, as the TSDB
+// deletes blocks beyond its retention, as backfilled blocks often are, once they were shipped.
+func (t *MultiTSDB) FinishBlockUpload(ctx context.Context, tenantID string, id ulid.ULID) error {
+	dir := t.blockUploadDir(tenantID, id)
+	if _, err := os.Stat(dir); err != nil {
+		if os.IsNotExist(err) {
+			return errBlockUploadNotStarted
+		}
+		return err
+	}
+
+	meta, err := block.VerifyBlockDir(ctx, t.logger, dir)
+	if err != nil {
+		return errors.Wrap(errInvalidBlock, err.Error())
+	}
+
+	tenant, err := t.getOrLoadTenant(tenantID, true)
+	if err != nil {
+		return err
+	}
+	db := tenant.readyStorage().Get()
+	if db == nil {
+		return ErrNotReady
+	}
+
+	t.blockUploadMtx.Lock()
+	defer t.blockUploadMtx.Unlock()
+
+	// Blocks may have been added to the tenant since the upload started.
+	if err := t.checkBlockConflicts(ctx, tenantID, tenant, db, meta); err != nil {
+		return err
+	}
+	ship := tenant.shipper()
+	if ship == nil {
+		return errors.New("block upload requires object storage")
+	}
+	return ship.AddBlock(ctx, dir)
+}
+
+// checkBlockConflicts returns errBlockConflict if the given block already exists for the tenant, locally or
+// in object storage, or if it overlaps with the local blocks or the head of the tenant's TSDB, or with the
+// blocks in object storage having the external labels of the tenant.
+func (t *MultiTSDB) checkBlockConflicts(ctx context.Context, tenantID string, tenant *tenant, db *tsdb.DB, meta *metadata.Meta) error {
+	dataDir := t.defaultTenantDataDir(tenantID)
+	entries, err := os.ReadDir(dataDir)
+	if err != nil {
+		return errors.Wrap(err, "read tenant dir")
+	}
+	// Blocks are read from disk rather than from the TSDB, which only loads new blocks periodically.
+	for _, e := range entries {
+		id, ok := block.IsBlockDir(e.Name())
+		if !ok || !e.IsDir() {
+			continue
+		}
+		if id == meta.ULID {
+			return errors.Wrapf(errBlockConflict, "block %s already exists", id)
+		}
+		m, err := metadata.ReadFromDir(filepath.Join(dataDir, e.Name()))
+		if err != nil {
+			// Blocks being deleted by the TSDB can be missing their meta.
+			if os.IsNotExist(err) {
+				continue
+			}
+			return errors.Wrapf(err, "read meta of block %s", id)
+		}
+		if m.MinTime < meta.MaxTime && meta.MinTime < m.MaxTime {
+			return errors.Wrapf(errBlockConflict, "block overlaps with block %s [%d, %d)", id, m.MinTime, m.MaxTime)
+		}
+	}
+
+	if head := db.Head(); head.NumSeries() > 0 && head.MinTime() < meta.MaxTime && meta.MinTime <= head.MaxTime() {
+		return errors.Wrapf(errBlockConflict, "block overlaps with the head [%d, %d]", head.MinTime(), head.MaxTime())
+	}
+
+	if t.bucket != nil {
+		exists, err := t.bucket.Exists(ctx, path.Join(meta.ULID.String(), block.MetaFilename))
+		if err != nil {
+			return errors.Wrap(err, "check block in object storage")
+		}
+		if exists {
+			return errors.Wrapf(errBlockConflict, "block %s already exists in object storage", meta.ULID)
+		}
+		if err := t.checkBucketBlockConflicts(ctx, tenant, meta); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// checkBucketBlockConflicts returns errBlockConflict if the given block overlaps with a block in object storage
+// having the external labels of the tenant, i.e. shipped by the tenant's TSDB or uploaded before.
+func (t *MultiTSDB) checkBucketBlockConflicts(ctx context.Context, tenant *tenant, meta *metadata.Meta) error {
+	client := tenant.client()
+	if client == nil {
+		return ErrNotReady
+	}
+	lset := labels.EmptyLabels()
+	if lsets := client.LabelSets(); len(lsets) > 0 {
+		lset = lsets[0]
+	}
+
+	bkt := objstore.WithNoopInstr(t.bucket)
+	fetcher, err := block.NewMetaFetcher(t.logger, block.FetcherConcurrency, bkt, block.NewConcurrentLister(t.logger, bkt), "", nil, nil)
+	if err != nil {
+		return errors.Wrap(err, "create meta fetcher")
+	}
+	metas, _, err := fetcher.Fetch(ctx)
+	if err != nil {
+		return errors.Wrap(err, "fetch metas of blocks in object storage")
+	}
+	for id, m := range metas {
+		if !labels.Equal(labels.FromMap(m.Thanos.Labels), lset) {
+			continue
+		}
+		if m.MinTime < meta.MaxTime && meta.MinTime < m.MaxTime {
+			return errors.Wrapf(errBlockConflict, "block overlaps with block %s [%d, %d) in object storage", id, m.MinTime, m.MaxTime)
+		}
+	}
+	return nil
 }
 
 func (t *MultiTSDB) SetHashringConfig(cfg []HashringConfig) error {
+	t.mtx.Lock()
+	defer t.mtx.Unlock()
+
 	t.hashringConfigs = cfg
 
 	// If a tenant's already existed in MultiTSDB, update its label set
 	// from the latest []HashringConfig.
-	// In case one tenant appears in multiple hashring configs,
-	// only the label set from the first hashring config is applied.
 	// This is the same logic as startTSDB.
-	updatedTenants := make([]string, 0)
-	for _, hc := range t.hashringConfigs {
-		for _, tenantID := range hc.Tenants {
-			if slices.Contains(updatedTenants, tenantID) {
-				continue
-			}
-			if t.tenants[tenantID] != nil {
-				updatedTenants = append(updatedTenants, tenantID)
-
-				lset := labelpb.ExtendSortedLabels(t.labels, labels.FromStrings(t.tenantLabelName, tenantID))
-				lset = labelpb.ExtendSortedLabels(hc.ExternalLabels, lset)
+	for tenantID, tenant := range t.tenants {
+		lset := t.extractTenantsLabels(tenantID, labelpb.ExtendSortedLabels(t.labels, labels.FromStrings(t.tenantLabelName, tenantID)))
 
-				if t.tenants[tenantID].ship != nil {
-					t.tenants[tenantID].ship.SetLabels(lset)
-				}
-				t.tenants[tenantID].storeTSDB.SetExtLset(lset)
-				t.tenants[tenantID].exemplarsTSDB.SetExtLabels(lset)
-			}
+		tenant.mtx.RLock()
+		if tenant.ship != nil {
+			tenant.ship.SetLabels(lset)
+		}
+		if tenant.storeTSDB != nil {
+			tenant.storeTSDB.SetExtLset(lset)
+		}
+		if tenant.exemplarsTSDB != nil {
+			tenant.exemplarsTSDB.SetExtLabels(lset)
 		}
+		tenant.mtx.RUnlock()
 	}
 
 	return nil
@@ -953,16 +1400,17 @@ func (u *UnRegisterer) MustRegister(cs ...prometheus.Collector) {
 }
 
 // extractTenantsLabels extracts tenant's external labels from hashring configs.
-// If one tenant appears in multiple hashring configs,
+// The labels of the hashring the tenant is routed to are applied, so tenants matched
+// through glob patterns or default hashrings get them as well. Since all replicas share
+// the same hashring configuration, the resulting label sets are consistent across them.
+// If one tenant matches multiple hashring configs,
 // only the external label set from the first hashring config is applied.
 func (t *MultiTSDB) extractTenantsLabels(tenantID string, initialLset labels.Labels) labels.Labels {
 	for _, hc := range t.hashringConfigs {
-		for _, tenant := range hc.Tenants {
-			if tenant != tenantID {
-				continue
-			}
-			return labelpb.ExtendSortedLabels(hc.ExternalLabels, initialLset)
+		if !hc.matchesTenant(tenantID) {
+			continue
 		}
+		return labelpb.ExtendSortedLabels(hc.ExternalLabels, initialLset)
 	}
 	return initialLset
 }
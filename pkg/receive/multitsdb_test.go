@@ -23,11 +23,14 @@ import (
 	"github.com/prometheus/prometheus/model/labels"
 	"github.com/prometheus/prometheus/storage"
 	"github.com/prometheus/prometheus/tsdb"
+	"github.com/prometheus/prometheus/tsdb/chunkenc"
+	"github.com/prometheus/prometheus/tsdb/wlog"
 	"github.com/stretchr/testify/require"
 	"github.com/thanos-io/objstore"
 	"golang.org/x/sync/errgroup"
 	"google.golang.org/grpc"
 
+	"github.com/thanos-io/thanos/pkg/block/lifecycle"
 	"github.com/thanos-io/thanos/pkg/block/metadata"
 	"github.com/thanos-io/thanos/pkg/component"
 	"github.com/thanos-io/thanos/pkg/exemplars/exemplarspb"
@@ -535,6 +538,195 @@ func TestMultiTSDBRecreatePrunedTenant(t *testing.T) {
 	testutil.Equals(t, 1, len(m.TSDBLocalClients()))
 }
 
+func TestMultiTSDBDrainTenant(t *testing.T) {
+	dir := t.TempDir()
+	bkt := objstore.NewInMemBucket()
+
+	m := NewMultiTSDB(dir, log.NewNopLogger(), prometheus.NewRegistry(),
+		&tsdb.Options{
+			MinBlockDuration:  (2 * time.Hour).Milliseconds(),
+			MaxBlockDuration:  (2 * time.Hour).Milliseconds(),
+			RetentionDuration: (6 * time.Hour).Milliseconds(),
+		},
+		labels.FromStrings("replica", "test"),
+		"tenant_id",
+		bkt,
+		false,
+		metadata.NoneFunc,
+	)
+	defer func() { testutil.Ok(t, m.Close()) }()
+
+	// Samples are within a single block range, so that draining uploads exactly one block.
+	start := time.Now().Truncate(2 * time.Hour).Add(-time.Hour)
+	for step := time.Duration(0); step <= 10*time.Minute; step += time.Minute {
+		testutil.Ok(t, appendSample(m, "moved", start.Add(step)))
+		testutil.Ok(t, appendSample(m, "kept", start.Add(step)))
+	}
+
+	uploaded, err := m.DrainTenant(context.Background(), "moved")
+	testutil.Ok(t, err)
+	testutil.Equals(t, 1, uploaded)
+
+	var blocks int
+	testutil.Ok(t, bkt.Iter(context.Background(), "", func(name string) error {
+		blocks++
+		return nil
+	}))
+	testutil.Equals(t, 1, blocks)
+
+	uploaded, err = m.DrainTenant(context.Background(), "unknown")
+	testutil.Ok(t, err)
+	testutil.Equals(t, 0, uploaded)
+}
+
+type recordingNotifier struct {
+	mtx    sync.Mutex
+	events []lifecycle.Event
+}
+
+func (n *recordingNotifier) Notify(e lifecycle.Event) {
+	n.mtx.Lock()
+	defer n.mtx.Unlock()
+	n.events = append(n.events, e)
+}
+
+func (n *recordingNotifier) Close() error { return nil }
+
+func TestMultiTSDBBlockEvents(t *testing.T) {
+	dir := t.TempDir()
+	blockEvents := &recordingNotifier{}
+
+	m := NewMultiTSDB(dir, log.NewNopLogger(), prometheus.NewRegistry(),
+		&tsdb.Options{
+			MinBlockDuration:  (2 * time.Hour).Milliseconds(),
+			MaxBlockDuration:  (2 * time.Hour).Milliseconds(),
+			RetentionDuration: (6 * time.Hour).Milliseconds(),
+		},
+		labels.FromStrings("replica", "test"),
+		"tenant_id",
+		objstore.NewInMemBucket(),
+		false,
+		metadata.NoneFunc,
+		WithBlockEvents(blockEvents),
+	)
+	defer func() { testutil.Ok(t, m.Close()) }()
+
+	start := time.Now().Truncate(2 * time.Hour).Add(-time.Hour)
+	for step := time.Duration(0); step <= 10*time.Minute; step += time.Minute {
+		testutil.Ok(t, appendSample(m, "foo", start.Add(step)))
+	}
+
+	uploaded, err := m.DrainTenant(context.Background(), "foo")
+	testutil.Ok(t, err)
+	testutil.Equals(t, 1, uploaded)
+
+	testutil.Equals(t, 1, len(blockEvents.events))
+	testutil.Equals(t, lifecycle.EventCreated, blockEvents.events[0].Type)
+	testutil.Equals(t, map[string]string{"replica": "test", "tenant_id": "foo"}, blockEvents.events[0].Meta.Thanos.Labels)
+	testutil.Equals(t, metadata.ReceiveSource, blockEvents.events[0].Meta.Thanos.Source)
+}
+
+func TestMultiTSDBReadAfterWrite(t *testing.T) {
+	dir := t.TempDir()
+	opts := &tsdb.Options{
+		MinBlockDuration:     (2 * time.Hour).Milliseconds(),
+		MaxBlockDuration:     (2 * time.Hour).Milliseconds(),
+		RetentionDuration:    (6 * time.Hour).Milliseconds(),
+		OutOfOrderTimeWindow: time.Hour.Milliseconds(),
+	}
+	newMultiTSDB := func() *MultiTSDB {
+		return NewMultiTSDB(dir, log.NewNopLogger(), prometheus.NewRegistry(), opts,
+			labels.FromStrings("replica", "test"), "tenant_id", nil, false, metadata.NoneFunc)
+	}
+	countSamples := func(m *MultiTSDB) int {
+		clients := m.TSDBLocalClients()
+		testutil.Equals(t, 1, len(clients))
+
+		respCh := make(chan *storepb.Series)
+		var err error
+		go func() {
+			err = getResponses(clients[0], respCh)
+			close(respCh)
+		}()
+		var samples int
+		for s := range respCh {
+			for _, c := range s.Chunks {
+				chk, cerr := chunkenc.FromData(chunkenc.EncXOR, c.Raw.Data)
+				testutil.Ok(t, cerr)
+				samples += chk.NumSamples()
+			}
+		}
+		testutil.Ok(t, err)
+		return samples
+	}
+
+	m := newMultiTSDB()
+	lbls := labels.FromStrings("a", "1")
+
+	// Every acknowledged sample, including out-of-order ones, is visible right away.
+	testutil.Ok(t, appendSampleWithLabels(m, "foo", lbls, time.UnixMilli(5)))
+	testutil.Equals(t, 1, countSamples(m))
+	testutil.Ok(t, appendSampleWithLabels(m, "foo", lbls, time.UnixMilli(7)))
+	testutil.Equals(t, 2, countSamples(m))
+	testutil.Ok(t, appendSampleWithLabels(m, "foo", lbls, time.UnixMilli(6)))
+	testutil.Equals(t, 3, countSamples(m))
+	testutil.Ok(t, m.Close())
+
+	// After a restart, the WAL is replayed before the StoreAPI is exposed.
+	m = newMultiTSDB()
+	testutil.Ok(t, m.Open())
+	testutil.Equals(t, 3, countSamples(m))
+	testutil.Ok(t, m.Close())
+
+	// Tenants whose TSDB is still being opened are skipped rather than waited for.
+	m = newMultiTSDB()
+	defer func() { testutil.Ok(t, m.Close()) }()
+	m.mtx.Lock()
+	m.tenants["bar"] = newTenant()
+	m.mtx.Unlock()
+	testutil.Ok(t, m.Open())
+	testutil.Equals(t, 3, countSamples(m))
+}
+
+func TestMultiTSDBWALCompression(t *testing.T) {
+	dir := t.TempDir()
+	newMultiTSDB := func(compression wlog.CompressionType) *MultiTSDB {
+		return NewMultiTSDB(dir, log.NewNopLogger(), prometheus.NewRegistry(), &tsdb.Options{
+			MinBlockDuration:  (2 * time.Hour).Milliseconds(),
+			MaxBlockDuration:  (2 * time.Hour).Milliseconds(),
+			RetentionDuration: (6 * time.Hour).Milliseconds(),
+			WALCompression:    compression,
+		}, labels.FromStrings("replica", "test"), "tenant_id", nil, false, metadata.NoneFunc)
+	}
+
+	m := newMultiTSDB(wlog.CompressionZstd)
+	tenants := []string{"foo", "bar"}
+	for _, tenant := range tenants {
+		// Long label values make sure the series record is compressed.
+		lbls := labels.FromStrings("a", strings.Repeat("1", 100), "b", strings.Repeat("2", 100))
+		testutil.Ok(t, appendSampleWithLabels(m, tenant, lbls, time.UnixMilli(5)))
+	}
+	testutil.Ok(t, m.Close())
+
+	// The WAL of every tenant is compressed with the configured algorithm.
+	for _, tenant := range tenants {
+		segment, err := os.ReadFile(filepath.Join(dir, tenant, "wal", "00000000"))
+		testutil.Ok(t, err)
+		testutil.Assert(t, len(segment) > 0, "expected a non-empty WAL segment for tenant %s", tenant)
+		testutil.Assert(t, segment[0]&(1<<4) != 0, "expected the first WAL record of tenant %s to be compressed with zstd", tenant)
+	}
+
+	// Changing the algorithm does not prevent replaying existing segments.
+	m = newMultiTSDB(wlog.CompressionSnappy)
+	defer func() { testutil.Ok(t, m.Close()) }()
+	testutil.Ok(t, m.Open())
+	for _, tenant := range tenants {
+		db := m.tenants[tenant].readyStorage().Get()
+		testutil.Assert(t, db != nil, "expected tenant %s to be opened", tenant)
+		testutil.Equals(t, uint64(1), db.Head().NumSeries())
+	}
+}
+
 func TestAlignedHeadFlush(t *testing.T) {
 	hourInSeconds := int64(1 * 60 * 60)
 
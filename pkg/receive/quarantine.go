@@ -0,0 +1,271 @@
+// Copyright (c) The Thanos Authors.
+// Licensed under the Apache License 2.0.
+
+package receive
+
+import (
+	"context"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-kit/log"
+	"github.com/go-kit/log/level"
+	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/prometheus/prometheus/model/exemplar"
+	"github.com/prometheus/prometheus/model/histogram"
+	"github.com/prometheus/prometheus/model/labels"
+	"github.com/prometheus/prometheus/storage"
+)
+
+// errTenantQuarantined is returned for writes of tenants quarantined after repeated TSDB errors.
+var errTenantQuarantined = errors.New("tenant is quarantined after repeated TSDB errors")
+
+// TenantQuarantineOptions configures the quarantine of tenants repeatedly causing TSDB errors.
+type TenantQuarantineOptions struct {
+	// ErrorThreshold is the number of TSDB errors of a tenant within Window after which the tenant
+	// is quarantined. 0 disables quarantine.
+	ErrorThreshold int
+	Window         time.Duration
+	// Cooldown is how long a tenant stays quarantined.
+	Cooldown time.Duration
+}
+
+// WithTenantQuarantine makes MultiTSDB quarantine tenants whose TSDB fails too often, so that
+// a tenant sending malformed data does not destabilize the others. Writes of quarantined tenants
+// are rejected and their head compaction is stopped until the cooldown ends.
+func WithTenantQuarantine(opts TenantQuarantineOptions) MultiTSDBOption {
+	return func(t *MultiTSDB) {
+		if opts.ErrorThreshold > 0 {
+			t.quarantine = newTenantQuarantine(t.logger, t.reg, opts)
+		}
+	}
+}
+
+// tenantQuarantine tracks the TSDB errors of every tenant and the tenants currently quarantined.
+type tenantQuarantine struct {
+	logger log.Logger
+	opts   TenantQuarantineOptions
+	now    func() time.Time
+
+	mtx sync.Mutex
+	// errs are the times of the recent errors of tenants which are not quarantined.
+	errs  map[string][]time.Time
+	until map[string]time.Time
+
+	tsdbErrors  *prometheus.CounterVec
+	quarantines *prometheus.CounterVec
+	quarantined *prometheus.GaugeVec
+}
+
+func newTenantQuarantine(logger log.Logger, reg prometheus.Registerer, opts TenantQuarantineOptions) *tenantQuarantine {
+	return &tenantQuarantine{
+		logger: logger,
+		opts:   opts,
+		now:    time.Now,
+		errs:   map[string][]time.Time{},
+		until:  map[string]time.Time{},
+		tsdbErrors: promauto.With(reg).NewCounterVec(prometheus.CounterOpts{
+			Name: "thanos_receive_tenant_tsdb_errors_total",
+			Help: "Number of TSDB errors per tenant accounted for quarantining tenants, i.e. failed writes and head compactions.",
+		}, []string{"tenant"}),
+		quarantines: promauto.With(reg).NewCounterVec(prometheus.CounterOpts{
+			Name: "thanos_receive_tenant_quarantines_total",
+			Help: "Number of times a tenant was quarantined after repeated TSDB errors.",
+		}, []string{"tenant"}),
+		quarantined: promauto.With(reg).NewGaugeVec(prometheus.GaugeOpts{
+			Name: "thanos_receive_tenant_quarantined",
+			Help: "Whether a tenant is currently quarantined after repeated TSDB errors.",
+		}, []string{"tenant"}),
+	}
+}
+
+// recordError records a TSDB error of the tenant. It returns true if the tenant got quarantined.
+func (q *tenantQuarantine) recordError(tenantID string, err error) bool {
+	q.tsdbErrors.WithLabelValues(tenantID).Inc()
+	now := q.now()
+
+	q.mtx.Lock()
+	defer q.mtx.Unlock()
+	if _, ok := q.until[tenantID]; ok {
+		return false
+	}
+
+	errs := append(q.errs[tenantID], now)
+	for len(errs) > 0 && !errs[0].After(now.Add(-q.opts.Window)) {
+		errs = errs[1:]
+	}
+	if len(errs) < q.opts.ErrorThreshold {
+		q.errs[tenantID] = errs
+		return false
+	}
+
+	delete(q.errs, tenantID)
+	q.until[tenantID] = now.Add(q.opts.Cooldown)
+	q.quarantines.WithLabelValues(tenantID).Inc()
+	q.quarantined.WithLabelValues(tenantID).Set(1)
+	level.Warn(q.logger).Log("msg", "quarantining tenant after repeated TSDB errors", "tenant", tenantID,
+		"errors", len(errs), "window", q.opts.Window, "cooldown", q.opts.Cooldown, "err", err)
+	return true
+}
+
+// check returns whether the tenant is quarantined, and whether its cooldown just ended.
+func (q *tenantQuarantine) check(tenantID string) (quarantined, released bool) {
+	q.mtx.Lock()
+	defer q.mtx.Unlock()
+
+	until, ok := q.until[tenantID]
+	if !ok {
+		return false, false
+	}
+	if q.now().Before(until) {
+		return true, false
+	}
+	delete(q.until, tenantID)
+	q.quarantined.DeleteLabelValues(tenantID)
+	level.Info(q.logger).Log("msg", "releasing tenant from quarantine", "tenant", tenantID)
+	return false, true
+}
+
+// isTSDBError returns true if err is not caused by samples which the TSDB rejects as part of its
+// normal operation, like out of order samples.
+func isTSDBError(err error) bool {
+	if err == nil {
+		return false
+	}
+	for _, expected := range []error{
+		storage.ErrOutOfOrderSample,
+		storage.ErrDuplicateSampleForTimestamp,
+		storage.ErrOutOfBounds,
+		storage.ErrTooOldSample,
+		ErrNotReady,
+		context.Canceled,
+	} {
+		if errors.Is(err, expected) {
+			return false
+		}
+	}
+	return true
+}
+
+// quarantineAppendable reports the TSDB errors of the appenders of a tenant.
+type quarantineAppendable struct {
+	Appendable
+	report func(err error)
+}
+
+func (a *quarantineAppendable) Appender(ctx context.Context) (storage.Appender, error) {
+	app, err := a.Appendable.Appender(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return &quarantineAppender{Appender: app, report: a.report}, nil
+}
+
+// quarantineAppender reports a single error per transaction, no matter how many of its samples failed.
+type quarantineAppender struct {
+	storage.Appender
+	report func(err error)
+
+	// err is the first TSDB error returned by the appender.
+	err error
+}
+
+func (a *quarantineAppender) observe(err error) {
+	if a.err == nil && isTSDBError(err) {
+		a.err = err
+	}
+}
+
+func (a *quarantineAppender) GetRef(lset labels.Labels, hash uint64) (storage.SeriesRef, labels.Labels) {
+	return a.Appender.(storage.GetRef).GetRef(lset, hash)
+}
+
+func (a *quarantineAppender) Append(ref storage.SeriesRef, l labels.Labels, t int64, v float64) (storage.SeriesRef, error) {
+	ref, err := a.Appender.Append(ref, l, t, v)
+	a.observe(err)
+	return ref, err
+}
+
+func (a *quarantineAppender) AppendHistogram(ref storage.SeriesRef, l labels.Labels, t int64, h *histogram.Histogram, fh *histogram.FloatHistogram) (storage.SeriesRef, error) {
+	ref, err := a.Appender.AppendHistogram(ref, l, t, h, fh)
+	a.observe(err)
+	return ref, err
+}
+
+func (a *quarantineAppender) AppendExemplar(ref storage.SeriesRef, l labels.Labels, e exemplar.Exemplar) (storage.SeriesRef, error) {
+	// Exemplars are validated by the TSDB without affecting its state, their errors are not accounted for.
+	return a.Appender.AppendExemplar(ref, l, e)
+}
+
+func (a *quarantineAppender) Commit() error {
+	err := a.Appender.Commit()
+	a.observe(err)
+	if a.err != nil {
+		a.report(a.err)
+	}
+	return err
+}
+
+func (a *quarantineAppender) Rollback() error {
+	err := a.Appender.Rollback()
+	a.observe(err)
+	if a.err != nil {
+		a.report(a.err)
+	}
+	return err
+}
+
+// failedCompactionsRegisterer keeps the counter of failed compactions registered by the TSDB of a
+// tenant, as failures of the compactions the TSDB runs in the background are not returned anywhere.
+//
+// Like UnRegisterer, it cannot embed the inner registerer, see UnRegisterer.
+type failedCompactionsRegisterer struct {
+	innerReg prometheus.Registerer
+
+	mtx     sync.Mutex
+	counter prometheus.Counter
+	seen    float64
+}
+
+func (r *failedCompactionsRegisterer) Register(c prometheus.Collector) error {
+	if counter, ok := c.(prometheus.Counter); ok && strings.Contains(counter.Desc().String(), `"prometheus_tsdb_compactions_failed_total"`) {
+		r.mtx.Lock()
+		r.counter = counter
+		r.mtx.Unlock()
+	}
+	return r.innerReg.Register(c)
+}
+
+func (r *failedCompactionsRegisterer) Unregister(c prometheus.Collector) bool {
+	return r.innerReg.Unregister(c)
+}
+
+func (r *failedCompactionsRegisterer) MustRegister(cs ...prometheus.Collector) {
+	for _, c := range cs {
+		if err := r.Register(c); err != nil {
+			panic(err)
+		}
+	}
+}
+
+// newFailures returns the number of compactions which failed since the last call.
+func (r *failedCompactionsRegisterer) newFailures() int {
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+	if r.counter == nil {
+		return 0
+	}
+
+	var m dto.Metric
+	if err := r.counter.Write(&m); err != nil {
+		return 0
+	}
+	total := m.GetCounter().GetValue()
+	n := int(total - r.seen)
+	r.seen = total
+	return n
+}
@@ -0,0 +1,89 @@
+// Copyright (c) The Thanos Authors.
+// Licensed under the Apache License 2.0.
+
+package receive
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/efficientgo/core/testutil"
+	"github.com/go-kit/log"
+	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus"
+	promtest "github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/prometheus/prometheus/model/labels"
+	"github.com/prometheus/prometheus/tsdb"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	"github.com/thanos-io/thanos/pkg/block/metadata"
+)
+
+func TestMultiTSDBTenantQuarantine(t *testing.T) {
+	m := NewMultiTSDB(t.TempDir(), log.NewNopLogger(), prometheus.NewRegistry(), &tsdb.Options{
+		MinBlockDuration:  (2 * time.Hour).Milliseconds(),
+		MaxBlockDuration:  (2 * time.Hour).Milliseconds(),
+		RetentionDuration: (6 * time.Hour).Milliseconds(),
+	}, labels.FromStrings("replica", "test"), "tenant_id", nil, false, metadata.NoneFunc,
+		WithTenantQuarantine(TenantQuarantineOptions{ErrorThreshold: 2, Window: time.Minute, Cooldown: 5 * time.Minute}),
+	)
+	defer func() { testutil.Ok(t, m.Close()) }()
+
+	now := time.Now()
+	m.quarantine.now = func() time.Time { return now }
+
+	// writeInvalid commits a write with a sample the TSDB fails to append.
+	writeInvalid := func(tenant string) {
+		app, err := m.TenantAppendable(tenant)
+		testutil.Ok(t, err)
+		a, err := app.Appender(context.Background())
+		testutil.Ok(t, err)
+		_, err = a.Append(0, labels.EmptyLabels(), now.UnixMilli(), 1)
+		testutil.NotOk(t, err)
+		testutil.Ok(t, a.Commit())
+	}
+
+	for _, tenant := range []string{"foo", "bar"} {
+		testutil.Ok(t, appendSample(m, tenant, now))
+	}
+
+	// Errors older than the window are forgotten.
+	writeInvalid("foo")
+	now = now.Add(2 * time.Minute)
+	writeInvalid("foo")
+	testutil.Ok(t, appendSample(m, "foo", now))
+
+	// Expected rejections of samples are not TSDB errors.
+	for i := 0; i < 3; i++ {
+		testutil.NotOk(t, appendSample(m, "foo", now.Add(-time.Hour)))
+	}
+	testutil.Ok(t, appendSample(m, "foo", now))
+
+	writeInvalid("foo")
+	testutil.Equals(t, errTenantQuarantined, errors.Cause(appendSample(m, "foo", now)))
+	testutil.Equals(t, 1.0, promtest.ToFloat64(m.quarantine.quarantines.WithLabelValues("foo")))
+	testutil.Equals(t, 1.0, promtest.ToFloat64(m.quarantine.quarantined.WithLabelValues("foo")))
+	testutil.Equals(t, 3.0, promtest.ToFloat64(m.quarantine.tsdbErrors.WithLabelValues("foo")))
+
+	// Other tenants are not affected.
+	testutil.Ok(t, appendSample(m, "bar", now))
+
+	// The tenant recovers after the cooldown.
+	now = now.Add(5 * time.Minute)
+	testutil.Ok(t, appendSample(m, "foo", now))
+
+	// Failed background compactions are accounted for as well.
+	failedCompactions := m.tenants["bar"].failedCompactions
+	testutil.Assert(t, failedCompactions.counter != nil, "expected the failed compactions counter of the TSDB to be tracked")
+	failedCompactions.counter.Add(2)
+	testutil.Equals(t, errTenantQuarantined, errors.Cause(appendSample(m, "bar", now)))
+}
+
+func TestReplicationErrors_TenantQuarantined(t *testing.T) {
+	errs := &replicationErrors{threshold: 2}
+	errs.Add(errors.Wrap(errTenantQuarantined, "get tenant appendable"))
+	errs.Add(status.Error(codes.FailedPrecondition, errTenantQuarantined.Error()))
+	testutil.Equals(t, errTenantQuarantined, errs.Cause())
+}
@@ -237,6 +237,102 @@ func TestAddingExternalLabelsForTenants(t *testing.T) {
 	}
 }
 
+func TestAddingExternalLabelsForMatchedTenants(t *testing.T) {
+	for _, tc := range []struct {
+		name                      string
+		cfg                       []HashringConfig
+		tenants                   []string
+		expectedExternalLabelSets []labels.Labels
+	}{
+		{
+			name: "Glob matched tenants",
+			cfg: []HashringConfig{
+				{
+					Endpoints:         []Endpoint{{Address: "node1"}},
+					Tenants:           []string{"team-a-*"},
+					TenantMatcherType: TenantMatcherGlob,
+					ExternalLabels:    labels.FromStrings("team", "a"),
+				},
+				{
+					Endpoints:      []Endpoint{{Address: "node2"}},
+					Tenants:        []string{"team-b"},
+					ExternalLabels: labels.FromStrings("team", "b"),
+				},
+			},
+			tenants: []string{"team-a-1", "team-a-2", "team-b", "team-c"},
+			expectedExternalLabelSets: []labels.Labels{
+				labels.FromStrings("replica", "test", "team", "a", "tenant_id", "team-a-1"),
+				labels.FromStrings("replica", "test", "team", "a", "tenant_id", "team-a-2"),
+				labels.FromStrings("replica", "test", "team", "b", "tenant_id", "team-b"),
+				labels.FromStrings("replica", "test", "tenant_id", "team-c"),
+			},
+		},
+		{
+			name: "Default hashring",
+			cfg: []HashringConfig{
+				{
+					Endpoints:      []Endpoint{{Address: "node1"}},
+					Tenants:        []string{"team-b"},
+					ExternalLabels: labels.FromStrings("team", "b"),
+				},
+				{
+					Endpoints:      []Endpoint{{Address: "node2"}},
+					ExternalLabels: labels.FromStrings("team", "default"),
+				},
+			},
+			tenants: []string{"team-b", "team-c"},
+			expectedExternalLabelSets: []labels.Labels{
+				labels.FromStrings("replica", "test", "team", "b", "tenant_id", "team-b"),
+				labels.FromStrings("replica", "test", "team", "default", "tenant_id", "team-c"),
+			},
+		},
+		{
+			name: "Tenant labels cannot be overridden",
+			cfg: []HashringConfig{
+				{
+					Endpoints:      []Endpoint{{Address: "node1"}},
+					ExternalLabels: labels.FromStrings("replica", "other", "tenant_id", "other"),
+				},
+			},
+			tenants: []string{"tenant1"},
+			expectedExternalLabelSets: []labels.Labels{
+				labels.FromStrings("replica", "test", "tenant_id", "tenant1"),
+			},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			m := initializeMultiTSDB(t.TempDir())
+			require.NoError(t, m.SetHashringConfig(tc.cfg))
+
+			for _, tenantID := range tc.tenants {
+				require.NoError(t, appendSample(m, tenantID, time.Now()))
+			}
+
+			storeClients := m.TSDBLocalClients()
+			require.Equal(t, len(tc.expectedExternalLabelSets), len(storeClients))
+
+			var actual []labels.Labels
+			for _, c := range storeClients {
+				actual = append(actual, c.LabelSets()...)
+			}
+			require.ElementsMatch(t, tc.expectedExternalLabelSets, actual)
+
+			// Removing the per-tenant labels from the configuration removes them from running tenants too.
+			require.NoError(t, m.SetHashringConfig([]HashringConfig{{Endpoints: []Endpoint{{Address: "node1"}}}}))
+			actual = actual[:0]
+			for _, c := range m.TSDBLocalClients() {
+				actual = append(actual, c.LabelSets()...)
+			}
+			for _, lset := range actual {
+				require.False(t, lset.Has("team"), "unexpected team label in %s", lset)
+			}
+
+			require.NoError(t, m.Flush())
+			require.NoError(t, m.Close())
+		})
+	}
+}
+
 func TestLabelSetsOfTenantsWhenAddingTenants(t *testing.T) {
 	initialConfig := []HashringConfig{
 		{
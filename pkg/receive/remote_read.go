@@ -0,0 +1,153 @@
+// Copyright (c) The Thanos Authors.
+// Licensed under the Apache License 2.0.
+
+package receive
+
+import (
+	"math"
+	"net/http"
+	"sync"
+
+	"github.com/go-kit/log"
+	"github.com/go-kit/log/level"
+	"github.com/pkg/errors"
+	"github.com/prometheus/prometheus/config"
+	"github.com/prometheus/prometheus/model/labels"
+	"github.com/prometheus/prometheus/storage"
+	"github.com/prometheus/prometheus/storage/remote"
+	promgate "github.com/prometheus/prometheus/util/gate"
+
+	"github.com/thanos-io/thanos/pkg/tenancy"
+)
+
+// errUnknownTenant is returned when reading from a tenant which has no local TSDB.
+var errUnknownTenant = errors.New("unknown tenant")
+
+// TenantReader gives read access to the local storage of tenants.
+type TenantReader interface {
+	// TenantQueryable returns the queryable storage of the given tenant along with
+	// the external labels of its TSDB.
+	TenantQueryable(tenantID string) (storage.SampleAndChunkQueryable, labels.Labels, error)
+	// OnTenantRemoved registers f to be called with the ID of every tenant removed from the local storage.
+	OnTenantRemoved(f func(tenantID string))
+}
+
+// tenantRemoteReadConcurrency is the concurrency limit of the remote read handlers of tenants. It does not limit
+// anything: the concurrent remote read requests are limited across tenants by the gate of remoteReadHandler, so
+// that the limit is not applied twice. Channels of empty structs do not allocate their buffer, whatever their size.
+const tenantRemoteReadConcurrency = math.MaxInt32
+
+// remoteReadHandler serves the Prometheus remote read protocol from the local
+// TSDB of the tenant determined by the request.
+type remoteReadHandler struct {
+	logger log.Logger
+	opts   *Options
+	gate   *promgate.Gate
+
+	mtx      sync.Mutex
+	handlers map[string]http.Handler
+}
+
+func newRemoteReadHandler(logger log.Logger, o *Options) *remoteReadHandler {
+	h := &remoteReadHandler{
+		logger:   logger,
+		opts:     o,
+		gate:     promgate.New(o.RemoteReadConcurrencyLimit),
+		handlers: map[string]http.Handler{},
+	}
+	o.TenantReader.OnTenantRemoved(h.removeTenantHandler)
+	return h
+}
+
+func (h *remoteReadHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	tenantHTTP, err := tenancy.GetTenantFromHTTP(r, h.opts.TenantHeader, h.opts.DefaultTenantID, h.opts.TenantField)
+	if err != nil {
+		level.Error(h.logger).Log("msg", "error getting tenant from HTTP", "err", err)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if _, _, err := h.opts.TenantReader.TenantQueryable(tenantHTTP); err != nil {
+		status := http.StatusInternalServerError
+		switch err {
+		case errUnknownTenant:
+			status = http.StatusNotFound
+		case ErrNotReady:
+			status = http.StatusServiceUnavailable
+		}
+		http.Error(w, err.Error(), status)
+		return
+	}
+
+	if err := h.gate.Start(r.Context()); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer h.gate.Done()
+
+	h.tenantHandler(tenantHTTP).ServeHTTP(w, r)
+}
+
+// tenantHandler returns the Prometheus remote read handler of the given tenant.
+func (h *remoteReadHandler) tenantHandler(tenantID string) http.Handler {
+	h.mtx.Lock()
+	defer h.mtx.Unlock()
+
+	if handler, ok := h.handlers[tenantID]; ok {
+		return handler
+	}
+
+	q := &tenantQueryable{tenantID: tenantID, reader: h.opts.TenantReader}
+	handler := remote.NewReadHandler(
+		log.With(h.logger, "tenant", tenantID),
+		nil,
+		q,
+		q.config,
+		h.opts.RemoteReadSampleLimit,
+		tenantRemoteReadConcurrency,
+		h.opts.RemoteReadMaxBytesInFrame,
+	)
+	h.handlers[tenantID] = handler
+	return handler
+}
+
+// removeTenantHandler removes the remote read handler of a tenant removed from the local storage.
+func (h *remoteReadHandler) removeTenantHandler(tenantID string) {
+	h.mtx.Lock()
+	defer h.mtx.Unlock()
+
+	delete(h.handlers, tenantID)
+}
+
+// tenantQueryable resolves the storage of a tenant on each query, so that
+// reads keep working after the tenant's TSDB is reopened.
+type tenantQueryable struct {
+	tenantID string
+	reader   TenantReader
+}
+
+func (q *tenantQueryable) Querier(mint, maxt int64) (storage.Querier, error) {
+	s, _, err := q.reader.TenantQueryable(q.tenantID)
+	if err != nil {
+		return nil, err
+	}
+	return s.Querier(mint, maxt)
+}
+
+func (q *tenantQueryable) ChunkQuerier(mint, maxt int64) (storage.ChunkQuerier, error) {
+	s, _, err := q.reader.TenantQueryable(q.tenantID)
+	if err != nil {
+		return nil, err
+	}
+	return s.ChunkQuerier(mint, maxt)
+}
+
+// config returns a configuration holding the external labels of the tenant, which
+// the remote read handler uses to filter matchers and label the returned series.
+func (q *tenantQueryable) config() config.Config {
+	var cfg config.Config
+	if _, lset, err := q.reader.TenantQueryable(q.tenantID); err == nil {
+		cfg.GlobalConfig.ExternalLabels = lset
+	}
+	return cfg
+}
@@ -0,0 +1,139 @@
+// Copyright (c) The Thanos Authors.
+// Licensed under the Apache License 2.0.
+
+package receive
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/efficientgo/core/testutil"
+	"github.com/go-kit/log"
+	"github.com/gogo/protobuf/proto"
+	"github.com/golang/snappy"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/prometheus/model/labels"
+	"github.com/prometheus/prometheus/prompb"
+	"github.com/prometheus/prometheus/storage/remote"
+	"github.com/prometheus/prometheus/tsdb"
+
+	"github.com/thanos-io/thanos/pkg/block/metadata"
+	"github.com/thanos-io/thanos/pkg/tenancy"
+)
+
+func TestRemoteReadHandler(t *testing.T) {
+	m := NewMultiTSDB(t.TempDir(), log.NewNopLogger(), prometheus.NewRegistry(),
+		&tsdb.Options{
+			MinBlockDuration:  (2 * time.Hour).Milliseconds(),
+			MaxBlockDuration:  (2 * time.Hour).Milliseconds(),
+			RetentionDuration: (6 * time.Hour).Milliseconds(),
+		},
+		labels.FromStrings("replica", "test"),
+		"tenant_id",
+		nil,
+		false,
+		metadata.NoneFunc,
+	)
+	defer func() { testutil.Ok(t, m.Close()) }()
+
+	now := time.Now()
+	testutil.Ok(t, appendSample(m, "foo", now))
+	testutil.Ok(t, appendSampleWithLabels(m, "bar", labels.FromStrings("foo", "baz"), now))
+
+	h := newRemoteReadHandler(log.NewNopLogger(), &Options{
+		TenantHeader:               tenancy.DefaultTenantHeader,
+		DefaultTenantID:            tenancy.DefaultTenant,
+		TenantReader:               m,
+		RemoteReadConcurrencyLimit: 1,
+		RemoteReadMaxBytesInFrame:  1024 * 1024,
+	})
+
+	read := func(tenant string, responseTypes ...prompb.ReadRequest_ResponseType) *httptest.ResponseRecorder {
+		req := &prompb.ReadRequest{Queries: []*prompb.Query{{
+			StartTimestampMs: now.Add(-time.Minute).UnixMilli(),
+			EndTimestampMs:   now.Add(time.Minute).UnixMilli(),
+			Matchers:         []*prompb.LabelMatcher{{Type: prompb.LabelMatcher_RE, Name: "foo", Value: ".+"}},
+		}}, AcceptedResponseTypes: responseTypes}
+		b, err := proto.Marshal(req)
+		testutil.Ok(t, err)
+
+		r := httptest.NewRequest(http.MethodPost, "/api/v1/read", bytes.NewReader(snappy.Encode(nil, b)))
+		r.Header.Set(tenancy.DefaultTenantHeader, tenant)
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+		return w
+	}
+
+	w := read("foo")
+	testutil.Equals(t, http.StatusOK, w.Code)
+
+	compressed, err := io.ReadAll(w.Body)
+	testutil.Ok(t, err)
+	b, err := snappy.Decode(nil, compressed)
+	testutil.Ok(t, err)
+
+	var resp prompb.ReadResponse
+	testutil.Ok(t, proto.Unmarshal(b, &resp))
+	testutil.Equals(t, 1, len(resp.Results))
+	testutil.Equals(t, 1, len(resp.Results[0].Timeseries))
+
+	// Only the series of the requested tenant are returned, labeled with the tenant's external labels.
+	testutil.Equals(t, []prompb.Label{
+		{Name: "foo", Value: "bar"},
+		{Name: "replica", Value: "test"},
+		{Name: "tenant_id", Value: "foo"},
+	}, resp.Results[0].Timeseries[0].Labels)
+	testutil.Equals(t, []prompb.Sample{{Value: 10, Timestamp: now.UnixMilli()}}, resp.Results[0].Timeseries[0].Samples)
+
+	testutil.Equals(t, http.StatusNotFound, read("unknown").Code)
+
+	t.Run("streamed XOR chunks", func(t *testing.T) {
+		w := read("foo", prompb.ReadRequest_STREAMED_XOR_CHUNKS)
+		testutil.Equals(t, http.StatusOK, w.Code)
+		testutil.Equals(t, "application/x-streamed-protobuf; proto=prometheus.ChunkedReadResponse", w.Header().Get("Content-Type"))
+
+		var series []*prompb.ChunkedSeries
+		cr := remote.NewChunkedReader(w.Body, remote.DefaultChunkedReadLimit, nil)
+		for {
+			var resp prompb.ChunkedReadResponse
+			err := cr.NextProto(&resp)
+			if err == io.EOF {
+				break
+			}
+			testutil.Ok(t, err)
+			series = append(series, resp.ChunkedSeries...)
+		}
+		testutil.Equals(t, 1, len(series))
+		testutil.Equals(t, []prompb.Label{
+			{Name: "foo", Value: "bar"},
+			{Name: "replica", Value: "test"},
+			{Name: "tenant_id", Value: "foo"},
+		}, series[0].Labels)
+		testutil.Equals(t, 1, len(series[0].Chunks))
+		testutil.Equals(t, prompb.Chunk_XOR, series[0].Chunks[0].Type)
+		testutil.Equals(t, now.UnixMilli(), series[0].Chunks[0].MinTimeMs)
+	})
+
+	t.Run("handlers of removed tenants are evicted", func(t *testing.T) {
+		// Samples past the retention, so that the tenant is pruned.
+		testutil.Ok(t, appendSample(m, "pruned", now.Add(-9*time.Hour)))
+		testutil.Equals(t, http.StatusOK, read("pruned").Code)
+		h.mtx.Lock()
+		testutil.Equals(t, 2, len(h.handlers))
+		h.mtx.Unlock()
+
+		testutil.Ok(t, m.Prune(context.Background()))
+		h.mtx.Lock()
+		_, ok := h.handlers["pruned"]
+		testutil.Assert(t, !ok, "expected the handler of the pruned tenant to be removed")
+		_, ok = h.handlers["foo"]
+		testutil.Assert(t, ok, "expected the handler of the active tenant to be kept")
+		h.mtx.Unlock()
+		testutil.Equals(t, http.StatusNotFound, read("pruned").Code)
+	})
+}
@@ -0,0 +1,270 @@
+// Copyright (c) The Thanos Authors.
+// Licensed under the Apache License 2.0.
+
+package receive
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"os"
+	"slices"
+	"sort"
+	"sync"
+
+	"github.com/go-kit/log"
+	"github.com/go-kit/log/level"
+	"github.com/pkg/errors"
+	"github.com/prometheus/common/route"
+	"github.com/prometheus/prometheus/tsdb/fileutil"
+
+	"github.com/thanos-io/thanos/pkg/store/storepb/prompb"
+)
+
+// TenantDrainer flushes the head of a tenant into blocks and uploads them to object storage, so that
+// the data written to this node so far is persisted after the tenant was moved to another node.
+type TenantDrainer interface {
+	// DrainTenant returns the number of uploaded blocks. Tenants without local storage are ignored.
+	DrainTenant(ctx context.Context, tenantID string) (int, error)
+}
+
+// TenantOverrides assigns tenants to nodes regardless of the hashring configuration, e.g. to move a heavy tenant
+// off a hot node. Overrides are persisted in a JSON file mapping tenants to the addresses of their nodes.
+type TenantOverrides struct {
+	path string
+
+	mtx       sync.RWMutex
+	overrides map[string]simpleHashring
+}
+
+// LoadTenantOverrides loads the tenant overrides persisted at the given path. The file is created on the
+// first override if it does not exist.
+func LoadTenantOverrides(path string) (*TenantOverrides, error) {
+	o := &TenantOverrides{path: path, overrides: map[string]simpleHashring{}}
+
+	b, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return o, nil
+	}
+	if err != nil {
+		return nil, errors.Wrap(err, "read tenant overrides")
+	}
+	var nodes map[string][]string
+	if err := json.Unmarshal(b, &nodes); err != nil {
+		return nil, errors.Wrap(err, "parse tenant overrides")
+	}
+	for tenant, n := range nodes {
+		if len(n) == 0 {
+			return nil, errors.Errorf("no nodes for tenant %q in tenant overrides", tenant)
+		}
+		o.overrides[tenant] = newOverrideHashring(n)
+	}
+	return o, nil
+}
+
+func newOverrideHashring(nodes []string) simpleHashring {
+	h := make(simpleHashring, len(nodes))
+	copy(h, nodes)
+	sort.Strings(h)
+	return h
+}
+
+// Set routes the writes of the tenant to the given nodes and persists the override.
+func (o *TenantOverrides) Set(tenant string, nodes []string) error {
+	if len(nodes) == 0 {
+		return errors.New("no nodes given")
+	}
+
+	o.mtx.Lock()
+	defer o.mtx.Unlock()
+
+	prev, ok := o.overrides[tenant]
+	o.overrides[tenant] = newOverrideHashring(nodes)
+	if err := o.persist(); err != nil {
+		if ok {
+			o.overrides[tenant] = prev
+		} else {
+			delete(o.overrides, tenant)
+		}
+		return err
+	}
+	return nil
+}
+
+// Delete removes the override of the tenant, which is routed according to the hashring configuration again.
+func (o *TenantOverrides) Delete(tenant string) error {
+	o.mtx.Lock()
+	defer o.mtx.Unlock()
+
+	prev, ok := o.overrides[tenant]
+	if !ok {
+		return nil
+	}
+	delete(o.overrides, tenant)
+	if err := o.persist(); err != nil {
+		o.overrides[tenant] = prev
+		return err
+	}
+	return nil
+}
+
+// Nodes returns the nodes of all overridden tenants.
+func (o *TenantOverrides) Nodes() map[string][]string {
+	o.mtx.RLock()
+	defer o.mtx.RUnlock()
+
+	res := make(map[string][]string, len(o.overrides))
+	for tenant, h := range o.overrides {
+		res[tenant] = append([]string(nil), h...)
+	}
+	return res
+}
+
+func (o *TenantOverrides) get(tenant string) (simpleHashring, bool) {
+	o.mtx.RLock()
+	defer o.mtx.RUnlock()
+
+	h, ok := o.overrides[tenant]
+	return h, ok
+}
+
+// persist writes the overrides to a temporary file first, so that a crash does not leave a partial file behind.
+func (o *TenantOverrides) persist() error {
+	nodes := make(map[string][]string, len(o.overrides))
+	for tenant, h := range o.overrides {
+		nodes[tenant] = h
+	}
+	b, err := json.MarshalIndent(nodes, "", "  ")
+	if err != nil {
+		return errors.Wrap(err, "marshal tenant overrides")
+	}
+	tmp := o.path + ".tmp"
+	if err := os.WriteFile(tmp, b, 0600); err != nil {
+		return errors.Wrap(err, "write tenant overrides")
+	}
+	return errors.Wrap(fileutil.Replace(tmp, o.path), "replace tenant overrides")
+}
+
+// Hashring returns a hashring routing overridden tenants to their nodes and all other tenants with h.
+func (o *TenantOverrides) Hashring(h Hashring) Hashring {
+	return &overrideHashring{hashring: h, overrides: o}
+}
+
+type overrideHashring struct {
+	hashring  Hashring
+	overrides *TenantOverrides
+}
+
+// Get implements the Hashring interface.
+func (h *overrideHashring) Get(tenant string, ts *prompb.TimeSeries) (string, error) {
+	return h.GetN(tenant, ts, 0)
+}
+
+// GetN implements the Hashring interface.
+func (h *overrideHashring) GetN(tenant string, ts *prompb.TimeSeries, n uint64) (string, error) {
+	if o, ok := h.overrides.get(tenant); ok {
+		return o.GetN(tenant, ts, n)
+	}
+	return h.hashring.GetN(tenant, ts, n)
+}
+
+// Nodes implements the Hashring interface. It includes the nodes of overridden tenants.
+func (h *overrideHashring) Nodes() []string {
+	nodes := append([]string(nil), h.hashring.Nodes()...)
+	for _, n := range h.overrides.Nodes() {
+		nodes = append(nodes, n...)
+	}
+	sort.Strings(nodes)
+	return nodes
+}
+
+// tenantMoveHandler serves the API moving tenants to other nodes.
+type tenantMoveHandler struct {
+	logger log.Logger
+	opts   *Options
+
+	// hashringNodes returns the nodes tenants can be moved to.
+	hashringNodes func() []string
+}
+
+func newTenantMoveHandler(logger log.Logger, o *Options, hashringNodes func() []string) *tenantMoveHandler {
+	return &tenantMoveHandler{logger: logger, opts: o, hashringNodes: hashringNodes}
+}
+
+// register registers the endpoints of the API on r, wrapping their handlers with wrap.
+func (h *tenantMoveHandler) register(r *route.Router, wrap func(name string, next http.HandlerFunc) http.HandlerFunc) {
+	r.Get("/api/v1/tenants/overrides", wrap("tenant_overrides", h.authenticate(h.list)))
+	r.Post("/api/v1/tenants/:tenant/move", wrap("tenant_move", h.authenticate(h.move)))
+	r.Del("/api/v1/tenants/:tenant/override", wrap("tenant_override_delete", h.authenticate(h.delete)))
+}
+
+// authenticate rejects requests not carrying the bearer token of the tenant overrides API, if any.
+func (h *tenantMoveHandler) authenticate(next http.HandlerFunc) http.HandlerFunc {
+	return bearerTokenAuth(h.opts.TenantOverridesBearerToken, next)
+}
+
+func (h *tenantMoveHandler) list(w http.ResponseWriter, _ *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(h.opts.TenantOverrides.Nodes())
+}
+
+// move routes the writes of the tenant to the nodes given by the node parameters, which have to be nodes of the
+// hashring. If this node is not one of
+// them, the head of the tenant is flushed and its blocks are uploaded afterwards. Writes received in the
+// meantime, including those forwarded by nodes not aware of the override yet, are forwarded to the new nodes.
+func (h *tenantMoveHandler) move(w http.ResponseWriter, r *http.Request) {
+	tenant := route.Param(r.Context(), "tenant")
+	if err := r.ParseForm(); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	nodes := r.Form["node"]
+	if len(nodes) == 0 || uint64(len(nodes)) < h.opts.ReplicationFactor {
+		http.Error(w, errors.Errorf("%d nodes given, at least %d are required by the replication factor", len(nodes), h.opts.ReplicationFactor).Error(), http.StatusBadRequest)
+		return
+	}
+	hashringNodes := h.hashringNodes()
+	for _, n := range nodes {
+		if !slices.Contains(hashringNodes, n) {
+			http.Error(w, errors.Errorf("node %q is not a node of the hashring", n).Error(), http.StatusBadRequest)
+			return
+		}
+	}
+	if err := h.opts.TenantOverrides.Set(tenant, nodes); err != nil {
+		level.Error(h.logger).Log("msg", "setting tenant override failed", "tenant", tenant, "err", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	level.Info(h.logger).Log("msg", "tenant moved", "tenant", tenant, "nodes", nodes)
+
+	var uploaded int
+	if h.opts.TenantDrainer != nil && !slices.Contains(nodes, h.opts.Endpoint) {
+		var err error
+		if uploaded, err = h.opts.TenantDrainer.DrainTenant(r.Context(), tenant); err != nil {
+			level.Error(h.logger).Log("msg", "draining tenant failed", "tenant", tenant, "err", err)
+			status := http.StatusInternalServerError
+			if errors.Cause(err) == ErrNotReady {
+				status = http.StatusServiceUnavailable
+			}
+			http.Error(w, errors.Wrap(err, "drain tenant").Error(), status)
+			return
+		}
+		level.Info(h.logger).Log("msg", "tenant drained", "tenant", tenant, "uploaded", uploaded)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(struct {
+		Uploaded int `json:"uploaded"`
+	}{Uploaded: uploaded})
+}
+
+func (h *tenantMoveHandler) delete(w http.ResponseWriter, r *http.Request) {
+	tenant := route.Param(r.Context(), "tenant")
+	if err := h.opts.TenantOverrides.Delete(tenant); err != nil {
+		level.Error(h.logger).Log("msg", "deleting tenant override failed", "tenant", tenant, "err", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	level.Info(h.logger).Log("msg", "tenant override deleted", "tenant", tenant)
+	w.WriteHeader(http.StatusOK)
+}
@@ -0,0 +1,161 @@
+// Copyright (c) The Thanos Authors.
+// Licensed under the Apache License 2.0.
+
+package receive
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/efficientgo/core/testutil"
+	"github.com/go-kit/log"
+	"github.com/prometheus/common/route"
+
+	"github.com/thanos-io/thanos/pkg/store/labelpb"
+	"github.com/thanos-io/thanos/pkg/store/storepb/prompb"
+)
+
+func TestTenantOverrides(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "overrides.json")
+	o, err := LoadTenantOverrides(path)
+	testutil.Ok(t, err)
+
+	h := o.Hashring(SingleNodeHashring("node-1"))
+	ts := &prompb.TimeSeries{Labels: []*labelpb.Label{{Name: "foo", Value: "bar"}}}
+
+	node, err := h.Get("heavy", ts)
+	testutil.Ok(t, err)
+	testutil.Equals(t, "node-1", node)
+
+	testutil.NotOk(t, o.Set("heavy", nil))
+	testutil.Ok(t, o.Set("heavy", []string{"node-3", "node-2"}))
+
+	node, err = h.GetN("heavy", ts, 0)
+	testutil.Ok(t, err)
+	other, err := h.GetN("heavy", ts, 1)
+	testutil.Ok(t, err)
+	testutil.Equals(t, []string{"node-2", "node-3"}, sortedStrings(node, other))
+	_, err = h.GetN("heavy", ts, 2)
+	testutil.NotOk(t, err)
+
+	node, err = h.Get("light", ts)
+	testutil.Ok(t, err)
+	testutil.Equals(t, "node-1", node)
+	testutil.Equals(t, []string{"node-1", "node-2", "node-3"}, h.Nodes())
+
+	// Overrides are persisted.
+	reloaded, err := LoadTenantOverrides(path)
+	testutil.Ok(t, err)
+	testutil.Equals(t, map[string][]string{"heavy": {"node-2", "node-3"}}, reloaded.Nodes())
+
+	testutil.Ok(t, o.Delete("heavy"))
+	node, err = h.Get("heavy", ts)
+	testutil.Ok(t, err)
+	testutil.Equals(t, "node-1", node)
+
+	reloaded, err = LoadTenantOverrides(path)
+	testutil.Ok(t, err)
+	testutil.Equals(t, map[string][]string{}, reloaded.Nodes())
+}
+
+func sortedStrings(s ...string) []string {
+	if s[0] > s[1] {
+		s[0], s[1] = s[1], s[0]
+	}
+	return s
+}
+
+type fakeTenantDrainer struct {
+	drained []string
+}
+
+func (d *fakeTenantDrainer) DrainTenant(_ context.Context, tenantID string) (int, error) {
+	d.drained = append(d.drained, tenantID)
+	return 2, nil
+}
+
+func TestTenantMoveHandler(t *testing.T) {
+	o, err := LoadTenantOverrides(filepath.Join(t.TempDir(), "overrides.json"))
+	testutil.Ok(t, err)
+	drainer := &fakeTenantDrainer{}
+
+	router := route.New()
+	newTenantMoveHandler(log.NewNopLogger(), &Options{
+		Endpoint:                   "node-1",
+		ReplicationFactor:          1,
+		TenantOverrides:            o,
+		TenantOverridesBearerToken: "secret",
+		TenantDrainer:              drainer,
+	}, func() []string { return []string{"node-1", "node-2"} }).register(router, func(_ string, next http.HandlerFunc) http.HandlerFunc { return next })
+
+	doWithToken := func(token, method, path string, nodes ...string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(method, path, strings.NewReader(url.Values{"node": nodes}.Encode()))
+		r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		if token != "" {
+			r.Header.Set("Authorization", "Bearer "+token)
+		}
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, r)
+		return w
+	}
+	do := func(method, path string, nodes ...string) *httptest.ResponseRecorder {
+		return doWithToken("secret", method, path, nodes...)
+	}
+
+	// Requests without the bearer token are rejected.
+	for _, token := range []string{"", "wrong"} {
+		testutil.Equals(t, http.StatusUnauthorized, doWithToken(token, http.MethodPost, "/api/v1/tenants/foo/move", "node-2").Code)
+		testutil.Equals(t, http.StatusUnauthorized, doWithToken(token, http.MethodDelete, "/api/v1/tenants/foo/override").Code)
+		testutil.Equals(t, http.StatusUnauthorized, doWithToken(token, http.MethodGet, "/api/v1/tenants/overrides").Code)
+	}
+
+	testutil.Equals(t, http.StatusBadRequest, do(http.MethodPost, "/api/v1/tenants/foo/move").Code)
+
+	// Tenants can only be moved to nodes of the hashring.
+	testutil.Equals(t, http.StatusBadRequest, do(http.MethodPost, "/api/v1/tenants/foo/move", "node-2", "attacker:10908").Code)
+	testutil.Equals(t, map[string][]string{}, o.Nodes())
+	testutil.Equals(t, 0, len(drainer.drained))
+
+	// Moving a tenant to this node does not drain it.
+	w := do(http.MethodPost, "/api/v1/tenants/foo/move", "node-1")
+	testutil.Equals(t, http.StatusOK, w.Code)
+	testutil.Equals(t, 0, len(drainer.drained))
+
+	w = do(http.MethodPost, "/api/v1/tenants/bar/move", "node-2")
+	testutil.Equals(t, http.StatusOK, w.Code)
+	testutil.Equals(t, []string{"bar"}, drainer.drained)
+	var res struct {
+		Uploaded int `json:"uploaded"`
+	}
+	testutil.Ok(t, json.NewDecoder(w.Body).Decode(&res))
+	testutil.Equals(t, 2, res.Uploaded)
+
+	w = do(http.MethodGet, "/api/v1/tenants/overrides")
+	testutil.Equals(t, http.StatusOK, w.Code)
+	var overrides map[string][]string
+	testutil.Ok(t, json.NewDecoder(w.Body).Decode(&overrides))
+	testutil.Equals(t, map[string][]string{"foo": {"node-1"}, "bar": {"node-2"}}, overrides)
+
+	testutil.Equals(t, http.StatusOK, do(http.MethodDelete, "/api/v1/tenants/foo/override").Code)
+	testutil.Equals(t, map[string][]string{"bar": {"node-2"}}, o.Nodes())
+}
+
+func TestHandlerHashringNodes(t *testing.T) {
+	o, err := LoadTenantOverrides(filepath.Join(t.TempDir(), "overrides.json"))
+	testutil.Ok(t, err)
+	testutil.Ok(t, o.Set("foo", []string{"node-3"}))
+
+	h := &Handler{}
+	testutil.Equals(t, 0, len(h.hashringNodes()))
+
+	// Nodes of tenant overrides are not nodes tenants can be moved to.
+	h.hashring = o.Hashring(simpleHashring{"node-1", "node-2"})
+	testutil.Equals(t, []string{"node-1", "node-2", "node-3"}, h.hashring.Nodes())
+	testutil.Equals(t, []string{"node-1", "node-2"}, h.hashringNodes())
+}
@@ -0,0 +1,227 @@
+// Copyright (c) The Thanos Authors.
+// Licensed under the Apache License 2.0.
+
+package receive
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/prometheus/model/labels"
+	"gopkg.in/yaml.v2"
+
+	"github.com/thanos-io/thanos/pkg/store/labelpb"
+	"github.com/thanos-io/thanos/pkg/store/storepb/prompb"
+)
+
+// maxReportedViolations is the maximum number of violations detailed in the response to a write request.
+const maxReportedViolations = 10
+
+// ValidationConfig configures the rules series written by tenants must follow.
+type ValidationConfig struct {
+	// Default are the rules of tenants without rules of their own.
+	Default []ValidationRule `yaml:"default"`
+	// Tenants are the rules of given tenants, replacing the default ones.
+	Tenants map[string][]ValidationRule `yaml:"tenants"`
+}
+
+// ValidationRule is a rule series must follow. All of its set conditions must hold for a series to be accepted.
+type ValidationRule struct {
+	// Name identifies the rule in responses and metrics.
+	Name string `yaml:"name"`
+	// MetricNameAllow is a regular expression metric names must fully match.
+	MetricNameAllow string `yaml:"metric_name_allow"`
+	// MetricNameDeny is a regular expression metric names must not fully match.
+	MetricNameDeny string `yaml:"metric_name_deny"`
+	// RequiredLabels are the names of the labels series must have.
+	RequiredLabels []string `yaml:"required_labels"`
+	// ForbiddenLabelPairs are sets of label names and regular expressions fully matching their values which series
+	// must not have all together, e.g. {env: prod, cluster: staging-.*}.
+	ForbiddenLabelPairs []map[string]string `yaml:"forbidden_label_pairs"`
+}
+
+// ParseValidationConfig parses the validation rules of tenants from YAML.
+func ParseValidationConfig(content []byte) (*ValidationConfig, error) {
+	var conf ValidationConfig
+	if err := yaml.UnmarshalStrict(content, &conf); err != nil {
+		return nil, errors.Wrap(err, "parse validation config")
+	}
+	return &conf, nil
+}
+
+// SeriesValidator rejects the series of tenants violating their validation rules.
+type SeriesValidator struct {
+	defaultRules []compiledRule
+	tenantRules  map[string][]compiledRule
+
+	rejected *prometheus.CounterVec
+}
+
+type compiledRule struct {
+	name           string
+	allow, deny    *labels.FastRegexMatcher
+	requiredLabels []string
+	forbiddenPairs [][]*labels.Matcher
+}
+
+// NewSeriesValidator returns a SeriesValidator enforcing the given rules, with their regular expressions compiled.
+func NewSeriesValidator(conf ValidationConfig, reg prometheus.Registerer) (*SeriesValidator, error) {
+	v := &SeriesValidator{
+		tenantRules: make(map[string][]compiledRule, len(conf.Tenants)),
+		rejected: promauto.With(reg).NewCounterVec(prometheus.CounterOpts{
+			Name: "thanos_receive_validation_rejected_series_total",
+			Help: "The total number of series rejected because they violate a validation rule of their tenant.",
+		}, []string{"tenant", "rule"}),
+	}
+	var err error
+	if v.defaultRules, err = compileRules(conf.Default); err != nil {
+		return nil, errors.Wrap(err, "default rules")
+	}
+	for tenant, rules := range conf.Tenants {
+		if v.tenantRules[tenant], err = compileRules(rules); err != nil {
+			return nil, errors.Wrapf(err, "rules of tenant %s", tenant)
+		}
+	}
+	return v, nil
+}
+
+func compileRules(rules []ValidationRule) ([]compiledRule, error) {
+	names := make(map[string]struct{}, len(rules))
+	compiled := make([]compiledRule, 0, len(rules))
+	for _, r := range rules {
+		if r.Name == "" {
+			return nil, errors.New("validation rule without name")
+		}
+		if _, ok := names[r.Name]; ok {
+			return nil, errors.Errorf("duplicate validation rule %s", r.Name)
+		}
+		names[r.Name] = struct{}{}
+
+		c := compiledRule{name: r.Name, requiredLabels: r.RequiredLabels}
+		var err error
+		if r.MetricNameAllow != "" {
+			if c.allow, err = labels.NewFastRegexMatcher(r.MetricNameAllow); err != nil {
+				return nil, errors.Wrapf(err, "metric_name_allow of rule %s", r.Name)
+			}
+		}
+		if r.MetricNameDeny != "" {
+			if c.deny, err = labels.NewFastRegexMatcher(r.MetricNameDeny); err != nil {
+				return nil, errors.Wrapf(err, "metric_name_deny of rule %s", r.Name)
+			}
+		}
+		for _, pairs := range r.ForbiddenLabelPairs {
+			if len(pairs) == 0 {
+				return nil, errors.Errorf("empty forbidden_label_pairs of rule %s", r.Name)
+			}
+			ms := make([]*labels.Matcher, 0, len(pairs))
+			for name, value := range pairs {
+				m, err := labels.NewMatcher(labels.MatchRegexp, name, value)
+				if err != nil {
+					return nil, errors.Wrapf(err, "forbidden_label_pairs of rule %s", r.Name)
+				}
+				ms = append(ms, m)
+			}
+			sort.Slice(ms, func(i, j int) bool { return ms[i].Name < ms[j].Name })
+			c.forbiddenPairs = append(c.forbiddenPairs, ms)
+		}
+		compiled = append(compiled, c)
+	}
+	return compiled, nil
+}
+
+// violation returns why the series violates the rule, or an empty string if it does not.
+func (r *compiledRule) violation(lset []*labelpb.Label) string {
+	value := func(name string) (string, bool) {
+		for _, l := range lset {
+			if l.Name == name {
+				return l.Value, true
+			}
+		}
+		return "", false
+	}
+
+	metricName, _ := value(labels.MetricName)
+	if r.allow != nil && !r.allow.MatchString(metricName) {
+		return fmt.Sprintf("metric name %q is not allowed", metricName)
+	}
+	if r.deny != nil && r.deny.MatchString(metricName) {
+		return fmt.Sprintf("metric name %q is denied", metricName)
+	}
+	for _, name := range r.requiredLabels {
+		if v, ok := value(name); !ok || v == "" {
+			return fmt.Sprintf("required label %q is missing", name)
+		}
+	}
+pairs:
+	for _, ms := range r.forbiddenPairs {
+		for _, m := range ms {
+			v, ok := value(m.Name)
+			if !ok || !m.Matches(v) {
+				continue pairs
+			}
+		}
+		return fmt.Sprintf("forbidden labels %s", matchersString(ms))
+	}
+	return ""
+}
+
+func matchersString(ms []*labels.Matcher) string {
+	s := make([]string, 0, len(ms))
+	for _, m := range ms {
+		s = append(s, m.String())
+	}
+	return "{" + strings.Join(s, ", ") + "}"
+}
+
+// Filter removes the series violating the rules of their tenant from the request. The tenant of a series is the
+// value of its splitTenantLabelName label if set, tenantHTTP otherwise. It returns an error detailing the violations,
+// if any, to be reported to the client once the valid series are written.
+func (v *SeriesValidator) Filter(tenantHTTP, splitTenantLabelName string, wreq *prompb.WriteRequest) error {
+	var (
+		valid      = wreq.Timeseries[:0]
+		violations []string
+		rejected   int
+	)
+	for _, ts := range wreq.Timeseries {
+		tenant := tenantHTTP
+		if splitTenantLabelName != "" {
+			for _, l := range ts.Labels {
+				if l.Name == splitTenantLabelName && l.Value != "" {
+					tenant = l.Value
+					break
+				}
+			}
+		}
+		rules, ok := v.tenantRules[tenant]
+		if !ok {
+			rules = v.defaultRules
+		}
+
+		var violation string
+		for i := range rules {
+			if violation = rules[i].violation(ts.Labels); violation != "" {
+				v.rejected.WithLabelValues(tenant, rules[i].name).Inc()
+				if len(violations) < maxReportedViolations {
+					violations = append(violations, fmt.Sprintf("series %s of tenant %s violates rule %s: %s",
+						labelpb.LabelpbLabelsToPromLabels(ts.Labels), tenant, rules[i].name, violation))
+				}
+				break
+			}
+		}
+		if violation != "" {
+			rejected++
+			continue
+		}
+		valid = append(valid, ts)
+	}
+	wreq.Timeseries = valid
+
+	if rejected == 0 {
+		return nil
+	}
+	return errors.Errorf("%d series rejected by validation rules: %s", rejected, strings.Join(violations, "; "))
+}
@@ -0,0 +1,127 @@
+// Copyright (c) The Thanos Authors.
+// Licensed under the Apache License 2.0.
+
+package receive
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/efficientgo/core/testutil"
+	"github.com/prometheus/client_golang/prometheus"
+	promtestutil "github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/prometheus/prometheus/model/labels"
+
+	"github.com/thanos-io/thanos/pkg/store/labelpb"
+	"github.com/thanos-io/thanos/pkg/store/storepb/prompb"
+)
+
+const testValidationConfig = `
+default:
+  - name: no-debug
+    metric_name_deny: 'debug_.*'
+tenants:
+  team-a:
+    - name: prefix
+      metric_name_allow: 'team_a_.*'
+    - name: labels
+      required_labels: [job]
+      forbidden_label_pairs:
+        - {env: prod, cluster: 'staging-.*'}
+`
+
+func newTestSeries(lset ...string) *prompb.TimeSeries {
+	return &prompb.TimeSeries{
+		Labels:  labelpb.PromLabelsToLabelpbLabels(labels.FromStrings(lset...)),
+		Samples: []*prompb.Sample{{Value: 1, Timestamp: 1}},
+	}
+}
+
+func TestSeriesValidator(t *testing.T) {
+	conf, err := ParseValidationConfig([]byte(testValidationConfig))
+	testutil.Ok(t, err)
+	v, err := NewSeriesValidator(*conf, prometheus.NewRegistry())
+	testutil.Ok(t, err)
+
+	wreq := &prompb.WriteRequest{Timeseries: []*prompb.TimeSeries{
+		newTestSeries("__name__", "team_a_up", "job", "api"),
+		newTestSeries("__name__", "up", "job", "api"),
+		newTestSeries("__name__", "team_a_up"),
+		newTestSeries("__name__", "team_a_up", "job", "api", "env", "prod", "cluster", "staging-1"),
+		newTestSeries("__name__", "team_a_up", "job", "api", "env", "prod", "cluster", "prod-1"),
+		// Series of other tenants follow the default rules.
+		newTestSeries("__name__", "debug_up", "tenant", "team-b"),
+		newTestSeries("__name__", "up", "tenant", "team-b"),
+	}}
+	err = v.Filter("team-a", "tenant", wreq)
+	testutil.NotOk(t, err)
+	testutil.Equals(t, "4 series rejected by validation rules: "+
+		`series {__name__="up", job="api"} of tenant team-a violates rule prefix: metric name "up" is not allowed; `+
+		`series {__name__="team_a_up"} of tenant team-a violates rule labels: required label "job" is missing; `+
+		`series {__name__="team_a_up", cluster="staging-1", env="prod", job="api"} of tenant team-a violates rule labels: forbidden labels {cluster=~"staging-.*", env=~"prod"}; `+
+		`series {__name__="debug_up", tenant="team-b"} of tenant team-b violates rule no-debug: metric name "debug_up" is denied`, err.Error())
+
+	testutil.Equals(t, 3, len(wreq.Timeseries))
+	testutil.Equals(t, `{__name__="team_a_up", job="api"}`, labelpb.LabelpbLabelsToPromLabels(wreq.Timeseries[0].Labels).String())
+	testutil.Equals(t, `{__name__="up", tenant="team-b"}`, labelpb.LabelpbLabelsToPromLabels(wreq.Timeseries[2].Labels).String())
+
+	testutil.Equals(t, 1.0, promtestutil.ToFloat64(v.rejected.WithLabelValues("team-a", "prefix")))
+	testutil.Equals(t, 2.0, promtestutil.ToFloat64(v.rejected.WithLabelValues("team-a", "labels")))
+	testutil.Equals(t, 1.0, promtestutil.ToFloat64(v.rejected.WithLabelValues("team-b", "no-debug")))
+
+	// Without split tenant label, all series are of the tenant of the request.
+	testutil.Ok(t, v.Filter("team-b", "", wreq))
+	testutil.NotOk(t, v.Filter("team-a", "", wreq))
+	testutil.Equals(t, 2, len(wreq.Timeseries))
+
+	for _, invalid := range []string{
+		`default: [{metric_name_allow: 'up'}]`,
+		`default: [{name: a}, {name: a}]`,
+		`default: [{name: a, metric_name_deny: '('}]`,
+		`tenants: {a: [{name: a, forbidden_label_pairs: [{}]}]}`,
+		`tenants: {a: [{name: a, unknown: true}]}`,
+	} {
+		conf, err := ParseValidationConfig([]byte(invalid))
+		if err == nil {
+			_, err = NewSeriesValidator(*conf, nil)
+		}
+		testutil.NotOk(t, err, invalid)
+	}
+}
+
+func TestReceiveHTTPValidation(t *testing.T) {
+	appendable := &fakeAppendable{appender: newFakeAppender(nil, nil, nil)}
+	handlers, _, err := newTestHandlerHashring([]*fakeAppendable{appendable}, 1, AlgorithmHashmod)
+	testutil.Ok(t, err)
+	handler := handlers[0]
+
+	conf, err := ParseValidationConfig([]byte(testValidationConfig))
+	testutil.Ok(t, err)
+	handler.options.SeriesValidator, err = NewSeriesValidator(*conf, prometheus.NewRegistry())
+	testutil.Ok(t, err)
+
+	valid := newTestSeries("__name__", "team_a_up", "job", "api")
+	rec, err := makeRequest(handler, "team-a", &prompb.WriteRequest{Timeseries: []*prompb.TimeSeries{
+		valid,
+		newTestSeries("__name__", "up", "job", "api"),
+	}})
+	testutil.Ok(t, err)
+	testutil.Equals(t, http.StatusBadRequest, rec.Code)
+	testutil.Assert(t, strings.Contains(rec.Body.String(), "1 series rejected by validation rules"), rec.Body.String())
+
+	// The valid series was written nonetheless.
+	testutil.Equals(t, 1, len(appendable.appender.(*fakeAppender).Get(labelpb.LabelpbLabelsToPromLabels(valid.Labels))))
+
+	rec, err = makeRequest(handler, "team-a", &prompb.WriteRequest{Timeseries: []*prompb.TimeSeries{
+		newTestSeries("__name__", "up", "job", "api"),
+	}})
+	testutil.Ok(t, err)
+	testutil.Equals(t, http.StatusBadRequest, rec.Code)
+
+	rec, err = makeRequest(handler, "team-b", &prompb.WriteRequest{Timeseries: []*prompb.TimeSeries{
+		newTestSeries("__name__", "up"),
+	}})
+	testutil.Ok(t, err)
+	testutil.Equals(t, http.StatusOK, rec.Code)
+}
@@ -10,6 +10,8 @@ import (
 	"github.com/go-kit/log"
 	"github.com/go-kit/log/level"
 	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
 	"github.com/prometheus/common/model"
 	"github.com/prometheus/prometheus/model/exemplar"
 	"github.com/prometheus/prometheus/model/histogram"
@@ -31,35 +33,94 @@ type TenantStorage interface {
 	TenantAppendable(string) (Appendable, error)
 }
 
+// TimestampBoundsAction is the action taken on samples with timestamps out of the bounds configured in
+// WriterOptions.
+type TimestampBoundsAction string
+
+const (
+	// TimestampBoundsReject rejects samples out of bounds as out of bounds.
+	TimestampBoundsReject TimestampBoundsAction = "reject"
+	// TimestampBoundsClamp appends samples out of bounds at the bound they exceed instead.
+	TimestampBoundsClamp TimestampBoundsAction = "clamp"
+)
+
 // Wraps storage.Appender to add validation and logging.
 type ReceiveAppender struct {
 	tLogger        log.Logger
 	tooFarInFuture int64 // Unit: nanoseconds
+	tooFarInPast   int64 // Unit: nanoseconds
+	boundsAction   TimestampBoundsAction
+	outOfBounds    *prometheus.CounterVec
 	storage.Appender
 }
 
+// checkTimestamp returns the timestamp to append the sample of lset at t at, or storage.ErrOutOfBounds if the
+// sample is rejected because its timestamp is out of the bounds relative to the receiver time.
+func (ra *ReceiveAppender) checkTimestamp(lset labels.Labels, t int64) (int64, error) {
+	if ra.tooFarInFuture <= 0 && ra.tooFarInPast <= 0 {
+		return t, nil
+	}
+
+	var (
+		now   = model.Now()
+		bound model.Time
+		side  string
+	)
+	if tooFar := now.Add(time.Duration(ra.tooFarInFuture)); ra.tooFarInFuture > 0 && tooFar.Before(model.Time(t)) {
+		// now + tooFarInFutureTimeWindow < sample timestamp
+		bound, side = tooFar, "future"
+	} else if tooOld := now.Add(-time.Duration(ra.tooFarInPast)); ra.tooFarInPast > 0 && model.Time(t).Before(tooOld) {
+		// sample timestamp < now - tooFarInPastTimeWindow
+		bound, side = tooOld, "past"
+	} else {
+		return t, nil
+	}
+
+	if ra.boundsAction == TimestampBoundsClamp {
+		ra.outOfBounds.WithLabelValues(side, string(TimestampBoundsClamp)).Inc()
+		level.Debug(ra.tLogger).Log("msg", "clamp metric too far in the "+side, "lset", lset,
+			"timestamp", t, "bound", bound)
+		return int64(bound), nil
+	}
+	ra.outOfBounds.WithLabelValues(side, string(TimestampBoundsReject)).Inc()
+	level.Warn(ra.tLogger).Log("msg", "block metric too far in the "+side, "lset", lset,
+		"timestamp", t, "bound", bound)
+	return 0, storage.ErrOutOfBounds
+}
+
 func (ra *ReceiveAppender) Append(ref storage.SeriesRef, lset labels.Labels, t int64, v float64) (storage.SeriesRef, error) {
-	if ra.tooFarInFuture > 0 {
-		tooFar := model.Now().Add(time.Duration(ra.tooFarInFuture))
-		if tooFar.Before(model.Time(t)) {
-			level.Warn(ra.tLogger).Log("msg", "block metric too far in the future", "lset", lset,
-				"timestamp", t, "bound", tooFar)
-			// now + tooFarInFutureTimeWindow < sample timestamp
-			return 0, storage.ErrOutOfBounds
-		}
+	t, err := ra.checkTimestamp(lset, t)
+	if err != nil {
+		return 0, err
 	}
 	return ra.Appender.Append(ref, lset, t, v)
 }
 
+func (ra *ReceiveAppender) AppendHistogram(ref storage.SeriesRef, lset labels.Labels, t int64, h *histogram.Histogram, fh *histogram.FloatHistogram) (storage.SeriesRef, error) {
+	t, err := ra.checkTimestamp(lset, t)
+	if err != nil {
+		return 0, err
+	}
+	return ra.Appender.AppendHistogram(ref, lset, t, h, fh)
+}
+
 type WriterOptions struct {
 	Intern                   bool
 	TooFarInFutureTimeWindow int64 // Unit: nanoseconds
+	TooFarInPastTimeWindow   int64 // Unit: nanoseconds
+	// TimestampBoundsAction is the action taken on samples too far in the future or the past. Defaults to
+	// TimestampBoundsReject.
+	TimestampBoundsAction TimestampBoundsAction
+	// Registerer registers the metrics of samples out of the timestamp bounds.
+	Registerer prometheus.Registerer
 }
 
 type Writer struct {
 	logger    log.Logger
 	multiTSDB TenantStorage
 	opts      *WriterOptions
+
+	outOfBoundsTimestamps *prometheus.CounterVec
 }
 
 func NewWriter(logger log.Logger, multiTSDB TenantStorage, opts *WriterOptions) *Writer {
@@ -70,6 +131,10 @@ func NewWriter(logger log.Logger, multiTSDB TenantStorage, opts *WriterOptions)
 		logger:    logger,
 		multiTSDB: multiTSDB,
 		opts:      opts,
+		outOfBoundsTimestamps: promauto.With(opts.Registerer).NewCounterVec(prometheus.CounterOpts{
+			Name: "thanos_receive_out_of_bounds_timestamp_samples_total",
+			Help: "Number of samples with timestamps too far in the future or the past of the receiver time, by the bound they exceed and the action taken.",
+		}, []string{"tenant", "bound", "action"}),
 	}
 }
 
@@ -111,6 +176,9 @@ func (r *Writer) Write(ctx context.Context, tenantID string, wreq *prompb.WriteR
 	app = &ReceiveAppender{
 		tLogger:        tLogger,
 		tooFarInFuture: r.opts.TooFarInFutureTimeWindow,
+		tooFarInPast:   r.opts.TooFarInPastTimeWindow,
+		boundsAction:   r.opts.TimestampBoundsAction,
+		outOfBounds:    r.outOfBoundsTimestamps.MustCurryWith(prometheus.Labels{"tenant": tenantID}),
 		Appender:       app,
 	}
 	for _, t := range wreq.Timeseries {
@@ -14,6 +14,7 @@ import (
 	"github.com/go-kit/log"
 	"github.com/pkg/errors"
 	"github.com/prometheus/client_golang/prometheus"
+	promtestutil "github.com/prometheus/client_golang/prometheus/testutil"
 	"github.com/prometheus/common/model"
 	"github.com/prometheus/prometheus/model/exemplar"
 	"github.com/prometheus/prometheus/model/labels"
@@ -390,6 +391,84 @@ func TestWriter(t *testing.T) {
 	}
 }
 
+func TestWriter_TimestampBounds(t *testing.T) {
+	lbls := []*labelpb.Label{{Name: "__name__", Value: "test"}}
+	lset := labelpb.LabelpbLabelsToPromLabels(lbls)
+
+	for _, tc := range []struct {
+		name            string
+		opts            *WriterOptions
+		expectedErr     error
+		expectedOffsets []time.Duration
+		expectedCounts  map[string]float64
+	}{
+		{
+			name:            "should accept all samples by default",
+			opts:            &WriterOptions{},
+			expectedOffsets: []time.Duration{-24 * time.Hour, 0, time.Hour},
+		},
+		{
+			name: "should reject samples out of bounds",
+			opts: &WriterOptions{
+				TooFarInFutureTimeWindow: int64(10 * time.Minute),
+				TooFarInPastTimeWindow:   int64(10 * time.Minute),
+			},
+			expectedErr:     errors.Wrapf(storage.ErrOutOfBounds, "add 2 samples"),
+			expectedOffsets: []time.Duration{0},
+			expectedCounts:  map[string]float64{"past/reject": 1, "future/reject": 1},
+		},
+		{
+			name: "should clamp samples out of bounds",
+			opts: &WriterOptions{
+				TooFarInFutureTimeWindow: int64(10 * time.Minute),
+				TooFarInPastTimeWindow:   int64(10 * time.Minute),
+				TimestampBoundsAction:    TimestampBoundsClamp,
+			},
+			expectedOffsets: []time.Duration{-10 * time.Minute, 0, 10 * time.Minute},
+			expectedCounts:  map[string]float64{"past/clamp": 1, "future/clamp": 1},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			reg := prometheus.NewRegistry()
+			tc.opts.Registerer = reg
+			app := newFakeAppender(nil, nil, nil)
+			w := NewWriter(log.NewNopLogger(), newFakeTenantAppendable(&fakeAppendable{appender: app}), tc.opts)
+
+			now := model.Now()
+			err := w.Write(context.Background(), tenancy.DefaultTenant, &prompb.WriteRequest{
+				Timeseries: []*prompb.TimeSeries{{
+					Labels: lbls,
+					Samples: []*prompb.Sample{
+						{Value: 1, Timestamp: int64(now.Add(-24 * time.Hour))},
+						{Value: 2, Timestamp: int64(now)},
+						{Value: 3, Timestamp: int64(now.Add(time.Hour))},
+					},
+				}},
+			})
+			if tc.expectedErr != nil {
+				testutil.NotOk(t, err)
+				testutil.Equals(t, tc.expectedErr.Error(), err.Error())
+			} else {
+				testutil.Ok(t, err)
+			}
+
+			samples := app.Get(lset)
+			testutil.Equals(t, len(tc.expectedOffsets), len(samples))
+			for i := range samples {
+				// The bounds are computed from the time of the write, allow for the time passed since.
+				d := model.Time(samples[i].Timestamp).Sub(now.Add(tc.expectedOffsets[i]))
+				testutil.Assert(t, d >= 0 && d < time.Minute, "sample %d: unexpected timestamp offset %v", i, d)
+			}
+
+			testutil.Equals(t, len(tc.expectedCounts), promtestutil.CollectAndCount(w.outOfBoundsTimestamps))
+			for key, count := range tc.expectedCounts {
+				bound, action, _ := strings.Cut(key, "/")
+				testutil.Equals(t, count, promtestutil.ToFloat64(w.outOfBoundsTimestamps.WithLabelValues(tenancy.DefaultTenant, bound, action)))
+			}
+		})
+	}
+}
+
 func BenchmarkWriterTimeSeriesWithSingleLabel_10(b *testing.B)   { benchmarkWriter(b, 1, 10, false) }
 func BenchmarkWriterTimeSeriesWithSingleLabel_100(b *testing.B)  { benchmarkWriter(b, 1, 100, false) }
 func BenchmarkWriterTimeSeriesWithSingleLabel_1000(b *testing.B) { benchmarkWriter(b, 1, 1000, false) }
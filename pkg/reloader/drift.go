@@ -0,0 +1,141 @@
+// Copyright (c) The Thanos Authors.
+// Licensed under the Apache License 2.0.
+
+package reloader
+
+import (
+	"bytes"
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/go-kit/log"
+	"github.com/go-kit/log/level"
+	"github.com/minio/sha256-simd"
+	"github.com/pkg/errors"
+	promconfig "github.com/prometheus/prometheus/config"
+
+	"github.com/thanos-io/thanos/pkg/runutil"
+)
+
+// configDriftChecker verifies that the configuration loaded by Prometheus
+// matches the configuration the reloader intended to apply.
+//
+// Both configurations are parsed and re-rendered using the Prometheus config
+// package before being hashed so that formatting differences, ordering of keys,
+// default values and masked secrets do not count as drift.
+type configDriftChecker struct {
+	logger    log.Logger
+	client    http.Client
+	statusURL *url.URL
+	interval  time.Duration
+}
+
+// intendedHash returns the hash of the normalized configuration stored in the given file.
+func (c *configDriftChecker) intendedHash(cfgFile string) ([]byte, error) {
+	b, err := os.ReadFile(cfgFile)
+	if err != nil {
+		return nil, errors.Wrap(err, "read config file")
+	}
+	cfg, err := promconfig.Load(string(b), false, c.logger)
+	if err != nil {
+		return nil, errors.Wrap(err, "parse config file")
+	}
+	// Prometheus resolves relative paths against the directory of its config file.
+	cfg.SetDirectory(filepath.Dir(cfgFile))
+	return hashConfig(cfg), nil
+}
+
+// reportedHash returns the hash of the normalized configuration reported by Prometheus.
+func (c *configDriftChecker) reportedHash(ctx context.Context) ([]byte, error) {
+	req, err := http.NewRequestWithContext(ctx, "GET", c.statusURL.String(), nil)
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", req.URL.String(), err)
+	}
+	defer runutil.ExhaustCloseWithLogOnErr(c.logger, resp.Body, "config status resp body")
+
+	if resp.StatusCode/100 != 2 {
+		return nil, fmt.Errorf("%s: invalid status code: %d", req.URL.String(), resp.StatusCode)
+	}
+
+	var configStatus = struct {
+		Status string `json:"status"`
+		Data   struct {
+			YAML string `json:"yaml"`
+		} `json:"data"`
+	}{}
+	if err := json.NewDecoder(resp.Body).Decode(&configStatus); err != nil {
+		return nil, fmt.Errorf("invalid response: %w", err)
+	}
+	if configStatus.Status != "success" {
+		return nil, fmt.Errorf("unexpected status: %s", configStatus.Status)
+	}
+
+	cfg, err := promconfig.Load(configStatus.Data.YAML, false, c.logger)
+	if err != nil {
+		return nil, errors.Wrap(err, "parse reported config")
+	}
+	return hashConfig(cfg), nil
+}
+
+// check polls Prometheus until the reported configuration matches the one stored
+// in cfgFile. It returns false if the configurations still differ when the context is done.
+func (c *configDriftChecker) check(ctx context.Context, cfgFile string) (bool, error) {
+	want, err := c.intendedHash(cfgFile)
+	if err != nil {
+		return false, err
+	}
+
+	t := time.NewTicker(c.interval)
+	defer t.Stop()
+
+	var (
+		got     []byte
+		lastErr error
+	)
+	for {
+		h, err := c.reportedHash(ctx)
+		switch {
+		case err == nil && bytes.Equal(want, h):
+			return true, nil
+		case err == nil:
+			got = h
+		case ctx.Err() == nil:
+			lastErr = err
+			level.Debug(c.logger).Log("msg", "failed to get config status", "err", err)
+		}
+
+		select {
+		case <-ctx.Done():
+			if got == nil {
+				if lastErr == nil {
+					lastErr = ctx.Err()
+				}
+				return false, lastErr
+			}
+			level.Warn(c.logger).Log(
+				"msg", "configuration reported by Prometheus differs from the intended configuration",
+				"cfg", cfgFile,
+				"intended_hash", hex.EncodeToString(want),
+				"reported_hash", hex.EncodeToString(got))
+			return false, nil
+		case <-t.C:
+		}
+	}
+}
+
+func hashConfig(cfg *promconfig.Config) []byte {
+	h := sha256.Sum256([]byte(cfg.String()))
+	return h[:]
+}
@@ -99,6 +99,11 @@ type Reloader struct {
 
 	tr TriggerReloader
 
+	driftChecker *configDriftChecker
+	driftTimeout time.Duration
+	// driftChecks holds a pending drift check, requested by successful reloads and run outside of the apply loop.
+	driftChecks chan struct{}
+
 	lastCfgHash         []byte
 	lastCfgDirsHash     [][]byte
 	lastWatchedDirsHash []byte
@@ -112,6 +117,8 @@ type Reloader struct {
 	configApplyErrors           prometheus.Counter
 	configEnvVarExpansionErrors prometheus.Gauge
 	configApply                 prometheus.Counter
+	configDrift                 prometheus.Gauge
+	configDriftCheckErrors      prometheus.Counter
 	reloaderInfo                *prometheus.GaugeVec
 }
 
@@ -177,6 +184,14 @@ type Options struct {
 	// TolerateEnvVarExpansionErrors suppresses errors when expanding environment variables in the config file, and
 	// leaves the unset variables as is. All found environment variables are still expanded.
 	TolerateEnvVarExpansionErrors bool
+	// ConfigStatusURL is the Prometheus URL returning the loaded configuration
+	// (e.g. `/api/v1/status/config`). If not nil, the reloader compares the hash of
+	// the configuration reported by Prometheus with the hash of the intended
+	// configuration after each successful reload and reports any drift.
+	ConfigStatusURL *url.URL
+	// ConfigDriftTimeout controls how long the reloader waits for Prometheus to
+	// report the intended configuration before considering that it drifted.
+	ConfigDriftTimeout time.Duration
 }
 
 var firstGzipBytes = []byte{0x1f, 0x8b, 0x08}
@@ -241,6 +256,18 @@ func New(logger log.Logger, reg prometheus.Registerer, o *Options) *Reloader {
 				Help: "Number of environment variable expansions that failed during the last operation.",
 			},
 		),
+		configDrift: promauto.With(reg).NewGauge(
+			prometheus.GaugeOpts{
+				Name: "reloader_config_drift",
+				Help: "Whether the configuration reported by Prometheus differed from the intended configuration after the last reload.",
+			},
+		),
+		configDriftCheckErrors: promauto.With(reg).NewCounter(
+			prometheus.CounterOpts{
+				Name: "reloader_config_drift_checks_failed_total",
+				Help: "Total number of configuration drift checks that failed to complete.",
+			},
+		),
 		reloaderInfo: promauto.With(reg).NewGaugeVec(
 			prometheus.GaugeOpts{
 				Name: "reloader_info",
@@ -258,6 +285,21 @@ func New(logger log.Logger, reg prometheus.Registerer, o *Options) *Reloader {
 		r.reloaderInfo.WithLabelValues("http").Set(1)
 	}
 
+	if o.ConfigStatusURL != nil {
+		interval := o.RetryInterval
+		if interval <= 0 {
+			interval = time.Second
+		}
+		r.driftChecker = &configDriftChecker{
+			logger:    r.logger,
+			client:    o.HTTPClient,
+			statusURL: o.ConfigStatusURL,
+			interval:  interval,
+		}
+		r.driftTimeout = o.ConfigDriftTimeout
+		r.driftChecks = make(chan struct{}, 1)
+	}
+
 	return r
 }
 
@@ -322,6 +364,14 @@ func (r *Reloader) Watch(ctx context.Context) error {
 		wg.Done()
 	}()
 
+	if r.driftChecker != nil {
+		wg.Add(1)
+		go func() {
+			r.runConfigDriftChecks(ctx)
+			wg.Done()
+		}()
+	}
+
 	cfgDirsNames := make([]string, 0, len(r.cfgDirs))
 	for _, cfgDir := range r.cfgDirs {
 		cfgDirsNames = append(cfgDirsNames, cfgDir.Dir)
@@ -557,11 +607,69 @@ func (r *Reloader) apply(ctx context.Context) error {
 	}); err != nil {
 		r.forceReload = true
 		level.Error(r.logger).Log("msg", "Failed to trigger reload. Retrying.", "err", err)
+		return nil
 	}
 
+	r.requestConfigDriftCheck()
 	return nil
 }
 
+// requestConfigDriftCheck requests a drift check of the configuration that was just applied, without waiting
+// for it. Requests made while a check is pending are coalesced.
+func (r *Reloader) requestConfigDriftCheck() {
+	if r.driftChecks == nil {
+		return
+	}
+	select {
+	case r.driftChecks <- struct{}{}:
+	default:
+	}
+}
+
+// runConfigDriftChecks runs the requested drift checks until the context is canceled, so that waiting for
+// Prometheus to report the applied configuration does not delay the next reloads.
+func (r *Reloader) runConfigDriftChecks(ctx context.Context) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-r.driftChecks:
+			r.checkConfigDrift(ctx)
+		}
+	}
+}
+
+// checkConfigDrift verifies that Prometheus reports the configuration that was
+// last applied and updates the drift metric accordingly.
+func (r *Reloader) checkConfigDrift(ctx context.Context) {
+	if r.driftChecker == nil || r.cfgFile == "" || r.watchInterval == 0 {
+		return
+	}
+
+	cfgFile := r.cfgFile
+	if r.cfgOutputFile != "" {
+		cfgFile = r.cfgOutputFile
+	}
+
+	if r.driftTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, r.driftTimeout)
+		defer cancel()
+	}
+
+	ok, err := r.driftChecker.check(ctx, cfgFile)
+	if err != nil {
+		r.configDriftCheckErrors.Inc()
+		level.Error(r.logger).Log("msg", "Failed to check configuration drift", "err", err)
+		return
+	}
+	if !ok {
+		r.configDrift.Set(1)
+		return
+	}
+	r.configDrift.Set(0)
+}
+
 func (r *Reloader) triggerReload(ctx context.Context) error {
 	if err := r.tr.TriggerReload(ctx); err != nil {
 		return err
@@ -697,6 +805,11 @@ func ReloadURLFromBase(u *url.URL) *url.URL {
 	return &r
 }
 
+// ConfigStatusURLFromBase returns the standard Prometheus config status URL from its base URL.
+func ConfigStatusURLFromBase(u *url.URL) *url.URL {
+	return u.JoinPath("/api/v1/status/config")
+}
+
 // RuntimeInfoURLFromBase returns the standard Prometheus runtime info URL from its base URL.
 func RuntimeInfoURLFromBase(u *url.URL) *url.URL {
 	return u.JoinPath("/api/v1/status/runtimeinfo")
@@ -1245,3 +1245,85 @@ config:
 	// Check no reload request made
 	testutil.Equals(t, 0, reloads.Load().(int))
 }
+
+func TestReloader_ConfigDrift(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+
+	l, err := net.Listen("tcp", "localhost:0")
+	testutil.Ok(t, err)
+
+	reported := &atomic.Value{}
+	reported.Store("")
+	// statusGate blocks the config status requests while it is full.
+	statusGate := make(chan struct{}, 1)
+	srv := &http.Server{}
+	srv.Handler = http.HandlerFunc(func(resp http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/api/v1/status/config" {
+			statusGate <- struct{}{}
+			<-statusGate
+			resp.Header().Set("Content-Type", "application/json")
+			_, _ = fmt.Fprintf(resp, `{"status":"success","data":{"yaml":%q}}`, reported.Load().(string))
+			return
+		}
+		resp.WriteHeader(http.StatusOK)
+	})
+	go func() { _ = srv.Serve(l) }()
+	defer func() { testutil.Ok(t, srv.Close()) }()
+
+	baseURL, err := url.Parse(fmt.Sprintf("http://%s", l.Addr().String()))
+	testutil.Ok(t, err)
+
+	input := filepath.Join(t.TempDir(), "prometheus.yml")
+	reloader := New(nil, nil, &Options{
+		ReloadURL:          ReloadURLFromBase(baseURL),
+		ConfigStatusURL:    ConfigStatusURLFromBase(baseURL),
+		ConfigDriftTimeout: 2 * time.Second,
+		CfgFile:            input,
+		WatchInterval:      9999 * time.Hour,
+		RetryInterval:      100 * time.Millisecond,
+	})
+
+	testutil.Ok(t, os.WriteFile(input, []byte(`
+global:
+  scrape_interval: 30s
+  external_labels:
+    replica: a
+`), os.ModePerm))
+
+	var wg sync.WaitGroup
+	checkCtx, checkCancel := context.WithCancel(ctx)
+	defer func() { checkCancel(); wg.Wait() }()
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		reloader.runConfigDriftChecks(checkCtx)
+	}()
+	waitForDrift := func(expected float64) {
+		t.Helper()
+		for promtest.ToFloat64(reloader.configDrift) != expected {
+			select {
+			case <-ctx.Done():
+				t.Fatalf("timed out waiting for the config drift to be %v", expected)
+			case <-time.After(10 * time.Millisecond):
+			}
+		}
+	}
+
+	// Prometheus still reports the old configuration.
+	reported.Store("global:\n  scrape_interval: 15s\n")
+	testutil.Ok(t, reloader.apply(ctx))
+	waitForDrift(1)
+
+	// Reloads do not wait for the drift checks.
+	statusGate <- struct{}{}
+	reported.Store("global:\n  external_labels: {replica: \"a\"}\n  scrape_interval: 30s\n  evaluation_interval: 1m\n")
+	reloader.forceReload = true
+	testutil.Ok(t, reloader.apply(ctx))
+	testutil.Equals(t, 1.0, promtest.ToFloat64(reloader.configDrift))
+
+	// Prometheus reports the intended configuration with a different formatting.
+	<-statusGate
+	waitForDrift(0)
+	testutil.Equals(t, 0.0, promtest.ToFloat64(reloader.configDriftCheckErrors))
+}
@@ -22,12 +22,12 @@ import (
 	"github.com/prometheus/prometheus/model/labels"
 
 	"github.com/thanos-io/objstore"
-	"github.com/thanos-io/objstore/client"
 	objstoretracing "github.com/thanos-io/objstore/tracing/opentracing"
 
 	thanosblock "github.com/thanos-io/thanos/pkg/block"
 	"github.com/thanos-io/thanos/pkg/compact"
 	"github.com/thanos-io/thanos/pkg/component"
+	"github.com/thanos-io/thanos/pkg/extobjstore"
 	"github.com/thanos-io/thanos/pkg/extprom"
 	thanosmodel "github.com/thanos-io/thanos/pkg/model"
 	"github.com/thanos-io/thanos/pkg/prober"
@@ -115,7 +115,7 @@ func RunReplicate(
 		return errors.New("No supported bucket was configured to replicate from")
 	}
 
-	bkt, err := client.NewBucket(logger, fromConfContentYaml, component.Replicate.String())
+	bkt, err := extobjstore.NewBucket(logger, reg, fromConfContentYaml, component.Replicate.String())
 	if err != nil {
 		return err
 	}
@@ -136,7 +136,7 @@ func RunReplicate(
 		return errors.New("No supported bucket was configured to replicate to")
 	}
 
-	toBkt, err := client.NewBucket(logger, toConfContentYaml, component.Replicate.String())
+	toBkt, err := extobjstore.NewBucket(logger, reg, toConfContentYaml, component.Replicate.String())
 	if err != nil {
 		return err
 	}
@@ -19,6 +19,7 @@ import (
 	"github.com/prometheus/prometheus/model/labels"
 	"github.com/prometheus/prometheus/model/rulefmt"
 	"github.com/prometheus/prometheus/rules"
+	"golang.org/x/sync/semaphore"
 	"google.golang.org/protobuf/proto"
 	"gopkg.in/yaml.v3"
 
@@ -112,6 +113,27 @@ func ActiveAlertsToProto(s storepb.PartialResponseStrategy, a *rules.AlertingRul
 	return ret
 }
 
+// ruleConcurrencyController limits the number of rules evaluated concurrently. Which rules are eligible
+// for concurrent evaluation is decided by the dependency analysis of the Prometheus rule manager: only
+// rules which neither depend on nor are depended on by other rules of their group are evaluated concurrently.
+type ruleConcurrencyController struct {
+	sema *semaphore.Weighted
+}
+
+func newRuleConcurrencyController(maxConcurrency int64) *ruleConcurrencyController {
+	return &ruleConcurrencyController{sema: semaphore.NewWeighted(maxConcurrency)}
+}
+
+// Allow implements rules.RuleConcurrencyController.
+func (c *ruleConcurrencyController) Allow() bool {
+	return c.sema.TryAcquire(1)
+}
+
+// Done implements rules.RuleConcurrencyController.
+func (c *ruleConcurrencyController) Done() {
+	c.sema.Release(1)
+}
+
 // Manager is a partial response strategy and proto compatible Manager.
 // Manager also implements rulespb.Rules gRPC service.
 type Manager struct {
@@ -127,7 +149,8 @@ type Manager struct {
 }
 
 // NewManager creates new Manager.
-// QueryFunc from baseOpts will be rewritten.
+// QueryFunc from baseOpts will be rewritten. If concurrent evaluation is enabled in baseOpts, the limit of
+// concurrently evaluated rules is shared by the managers of all partial response strategies.
 func NewManager(
 	ctx context.Context,
 	reg prometheus.Registerer,
@@ -144,6 +167,9 @@ func NewManager(
 		ruleFiles:   make(map[string]string),
 		externalURL: externalURL,
 	}
+	if baseOpts.ConcurrentEvalsEnabled && baseOpts.RuleConcurrencyController == nil {
+		baseOpts.RuleConcurrencyController = newRuleConcurrencyController(baseOpts.MaxConcurrentEvals)
+	}
 	for _, strategy := range storepb.PartialResponseStrategy_value {
 		s := storepb.PartialResponseStrategy(strategy)
 
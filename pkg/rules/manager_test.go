@@ -462,3 +462,113 @@ groups:
 	}))
 	testutil.Equals(t, "exceeded limit of 1 with 2 alerts", thanosRuleMgr.protoRuleGroups()[0].Rules[0].GetAlert().LastError)
 }
+
+func TestManagerConcurrentEvaluation(t *testing.T) {
+	for _, tcase := range []struct {
+		name          string
+		rules         string
+		expectedMax   int
+		expectedOrder []string
+	}{
+		{
+			name: "independent rules are evaluated concurrently",
+			rules: `
+  - record: "a"
+    expr: "up{job=\"a\"}"
+  - record: "b"
+    expr: "up{job=\"b\"}"
+  - record: "c"
+    expr: "up{job=\"c\"}"
+`,
+			expectedMax: 3,
+		},
+		{
+			name: "dependent rules are evaluated in order",
+			rules: `
+  - record: "a"
+    expr: "up{job=\"a\"}"
+  - record: "b"
+    expr: "a * 2"
+  - record: "c"
+    expr: "b * 2"
+`,
+			expectedMax:   1,
+			expectedOrder: []string{`up{job="a"}`, `up{job="a"}`, `a * 2`, `a * 2`, `b * 2`, `b * 2`},
+		},
+	} {
+		t.Run(tcase.name, func(t *testing.T) {
+			dir := t.TempDir()
+			filename := filepath.Join(dir, "rules.yaml")
+			testutil.Ok(t, os.WriteFile(filename, []byte(`
+groups:
+- name: "group"
+  interval: 1s
+  rules:`+tcase.rules), os.ModePerm))
+
+			var (
+				mtx                   sync.Mutex
+				inflight, maxInflight int
+				order                 []string
+				done                  = make(chan struct{})
+			)
+			record := func(q string) {
+				order = append(order, q)
+				if len(order) == 6 {
+					close(done)
+				}
+			}
+			thanosRuleMgr := NewManager(
+				context.Background(),
+				nil,
+				dir,
+				rules.ManagerOptions{
+					Logger:                 log.NewNopLogger(),
+					Appendable:             nopAppendable{},
+					Queryable:              nopQueryable{},
+					ConcurrentEvalsEnabled: true,
+					MaxConcurrentEvals:     2,
+				},
+				func(partialResponseStrategy storepb.PartialResponseStrategy) rules.QueryFunc {
+					return func(ctx context.Context, q string, _ time.Time) (promql.Vector, error) {
+						mtx.Lock()
+						if len(order) >= 6 {
+							// Only the first evaluation is checked.
+							mtx.Unlock()
+							return nil, nil
+						}
+						inflight++
+						maxInflight = max(maxInflight, inflight)
+						record(q)
+						mtx.Unlock()
+
+						time.Sleep(100 * time.Millisecond)
+
+						mtx.Lock()
+						inflight--
+						record(q)
+						mtx.Unlock()
+						return nil, nil
+					}
+				},
+				labels.EmptyLabels(),
+				"http://localhost",
+			)
+			testutil.Ok(t, thanosRuleMgr.Update(time.Second, []string{filename}))
+			thanosRuleMgr.Run()
+			t.Cleanup(thanosRuleMgr.Stop)
+
+			select {
+			case <-time.After(10 * time.Second):
+				t.Fatal("timeout while waiting on rule evaluation")
+			case <-done:
+			}
+
+			mtx.Lock()
+			defer mtx.Unlock()
+			testutil.Equals(t, tcase.expectedMax, maxInflight)
+			if tcase.expectedOrder != nil {
+				testutil.Equals(t, tcase.expectedOrder, order)
+			}
+		})
+	}
+}
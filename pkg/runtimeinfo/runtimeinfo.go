@@ -0,0 +1,86 @@
+// Copyright (c) The Thanos Authors.
+// Licensed under the Apache License 2.0.
+
+// Package runtimeinfo exposes the build information and Go runtime settings of a Thanos process.
+package runtimeinfo
+
+import (
+	"encoding/json"
+	"net/http"
+	"os"
+	"runtime"
+	"runtime/debug"
+
+	"github.com/prometheus/common/version"
+)
+
+// Info holds the build information and the effective Go runtime settings of a Thanos process.
+type Info struct {
+	Component string `json:"component"`
+
+	Version   string `json:"version"`
+	Revision  string `json:"revision"`
+	Branch    string `json:"branch"`
+	BuildUser string `json:"buildUser"`
+	BuildDate string `json:"buildDate"`
+
+	GoVersion  string `json:"goVersion"`
+	GOOS       string `json:"GOOS"`
+	GOARCH     string `json:"GOARCH"`
+	NumCPU     int    `json:"numCPU"`
+	GOMAXPROCS int    `json:"GOMAXPROCS"`
+	GOGC       string `json:"GOGC"`
+	// GOMEMLIMIT is the effective soft memory limit in bytes, math.MaxInt64 if unlimited.
+	GOMEMLIMIT int64 `json:"GOMEMLIMIT"`
+}
+
+// New returns the current Info of the given component.
+func New(component string) Info {
+	gogc := os.Getenv("GOGC")
+	if gogc == "" {
+		gogc = "100"
+	}
+	return Info{
+		Component:  component,
+		Version:    version.Version,
+		Revision:   version.Revision,
+		Branch:     version.Branch,
+		BuildUser:  version.BuildUser,
+		BuildDate:  version.BuildDate,
+		GoVersion:  runtime.Version(),
+		GOOS:       runtime.GOOS,
+		GOARCH:     runtime.GOARCH,
+		NumCPU:     runtime.NumCPU(),
+		GOMAXPROCS: runtime.GOMAXPROCS(0),
+		GOGC:       gogc,
+		// A negative input does not change the limit, only returns it.
+		GOMEMLIMIT: debug.SetMemoryLimit(-1),
+	}
+}
+
+// Keyvals returns the Info as key-value pairs suitable for structured logging.
+func (i Info) Keyvals() []interface{} {
+	return []interface{}{
+		"component", i.Component,
+		"version", i.Version,
+		"revision", i.Revision,
+		"branch", i.Branch,
+		"build_user", i.BuildUser,
+		"build_date", i.BuildDate,
+		"go_version", i.GoVersion,
+		"goos", i.GOOS,
+		"goarch", i.GOARCH,
+		"num_cpu", i.NumCPU,
+		"gomaxprocs", i.GOMAXPROCS,
+		"gogc", i.GOGC,
+		"gomemlimit", i.GOMEMLIMIT,
+	}
+}
+
+// Handler returns an HTTP handler serving the current Info of the given component as JSON.
+func Handler(component string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(New(component))
+	})
+}
@@ -0,0 +1,36 @@
+// Copyright (c) The Thanos Authors.
+// Licensed under the Apache License 2.0.
+
+package runtimeinfo
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"runtime"
+	"testing"
+
+	"github.com/efficientgo/core/testutil"
+)
+
+func TestHandler(t *testing.T) {
+	rec := httptest.NewRecorder()
+	Handler("store").ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/debug/info", nil))
+
+	testutil.Equals(t, http.StatusOK, rec.Code)
+	testutil.Equals(t, "application/json", rec.Header().Get("Content-Type"))
+
+	var got Info
+	testutil.Ok(t, json.Unmarshal(rec.Body.Bytes(), &got))
+	testutil.Equals(t, "store", got.Component)
+	testutil.Equals(t, runtime.Version(), got.GoVersion)
+	testutil.Equals(t, runtime.GOMAXPROCS(0), got.GOMAXPROCS)
+	testutil.Assert(t, got.GOMEMLIMIT > 0, "expected memory limit to be set")
+}
+
+func TestKeyvals(t *testing.T) {
+	kvs := New("query").Keyvals()
+	testutil.Equals(t, 0, len(kvs)%2)
+	testutil.Equals(t, "component", kvs[0])
+	testutil.Equals(t, "query", kvs[1])
+}
@@ -20,6 +20,7 @@ import (
 
 	"github.com/thanos-io/thanos/pkg/component"
 	"github.com/thanos-io/thanos/pkg/prober"
+	"github.com/thanos-io/thanos/pkg/runtimeinfo"
 )
 
 // A Server defines parameters for serve HTTP requests, a wrapper around http.Server.
@@ -49,6 +50,7 @@ func New(logger log.Logger, reg *prometheus.Registry, comp component.Component,
 	registerMetrics(mux, reg)
 	registerProbes(mux, prober, logger)
 	registerProfiler(mux)
+	mux.Handle("/debug/info", runtimeinfo.Handler(comp.String()))
 
 	var h http.Handler
 	if options.enableH2C {
@@ -0,0 +1,166 @@
+// Copyright (c) The Thanos Authors.
+// Licensed under the Apache License 2.0.
+
+package middleware
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/andybalholm/brotli"
+	"github.com/klauspost/compress/gzhttp"
+	"github.com/pkg/errors"
+)
+
+// DefaultBrotliLevel is the default Brotli compression level of responses. Higher levels compress better but use
+// much more CPU, which rarely pays off for responses compressed on the fly.
+const DefaultBrotliLevel = 4
+
+// NewCompressionHandler returns a wrapper compressing responses with Brotli at the given level, from 0 to 11, for
+// requests preferring it in their Accept-Encoding header, and with gzip otherwise, as gzhttp.GzipHandler does.
+// Responses with a Content-Encoding or an already compressed Content-Type, e.g. image/jpeg, are not compressed.
+func NewCompressionHandler(brotliLevel int) (func(http.Handler) http.HandlerFunc, error) {
+	if brotliLevel < brotli.BestSpeed || brotliLevel > brotli.BestCompression {
+		return nil, errors.Errorf("invalid Brotli compression level %d, must be between %d and %d", brotliLevel, brotli.BestSpeed, brotli.BestCompression)
+	}
+	return func(h http.Handler) http.HandlerFunc {
+		gzipHandler := gzhttp.GzipHandler(h)
+		return func(w http.ResponseWriter, r *http.Request) {
+			if !prefersBrotli(r.Header.Get("Accept-Encoding")) {
+				gzipHandler(w, r)
+				return
+			}
+			w.Header().Add("Vary", "Accept-Encoding")
+
+			bw := &brotliResponseWriter{ResponseWriter: w, level: brotliLevel}
+			defer func() { _ = bw.Close() }()
+			h.ServeHTTP(bw, r)
+		}
+	}, nil
+}
+
+// prefersBrotli returns whether the given Accept-Encoding header value accepts br with a quality at least as high
+// as gzip's.
+func prefersBrotli(acceptEncoding string) bool {
+	br, gzip, wildcard := -1.0, -1.0, -1.0
+	for _, c := range strings.Split(acceptEncoding, ",") {
+		coding, q := parseCoding(c)
+		switch coding {
+		case "br":
+			br = q
+		case "gzip":
+			gzip = q
+		case "*":
+			wildcard = q
+		}
+	}
+	if br < 0 {
+		br = wildcard
+	}
+	if gzip < 0 {
+		gzip = wildcard
+	}
+	return br > 0 && br >= gzip
+}
+
+// parseCoding parses a content coding of an Accept-Encoding header, e.g. "br;q=0.8", into its name and quality.
+func parseCoding(s string) (string, float64) {
+	coding, params, _ := strings.Cut(s, ";")
+	q := 1.0
+	for _, p := range strings.Split(params, ";") {
+		k, v, ok := strings.Cut(strings.TrimSpace(p), "=")
+		if !ok || strings.ToLower(k) != "q" {
+			continue
+		}
+		var err error
+		if q, err = strconv.ParseFloat(v, 64); err != nil {
+			q = 0
+		}
+	}
+	return strings.ToLower(strings.TrimSpace(coding)), q
+}
+
+// brotliResponseWriter compresses the response with Brotli. Whether to compress is decided when the body starts
+// being written, so that headers set by the handler, e.g. Content-Type or Content-Encoding, are taken into account
+// and empty responses are left untouched.
+type brotliResponseWriter struct {
+	http.ResponseWriter
+	level int
+
+	code    int
+	started bool
+	bw      *brotli.Writer
+}
+
+func (w *brotliResponseWriter) WriteHeader(code int) {
+	if w.started || w.code != 0 || code < http.StatusOK {
+		return
+	}
+	w.code = code
+}
+
+func (w *brotliResponseWriter) Write(b []byte) (int, error) {
+	if !w.started {
+		if len(b) == 0 {
+			return 0, nil
+		}
+		// Sniff the content type on the uncompressed body, as the standard library would.
+		if w.Header().Get("Content-Type") == "" {
+			w.Header().Set("Content-Type", http.DetectContentType(b))
+		}
+		w.start()
+	}
+	if w.bw != nil {
+		return w.bw.Write(b)
+	}
+	return w.ResponseWriter.Write(b)
+}
+
+func (w *brotliResponseWriter) start() {
+	w.started = true
+	if w.code == 0 {
+		w.code = http.StatusOK
+	}
+	h := w.Header()
+	if w.code != http.StatusNoContent && w.code != http.StatusNotModified &&
+		h.Get("Content-Encoding") == "" && gzhttp.DefaultContentTypeFilter(h.Get("Content-Type")) {
+		h.Set("Content-Encoding", "br")
+		h.Del("Content-Length")
+		h.Del("Accept-Ranges")
+		w.bw = brotli.NewWriterLevel(w.ResponseWriter, w.level)
+	}
+	w.ResponseWriter.WriteHeader(w.code)
+}
+
+// Flush sends the data compressed so far to the client.
+func (w *brotliResponseWriter) Flush() {
+	if !w.started {
+		w.start()
+	}
+	if w.bw != nil {
+		_ = w.bw.Flush()
+	}
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// Close writes the end of the compressed stream, or the status code of responses without body.
+func (w *brotliResponseWriter) Close() error {
+	if !w.started {
+		if w.code != 0 {
+			w.ResponseWriter.WriteHeader(w.code)
+		}
+		return nil
+	}
+	if w.bw != nil {
+		return w.bw.Close()
+	}
+	return nil
+}
+
+// Unwrap returns the wrapped writer, for http.ResponseController.
+func (w *brotliResponseWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
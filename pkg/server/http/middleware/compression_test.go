@@ -0,0 +1,119 @@
+// Copyright (c) The Thanos Authors.
+// Licensed under the Apache License 2.0.
+
+package middleware
+
+import (
+	"compress/gzip"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/andybalholm/brotli"
+	"github.com/efficientgo/core/testutil"
+)
+
+func TestPrefersBrotli(t *testing.T) {
+	for acceptEncoding, expected := range map[string]bool{
+		"":                         false,
+		"gzip":                     false,
+		"gzip, deflate, br":        true,
+		"br;q=0.5, gzip":           false,
+		"BR;Q=1.0, gzip;q=0.9":     true,
+		"br;q=0":                   false,
+		"*":                        true,
+		"gzip;q=0.8, *;q=0.9":      true,
+		"gzip, *;q=0.5":            false,
+		"identity, br;q=invalid":   false,
+		"deflate, br ; q=0.2":      true,
+		"br;level=3":               true,
+		"gzip;q=1, br;q=1, *;q=0":  true,
+		"compress, gzip;q=0.1, br": true,
+	} {
+		testutil.Equals(t, expected, prefersBrotli(acceptEncoding), acceptEncoding)
+	}
+}
+
+func TestCompressionHandler(t *testing.T) {
+	body := strings.Repeat(`{"status":"success","data":{"resultType":"matrix","result":[]}}`, 100)
+
+	_, err := NewCompressionHandler(12)
+	testutil.NotOk(t, err)
+
+	compress, err := NewCompressionHandler(DefaultBrotliLevel)
+	testutil.Ok(t, err)
+
+	serve := func(acceptEncoding string, h http.HandlerFunc) *http.Response {
+		req := httptest.NewRequest(http.MethodGet, "/api/v1/query", nil)
+		req.Header.Set("Accept-Encoding", acceptEncoding)
+		rec := httptest.NewRecorder()
+		compress(h).ServeHTTP(rec, req)
+		return rec.Result()
+	}
+	jsonHandler := func(w http.ResponseWriter, _ *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Content-Length", "6400")
+		w.WriteHeader(http.StatusUnprocessableEntity)
+		_, _ = io.WriteString(w, body[:len(body)/2])
+		w.(http.Flusher).Flush()
+		_, _ = io.WriteString(w, body[len(body)/2:])
+	}
+
+	t.Run("brotli", func(t *testing.T) {
+		resp := serve("gzip, deflate, br", jsonHandler)
+		testutil.Equals(t, http.StatusUnprocessableEntity, resp.StatusCode)
+		testutil.Equals(t, "br", resp.Header.Get("Content-Encoding"))
+		testutil.Equals(t, "Accept-Encoding", resp.Header.Get("Vary"))
+		testutil.Equals(t, "", resp.Header.Get("Content-Length"))
+
+		b, err := io.ReadAll(brotli.NewReader(resp.Body))
+		testutil.Ok(t, err)
+		testutil.Equals(t, body, string(b))
+	})
+	t.Run("gzip fallback", func(t *testing.T) {
+		resp := serve("gzip, br;q=0.5", jsonHandler)
+		testutil.Equals(t, "gzip", resp.Header.Get("Content-Encoding"))
+
+		r, err := gzip.NewReader(resp.Body)
+		testutil.Ok(t, err)
+		b, err := io.ReadAll(r)
+		testutil.Ok(t, err)
+		testutil.Equals(t, body, string(b))
+	})
+	t.Run("identity", func(t *testing.T) {
+		resp := serve("", jsonHandler)
+		testutil.Equals(t, "", resp.Header.Get("Content-Encoding"))
+
+		b, err := io.ReadAll(resp.Body)
+		testutil.Ok(t, err)
+		testutil.Equals(t, body, string(b))
+	})
+	t.Run("already compressed", func(t *testing.T) {
+		for _, h := range []http.HandlerFunc{
+			func(w http.ResponseWriter, _ *http.Request) {
+				w.Header().Set("Content-Type", "application/zstd")
+				_, _ = io.WriteString(w, body)
+			},
+			func(w http.ResponseWriter, _ *http.Request) {
+				w.Header().Set("Content-Encoding", "snappy")
+				_, _ = io.WriteString(w, body)
+			},
+			func(w http.ResponseWriter, _ *http.Request) {
+				// Sniffed as image/jpeg.
+				_, _ = io.WriteString(w, "\xFF\xD8\xFF"+body)
+			},
+		} {
+			resp := serve("br", h)
+			testutil.Assert(t, resp.Header.Get("Content-Encoding") != "br")
+		}
+	})
+	t.Run("no body", func(t *testing.T) {
+		resp := serve("br", func(w http.ResponseWriter, _ *http.Request) {
+			w.WriteHeader(http.StatusNoContent)
+		})
+		testutil.Equals(t, http.StatusNoContent, resp.StatusCode)
+		testutil.Equals(t, "", resp.Header.Get("Content-Encoding"))
+	})
+}
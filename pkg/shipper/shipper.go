@@ -28,6 +28,7 @@ import (
 	"github.com/thanos-io/objstore"
 
 	"github.com/thanos-io/thanos/pkg/block"
+	"github.com/thanos-io/thanos/pkg/block/lifecycle"
 	"github.com/thanos-io/thanos/pkg/block/metadata"
 	"github.com/thanos-io/thanos/pkg/runutil"
 )
@@ -79,6 +80,7 @@ type Shipper struct {
 	uploadCompactedFunc    func() bool
 	allowOutOfOrderUploads bool
 	hashFunc               metadata.HashFunc
+	blockEvents            lifecycle.Notifier
 
 	labels func() labels.Labels
 	mtx    sync.RWMutex
@@ -125,6 +127,7 @@ func New(
 		allowOutOfOrderUploads: allowOutOfOrderUploads,
 		uploadCompactedFunc:    uploadCompactedFunc,
 		hashFunc:               hashFunc,
+		blockEvents:            lifecycle.NopNotifier{},
 		metadataFilePath:       filepath.Join(dir, filepath.Clean(metaFileName)),
 	}
 }
@@ -136,6 +139,14 @@ func (s *Shipper) SetLabels(lbls labels.Labels) {
 	s.labels = func() labels.Labels { return lbls }
 }
 
+// SetBlockEvents sets the notifier of the blocks uploaded by the shipper.
+func (s *Shipper) SetBlockEvents(n lifecycle.Notifier) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	s.blockEvents = n
+}
+
 // Timestamps returns the minimum timestamp for which data is available and the highest timestamp
 // of blocks that were successfully uploaded.
 func (s *Shipper) Timestamps() (minTime, maxSyncTime int64, err error) {
@@ -318,7 +329,7 @@ func (s *Shipper) Sync(ctx context.Context) (uploaded int, err error) {
 			}
 		}
 
-		if err := s.upload(ctx, m); err != nil {
+		if err := s.upload(ctx, filepath.Join(s.dir, m.ULID.String()), m); err != nil {
 			if !s.allowOutOfOrderUploads {
 				return 0, errors.Wrapf(err, "upload %v", m.ULID)
 			}
@@ -332,6 +343,7 @@ func (s *Shipper) Sync(ctx context.Context) (uploaded int, err error) {
 		meta.Uploaded = append(meta.Uploaded, m.ULID)
 		uploaded++
 		s.metrics.uploads.Inc()
+		s.blockEvents.Notify(lifecycle.NewEvent(lifecycle.EventCreated, m.ULID, m))
 	}
 	if err := WriteMetaFile(s.logger, s.metadataFilePath, meta); err != nil {
 		level.Warn(s.logger).Log("msg", "updating meta file failed", "err", err)
@@ -351,6 +363,40 @@ func (s *Shipper) Sync(ctx context.Context) (uploaded int, err error) {
 	return uploaded, nil
 }
 
+// AddBlock uploads the block in dir, which is outside of the shipper directory, and then moves it into the
+// shipper directory, recording it as uploaded. Unlike blocks shipped by Sync, it is in the bucket before it
+// can be deleted locally, e.g. by the retention of the TSDB, and it is uploaded regardless of its compaction
+// level.
+func (s *Shipper) AddBlock(ctx context.Context, dir string) error {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	m, err := metadata.ReadFromDir(dir)
+	if err != nil {
+		return errors.Wrap(err, "read metadata")
+	}
+	if err := s.upload(ctx, dir, m); err != nil {
+		s.metrics.uploadFailures.Inc()
+		return errors.Wrapf(err, "upload %v", m.ULID)
+	}
+	s.metrics.uploads.Inc()
+	s.blockEvents.Notify(lifecycle.NewEvent(lifecycle.EventCreated, m.ULID, m))
+
+	if err := fileutil.Rename(dir, filepath.Join(s.dir, m.ULID.String())); err != nil {
+		return errors.Wrap(err, "move block")
+	}
+
+	meta, err := ReadMetaFile(s.metadataFilePath)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			level.Warn(s.logger).Log("msg", "reading meta file failed, will override it", "err", err)
+		}
+		meta = &Meta{Version: MetaVersion1}
+	}
+	meta.Uploaded = append(meta.Uploaded, m.ULID)
+	return errors.Wrap(WriteMetaFile(s.logger, s.metadataFilePath, meta), "write meta file")
+}
+
 func (s *Shipper) UploadedBlocks() map[ulid.ULID]struct{} {
 	meta, err := ReadMetaFile(s.metadataFilePath)
 	if err != nil {
@@ -368,7 +414,7 @@ func (s *Shipper) UploadedBlocks() map[ulid.ULID]struct{} {
 
 // sync uploads the block if not exists in remote storage.
 // TODO(khyatisoneji): Double check if block does not have deletion-mark.json for some reason, otherwise log it or return error.
-func (s *Shipper) upload(ctx context.Context, meta *metadata.Meta) error {
+func (s *Shipper) upload(ctx context.Context, dir string, meta *metadata.Meta) error {
 	level.Info(s.logger).Log("msg", "upload new block", "id", meta.ULID)
 
 	// We hard-link the files into a temporary upload directory so we are not affected
@@ -388,7 +434,6 @@ func (s *Shipper) upload(ctx context.Context, meta *metadata.Meta) error {
 		}
 	}()
 
-	dir := filepath.Join(s.dir, meta.ULID.String())
 	if err := hardlinkBlock(dir, updir); err != nil {
 		return errors.Wrap(err, "hard link block")
 	}
@@ -23,6 +23,7 @@ import (
 
 	"github.com/efficientgo/core/testutil"
 	"github.com/thanos-io/thanos/pkg/block"
+	"github.com/thanos-io/thanos/pkg/block/lifecycle"
 	"github.com/thanos-io/thanos/pkg/block/metadata"
 )
 
@@ -198,6 +199,96 @@ func TestShipperAddsSegmentFiles(t *testing.T) {
 	testutil.Equals(t, []string{segmentFile}, meta.Thanos.SegmentFiles)
 }
 
+func TestShipperAddBlock(t *testing.T) {
+	dir, uploadDir := t.TempDir(), t.TempDir()
+
+	inmemory := objstore.NewInMemBucket()
+	lbls := labels.FromStrings("test", "test")
+	s := New(nil, nil, dir, inmemory, func() labels.Labels { return lbls }, metadata.TestSource, nil, false, metadata.NoneFunc, DefaultMetaFilename)
+
+	// Compacted blocks are added too, although Sync does not upload them.
+	id := ulid.MustNew(1, nil)
+	blockDir := path.Join(uploadDir, id.String())
+	testutil.Ok(t, os.MkdirAll(path.Join(blockDir, block.ChunksDirname), os.ModePerm))
+	testutil.Ok(t, metadata.Meta{
+		BlockMeta: tsdb.BlockMeta{
+			ULID:       id,
+			MaxTime:    2000,
+			MinTime:    1000,
+			Version:    1,
+			Compaction: tsdb.BlockMetaCompaction{Level: 2},
+			Stats: tsdb.BlockStats{
+				NumSamples: 1000,
+			},
+		},
+	}.WriteToDir(log.NewNopLogger(), blockDir))
+	testutil.Ok(t, os.WriteFile(filepath.Join(blockDir, "index"), []byte("index file"), 0666))
+
+	testutil.Ok(t, s.AddBlock(context.Background(), blockDir))
+
+	meta, err := block.DownloadMeta(context.Background(), log.NewNopLogger(), inmemory, id)
+	testutil.Ok(t, err)
+	testutil.Equals(t, map[string]string{"test": "test"}, meta.Thanos.Labels)
+	_, err = os.Stat(blockDir)
+	testutil.Assert(t, os.IsNotExist(err), "expected block to be moved, got %v", err)
+	_, err = os.Stat(path.Join(dir, id.String(), block.MetaFilename))
+	testutil.Ok(t, err)
+	testutil.Equals(t, map[ulid.ULID]struct{}{id: {}}, s.UploadedBlocks())
+
+	// The block stays recorded as uploaded.
+	uploaded, err := s.Sync(context.Background())
+	testutil.Ok(t, err)
+	testutil.Equals(t, 0, uploaded)
+	testutil.Equals(t, map[ulid.ULID]struct{}{id: {}}, s.UploadedBlocks())
+}
+
+type recordingNotifier struct {
+	events []lifecycle.Event
+}
+
+func (n *recordingNotifier) Notify(e lifecycle.Event) { n.events = append(n.events, e) }
+
+func (n *recordingNotifier) Close() error { return nil }
+
+func TestShipperNotifiesBlockEvents(t *testing.T) {
+	dir := t.TempDir()
+
+	lbls := labels.FromStrings("cluster", "eu")
+	s := New(nil, nil, dir, objstore.NewInMemBucket(), func() labels.Labels { return lbls }, metadata.TestSource, nil, false, metadata.NoneFunc, DefaultMetaFilename)
+	blockEvents := &recordingNotifier{}
+	s.SetBlockEvents(blockEvents)
+
+	id := ulid.MustNew(1, nil)
+	testutil.Ok(t, os.MkdirAll(path.Join(dir, id.String(), block.ChunksDirname), os.ModePerm))
+	testutil.Ok(t, metadata.Meta{
+		BlockMeta: tsdb.BlockMeta{
+			ULID:    id,
+			MaxTime: 2000,
+			MinTime: 1000,
+			Version: 1,
+			Stats: tsdb.BlockStats{
+				NumSamples: 1000, // Not really, but shipper needs nonzero value.
+			},
+		},
+	}.WriteToDir(log.NewNopLogger(), path.Join(dir, id.String())))
+	testutil.Ok(t, os.WriteFile(filepath.Join(dir, id.String(), "index"), []byte("index file"), 0666))
+
+	uploaded, err := s.Sync(context.Background())
+	testutil.Ok(t, err)
+	testutil.Equals(t, 1, uploaded)
+
+	// Blocks already uploaded are not notified again.
+	uploaded, err = s.Sync(context.Background())
+	testutil.Ok(t, err)
+	testutil.Equals(t, 0, uploaded)
+
+	testutil.Equals(t, 1, len(blockEvents.events))
+	testutil.Equals(t, lifecycle.EventCreated, blockEvents.events[0].Type)
+	testutil.Equals(t, id, blockEvents.events[0].Block)
+	testutil.Equals(t, map[string]string{"cluster": "eu"}, blockEvents.events[0].Meta.Thanos.Labels)
+	testutil.Equals(t, metadata.TestSource, blockEvents.events[0].Meta.Thanos.Source)
+}
+
 func TestReadMetaFile(t *testing.T) {
 	t.Run("Missing meta file", func(t *testing.T) {
 		// Create TSDB directory without meta file
@@ -14,6 +14,7 @@ import (
 	"math"
 	"os"
 	"path"
+	"regexp/syntax"
 	"sort"
 	"strings"
 	"sync"
@@ -33,7 +34,9 @@ import (
 	"github.com/prometheus/prometheus/tsdb/chunks"
 	"github.com/prometheus/prometheus/tsdb/encoding"
 	"github.com/prometheus/prometheus/tsdb/index"
+	promgate "github.com/prometheus/prometheus/util/gate"
 	"github.com/weaveworks/common/httpgrpc"
+	"go.uber.org/atomic"
 	"golang.org/x/exp/slices"
 	"golang.org/x/sync/errgroup"
 	"google.golang.org/grpc"
@@ -87,8 +90,8 @@ const (
 	EstimatedMaxChunkSize  = 16000
 	EstimatedMaxSeriesSize = 64 * 1024
 	// Relatively large in order to reduce memory waste, yet small enough to avoid excessive allocations.
-	chunkBytesPoolMinSize = 64 * 1024        // 64 KiB
-	chunkBytesPoolMaxSize = 64 * 1024 * 1024 // 64 MiB
+	DefaultChunkBytesPoolMinSize = 64 * 1024        // 64 KiB
+	DefaultChunkBytesPoolMaxSize = 64 * 1024 * 1024 // 64 MiB
 
 	// CompatibilityTypeLabelName is an artificial label that Store Gateway can optionally advertise. This is required for compatibility
 	// with pre v0.8.0 Querier. Previous Queriers was strict about duplicated external labels of all StoreAPIs that had any labels.
@@ -109,6 +112,9 @@ const (
 
 	PartitionerMaxGapSize = 512 * 1024
 
+	// DefaultCorruptedBlockRetryInterval is the default time to wait before retrying to load a block with a corrupted index-header.
+	DefaultCorruptedBlockRetryInterval = time.Hour
+
 	// Labels for metrics.
 	labelEncode = "encode"
 	labelDecode = "decode"
@@ -131,8 +137,12 @@ var (
 
 type bucketStoreMetrics struct {
 	blocksLoaded          prometheus.Gauge
+	blockLoadQueueLength  prometheus.Gauge
+	inMemoryBlocks        prometheus.Gauge
+	inMemoryBlocksBytes   prometheus.Gauge
 	blockLoads            prometheus.Counter
 	blockLoadFailures     prometheus.Counter
+	blocksSkipped         prometheus.Gauge
 	lastLoadedBlock       prometheus.Gauge
 	blockDrops            prometheus.Counter
 	blockDropFailures     prometheus.Counter
@@ -150,12 +160,19 @@ type bucketStoreMetrics struct {
 	queriesDropped        *prometheus.CounterVec
 	seriesRefetches       *prometheus.CounterVec
 	chunkRefetches        *prometheus.CounterVec
+	chunkReadAheadBytes   *prometheus.CounterVec
+	chunkReadAheadWasted  *prometheus.CounterVec
 	emptyPostingCount     *prometheus.CounterVec
 
 	lazyExpandedPostingsCount                     prometheus.Counter
 	lazyExpandedPostingSizeBytes                  prometheus.Counter
 	lazyExpandedPostingSeriesOverfetchedSizeBytes prometheus.Counter
 
+	postingsWarmupDuration  prometheus.Histogram
+	postingsWarmupTruncated prometheus.Counter
+
+	caseFoldedExtLabelMatches *prometheus.CounterVec
+
 	cachedPostingsCompressions           *prometheus.CounterVec
 	cachedPostingsCompressionErrors      *prometheus.CounterVec
 	cachedPostingsCompressionTimeSeconds *prometheus.CounterVec
@@ -184,6 +201,10 @@ func newBucketStoreMetrics(reg prometheus.Registerer) *bucketStoreMetrics {
 		Name: "thanos_bucket_store_block_load_failures_total",
 		Help: "Total number of failed remote block loading attempts.",
 	})
+	m.blocksSkipped = promauto.With(reg).NewGauge(prometheus.GaugeOpts{
+		Name: "thanos_bucket_store_blocks_skipped",
+		Help: "Number of blocks not loaded because of a corrupted index-header, whose loading is periodically retried.",
+	})
 	m.blockDrops = promauto.With(reg).NewCounter(prometheus.CounterOpts{
 		Name: "thanos_bucket_store_block_drops_total",
 		Help: "Total number of local blocks that were dropped.",
@@ -196,6 +217,31 @@ func newBucketStoreMetrics(reg prometheus.Registerer) *bucketStoreMetrics {
 		Name: "thanos_bucket_store_blocks_loaded",
 		Help: "Number of currently loaded blocks.",
 	})
+	m.blockLoadQueueLength = promauto.With(reg).NewGauge(prometheus.GaugeOpts{
+		Name: "thanos_bucket_store_block_load_queue_length",
+		Help: "Number of discovered blocks waiting to be loaded.",
+	})
+	m.inMemoryBlocks = promauto.With(reg).NewGauge(prometheus.GaugeOpts{
+		Name: "thanos_bucket_store_in_memory_blocks",
+		Help: "Number of recent blocks fully held in memory.",
+	})
+	m.inMemoryBlocksBytes = promauto.With(reg).NewGauge(prometheus.GaugeOpts{
+		Name: "thanos_bucket_store_in_memory_blocks_size_bytes",
+		Help: "Size of index and chunk files of recent blocks fully held in memory.",
+	})
+	m.postingsWarmupDuration = promauto.With(reg).NewHistogram(prometheus.HistogramOpts{
+		Name:    "thanos_bucket_store_postings_warmup_duration_seconds",
+		Help:    "Time taken to fetch the postings of the warm-up selectors of a loaded block into the index cache.",
+		Buckets: []float64{0.01, 0.05, 0.1, 0.5, 1, 5, 15, 60},
+	})
+	m.postingsWarmupTruncated = promauto.With(reg).NewCounter(prometheus.CounterOpts{
+		Name: "thanos_bucket_store_postings_warmup_truncated_total",
+		Help: "Total number of blocks whose postings warm-up was stopped by the size limit.",
+	})
+	m.caseFoldedExtLabelMatches = promauto.With(reg).NewCounterVec(prometheus.CounterOpts{
+		Name: "thanos_bucket_store_case_folded_external_label_matches_total",
+		Help: "Total number of matchers matching the external label of a block only because the case of its value is ignored.",
+	}, []string{"label"})
 	m.lastLoadedBlock = promauto.With(reg).NewGauge(prometheus.GaugeOpts{
 		Name: "thanos_bucket_store_blocks_last_loaded_timestamp_seconds",
 		Help: "Timestamp when last block got loaded.",
@@ -276,6 +322,14 @@ func newBucketStoreMetrics(reg prometheus.Registerer) *bucketStoreMetrics {
 		Name: "thanos_bucket_store_chunk_refetches_total",
 		Help: "Total number of cases where configured estimated chunk bytes was not enough was to fetch chunks from object store, resulting in refetch.",
 	}, []string{tenancy.MetricLabel})
+	m.chunkReadAheadBytes = promauto.With(reg).NewCounterVec(prometheus.CounterOpts{
+		Name: "thanos_bucket_store_chunk_read_ahead_bytes_total",
+		Help: "Total number of bytes read ahead from chunk files after the last chunk requested.",
+	}, []string{tenancy.MetricLabel})
+	m.chunkReadAheadWasted = promauto.With(reg).NewCounterVec(prometheus.CounterOpts{
+		Name: "thanos_bucket_store_chunk_read_ahead_wasted_bytes_total",
+		Help: "Total number of bytes read ahead from chunk files which did not belong to any chunk served from the read-ahead buffer.",
+	}, []string{tenancy.MetricLabel})
 
 	m.cachedPostingsCompressions = promauto.With(reg).NewCounterVec(prometheus.CounterOpts{
 		Name: "thanos_bucket_store_cached_postings_compressions_total",
@@ -386,15 +440,27 @@ type BucketStore struct {
 	chunkPool       pool.Pool[byte]
 	seriesBatchSize int
 
+	// seriesResponseChunkBatchSize is the maximum number of chunks sent in a single Series response
+	// message. Series with more chunks are split into several messages with the same labels.
+	// Zero means all chunks of a series are sent in one message.
+	seriesResponseChunkBatchSize int
+
 	// Sets of blocks that have the same labels. They are indexed by a hash over their label set.
 	mtx       sync.RWMutex
 	blocks    map[ulid.ULID]*bucketBlock
 	blockSets map[uint64]*bucketBlockSet
+	// Blocks with a corrupted index-header, along with the time after which loading them is retried.
+	skippedBlocks map[ulid.ULID]time.Time
+
+	// How long to wait before retrying to load a block with a corrupted index-header.
+	corruptedBlockRetryInterval time.Duration
 
 	// Verbose enabled additional logging.
 	debugLogging bool
 	// Number of goroutines to use when syncing blocks from object storage.
 	blockSyncConcurrency int
+	// Gate limiting the number of blocks loaded concurrently, across all syncs, to blockSyncConcurrency.
+	blockLoadGate gate.Gate
 
 	// Query gate which limits the maximum amount of concurrent queries.
 	queryGate gate.Gate
@@ -429,6 +495,27 @@ type BucketStore struct {
 	blockEstimatedMaxChunkFunc  BlockEstimator
 
 	indexHeaderLazyDownloadStrategy indexheader.LazyDownloadIndexHeaderFunc
+	indexHeaderMmapAdvice           indexheader.MmapAdvice
+	indexHeaderProgressiveLoad      bool
+
+	// Recent blocks held fully in memory. Nil if disabled.
+	inMemoryBlocks        *inMemoryBlocks
+	inMemoryBlocksMaxAge  time.Duration
+	inMemoryBlocksMaxSize int64
+
+	// chunkReadAheadMaxSize bounds the number of bytes read ahead after the last chunk of each fetch. Zero disables read-ahead.
+	chunkReadAheadMaxSize int
+
+	// maxBlocksPerQuery is the maximum number of blocks a single Series request can touch. Zero means no limit.
+	maxBlocksPerQuery int
+
+	// Selectors whose postings are fetched into the index cache when a block is loaded.
+	postingsWarmupSelectors [][]*labels.Matcher
+	postingsWarmupMaxBytes  int64
+
+	// caseInsensitiveExtLabels are the external labels whose values are matched ignoring case by extLabelMatcher.
+	caseInsensitiveExtLabels []string
+	extLabelMatcher          *externalLabelMatcher
 
 	requestLoggerFunc RequestLoggerFunc
 
@@ -537,6 +624,15 @@ func WithSeriesBatchSize(seriesBatchSize int) BucketStoreOption {
 	}
 }
 
+// WithSeriesResponseChunkBatchSize sets the maximum number of chunks sent in a single Series response message.
+// Series with more chunks are split into several consecutive messages with the same labels, which
+// the querier merges back together. Zero, the default, sends all chunks of a series in one message.
+func WithSeriesResponseChunkBatchSize(chunkBatchSize int) BucketStoreOption {
+	return func(s *BucketStore) {
+		s.seriesResponseChunkBatchSize = chunkBatchSize
+	}
+}
+
 func WithBlockEstimatedMaxSeriesFunc(f BlockEstimator) BucketStoreOption {
 	return func(s *BucketStore) {
 		s.blockEstimatedMaxSeriesFunc = f
@@ -573,6 +669,65 @@ func WithIndexHeaderLazyDownloadStrategy(strategy indexheader.LazyDownloadIndexH
 	}
 }
 
+// WithIndexHeaderMmapAdvice specifies the access pattern advised to the kernel for the memory maps of index-headers.
+func WithIndexHeaderMmapAdvice(advice indexheader.MmapAdvice) BucketStoreOption {
+	return func(s *BucketStore) {
+		s.indexHeaderMmapAdvice = advice
+	}
+}
+
+// WithIndexHeaderProgressiveLoad makes blocks queryable before the postings offset tables of their index-headers are
+// fully loaded. Requests wait for the label names they need to be loaded, so they never see partial data.
+func WithIndexHeaderProgressiveLoad(enabled bool) BucketStoreOption {
+	return func(s *BucketStore) {
+		s.indexHeaderProgressiveLoad = enabled
+	}
+}
+
+// WithInMemoryRecentBlocks keeps the index and chunk files of blocks whose max time is
+// within maxAge from now fully in memory, up to maxSize bytes in total. Blocks are
+// evicted from memory once they age out of the window.
+func WithInMemoryRecentBlocks(maxAge time.Duration, maxSize int64) BucketStoreOption {
+	return func(s *BucketStore) {
+		s.inMemoryBlocksMaxAge = maxAge
+		s.inMemoryBlocksMaxSize = maxSize
+	}
+}
+
+// WithChunkReadAhead makes chunk readers read up to maxSize bytes after the last chunk of each fetch from a chunk file,
+// so that chunks of the following series batches can be served from memory. See chunkReadAhead.
+func WithChunkReadAhead(maxSize int) BucketStoreOption {
+	return func(s *BucketStore) {
+		s.chunkReadAheadMaxSize = maxSize
+	}
+}
+
+// WithMaxBlocksPerQuery sets the maximum number of blocks a single Series request can touch.
+// Requests selecting more blocks fail with ResourceExhausted before any block is read. Zero means no limit.
+func WithMaxBlocksPerQuery(limit int) BucketStoreOption {
+	return func(s *BucketStore) {
+		s.maxBlocksPerQuery = limit
+	}
+}
+
+// WithPostingsWarmup fetches the postings of the given selectors into the index cache when a block
+// is loaded, so that the first queries using them do not pay for the postings lookup. At most
+// maxBytes of postings are fetched per block, 0 meaning no limit.
+func WithPostingsWarmup(selectors [][]*labels.Matcher, maxBytes int64) BucketStoreOption {
+	return func(s *BucketStore) {
+		s.postingsWarmupSelectors = selectors
+		s.postingsWarmupMaxBytes = maxBytes
+	}
+}
+
+// WithCorruptedBlockRetryInterval sets how long to wait before retrying to load a block whose
+// index-header was still corrupted after downloading it again.
+func WithCorruptedBlockRetryInterval(interval time.Duration) BucketStoreOption {
+	return func(s *BucketStore) {
+		s.corruptedBlockRetryInterval = interval
+	}
+}
+
 // NewBucketStore creates a new bucket backed store that implements the store API against
 // an object store bucket. It is optimized to work against high latency backends.
 func NewBucketStore(
@@ -604,6 +759,8 @@ func NewBucketStore(
 		chunkPool:                       pool.NoopPool[byte]{},
 		blocks:                          map[ulid.ULID]*bucketBlock{},
 		blockSets:                       map[uint64]*bucketBlockSet{},
+		skippedBlocks:                   map[ulid.ULID]time.Time{},
+		corruptedBlockRetryInterval:     DefaultCorruptedBlockRetryInterval,
 		blockSyncConcurrency:            blockSyncConcurrency,
 		queryGate:                       gate.NewNoop(),
 		chunksLimiterFactory:            chunksLimiterFactory,
@@ -617,6 +774,7 @@ func NewBucketStore(
 		seriesBatchSize:                 SeriesBatchSize,
 		sortingStrategy:                 sortingStrategyStore,
 		indexHeaderLazyDownloadStrategy: indexheader.AlwaysEagerDownloadIndexHeader,
+		indexHeaderMmapAdvice:           indexheader.MmapAdviceNormal,
 		requestLoggerFunc:               NoopRequestLoggerFunc,
 	}
 
@@ -626,12 +784,21 @@ func NewBucketStore(
 
 	// Depend on the options
 	indexReaderPoolMetrics := indexheader.NewReaderPoolMetrics(extprom.WrapRegistererWithPrefix("thanos_bucket_store_", s.reg))
-	s.indexReaderPool = indexheader.NewReaderPool(s.logger, lazyIndexReaderEnabled, lazyIndexReaderIdleTimeout, indexReaderPoolMetrics, s.indexHeaderLazyDownloadStrategy)
+	s.indexReaderPool = indexheader.NewReaderPool(s.logger, lazyIndexReaderEnabled, lazyIndexReaderIdleTimeout, indexReaderPoolMetrics, s.indexHeaderLazyDownloadStrategy,
+		indexheader.WithMmapAdvice(s.indexHeaderMmapAdvice), indexheader.WithProgressiveLoad(s.indexHeaderProgressiveLoad),
+		indexheader.WithCorruptedHandler(s.skipLoadedBlock))
 	s.metrics = newBucketStoreMetrics(s.reg) // TODO(metalmatze): Might be possible via Option too
+	if len(s.caseInsensitiveExtLabels) > 0 {
+		s.extLabelMatcher = newExternalLabelMatcher(s.caseInsensitiveExtLabels, s.metrics.caseFoldedExtLabelMatches)
+	}
 
 	if err := s.validate(); err != nil {
 		return nil, errors.Wrap(err, "validate config")
 	}
+	s.blockLoadGate = promgate.New(s.blockSyncConcurrency)
+	if s.inMemoryBlocksMaxAge > 0 && s.inMemoryBlocksMaxSize > 0 {
+		s.inMemoryBlocks = newInMemoryBlocks(s.logger, s.metrics, s.inMemoryBlocksMaxAge, s.inMemoryBlocksMaxSize)
+	}
 
 	if dir == "" {
 		return s, nil
@@ -666,6 +833,18 @@ func (s *BucketStore) SyncBlocks(ctx context.Context) error {
 		return metaFetchErr
 	}
 
+	var missing []*metadata.Meta
+	for id, meta := range metas {
+		if b := s.getBlock(id); b != nil {
+			continue
+		}
+		if s.isSkipped(id) {
+			continue
+		}
+		missing = append(missing, meta)
+	}
+	s.metrics.blockLoadQueueLength.Add(float64(len(missing)))
+
 	var wg sync.WaitGroup
 	blockc := make(chan *metadata.Meta)
 
@@ -673,7 +852,7 @@ func (s *BucketStore) SyncBlocks(ctx context.Context) error {
 		wg.Add(1)
 		go func() {
 			for meta := range blockc {
-				if err := s.addBlock(ctx, meta); err != nil {
+				if err := s.loadBlock(ctx, meta); err != nil {
 					continue
 				}
 			}
@@ -681,12 +860,10 @@ func (s *BucketStore) SyncBlocks(ctx context.Context) error {
 		}()
 	}
 
-	for id, meta := range metas {
-		if b := s.getBlock(id); b != nil {
-			continue
-		}
+	for _, meta := range missing {
 		select {
 		case <-ctx.Done():
+			s.metrics.blockLoadQueueLength.Dec()
 		case blockc <- meta:
 		}
 	}
@@ -711,6 +888,23 @@ func (s *BucketStore) SyncBlocks(ctx context.Context) error {
 		s.metrics.blockDrops.Inc()
 	}
 
+	s.mtx.Lock()
+	for id := range s.skippedBlocks {
+		if _, ok := metas[id]; !ok {
+			delete(s.skippedBlocks, id)
+		}
+	}
+	s.metrics.blocksSkipped.Set(float64(len(s.skippedBlocks)))
+	s.mtx.Unlock()
+
+	if s.inMemoryBlocks != nil {
+		maxTimes := make(map[ulid.ULID]int64, len(metas))
+		for id, meta := range metas {
+			maxTimes[id] = meta.MaxTime
+		}
+		s.inMemoryBlocks.evictExpired(maxTimes)
+	}
+
 	// Sync advertise labels.
 	s.mtx.Lock()
 	s.advLabelSets = make([]*labelpb.LabelSet, 0, len(s.advLabelSets))
@@ -767,6 +961,49 @@ func (s *BucketStore) getBlock(id ulid.ULID) *bucketBlock {
 	return s.blocks[id]
 }
 
+// isSkipped returns true if the block has a corrupted index-header and loading it should not be retried yet.
+func (s *BucketStore) isSkipped(id ulid.ULID) bool {
+	s.mtx.RLock()
+	defer s.mtx.RUnlock()
+	retryAt, ok := s.skippedBlocks[id]
+	return ok && time.Now().Before(retryAt)
+}
+
+// skipBlock stops loading the block until the retry interval elapses.
+func (s *BucketStore) skipBlock(id ulid.ULID) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	s.skippedBlocks[id] = time.Now().Add(s.corruptedBlockRetryInterval)
+	s.metrics.blocksSkipped.Set(float64(len(s.skippedBlocks)))
+}
+
+// skipLoadedBlock skips a loaded block whose index-header turned out to be corrupted when lazily loading it, like
+// blocks whose index-header is corrupted when adding them.
+func (s *BucketStore) skipLoadedBlock(id ulid.ULID) {
+	level.Warn(s.logger).Log("msg", "skipping block with corrupted index-header", "id", id, "retry_in", s.corruptedBlockRetryInterval)
+	s.skipBlock(id)
+	// The block is removed in the background, since the index-header reader is still being loaded and removing the
+	// block waits for its pending readers.
+	go func() {
+		if err := s.removeBlock(id); err != nil {
+			level.Warn(s.logger).Log("msg", "failed to remove block with corrupted index-header", "id", id, "err", err)
+		}
+	}()
+}
+
+// loadBlock waits until the number of blocks being loaded drops below the block sync
+// concurrency and loads the given block. The block is queryable as soon as it is loaded.
+func (s *BucketStore) loadBlock(ctx context.Context, meta *metadata.Meta) error {
+	err := s.blockLoadGate.Start(ctx)
+	s.metrics.blockLoadQueueLength.Dec()
+	if err != nil {
+		return err
+	}
+	defer s.blockLoadGate.Done()
+
+	return s.addBlock(ctx, meta)
+}
+
 func (s *BucketStore) addBlock(ctx context.Context, meta *metadata.Meta) (err error) {
 	var dir string
 	if s.dir != "" {
@@ -794,16 +1031,12 @@ func (s *BucketStore) addBlock(ctx context.Context, meta *metadata.Meta) (err er
 	lset := labels.FromMap(meta.Thanos.Labels)
 	h := lset.Hash()
 
-	indexHeaderReader, err := s.indexReaderPool.NewBinaryReader(
-		ctx,
-		s.logger,
-		s.bkt,
-		s.dir,
-		meta.ULID,
-		s.postingOffsetsInMemSampling,
-		meta,
-	)
+	indexHeaderReader, err := s.newIndexHeaderReader(ctx, meta)
 	if err != nil {
+		if indexheader.IsCorrupted(err) {
+			level.Warn(s.logger).Log("msg", "skipping block with corrupted index-header", "id", meta.ULID, "retry_in", s.corruptedBlockRetryInterval)
+			s.skipBlock(meta.ULID)
+		}
 		return errors.Wrap(err, "create index header reader")
 	}
 	defer func() {
@@ -828,18 +1061,37 @@ func (s *BucketStore) addBlock(ctx context.Context, meta *metadata.Meta) (err er
 	if err != nil {
 		return errors.Wrap(err, "new bucket block")
 	}
+	b.extLabelMatcher = s.extLabelMatcher
+	b.chunkReadAheadMaxSize = s.chunkReadAheadMaxSize
 	defer func() {
 		if err != nil {
 			runutil.CloseWithErrCapture(&err, b, "index-header")
 		}
 	}()
 
+	if s.inMemoryBlocks != nil {
+		if err := s.inMemoryBlocks.load(ctx, b); err != nil {
+			// The block is still queryable, just not from memory.
+			level.Warn(s.logger).Log("msg", "failed to load recent block into memory", "id", meta.ULID, "err", err)
+		}
+		defer func() {
+			if err != nil {
+				s.inMemoryBlocks.release(meta.ULID)
+			}
+		}()
+	}
+
+	if len(s.postingsWarmupSelectors) > 0 {
+		s.warmPostings(ctx, b)
+	}
+
 	s.mtx.Lock()
 	defer s.mtx.Unlock()
 
 	set, ok := s.blockSets[h]
 	if !ok {
 		set = newBucketBlockSet(lset)
+		set.extLabelMatcher = s.extLabelMatcher
 		s.blockSets[h] = set
 	}
 
@@ -847,12 +1099,33 @@ func (s *BucketStore) addBlock(ctx context.Context, meta *metadata.Meta) (err er
 		return errors.Wrap(err, "add block to set")
 	}
 	s.blocks[b.meta.ULID] = b
+	if _, ok := s.skippedBlocks[b.meta.ULID]; ok {
+		delete(s.skippedBlocks, b.meta.ULID)
+		s.metrics.blocksSkipped.Set(float64(len(s.skippedBlocks)))
+	}
 
 	s.metrics.blocksLoaded.Inc()
 	s.metrics.lastLoadedBlock.SetToCurrentTime()
 	return nil
 }
 
+// newIndexHeaderReader creates the index-header reader of the block. If the index-header is corrupted,
+// it is removed and downloaded once more, in case it was damaged on the local disk or during the download.
+func (s *BucketStore) newIndexHeaderReader(ctx context.Context, meta *metadata.Meta) (indexheader.Reader, error) {
+	r, err := s.indexReaderPool.NewBinaryReader(ctx, s.logger, s.bkt, s.dir, meta.ULID, s.postingOffsetsInMemSampling, meta)
+	if err == nil || !indexheader.IsCorrupted(err) {
+		return r, err
+	}
+
+	level.Warn(s.logger).Log("msg", "index-header is corrupted; downloading it again", "id", meta.ULID, "err", err)
+	if s.dir != "" {
+		if err := os.Remove(path.Join(s.dir, meta.ULID.String(), block.IndexHeaderFilename)); err != nil && !os.IsNotExist(err) {
+			return nil, errors.Wrap(err, "remove corrupted index-header")
+		}
+	}
+	return s.indexReaderPool.NewBinaryReader(ctx, s.logger, s.bkt, s.dir, meta.ULID, s.postingOffsetsInMemSampling, meta)
+}
+
 func (s *BucketStore) removeBlock(id ulid.ULID) error {
 	s.mtx.Lock()
 	b, ok := s.blocks[id]
@@ -868,6 +1141,9 @@ func (s *BucketStore) removeBlock(id ulid.ULID) error {
 	}
 
 	s.metrics.blocksLoaded.Dec()
+	if s.inMemoryBlocks != nil {
+		s.inMemoryBlocks.release(id)
+	}
 	if err := b.Close(); err != nil {
 		return errors.Wrap(err, "close block")
 	}
@@ -1014,6 +1290,7 @@ type blockSeriesClient struct {
 	lazyExpandedPostingSeriesOverfetchedSizeBytes prometheus.Counter
 
 	skipChunks             bool
+	onlyLastSample         bool
 	shardMatcher           *storepb.ShardMatcher
 	blockMatchers          []*labels.Matcher
 	calculateChunkHash     bool
@@ -1082,6 +1359,7 @@ func newBlockSeriesClient(
 		chunksLimiter:          chunksLimiter,
 		bytesLimiter:           bytesLimiter,
 		skipChunks:             req.SkipChunks,
+		onlyLastSample:         req.OnlyLastSample(),
 		seriesFetchDurationSum: seriesFetchDurationSum,
 		chunkFetchDuration:     chunkFetchDuration,
 		chunkFetchDurationSum:  chunkFetchDurationSum,
@@ -1103,6 +1381,10 @@ func newBlockSeriesClient(
 	}
 }
 
+func chunkMetaBounds(m chunks.Meta) (int64, int64) {
+	return m.MinTime, m.MaxTime
+}
+
 func (b *blockSeriesClient) Close() {
 	if !b.skipChunks {
 		runutil.CloseWithLogOnErr(b.logger, b.chunkr, "series block")
@@ -1301,6 +1583,10 @@ OUTER:
 			continue
 		}
 
+		if b.onlyLastSample {
+			b.chkMetas = storepb.LastChunks(b.chkMetas, b.maxt, chunkMetaBounds)
+		}
+
 		// Schedule loading chunks.
 		s.refs = make([]chunks.ChunkRef, 0, len(b.chkMetas))
 		s.chks = make([]*storepb.AggrChunk, 0, len(b.chkMetas))
@@ -1465,6 +1751,19 @@ func debugFoundBlockSetOverview(logger log.Logger, mint, maxt, maxResolutionMill
 	level.Debug(logger).Log("msg", "Blocks source resolutions", "blocks", len(bs), "Maximum Resolution", maxResolutionMillis, "mint", mint, "maxt", maxt, "lset", lset.String(), "spans", strings.Join(parts, "\n"))
 }
 
+// numBlocksFor returns the number of blocks a Series request with the given matchers touches.
+// It must be called with s.mtx held.
+func (s *BucketStore) numBlocksFor(req *storepb.SeriesRequest, matchers, reqBlockMatchers []*labels.Matcher) int {
+	n := 0
+	for _, bs := range s.blockSets {
+		if _, ok := bs.labelMatchers(matchers...); !ok {
+			continue
+		}
+		n += len(bs.getFor(req.MinTime, req.MaxTime, req.MaxResolutionWindow, reqBlockMatchers))
+	}
+	return n
+}
+
 // Series implements the storepb.StoreServer interface.
 func (s *BucketStore) Series(req *storepb.SeriesRequest, seriesSrv storepb.Store_SeriesServer) (err error) {
 	srv := newFlushableServer(seriesSrv, sortingStrategyNone)
@@ -1486,6 +1785,10 @@ func (s *BucketStore) Series(req *storepb.SeriesRequest, seriesSrv storepb.Store
 	if err != nil {
 		return status.Error(codes.InvalidArgument, err.Error())
 	}
+	matchers, err = optimizeLiteralRegexMatchers(matchers)
+	if err != nil {
+		return status.Error(codes.InvalidArgument, err.Error())
+	}
 	req.MinTime = s.limitMinTime(req.MinTime)
 	req.MaxTime = s.limitMaxTime(req.MaxTime)
 
@@ -1503,6 +1806,8 @@ func (s *BucketStore) Series(req *storepb.SeriesRequest, seriesSrv storepb.Store
 		seriesLimiter = s.seriesLimiterFactory(s.metrics.queriesDropped.WithLabelValues("series", tenant))
 
 		queryStatsEnabled = false
+		// Clients sending request hints understand response hints.
+		sendResHints = s.enableSeriesResponseHints || req.Hints != nil
 
 		logger = s.requestLoggerFunc(ctx, s.logger)
 	)
@@ -1520,6 +1825,13 @@ func (s *BucketStore) Series(req *storepb.SeriesRequest, seriesSrv storepb.Store
 		}
 	}
 
+	if req.SkipChunks && seriesTimeRangeRequested(ctx) {
+		return s.seriesTimeRange(srv, req, matchers, reqBlockMatchers, tenant)
+	}
+	if req.SkipChunks && metricNameStatsRequested(ctx) {
+		return s.metricNameStats(srv, req, matchers, reqBlockMatchers, tenant)
+	}
+
 	var extLsetToRemove map[string]struct{}
 	if len(req.WithoutReplicaLabels) > 0 {
 		extLsetToRemove = make(map[string]struct{})
@@ -1529,11 +1841,20 @@ func (s *BucketStore) Series(req *storepb.SeriesRequest, seriesSrv storepb.Store
 	}
 
 	s.mtx.RLock()
+	if s.maxBlocksPerQuery > 0 {
+		if n := s.numBlocksFor(req, matchers, reqBlockMatchers); n > s.maxBlocksPerQuery {
+			s.mtx.RUnlock()
+			s.metrics.queriesDropped.WithLabelValues("blocks", tenant).Inc()
+			return httpgrpc.Errorf(int(codes.ResourceExhausted), "exceeded blocks limit: query would touch %d blocks, the limit is %d. "+
+				"Narrow the time range of the query or increase max_source_resolution to query fewer, downsampled blocks", n, s.maxBlocksPerQuery)
+		}
+	}
 	for _, bs := range s.blockSets {
 		blockMatchers, ok := bs.labelMatchers(matchers...)
 		if !ok {
 			continue
 		}
+		s.extLabelMatcher.countCaseFolded(bs.labels, matchers...)
 		// Sort matchers to make sure we generate the same cache key
 		// when fetching expanded postings.
 		sortedBlockMatchers := newSortedMatchers(blockMatchers)
@@ -1548,7 +1869,7 @@ func (s *BucketStore) Series(req *storepb.SeriesRequest, seriesSrv storepb.Store
 			blk := b
 			gctx := gctx
 
-			if s.enableSeriesResponseHints {
+			if sendResHints {
 				// Keep track of queried blocks.
 				resHints.AddQueriedBlock(blk.meta.ULID)
 			}
@@ -1722,7 +2043,7 @@ func (s *BucketStore) Series(req *storepb.SeriesRequest, seriesSrv storepb.Store
 					s.metrics.chunkSizeBytes.WithLabelValues(tenant).Observe(float64(chunksSize(series.Chunks)))
 				}
 			}
-			if err = srv.Send(at); err != nil {
+			if err = sendSeriesResponse(srv, at, s.seriesResponseChunkBatchSize); err != nil {
 				err = status.Error(codes.Unknown, errors.Wrap(err, "send series response").Error())
 				return
 			}
@@ -1736,7 +2057,7 @@ func (s *BucketStore) Series(req *storepb.SeriesRequest, seriesSrv storepb.Store
 		return err
 	}
 
-	if s.enableSeriesResponseHints {
+	if sendResHints {
 		var anyHints *anypb.Any
 
 		if queryStatsEnabled {
@@ -1759,6 +2080,26 @@ func (s *BucketStore) Series(req *storepb.SeriesRequest, seriesSrv storepb.Store
 	return srv.Flush()
 }
 
+// sendSeriesResponse sends the response to srv. If the response is a series with more than chunkBatchSize
+// chunks, its chunks are sent in batches of at most chunkBatchSize chunks, each in a separate message
+// with the labels of the series.
+func sendSeriesResponse(srv storepb.Store_SeriesServer, resp *storepb.SeriesResponse, chunkBatchSize int) error {
+	series := resp.GetSeries()
+	if series == nil || chunkBatchSize <= 0 || len(series.Chunks) <= chunkBatchSize {
+		return srv.Send(resp)
+	}
+	for i := 0; i < len(series.Chunks); i += chunkBatchSize {
+		end := min(i+chunkBatchSize, len(series.Chunks))
+		if err := srv.Send(storepb.NewSeriesResponse(&storepb.Series{
+			Labels: series.Labels,
+			Chunks: series.Chunks[i:end],
+		})); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
 func chunksSize(chks []*storepb.AggrChunk) (size int) {
 	for _, chk := range chks {
 		size += chk.SizeVT() // This gets the encoded proto size.
@@ -1772,6 +2113,10 @@ func (s *BucketStore) LabelNames(ctx context.Context, req *storepb.LabelNamesReq
 	if err != nil {
 		return nil, status.Error(codes.InvalidArgument, errors.Wrap(err, "translate request labels matchers").Error())
 	}
+	reqSeriesMatchers, err = optimizeLiteralRegexMatchers(reqSeriesMatchers)
+	if err != nil {
+		return nil, status.Error(codes.InvalidArgument, errors.Wrap(err, "optimize request labels matchers").Error())
+	}
 
 	tenant, _ := tenancy.GetTenantFromGRPCMetadata(ctx)
 
@@ -1822,6 +2167,7 @@ func (s *BucketStore) LabelNames(ctx context.Context, req *storepb.LabelNamesReq
 		if !ok {
 			continue
 		}
+		s.extLabelMatcher.countCaseFolded(b.extLset, reqSeriesMatchers...)
 
 		sortedReqSeriesMatchersNoExtLabels := newSortedMatchers(reqSeriesMatchersNoExtLabels)
 
@@ -1964,20 +2310,7 @@ func (s *BucketStore) LabelNames(ctx context.Context, req *storepb.LabelNamesReq
 
 func (b *bucketBlock) FilterExtLabelsMatchers(matchers []*labels.Matcher) ([]*labels.Matcher, bool) {
 	// We filter external labels from matchers so we won't try to match series on them.
-	var result []*labels.Matcher
-	for _, m := range matchers {
-		// Get value of external label from block.
-		v := b.extLset.Get(m.Name)
-		// If value is empty string the matcher is a valid one since it's not part of external labels.
-		if v == "" {
-			result = append(result, m)
-		} else if v != "" && !m.Matches(v) {
-			// If matcher is external label but value is different we don't want to look in block anyway.
-			return []*labels.Matcher{}, false
-		}
-	}
-
-	return result, true
+	return b.extLabelMatcher.filter(b.extLset, matchers...)
 }
 
 // LabelValues implements the storepb.StoreServer interface.
@@ -1986,6 +2319,10 @@ func (s *BucketStore) LabelValues(ctx context.Context, req *storepb.LabelValuesR
 	if err != nil {
 		return nil, status.Error(codes.InvalidArgument, errors.Wrap(err, "translate request labels matchers").Error())
 	}
+	reqSeriesMatchers, err = optimizeLiteralRegexMatchers(reqSeriesMatchers)
+	if err != nil {
+		return nil, status.Error(codes.InvalidArgument, errors.Wrap(err, "optimize request labels matchers").Error())
+	}
 	for i := range req.WithoutReplicaLabels {
 		if req.Label == req.WithoutReplicaLabels[i] {
 			return &storepb.LabelValuesResponse{}, nil
@@ -2034,6 +2371,7 @@ func (s *BucketStore) LabelValues(ctx context.Context, req *storepb.LabelValuesR
 		if !ok {
 			continue
 		}
+		s.extLabelMatcher.countCaseFolded(b.extLset, reqSeriesMatchers...)
 
 		// If we have series matchers and the Label is not an external one, add <labelName> != "" matcher
 		// to only select series that have given label name.
@@ -2186,6 +2524,9 @@ type bucketBlockSet struct {
 	mtx         sync.RWMutex
 	resolutions []int64          // Available resolution, high to low (in milliseconds).
 	blocks      [][]*bucketBlock // Ordered buckets for the existing resolutions.
+
+	// extLabelMatcher matches the labels of the set, nil to match them case-sensitively.
+	extLabelMatcher *externalLabelMatcher
 }
 
 // newBucketBlockSet initializes a new set with the known downsampling windows hard-configured.
@@ -2299,19 +2640,7 @@ func (s *bucketBlockSet) getFor(mint, maxt, maxResolutionMillis int64, blockMatc
 // labelMatchers verifies whether the block set matches the given matchers and returns a new
 // set of matchers that is equivalent when querying data within the block.
 func (s *bucketBlockSet) labelMatchers(matchers ...*labels.Matcher) ([]*labels.Matcher, bool) {
-	res := make([]*labels.Matcher, 0, len(matchers))
-
-	for _, m := range matchers {
-		v := s.labels.Get(m.Name)
-		if v == "" {
-			res = append(res, m)
-			continue
-		}
-		if !m.Matches(v) {
-			return nil, false
-		}
-	}
-	return res, true
+	return s.extLabelMatcher.filter(s.labels, matchers...)
 }
 
 // bucketBlock represents a block that is located in a bucket. It holds intermediate
@@ -2324,6 +2653,8 @@ type bucketBlock struct {
 	indexCache storecache.IndexCache
 	chunkPool  pool.Pool[byte]
 	extLset    labels.Labels
+	// extLabelMatcher matches extLset, nil to match it case-sensitively.
+	extLabelMatcher *externalLabelMatcher
 
 	indexHeaderReader indexheader.Reader
 
@@ -2339,6 +2670,11 @@ type bucketBlock struct {
 
 	estimatedMaxChunkSize  int
 	estimatedMaxSeriesSize int
+
+	chunkReadAheadMaxSize int
+
+	// pinnedChunkBytes is the size of the chunk buffers held by the chunk readers of the block.
+	pinnedChunkBytes atomic.Int64
 }
 
 func newBucketBlock(
@@ -2893,6 +3229,54 @@ func toPostingGroup(ctx context.Context, lvalsFn func(name string) ([]string, er
 	return newPostingGroup(false, m.Name, toAdd, nil), vals, nil
 }
 
+// optimizeLiteralRegexMatchers replaces regex matchers whose pattern matches exactly one literal string,
+// e.g. {__name__=~"http_requests_total"}, with the equivalent equality matchers, which use the faster
+// equality paths when resolving postings and share index cache entries with equality matchers.
+// Patterns with escaped metacharacters are unescaped, e.g. =~"a\\.b" becomes ="a.b".
+func optimizeLiteralRegexMatchers(ms []*labels.Matcher) ([]*labels.Matcher, error) {
+	var res []*labels.Matcher
+	for i, m := range ms {
+		if m.Type != labels.MatchRegexp && m.Type != labels.MatchNotRegexp {
+			continue
+		}
+		val, ok := literalRegexValue(m.Value)
+		if !ok {
+			continue
+		}
+		t := labels.MatchEqual
+		if m.Type == labels.MatchNotRegexp {
+			t = labels.MatchNotEqual
+		}
+		eq, err := labels.NewMatcher(t, m.Name, val)
+		if err != nil {
+			return nil, err
+		}
+		if res == nil {
+			res = make([]*labels.Matcher, len(ms))
+			copy(res, ms)
+		}
+		res[i] = eq
+	}
+	if res == nil {
+		return ms, nil
+	}
+	return res, nil
+}
+
+// literalRegexValue returns the only string matched by the given anchored regex pattern, if any.
+func literalRegexValue(pattern string) (string, bool) {
+	// Same flags as used by labels.NewFastRegexMatcher.
+	re, err := syntax.Parse(pattern, syntax.Perl|syntax.DotNL)
+	if err != nil {
+		return "", false
+	}
+	re = re.Simplify()
+	if re.Op != syntax.OpLiteral || re.Flags&syntax.FoldCase != 0 {
+		return "", false
+	}
+	return string(re.Rune), true
+}
+
 type postingPtr struct {
 	keyID int
 	ptr   index.Range
@@ -3457,6 +3841,10 @@ type bucketChunkReader struct {
 	loadingChunksMtx  sync.Mutex
 	loadingChunks     bool
 	finishLoadingChks chan struct{}
+
+	// Read-ahead buffers by chunk file sequence number. Nil if read-ahead is disabled.
+	readAheads []chunkReadAhead
+	tenant     string
 }
 
 func newBucketChunkReader(block *bucketBlock, logger log.Logger) *bucketChunkReader {
@@ -3490,7 +3878,11 @@ func (r *bucketChunkReader) Close() error {
 	}
 	r.block.pendingReaders.Done()
 
+	for seq := range r.readAheads {
+		r.discardReadAhead(seq)
+	}
 	for _, b := range r.chunkBytes {
+		r.block.pinnedChunkBytes.Sub(int64(cap(*b)))
 		r.block.chunkPool.Put(b)
 	}
 	return nil
@@ -3529,26 +3921,53 @@ func (r *bucketChunkReader) load(ctx context.Context, res []seriesEntry, aggrs [
 
 	g, ctx := errgroup.WithContext(ctx)
 
+	r.tenant = tenant
+	if r.block.chunkReadAheadMaxSize > 0 && r.readAheads == nil {
+		r.readAheads = make([]chunkReadAhead, len(r.toLoad))
+	}
 	for seq, pIdxs := range r.toLoad {
 		sort.Slice(pIdxs, func(i, j int) bool {
 			return pIdxs[i].offset < pIdxs[j].offset
 		})
+
+		readAhead := 0
+		if r.readAheads != nil {
+			var err error
+			if pIdxs, err = r.loadFromReadAhead(res, aggrs, seq, pIdxs, calculateChunkChecksum); err != nil {
+				return err
+			}
+			if len(pIdxs) > 0 {
+				// The remaining chunks are fetched together with a new read-ahead.
+				r.discardReadAhead(seq)
+				readAhead = r.readAheads[seq].size
+			}
+		}
+
 		parts := r.block.partitioner.Partition(len(pIdxs), func(i int) (start, end uint64) {
 			return uint64(pIdxs[i].offset), uint64(pIdxs[i].offset) + uint64(r.block.estimatedMaxChunkSize)
 		})
 
-		for _, p := range parts {
-			if err := bytesLimiter.ReserveWithType(uint64(p.End-p.Start), ChunksFetched); err != nil {
+		for i, p := range parts {
+			size := p.End - p.Start
+			if i == len(parts)-1 {
+				size += uint64(readAhead)
+			}
+			if err := bytesLimiter.ReserveWithType(size, ChunksFetched); err != nil {
 				return httpgrpc.Errorf(int(codes.ResourceExhausted), "exceeded bytes limit while fetching chunks: %s", err)
 			}
 		}
 
-		for _, p := range parts {
+		for i, p := range parts {
 			seq := seq
 			p := p
 			indices := pIdxs[p.ElemRng[0]:p.ElemRng[1]]
+			// Only the last part of each chunk file reads ahead, as the following chunks are fetched by the next load.
+			partReadAhead := 0
+			if i == len(parts)-1 {
+				partReadAhead = readAhead
+			}
 			g.Go(func() error {
-				return r.loadChunks(ctx, res, aggrs, seq, p, indices, calculateChunkChecksum, bytesLimiter, tenant)
+				return r.loadChunks(ctx, res, aggrs, seq, p, indices, partReadAhead, calculateChunkChecksum, bytesLimiter, tenant)
 			})
 		}
 	}
@@ -3556,8 +3975,9 @@ func (r *bucketChunkReader) load(ctx context.Context, res []seriesEntry, aggrs [
 }
 
 // loadChunks will read range [start, end] from the segment file with sequence number seq.
-// This data range covers chunks starting at supplied offsets.
-func (r *bucketChunkReader) loadChunks(ctx context.Context, res []seriesEntry, aggrs []storepb.Aggr, seq int, part Part, pIdxs []loadIdx, calculateChunkChecksum bool, bytesLimiter BytesLimiter, tenant string) error {
+// This data range covers chunks starting at supplied offsets. If readAhead is positive, up to readAhead bytes
+// following the range are read as well and kept in the read-ahead buffer of the segment file.
+func (r *bucketChunkReader) loadChunks(ctx context.Context, res []seriesEntry, aggrs []storepb.Aggr, seq int, part Part, pIdxs []loadIdx, readAhead int, calculateChunkChecksum bool, bytesLimiter BytesLimiter, tenant string) error {
 	fetchBegin := time.Now()
 	stats := new(queryStats)
 	defer func() {
@@ -3566,7 +3986,7 @@ func (r *bucketChunkReader) loadChunks(ctx context.Context, res []seriesEntry, a
 	}()
 
 	// Get a reader for the required range.
-	reader, err := r.block.chunkRangeReader(ctx, seq, int64(part.Start), int64(part.End-part.Start))
+	reader, err := r.block.chunkRangeReader(ctx, seq, int64(part.Start), int64(part.End-part.Start)+int64(readAhead))
 	if err != nil {
 		return errors.Wrap(err, "get range reader")
 	}
@@ -3584,7 +4004,11 @@ func (r *bucketChunkReader) loadChunks(ctx context.Context, res []seriesEntry, a
 		written  int
 		diff     uint32
 		chunkLen int
-		n        int
+		read     int
+
+		// Start of the read-ahead in the segment file and the bytes already read past the last chunk.
+		readAheadStart uint64
+		readAheadTail  []byte
 	)
 
 	bufPooled, err := r.block.chunkPool.Get(r.block.estimatedMaxChunkSize)
@@ -3614,8 +4038,8 @@ func (r *bucketChunkReader) loadChunks(ctx context.Context, res []seriesEntry, a
 			}
 		}
 		cb := buf[:chunkLen]
-		n, err = io.ReadFull(bufReader, cb)
-		readOffset += n
+		read, err = io.ReadFull(bufReader, cb)
+		readOffset += read
 		// Unexpected EOF for last chunk could be a valid case. Any other errors are definitely real.
 		if err != nil && !(errors.Is(err, io.ErrUnexpectedEOF) && i == len(pIdxs)-1) {
 			return errors.Wrapf(err, "read range for seq %d offset %x", seq, pIdx.offset)
@@ -3629,6 +4053,12 @@ func (r *bucketChunkReader) loadChunks(ctx context.Context, res []seriesEntry, a
 		// Chunk length is n (number of bytes used to encode chunk data), 1 for chunk encoding and chunkDataLen for actual chunk data.
 		// There is also crc32 after the chunk, but we ignore that.
 		chunkLen = n + 1 + int(chunkDataLen)
+		if readAhead > 0 && i == len(pIdxs)-1 {
+			readAheadStart = uint64(pIdx.offset) + uint64(chunkLen)
+			if chunkLen < read {
+				readAheadTail = cb[chunkLen:read]
+			}
+		}
 		if chunkLen <= len(cb) {
 			c := rawChunk(cb[n:chunkLen])
 			err = populateChunk(res[pIdx.seriesEntry].chks[pIdx.chunk], &c, aggrs, r.save, calculateChunkChecksum)
@@ -3668,6 +4098,9 @@ func (r *bucketChunkReader) loadChunks(ctx context.Context, res []seriesEntry, a
 
 		r.block.chunkPool.Put(nb)
 	}
+	if readAhead > 0 {
+		return r.fillReadAhead(seq, bufReader, uint64(readOffset), readAheadStart, readAheadTail, part.End+uint64(readAhead))
+	}
 	return nil
 }
 
@@ -3683,6 +4116,7 @@ func (r *bucketChunkReader) save(b []byte) ([]byte, error) {
 		if err != nil {
 			return nil, errors.Wrap(err, "allocate chunk bytes")
 		}
+		r.block.pinnedChunkBytes.Add(int64(cap(*s)))
 		r.chunkBytes = append(r.chunkBytes, s)
 	}
 	slab := r.chunkBytes[len(r.chunkBytes)-1]
@@ -3876,5 +4310,42 @@ func (s *queryStats) toHints() *hintspb.QueryStats {
 
 // NewDefaultChunkBytesPool returns a chunk bytes pool with default settings.
 func NewDefaultChunkBytesPool(maxChunkPoolBytes uint64) (pool.Pool[byte], error) {
-	return pool.NewBucketedPool[byte](chunkBytesPoolMinSize, chunkBytesPoolMaxSize, 2, maxChunkPoolBytes)
+	return NewChunkBytesPool(nil, DefaultChunkBytesPoolMinSize, DefaultChunkBytesPoolMaxSize, maxChunkPoolBytes)
+}
+
+// NewChunkBytesPool returns a chunk bytes pool with size classes doubling from minSize up to maxSize
+// and at most maxChunkPoolBytes in use at any time. Pool usage metrics are registered in reg if not nil.
+func NewChunkBytesPool(reg prometheus.Registerer, minSize, maxSize int, maxChunkPoolBytes uint64) (pool.Pool[byte], error) {
+	p, err := pool.NewBucketedPool[byte](minSize, maxSize, 2, maxChunkPoolBytes)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, result := range []string{"hit", "miss", "exhausted"} {
+		promauto.With(reg).NewCounterFunc(prometheus.CounterOpts{
+			Name:        "thanos_bucket_store_chunk_pool_requests_total",
+			Help:        "Total number of chunk pool requests by result. A hit means a previously returned buffer was reused.",
+			ConstLabels: prometheus.Labels{"result": result},
+		}, func() float64 {
+			stats := p.Stats()
+			switch result {
+			case "hit":
+				return float64(stats.Hits)
+			case "miss":
+				return float64(stats.Misses)
+			default:
+				return float64(stats.Exhausted)
+			}
+		})
+	}
+	promauto.With(reg).NewCounterFunc(prometheus.CounterOpts{
+		Name: "thanos_bucket_store_chunk_pool_returned_total",
+		Help: "Total number of buffers returned to the chunk pool for reuse.",
+	}, func() float64 { return float64(p.Stats().Returned) })
+	promauto.With(reg).NewGaugeFunc(prometheus.GaugeOpts{
+		Name: "thanos_bucket_store_chunk_pool_used_bytes",
+		Help: "Number of bytes currently handed out by the chunk pool.",
+	}, func() float64 { return float64(p.UsedBytes()) })
+
+	return p, nil
 }
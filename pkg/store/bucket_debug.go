@@ -0,0 +1,91 @@
+// Copyright (c) The Thanos Authors.
+// Licensed under the Apache License 2.0.
+
+package store
+
+import (
+	"encoding/json"
+	"net/http"
+	"sort"
+
+	"github.com/oklog/ulid"
+
+	"github.com/thanos-io/thanos/pkg/block/indexheader"
+	storecache "github.com/thanos-io/thanos/pkg/store/cache"
+)
+
+// BlockMemory is the estimated resident memory of a loaded block, broken down by component.
+type BlockMemory struct {
+	ID         ulid.ULID         `json:"id"`
+	MinTime    int64             `json:"minTime"`
+	MaxTime    int64             `json:"maxTime"`
+	Resolution int64             `json:"resolution"`
+	Labels     map[string]string `json:"labels"`
+
+	// IndexHeaderMappedBytes is the size of the index-header mapped into memory, zero if it is lazily loaded and
+	// currently unloaded. Mapped pages are only resident once read.
+	IndexHeaderMappedBytes int64 `json:"indexHeaderMappedBytes"`
+	// IndexHeaderTablesBytes is the estimated size of the lookup tables built from the index-header.
+	IndexHeaderTablesBytes int64 `json:"indexHeaderTablesBytes"`
+	// CachedPostingsBytes and CachedSeriesBytes are the size of the items of the block in the index cache. They are
+	// omitted if the index cache cannot report them, e.g. for remote caches.
+	CachedPostingsBytes *int64 `json:"cachedPostingsBytes,omitempty"`
+	CachedSeriesBytes   *int64 `json:"cachedSeriesBytes,omitempty"`
+	// InMemoryFilesBytes is the size of the index and chunk files of the block held in memory, see
+	// WithInMemoryRecentBlocks.
+	InMemoryFilesBytes int64 `json:"inMemoryFilesBytes"`
+	// PinnedChunksBytes is the size of the chunk buffers held by in-flight requests.
+	PinnedChunksBytes int64 `json:"pinnedChunksBytes"`
+	TotalBytes        int64 `json:"totalBytes"`
+}
+
+// BlocksMemory returns the estimated memory footprint of the loaded blocks, sorted by footprint descending.
+// It neither loads index-headers nor blocks queries.
+func (s *BucketStore) BlocksMemory() []BlockMemory {
+	s.mtx.RLock()
+	blocks := make([]*bucketBlock, 0, len(s.blocks))
+	for _, b := range s.blocks {
+		blocks = append(blocks, b)
+	}
+	s.mtx.RUnlock()
+
+	res := make([]BlockMemory, 0, len(blocks))
+	for _, b := range blocks {
+		m := BlockMemory{
+			ID:                b.meta.ULID,
+			MinTime:           b.meta.MinTime,
+			MaxTime:           b.meta.MaxTime,
+			Resolution:        b.meta.Thanos.Downsample.Resolution,
+			Labels:            b.meta.Thanos.Labels,
+			PinnedChunksBytes: b.pinnedChunkBytes.Load(),
+		}
+		if r, ok := b.indexHeaderReader.(indexheader.MemoryReporter); ok {
+			m.IndexHeaderMappedBytes, m.IndexHeaderTablesBytes = r.MemoryUsage()
+		}
+		if r, ok := b.bkt.(*inMemoryBlockReader); ok {
+			m.InMemoryFilesBytes = r.loadedSize()
+		}
+		if postings, series, ok := storecache.CachedBlockSize(b.indexCache, b.meta.ULID); ok {
+			p, s := int64(postings), int64(series)
+			m.CachedPostingsBytes, m.CachedSeriesBytes = &p, &s
+			m.TotalBytes += p + s
+		}
+		m.TotalBytes += m.IndexHeaderMappedBytes + m.IndexHeaderTablesBytes + m.InMemoryFilesBytes + m.PinnedChunksBytes
+		res = append(res, m)
+	}
+	sort.Slice(res, func(i, j int) bool {
+		if res[i].TotalBytes != res[j].TotalBytes {
+			return res[i].TotalBytes > res[j].TotalBytes
+		}
+		return res[i].ID.Compare(res[j].ID) < 0
+	})
+	return res
+}
+
+// BlocksMemoryHandler returns a read-only HTTP handler serving the BlocksMemory of the store as JSON.
+func (s *BucketStore) BlocksMemoryHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(s.BlocksMemory())
+	})
+}
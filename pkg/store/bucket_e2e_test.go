@@ -615,6 +615,7 @@ func TestBucketStore_Series_ChunksLimiter_e2e(t *testing.T) {
 		maxChunksLimit uint64
 		maxSeriesLimit uint64
 		maxBytesLimit  int64
+		maxBlocks      int
 		expectedErr    string
 		code           codes.Code
 	}{
@@ -639,6 +640,16 @@ func TestBucketStore_Series_ChunksLimiter_e2e(t *testing.T) {
 			maxBytesLimit:  1,
 			code:           codes.ResourceExhausted,
 		},
+		"should succeed if the max blocks limit is not exceeded": {
+			maxChunksLimit: expectedChunks,
+			maxBlocks:      6,
+		},
+		"should fail if the max blocks limit is exceeded - ResourceExhausted": {
+			maxChunksLimit: expectedChunks,
+			maxBlocks:      5,
+			expectedErr:    "exceeded blocks limit: query would touch 6 blocks, the limit is 5",
+			code:           codes.ResourceExhausted,
+		},
 	}
 
 	for testName, testData := range cases {
@@ -650,6 +661,7 @@ func TestBucketStore_Series_ChunksLimiter_e2e(t *testing.T) {
 			dir := t.TempDir()
 
 			s := prepareStoreWithTestBlocks(t, dir, bkt, false, NewChunksLimiterFactory(testData.maxChunksLimit), NewSeriesLimiterFactory(testData.maxSeriesLimit), NewBytesLimiterFactory(units.Base2Bytes(testData.maxBytesLimit)), emptyRelabelConfig, allowAllFilterConf)
+			s.store.maxBlocksPerQuery = testData.maxBlocks
 			testutil.Ok(t, s.store.SyncBlocks(ctx))
 
 			req := &storepb.SeriesRequest{
@@ -0,0 +1,111 @@
+// Copyright (c) The Thanos Authors.
+// Licensed under the Apache License 2.0.
+
+package store
+
+import (
+	"strings"
+
+	lru "github.com/hashicorp/golang-lru/v2"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/prometheus/model/labels"
+)
+
+// foldedRegexCacheSize is the number of case-insensitive regex matchers kept compiled.
+const foldedRegexCacheSize = 256
+
+// WithCaseInsensitiveExternalLabels matches the values of the given external labels of blocks ignoring case, so
+// that e.g. cluster="prod" selects blocks labeled cluster="Prod" too. It is a stopgap for buckets with
+// inconsistently labeled blocks: series keep the external labels of their blocks, and queriers still select
+// stores by their advertised label sets case-sensitively.
+func WithCaseInsensitiveExternalLabels(names []string) BucketStoreOption {
+	return func(s *BucketStore) {
+		s.caseInsensitiveExtLabels = names
+	}
+}
+
+// externalLabelMatcher matches matchers against the external labels of blocks, ignoring the case of the values of
+// the configured labels. A nil externalLabelMatcher matches all external labels case-sensitively.
+type externalLabelMatcher struct {
+	caseInsensitive map[string]struct{}
+	// foldedRegexes caches the case-insensitive versions of regex matchers, by type and value.
+	foldedRegexes     *lru.Cache[string, *labels.Matcher]
+	caseFoldedMatches *prometheus.CounterVec
+}
+
+func newExternalLabelMatcher(names []string, caseFoldedMatches *prometheus.CounterVec) *externalLabelMatcher {
+	e := &externalLabelMatcher{
+		caseInsensitive:   make(map[string]struct{}, len(names)),
+		caseFoldedMatches: caseFoldedMatches,
+	}
+	// The size is positive, so the cache cannot fail to be created.
+	e.foldedRegexes, _ = lru.New[string, *labels.Matcher](foldedRegexCacheSize)
+	for _, n := range names {
+		e.caseInsensitive[n] = struct{}{}
+	}
+	return e
+}
+
+// filter returns the matchers not on the given external labels, false if any matcher on an external label does
+// not match.
+func (e *externalLabelMatcher) filter(extLset labels.Labels, matchers ...*labels.Matcher) ([]*labels.Matcher, bool) {
+	res := make([]*labels.Matcher, 0, len(matchers))
+
+	for _, m := range matchers {
+		v := extLset.Get(m.Name)
+		if v == "" {
+			res = append(res, m)
+			continue
+		}
+		if !e.matches(m, v) {
+			return nil, false
+		}
+	}
+	return res, true
+}
+
+// matches returns true if the value of an external label matches the matcher, ignoring case if the label is
+// case-insensitive.
+func (e *externalLabelMatcher) matches(m *labels.Matcher, v string) bool {
+	if e == nil {
+		return m.Matches(v)
+	}
+	if _, ok := e.caseInsensitive[m.Name]; !ok {
+		return m.Matches(v)
+	}
+
+	switch m.Type {
+	case labels.MatchEqual:
+		return strings.EqualFold(v, m.Value)
+	case labels.MatchNotEqual:
+		return !strings.EqualFold(v, m.Value)
+	}
+
+	key := m.Type.String() + m.Value
+	folded, ok := e.foldedRegexes.Get(key)
+	if !ok {
+		var err error
+		if folded, err = labels.NewMatcher(m.Type, m.Name, "(?i)"+m.Value); err != nil {
+			// The matcher compiled case-sensitively, this should not happen.
+			return m.Matches(v)
+		}
+		e.foldedRegexes.Add(key, folded)
+	}
+	return folded.Matches(v)
+}
+
+// countCaseFolded counts the matchers matching the given external labels only because their case is ignored.
+// It must only be called for external labels the matchers were filtered with.
+func (e *externalLabelMatcher) countCaseFolded(extLset labels.Labels, matchers ...*labels.Matcher) {
+	if e == nil {
+		return
+	}
+	for _, m := range matchers {
+		if _, ok := e.caseInsensitive[m.Name]; !ok {
+			continue
+		}
+		if v := extLset.Get(m.Name); v != "" && !m.Matches(v) {
+			e.caseFoldedMatches.WithLabelValues(m.Name).Inc()
+		}
+	}
+}
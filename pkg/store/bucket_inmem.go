@@ -0,0 +1,211 @@
+// Copyright (c) The Thanos Authors.
+// Licensed under the Apache License 2.0.
+
+package store
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"sync"
+	"time"
+
+	"github.com/go-kit/log"
+	"github.com/go-kit/log/level"
+	"github.com/oklog/ulid"
+	"github.com/pkg/errors"
+	"github.com/thanos-io/objstore"
+
+	"github.com/thanos-io/thanos/pkg/runutil"
+)
+
+// inMemoryBlocks keeps the index and chunk files of recent blocks fully resident in
+// memory, so that queries against them never hit the object storage. Blocks are
+// evicted once their max time falls out of the configured window. The total size of
+// resident blocks is bounded; blocks not fitting into the budget are read lazily as usual.
+type inMemoryBlocks struct {
+	logger  log.Logger
+	metrics *bucketStoreMetrics
+	maxAge  time.Duration
+	maxSize int64
+	now     func() time.Time
+
+	mtx    sync.Mutex
+	size   int64
+	blocks map[ulid.ULID]*inMemoryBlockReader
+}
+
+func newInMemoryBlocks(logger log.Logger, metrics *bucketStoreMetrics, maxAge time.Duration, maxSize int64) *inMemoryBlocks {
+	return &inMemoryBlocks{
+		logger:  logger,
+		metrics: metrics,
+		maxAge:  maxAge,
+		maxSize: maxSize,
+		now:     time.Now,
+		blocks:  map[ulid.ULID]*inMemoryBlockReader{},
+	}
+}
+
+// isRecent returns true if the block with the given max time (in milliseconds) is within the window.
+func (m *inMemoryBlocks) isRecent(maxTime int64) bool {
+	return maxTime >= m.now().Add(-m.maxAge).UnixMilli()
+}
+
+// load downloads the index and chunk files of the given block into memory if the block
+// is recent and fits into the budget, and makes the block read from memory from now on.
+// It must be called before the block becomes queryable.
+func (m *inMemoryBlocks) load(ctx context.Context, b *bucketBlock) error {
+	if !m.isRecent(b.meta.MaxTime) {
+		return nil
+	}
+
+	names := append([]string{b.indexFilename()}, b.chunkObjs...)
+	var size int64
+	for _, n := range names {
+		attrs, err := b.bkt.Attributes(ctx, n)
+		if err != nil {
+			return errors.Wrapf(err, "get attributes of %s", n)
+		}
+		size += attrs.Size
+	}
+
+	m.mtx.Lock()
+	if m.size+size > m.maxSize {
+		m.mtx.Unlock()
+		level.Debug(m.logger).Log("msg", "not enough memory left to keep recent block in memory", "id", b.meta.ULID, "size", size)
+		return nil
+	}
+	// Reserve the budget while downloading.
+	m.size += size
+	m.mtx.Unlock()
+
+	files := make(map[string][]byte, len(names))
+	for _, n := range names {
+		buf, err := m.download(ctx, b.bkt, n)
+		if err != nil {
+			m.mtx.Lock()
+			m.size -= size
+			m.mtx.Unlock()
+			return errors.Wrapf(err, "download %s", n)
+		}
+		files[n] = buf
+	}
+
+	r := &inMemoryBlockReader{BucketReader: b.bkt, files: files, size: size}
+	b.bkt = r
+
+	m.mtx.Lock()
+	m.blocks[b.meta.ULID] = r
+	m.updateMetrics()
+	m.mtx.Unlock()
+	return nil
+}
+
+func (m *inMemoryBlocks) download(ctx context.Context, bkt objstore.BucketReader, name string) (_ []byte, err error) {
+	r, err := bkt.Get(ctx, name)
+	if err != nil {
+		return nil, err
+	}
+	defer runutil.CloseWithErrCapture(&err, r, "close object")
+	return io.ReadAll(r)
+}
+
+// release drops the in-memory copy of the given block, if any.
+func (m *inMemoryBlocks) release(id ulid.ULID) {
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+
+	m.releaseLocked(id)
+	m.updateMetrics()
+}
+
+// evictExpired drops the in-memory copies of blocks which fell out of the window.
+func (m *inMemoryBlocks) evictExpired(metas map[ulid.ULID]int64) {
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+
+	for id := range m.blocks {
+		if maxTime, ok := metas[id]; ok && m.isRecent(maxTime) {
+			continue
+		}
+		level.Debug(m.logger).Log("msg", "evicting block from memory", "id", id)
+		m.releaseLocked(id)
+	}
+	m.updateMetrics()
+}
+
+func (m *inMemoryBlocks) releaseLocked(id ulid.ULID) {
+	r, ok := m.blocks[id]
+	if !ok {
+		return
+	}
+	m.size -= r.release()
+	delete(m.blocks, id)
+}
+
+func (m *inMemoryBlocks) updateMetrics() {
+	m.metrics.inMemoryBlocks.Set(float64(len(m.blocks)))
+	m.metrics.inMemoryBlocksBytes.Set(float64(m.size))
+}
+
+// inMemoryBlockReader serves the block's files from memory, falling back to the
+// underlying bucket once the files are released.
+type inMemoryBlockReader struct {
+	objstore.BucketReader
+
+	mtx   sync.RWMutex
+	files map[string][]byte
+	size  int64
+}
+
+func (r *inMemoryBlockReader) file(name string) ([]byte, bool) {
+	r.mtx.RLock()
+	defer r.mtx.RUnlock()
+
+	b, ok := r.files[name]
+	return b, ok
+}
+
+// loadedSize returns the size of the files held in memory, zero once released.
+func (r *inMemoryBlockReader) loadedSize() int64 {
+	r.mtx.RLock()
+	defer r.mtx.RUnlock()
+
+	if r.files == nil {
+		return 0
+	}
+	return r.size
+}
+
+// release drops the in-memory files and returns the number of released bytes.
+// In-flight readers keep the data they already hold.
+func (r *inMemoryBlockReader) release() int64 {
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+
+	r.files = nil
+	return r.size
+}
+
+func (r *inMemoryBlockReader) Get(ctx context.Context, name string) (io.ReadCloser, error) {
+	b, ok := r.file(name)
+	if !ok {
+		return r.BucketReader.Get(ctx, name)
+	}
+	return io.NopCloser(bytes.NewReader(b)), nil
+}
+
+func (r *inMemoryBlockReader) GetRange(ctx context.Context, name string, off, length int64) (io.ReadCloser, error) {
+	b, ok := r.file(name)
+	if !ok {
+		return r.BucketReader.GetRange(ctx, name, off, length)
+	}
+	if off < 0 || off > int64(len(b)) {
+		return nil, errors.Errorf("offset %d out of range of %s of size %d", off, name, len(b))
+	}
+	end := int64(len(b))
+	if length >= 0 && off+length < end {
+		end = off + length
+	}
+	return io.NopCloser(bytes.NewReader(b[off:end])), nil
+}
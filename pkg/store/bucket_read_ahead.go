@@ -0,0 +1,150 @@
+// Copyright (c) The Thanos Authors.
+// Licensed under the Apache License 2.0.
+
+package store
+
+import (
+	"bufio"
+	"encoding/binary"
+	"io"
+
+	"github.com/pkg/errors"
+
+	"github.com/thanos-io/thanos/pkg/store/storepb"
+)
+
+// minChunkReadAheadSize is the read-ahead size of a chunk file before any locality of chunks was observed.
+const minChunkReadAheadSize = 16 * 1024
+
+// chunkReadAhead holds the bytes read from a chunk file after the last chunk fetched by a chunk reader.
+// Series are loaded in batches and chunks of consecutive series are usually stored next to each other,
+// so the first chunks of the next batch can often be served from the read-ahead buffer instead of
+// with another request to object storage.
+//
+// The read-ahead size adapts to the observed locality: it is doubled, up to the configured maximum,
+// whenever most of the buffer was used and more chunks were requested past its end, and halved
+// whenever less than half of the buffer was used by the time it is discarded.
+type chunkReadAhead struct {
+	// size is the number of bytes to read ahead with the next fetch.
+	size int
+
+	// start is the offset of buf in the chunk file.
+	start uint64
+	buf   *[]byte
+	// used is the number of bytes of buf belonging to chunks served from it.
+	used int
+	// exhausted is set when chunks continuing or following right after the end of buf were requested.
+	exhausted bool
+}
+
+// loadFromReadAhead populates the chunks stored in the read-ahead buffer of the chunk file seq and
+// returns the remaining ones, which still have to be fetched.
+func (r *bucketChunkReader) loadFromReadAhead(res []seriesEntry, aggrs []storepb.Aggr, seq int, pIdxs []loadIdx, calculateChunkChecksum bool) ([]loadIdx, error) {
+	ra := &r.readAheads[seq]
+	if ra.buf == nil {
+		return pIdxs, nil
+	}
+
+	end := ra.start + uint64(len(*ra.buf))
+	rest := pIdxs[:0]
+	for _, pIdx := range pIdxs {
+		off := uint64(pIdx.offset)
+		if off < ra.start || off >= end {
+			// Chunks are sorted, so all chunks within the buffer were served already. If they used most of it,
+			// the chunks are likely contiguous and a larger read-ahead would have served more of them.
+			if off >= end && 2*ra.used >= len(*ra.buf) {
+				ra.exhausted = true
+			}
+			rest = append(rest, pIdx)
+			continue
+		}
+
+		b := (*ra.buf)[off-ra.start:]
+		chunkDataLen, n := binary.Uvarint(b)
+		// Chunk length is n (number of bytes used to encode chunk data), 1 for chunk encoding and chunkDataLen for actual chunk data.
+		chunkLen := n + 1 + int(chunkDataLen)
+		if n < 1 || chunkLen > len(b) {
+			// The chunk continues past the end of the buffer.
+			ra.exhausted = true
+			rest = append(rest, pIdx)
+			continue
+		}
+
+		c := rawChunk(b[n:chunkLen])
+		if err := populateChunk(res[pIdx.seriesEntry].chks[pIdx.chunk], &c, aggrs, r.save, calculateChunkChecksum); err != nil {
+			return nil, errors.Wrap(err, "populate chunk")
+		}
+		ra.used += chunkLen
+		r.stats.add(ChunksTouched, 1, int(chunkDataLen))
+	}
+	return rest, nil
+}
+
+// fillReadAhead reads the bytes following the last chunk fetched from the chunk file seq into its read-ahead buffer.
+// The reader rd is positioned at offset, tail holds the bytes past the last chunk which were read already,
+// start is the offset of the end of the last chunk and end is the offset up to which bytes were requested.
+func (r *bucketChunkReader) fillReadAhead(seq int, rd *bufio.Reader, offset, start uint64, tail []byte, end uint64) error {
+	// Skip the rest of a last chunk larger than estimated, which was fetched separately.
+	for offset < start {
+		n, err := rd.Discard(int(start - offset))
+		offset += uint64(n)
+		if err != nil {
+			if errors.Is(err, io.EOF) {
+				return nil
+			}
+			return errors.Wrap(err, "skip to read-ahead")
+		}
+	}
+	if offset >= end && len(tail) == 0 {
+		return nil
+	}
+
+	size := len(tail)
+	if end > offset {
+		size += int(end - offset)
+	}
+	buf, err := r.block.chunkPool.Get(size)
+	if err != nil {
+		return errors.Wrap(err, "allocate read-ahead bytes")
+	}
+	*buf = append((*buf)[:0], tail...)
+	*buf = (*buf)[:size]
+	n, err := io.ReadFull(rd, (*buf)[len(tail):])
+	// The read-ahead may reach past the end of the chunk file.
+	if err != nil && !errors.Is(err, io.ErrUnexpectedEOF) && !errors.Is(err, io.EOF) {
+		r.block.chunkPool.Put(buf)
+		return errors.Wrap(err, "read ahead")
+	}
+	*buf = (*buf)[:len(tail)+n]
+
+	r.readAheads[seq].start = start
+	r.readAheads[seq].buf = buf
+	r.block.metrics.chunkReadAheadBytes.WithLabelValues(r.tenant).Add(float64(len(*buf)))
+	return nil
+}
+
+// discardReadAhead releases the read-ahead buffer of the chunk file seq, accounts for its unused bytes
+// and adapts the read-ahead size of the chunk file to how much of the buffer was used.
+func (r *bucketChunkReader) discardReadAhead(seq int) {
+	ra := &r.readAheads[seq]
+	minSize := min(minChunkReadAheadSize, r.block.chunkReadAheadMaxSize)
+	if ra.size == 0 {
+		ra.size = minSize
+	}
+	if ra.buf == nil {
+		return
+	}
+
+	r.block.metrics.chunkReadAheadWasted.WithLabelValues(r.tenant).Add(float64(len(*ra.buf) - ra.used))
+	switch {
+	case ra.exhausted:
+		ra.size = min(2*ra.size, r.block.chunkReadAheadMaxSize)
+	case 2*ra.used < len(*ra.buf):
+		ra.size = max(ra.size/2, minSize)
+	}
+
+	r.block.chunkPool.Put(ra.buf)
+	ra.buf = nil
+	ra.used = 0
+	ra.exhausted = false
+}
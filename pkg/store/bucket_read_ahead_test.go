@@ -0,0 +1,108 @@
+// Copyright (c) The Thanos Authors.
+// Licensed under the Apache License 2.0.
+
+package store
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"testing"
+
+	"github.com/efficientgo/core/testutil"
+	promtest "github.com/prometheus/client_golang/prometheus/testutil"
+
+	"github.com/thanos-io/thanos/pkg/pool"
+	"github.com/thanos-io/thanos/pkg/store/hintspb"
+	"github.com/thanos-io/thanos/pkg/store/storepb"
+	"github.com/thanos-io/thanos/pkg/tenancy"
+)
+
+func TestSeries_ChunkReadAhead(t *testing.T) {
+	const numSeries = 100
+
+	req := &storepb.SeriesRequest{
+		MinTime:  math.MinInt64,
+		MaxTime:  math.MaxInt64,
+		Matchers: []*storepb.LabelMatcher{{Type: storepb.LabelMatcher_EQ, Name: "__name__", Value: "test"}},
+		Hints:    mustMarshalAny(&hintspb.SeriesRequestHints{EnableQueryStats: true}),
+	}
+	series := func(t *testing.T, store *BucketStore) ([]*storepb.Series, *hintspb.QueryStats) {
+		srv := newStoreSeriesServer(context.Background())
+		testutil.Ok(t, store.Series(req, srv))
+		testutil.Equals(t, 1, len(srv.HintsSet))
+
+		var hints hintspb.SeriesResponseHints
+		testutil.Ok(t, srv.HintsSet[0].UnmarshalTo(&hints))
+		return srv.SeriesSet, hints.QueryStats
+	}
+
+	// Loading series one by one fetches the chunks of each series with a separate request.
+	expected, stats := series(t, prepareStoreWithMultiChunkSeries(t, numSeries, 2*MaxSamplesPerChunk, WithSeriesBatchSize(1)))
+	testutil.Equals(t, numSeries, len(expected))
+	testutil.Equals(t, int64(numSeries), stats.ChunksFetchCount)
+
+	for _, maxSize := range []int{1, 1024, 1024 * 1024} {
+		t.Run(fmt.Sprintf("max=%d", maxSize), func(t *testing.T) {
+			store := prepareStoreWithMultiChunkSeries(t, numSeries, 2*MaxSamplesPerChunk, WithSeriesBatchSize(1), WithChunkReadAhead(maxSize))
+
+			actual, stats := series(t, store)
+			testutil.Equals(t, expected, actual)
+			testutil.Assert(t, stats.ChunksFetchCount < numSeries, "expected fewer than %d chunk fetches, got %d", numSeries, stats.ChunksFetchCount)
+
+			read := promtest.ToFloat64(store.metrics.chunkReadAheadBytes.WithLabelValues(tenancy.DefaultTenant))
+			wasted := promtest.ToFloat64(store.metrics.chunkReadAheadWasted.WithLabelValues(tenancy.DefaultTenant))
+			testutil.Assert(t, read > 0, "expected bytes read ahead")
+			testutil.Assert(t, wasted <= read, "wasted %v of %v bytes read ahead", wasted, read)
+		})
+	}
+}
+
+func TestBucketChunkReader_DiscardReadAhead(t *testing.T) {
+	const maxSize = 8 * minChunkReadAheadSize
+
+	chunkPool, err := pool.NewBucketedPool[byte](DefaultChunkBytesPoolMinSize, DefaultChunkBytesPoolMaxSize, 2, 1e9)
+	testutil.Ok(t, err)
+	r := &bucketChunkReader{
+		block: &bucketBlock{
+			metrics:               newBucketStoreMetrics(nil),
+			chunkPool:             chunkPool,
+			chunkReadAheadMaxSize: maxSize,
+		},
+		readAheads: make([]chunkReadAhead, 1),
+	}
+	fill := func(size, used int, exhausted bool) {
+		buf, err := r.block.chunkPool.Get(size)
+		testutil.Ok(t, err)
+		*buf = (*buf)[:size]
+		r.readAheads[0].buf = buf
+		r.readAheads[0].used = used
+		r.readAheads[0].exhausted = exhausted
+	}
+
+	// The first read-ahead uses the minimum size.
+	r.discardReadAhead(0)
+	testutil.Equals(t, minChunkReadAheadSize, r.readAheads[0].size)
+
+	// Exhausted read-aheads double up to the maximum.
+	for _, expected := range []int{2 * minChunkReadAheadSize, 4 * minChunkReadAheadSize, maxSize, maxSize} {
+		fill(r.readAheads[0].size, r.readAheads[0].size, true)
+		r.discardReadAhead(0)
+		testutil.Equals(t, expected, r.readAheads[0].size)
+		testutil.Assert(t, r.readAheads[0].buf == nil)
+	}
+
+	// Mostly used read-aheads keep their size.
+	fill(maxSize, maxSize/2, false)
+	r.discardReadAhead(0)
+	testutil.Equals(t, maxSize, r.readAheads[0].size)
+
+	// Mostly unused read-aheads halve down to the minimum.
+	for _, expected := range []int{4 * minChunkReadAheadSize, 2 * minChunkReadAheadSize, minChunkReadAheadSize, minChunkReadAheadSize} {
+		fill(r.readAheads[0].size, 0, false)
+		r.discardReadAhead(0)
+		testutil.Equals(t, expected, r.readAheads[0].size)
+	}
+	testutil.Equals(t, float64(maxSize/2+maxSize+4*minChunkReadAheadSize+2*minChunkReadAheadSize+minChunkReadAheadSize),
+		promtest.ToFloat64(r.block.metrics.chunkReadAheadWasted.WithLabelValues("")))
+}
@@ -7,10 +7,13 @@ import (
 	"bytes"
 	"context"
 	"encoding/binary"
+	"encoding/json"
 	"fmt"
 	"io"
 	"math"
 	"math/rand"
+	"net/http"
+	"net/http/httptest"
 	"os"
 	"path"
 	"path/filepath"
@@ -58,6 +61,7 @@ import (
 	"github.com/thanos-io/thanos/pkg/gate"
 	"github.com/thanos-io/thanos/pkg/info/infopb"
 	"github.com/thanos-io/thanos/pkg/pool"
+	"github.com/thanos-io/thanos/pkg/runutil"
 	storecache "github.com/thanos-io/thanos/pkg/store/cache"
 	"github.com/thanos-io/thanos/pkg/store/hintspb"
 	"github.com/thanos-io/thanos/pkg/store/labelpb"
@@ -570,6 +574,47 @@ func TestBucketBlockSet_labelMatchers(t *testing.T) {
 	}
 }
 
+func TestBucketBlockSet_labelMatchersCaseInsensitive(t *testing.T) {
+	defer custom.TolerantVerifyLeak(t)
+
+	metrics := newBucketStoreMetrics(nil)
+	set := newBucketBlockSet(labels.FromStrings("cluster", "Prod", "region", "EU"))
+	set.extLabelMatcher = newExternalLabelMatcher([]string{"cluster"}, metrics.caseFoldedExtLabelMatches)
+
+	for _, c := range []struct {
+		in     *labels.Matcher
+		match  bool
+		folded bool
+	}{
+		{in: labels.MustNewMatcher(labels.MatchEqual, "cluster", "Prod"), match: true},
+		{in: labels.MustNewMatcher(labels.MatchEqual, "cluster", "prod"), match: true, folded: true},
+		{in: labels.MustNewMatcher(labels.MatchEqual, "cluster", "dev"), match: false},
+		{in: labels.MustNewMatcher(labels.MatchNotEqual, "cluster", "prod"), match: false},
+		{in: labels.MustNewMatcher(labels.MatchNotEqual, "cluster", "dev"), match: true},
+		{in: labels.MustNewMatcher(labels.MatchRegexp, "cluster", "prod|dev"), match: true, folded: true},
+		{in: labels.MustNewMatcher(labels.MatchRegexp, "cluster", "pr.*"), match: true, folded: true},
+		{in: labels.MustNewMatcher(labels.MatchNotRegexp, "cluster", "prod|dev"), match: false},
+		// Other external labels are still matched case-sensitively.
+		{in: labels.MustNewMatcher(labels.MatchEqual, "region", "eu"), match: false},
+		{in: labels.MustNewMatcher(labels.MatchEqual, "region", "EU"), match: true},
+	} {
+		t.Run(c.in.String(), func(t *testing.T) {
+			before := promtest.ToFloat64(metrics.caseFoldedExtLabelMatches.WithLabelValues(c.in.Name))
+
+			res, ok := set.labelMatchers(c.in)
+			testutil.Equals(t, c.match, ok)
+			if !ok {
+				return
+			}
+			testutil.Equals(t, 0, len(res))
+
+			set.extLabelMatcher.countCaseFolded(set.labels, c.in)
+			folded := promtest.ToFloat64(metrics.caseFoldedExtLabelMatches.WithLabelValues(c.in.Name)) - before
+			testutil.Equals(t, c.folded, folded == 1)
+		})
+	}
+}
+
 func TestGapBasedPartitioner_Partition(t *testing.T) {
 	defer custom.TolerantVerifyLeak(t)
 
@@ -1493,7 +1538,7 @@ func benchBucketSeries(t testutil.TB, sampleType chunkenc.ValueType, skipChunk,
 	f, err := block.NewRawMetaFetcher(logger, ibkt, baseBlockIDsFetcher)
 	testutil.Ok(t, err)
 
-	chunkPool, err := pool.NewBucketedPool[byte](chunkBytesPoolMinSize, chunkBytesPoolMaxSize, 2, 1e9) // 1GB.
+	chunkPool, err := pool.NewBucketedPool[byte](DefaultChunkBytesPoolMinSize, DefaultChunkBytesPoolMaxSize, 2, 1e9) // 1GB.
 	testutil.Ok(t, err)
 
 	st, err := NewBucketStore(
@@ -1635,7 +1680,7 @@ func TestBucketSeries_OneBlock_InMemIndexCacheSegfault(t *testing.T) {
 		Source:     metadata.TestSource,
 	}
 
-	chunkPool, err := pool.NewBucketedPool[byte](chunkBytesPoolMinSize, chunkBytesPoolMaxSize, 2, 100e7)
+	chunkPool, err := pool.NewBucketedPool[byte](DefaultChunkBytesPoolMinSize, DefaultChunkBytesPoolMaxSize, 2, 100e7)
 	testutil.Ok(t, err)
 
 	indexCache, err := storecache.NewInMemoryIndexCacheWithConfig(logger, nil, nil, storecache.InMemoryIndexCacheConfig{
@@ -1920,6 +1965,22 @@ func TestSeries_RequestAndResponseHints(t *testing.T) {
 	}
 
 	storetestutil.TestServerSeries(tb, store, testCases...)
+
+	// Clients sending request hints get response hints even if they are not enabled for every request.
+	store.enableSeriesResponseHints = false
+	storetestutil.TestServerSeries(tb, store, &storetestutil.SeriesCase{
+		Name: "request hints enable response hints",
+		Req: &storepb.SeriesRequest{
+			MinTime:  0,
+			MaxTime:  1,
+			Matchers: []*storepb.LabelMatcher{{Type: storepb.LabelMatcher_EQ, Name: "foo", Value: "bar"}},
+			Hints:    mustMarshalAny(&hintspb.SeriesRequestHints{}),
+		},
+		ExpectedSeries: seriesSet1,
+		ExpectedHints: []hintspb.SeriesResponseHints{
+			{QueriedBlocks: []*hintspb.Block{{Id: block1.String()}}},
+		},
+	})
 }
 
 func TestSeries_ErrorUnmarshallingRequestHints(t *testing.T) {
@@ -2113,6 +2174,135 @@ func TestSeries_BlockWithMultipleChunks(t *testing.T) {
 	}
 }
 
+// prepareStoreWithMultiChunkSeries returns a bucket store with a single block containing numSeries series
+// with numSamples samples each, spanning numSamples/MaxSamplesPerChunk chunks per series.
+func prepareStoreWithMultiChunkSeries(t testing.TB, numSeries, numSamples int, opts ...BucketStoreOption) *BucketStore {
+	tmpDir := t.TempDir()
+
+	headOpts := tsdb.DefaultHeadOptions()
+	headOpts.ChunkDirRoot = filepath.Join(tmpDir, "block")
+	headOpts.ChunkRange = 10000000000
+
+	h, err := tsdb.NewHead(nil, nil, nil, nil, headOpts, nil)
+	testutil.Ok(t, err)
+	defer func() { testutil.Ok(t, h.Close()) }()
+
+	for ts := int64(0); ts < int64(numSamples); ts++ {
+		app := h.Appender(context.Background())
+		for i := 0; i < numSeries; i++ {
+			_, err := app.Append(0, labels.FromStrings("__name__", "test", "i", strconv.Itoa(i)), ts, float64(ts))
+			testutil.Ok(t, err)
+		}
+		testutil.Ok(t, app.Commit())
+	}
+
+	blk := storetestutil.CreateBlockFromHead(t, headOpts.ChunkDirRoot, h)
+	_, err = metadata.InjectThanos(log.NewNopLogger(), filepath.Join(headOpts.ChunkDirRoot, blk.String()), metadata.Thanos{
+		Labels:     labels.FromStrings("ext1", "1").Map(),
+		Downsample: metadata.ThanosDownsample{Resolution: 0},
+		Source:     metadata.TestSource,
+	}, nil)
+	testutil.Ok(t, err)
+
+	bkt, err := filesystem.NewBucket(filepath.Join(tmpDir, "bucket"))
+	testutil.Ok(t, err)
+	t.Cleanup(func() { testutil.Ok(t, bkt.Close()) })
+
+	instrBkt := objstore.WithNoopInstr(bkt)
+	logger := log.NewNopLogger()
+	testutil.Ok(t, block.Upload(context.Background(), logger, bkt, filepath.Join(headOpts.ChunkDirRoot, blk.String()), metadata.NoneFunc))
+
+	fetcher, err := block.NewMetaFetcher(logger, 10, instrBkt, block.NewConcurrentLister(logger, instrBkt), tmpDir, nil, nil)
+	testutil.Ok(t, err)
+
+	store, err := NewBucketStore(
+		instrBkt,
+		fetcher,
+		tmpDir,
+		NewChunksLimiterFactory(0),
+		NewSeriesLimiterFactory(0),
+		NewBytesLimiterFactory(0),
+		NewGapBasedPartitioner(PartitionerMaxGapSize),
+		10,
+		false,
+		DefaultPostingOffsetInMemorySampling,
+		true,
+		false,
+		0,
+		append([]BucketStoreOption{WithLogger(logger)}, opts...)...,
+	)
+	testutil.Ok(t, err)
+	testutil.Ok(t, store.SyncBlocks(context.Background()))
+	return store
+}
+
+func TestSeries_SeriesResponseChunkBatchSize(t *testing.T) {
+	const numSamples = 10 * MaxSamplesPerChunk
+
+	req := &storepb.SeriesRequest{
+		MinTime:  math.MinInt64,
+		MaxTime:  math.MaxInt64,
+		Matchers: []*storepb.LabelMatcher{{Type: storepb.LabelMatcher_EQ, Name: "__name__", Value: "test"}},
+	}
+
+	srv := newStoreSeriesServer(context.Background())
+	testutil.Ok(t, prepareStoreWithMultiChunkSeries(t, 2, numSamples).Series(req, srv))
+	testutil.Equals(t, 2, len(srv.SeriesSet))
+	testutil.Equals(t, 10, len(srv.SeriesSet[0].Chunks))
+	expected := srv.SeriesSet
+
+	for _, tc := range []struct {
+		chunkBatchSize int
+		expectedFrames int
+	}{
+		{chunkBatchSize: 1, expectedFrames: 20},
+		{chunkBatchSize: 3, expectedFrames: 8},
+		{chunkBatchSize: 10, expectedFrames: 2},
+		{chunkBatchSize: 100, expectedFrames: 2},
+	} {
+		t.Run(fmt.Sprintf("batch=%d", tc.chunkBatchSize), func(t *testing.T) {
+			srv := newStoreSeriesServer(context.Background())
+			testutil.Ok(t, prepareStoreWithMultiChunkSeries(t, 2, numSamples, WithSeriesResponseChunkBatchSize(tc.chunkBatchSize)).Series(req, srv))
+			testutil.Equals(t, tc.expectedFrames, len(srv.SeriesSet))
+
+			// Frames of the same series are consecutive and merging them gives the unsplit response.
+			var merged []*storepb.Series
+			for _, s := range srv.SeriesSet {
+				testutil.Assert(t, len(s.Chunks) <= tc.chunkBatchSize, "frame with %d chunks", len(s.Chunks))
+				if len(merged) > 0 && labelpb.CompareLabels(merged[len(merged)-1].Labels, s.Labels) == 0 {
+					merged[len(merged)-1].Chunks = append(merged[len(merged)-1].Chunks, s.Chunks...)
+					continue
+				}
+				merged = append(merged, &storepb.Series{Labels: s.Labels, Chunks: append([]*storepb.AggrChunk(nil), s.Chunks...)})
+			}
+			testutil.Equals(t, expected, merged)
+		})
+	}
+}
+
+// BenchmarkBucketStoreSeriesResponseChunkBatchSize measures Series with different chunk batch sizes
+// for series spanning many chunks, e.g. long range queries.
+func BenchmarkBucketStoreSeriesResponseChunkBatchSize(b *testing.B) {
+	req := &storepb.SeriesRequest{
+		MinTime:  math.MinInt64,
+		MaxTime:  math.MaxInt64,
+		Matchers: []*storepb.LabelMatcher{{Type: storepb.LabelMatcher_EQ, Name: "__name__", Value: "test"}},
+	}
+
+	for _, chunkBatchSize := range []int{0, 1, 10, 100, 1000} {
+		b.Run(fmt.Sprintf("batch=%d", chunkBatchSize), func(b *testing.B) {
+			store := prepareStoreWithMultiChunkSeries(b, 10, 1000*MaxSamplesPerChunk, WithSeriesResponseChunkBatchSize(chunkBatchSize))
+
+			b.ReportAllocs()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				srv := newStoreSeriesServer(context.Background())
+				testutil.Ok(b, store.Series(req, srv))
+			}
+		})
+	}
+}
+
 func TestSeries_SeriesSortedWithoutReplicaLabels(t *testing.T) {
 	tests := map[string]struct {
 		series         [][]labels.Labels
@@ -2942,6 +3132,97 @@ func samePostingGroup(a, b *postingGroup) bool {
 	return true
 }
 
+func TestOptimizeLiteralRegexMatchers(t *testing.T) {
+	for _, tc := range []struct {
+		name     string
+		matcher  *labels.Matcher
+		expected *labels.Matcher
+	}{
+		{
+			name:     "literal regex on metric name",
+			matcher:  labels.MustNewMatcher(labels.MatchRegexp, labels.MetricName, "http_requests_total"),
+			expected: labels.MustNewMatcher(labels.MatchEqual, labels.MetricName, "http_requests_total"),
+		},
+		{
+			name:     "literal negative regex",
+			matcher:  labels.MustNewMatcher(labels.MatchNotRegexp, "job", "api"),
+			expected: labels.MustNewMatcher(labels.MatchNotEqual, "job", "api"),
+		},
+		{
+			name:     "escaped dot",
+			matcher:  labels.MustNewMatcher(labels.MatchRegexp, "a", `foo\.bar`),
+			expected: labels.MustNewMatcher(labels.MatchEqual, "a", "foo.bar"),
+		},
+		{
+			name:     "escaped star",
+			matcher:  labels.MustNewMatcher(labels.MatchRegexp, "a", `foo\*`),
+			expected: labels.MustNewMatcher(labels.MatchEqual, "a", "foo*"),
+		},
+		{
+			name:     "escaped anchors",
+			matcher:  labels.MustNewMatcher(labels.MatchRegexp, "a", `\^foo\$`),
+			expected: labels.MustNewMatcher(labels.MatchEqual, "a", "^foo$"),
+		},
+		{
+			name:     "escaped backslash",
+			matcher:  labels.MustNewMatcher(labels.MatchRegexp, "a", `foo\\bar`),
+			expected: labels.MustNewMatcher(labels.MatchEqual, "a", `foo\bar`),
+		},
+		{
+			name:    "unescaped dot",
+			matcher: labels.MustNewMatcher(labels.MatchRegexp, "a", "foo.bar"),
+		},
+		{
+			name:    "escaped dot followed by quantifier",
+			matcher: labels.MustNewMatcher(labels.MatchRegexp, "a", `foo\.+`),
+		},
+		{
+			name:    "escaped character class",
+			matcher: labels.MustNewMatcher(labels.MatchRegexp, "a", `foo\d`),
+		},
+		{
+			name:    "case insensitive",
+			matcher: labels.MustNewMatcher(labels.MatchRegexp, "a", "(?i)foo"),
+		},
+		{
+			name:    "alternation",
+			matcher: labels.MustNewMatcher(labels.MatchRegexp, "a", "foo|bar"),
+		},
+		{
+			name:    "explicit anchors",
+			matcher: labels.MustNewMatcher(labels.MatchRegexp, "a", "^foo$"),
+		},
+		{
+			name:    "empty regex",
+			matcher: labels.MustNewMatcher(labels.MatchRegexp, "a", ""),
+		},
+		{
+			name:    "equal matcher",
+			matcher: labels.MustNewMatcher(labels.MatchEqual, "a", "foo"),
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			in := []*labels.Matcher{labels.MustNewMatcher(labels.MatchEqual, "b", "c"), tc.matcher}
+			out, err := optimizeLiteralRegexMatchers(in)
+			testutil.Ok(t, err)
+			testutil.Equals(t, 2, len(out))
+			testutil.Equals(t, in[0], out[0])
+			// The input must not be modified.
+			testutil.Equals(t, tc.matcher, in[1])
+
+			expected := tc.expected
+			if expected == nil {
+				expected = tc.matcher
+			}
+			testutil.Equals(t, expected.String(), out[1].String())
+
+			for _, v := range []string{"", "foo", "bar", "foo.bar", "fooxbar", "foo*", "^foo$", `foo\bar`, "foo1", "FOO", "api", "http_requests_total"} {
+				testutil.Equals(t, tc.matcher.Matches(v), out[1].Matches(v), "value %q", v)
+			}
+		})
+	}
+}
+
 func TestMatchersToPostingGroup(t *testing.T) {
 	ctx := context.Background()
 	for _, tc := range []struct {
@@ -4041,3 +4322,497 @@ func TestBucketStoreMetadataLimit(t *testing.T) {
 		})
 	}
 }
+
+// recordingGate wraps a gate.Gate and records how many callers hold it at once.
+// Callers that acquired the gate are held until release is closed.
+type recordingGate struct {
+	gate.Gate
+	release chan struct{}
+
+	mtx         sync.Mutex
+	inflight    int
+	maxInflight int
+}
+
+func (g *recordingGate) Start(ctx context.Context) error {
+	if err := g.Gate.Start(ctx); err != nil {
+		return err
+	}
+	g.mtx.Lock()
+	g.inflight++
+	if g.inflight > g.maxInflight {
+		g.maxInflight = g.inflight
+	}
+	g.mtx.Unlock()
+
+	<-g.release
+	return nil
+}
+
+func (g *recordingGate) Done() {
+	g.mtx.Lock()
+	g.inflight--
+	g.mtx.Unlock()
+	g.Gate.Done()
+}
+
+func (g *recordingGate) current() int {
+	g.mtx.Lock()
+	defer g.mtx.Unlock()
+	return g.inflight
+}
+
+func (g *recordingGate) max() int {
+	g.mtx.Lock()
+	defer g.mtx.Unlock()
+	return g.maxInflight
+}
+
+func TestBucketStore_SyncBlocksConcurrency(t *testing.T) {
+	defer custom.TolerantVerifyLeak(t)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	logger := log.NewNopLogger()
+	dir := t.TempDir()
+
+	const numBlocks, concurrency = 8, 2
+
+	bkt := objstore.NewInMemBucket()
+	series := []labels.Labels{labels.FromStrings("a", "1", "b", "1")}
+	for i := int64(0); i < numBlocks; i++ {
+		id, err := e2eutil.CreateBlock(ctx, dir, series, 10, i*1000, (i+1)*1000, labels.FromStrings("ext", "1"), 0, metadata.NoneFunc)
+		testutil.Ok(t, err)
+		testutil.Ok(t, block.Upload(ctx, logger, bkt, filepath.Join(dir, id.String()), metadata.NoneFunc))
+	}
+
+	metaFetcher, err := block.NewMetaFetcher(logger, 20, objstore.WithNoopInstr(bkt), block.NewConcurrentLister(logger, objstore.WithNoopInstr(bkt)), dir, nil, nil)
+	testutil.Ok(t, err)
+
+	reg := prometheus.NewRegistry()
+	bucketStore, err := NewBucketStore(
+		objstore.WithNoopInstr(bkt),
+		metaFetcher,
+		filepath.Join(dir, "store"),
+		NewChunksLimiterFactory(0),
+		NewSeriesLimiterFactory(0),
+		NewBytesLimiterFactory(0),
+		NewGapBasedPartitioner(PartitionerMaxGapSize),
+		concurrency,
+		true,
+		DefaultPostingOffsetInMemorySampling,
+		false,
+		false,
+		0,
+		WithRegistry(reg),
+		WithFilterConfig(allowAllFilterConf),
+	)
+	testutil.Ok(t, err)
+	defer func() { testutil.Ok(t, bucketStore.Close()) }()
+
+	// Hold every load that acquired the block load gate, so that the remaining blocks queue up behind it.
+	loadGate := &recordingGate{Gate: bucketStore.blockLoadGate, release: make(chan struct{})}
+	bucketStore.blockLoadGate = loadGate
+
+	syncErr := make(chan error, 1)
+	go func() { syncErr <- bucketStore.SyncBlocks(ctx) }()
+
+	testutil.Ok(t, runutil.Retry(10*time.Millisecond, ctx.Done(), func() error {
+		if n := loadGate.current(); n != concurrency {
+			return fmt.Errorf("expected %d loads holding the gate, got %d", concurrency, n)
+		}
+		return nil
+	}))
+	testutil.Equals(t, float64(numBlocks), promtest.ToFloat64(bucketStore.metrics.blockLoadQueueLength))
+	bucketStore.mtx.RLock()
+	testutil.Equals(t, 0, len(bucketStore.blocks))
+	bucketStore.mtx.RUnlock()
+
+	close(loadGate.release)
+	testutil.Ok(t, <-syncErr)
+
+	testutil.Equals(t, numBlocks, len(bucketStore.blocks))
+	testutil.Equals(t, concurrency, loadGate.max())
+	testutil.Equals(t, 0.0, promtest.ToFloat64(bucketStore.metrics.blockLoadQueueLength))
+}
+
+func TestBucketStore_InMemoryRecentBlocks(t *testing.T) {
+	defer custom.TolerantVerifyLeak(t)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	logger := log.NewNopLogger()
+	dir := t.TempDir()
+
+	now := time.Now()
+	bkt := objstore.NewInMemBucket()
+	series := []labels.Labels{labels.FromStrings("a", "1", "b", "1")}
+	var ids []ulid.ULID
+	for _, age := range []time.Duration{3 * time.Hour, 30 * time.Minute, 0} {
+		maxt := now.Add(-age).UnixMilli()
+		id, err := e2eutil.CreateBlock(ctx, dir, series, 10, maxt-time.Hour.Milliseconds(), maxt, labels.FromStrings("ext", "1"), 0, metadata.NoneFunc)
+		testutil.Ok(t, err)
+		testutil.Ok(t, block.Upload(ctx, logger, bkt, filepath.Join(dir, id.String()), metadata.NoneFunc))
+		ids = append(ids, id)
+	}
+
+	metaFetcher, err := block.NewMetaFetcher(logger, 20, objstore.WithNoopInstr(bkt), block.NewConcurrentLister(logger, objstore.WithNoopInstr(bkt)), dir, nil, nil)
+	testutil.Ok(t, err)
+
+	bucketStore, err := NewBucketStore(
+		objstore.WithNoopInstr(bkt),
+		metaFetcher,
+		filepath.Join(dir, "store"),
+		NewChunksLimiterFactory(0),
+		NewSeriesLimiterFactory(0),
+		NewBytesLimiterFactory(0),
+		NewGapBasedPartitioner(PartitionerMaxGapSize),
+		20,
+		true,
+		DefaultPostingOffsetInMemorySampling,
+		false,
+		false,
+		0,
+		WithFilterConfig(allowAllFilterConf),
+		WithInMemoryRecentBlocks(time.Hour, 1<<30),
+	)
+	testutil.Ok(t, err)
+	defer func() { testutil.Ok(t, bucketStore.Close()) }()
+
+	testutil.Ok(t, bucketStore.SyncBlocks(ctx))
+	testutil.Equals(t, 3, len(bucketStore.blocks))
+	testutil.Equals(t, 2.0, promtest.ToFloat64(bucketStore.metrics.inMemoryBlocks))
+	testutil.Assert(t, promtest.ToFloat64(bucketStore.metrics.inMemoryBlocksBytes) > 0, "expected non-zero in-memory size")
+
+	// Recent blocks are served from memory even if their files disappear from the bucket.
+	recent := bucketStore.blocks[ids[2]]
+	testutil.Ok(t, bkt.Delete(ctx, recent.indexFilename()))
+	r, err := recent.bkt.GetRange(ctx, recent.indexFilename(), 0, 4)
+	testutil.Ok(t, err)
+	b, err := io.ReadAll(r)
+	testutil.Ok(t, err)
+	testutil.Ok(t, r.Close())
+	testutil.Equals(t, 4, len(b))
+
+	old := bucketStore.blocks[ids[0]]
+	_, ok := old.bkt.(*inMemoryBlockReader)
+	testutil.Assert(t, !ok, "expected old block to be read lazily")
+
+	// Once blocks age out of the window they are evicted.
+	bucketStore.inMemoryBlocks.now = func() time.Time { return now.Add(45 * time.Minute) }
+	testutil.Ok(t, bucketStore.SyncBlocks(ctx))
+	testutil.Equals(t, 1.0, promtest.ToFloat64(bucketStore.metrics.inMemoryBlocks))
+	_, err = bucketStore.blocks[ids[1]].bkt.GetRange(ctx, bucketStore.blocks[ids[1]].indexFilename(), 0, 4)
+	testutil.Ok(t, err)
+
+	bucketStore.inMemoryBlocks.now = func() time.Time { return now.Add(2 * time.Hour) }
+	testutil.Ok(t, bucketStore.SyncBlocks(ctx))
+	testutil.Equals(t, 0.0, promtest.ToFloat64(bucketStore.metrics.inMemoryBlocks))
+	testutil.Equals(t, 0.0, promtest.ToFloat64(bucketStore.metrics.inMemoryBlocksBytes))
+	_, err = recent.bkt.GetRange(ctx, recent.indexFilename(), 0, 4)
+	testutil.Assert(t, bkt.IsObjNotFoundErr(err), "expected evicted block to be read from the bucket, got %v", err)
+}
+
+func TestBucketStore_InMemoryRecentBlocksBudget(t *testing.T) {
+	defer custom.TolerantVerifyLeak(t)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	logger := log.NewNopLogger()
+	dir := t.TempDir()
+
+	now := time.Now()
+	bkt := objstore.NewInMemBucket()
+	series := []labels.Labels{labels.FromStrings("a", "1", "b", "1")}
+	for i := int64(0); i < 3; i++ {
+		maxt := now.UnixMilli() - i*1000
+		id, err := e2eutil.CreateBlock(ctx, dir, series, 10, maxt-time.Hour.Milliseconds(), maxt, labels.FromStrings("ext", "1"), 0, metadata.NoneFunc)
+		testutil.Ok(t, err)
+		testutil.Ok(t, block.Upload(ctx, logger, bkt, filepath.Join(dir, id.String()), metadata.NoneFunc))
+	}
+
+	// Size of the index and chunk files of the biggest block.
+	sizes := map[string]int64{}
+	testutil.Ok(t, bkt.Iter(ctx, "", func(name string) error {
+		if !strings.HasSuffix(name, block.IndexFilename) && !strings.Contains(name, block.ChunksDirname) {
+			return nil
+		}
+		attrs, err := bkt.Attributes(ctx, name)
+		if err != nil {
+			return err
+		}
+		sizes[strings.Split(name, "/")[0]] += attrs.Size
+		return nil
+	}, objstore.WithRecursiveIter))
+	var blockSize int64
+	for _, s := range sizes {
+		blockSize = max(blockSize, s)
+	}
+
+	metaFetcher, err := block.NewMetaFetcher(logger, 20, objstore.WithNoopInstr(bkt), block.NewConcurrentLister(logger, objstore.WithNoopInstr(bkt)), dir, nil, nil)
+	testutil.Ok(t, err)
+
+	bucketStore, err := NewBucketStore(
+		objstore.WithNoopInstr(bkt),
+		metaFetcher,
+		filepath.Join(dir, "store"),
+		NewChunksLimiterFactory(0),
+		NewSeriesLimiterFactory(0),
+		NewBytesLimiterFactory(0),
+		NewGapBasedPartitioner(PartitionerMaxGapSize),
+		20,
+		true,
+		DefaultPostingOffsetInMemorySampling,
+		false,
+		false,
+		0,
+		WithFilterConfig(allowAllFilterConf),
+		// Index and chunks of a single block fit, but not of two.
+		WithInMemoryRecentBlocks(time.Hour, blockSize),
+	)
+	testutil.Ok(t, err)
+	defer func() { testutil.Ok(t, bucketStore.Close()) }()
+
+	testutil.Ok(t, bucketStore.SyncBlocks(ctx))
+	testutil.Equals(t, 3, len(bucketStore.blocks))
+	testutil.Equals(t, 1.0, promtest.ToFloat64(bucketStore.metrics.inMemoryBlocks))
+	testutil.Assert(t, promtest.ToFloat64(bucketStore.metrics.inMemoryBlocksBytes) <= float64(blockSize), "in-memory size exceeds the budget")
+}
+
+func TestBucketStore_PostingsWarmup(t *testing.T) {
+	defer custom.TolerantVerifyLeak(t)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	logger := log.NewNopLogger()
+	dir := t.TempDir()
+
+	bkt := objstore.NewInMemBucket()
+	series := []labels.Labels{
+		labels.FromStrings("namespace", "prod", "pod", "a"),
+		labels.FromStrings("namespace", "prod", "pod", "b"),
+		labels.FromStrings("namespace", "dev", "pod", "c"),
+	}
+	id, err := e2eutil.CreateBlock(ctx, dir, series, 10, 0, 1000, labels.FromStrings("ext", "1"), 0, metadata.NoneFunc)
+	testutil.Ok(t, err)
+	testutil.Ok(t, block.Upload(ctx, logger, bkt, filepath.Join(dir, id.String()), metadata.NoneFunc))
+
+	newStore := func(maxBytes int64, selectors ...[]*labels.Matcher) (*BucketStore, storecache.IndexCache) {
+		indexCache, err := storecache.NewInMemoryIndexCacheWithConfig(logger, nil, nil, storecache.DefaultInMemoryIndexCacheConfig)
+		testutil.Ok(t, err)
+		metaFetcher, err := block.NewMetaFetcher(logger, 20, objstore.WithNoopInstr(bkt), block.NewConcurrentLister(logger, objstore.WithNoopInstr(bkt)), dir, nil, nil)
+		testutil.Ok(t, err)
+
+		bucketStore, err := NewBucketStore(
+			objstore.WithNoopInstr(bkt),
+			metaFetcher,
+			t.TempDir(),
+			NewChunksLimiterFactory(0),
+			NewSeriesLimiterFactory(0),
+			NewBytesLimiterFactory(0),
+			NewGapBasedPartitioner(PartitionerMaxGapSize),
+			20,
+			true,
+			DefaultPostingOffsetInMemorySampling,
+			false,
+			false,
+			0,
+			WithFilterConfig(allowAllFilterConf),
+			WithIndexCache(indexCache),
+			WithPostingsWarmup(selectors, maxBytes),
+		)
+		testutil.Ok(t, err)
+		t.Cleanup(func() { testutil.Ok(t, bucketStore.Close()) })
+
+		testutil.Ok(t, bucketStore.SyncBlocks(ctx))
+		testutil.Equals(t, 1, len(bucketStore.blocks))
+		return bucketStore, indexCache
+	}
+
+	prod := labels.MustNewMatcher(labels.MatchEqual, "namespace", "prod")
+	dev := labels.MustNewMatcher(labels.MatchEqual, "namespace", "dev")
+	otherExt := labels.MustNewMatcher(labels.MatchEqual, "ext", "2")
+	keys := []labels.Label{{Name: "namespace", Value: "prod"}, {Name: "namespace", Value: "dev"}}
+
+	// Postings of selectors not matching the external labels of the block are not fetched.
+	bucketStore, indexCache := newStore(0, []*labels.Matcher{prod}, []*labels.Matcher{otherExt, dev})
+	hits, misses := indexCache.FetchMultiPostings(ctx, id, keys, tenancy.DefaultTenant)
+	testutil.Equals(t, 1, len(hits))
+	testutil.Equals(t, []labels.Label{{Name: "namespace", Value: "dev"}}, misses)
+	_, ok := indexCache.FetchExpandedPostings(ctx, id, []*labels.Matcher{prod}, tenancy.DefaultTenant)
+	testutil.Assert(t, ok, "expected expanded postings of the selector to be cached")
+	testutil.Equals(t, 0.0, promtest.ToFloat64(bucketStore.metrics.postingsWarmupTruncated))
+
+	// Warm-up stops once the size limit is reached.
+	bucketStore, indexCache = newStore(1, []*labels.Matcher{prod}, []*labels.Matcher{dev})
+	hits, _ = indexCache.FetchMultiPostings(ctx, id, keys, tenancy.DefaultTenant)
+	testutil.Equals(t, 0, len(hits))
+	testutil.Equals(t, 1.0, promtest.ToFloat64(bucketStore.metrics.postingsWarmupTruncated))
+}
+
+func TestBucketStore_CorruptedIndexHeader(t *testing.T) {
+	defer custom.TolerantVerifyLeak(t)
+
+	for _, lazyReader := range []bool{false, true} {
+		t.Run(fmt.Sprintf("lazyReader=%t", lazyReader), func(t *testing.T) {
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+
+			logger := log.NewNopLogger()
+			dir := t.TempDir()
+
+			bkt := objstore.NewInMemBucket()
+			series := []labels.Labels{labels.FromStrings("a", "1", "b", "1")}
+			id, err := e2eutil.CreateBlock(ctx, dir, series, 10, 0, 1000, labels.FromStrings("ext", "1"), 0, metadata.NoneFunc)
+			testutil.Ok(t, err)
+			testutil.Ok(t, block.Upload(ctx, logger, bkt, filepath.Join(dir, id.String()), metadata.NoneFunc))
+
+			// Corrupt the postings offset table, which is copied as is into the index-header.
+			indexFile := filepath.Join(dir, id.String(), block.IndexFilename)
+			idx, err := os.ReadFile(indexFile)
+			testutil.Ok(t, err)
+			// The postings offset table offset is the last entry of the TOC, before its checksum.
+			postingsTable := binary.BigEndian.Uint64(idx[len(idx)-12:])
+			corrupted := append([]byte{}, idx...)
+			corrupted[postingsTable+5] ^= 0xff
+			testutil.Ok(t, bkt.Upload(ctx, path.Join(id.String(), block.IndexFilename), bytes.NewReader(corrupted)))
+
+			metaFetcher, err := block.NewMetaFetcher(logger, 20, objstore.WithNoopInstr(bkt), block.NewConcurrentLister(logger, objstore.WithNoopInstr(bkt)), dir, nil, nil)
+			testutil.Ok(t, err)
+
+			bucketStore, err := NewBucketStore(
+				objstore.WithNoopInstr(bkt),
+				metaFetcher,
+				filepath.Join(dir, "store"),
+				NewChunksLimiterFactory(0),
+				NewSeriesLimiterFactory(0),
+				NewBytesLimiterFactory(0),
+				NewGapBasedPartitioner(PartitionerMaxGapSize),
+				20,
+				true,
+				DefaultPostingOffsetInMemorySampling,
+				false,
+				lazyReader,
+				0,
+				WithFilterConfig(allowAllFilterConf),
+				WithCorruptedBlockRetryInterval(time.Hour),
+			)
+			testutil.Ok(t, err)
+			defer func() { testutil.Ok(t, bucketStore.Close()) }()
+
+			testutil.Ok(t, bucketStore.SyncBlocks(ctx))
+			if lazyReader {
+				// The index-header is only parsed by the first request using it.
+				testutil.Equals(t, 1, len(bucketStore.blocks))
+				_, err := bucketStore.LabelNames(ctx, &storepb.LabelNamesRequest{Start: 0, End: 1000})
+				testutil.NotOk(t, err)
+				testutil.Assert(t, strings.Contains(err.Error(), "corrupted index-header"), "unexpected error %v", err)
+				// The block is removed in the background.
+				testutil.Ok(t, runutil.Retry(10*time.Millisecond, ctx.Done(), func() error {
+					if bucketStore.getBlock(id) != nil {
+						return fmt.Errorf("block %s not removed yet", id)
+					}
+					return nil
+				}))
+			}
+			testutil.Equals(t, 0, len(bucketStore.blocks))
+			testutil.Equals(t, 1.0, promtest.ToFloat64(bucketStore.metrics.blocksSkipped))
+			testutil.Equals(t, 1.0, promtest.ToFloat64(bucketStore.metrics.blockLoads))
+
+			// Skipped blocks are not loaded again until the retry interval elapses.
+			testutil.Ok(t, bucketStore.SyncBlocks(ctx))
+			testutil.Equals(t, 1.0, promtest.ToFloat64(bucketStore.metrics.blockLoads))
+
+			// Once the corruption is gone, the block is loaded on the next retry.
+			testutil.Ok(t, bkt.Upload(ctx, path.Join(id.String(), block.IndexFilename), bytes.NewReader(idx)))
+			bucketStore.skippedBlocks[id] = time.Now()
+			testutil.Ok(t, bucketStore.SyncBlocks(ctx))
+			testutil.Equals(t, 1, len(bucketStore.blocks))
+			testutil.Equals(t, 0.0, promtest.ToFloat64(bucketStore.metrics.blocksSkipped))
+			testutil.Equals(t, 2.0, promtest.ToFloat64(bucketStore.metrics.blockLoads))
+			_, err = bucketStore.LabelNames(ctx, &storepb.LabelNamesRequest{Start: 0, End: 1000})
+			testutil.Ok(t, err)
+		})
+	}
+}
+
+func TestBucketStore_BlocksMemory(t *testing.T) {
+	defer custom.TolerantVerifyLeak(t)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	logger := log.NewNopLogger()
+	dir := t.TempDir()
+
+	bkt := objstore.NewInMemBucket()
+	var ids []ulid.ULID
+	for _, numSeries := range []int{1, 100} {
+		var series []labels.Labels
+		for i := 0; i < numSeries; i++ {
+			series = append(series, labels.FromStrings("a", strconv.Itoa(i)))
+		}
+		id, err := e2eutil.CreateBlock(ctx, dir, series, 10, 0, 1000, labels.FromStrings("ext", "1"), 0, metadata.NoneFunc)
+		testutil.Ok(t, err)
+		testutil.Ok(t, block.Upload(ctx, logger, bkt, filepath.Join(dir, id.String()), metadata.NoneFunc))
+		ids = append(ids, id)
+	}
+
+	metaFetcher, err := block.NewMetaFetcher(logger, 20, objstore.WithNoopInstr(bkt), block.NewConcurrentLister(logger, objstore.WithNoopInstr(bkt)), dir, nil, nil)
+	testutil.Ok(t, err)
+	indexCache, err := storecache.NewInMemoryIndexCacheWithConfig(logger, nil, nil, storecache.DefaultInMemoryIndexCacheConfig)
+	testutil.Ok(t, err)
+
+	bucketStore, err := NewBucketStore(
+		objstore.WithNoopInstr(bkt),
+		metaFetcher,
+		filepath.Join(dir, "store"),
+		NewChunksLimiterFactory(0),
+		NewSeriesLimiterFactory(0),
+		NewBytesLimiterFactory(0),
+		NewGapBasedPartitioner(PartitionerMaxGapSize),
+		20,
+		true,
+		DefaultPostingOffsetInMemorySampling,
+		false,
+		false,
+		0,
+		WithFilterConfig(allowAllFilterConf),
+		WithIndexCache(indexCache),
+	)
+	testutil.Ok(t, err)
+	defer func() { testutil.Ok(t, bucketStore.Close()) }()
+	testutil.Ok(t, bucketStore.SyncBlocks(ctx))
+
+	srv := newStoreSeriesServer(ctx)
+	testutil.Ok(t, bucketStore.Series(&storepb.SeriesRequest{
+		MinTime:  0,
+		MaxTime:  1000,
+		Matchers: []*storepb.LabelMatcher{{Type: storepb.LabelMatcher_RE, Name: "a", Value: ".+"}},
+	}, srv))
+	// The series of the small block is also in the large one.
+	testutil.Equals(t, 100, len(srv.SeriesSet))
+
+	rec := httptest.NewRecorder()
+	bucketStore.BlocksMemoryHandler().ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/debug/blocks", nil))
+	testutil.Equals(t, http.StatusOK, rec.Code)
+
+	var got []BlockMemory
+	testutil.Ok(t, json.Unmarshal(rec.Body.Bytes(), &got))
+	testutil.Equals(t, 2, len(got))
+	// The block with more series has the larger footprint and comes first.
+	testutil.Equals(t, ids[1], got[0].ID)
+	testutil.Equals(t, ids[0], got[1].ID)
+	for _, b := range got {
+		testutil.Assert(t, b.IndexHeaderMappedBytes > 0, "expected mapped index-header for block %s", b.ID)
+		testutil.Assert(t, b.CachedPostingsBytes != nil && *b.CachedPostingsBytes > 0, "expected cached postings for block %s", b.ID)
+		testutil.Assert(t, b.CachedSeriesBytes != nil && *b.CachedSeriesBytes > 0, "expected cached series for block %s", b.ID)
+		// Chunk buffers are released once the request is done.
+		testutil.Equals(t, int64(0), b.PinnedChunksBytes)
+		testutil.Equals(t, b.IndexHeaderMappedBytes+b.IndexHeaderTablesBytes+*b.CachedPostingsBytes+*b.CachedSeriesBytes, b.TotalBytes)
+	}
+}
@@ -62,6 +62,21 @@ type IndexCache interface {
 	FetchMultiSeries(ctx context.Context, blockID ulid.ULID, ids []storage.SeriesRef, tenant string) (hits map[storage.SeriesRef][]byte, misses []storage.SeriesRef)
 }
 
+// BlockSizer is implemented by index caches able to report the size of the items they hold for a block.
+type BlockSizer interface {
+	// BlockSize returns the size in bytes of the postings, including expanded postings, and of the series cached
+	// for the block. ok is false if the size is unknown, e.g. for remote caches.
+	BlockSize(blockID ulid.ULID) (postings, series uint64, ok bool)
+}
+
+// CachedBlockSize returns the size of the items cached for the block if the cache is a BlockSizer.
+func CachedBlockSize(c IndexCache, blockID ulid.ULID) (postings, series uint64, ok bool) {
+	if s, isSizer := c.(BlockSizer); isSizer {
+		return s.BlockSize(blockID)
+	}
+	return 0, 0, false
+}
+
 // Common metrics that should be used by all cache implementations.
 type CommonMetrics struct {
 	RequestTotal  *prometheus.CounterVec
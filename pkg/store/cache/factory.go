@@ -61,7 +61,11 @@ func NewIndexCache(logger log.Logger, confContentYaml []byte, reg prometheus.Reg
 		cache, err = NewInMemoryIndexCache(logger, cacheMetrics, reg, backendConfig)
 	case string(MEMCACHED):
 		var memcached cacheutil.RemoteCacheClient
-		memcached, err = cacheutil.NewMemcachedClient(logger, "index-cache", backendConfig, reg)
+		if cacheutil.IsShardedMemcachedClientConfig(backendConfig) {
+			memcached, err = cacheutil.NewShardedMemcachedClient(logger, "index-cache", backendConfig, reg)
+		} else {
+			memcached, err = cacheutil.NewMemcachedClient(logger, "index-cache", backendConfig, reg)
+		}
 		if err == nil {
 			cache, err = NewRemoteIndexCache(logger, memcached, cacheMetrics, reg, cacheConfig.TTL)
 		}
@@ -78,6 +78,11 @@ func (c *FilteredIndexCache) FetchMultiSeries(ctx context.Context, blockID ulid.
 	return nil, ids
 }
 
+// BlockSize implements BlockSizer if the wrapped cache does.
+func (c *FilteredIndexCache) BlockSize(blockID ulid.ULID) (postings, series uint64, ok bool) {
+	return CachedBlockSize(c.cache, blockID)
+}
+
 func ValidateEnabledItems(enabledItems []string) error {
 	for _, item := range enabledItems {
 		switch item {
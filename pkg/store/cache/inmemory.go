@@ -46,6 +46,8 @@ type InMemoryIndexCache struct {
 	maxItemSizeBytes uint64
 
 	curSize uint64
+	// blockSizes is the size of the items, including their keys, of each block.
+	blockSizes map[string]*cachedBlockSize
 
 	evicted          *prometheus.CounterVec
 	added            *prometheus.CounterVec
@@ -102,6 +104,7 @@ func NewInMemoryIndexCacheWithConfig(logger log.Logger, commonMetrics *CommonMet
 		maxSizeBytes:     uint64(config.MaxSize),
 		maxItemSizeBytes: uint64(config.MaxItemSize),
 		commonMetrics:    commonMetrics,
+		blockSizes:       map[string]*cachedBlockSize{},
 	}
 
 	c.evicted = promauto.With(reg).NewCounterVec(prometheus.CounterOpts{
@@ -200,6 +203,11 @@ func (c *InMemoryIndexCache) onEvict(key CacheKey, val []byte) {
 	c.totalCurrentSize.WithLabelValues(k).Sub(float64(entrySize + key.Size()))
 
 	c.curSize -= entrySize
+	bs := c.blockSizeOf(key)
+	bs.add(k, -int64(entrySize+key.Size()))
+	if bs.postings <= 0 && bs.series <= 0 {
+		delete(c.blockSizes, key.Block)
+	}
 }
 
 func (c *InMemoryIndexCache) get(key CacheKey) ([]byte, bool) {
@@ -239,6 +247,41 @@ func (c *InMemoryIndexCache) set(typ string, key CacheKey, val []byte) {
 	c.totalCurrentSize.WithLabelValues(typ).Add(float64(size + key.Size()))
 	c.current.WithLabelValues(typ).Inc()
 	c.curSize += size
+	c.blockSizeOf(key).add(typ, int64(size+key.Size()))
+}
+
+type cachedBlockSize struct {
+	postings, series int64
+}
+
+func (s *cachedBlockSize) add(typ string, size int64) {
+	if typ == CacheTypeSeries {
+		s.series += size
+	} else {
+		s.postings += size
+	}
+}
+
+// blockSizeOf returns the size of the items of the block of the key.
+func (c *InMemoryIndexCache) blockSizeOf(key CacheKey) *cachedBlockSize {
+	bs, ok := c.blockSizes[key.Block]
+	if !ok {
+		bs = &cachedBlockSize{}
+		c.blockSizes[key.Block] = bs
+	}
+	return bs
+}
+
+// BlockSize implements BlockSizer.
+func (c *InMemoryIndexCache) BlockSize(blockID ulid.ULID) (postings, series uint64, ok bool) {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+
+	bs, found := c.blockSizes[blockID.String()]
+	if !found {
+		return 0, 0, true
+	}
+	return uint64(bs.postings), uint64(bs.series), true
 }
 
 // ensureFits tries to make sure that the passed slice will fit into the LRU cache.
@@ -278,6 +321,7 @@ func (c *InMemoryIndexCache) reset() {
 	c.currentSize.Reset()
 	c.totalCurrentSize.Reset()
 	c.curSize = 0
+	c.blockSizes = map[string]*cachedBlockSize{}
 }
 
 func copyString(s string) string {
@@ -239,6 +239,38 @@ func TestInMemoryIndexCache_MaxNumberOfItemsHit(t *testing.T) {
 	testutil.Equals(t, float64(0), promtest.ToFloat64(cache.commonMetrics.HitsTotal.WithLabelValues(CacheTypeSeries, tenancy.DefaultTenant)))
 }
 
+func TestInMemoryIndexCache_BlockSize(t *testing.T) {
+	cache, err := NewInMemoryIndexCacheWithConfig(log.NewNopLogger(), nil, nil, InMemoryIndexCacheConfig{
+		MaxItemSize: 1024,
+		MaxSize:     1024,
+	})
+	testutil.Ok(t, err)
+
+	id1, id2 := ulid.MustNew(1, nil), ulid.MustNew(2, nil)
+	lbl := labels.Label{Name: "test", Value: "123"}
+	cache.StorePostings(id1, lbl, []byte{42, 33}, tenancy.DefaultTenant)
+	cache.StoreExpandedPostings(id1, []*labels.Matcher{labels.MustNewMatcher(labels.MatchEqual, "a", "b")}, []byte{1}, tenancy.DefaultTenant)
+	cache.StoreSeries(id1, 1, []byte{1, 2, 3}, tenancy.DefaultTenant)
+
+	postings, series, ok := CachedBlockSize(NewTracingIndexCache("test", NewFilteredIndexCache(cache, nil)), id1)
+	testutil.Assert(t, ok)
+	postingsKey := CacheKey{Block: id1.String(), Key: CacheKeyPostings(lbl)}
+	expandedKey := CacheKey{Block: id1.String(), Key: CacheKeyExpandedPostings(LabelMatchersToString([]*labels.Matcher{labels.MustNewMatcher(labels.MatchEqual, "a", "b")}))}
+	seriesKey := CacheKey{Block: id1.String(), Key: CacheKeySeries(1)}
+	testutil.Equals(t, 2*sliceHeaderSize+3+postingsKey.Size()+expandedKey.Size(), postings)
+	testutil.Equals(t, sliceHeaderSize+3+seriesKey.Size(), series)
+
+	postings, series, ok = cache.BlockSize(id2)
+	testutil.Assert(t, ok)
+	testutil.Equals(t, uint64(0), postings+series)
+
+	// Evicted items are not accounted for anymore.
+	cache.reset()
+	postings, series, _ = cache.BlockSize(id1)
+	testutil.Equals(t, uint64(0), postings+series)
+	testutil.Equals(t, 0, len(cache.blockSizes))
+}
+
 func TestInMemoryIndexCache_Eviction_WithMetrics(t *testing.T) {
 	metrics := prometheus.NewRegistry()
 	cache, err := NewInMemoryIndexCacheWithConfig(log.NewNopLogger(), nil, metrics, InMemoryIndexCacheConfig{
@@ -90,3 +90,8 @@ func (c *TracingIndexCache) FetchMultiSeries(ctx context.Context, blockID ulid.U
 	span.SetTag("bytes", dataBytes)
 	return hits, misses
 }
+
+// BlockSize implements BlockSizer if the wrapped cache does.
+func (c *TracingIndexCache) BlockSize(blockID ulid.ULID) (postings, series uint64, ok bool) {
+	return CachedBlockSize(c.cache, blockID)
+}
@@ -0,0 +1,442 @@
+// Copyright (c) The Thanos Authors.
+// Licensed under the Apache License 2.0.
+
+package store
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/binary"
+	"io"
+	"strings"
+	"time"
+
+	"github.com/go-kit/log"
+	"github.com/go-kit/log/level"
+	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"golang.org/x/crypto/blake2b"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/protobuf/proto"
+	"gopkg.in/yaml.v2"
+
+	"github.com/thanos-io/thanos/pkg/cache"
+	"github.com/thanos-io/thanos/pkg/cacheutil"
+	"github.com/thanos-io/thanos/pkg/model"
+	storecache "github.com/thanos-io/thanos/pkg/store/cache"
+	"github.com/thanos-io/thanos/pkg/store/storepb"
+	"github.com/thanos-io/thanos/pkg/tenancy"
+)
+
+const (
+	cachingStoreOpSeries      = "series"
+	cachingStoreOpLabelNames  = "label_names"
+	cachingStoreOpLabelValues = "label_values"
+)
+
+type cachingStoreMetrics struct {
+	requests *prometheus.CounterVec
+	hits     *prometheus.CounterVec
+	skipped  *prometheus.CounterVec
+}
+
+func newCachingStoreMetrics(reg prometheus.Registerer) *cachingStoreMetrics {
+	m := &cachingStoreMetrics{
+		requests: promauto.With(reg).NewCounterVec(prometheus.CounterOpts{
+			Name: "thanos_caching_store_requests_total",
+			Help: "Total number of StoreAPI requests handled by the caching store.",
+		}, []string{"operation"}),
+		hits: promauto.With(reg).NewCounterVec(prometheus.CounterOpts{
+			Name: "thanos_caching_store_hits_total",
+			Help: "Total number of StoreAPI requests served from the cache.",
+		}, []string{"operation"}),
+		skipped: promauto.With(reg).NewCounterVec(prometheus.CounterOpts{
+			Name: "thanos_caching_store_skipped_total",
+			Help: "Total number of remote responses which were not cached, either because they were partial or too large.",
+		}, []string{"operation"}),
+	}
+	for _, op := range []string{cachingStoreOpSeries, cachingStoreOpLabelNames, cachingStoreOpLabelValues} {
+		m.requests.WithLabelValues(op)
+		m.hits.WithLabelValues(op)
+		m.skipped.WithLabelValues(op)
+	}
+	return m
+}
+
+// CachingStore implements the StoreAPI in front of a remote StoreAPI, caching its complete responses.
+// It is meant for setups where the remote StoreAPI is behind a slow link and the same data is queried repeatedly.
+//
+// Responses are cached per tenant and per request, so the key covers matchers, time range and every
+// other request field. Partial response strategy is passed to the remote as is, but it is not part of
+// the key: responses carrying warnings are partial and therefore never cached, so a cached response is
+// valid for both strategies.
+type CachingStore struct {
+	storepb.UnimplementedStoreServer
+
+	logger      log.Logger
+	remote      storepb.StoreClient
+	cache       cache.Cache
+	ttl         time.Duration
+	maxItemSize int
+	metrics     *cachingStoreMetrics
+	// name is part of the cache keys, so that CachingStores of different remotes can share a cache.
+	name string
+}
+
+// NewCachingStore returns a CachingStore serving requests from remote and caching responses in c for ttl.
+// Series responses bigger than maxItemSize bytes are not cached. Zero means no limit.
+func NewCachingStore(logger log.Logger, reg prometheus.Registerer, remote storepb.StoreClient, c cache.Cache, ttl time.Duration, maxItemSize int) *CachingStore {
+	if logger == nil {
+		logger = log.NewNopLogger()
+	}
+	return &CachingStore{
+		logger:      logger,
+		remote:      remote,
+		cache:       c,
+		ttl:         ttl,
+		maxItemSize: maxItemSize,
+		metrics:     newCachingStoreMetrics(reg),
+	}
+}
+
+// CachingStoreConfig is the configuration of the cache of the responses of remote StoreAPIs.
+type CachingStoreConfig struct {
+	Type          storecache.BucketCacheProvider `yaml:"type"`
+	BackendConfig interface{}                    `yaml:"config"`
+
+	// TTL of cached responses.
+	TTL time.Duration `yaml:"ttl"`
+	// Maximum size of a cached series response. Zero means no limit.
+	MaxItemSize model.Bytes `yaml:"max_item_size"`
+}
+
+// CachingClients wraps the clients of selected remote StoreAPIs with CachingStores sharing one cache.
+type CachingClients struct {
+	logger      log.Logger
+	cache       cache.Cache
+	ttl         time.Duration
+	maxItemSize int
+	metrics     *cachingStoreMetrics
+	addrs       map[string]struct{}
+}
+
+// NewCachingClientsFromYaml returns CachingClients caching the responses of the StoreAPIs with the given addresses,
+// in the cache configured by the given YAML content.
+func NewCachingClientsFromYaml(yamlContent []byte, addrs []string, logger log.Logger, reg prometheus.Registerer) (*CachingClients, error) {
+	level.Info(logger).Log("msg", "loading caching store configuration")
+
+	config := &CachingStoreConfig{TTL: 10 * time.Minute, MaxItemSize: 1024 * 1024}
+	if err := yaml.UnmarshalStrict(yamlContent, config); err != nil {
+		return nil, errors.Wrap(err, "parsing config YAML file")
+	}
+	backendConfig, err := yaml.Marshal(config.BackendConfig)
+	if err != nil {
+		return nil, errors.Wrap(err, "marshal content of cache backend configuration")
+	}
+
+	var c cache.Cache
+	switch strings.ToUpper(string(config.Type)) {
+	case string(storecache.MemcachedBucketCacheProvider):
+		memcached, err := cacheutil.NewMemcachedClient(logger, "caching-store", backendConfig, reg)
+		if err != nil {
+			return nil, errors.Wrap(err, "failed to create memcached client")
+		}
+		c = cache.NewMemcachedCache("caching-store", logger, memcached, reg)
+	case string(storecache.InMemoryBucketCacheProvider):
+		c, err = cache.NewInMemoryCache("caching-store", logger, reg, backendConfig)
+		if err != nil {
+			return nil, errors.Wrap(err, "failed to create inmemory cache")
+		}
+	case string(storecache.RedisBucketCacheProvider):
+		redisCache, err := cacheutil.NewRedisClient(logger, "caching-store", backendConfig, reg)
+		if err != nil {
+			return nil, errors.Wrap(err, "failed to create redis client")
+		}
+		c = cache.NewRedisCache("caching-store", logger, redisCache, reg)
+	default:
+		return nil, errors.Errorf("unsupported cache type: %s", config.Type)
+	}
+
+	return NewCachingClients(logger, reg, cache.NewTracingCache(c), config.TTL, int(config.MaxItemSize), addrs), nil
+}
+
+// NewCachingClients returns CachingClients caching the responses of the StoreAPIs with the given addresses in c for ttl.
+// Series responses bigger than maxItemSize bytes are not cached. Zero means no limit.
+func NewCachingClients(logger log.Logger, reg prometheus.Registerer, c cache.Cache, ttl time.Duration, maxItemSize int, addrs []string) *CachingClients {
+	if logger == nil {
+		logger = log.NewNopLogger()
+	}
+	cc := &CachingClients{
+		logger:      logger,
+		cache:       c,
+		ttl:         ttl,
+		maxItemSize: maxItemSize,
+		metrics:     newCachingStoreMetrics(reg),
+		addrs:       make(map[string]struct{}, len(addrs)),
+	}
+	for _, addr := range addrs {
+		cc.addrs[addr] = struct{}{}
+	}
+	return cc
+}
+
+// Wrap returns a function returning the clients returned by getClients, with the clients of the configured
+// addresses serving their requests through a CachingStore. A nil CachingClients returns getClients as is.
+func (c *CachingClients) Wrap(getClients func() []Client) func() []Client {
+	if c == nil {
+		return getClients
+	}
+	return func() []Client {
+		clients := getClients()
+		wrapped := make([]Client, 0, len(clients))
+		for _, cl := range clients {
+			addr, isLocal := cl.Addr()
+			if _, ok := c.addrs[addr]; !ok || isLocal {
+				wrapped = append(wrapped, cl)
+				continue
+			}
+			wrapped = append(wrapped, &cachingClient{
+				Client: cl,
+				cached: storepb.ServerAsClient(&CachingStore{
+					logger:      log.With(c.logger, "store", addr),
+					remote:      cl,
+					cache:       c.cache,
+					ttl:         c.ttl,
+					maxItemSize: c.maxItemSize,
+					metrics:     c.metrics,
+					name:        addr,
+				}),
+			})
+		}
+		return wrapped
+	}
+}
+
+// cachingClient is a Client whose StoreAPI requests are served by a CachingStore in front of it.
+type cachingClient struct {
+	Client
+	cached storepb.StoreClient
+}
+
+func (c *cachingClient) Series(ctx context.Context, in *storepb.SeriesRequest, opts ...grpc.CallOption) (storepb.Store_SeriesClient, error) {
+	return c.cached.Series(ctx, in, opts...)
+}
+
+func (c *cachingClient) LabelNames(ctx context.Context, in *storepb.LabelNamesRequest, opts ...grpc.CallOption) (*storepb.LabelNamesResponse, error) {
+	return c.cached.LabelNames(ctx, in, opts...)
+}
+
+func (c *cachingClient) LabelValues(ctx context.Context, in *storepb.LabelValuesRequest, opts ...grpc.CallOption) (*storepb.LabelValuesResponse, error) {
+	return c.cached.LabelValues(ctx, in, opts...)
+}
+
+// Series returns all series for a requested time range and label matcher, either from the cache or from the remote StoreAPI.
+func (s *CachingStore) Series(r *storepb.SeriesRequest, srv storepb.Store_SeriesServer) error {
+	ctx, tenant := remoteContext(srv.Context())
+	s.metrics.requests.WithLabelValues(cachingStoreOpSeries).Inc()
+
+	normalized := proto.Clone(r).(*storepb.SeriesRequest)
+	normalized.PartialResponseDisabled = false
+	normalized.PartialResponseStrategy = storepb.PartialResponseStrategy_WARN
+	key, err := cachingStoreKey(cachingStoreOpSeries, s.name, tenant, normalized)
+	if err != nil {
+		return err
+	}
+
+	if data, ok := s.cache.Fetch(ctx, []string{key})[key]; ok {
+		resps, err := decodeSeriesResponses(data)
+		if err == nil {
+			s.metrics.hits.WithLabelValues(cachingStoreOpSeries).Inc()
+			for _, resp := range resps {
+				if err := srv.Send(resp); err != nil {
+					return err
+				}
+			}
+			return nil
+		}
+		level.Warn(s.logger).Log("msg", "failed to decode cached series response", "key", key, "err", err)
+	}
+
+	stream, err := s.remote.Series(ctx, r)
+	if err != nil {
+		return err
+	}
+
+	var (
+		buf       []byte
+		cacheable = true
+	)
+	for {
+		resp, err := stream.Recv()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		if resp.GetWarning() != "" {
+			cacheable = false
+		}
+		if cacheable {
+			if buf, err = appendSeriesResponse(buf, resp); err != nil {
+				return errors.Wrap(err, "encode series response")
+			}
+			if s.maxItemSize > 0 && len(buf) > s.maxItemSize {
+				cacheable = false
+				buf = nil
+			}
+		}
+		if err := srv.Send(resp); err != nil {
+			return err
+		}
+	}
+
+	if !cacheable {
+		s.metrics.skipped.WithLabelValues(cachingStoreOpSeries).Inc()
+		return nil
+	}
+	// Store an explicit empty entry, so that empty results are cached too.
+	if buf == nil {
+		buf = []byte{}
+	}
+	s.cache.Store(map[string][]byte{key: buf}, s.ttl)
+	return nil
+}
+
+// LabelNames returns all known label names constrained with the given matchers, either from the cache or from the remote StoreAPI.
+func (s *CachingStore) LabelNames(ctx context.Context, r *storepb.LabelNamesRequest) (*storepb.LabelNamesResponse, error) {
+	ctx, tenant := remoteContext(ctx)
+	s.metrics.requests.WithLabelValues(cachingStoreOpLabelNames).Inc()
+
+	normalized := proto.Clone(r).(*storepb.LabelNamesRequest)
+	normalized.PartialResponseDisabled = false
+	normalized.PartialResponseStrategy = storepb.PartialResponseStrategy_WARN
+	key, err := cachingStoreKey(cachingStoreOpLabelNames, s.name, tenant, normalized)
+	if err != nil {
+		return nil, err
+	}
+
+	resp := &storepb.LabelNamesResponse{}
+	if s.fetch(ctx, cachingStoreOpLabelNames, key, resp) {
+		return resp, nil
+	}
+
+	resp, err = s.remote.LabelNames(ctx, r)
+	if err != nil {
+		return nil, err
+	}
+	s.store(cachingStoreOpLabelNames, key, resp, len(resp.Warnings) > 0)
+	return resp, nil
+}
+
+// LabelValues returns all known label values for a given label name, either from the cache or from the remote StoreAPI.
+func (s *CachingStore) LabelValues(ctx context.Context, r *storepb.LabelValuesRequest) (*storepb.LabelValuesResponse, error) {
+	ctx, tenant := remoteContext(ctx)
+	s.metrics.requests.WithLabelValues(cachingStoreOpLabelValues).Inc()
+
+	normalized := proto.Clone(r).(*storepb.LabelValuesRequest)
+	normalized.PartialResponseDisabled = false
+	normalized.PartialResponseStrategy = storepb.PartialResponseStrategy_WARN
+	key, err := cachingStoreKey(cachingStoreOpLabelValues, s.name, tenant, normalized)
+	if err != nil {
+		return nil, err
+	}
+
+	resp := &storepb.LabelValuesResponse{}
+	if s.fetch(ctx, cachingStoreOpLabelValues, key, resp) {
+		return resp, nil
+	}
+
+	resp, err = s.remote.LabelValues(ctx, r)
+	if err != nil {
+		return nil, err
+	}
+	s.store(cachingStoreOpLabelValues, key, resp, len(resp.Warnings) > 0)
+	return resp, nil
+}
+
+// fetch looks up key in the cache and unmarshals it into resp. It returns false on a miss.
+func (s *CachingStore) fetch(ctx context.Context, op, key string, resp proto.Message) bool {
+	data, ok := s.cache.Fetch(ctx, []string{key})[key]
+	if !ok {
+		return false
+	}
+	if err := proto.Unmarshal(data, resp); err != nil {
+		level.Warn(s.logger).Log("msg", "failed to decode cached response", "key", key, "err", err)
+		return false
+	}
+	s.metrics.hits.WithLabelValues(op).Inc()
+	return true
+}
+
+// store caches resp under key unless it is partial or too large.
+func (s *CachingStore) store(op, key string, resp proto.Message, partial bool) {
+	if partial {
+		s.metrics.skipped.WithLabelValues(op).Inc()
+		return
+	}
+	data, err := proto.Marshal(resp)
+	if err != nil {
+		level.Warn(s.logger).Log("msg", "failed to encode response for caching", "key", key, "err", err)
+		return
+	}
+	if s.maxItemSize > 0 && len(data) > s.maxItemSize {
+		s.metrics.skipped.WithLabelValues(op).Inc()
+		return
+	}
+	s.cache.Store(map[string][]byte{key: data}, s.ttl)
+}
+
+// remoteContext returns the context to use for calling the remote StoreAPI, carrying the tenant of the incoming request.
+func remoteContext(ctx context.Context) (context.Context, string) {
+	tenant, foundTenant := tenancy.GetTenantFromGRPCMetadata(ctx)
+	if !foundTenant {
+		if ctx.Value(tenancy.TenantKey) != nil {
+			tenant = ctx.Value(tenancy.TenantKey).(string)
+		}
+	}
+	return metadata.AppendToOutgoingContext(ctx, tenancy.DefaultTenantHeader, tenant), tenant
+}
+
+// cachingStoreKey returns the cache key of the given request to the named remote. The request is hashed as a whole,
+// so that matchers, time range, hints and any other field influencing the response are covered.
+func cachingStoreKey(op, name, tenant string, r proto.Message) (string, error) {
+	data, err := proto.MarshalOptions{Deterministic: true}.Marshal(r)
+	if err != nil {
+		return "", errors.Wrap(err, "marshal request")
+	}
+	// Use cryptographically hash functions to avoid hash collisions
+	// which would end up in wrong query results.
+	hash := blake2b.Sum256(data)
+	return "CS:" + op + ":" + name + ":" + tenant + ":" + base64.RawURLEncoding.EncodeToString(hash[0:]), nil
+}
+
+// appendSeriesResponse appends the length prefixed encoding of resp to buf.
+func appendSeriesResponse(buf []byte, resp *storepb.SeriesResponse) ([]byte, error) {
+	data, err := resp.MarshalVT()
+	if err != nil {
+		return buf, err
+	}
+	buf = binary.AppendUvarint(buf, uint64(len(data)))
+	return append(buf, data...), nil
+}
+
+// decodeSeriesResponses decodes series responses encoded with appendSeriesResponse.
+func decodeSeriesResponses(buf []byte) ([]*storepb.SeriesResponse, error) {
+	var resps []*storepb.SeriesResponse
+	for len(buf) > 0 {
+		l, n := binary.Uvarint(buf)
+		if n <= 0 || uint64(len(buf)-n) < l {
+			return nil, errors.New("corrupted series response")
+		}
+		resp := &storepb.SeriesResponse{}
+		if err := resp.UnmarshalVT(buf[n : n+int(l)]); err != nil {
+			return nil, err
+		}
+		resps = append(resps, resp)
+		buf = buf[n+int(l):]
+	}
+	return resps, nil
+}
@@ -0,0 +1,226 @@
+// Copyright (c) The Thanos Authors.
+// Licensed under the Apache License 2.0.
+
+package store
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/go-kit/log"
+	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus"
+	promtest "github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/prometheus/prometheus/model/labels"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/protobuf/proto"
+
+	"github.com/efficientgo/core/testutil"
+
+	"github.com/thanos-io/thanos/pkg/cache"
+	"github.com/thanos-io/thanos/pkg/component"
+	"github.com/thanos-io/thanos/pkg/store/storepb"
+	storetestutil "github.com/thanos-io/thanos/pkg/store/storepb/testutil"
+	"github.com/thanos-io/thanos/pkg/tenancy"
+)
+
+func newTestCachingStore(t *testing.T, remote storepb.StoreClient) *CachingStore {
+	t.Helper()
+
+	c, err := cache.NewInMemoryCacheWithConfig("test", log.NewNopLogger(), nil, cache.InMemoryCacheConfig{
+		MaxSize:     10 * 1024 * 1024,
+		MaxItemSize: 1024 * 1024,
+	})
+	testutil.Ok(t, err)
+	return NewCachingStore(log.NewNopLogger(), prometheus.NewRegistry(), remote, c, time.Hour, 0)
+}
+
+func TestCachingStore_Series(t *testing.T) {
+	remote := &mockedStoreAPI{
+		RespSeries: []*storepb.SeriesResponse{
+			storeSeriesResponse(t, labels.FromStrings("a", "1"), []sample{{0, 0}, {2, 1}, {3, 2}}),
+			storeSeriesResponse(t, labels.FromStrings("a", "2"), []sample{{0, 3}, {2, 4}}),
+		},
+	}
+	s := newTestCachingStore(t, remote)
+
+	req := &storepb.SeriesRequest{
+		MinTime:                 0,
+		MaxTime:                 10,
+		Matchers:                []*storepb.LabelMatcher{{Type: storepb.LabelMatcher_RE, Name: "a", Value: ".+"}},
+		PartialResponseStrategy: storepb.PartialResponseStrategy_ABORT,
+	}
+
+	series := func(ctx context.Context, req *storepb.SeriesRequest) *storetestutil.SeriesServer {
+		srv := storetestutil.NewSeriesServer(ctx)
+		testutil.Ok(t, s.Series(req, srv))
+		return srv
+	}
+
+	first := series(context.Background(), req)
+	testutil.Equals(t, 2, len(first.SeriesSet))
+	testutil.Equals(t, storepb.PartialResponseStrategy_ABORT, remote.LastSeriesReq.PartialResponseStrategy)
+
+	t.Run("same request is served from cache regardless of partial response strategy", func(t *testing.T) {
+		remote.LastSeriesReq = nil
+		cached := proto.Clone(req).(*storepb.SeriesRequest)
+		cached.PartialResponseStrategy = storepb.PartialResponseStrategy_WARN
+
+		srv := series(context.Background(), cached)
+		testutil.Assert(t, remote.LastSeriesReq == nil, "expected request to be served from cache")
+		testutil.Equals(t, first.SeriesSet, srv.SeriesSet)
+	})
+
+	t.Run("different time range or matchers miss the cache", func(t *testing.T) {
+		for _, modify := range []func(r *storepb.SeriesRequest){
+			func(r *storepb.SeriesRequest) { r.MaxTime = 20 },
+			func(r *storepb.SeriesRequest) { r.MinTime = 1 },
+			func(r *storepb.SeriesRequest) { r.Matchers[0].Value = "1" },
+			func(r *storepb.SeriesRequest) { r.SkipChunks = true },
+		} {
+			remote.LastSeriesReq = nil
+			other := proto.Clone(req).(*storepb.SeriesRequest)
+			modify(other)
+
+			series(context.Background(), other)
+			testutil.Assert(t, remote.LastSeriesReq != nil, "expected request to hit the remote store")
+		}
+	})
+
+	t.Run("different tenants do not share cache entries", func(t *testing.T) {
+		remote.LastSeriesReq = nil
+		ctx := metadata.NewIncomingContext(context.Background(), metadata.Pairs(tenancy.DefaultTenantHeader, "other"))
+
+		series(ctx, req)
+		testutil.Assert(t, remote.LastSeriesReq != nil, "expected request to hit the remote store")
+	})
+
+	testutil.Equals(t, 1.0, promtest.ToFloat64(s.metrics.hits.WithLabelValues(cachingStoreOpSeries)))
+}
+
+func TestCachingStore_SeriesPartialResponse(t *testing.T) {
+	remote := &mockedStoreAPI{
+		RespSeries: []*storepb.SeriesResponse{
+			storeSeriesResponse(t, labels.FromStrings("a", "1"), []sample{{0, 0}}),
+			storepb.NewWarnSeriesResponse(errors.New("store unavailable")),
+		},
+	}
+	s := newTestCachingStore(t, remote)
+	req := &storepb.SeriesRequest{
+		MaxTime:  10,
+		Matchers: []*storepb.LabelMatcher{{Type: storepb.LabelMatcher_EQ, Name: "a", Value: "1"}},
+	}
+
+	for i := 0; i < 2; i++ {
+		remote.LastSeriesReq = nil
+		srv := storetestutil.NewSeriesServer(context.Background())
+		testutil.Ok(t, s.Series(req, srv))
+		testutil.Equals(t, []string{"store unavailable"}, srv.Warnings)
+		testutil.Assert(t, remote.LastSeriesReq != nil, "partial responses must not be cached")
+	}
+	testutil.Equals(t, 2.0, promtest.ToFloat64(s.metrics.skipped.WithLabelValues(cachingStoreOpSeries)))
+
+	// Errors of the remote store are propagated and not cached either.
+	remote.RespError = errors.New("connection refused")
+	testutil.NotOk(t, s.Series(req, storetestutil.NewSeriesServer(context.Background())))
+}
+
+func TestCachingStore_Labels(t *testing.T) {
+	remote := &mockedStoreAPI{
+		RespLabelNames:  &storepb.LabelNamesResponse{Names: []string{"a", "b"}},
+		RespLabelValues: &storepb.LabelValuesResponse{Values: []string{"1", "2"}, Warnings: []string{"partial"}},
+	}
+	s := newTestCachingStore(t, remote)
+	ctx := context.Background()
+
+	namesReq := &storepb.LabelNamesRequest{Start: 0, End: 10}
+	for i := 0; i < 2; i++ {
+		remote.LastLabelNamesReq = nil
+		resp, err := s.LabelNames(ctx, namesReq)
+		testutil.Ok(t, err)
+		testutil.Equals(t, []string{"a", "b"}, resp.Names)
+		testutil.Equals(t, i == 0, remote.LastLabelNamesReq != nil)
+	}
+
+	// Label values responses with warnings are partial and must not be cached.
+	valuesReq := &storepb.LabelValuesRequest{Label: "a", Start: 0, End: 10}
+	for i := 0; i < 2; i++ {
+		remote.LastLabelValuesReq = nil
+		resp, err := s.LabelValues(ctx, valuesReq)
+		testutil.Ok(t, err)
+		testutil.Equals(t, []string{"1", "2"}, resp.Values)
+		testutil.Assert(t, remote.LastLabelValuesReq != nil, "partial responses must not be cached")
+	}
+}
+
+func TestCachingClients_ProxyStore(t *testing.T) {
+	newRemote := func(value string) *mockedStoreAPI {
+		return &mockedStoreAPI{
+			RespSeries: []*storepb.SeriesResponse{
+				storeSeriesResponse(t, labels.FromStrings("a", value), []sample{{0, 0}, {2, 1}}),
+			},
+		}
+	}
+	remotes := map[string]*mockedStoreAPI{
+		"central-1:10901": newRemote("1"),
+		"central-2:10901": newRemote("2"),
+		"local:10901":     newRemote("3"),
+	}
+	getClients := func() []Client {
+		var clients []Client
+		for _, name := range []string{"central-1:10901", "central-2:10901", "local:10901"} {
+			clients = append(clients, &storetestutil.TestClient{Name: name, StoreClient: remotes[name], MaxTime: 10})
+		}
+		return clients
+	}
+
+	cc, err := NewCachingClientsFromYaml([]byte(`
+type: IN-MEMORY
+config:
+  max_size: 10MB
+  max_item_size: 1MB
+ttl: 1h
+`), []string{"central-1:10901", "central-2:10901"}, log.NewNopLogger(), prometheus.NewRegistry())
+	testutil.Ok(t, err)
+
+	proxy := NewProxyStore(log.NewNopLogger(), prometheus.NewRegistry(), cc.Wrap(getClients), component.Query, labels.EmptyLabels(), 0, EagerRetrieval)
+	req := &storepb.SeriesRequest{
+		MaxTime:  10,
+		Matchers: []*storepb.LabelMatcher{{Type: storepb.LabelMatcher_RE, Name: "a", Value: ".+"}},
+	}
+	for i := 0; i < 2; i++ {
+		for _, remote := range remotes {
+			remote.LastSeriesReq = nil
+		}
+		srv := storetestutil.NewSeriesServer(context.Background())
+		testutil.Ok(t, proxy.Series(req, srv))
+
+		// Responses are cached per address, so the series of both cached stores are returned.
+		testutil.Equals(t, 3, len(srv.SeriesSet))
+		testutil.Equals(t, i == 0, remotes["central-1:10901"].LastSeriesReq != nil)
+		testutil.Equals(t, i == 0, remotes["central-2:10901"].LastSeriesReq != nil)
+		testutil.Assert(t, remotes["local:10901"].LastSeriesReq != nil, "expected stores which are not cached to be queried")
+	}
+	testutil.Equals(t, 2.0, promtest.ToFloat64(cc.metrics.hits.WithLabelValues(cachingStoreOpSeries)))
+}
+
+func TestNewCachingClientsFromYaml(t *testing.T) {
+	cc, err := NewCachingClientsFromYaml([]byte(`
+type: IN-MEMORY
+config:
+  max_size: 1GB
+  max_item_size: 16MB
+ttl: 5m
+max_item_size: 2MiB
+`), nil, log.NewNopLogger(), prometheus.NewRegistry())
+	testutil.Ok(t, err)
+	testutil.Equals(t, 5*time.Minute, cc.ttl)
+	testutil.Equals(t, 2*1024*1024, cc.maxItemSize)
+
+	_, err = NewCachingClientsFromYaml([]byte("type: UNKNOWN"), nil, log.NewNopLogger(), prometheus.NewRegistry())
+	testutil.NotOk(t, err)
+
+	_, err = NewCachingClientsFromYaml([]byte("type: IN-MEMORY\nunknown_field: 1"), nil, log.NewNopLogger(), prometheus.NewRegistry())
+	testutil.NotOk(t, err)
+}
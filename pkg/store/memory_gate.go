@@ -0,0 +1,169 @@
+// Copyright (c) The Thanos Authors.
+// Licensed under the Apache License 2.0.
+
+package store
+
+import (
+	"context"
+	"math"
+	"runtime/debug"
+	"runtime/metrics"
+	"time"
+
+	"github.com/go-kit/log"
+	"github.com/go-kit/log/level"
+	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"go.uber.org/atomic"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	"github.com/thanos-io/thanos/pkg/gate"
+)
+
+const (
+	// Concurrency is reduced once memory usage reaches this ratio of the soft limit.
+	memoryGateHighWatermark = 0.9
+	// Concurrency ramps back up once memory usage drops below this ratio of the soft limit.
+	memoryGateLowWatermark = 0.8
+)
+
+// MemoryPressureGate is a gate.Gate which adapts the number of concurrently accepted requests to memory usage.
+// When memory usage approaches the soft limit, the concurrency limit is halved on every update, down to a
+// single request. Requests over the limit are rejected immediately with codes.ResourceExhausted instead of
+// waiting, so that they can be retried elsewhere. Once memory usage drops, the limit ramps back up to the
+// configured maximum. Accepted requests are passed to the wrapped gate.
+type MemoryPressureGate struct {
+	logger         log.Logger
+	gate           gate.Gate
+	softLimit      uint64
+	maxConcurrency int64
+	memoryUsage    func() uint64
+
+	limit    atomic.Int64
+	inflight atomic.Int64
+
+	limitGauge prometheus.Gauge
+	shed       prometheus.Counter
+}
+
+// NewMemoryPressureGate returns a MemoryPressureGate wrapping g. Concurrency never exceeds maxConcurrency,
+// 0 meaning no limit. If softLimit is 0, the Go runtime memory limit (GOMEMLIMIT) is used instead.
+func NewMemoryPressureGate(logger log.Logger, reg prometheus.Registerer, g gate.Gate, maxConcurrency int, softLimit uint64) (*MemoryPressureGate, error) {
+	if softLimit == 0 {
+		if l := debug.SetMemoryLimit(-1); l != math.MaxInt64 {
+			softLimit = uint64(l)
+		}
+	}
+	if softLimit == 0 {
+		return nil, errors.New("memory soft limit is neither configured nor set through GOMEMLIMIT")
+	}
+
+	ceiling := int64(maxConcurrency)
+	if ceiling <= 0 {
+		ceiling = math.MaxInt64
+	}
+	mg := &MemoryPressureGate{
+		logger:         logger,
+		gate:           g,
+		softLimit:      softLimit,
+		maxConcurrency: ceiling,
+		memoryUsage:    runtimeMemoryUsage,
+		limitGauge: promauto.With(reg).NewGauge(prometheus.GaugeOpts{
+			Name: "thanos_bucket_store_series_adaptive_concurrency_limit",
+			Help: "Current number of concurrent Series calls allowed by the memory pressure based limiter.",
+		}),
+		shed: promauto.With(reg).NewCounter(prometheus.CounterOpts{
+			Name: "thanos_bucket_store_series_shed_total",
+			Help: "Total number of Series calls rejected because of memory pressure.",
+		}),
+	}
+	promauto.With(reg).NewGauge(prometheus.GaugeOpts{
+		Name: "thanos_bucket_store_memory_soft_limit_bytes",
+		Help: "Memory soft limit used by the memory pressure based limiter.",
+	}).Set(float64(softLimit))
+	mg.setLimit(ceiling)
+
+	return mg, nil
+}
+
+// Start implements gate.Gate.
+func (g *MemoryPressureGate) Start(ctx context.Context) error {
+	if limit := g.limit.Load(); g.inflight.Inc() > limit {
+		g.inflight.Dec()
+		g.shed.Inc()
+		return status.Errorf(codes.ResourceExhausted, "store is under memory pressure, concurrency is limited to %d requests", limit)
+	}
+	if err := g.gate.Start(ctx); err != nil {
+		g.inflight.Dec()
+		return err
+	}
+	return nil
+}
+
+// Done implements gate.Gate.
+func (g *MemoryPressureGate) Done() {
+	g.gate.Done()
+	g.inflight.Dec()
+}
+
+// Run adjusts the concurrency limit to memory usage every interval until ctx is canceled.
+func (g *MemoryPressureGate) Run(ctx context.Context, interval time.Duration) {
+	t := time.NewTicker(interval)
+	defer t.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+			g.update()
+		}
+	}
+}
+
+// update halves the concurrency limit when memory usage is above the high watermark and
+// increases it by a tenth (at least one) when memory usage is below the low watermark.
+func (g *MemoryPressureGate) update() {
+	usage := float64(g.memoryUsage()) / float64(g.softLimit)
+	limit := g.limit.Load()
+
+	switch {
+	case usage >= memoryGateHighWatermark:
+		// Start from the number of requests in flight, the limit may be far above it with no concurrency limit set.
+		newLimit := min(limit, max(g.inflight.Load(), 1)) / 2
+		newLimit = max(newLimit, 1)
+		if newLimit != limit {
+			level.Warn(g.logger).Log("msg", "memory usage is close to the soft limit, reducing Series concurrency", "usage_ratio", usage, "limit", newLimit)
+			g.setLimit(newLimit)
+		}
+	case usage < memoryGateLowWatermark && limit < g.maxConcurrency:
+		step := max(limit/10, 1)
+		if limit > g.maxConcurrency-step {
+			g.setLimit(g.maxConcurrency)
+			level.Info(g.logger).Log("msg", "memory usage recovered, Series concurrency is no longer limited by memory pressure")
+			return
+		}
+		g.setLimit(limit + step)
+	}
+}
+
+func (g *MemoryPressureGate) setLimit(limit int64) {
+	g.limit.Store(limit)
+	g.limitGauge.Set(float64(limit))
+}
+
+var runtimeMemorySamples = []metrics.Sample{
+	{Name: "/memory/classes/total:bytes"},
+	{Name: "/memory/classes/heap/released:bytes"},
+}
+
+// runtimeMemoryUsage returns the memory mapped by the Go runtime which was not released to the OS.
+// This is the same quantity the Go runtime compares against GOMEMLIMIT.
+func runtimeMemoryUsage() uint64 {
+	samples := make([]metrics.Sample, len(runtimeMemorySamples))
+	copy(samples, runtimeMemorySamples)
+	metrics.Read(samples)
+	return samples[0].Value.Uint64() - samples[1].Value.Uint64()
+}
@@ -0,0 +1,87 @@
+// Copyright (c) The Thanos Authors.
+// Licensed under the Apache License 2.0.
+
+package store
+
+import (
+	"context"
+	"testing"
+
+	"github.com/go-kit/log"
+	"github.com/prometheus/client_golang/prometheus"
+	promtest "github.com/prometheus/client_golang/prometheus/testutil"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	"github.com/efficientgo/core/testutil"
+
+	"github.com/thanos-io/thanos/pkg/gate"
+)
+
+func TestMemoryPressureGate(t *testing.T) {
+	ctx := context.Background()
+	reg := prometheus.NewRegistry()
+
+	g, err := NewMemoryPressureGate(log.NewNopLogger(), reg, gate.NewNoop(), 8, 1000)
+	testutil.Ok(t, err)
+
+	var usage uint64
+	g.memoryUsage = func() uint64 { return usage }
+
+	// No memory pressure, all requests up to the maximum concurrency are accepted.
+	for i := 0; i < 8; i++ {
+		testutil.Ok(t, g.Start(ctx))
+	}
+	g.update()
+	testutil.Equals(t, int64(8), g.limit.Load())
+
+	// Memory usage approaches the soft limit, the limit is halved on each update.
+	usage = 950
+	g.update()
+	testutil.Equals(t, 4.0, promtest.ToFloat64(g.limitGauge))
+	g.update()
+	g.update()
+	g.update()
+	testutil.Equals(t, int64(1), g.limit.Load())
+
+	// New requests are shed while the in-flight ones are over the limit.
+	err = g.Start(ctx)
+	testutil.NotOk(t, err)
+	testutil.Equals(t, codes.ResourceExhausted, status.Code(err))
+	testutil.Equals(t, 1.0, promtest.ToFloat64(g.shed))
+
+	for i := 0; i < 8; i++ {
+		g.Done()
+	}
+	testutil.Ok(t, g.Start(ctx))
+	testutil.NotOk(t, g.Start(ctx))
+	g.Done()
+
+	// Between the watermarks the limit is kept.
+	usage = 850
+	g.update()
+	testutil.Equals(t, int64(1), g.limit.Load())
+
+	// Once memory recovers, concurrency ramps back up to the maximum.
+	usage = 100
+	for i := 0; i < 7; i++ {
+		g.update()
+		testutil.Equals(t, int64(i+2), g.limit.Load())
+	}
+	g.update()
+	testutil.Equals(t, int64(8), g.limit.Load())
+}
+
+func TestMemoryPressureGateUnlimited(t *testing.T) {
+	g, err := NewMemoryPressureGate(log.NewNopLogger(), nil, gate.NewNoop(), 0, 1000)
+	testutil.Ok(t, err)
+	g.memoryUsage = func() uint64 { return 1000 }
+
+	for i := 0; i < 100; i++ {
+		testutil.Ok(t, g.Start(context.Background()))
+	}
+
+	// Without a maximum, the limit is reduced based on the requests in flight.
+	g.update()
+	testutil.Equals(t, int64(50), g.limit.Load())
+}
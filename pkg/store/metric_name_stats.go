@@ -0,0 +1,415 @@
+// Copyright (c) The Thanos Authors.
+// Licensed under the Apache License 2.0.
+
+package store
+
+import (
+	"context"
+	"sort"
+	"sync"
+
+	"github.com/go-kit/log"
+	"github.com/pkg/errors"
+	"github.com/prometheus/prometheus/model/labels"
+	"github.com/prometheus/prometheus/storage"
+	"github.com/prometheus/prometheus/tsdb/chunks"
+	"golang.org/x/sync/errgroup"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/known/anypb"
+
+	"github.com/thanos-io/thanos/pkg/block/indexheader"
+	"github.com/thanos-io/thanos/pkg/runutil"
+	"github.com/thanos-io/thanos/pkg/store/labelpb"
+	"github.com/thanos-io/thanos/pkg/store/storepb"
+	"github.com/thanos-io/thanos/pkg/store/storepb/prompb"
+)
+
+// MetricNameStatsHeader is the gRPC metadata key asking stores to answer Series requests skipping chunks with the
+// approximate number of series and the freshness of every matching metric name, instead of the series themselves.
+const MetricNameStatsHeader = "thanos-metric-name-stats"
+
+const metricNameStatsTrackerKey = ctxKey(3)
+
+// metricNameStatsBatchSize is the maximum number of metric names sent in a single response hints message.
+const metricNameStatsBatchSize = 1000
+
+// MetricNameStats are the approximate statistics of a metric name.
+type MetricNameStats struct {
+	Name string
+	// Series is the approximate number of series with the metric name.
+	Series int64
+	// LastTimestamp approximates the time of the most recent sample of the metric name within the requested time
+	// range, in milliseconds.
+	LastTimestamp int64
+}
+
+// StoreMetricNameStats tells whether a store reported statistics of metric names.
+type StoreMetricNameStats struct {
+	// Store is the address of the store endpoint.
+	Store string
+	// Reported is false for stores which returned matching series without reporting statistics, in which case the
+	// returned series are counted and the end of the data of the store overlapping the request is used as freshness.
+	Reported bool
+}
+
+// MetricNameStatsTracker records the statistics of the metric names matching a Series request skipping chunks in
+// every store, see WithMetricNameStatsTracker. Store Gateways report them from the postings offset tables of their
+// index headers, without fetching postings unless matchers other than on the metric name and external labels are
+// given, and stores backed by a TSDB from the series of their index and the bounds of their chunks. No chunk is sent
+// or decoded.
+type MetricNameStatsTracker struct {
+	mtx    sync.Mutex
+	stores map[string]*storeMetricNameStats
+}
+
+type storeMetricNameStats struct {
+	reported bool
+	names    map[string]*MetricNameStats
+}
+
+// NewMetricNameStatsTracker returns an empty MetricNameStatsTracker.
+func NewMetricNameStatsTracker() *MetricNameStatsTracker {
+	return &MetricNameStatsTracker{stores: map[string]*storeMetricNameStats{}}
+}
+
+// WithMetricNameStatsTracker returns a context making the proxy ask stores for the statistics of the matching metric
+// names instead of the series, and record them in t.
+func WithMetricNameStatsTracker(ctx context.Context, t *MetricNameStatsTracker) context.Context {
+	return context.WithValue(ctx, metricNameStatsTrackerKey, t)
+}
+
+// MetricNameStatsTrackerFromContext returns the MetricNameStatsTracker of ctx, nil if none.
+func MetricNameStatsTrackerFromContext(ctx context.Context) *MetricNameStatsTracker {
+	t, _ := ctx.Value(metricNameStatsTrackerKey).(*MetricNameStatsTracker)
+	return t
+}
+
+// metricNameStatsRequested returns true if the Series request with the given context asks for the statistics of the
+// matching metric names, either through the incoming gRPC metadata or, for in-process clients, a tracker in the context.
+func metricNameStatsRequested(ctx context.Context) bool {
+	return len(metadata.ValueFromIncomingContext(ctx, MetricNameStatsHeader)) > 0 || MetricNameStatsTrackerFromContext(ctx) != nil
+}
+
+// observe records the statistics of a metric name in a store. Statistics reported by a store replace the series it
+// returned, series are counted one by one.
+func (t *MetricNameStatsTracker) observe(store, name string, series, ts int64, reported bool) {
+	t.mtx.Lock()
+	defer t.mtx.Unlock()
+
+	s, ok := t.stores[store]
+	if !ok || (reported && !s.reported) {
+		s = &storeMetricNameStats{reported: reported, names: map[string]*MetricNameStats{}}
+		t.stores[store] = s
+	}
+	if s.reported && !reported {
+		return
+	}
+	st, ok := s.names[name]
+	if !ok {
+		s.names[name] = &MetricNameStats{Name: name, Series: series, LastTimestamp: ts}
+		return
+	}
+	if reported {
+		st.Series = max(st.Series, series)
+	} else {
+		st.Series += series
+	}
+	st.LastTimestamp = max(st.LastTimestamp, ts)
+}
+
+// Stats returns the statistics of the metric names recorded so far, sorted by name. The series of a metric name are
+// summed across stores, so series replicated in several stores are counted several times.
+func (t *MetricNameStatsTracker) Stats() []MetricNameStats {
+	t.mtx.Lock()
+	defer t.mtx.Unlock()
+
+	byName := map[string]*MetricNameStats{}
+	for _, s := range t.stores {
+		for name, st := range s.names {
+			agg, ok := byName[name]
+			if !ok {
+				agg = &MetricNameStats{Name: name, LastTimestamp: st.LastTimestamp}
+				byName[name] = agg
+			}
+			agg.Series += st.Series
+			agg.LastTimestamp = max(agg.LastTimestamp, st.LastTimestamp)
+		}
+	}
+
+	stats := make([]MetricNameStats, 0, len(byName))
+	for _, st := range byName {
+		stats = append(stats, *st)
+	}
+	sort.Slice(stats, func(i, j int) bool { return stats[i].Name < stats[j].Name })
+	return stats
+}
+
+// Stores returns the stores having matching metric names, sorted by address.
+func (t *MetricNameStatsTracker) Stores() []StoreMetricNameStats {
+	t.mtx.Lock()
+	defer t.mtx.Unlock()
+
+	stores := make([]StoreMetricNameStats, 0, len(t.stores))
+	for store, s := range t.stores {
+		if len(s.names) == 0 {
+			continue
+		}
+		stores = append(stores, StoreMetricNameStats{Store: store, Reported: s.reported})
+	}
+	sort.Slice(stores, func(i, j int) bool { return stores[i].Store < stores[j].Store })
+	return stores
+}
+
+// metricNameStatsTrackingRespSet records the statistics of metric names reported by a store. Series returned by
+// stores which do not report statistics are counted by metric name, with the end of the data of the store
+// overlapping the request as freshness.
+type metricNameStatsTrackingRespSet struct {
+	respSet
+	store   string
+	maxt    int64
+	tracker *MetricNameStatsTracker
+}
+
+func (s *metricNameStatsTrackingRespSet) Next() bool {
+	if !s.respSet.Next() {
+		return false
+	}
+	resp := s.respSet.At()
+	if resp == nil {
+		return true
+	}
+	if series := resp.GetSeries(); series != nil {
+		for _, l := range series.Labels {
+			if l.Name == labels.MetricName {
+				s.tracker.observe(s.store, l.Value, 1, s.maxt, false)
+				break
+			}
+		}
+		return true
+	}
+	if resp.GetHints() == nil {
+		return true
+	}
+	req := &prompb.WriteRequest{}
+	if err := anypb.UnmarshalTo(resp.GetHints(), req, proto.UnmarshalOptions{}); err != nil {
+		// Other hints, e.g. queried blocks, are not statistics.
+		return true
+	}
+	for _, ts := range req.Timeseries {
+		if len(ts.Labels) == 0 || len(ts.Samples) == 0 {
+			continue
+		}
+		s.tracker.observe(s.store, ts.Labels[0].Value, int64(ts.Samples[0].Value), ts.Samples[0].Timestamp, true)
+	}
+	return true
+}
+
+// metricNameStat is the number of series and the freshness of a metric name in a store.
+type metricNameStat struct {
+	series        int64
+	lastTimestamp int64
+}
+
+func (st *metricNameStat) merge(series, ts int64) {
+	st.series = max(st.series, series)
+	st.lastTimestamp = max(st.lastTimestamp, ts)
+}
+
+// sendMetricNameStats sends the statistics of the metric names as response hints, in batches. Every metric name is
+// encoded as a series with the metric name as only label and a single sample, with the number of series as value at
+// the freshness timestamp.
+func sendMetricNameStats(srv storepb.Store_SeriesServer, stats map[string]*metricNameStat) error {
+	names := make([]string, 0, len(stats))
+	for name := range stats {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for len(names) > 0 {
+		batch := names[:min(len(names), metricNameStatsBatchSize)]
+		names = names[len(batch):]
+
+		req := &prompb.WriteRequest{Timeseries: make([]*prompb.TimeSeries, 0, len(batch))}
+		for _, name := range batch {
+			req.Timeseries = append(req.Timeseries, &prompb.TimeSeries{
+				Labels:  []*labelpb.Label{{Name: labels.MetricName, Value: name}},
+				Samples: []*prompb.Sample{{Value: float64(stats[name].series), Timestamp: stats[name].lastTimestamp}},
+			})
+		}
+		hints, err := anypb.New(req)
+		if err != nil {
+			return status.Error(codes.Internal, errors.Wrap(err, "marshal metric name stats").Error())
+		}
+		if err := srv.Send(storepb.NewHintsSeriesResponse(hints)); err != nil {
+			return status.Error(codes.Unknown, errors.Wrap(err, "send metric name stats").Error())
+		}
+	}
+	return nil
+}
+
+// metricNameStats sends the statistics of the metric names of the blocks overlapping the request. The number of series
+// of a metric name is the largest number of series in a block, estimated from the size of its postings in the postings
+// offset table of the index header, and its freshness the end of the most recent block having it, clipped to the
+// request. Postings are only fetched for matchers other than on the metric name and external labels.
+func (s *BucketStore) metricNameStats(srv flushableServer, req *storepb.SeriesRequest, matchers, reqBlockMatchers []*labels.Matcher, tenant string) error {
+	var (
+		mtx          sync.Mutex
+		stats        = map[string]*metricNameStat{}
+		g, gctx      = errgroup.WithContext(srv.Context())
+		bytesLimiter = s.bytesLimiterFactory(s.metrics.queriesDropped.WithLabelValues("bytes", tenant))
+		logger       = s.requestLoggerFunc(srv.Context(), s.logger)
+	)
+
+	s.mtx.RLock()
+	for _, bs := range s.blockSets {
+		blockMatchers, ok := bs.labelMatchers(matchers...)
+		if !ok {
+			continue
+		}
+		var nameMatchers, otherMatchers []*labels.Matcher
+		for _, m := range blockMatchers {
+			if m.Name == labels.MetricName {
+				nameMatchers = append(nameMatchers, m)
+			} else {
+				otherMatchers = append(otherMatchers, m)
+			}
+		}
+
+		for _, b := range bs.getFor(req.MinTime, req.MaxTime, req.MaxResolutionWindow, reqBlockMatchers) {
+			blk := b
+			blockLogger := log.With(logger, "block", blk.meta.ULID)
+			indexr := blk.indexReader(blockLogger)
+
+			g.Go(func() error {
+				defer runutil.CloseWithLogOnErr(blockLogger, indexr, "close index reader of metric name stats")
+
+				names, err := blk.indexHeaderReader.LabelValues(labels.MetricName)
+				if err != nil {
+					return errors.Wrapf(err, "metric names of block %s", blk.meta.ULID)
+				}
+				// The maximum time of blocks is exclusive.
+				ts := min(blk.meta.MaxTime-1, req.MaxTime)
+
+			Names:
+				for _, name := range names {
+					for _, m := range nameMatchers {
+						if !m.Matches(name) {
+							continue Names
+						}
+					}
+
+					var series int64
+					if len(otherMatchers) == 0 {
+						rng, err := blk.indexHeaderReader.PostingsOffset(labels.MetricName, name)
+						if err == indexheader.NotFoundRangeErr {
+							continue
+						}
+						if err != nil {
+							return errors.Wrapf(err, "postings offset of %s in block %s", name, blk.meta.ULID)
+						}
+						// Each range starts from the #entries field which is 4 bytes, followed by 4 bytes per series.
+						series = (rng.End - rng.Start - 4) / 4
+					} else {
+						ms := append([]*labels.Matcher{labels.MustNewMatcher(labels.MatchEqual, labels.MetricName, name)}, otherMatchers...)
+						ps, err := indexr.ExpandedPostings(gctx, newSortedMatchers(ms), bytesLimiter, false, s.metrics.lazyExpandedPostingSizeBytes, tenant)
+						if err != nil {
+							return errors.Wrapf(err, "fetch postings of %s for block %s", name, blk.meta.ULID)
+						}
+						if ps != nil {
+							series = int64(len(ps.postings))
+						}
+					}
+					if series <= 0 {
+						continue
+					}
+
+					mtx.Lock()
+					st, ok := stats[name]
+					if !ok {
+						st = &metricNameStat{}
+						stats[name] = st
+					}
+					st.merge(series, ts)
+					mtx.Unlock()
+				}
+				return nil
+			})
+		}
+	}
+	s.mtx.RUnlock()
+
+	if err := g.Wait(); err != nil {
+		code := codes.Aborted
+		if s, ok := status.FromError(errors.Cause(err)); ok {
+			code = s.Code()
+		}
+		return status.Error(code, err.Error())
+	}
+	if err := sendMetricNameStats(srv, stats); err != nil {
+		return err
+	}
+	return srv.Flush()
+}
+
+// metricNameStats sends the statistics of the metric names of the series matching the request. Series are counted from
+// the index and the freshness of a metric name is the end of the most recent chunk of its series overlapping the
+// request, so chunks are located but none is sent.
+func (s *TSDBStore) metricNameStats(srv flushableServer, r *storepb.SeriesRequest, matchers []*labels.Matcher) error {
+	q, err := s.db.ChunkQuerier(r.MinTime, r.MaxTime)
+	if err != nil {
+		return status.Error(codes.Internal, err.Error())
+	}
+	defer runutil.CloseWithLogOnErr(s.logger, q, "close tsdb chunk querier metric name stats")
+
+	var (
+		stats = map[string]*metricNameStat{}
+		set   = q.Select(srv.Context(), false, &storage.SelectHints{Start: r.MinTime, End: r.MaxTime}, matchers...)
+		it    chunks.Iterator
+	)
+	for set.Next() {
+		series := set.At()
+		name := series.Labels().Get(labels.MetricName)
+		if name == "" {
+			continue
+		}
+
+		var (
+			ts    int64
+			found bool
+		)
+		it = series.Iterator(it)
+		for it.Next() {
+			chk := it.At()
+			if chk.MaxTime < r.MinTime || chk.MinTime > r.MaxTime {
+				continue
+			}
+			if !found || chk.MaxTime > ts {
+				ts, found = min(chk.MaxTime, r.MaxTime), true
+			}
+		}
+		if err := it.Err(); err != nil {
+			return status.Error(codes.Internal, errors.Wrap(err, "chunk iter").Error())
+		}
+		if !found {
+			continue
+		}
+
+		st, ok := stats[name]
+		if !ok {
+			st = &metricNameStat{lastTimestamp: ts}
+			stats[name] = st
+		}
+		st.series++
+		st.lastTimestamp = max(st.lastTimestamp, ts)
+	}
+	if err := set.Err(); err != nil {
+		return status.Error(codes.Internal, err.Error())
+	}
+	if err := sendMetricNameStats(srv, stats); err != nil {
+		return err
+	}
+	return srv.Flush()
+}
@@ -0,0 +1,222 @@
+// Copyright (c) The Thanos Authors.
+// Licensed under the Apache License 2.0.
+
+package store
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/efficientgo/core/testutil"
+	"github.com/go-kit/log"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/prometheus/model/labels"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/known/anypb"
+
+	"github.com/thanos-io/thanos/pkg/component"
+	"github.com/thanos-io/thanos/pkg/store/labelpb"
+	"github.com/thanos-io/thanos/pkg/store/storepb"
+	"github.com/thanos-io/thanos/pkg/store/storepb/prompb"
+	storetestutil "github.com/thanos-io/thanos/pkg/store/storepb/testutil"
+	"github.com/thanos-io/thanos/pkg/testutil/e2eutil"
+)
+
+// metricNameStatsHints returns the statistics of the metric names sent as hints.
+func metricNameStatsHints(t *testing.T, hints []*anypb.Any) []MetricNameStats {
+	t.Helper()
+
+	var stats []MetricNameStats
+	for _, h := range hints {
+		req := &prompb.WriteRequest{}
+		testutil.Ok(t, anypb.UnmarshalTo(h, req, proto.UnmarshalOptions{}))
+		for _, ts := range req.Timeseries {
+			stats = append(stats, MetricNameStats{Name: ts.Labels[0].Value, Series: int64(ts.Samples[0].Value), LastTimestamp: ts.Samples[0].Timestamp})
+		}
+	}
+	return stats
+}
+
+func metricNameStatsResponse(stats ...MetricNameStats) *storepb.SeriesResponse {
+	req := &prompb.WriteRequest{}
+	for _, st := range stats {
+		req.Timeseries = append(req.Timeseries, &prompb.TimeSeries{
+			Labels:  []*labelpb.Label{{Name: labels.MetricName, Value: st.Name}},
+			Samples: []*prompb.Sample{{Value: float64(st.Series), Timestamp: st.LastTimestamp}},
+		})
+	}
+	return storepb.NewHintsSeriesResponse(mustMarshalAny(req))
+}
+
+func TestProxyStore_MetricNameStats(t *testing.T) {
+	gateway := &mockedStoreAPI{
+		RespSeries: []*storepb.SeriesResponse{
+			metricNameStatsResponse(MetricNameStats{Name: "up", Series: 10, LastTimestamp: 5}, MetricNameStats{Name: "requests_total", Series: 100, LastTimestamp: 5}),
+		},
+	}
+	stores := []Client{
+		&storetestutil.TestClient{Name: "store:10901", StoreClient: gateway, MinTime: 0, MaxTime: 10},
+		// Sidecars return series without reporting statistics.
+		&storetestutil.TestClient{
+			Name: "sidecar:10901",
+			StoreClient: &mockedStoreAPI{RespSeries: []*storepb.SeriesResponse{
+				storeSeriesResponse(t, labels.FromStrings("__name__", "up", "instance", "a")),
+				storeSeriesResponse(t, labels.FromStrings("__name__", "up", "instance", "b")),
+			}},
+			MinTime: 8,
+			MaxTime: 20,
+		},
+		&storetestutil.TestClient{Name: "empty:10901", StoreClient: &mockedStoreAPI{}, MinTime: 0, MaxTime: 20},
+	}
+	q := NewProxyStore(log.NewNopLogger(), prometheus.NewRegistry(), func() []Client { return stores }, component.Query, labels.EmptyLabels(), 0, LazyRetrieval)
+	req := &storepb.SeriesRequest{
+		MinTime:    0,
+		MaxTime:    15,
+		SkipChunks: true,
+		Matchers:   []*storepb.LabelMatcher{{Type: storepb.LabelMatcher_RE, Name: "__name__", Value: ".+"}},
+	}
+
+	tracker := NewMetricNameStatsTracker()
+	ctx, cancel := context.WithTimeout(WithMetricNameStatsTracker(context.Background(), tracker), time.Minute)
+	defer cancel()
+	testutil.Ok(t, q.Series(req, storetestutil.NewSeriesServer(ctx)))
+
+	testutil.Equals(t, []MetricNameStats{
+		{Name: "requests_total", Series: 100, LastTimestamp: 5},
+		{Name: "up", Series: 12, LastTimestamp: 15},
+	}, tracker.Stats())
+	testutil.Equals(t, []StoreMetricNameStats{
+		{Store: "sidecar:10901"},
+		{Store: "store:10901", Reported: true},
+	}, tracker.Stores())
+}
+
+func TestTSDBStore_MetricNameStats(t *testing.T) {
+	db, err := e2eutil.NewTSDB()
+	testutil.Ok(t, err)
+	defer func() { testutil.Ok(t, db.Close()) }()
+
+	app := db.Appender(context.Background())
+	for i := int64(1); i <= 10; i++ {
+		_, err = app.Append(0, labels.FromStrings("__name__", "up", "instance", "a"), i, 1)
+		testutil.Ok(t, err)
+	}
+	_, err = app.Append(0, labels.FromStrings("__name__", "up", "instance", "b"), 20, 1)
+	testutil.Ok(t, err)
+	_, err = app.Append(0, labels.FromStrings("__name__", "requests_total", "instance", "a"), 5, 1)
+	testutil.Ok(t, err)
+	testutil.Ok(t, app.Commit())
+
+	tsdbStore := NewTSDBStore(nil, db, component.Receive, labels.FromStrings("region", "eu-west"))
+	ctx := metadata.NewIncomingContext(context.Background(), metadata.Pairs(MetricNameStatsHeader, "true"))
+
+	for _, tc := range []struct {
+		name     string
+		req      *storepb.SeriesRequest
+		expected []MetricNameStats
+	}{
+		{
+			name: "all metric names",
+			req: &storepb.SeriesRequest{
+				MinTime:  0,
+				MaxTime:  30,
+				Matchers: []*storepb.LabelMatcher{{Type: storepb.LabelMatcher_RE, Name: "__name__", Value: ".+"}},
+			},
+			expected: []MetricNameStats{
+				{Name: "requests_total", Series: 1, LastTimestamp: 5},
+				{Name: "up", Series: 2, LastTimestamp: 20},
+			},
+		},
+		{
+			name: "freshness clipped to the request",
+			req: &storepb.SeriesRequest{
+				MinTime:  3,
+				MaxTime:  15,
+				Matchers: []*storepb.LabelMatcher{{Type: storepb.LabelMatcher_RE, Name: "__name__", Value: ".+"}},
+			},
+			expected: []MetricNameStats{
+				{Name: "requests_total", Series: 1, LastTimestamp: 5},
+				{Name: "up", Series: 1, LastTimestamp: 10},
+			},
+		},
+		{
+			name: "no matching series",
+			req: &storepb.SeriesRequest{
+				MinTime:  0,
+				MaxTime:  30,
+				Matchers: []*storepb.LabelMatcher{{Type: storepb.LabelMatcher_EQ, Name: "__name__", Value: "down"}},
+			},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			tc.req.SkipChunks = true
+			srv := storetestutil.NewSeriesServer(ctx)
+			testutil.Ok(t, tsdbStore.Series(tc.req, srv))
+			testutil.Equals(t, 0, len(srv.SeriesSet))
+			testutil.Equals(t, tc.expected, metricNameStatsHints(t, srv.HintsSet))
+		})
+	}
+}
+
+func TestBucketStore_MetricNameStats(t *testing.T) {
+	s := prepareStoreWithMultiChunkSeries(t, 3, 10)
+	ctx := metadata.NewIncomingContext(context.Background(), metadata.Pairs(MetricNameStatsHeader, "true"))
+
+	for _, tc := range []struct {
+		name     string
+		req      *storepb.SeriesRequest
+		expected []MetricNameStats
+	}{
+		{
+			name: "estimated from the index header",
+			req: &storepb.SeriesRequest{
+				MinTime:  0,
+				MaxTime:  100,
+				Matchers: []*storepb.LabelMatcher{{Type: storepb.LabelMatcher_RE, Name: "__name__", Value: ".+"}},
+			},
+			expected: []MetricNameStats{{Name: "test", Series: 3, LastTimestamp: 9}},
+		},
+		{
+			name: "external label matchers",
+			req: &storepb.SeriesRequest{
+				MinTime: 0,
+				MaxTime: 5,
+				Matchers: []*storepb.LabelMatcher{
+					{Type: storepb.LabelMatcher_EQ, Name: "__name__", Value: "test"},
+					{Type: storepb.LabelMatcher_EQ, Name: "ext1", Value: "1"},
+				},
+			},
+			expected: []MetricNameStats{{Name: "test", Series: 3, LastTimestamp: 5}},
+		},
+		{
+			name: "other matchers fetch postings",
+			req: &storepb.SeriesRequest{
+				MinTime: 0,
+				MaxTime: 100,
+				Matchers: []*storepb.LabelMatcher{
+					{Type: storepb.LabelMatcher_RE, Name: "__name__", Value: ".+"},
+					{Type: storepb.LabelMatcher_RE, Name: "i", Value: "0|1"},
+				},
+			},
+			expected: []MetricNameStats{{Name: "test", Series: 2, LastTimestamp: 9}},
+		},
+		{
+			name: "no matching metric names",
+			req: &storepb.SeriesRequest{
+				MinTime:  0,
+				MaxTime:  100,
+				Matchers: []*storepb.LabelMatcher{{Type: storepb.LabelMatcher_EQ, Name: "__name__", Value: "other"}},
+			},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			tc.req.SkipChunks = true
+			srv := storetestutil.NewSeriesServer(ctx)
+			testutil.Ok(t, s.Series(tc.req, srv))
+			testutil.Equals(t, 0, len(srv.SeriesSet))
+			testutil.Equals(t, tc.expected, metricNameStatsHints(t, srv.HintsSet))
+		})
+	}
+}
@@ -0,0 +1,167 @@
+// Copyright (c) The Thanos Authors.
+// Licensed under the Apache License 2.0.
+
+package store
+
+import (
+	"context"
+	"sort"
+	"sync"
+
+	"github.com/prometheus/prometheus/model/labels"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/known/anypb"
+
+	"github.com/thanos-io/thanos/pkg/store/hintspb"
+	"github.com/thanos-io/thanos/pkg/store/labelpb"
+	"github.com/thanos-io/thanos/pkg/store/storepb"
+)
+
+const originTrackerKey = ctxKey(1)
+
+// SeriesOrigin describes where the data of a series selected by a query comes from.
+type SeriesOrigin struct {
+	Labels labels.Labels `json:"metric"`
+	// Stores are the store endpoints which returned the series, sorted by address.
+	Stores []StoreOrigin `json:"stores"`
+}
+
+// StoreOrigin is a store endpoint which returned a series.
+type StoreOrigin struct {
+	Address string `json:"address"`
+	// QueriedBlocks are the ULIDs of all blocks queried on this store for the request, which may not all
+	// contain the series. Only stores reporting queried blocks in their response hints, like store
+	// gateways, have them.
+	QueriedBlocks []string `json:"queried_blocks,omitempty"`
+}
+
+// OriginTracker records which store endpoints return which series through the proxy, to help
+// debugging surprising query results, e.g. after deduplication. Tracking every series is costly
+// so it is only done for requests with a tracker in their context, see WithOriginTracker.
+type OriginTracker struct {
+	mtx sync.Mutex
+	// series maps the labels of every series to the addresses of the stores which returned it.
+	series map[string]map[string]struct{}
+	lsets  map[string]labels.Labels
+	blocks map[string]map[string]struct{}
+}
+
+// NewOriginTracker returns an empty OriginTracker.
+func NewOriginTracker() *OriginTracker {
+	return &OriginTracker{
+		series: map[string]map[string]struct{}{},
+		lsets:  map[string]labels.Labels{},
+		blocks: map[string]map[string]struct{}{},
+	}
+}
+
+// WithOriginTracker returns a context making the proxy record the origin of series in t.
+func WithOriginTracker(ctx context.Context, t *OriginTracker) context.Context {
+	return context.WithValue(ctx, originTrackerKey, t)
+}
+
+// OriginTrackerFromContext returns the OriginTracker of ctx, nil if origins are not tracked.
+func OriginTrackerFromContext(ctx context.Context) *OriginTracker {
+	t, _ := ctx.Value(originTrackerKey).(*OriginTracker)
+	return t
+}
+
+func (t *OriginTracker) observe(store string, resp *storepb.SeriesResponse) {
+	if s := resp.GetSeries(); s != nil {
+		lset := labelpb.LabelpbLabelsToPromLabels(s.Labels)
+		key := lset.String()
+
+		t.mtx.Lock()
+		defer t.mtx.Unlock()
+		if _, ok := t.series[key]; !ok {
+			t.series[key] = map[string]struct{}{}
+			t.lsets[key] = lset
+		}
+		t.series[key][store] = struct{}{}
+		return
+	}
+
+	if resp.GetHints() == nil {
+		return
+	}
+	hints := &hintspb.SeriesResponseHints{}
+	if err := anypb.UnmarshalTo(resp.GetHints(), hints, proto.UnmarshalOptions{}); err != nil {
+		// Origins are best effort, ignore hints of unexpected types.
+		return
+	}
+
+	t.mtx.Lock()
+	defer t.mtx.Unlock()
+	if _, ok := t.blocks[store]; !ok {
+		t.blocks[store] = map[string]struct{}{}
+	}
+	for _, b := range hints.QueriedBlocks {
+		t.blocks[store][b.Id] = struct{}{}
+	}
+}
+
+// Origins returns the origin of every series recorded so far, sorted by labels. Series which only
+// differ by the given replica labels are merged, the same way deduplication merges them.
+func (t *OriginTracker) Origins(replicaLabels ...string) []SeriesOrigin {
+	t.mtx.Lock()
+	defer t.mtx.Unlock()
+
+	type origin struct {
+		lset   labels.Labels
+		stores map[string]struct{}
+	}
+	merged := map[string]*origin{}
+	for key, stores := range t.series {
+		lset := labels.NewBuilder(t.lsets[key]).Del(replicaLabels...).Labels()
+		o, ok := merged[lset.String()]
+		if !ok {
+			o = &origin{lset: lset, stores: map[string]struct{}{}}
+			merged[lset.String()] = o
+		}
+		for s := range stores {
+			o.stores[s] = struct{}{}
+		}
+	}
+
+	origins := make([]SeriesOrigin, 0, len(merged))
+	for _, o := range merged {
+		so := SeriesOrigin{Labels: o.lset}
+		for _, s := range sortedKeys(o.stores) {
+			so.Stores = append(so.Stores, StoreOrigin{Address: s, QueriedBlocks: sortedKeys(t.blocks[s])})
+		}
+		origins = append(origins, so)
+	}
+	sort.Slice(origins, func(i, j int) bool {
+		return labels.Compare(origins[i].Labels, origins[j].Labels) < 0
+	})
+	return origins
+}
+
+func sortedKeys(m map[string]struct{}) []string {
+	if len(m) == 0 {
+		return nil
+	}
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// originTrackingRespSet records the origin of the responses of a store.
+type originTrackingRespSet struct {
+	respSet
+	store   string
+	tracker *OriginTracker
+}
+
+func (s *originTrackingRespSet) Next() bool {
+	if !s.respSet.Next() {
+		return false
+	}
+	if resp := s.respSet.At(); resp != nil {
+		s.tracker.observe(s.store, resp)
+	}
+	return true
+}
@@ -0,0 +1,89 @@
+// Copyright (c) The Thanos Authors.
+// Licensed under the Apache License 2.0.
+
+package store
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/efficientgo/core/testutil"
+	"github.com/go-kit/log"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/prometheus/model/labels"
+
+	"github.com/thanos-io/thanos/pkg/component"
+	"github.com/thanos-io/thanos/pkg/store/hintspb"
+	"github.com/thanos-io/thanos/pkg/store/storepb"
+	storetestutil "github.com/thanos-io/thanos/pkg/store/storepb/testutil"
+)
+
+func TestProxyStore_SeriesOrigins(t *testing.T) {
+	hints := &hintspb.SeriesResponseHints{QueriedBlocks: []*hintspb.Block{{Id: "01H0000000000000000000000B"}, {Id: "01H0000000000000000000000A"}}}
+	gateway := &mockedStoreAPI{
+		RespSeries: []*storepb.SeriesResponse{
+			storeSeriesResponse(t, labels.FromStrings("a", "1", "replica", "a"), []sample{{0, 0}}),
+			storepb.NewHintsSeriesResponse(mustMarshalAny(hints)),
+		},
+	}
+	stores := []Client{
+		&storetestutil.TestClient{
+			Name:        "receive-a:10901",
+			StoreClient: &mockedStoreAPI{RespSeries: []*storepb.SeriesResponse{storeSeriesResponse(t, labels.FromStrings("a", "1", "replica", "a"), []sample{{1, 1}})}},
+			MaxTime:     10,
+		},
+		&storetestutil.TestClient{
+			Name: "receive-b:10901",
+			StoreClient: &mockedStoreAPI{RespSeries: []*storepb.SeriesResponse{
+				storeSeriesResponse(t, labels.FromStrings("a", "1", "replica", "b"), []sample{{1, 1}}),
+				storeSeriesResponse(t, labels.FromStrings("a", "2", "replica", "b"), []sample{{1, 1}}),
+			}},
+			MaxTime: 10,
+		},
+		&storetestutil.TestClient{Name: "store:10901", StoreClient: gateway, MaxTime: 10},
+	}
+	q := NewProxyStore(log.NewNopLogger(), prometheus.NewRegistry(), func() []Client { return stores }, component.Query, labels.EmptyLabels(), 0, LazyRetrieval)
+	req := &storepb.SeriesRequest{
+		MinTime:  0,
+		MaxTime:  10,
+		Matchers: []*storepb.LabelMatcher{{Type: storepb.LabelMatcher_RE, Name: "a", Value: ".+"}},
+	}
+
+	// Origins are not tracked by default.
+	testutil.Ok(t, q.Series(req, storetestutil.NewSeriesServer(context.Background())))
+	testutil.Assert(t, gateway.LastSeriesReq.Hints == nil, "expected no request hints without origin tracking")
+
+	tracker := NewOriginTracker()
+	ctx, cancel := context.WithTimeout(WithOriginTracker(context.Background(), tracker), time.Minute)
+	defer cancel()
+	srv := storetestutil.NewSeriesServer(ctx)
+	testutil.Ok(t, q.Series(req, srv))
+	testutil.Equals(t, 3, len(srv.SeriesSet))
+	testutil.Assert(t, gateway.LastSeriesReq.Hints != nil, "expected request hints asking for queried blocks")
+
+	testutil.Equals(t, []SeriesOrigin{
+		{
+			Labels: labels.FromStrings("a", "1", "replica", "a"),
+			Stores: []StoreOrigin{
+				{Address: "receive-a:10901"},
+				{Address: "store:10901", QueriedBlocks: []string{"01H0000000000000000000000A", "01H0000000000000000000000B"}},
+			},
+		},
+		{Labels: labels.FromStrings("a", "1", "replica", "b"), Stores: []StoreOrigin{{Address: "receive-b:10901"}}},
+		{Labels: labels.FromStrings("a", "2", "replica", "b"), Stores: []StoreOrigin{{Address: "receive-b:10901"}}},
+	}, tracker.Origins())
+
+	// With deduplication, replicas of a series share their origins.
+	testutil.Equals(t, []SeriesOrigin{
+		{
+			Labels: labels.FromStrings("a", "1"),
+			Stores: []StoreOrigin{
+				{Address: "receive-a:10901"},
+				{Address: "receive-b:10901"},
+				{Address: "store:10901", QueriedBlocks: []string{"01H0000000000000000000000A", "01H0000000000000000000000B"}},
+			},
+		},
+		{Labels: labels.FromStrings("a", "2"), Stores: []StoreOrigin{{Address: "receive-b:10901"}}},
+	}, tracker.Origins("replica"))
+}
@@ -0,0 +1,42 @@
+// Copyright (c) The Thanos Authors.
+// Licensed under the Apache License 2.0.
+
+package store
+
+import (
+	"context"
+	"time"
+
+	"github.com/go-kit/log"
+	"github.com/go-kit/log/level"
+
+	"github.com/thanos-io/thanos/pkg/runutil"
+	"github.com/thanos-io/thanos/pkg/tenancy"
+)
+
+// warmPostings fetches the postings of the warm-up selectors matching b into the index cache.
+// Both the postings of every label pair of the selectors and the expanded postings of the whole
+// selectors are cached, so queries using the same selector or some of its label pairs benefit from it.
+// Failures are only logged since the block can be queried without warm postings.
+func (s *BucketStore) warmPostings(ctx context.Context, b *bucketBlock) {
+	start := time.Now()
+	logger := log.With(s.logger, "block", b.meta.ULID)
+
+	indexr := b.indexReader(logger)
+	defer runutil.CloseWithLogOnErr(logger, indexr, "close index reader after postings warm-up")
+
+	// The limit is shared by all selectors, warm-up stops once it is exceeded.
+	bytesLimiter := NewLimiter(uint64(s.postingsWarmupMaxBytes), s.metrics.postingsWarmupTruncated)
+
+	for _, selector := range s.postingsWarmupSelectors {
+		ms, ok := b.FilterExtLabelsMatchers(selector)
+		if !ok || len(ms) == 0 {
+			continue
+		}
+		if _, err := indexr.ExpandedPostings(ctx, newSortedMatchers(ms), bytesLimiter, false, s.metrics.lazyExpandedPostingSizeBytes, tenancy.DefaultTenant); err != nil {
+			level.Warn(logger).Log("msg", "postings warm-up stopped", "err", err)
+			break
+		}
+	}
+	s.metrics.postingsWarmupDuration.Observe(time.Since(start).Seconds())
+}
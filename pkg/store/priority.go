@@ -0,0 +1,85 @@
+// Copyright (c) The Thanos Authors.
+// Licensed under the Apache License 2.0.
+
+package store
+
+import (
+	"context"
+	"net/http"
+	"strings"
+
+	"github.com/pkg/errors"
+	"google.golang.org/grpc/metadata"
+)
+
+// PriorityHeader is the HTTP header and gRPC metadata key carrying the priority of a query.
+const PriorityHeader = "thanos-priority"
+
+// Priority is the priority of a query. Store Gateway serves Series requests of higher priority first
+// when the number of concurrent Series calls is limited.
+type Priority int
+
+const (
+	// PriorityLow is meant for background queries, e.g. from recording rules.
+	PriorityLow Priority = iota
+	// PriorityNormal is the priority of queries without a priority hint.
+	PriorityNormal
+	// PriorityHigh is meant for interactive queries, e.g. from dashboards.
+	PriorityHigh
+)
+
+func (p Priority) String() string {
+	switch p {
+	case PriorityLow:
+		return "low"
+	case PriorityHigh:
+		return "high"
+	default:
+		return "normal"
+	}
+}
+
+// ParsePriority parses the name of a priority. An empty name is the normal priority.
+func ParsePriority(s string) (Priority, error) {
+	switch strings.ToLower(s) {
+	case "low":
+		return PriorityLow, nil
+	case "", "normal":
+		return PriorityNormal, nil
+	case "high":
+		return PriorityHigh, nil
+	}
+	return PriorityNormal, errors.Errorf("invalid priority %q, expected one of low, normal or high", s)
+}
+
+type priorityKey struct{}
+
+// ContextWithPriority returns a context carrying the priority p, which is propagated to StoreAPIs by the proxy store.
+func ContextWithPriority(ctx context.Context, p Priority) context.Context {
+	return context.WithValue(ctx, priorityKey{}, p)
+}
+
+// GetPriorityFromHTTP returns the priority set in the PriorityHeader of r.
+func GetPriorityFromHTTP(r *http.Request) (Priority, error) {
+	return ParsePriority(r.Header.Get(PriorityHeader))
+}
+
+// PriorityFromContext returns the priority of the request with the given context, taken from the incoming gRPC metadata
+// or set with ContextWithPriority. Requests without a valid priority have the normal priority.
+func PriorityFromContext(ctx context.Context) Priority {
+	if vals := metadata.ValueFromIncomingContext(ctx, PriorityHeader); len(vals) > 0 {
+		if p, err := ParsePriority(vals[0]); err == nil {
+			return p
+		}
+		return PriorityNormal
+	}
+	if p, ok := ctx.Value(priorityKey{}).(Priority); ok {
+		return p
+	}
+	return PriorityNormal
+}
+
+// appendPriorityToOutgoingContext propagates the priority of the request with the given context to outgoing gRPC calls.
+func appendPriorityToOutgoingContext(ctx context.Context) context.Context {
+	return metadata.AppendToOutgoingContext(ctx, PriorityHeader, PriorityFromContext(ctx).String())
+}
@@ -0,0 +1,38 @@
+// Copyright (c) The Thanos Authors.
+// Licensed under the Apache License 2.0.
+
+package store
+
+import (
+	"context"
+	"testing"
+
+	"github.com/efficientgo/core/testutil"
+	"google.golang.org/grpc/metadata"
+)
+
+func TestPriorityFromContext(t *testing.T) {
+	ctx := context.Background()
+	testutil.Equals(t, PriorityNormal, PriorityFromContext(ctx))
+	testutil.Equals(t, PriorityHigh, PriorityFromContext(ContextWithPriority(ctx, PriorityHigh)))
+
+	for hint, expected := range map[string]Priority{
+		"low":     PriorityLow,
+		"NORMAL":  PriorityNormal,
+		"high":    PriorityHigh,
+		"":        PriorityNormal,
+		"urgent!": PriorityNormal,
+	} {
+		incoming := metadata.NewIncomingContext(ctx, metadata.Pairs(PriorityHeader, hint))
+		testutil.Equals(t, expected, PriorityFromContext(incoming), "hint %q", hint)
+	}
+
+	// The priority is propagated from the context of the query to StoreAPIs, and from there to further StoreAPIs.
+	outgoing := appendPriorityToOutgoingContext(ContextWithPriority(ctx, PriorityLow))
+	md, ok := metadata.FromOutgoingContext(outgoing)
+	testutil.Assert(t, ok)
+	testutil.Equals(t, PriorityLow, PriorityFromContext(metadata.NewIncomingContext(ctx, md)))
+
+	_, err := ParsePriority("urgent!")
+	testutil.NotOk(t, err)
+}
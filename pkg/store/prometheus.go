@@ -140,10 +140,10 @@ func (p *PrometheusStore) Series(r *storepb.SeriesRequest, seriesSrv storepb.Sto
 		return status.Error(codes.InvalidArgument, "no matchers specified (excluding external labels)")
 	}
 
-	// Don't ask for more than available time. This includes potential `minTime` flag limit.
-	availableMinTime, _ := p.timestamps()
-	if r.MinTime < availableMinTime {
-		r.MinTime = availableMinTime
+	// Don't ask for more than available time. This includes potential `minTime` and `maxTime` flag limits.
+	var ok bool
+	if r.MinTime, r.MaxTime, ok = p.availableTimeRange(r.MinTime, r.MaxTime); !ok {
+		return nil
 	}
 
 	extLsetToRemove := map[string]struct{}{}
@@ -548,6 +548,10 @@ func (p *PrometheusStore) LabelNames(ctx context.Context, r *storepb.LabelNamesR
 	if !match {
 		return &storepb.LabelNamesResponse{Names: nil}, nil
 	}
+	var ok bool
+	if r.Start, r.End, ok = p.availableTimeRange(r.Start, r.End); !ok {
+		return &storepb.LabelNamesResponse{Names: nil}, nil
+	}
 
 	var lbls []string
 	if len(matchers) == 0 || p.labelCallsSupportMatchers() {
@@ -611,6 +615,10 @@ func (p *PrometheusStore) LabelValues(ctx context.Context, r *storepb.LabelValue
 	if !match {
 		return &storepb.LabelValuesResponse{}, nil
 	}
+	var ok bool
+	if r.Start, r.End, ok = p.availableTimeRange(r.Start, r.End); !ok {
+		return &storepb.LabelValuesResponse{}, nil
+	}
 
 	var (
 		sers []map[string]string
@@ -694,6 +702,18 @@ func (p *PrometheusStore) Timestamps() (mint int64, maxt int64) {
 	return p.timestamps()
 }
 
+// availableTimeRange clamps the given time range to the one served. It returns false if they do not overlap.
+func (p *PrometheusStore) availableTimeRange(mint, maxt int64) (int64, int64, bool) {
+	availableMinTime, availableMaxTime := p.timestamps()
+	if mint < availableMinTime {
+		mint = availableMinTime
+	}
+	if maxt > availableMaxTime {
+		maxt = availableMaxTime
+	}
+	return mint, maxt, mint <= maxt
+}
+
 // NewChunkedReader constructs a ChunkedReader.
 // It allows passing data slice for byte slice reuse, which will be increased to needed size if smaller.
 func NewChunkedReader(r io.Reader, sizeLimit uint64, data []byte) *ChunkedReader {
@@ -6,14 +6,21 @@ package store
 import (
 	"context"
 	"fmt"
+	"io"
 	"math"
+	"net/http"
+	"net/http/httptest"
 	"net/url"
 	"os"
+	"strconv"
+	"sync"
 	"testing"
 	"time"
 
 	"github.com/cespare/xxhash"
 	"github.com/go-kit/log"
+	"github.com/golang/snappy"
+	"google.golang.org/protobuf/proto"
 
 	"github.com/pkg/errors"
 	"github.com/prometheus/prometheus/model/labels"
@@ -26,6 +33,7 @@ import (
 	"github.com/thanos-io/thanos/pkg/promclient"
 	"github.com/thanos-io/thanos/pkg/store/labelpb"
 	"github.com/thanos-io/thanos/pkg/store/storepb"
+	"github.com/thanos-io/thanos/pkg/store/storepb/prompb"
 	"github.com/thanos-io/thanos/pkg/testutil/custom"
 	"github.com/thanos-io/thanos/pkg/testutil/e2eutil"
 )
@@ -70,9 +78,9 @@ func testPrometheusStoreSeriesE2e(t *testing.T, prefix string) {
 	limitMinT := int64(0)
 	proxy, err := NewPrometheusStore(nil, nil, promclient.NewDefaultClient(), u, component.Sidecar,
 		func() labels.Labels { return labels.FromStrings("region", "eu-west") },
-		func() (int64, int64) { return limitMinT, -1 },
+		func() (int64, int64) { return limitMinT, math.MaxInt64 },
 		nil,
-	) // MaxTime does not matter.
+	)
 	testutil.Ok(t, err)
 
 	// Query all three samples except for the first one. Since we round up queried data
@@ -345,6 +353,130 @@ func TestPrometheusStore_SeriesLabels_e2e(t *testing.T) {
 	}
 }
 
+// timeRangeRecorder is a fake Prometheus recording the time ranges of the requests it gets, by path.
+type timeRangeRecorder struct {
+	mtx    sync.Mutex
+	ranges map[string][2]int64
+}
+
+// reset returns the recorded time ranges and clears them.
+func (rec *timeRangeRecorder) reset() map[string][2]int64 {
+	rec.mtx.Lock()
+	defer rec.mtx.Unlock()
+
+	ranges := rec.ranges
+	rec.ranges = map[string][2]int64{}
+	return ranges
+}
+
+func (rec *timeRangeRecorder) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	rec.mtx.Lock()
+	defer rec.mtx.Unlock()
+
+	if r.URL.Path == "/api/v1/read" {
+		b, err := io.ReadAll(r.Body)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		b, err = snappy.Decode(nil, b)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		var req prompb.ReadRequest
+		if err := proto.Unmarshal(b, &req); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		rec.ranges[r.URL.Path] = [2]int64{req.Queries[0].StartTimestampMs, req.Queries[0].EndTimestampMs}
+		w.Header().Set("Content-Type", "application/x-streamed-protobuf; proto=prometheus.ChunkedReadResponse")
+		return
+	}
+
+	var tr [2]int64
+	for i, param := range []string{"start", "end"} {
+		f, err := strconv.ParseFloat(r.FormValue(param), 64)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		tr[i] = int64(math.Round(f * 1000))
+	}
+	rec.ranges[r.URL.Path] = tr
+	switch r.URL.Path {
+	case "/api/v1/series":
+		_, _ = w.Write([]byte(`{"status":"success","data":[{"a":"b"}]}`))
+	default:
+		_, _ = w.Write([]byte(`{"status":"success","data":["a"]}`))
+	}
+}
+
+func TestPrometheusStore_AvailableTimeRange(t *testing.T) {
+	defer custom.TolerantVerifyLeak(t)
+
+	rec := &timeRangeRecorder{ranges: map[string][2]int64{}}
+	srv := httptest.NewServer(rec)
+	defer srv.Close()
+	u, err := url.Parse(srv.URL)
+	testutil.Ok(t, err)
+
+	// The sidecar serves data from 1s to its --max-time of 5s.
+	p, err := NewPrometheusStore(nil, nil, promclient.NewDefaultClient(), u, component.Sidecar,
+		func() labels.Labels { return labels.FromStrings("region", "eu-west") },
+		func() (int64, int64) { return 1000, 5000 },
+		func() string { return "2.50.0" })
+	testutil.Ok(t, err)
+
+	mint, maxt := p.Timestamps()
+	testutil.Equals(t, int64(1000), mint)
+	testutil.Equals(t, int64(5000), maxt)
+	testutil.Equals(t, int64(5000), p.TSDBInfos()[0].MaxTime)
+
+	matchers := []*storepb.LabelMatcher{{Type: storepb.LabelMatcher_EQ, Name: "a", Value: "b"}}
+	for _, tcase := range []struct {
+		name       string
+		mint, maxt int64
+		// expected is the time range requested from Prometheus, if any.
+		expected *[2]int64
+	}{
+		{name: "within the served range", mint: 2000, maxt: 4000, expected: &[2]int64{2000, 4000}},
+		{name: "past the max time", mint: 2000, maxt: 10000, expected: &[2]int64{2000, 5000}},
+		{name: "before the min time", mint: 0, maxt: 3000, expected: &[2]int64{1000, 3000}},
+		{name: "only past the max time", mint: 6000, maxt: 10000},
+	} {
+		t.Run(tcase.name, func(t *testing.T) {
+			ctx := context.Background()
+
+			testutil.Ok(t, p.Series(&storepb.SeriesRequest{MinTime: tcase.mint, MaxTime: tcase.maxt, Matchers: matchers}, newStoreSeriesServer(ctx)))
+			seriesSrv := newStoreSeriesServer(ctx)
+			testutil.Ok(t, p.Series(&storepb.SeriesRequest{MinTime: tcase.mint, MaxTime: tcase.maxt, Matchers: matchers, SkipChunks: true}, seriesSrv))
+			names, err := p.LabelNames(ctx, &storepb.LabelNamesRequest{Start: tcase.mint, End: tcase.maxt, Matchers: matchers})
+			testutil.Ok(t, err)
+			values, err := p.LabelValues(ctx, &storepb.LabelValuesRequest{Label: "a", Start: tcase.mint, End: tcase.maxt, Matchers: matchers})
+			testutil.Ok(t, err)
+
+			ranges := rec.reset()
+			if tcase.expected == nil {
+				testutil.Equals(t, map[string][2]int64{}, ranges)
+				testutil.Equals(t, 0, len(seriesSrv.SeriesSet))
+				testutil.Equals(t, 0, len(names.Names))
+				testutil.Equals(t, 0, len(values.Values))
+				return
+			}
+			testutil.Equals(t, map[string][2]int64{
+				"/api/v1/read":           *tcase.expected,
+				"/api/v1/series":         *tcase.expected,
+				"/api/v1/labels":         *tcase.expected,
+				"/api/v1/label/a/values": *tcase.expected,
+			}, ranges)
+			testutil.Equals(t, 1, len(seriesSrv.SeriesSet))
+			testutil.Equals(t, []string{"a", "region"}, names.Names)
+			testutil.Equals(t, []string{"a"}, values.Values)
+		})
+	}
+}
+
 func TestPrometheusStore_Series_MatchExternalLabel(t *testing.T) {
 	defer custom.TolerantVerifyLeak(t)
 
@@ -22,9 +22,12 @@ import (
 	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/metadata"
 	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/anypb"
 
 	"github.com/thanos-io/thanos/pkg/component"
+	"github.com/thanos-io/thanos/pkg/extannotations"
 	"github.com/thanos-io/thanos/pkg/info/infopb"
+	"github.com/thanos-io/thanos/pkg/store/hintspb"
 	"github.com/thanos-io/thanos/pkg/store/labelpb"
 	"github.com/thanos-io/thanos/pkg/store/storepb"
 	"github.com/thanos-io/thanos/pkg/strutil"
@@ -86,12 +89,14 @@ type ProxyStore struct {
 	retrievalStrategy RetrievalStrategy
 	debugLogging      bool
 	tsdbSelector      *TSDBSelector
+	seriesRetries     SeriesRetryConfig
 
 	storepb.UnimplementedStoreServer
 }
 
 type proxyStoreMetrics struct {
 	emptyStreamResponses prometheus.Counter
+	seriesRetries        prometheus.Counter
 }
 
 func newProxyStoreMetrics(reg prometheus.Registerer) *proxyStoreMetrics {
@@ -101,6 +106,10 @@ func newProxyStoreMetrics(reg prometheus.Registerer) *proxyStoreMetrics {
 		Name: "thanos_proxy_store_empty_stream_responses_total",
 		Help: "Total number of empty responses received.",
 	})
+	m.seriesRetries = promauto.With(reg).NewCounter(prometheus.CounterOpts{
+		Name: "thanos_proxy_store_series_retries_total",
+		Help: "Total number of Series streams of stores restarted after failing with a retriable error.",
+	})
 
 	return &m
 }
@@ -263,6 +272,7 @@ func (s *ProxyStore) Series(originalRequest *storepb.SeriesRequest, srv storepb.
 	}
 
 	ctx = metadata.AppendToOutgoingContext(ctx, tenancy.DefaultTenantHeader, tenant)
+	ctx = appendPriorityToOutgoingContext(ctx)
 	level.Debug(s.logger).Log("msg", "Tenant info in Series()", "tenant", tenant)
 
 	stores, storeLabelSets, storeDebugMsgs := s.matchingStores(ctx, originalRequest.MinTime, originalRequest.MaxTime, matchers)
@@ -287,11 +297,34 @@ func (s *ProxyStore) Series(originalRequest *storepb.SeriesRequest, srv storepb.
 		WithoutReplicaLabels:    originalRequest.WithoutReplicaLabels,
 	}
 
+	tracker := OriginTrackerFromContext(ctx)
+	if tracker != nil {
+		// Stores sending response hints only do so for clients sending request hints, ask them to
+		// report the blocks they query.
+		hints, err := anypb.New(&hintspb.SeriesRequestHints{})
+		if err != nil {
+			return status.Error(codes.Internal, errors.Wrap(err, "marshal series request hints").Error())
+		}
+		r.Hints = hints
+	}
+	timeRangeTracker := SeriesTimeRangeTrackerFromContext(ctx)
+	if timeRangeTracker != nil && r.SkipChunks {
+		ctx = metadata.AppendToOutgoingContext(ctx, SeriesTimeRangeHeader, "true")
+	} else {
+		timeRangeTracker = nil
+	}
+	metricNameStatsTracker := MetricNameStatsTrackerFromContext(ctx)
+	if metricNameStatsTracker != nil && r.SkipChunks {
+		ctx = metadata.AppendToOutgoingContext(ctx, MetricNameStatsHeader, "true")
+	} else {
+		metricNameStatsTracker = nil
+	}
+
 	storeResponses := make([]respSet, 0, len(stores))
 	for _, st := range stores {
 		st := st
 
-		respSet, err := newAsyncRespSet(ctx, st, r, s.responseTimeout, s.retrievalStrategy, &s.buffers, r.ShardInfo, reqLogger, s.metrics.emptyStreamResponses)
+		respSet, err := newAsyncRespSet(ctx, st, r, s.responseTimeout, s.retrievalStrategy, &s.buffers, r.ShardInfo, reqLogger, s.metrics.emptyStreamResponses, s.seriesRetries, s.metrics.seriesRetries)
 		if err != nil {
 			level.Error(reqLogger).Log("err", err)
 
@@ -305,14 +338,31 @@ func (s *ProxyStore) Series(originalRequest *storepb.SeriesRequest, srv storepb.
 			}
 		}
 
-		storeResponses = append(storeResponses, respSet)
 		defer respSet.Close()
+		if tracker != nil {
+			addr, _ := st.Addr()
+			respSet = &originTrackingRespSet{respSet: respSet, store: addr, tracker: tracker}
+		}
+		if timeRangeTracker != nil {
+			addr, _ := st.Addr()
+			mint, maxt := st.TimeRange()
+			respSet = &timeRangeTrackingRespSet{respSet: respSet, store: addr, mint: max(mint, r.MinTime), maxt: min(maxt, r.MaxTime), tracker: timeRangeTracker}
+		}
+		if metricNameStatsTracker != nil {
+			addr, _ := st.Addr()
+			_, maxt := st.TimeRange()
+			respSet = &metricNameStatsTrackingRespSet{respSet: respSet, store: addr, maxt: min(maxt, r.MaxTime), tracker: metricNameStatsTracker}
+		}
+		storeResponses = append(storeResponses, respSet)
 	}
 
 	level.Debug(reqLogger).Log("msg", "Series: started fanout streams", "status", strings.Join(storeDebugMsgs, ";"))
 
 	respHeap := NewResponseDeduplicator(NewProxyResponseLoserTree(storeResponses...))
 
+	// Fanned-out stores may report the same warning, e.g. an annotation about the same series. Each
+	// distinct warning is sent once.
+	sentWarnings := map[string]struct{}{}
 	i := 0
 	for respHeap.Next() {
 		i++
@@ -321,8 +371,15 @@ func (s *ProxyStore) Series(originalRequest *storepb.SeriesRequest, srv storepb.
 		}
 		resp := respHeap.At()
 
-		if resp.GetWarning() != "" && (r.PartialResponseDisabled || r.PartialResponseStrategy == storepb.PartialResponseStrategy_ABORT) {
-			return status.Error(codes.Aborted, resp.GetWarning())
+		if w := resp.GetWarning(); w != "" {
+			// PromQL annotations are not failures, so they do not abort requests without partial response.
+			if !extannotations.IsPromQLAnnotation(w) && (r.PartialResponseDisabled || r.PartialResponseStrategy == storepb.PartialResponseStrategy_ABORT) {
+				return status.Error(codes.Aborted, w)
+			}
+			if _, ok := sentWarnings[w]; ok {
+				continue
+			}
+			sentWarnings[w] = struct{}{}
 		}
 
 		if err := srv.Send(resp); err != nil {
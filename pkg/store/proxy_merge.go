@@ -436,6 +436,8 @@ func newAsyncRespSet(
 	shardInfo *storepb.ShardInfo,
 	logger log.Logger,
 	emptyStreamResponses prometheus.Counter,
+	seriesRetries SeriesRetryConfig,
+	seriesRetriesTotal prometheus.Counter,
 ) (respSet, error) {
 
 	var span opentracing.Span
@@ -460,7 +462,9 @@ func newAsyncRespSet(
 		level.Debug(logger).Log("msg", "Applying series sharding in the proxy since there is not support in the underlying store", "store", st.String())
 	}
 
-	cl, err := st.Series(seriesCtx, req)
+	cl, err := openSeriesWithRetries(seriesCtx, func() (storepb.Store_SeriesClient, error) {
+		return st.Series(seriesCtx, req)
+	}, seriesRetries, seriesRetriesTotal, logger, st.String())
 	if err != nil {
 		err = errors.Wrapf(err, "fetch series for %s %s", storeID, st)
 
@@ -600,6 +604,15 @@ func newEagerRespSet(
 			}
 		}()
 
+		// Everything received is buffered until the stream ends, so it can be restarted from scratch.
+		if rc, ok := cl.(*retryingSeriesClient); ok {
+			rc.onRestart = func() {
+				l.bufferedResponses = l.bufferedResponses[:0]
+				*seriesStats = storepb.SeriesStatsCounter{}
+				numResponses = 0
+			}
+		}
+
 		// TODO(bwplotka): Consider improving readability by getting rid of anonymous functions and merging eager and
 		// lazyResponse into one struct.
 		handleRecvResponse := func(t *time.Timer) bool {
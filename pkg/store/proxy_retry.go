@@ -0,0 +1,148 @@
+// Copyright (c) The Thanos Authors.
+// Licensed under the Apache License 2.0.
+
+package store
+
+import (
+	"context"
+	"io"
+	"time"
+
+	"github.com/go-kit/log"
+	"github.com/go-kit/log/level"
+	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	"github.com/thanos-io/thanos/pkg/store/storepb"
+)
+
+const (
+	seriesRetryMinBackoff = 100 * time.Millisecond
+	seriesRetryMaxBackoff = time.Second
+)
+
+// SeriesRetryConfig configures the retries of Series streams of stores failing with retriable errors.
+type SeriesRetryConfig struct {
+	// MaxRetries is the maximum number of times the Series stream of a store is restarted. Zero disables retries.
+	MaxRetries int
+	// Timeout bounds the time from the first request to the last retry of the Series stream of a store.
+	Timeout time.Duration
+}
+
+// WithSeriesRetries retries the Series streams of stores failing with UNAVAILABLE errors. Streams cannot be resumed,
+// so a retry restarts the stream from scratch and discards the responses received so far. With lazy retrieval,
+// responses may already have been consumed, so only streams failing before their first response are retried.
+func WithSeriesRetries(cfg SeriesRetryConfig) ProxyStoreOption {
+	return func(s *ProxyStore) {
+		s.seriesRetries = cfg
+	}
+}
+
+// isRetriableSeriesErr returns true if the error of a Series stream is likely transient, e.g. a network blip.
+func isRetriableSeriesErr(err error) bool {
+	return status.Code(errors.Cause(err)) == codes.Unavailable
+}
+
+// retryingSeriesClient is a Series stream which is restarted from scratch when failing with a retriable error.
+type retryingSeriesClient struct {
+	storepb.Store_SeriesClient
+
+	ctx      context.Context
+	open     func() (storepb.Store_SeriesClient, error)
+	cfg      SeriesRetryConfig
+	deadline time.Time
+	retries  prometheus.Counter
+	logger   log.Logger
+	store    string
+
+	attempts int
+	received int
+	// onRestart discards the responses received from the failed stream. Streams which received responses are
+	// only restarted if it is set.
+	onRestart func()
+}
+
+// openSeriesWithRetries opens the Series stream with open, retrying it according to cfg. The returned stream is
+// retried the same way when failing.
+func openSeriesWithRetries(
+	ctx context.Context,
+	open func() (storepb.Store_SeriesClient, error),
+	cfg SeriesRetryConfig,
+	retries prometheus.Counter,
+	logger log.Logger,
+	store string,
+) (storepb.Store_SeriesClient, error) {
+	if cfg.MaxRetries <= 0 {
+		return open()
+	}
+	c := &retryingSeriesClient{
+		ctx:      ctx,
+		open:     open,
+		cfg:      cfg,
+		deadline: time.Now().Add(cfg.Timeout),
+		retries:  retries,
+		logger:   logger,
+		store:    store,
+	}
+	if err := c.reopen(nil); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+func (c *retryingSeriesClient) Recv() (*storepb.SeriesResponse, error) {
+	resp, err := c.Store_SeriesClient.Recv()
+	for err != nil && err != io.EOF {
+		// Responses of lazily retrieved streams may already be consumed and cannot be taken back.
+		if c.received > 0 && c.onRestart == nil {
+			return nil, err
+		}
+		if err := c.reopen(err); err != nil {
+			return nil, err
+		}
+		if c.received > 0 {
+			c.onRestart()
+			c.received = 0
+		}
+		resp, err = c.Store_SeriesClient.Recv()
+	}
+	if err == nil {
+		c.received++
+	}
+	return resp, err
+}
+
+// reopen opens a new stream after the previous one failed with err, or the first one if err is nil. It returns the
+// error of the last attempt if the stream could not be opened within the configured retries.
+func (c *retryingSeriesClient) reopen(err error) error {
+	for {
+		if err != nil {
+			backoff := seriesRetryMinBackoff << c.attempts
+			if backoff > seriesRetryMaxBackoff {
+				backoff = seriesRetryMaxBackoff
+			}
+			if !isRetriableSeriesErr(err) || c.attempts >= c.cfg.MaxRetries || time.Now().Add(backoff).After(c.deadline) {
+				return err
+			}
+
+			t := time.NewTimer(backoff)
+			select {
+			case <-c.ctx.Done():
+				t.Stop()
+				return err
+			case <-t.C:
+			}
+			c.attempts++
+			c.retries.Inc()
+			level.Debug(c.logger).Log("msg", "retrying series stream", "store", c.store, "attempt", c.attempts, "err", err)
+		}
+
+		var cl storepb.Store_SeriesClient
+		if cl, err = c.open(); err == nil {
+			c.Store_SeriesClient = cl
+			return nil
+		}
+	}
+}
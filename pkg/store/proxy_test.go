@@ -7,6 +7,7 @@ import (
 	"context"
 	"fmt"
 
+	"io"
 	"math"
 	"math/rand"
 	"os"
@@ -21,9 +22,13 @@ import (
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/prometheus/model/labels"
 	"github.com/prometheus/prometheus/model/timestamp"
+	"github.com/prometheus/prometheus/promql/parser/posrange"
 	"github.com/prometheus/prometheus/tsdb"
 	"github.com/prometheus/prometheus/tsdb/chunkenc"
+	"github.com/prometheus/prometheus/util/annotations"
 	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
 	"google.golang.org/protobuf/proto"
 	"google.golang.org/protobuf/types/known/anypb"
 
@@ -320,7 +325,7 @@ func TestProxyStore_Series(t *testing.T) {
 					chunks: [][]sample{{{100, 1}, {300, 3}, {400, 4}}},
 				},
 			},
-			expectedWarningsLen: 2,
+			expectedWarningsLen: 1, // The same warning of two stores is sent once.
 		},
 		{
 			title: "storeAPI available for time range; available two duplicated series for ext=1 external label matcher from 2 storeAPIs",
@@ -512,6 +517,47 @@ func TestProxyStore_Series(t *testing.T) {
 			},
 			expectedErr: errors.New("fetch series for {ext=\"1\"} : error!"),
 		},
+		{
+			title: "partial response disabled; PromQL annotations of stores",
+			storeAPIs: []Client{
+				&storetestutil.TestClient{
+					StoreClient: &mockedStoreAPI{
+						RespSeries: []*storepb.SeriesResponse{
+							storepb.NewWarnSeriesResponse(annotations.NewPossibleNonCounterInfo("a", posrange.PositionRange{})),
+							storeSeriesResponse(t, labels.FromStrings("a", "b"), []sample{{1, 1}, {2, 2}, {3, 3}}),
+						},
+					},
+					ExtLset: []labels.Labels{labels.FromStrings("ext", "1")},
+					MinTime: 1,
+					MaxTime: 300,
+				},
+				&storetestutil.TestClient{
+					StoreClient: &mockedStoreAPI{
+						RespSeries: []*storepb.SeriesResponse{
+							storepb.NewWarnSeriesResponse(annotations.NewPossibleNonCounterInfo("a", posrange.PositionRange{})),
+							storepb.NewWarnSeriesResponse(annotations.NewMixedFloatsHistogramsWarning("a", posrange.PositionRange{})),
+						},
+					},
+					ExtLset: []labels.Labels{labels.FromStrings("ext", "1")},
+					MinTime: 1,
+					MaxTime: 300,
+				},
+			},
+			req: &storepb.SeriesRequest{
+				MinTime:                 1,
+				MaxTime:                 300,
+				Matchers:                []*storepb.LabelMatcher{{Name: "ext", Value: "1", Type: storepb.LabelMatcher_EQ}},
+				PartialResponseDisabled: true,
+				PartialResponseStrategy: storepb.PartialResponseStrategy_ABORT,
+			},
+			expectedSeries: []rawSeries{
+				{
+					lset:   labels.FromStrings("a", "b"),
+					chunks: [][]sample{{{1, 1}, {2, 2}, {3, 3}}},
+				},
+			},
+			expectedWarningsLen: 2,
+		},
 		{
 			title: "storeAPI available for time range; available series for ext=1 external label matcher; allowed by store debug matcher",
 			storeAPIs: []Client{
@@ -1444,7 +1490,120 @@ func TestProxyStore_Series_RegressionFillResponseChannel(t *testing.T) {
 		}, s,
 	))
 	testutil.Equals(t, 0, len(s.SeriesSet))
-	testutil.Equals(t, 110, len(s.Warnings))
+	// 10 errors of stores and the warning repeated by the other stores, which is sent once.
+	testutil.Equals(t, 11, len(s.Warnings))
+}
+
+// flakyStoreAPI is a test gRPC store API client whose first Series streams fail.
+type flakyStoreAPI struct {
+	*mockedStoreAPI
+
+	// failures is the number of Series streams failing with err at the response failIndex.
+	failures  int
+	failIndex int
+	err       error
+
+	calls int
+}
+
+func (s *flakyStoreAPI) Series(ctx context.Context, req *storepb.SeriesRequest, _ ...grpc.CallOption) (storepb.Store_SeriesClient, error) {
+	s.calls++
+	if s.calls <= s.failures {
+		cl := &storetestutil.StoreSeriesClient{Ctx: ctx, RespSet: s.RespSeries[:s.failIndex]}
+		return &failingSeriesClient{Store_SeriesClient: cl, err: s.err}, nil
+	}
+	return &storetestutil.StoreSeriesClient{Ctx: ctx, RespSet: s.RespSeries}, nil
+}
+
+// failingSeriesClient fails with err instead of ending the stream.
+type failingSeriesClient struct {
+	storepb.Store_SeriesClient
+	err error
+}
+
+func (c *failingSeriesClient) Recv() (*storepb.SeriesResponse, error) {
+	resp, err := c.Store_SeriesClient.Recv()
+	if err == io.EOF {
+		return nil, c.err
+	}
+	return resp, err
+}
+
+func TestProxyStore_SeriesRetries(t *testing.T) {
+	defer custom.TolerantVerifyLeak(t)
+
+	respSeries := []*storepb.SeriesResponse{
+		storeSeriesResponse(t, labels.FromStrings("a", "1"), []sample{{1, 1}, {2, 2}}),
+		storeSeriesResponse(t, labels.FromStrings("a", "2"), []sample{{1, 1}, {2, 2}}),
+	}
+	unavailable := status.Error(codes.Unavailable, "connection reset")
+
+	for _, tc := range []struct {
+		title     string
+		strategy  RetrievalStrategy
+		failures  int
+		failIndex int
+		err       error
+
+		expectedCalls  int
+		expectedSeries int
+		expectedErr    bool
+	}{
+		{
+			title:    "unavailable mid-stream is retried from scratch",
+			strategy: EagerRetrieval, failures: 2, failIndex: 1, err: unavailable,
+			expectedCalls: 3, expectedSeries: 2,
+		},
+		{
+			title:    "retries are bounded",
+			strategy: EagerRetrieval, failures: 4, failIndex: 1, err: unavailable,
+			expectedCalls: 3, expectedErr: true,
+		},
+		{
+			title:    "non-retriable errors fail fast",
+			strategy: EagerRetrieval, failures: 1, failIndex: 1, err: status.Error(codes.Internal, "boom"),
+			expectedCalls: 1, expectedErr: true,
+		},
+		{
+			title:    "lazy stream failing before its first response is retried",
+			strategy: LazyRetrieval, failures: 1, failIndex: 0, err: unavailable,
+			expectedCalls: 2, expectedSeries: 2,
+		},
+		{
+			title:    "lazy stream failing after its first response is not retried",
+			strategy: LazyRetrieval, failures: 1, failIndex: 1, err: unavailable,
+			expectedCalls: 1, expectedErr: true,
+		},
+	} {
+		t.Run(tc.title, func(t *testing.T) {
+			st := &flakyStoreAPI{
+				mockedStoreAPI: &mockedStoreAPI{RespSeries: respSeries},
+				failures:       tc.failures,
+				failIndex:      tc.failIndex,
+				err:            tc.err,
+			}
+			cls := []Client{&storetestutil.TestClient{StoreClient: st, MinTime: 1, MaxTime: 300}}
+			q := NewProxyStore(nil, nil, func() []Client { return cls }, component.Query, labels.EmptyLabels(), 0, tc.strategy,
+				WithSeriesRetries(SeriesRetryConfig{MaxRetries: 2, Timeout: time.Minute}),
+			)
+
+			s := newStoreSeriesServer(context.Background())
+			err := q.Series(&storepb.SeriesRequest{
+				MinTime:                 1,
+				MaxTime:                 300,
+				Matchers:                []*storepb.LabelMatcher{{Name: "a", Value: ".+", Type: storepb.LabelMatcher_RE}},
+				PartialResponseDisabled: true,
+				PartialResponseStrategy: storepb.PartialResponseStrategy_ABORT,
+			}, s)
+			if tc.expectedErr {
+				testutil.NotOk(t, err)
+			} else {
+				testutil.Ok(t, err)
+			}
+			testutil.Equals(t, tc.expectedCalls, st.calls)
+			testutil.Equals(t, tc.expectedSeries, len(s.SeriesSet))
+		})
+	}
 }
 
 func TestProxyStore_LabelValues(t *testing.T) {
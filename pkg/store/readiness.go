@@ -0,0 +1,88 @@
+// Copyright (c) The Thanos Authors.
+// Licensed under the Apache License 2.0.
+
+package store
+
+import (
+	"context"
+	"io"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/prometheus/common/model"
+	"github.com/prometheus/prometheus/model/labels"
+	"gopkg.in/yaml.v2"
+
+	"github.com/thanos-io/thanos/pkg/extpromql"
+	"github.com/thanos-io/thanos/pkg/store/storepb"
+)
+
+// defaultReadinessQueryRange is the time range of readiness queries without one.
+const defaultReadinessQueryRange = model.Duration(time.Hour)
+
+// ReadinessQuery is a representative query served by a store before it reports ready, see RunReadinessQueries.
+type ReadinessQuery struct {
+	// Selector selects the series of the query, e.g. {job="api"}.
+	Selector string `yaml:"selector"`
+	// Range is the time range of the query, ending when it is run. Defaults to 1h.
+	Range model.Duration `yaml:"range"`
+
+	matchers []*labels.Matcher
+}
+
+// ParseReadinessQueries parses a YAML list of readiness queries.
+func ParseReadinessQueries(content []byte) ([]ReadinessQuery, error) {
+	var queries []ReadinessQuery
+	if err := yaml.UnmarshalStrict(content, &queries); err != nil {
+		return nil, errors.Wrap(err, "parse readiness queries")
+	}
+	for i := range queries {
+		q := &queries[i]
+		ms, err := extpromql.ParseMetricSelector(q.Selector)
+		if err != nil {
+			return nil, errors.Wrapf(err, "parse selector %q of readiness query", q.Selector)
+		}
+		q.matchers = ms
+		if q.Range < 0 {
+			return nil, errors.Errorf("negative range %s of readiness query %s", q.Range, q.Selector)
+		}
+		if q.Range == 0 {
+			q.Range = defaultReadinessQueryRange
+		}
+	}
+	return queries, nil
+}
+
+// RunReadinessQueries runs the given queries against s, reading all of the series and chunks they return so that
+// the index-headers, postings, series and chunks they touch are loaded and cached. It returns the first error.
+func RunReadinessQueries(ctx context.Context, s storepb.StoreServer, queries []ReadinessQuery, now time.Time) error {
+	client := storepb.ServerAsClient(s)
+	for _, q := range queries {
+		matchers, err := storepb.PromMatchersToMatchers(q.matchers...)
+		if err != nil {
+			return errors.Wrapf(err, "convert matchers of readiness query %s", q.Selector)
+		}
+		stream, err := client.Series(ctx, &storepb.SeriesRequest{
+			MinTime:                 now.Add(-time.Duration(q.Range)).UnixMilli(),
+			MaxTime:                 now.UnixMilli(),
+			Matchers:                matchers,
+			PartialResponseStrategy: storepb.PartialResponseStrategy_ABORT,
+		})
+		if err != nil {
+			return errors.Wrapf(err, "readiness query %s", q.Selector)
+		}
+		for {
+			resp, err := stream.Recv()
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				return errors.Wrapf(err, "readiness query %s", q.Selector)
+			}
+			if w := resp.GetWarning(); w != "" {
+				return errors.Errorf("readiness query %s: %s", q.Selector, w)
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,75 @@
+// Copyright (c) The Thanos Authors.
+// Licensed under the Apache License 2.0.
+
+package store
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/efficientgo/core/testutil"
+	"github.com/pkg/errors"
+	"github.com/prometheus/common/model"
+	"github.com/prometheus/prometheus/model/labels"
+
+	"github.com/thanos-io/thanos/pkg/component"
+	"github.com/thanos-io/thanos/pkg/store/storepb"
+	"github.com/thanos-io/thanos/pkg/testutil/e2eutil"
+)
+
+func TestParseReadinessQueries(t *testing.T) {
+	queries, err := ParseReadinessQueries([]byte(`
+- selector: '{job="api"}'
+  range: 6h
+- selector: up
+`))
+	testutil.Ok(t, err)
+	testutil.Equals(t, 2, len(queries))
+	testutil.Equals(t, model.Duration(6*time.Hour), queries[0].Range)
+	testutil.Equals(t, `job="api"`, queries[0].matchers[0].String())
+	testutil.Equals(t, model.Duration(time.Hour), queries[1].Range)
+	testutil.Equals(t, `__name__="up"`, queries[1].matchers[0].String())
+
+	for _, invalid := range []string{
+		`- selector: '{job=}'`,
+		`- selector: up
+  range: -1h`,
+		`- selector: up
+  matchers: up`,
+	} {
+		_, err := ParseReadinessQueries([]byte(invalid))
+		testutil.NotOk(t, err, invalid)
+	}
+}
+
+type failingStoreServer struct {
+	storepb.StoreServer
+	err error
+}
+
+func (s *failingStoreServer) Series(*storepb.SeriesRequest, storepb.Store_SeriesServer) error {
+	return s.err
+}
+
+func TestRunReadinessQueries(t *testing.T) {
+	db, err := e2eutil.NewTSDB()
+	testutil.Ok(t, err)
+	defer func() { testutil.Ok(t, db.Close()) }()
+
+	now := time.Now()
+	app := db.Appender(context.Background())
+	_, err = app.Append(0, labels.FromStrings("job", "api"), now.Add(-time.Minute).UnixMilli(), 1)
+	testutil.Ok(t, err)
+	testutil.Ok(t, app.Commit())
+
+	queries, err := ParseReadinessQueries([]byte(`[{selector: '{job="api"}'}, {selector: '{job="other"}'}]`))
+	testutil.Ok(t, err)
+
+	tsdbStore := NewTSDBStore(nil, db, component.Store, labels.EmptyLabels())
+	testutil.Ok(t, RunReadinessQueries(context.Background(), tsdbStore, queries, now))
+
+	err = RunReadinessQueries(context.Background(), &failingStoreServer{err: errors.New("bucket unavailable")}, queries, now)
+	testutil.NotOk(t, err)
+	testutil.Equals(t, `readiness query {job="api"}: bucket unavailable`, err.Error())
+}
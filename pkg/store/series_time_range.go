@@ -0,0 +1,255 @@
+// Copyright (c) The Thanos Authors.
+// Licensed under the Apache License 2.0.
+
+package store
+
+import (
+	"context"
+	"math"
+	"sort"
+	"sync"
+
+	"github.com/go-kit/log"
+	"github.com/pkg/errors"
+	"github.com/prometheus/prometheus/model/labels"
+	"github.com/prometheus/prometheus/storage"
+	"github.com/prometheus/prometheus/tsdb/chunks"
+	"golang.org/x/sync/errgroup"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/known/anypb"
+
+	"github.com/thanos-io/thanos/pkg/info/infopb"
+	"github.com/thanos-io/thanos/pkg/runutil"
+	"github.com/thanos-io/thanos/pkg/store/storepb"
+)
+
+// SeriesTimeRangeHeader is the gRPC metadata key asking stores to answer Series requests skipping chunks
+// with the time range of the matching series, instead of the series themselves.
+const SeriesTimeRangeHeader = "thanos-series-time-range"
+
+const seriesTimeRangeTrackerKey = ctxKey(2)
+
+// StoreTimeRange is the time range of the series matching a request in a store.
+type StoreTimeRange struct {
+	// Store is the address of the store endpoint.
+	Store string
+	// MinTime and MaxTime bound the samples of the matching series within the requested time range, in milliseconds.
+	MinTime, MaxTime int64
+	// Reported is false for stores which returned matching series without reporting their time range, in which case
+	// the time range of the data of the store overlapping the request is used.
+	Reported bool
+}
+
+// SeriesTimeRangeTracker records the time range of the series matching a Series request skipping chunks in every
+// store, see WithSeriesTimeRangeTracker. Store Gateways report the time ranges of the blocks having matching series
+// according to their index, and stores backed by a TSDB the time ranges of the chunks of the matching series. No chunk
+// is sent and Store Gateways do not even read series, which makes it much cheaper than querying samples.
+type SeriesTimeRangeTracker struct {
+	mtx    sync.Mutex
+	ranges map[string]*StoreTimeRange
+}
+
+// NewSeriesTimeRangeTracker returns an empty SeriesTimeRangeTracker.
+func NewSeriesTimeRangeTracker() *SeriesTimeRangeTracker {
+	return &SeriesTimeRangeTracker{ranges: map[string]*StoreTimeRange{}}
+}
+
+// WithSeriesTimeRangeTracker returns a context making the proxy ask stores for the time range of the matching series
+// instead of the series, and record it in t.
+func WithSeriesTimeRangeTracker(ctx context.Context, t *SeriesTimeRangeTracker) context.Context {
+	return context.WithValue(ctx, seriesTimeRangeTrackerKey, t)
+}
+
+// SeriesTimeRangeTrackerFromContext returns the SeriesTimeRangeTracker of ctx, nil if none.
+func SeriesTimeRangeTrackerFromContext(ctx context.Context) *SeriesTimeRangeTracker {
+	t, _ := ctx.Value(seriesTimeRangeTrackerKey).(*SeriesTimeRangeTracker)
+	return t
+}
+
+// seriesTimeRangeRequested returns true if the Series request with the given context asks for the time range of the
+// matching series, either through the incoming gRPC metadata or, for in-process clients, a tracker in the context.
+func seriesTimeRangeRequested(ctx context.Context) bool {
+	return len(metadata.ValueFromIncomingContext(ctx, SeriesTimeRangeHeader)) > 0 || SeriesTimeRangeTrackerFromContext(ctx) != nil
+}
+
+func (t *SeriesTimeRangeTracker) observe(store string, mint, maxt int64, reported bool) {
+	if mint > maxt {
+		return
+	}
+
+	t.mtx.Lock()
+	defer t.mtx.Unlock()
+	r, ok := t.ranges[store]
+	if !ok || (reported && !r.Reported) {
+		t.ranges[store] = &StoreTimeRange{Store: store, MinTime: mint, MaxTime: maxt, Reported: reported}
+		return
+	}
+	if r.Reported && !reported {
+		return
+	}
+	r.MinTime = min(r.MinTime, mint)
+	r.MaxTime = max(r.MaxTime, maxt)
+}
+
+// TimeRanges returns the time ranges recorded so far, sorted by store. Stores without matching series are omitted.
+func (t *SeriesTimeRangeTracker) TimeRanges() []StoreTimeRange {
+	t.mtx.Lock()
+	defer t.mtx.Unlock()
+
+	ranges := make([]StoreTimeRange, 0, len(t.ranges))
+	for _, r := range t.ranges {
+		ranges = append(ranges, *r)
+	}
+	sort.Slice(ranges, func(i, j int) bool { return ranges[i].Store < ranges[j].Store })
+	return ranges
+}
+
+// timeRangeTrackingRespSet records the time range reported by a store. Series returned by stores which do not
+// report time ranges are recorded with the time range of the store overlapping the request.
+type timeRangeTrackingRespSet struct {
+	respSet
+	store      string
+	mint, maxt int64
+	tracker    *SeriesTimeRangeTracker
+}
+
+func (s *timeRangeTrackingRespSet) Next() bool {
+	if !s.respSet.Next() {
+		return false
+	}
+	resp := s.respSet.At()
+	if resp == nil {
+		return true
+	}
+	if resp.GetSeries() != nil {
+		s.tracker.observe(s.store, s.mint, s.maxt, false)
+		return true
+	}
+	if resp.GetHints() == nil {
+		return true
+	}
+	info := &infopb.TSDBInfo{}
+	if err := anypb.UnmarshalTo(resp.GetHints(), info, proto.UnmarshalOptions{}); err != nil {
+		// Other hints, e.g. queried blocks, are not time ranges.
+		return true
+	}
+	s.tracker.observe(s.store, info.MinTime, info.MaxTime, true)
+	return true
+}
+
+// sendSeriesTimeRange sends the time range [mint, maxt] as response hints, unless it is empty.
+func sendSeriesTimeRange(srv storepb.Store_SeriesServer, mint, maxt int64) error {
+	if mint > maxt {
+		return nil
+	}
+	hints, err := anypb.New(&infopb.TSDBInfo{MinTime: mint, MaxTime: maxt})
+	if err != nil {
+		return status.Error(codes.Internal, errors.Wrap(err, "marshal series time range").Error())
+	}
+	if err := srv.Send(storepb.NewHintsSeriesResponse(hints)); err != nil {
+		return status.Error(codes.Unknown, errors.Wrap(err, "send series time range").Error())
+	}
+	return nil
+}
+
+// seriesTimeRange sends the time range of the blocks having series matching the request, clipped to the requested
+// time range. Only the postings of the blocks are fetched, so the time range is as precise as the blocks.
+func (s *BucketStore) seriesTimeRange(srv flushableServer, req *storepb.SeriesRequest, matchers, reqBlockMatchers []*labels.Matcher, tenant string) error {
+	var (
+		mtx          sync.Mutex
+		mint, maxt   int64 = math.MaxInt64, math.MinInt64
+		g, gctx            = errgroup.WithContext(srv.Context())
+		bytesLimiter       = s.bytesLimiterFactory(s.metrics.queriesDropped.WithLabelValues("bytes", tenant))
+		logger             = s.requestLoggerFunc(srv.Context(), s.logger)
+	)
+
+	s.mtx.RLock()
+	for _, bs := range s.blockSets {
+		blockMatchers, ok := bs.labelMatchers(matchers...)
+		if !ok {
+			continue
+		}
+		sortedBlockMatchers := newSortedMatchers(blockMatchers)
+
+		for _, b := range bs.getFor(req.MinTime, req.MaxTime, req.MaxResolutionWindow, reqBlockMatchers) {
+			blk := b
+			blockLogger := log.With(logger, "block", blk.meta.ULID)
+			indexr := blk.indexReader(blockLogger)
+
+			g.Go(func() error {
+				defer runutil.CloseWithLogOnErr(blockLogger, indexr, "close index reader of series time range")
+
+				// Without matchers other than external labels, every series of the block matches.
+				if len(sortedBlockMatchers) > 0 {
+					ps, err := indexr.ExpandedPostings(gctx, sortedBlockMatchers, bytesLimiter, false, s.metrics.lazyExpandedPostingSizeBytes, tenant)
+					if err != nil {
+						return errors.Wrapf(err, "fetch postings for block %s", blk.meta.ULID)
+					}
+					if ps == nil || len(ps.postings) == 0 {
+						return nil
+					}
+				}
+
+				mtx.Lock()
+				defer mtx.Unlock()
+				// The maximum time of blocks is exclusive.
+				mint = min(mint, max(blk.meta.MinTime, req.MinTime))
+				maxt = max(maxt, min(blk.meta.MaxTime-1, req.MaxTime))
+				return nil
+			})
+		}
+	}
+	s.mtx.RUnlock()
+
+	if err := g.Wait(); err != nil {
+		code := codes.Aborted
+		if s, ok := status.FromError(errors.Cause(err)); ok {
+			code = s.Code()
+		}
+		return status.Error(code, err.Error())
+	}
+	if err := sendSeriesTimeRange(srv, mint, maxt); err != nil {
+		return err
+	}
+	return srv.Flush()
+}
+
+// seriesTimeRange sends the time range of the chunks of the series matching the request. Chunks are bounded by their
+// first and last sample, and the TSDB trims the chunks crossing the bounds of the request, so the time range is exact.
+func (s *TSDBStore) seriesTimeRange(srv flushableServer, r *storepb.SeriesRequest, matchers []*labels.Matcher) error {
+	q, err := s.db.ChunkQuerier(r.MinTime, r.MaxTime)
+	if err != nil {
+		return status.Error(codes.Internal, err.Error())
+	}
+	defer runutil.CloseWithLogOnErr(s.logger, q, "close tsdb chunk querier series time range")
+
+	var (
+		mint, maxt int64 = math.MaxInt64, math.MinInt64
+		set              = q.Select(srv.Context(), false, &storage.SelectHints{Start: r.MinTime, End: r.MaxTime}, matchers...)
+		it         chunks.Iterator
+	)
+	for set.Next() {
+		it = set.At().Iterator(it)
+		for it.Next() {
+			chk := it.At()
+			if chk.MaxTime < r.MinTime || chk.MinTime > r.MaxTime {
+				continue
+			}
+			mint = min(mint, max(chk.MinTime, r.MinTime))
+			maxt = max(maxt, min(chk.MaxTime, r.MaxTime))
+		}
+		if err := it.Err(); err != nil {
+			return status.Error(codes.Internal, errors.Wrap(err, "chunk iter").Error())
+		}
+	}
+	if err := set.Err(); err != nil {
+		return status.Error(codes.Internal, err.Error())
+	}
+	if err := sendSeriesTimeRange(srv, mint, maxt); err != nil {
+		return err
+	}
+	return srv.Flush()
+}
@@ -0,0 +1,200 @@
+// Copyright (c) The Thanos Authors.
+// Licensed under the Apache License 2.0.
+
+package store
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/efficientgo/core/testutil"
+	"github.com/go-kit/log"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/prometheus/model/labels"
+	"github.com/thanos-io/objstore"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/known/anypb"
+
+	"github.com/thanos-io/thanos/pkg/component"
+	"github.com/thanos-io/thanos/pkg/info/infopb"
+	"github.com/thanos-io/thanos/pkg/store/storepb"
+	storetestutil "github.com/thanos-io/thanos/pkg/store/storepb/testutil"
+	"github.com/thanos-io/thanos/pkg/testutil/e2eutil"
+)
+
+// seriesTimeRangeHints returns the minimum and maximum times of the time ranges sent as hints.
+func seriesTimeRangeHints(t *testing.T, hints []*anypb.Any) [][2]int64 {
+	t.Helper()
+
+	var ranges [][2]int64
+	for _, h := range hints {
+		info := &infopb.TSDBInfo{}
+		testutil.Ok(t, anypb.UnmarshalTo(h, info, proto.UnmarshalOptions{}))
+		ranges = append(ranges, [2]int64{info.MinTime, info.MaxTime})
+	}
+	return ranges
+}
+
+func TestProxyStore_SeriesTimeRange(t *testing.T) {
+	gateway := &mockedStoreAPI{
+		RespSeries: []*storepb.SeriesResponse{
+			storepb.NewHintsSeriesResponse(mustMarshalAny(&infopb.TSDBInfo{MinTime: 2, MaxTime: 5})),
+		},
+	}
+	stores := []Client{
+		&storetestutil.TestClient{Name: "store:10901", StoreClient: gateway, MinTime: 0, MaxTime: 10},
+		// Sidecars return series without reporting their time range.
+		&storetestutil.TestClient{
+			Name:        "sidecar:10901",
+			StoreClient: &mockedStoreAPI{RespSeries: []*storepb.SeriesResponse{storeSeriesResponse(t, labels.FromStrings("a", "1"))}},
+			MinTime:     8,
+			MaxTime:     20,
+		},
+		&storetestutil.TestClient{Name: "empty:10901", StoreClient: &mockedStoreAPI{}, MinTime: 0, MaxTime: 20},
+	}
+	q := NewProxyStore(log.NewNopLogger(), prometheus.NewRegistry(), func() []Client { return stores }, component.Query, labels.EmptyLabels(), 0, LazyRetrieval)
+	req := &storepb.SeriesRequest{
+		MinTime:    0,
+		MaxTime:    15,
+		SkipChunks: true,
+		Matchers:   []*storepb.LabelMatcher{{Type: storepb.LabelMatcher_EQ, Name: "a", Value: "1"}},
+	}
+
+	tracker := NewSeriesTimeRangeTracker()
+	ctx, cancel := context.WithTimeout(WithSeriesTimeRangeTracker(context.Background(), tracker), time.Minute)
+	defer cancel()
+	testutil.Ok(t, q.Series(req, storetestutil.NewSeriesServer(ctx)))
+
+	testutil.Equals(t, []StoreTimeRange{
+		{Store: "sidecar:10901", MinTime: 8, MaxTime: 15},
+		{Store: "store:10901", MinTime: 2, MaxTime: 5, Reported: true},
+	}, tracker.TimeRanges())
+}
+
+func TestTSDBStore_SeriesTimeRange(t *testing.T) {
+	db, err := e2eutil.NewTSDB()
+	testutil.Ok(t, err)
+	defer func() { testutil.Ok(t, db.Close()) }()
+
+	app := db.Appender(context.Background())
+	for i := int64(1); i <= 10; i++ {
+		_, err = app.Append(0, labels.FromStrings("a", "1"), i, float64(i))
+		testutil.Ok(t, err)
+	}
+	_, err = app.Append(0, labels.FromStrings("a", "2"), 20, 20)
+	testutil.Ok(t, err)
+	testutil.Ok(t, app.Commit())
+
+	tsdbStore := NewTSDBStore(nil, db, component.Receive, labels.FromStrings("region", "eu-west"))
+	ctx := metadata.NewIncomingContext(context.Background(), metadata.Pairs(SeriesTimeRangeHeader, "true"))
+
+	for _, tc := range []struct {
+		name     string
+		req      *storepb.SeriesRequest
+		expected [][2]int64
+	}{
+		{
+			name: "matching series",
+			req: &storepb.SeriesRequest{
+				MinTime:  0,
+				MaxTime:  30,
+				Matchers: []*storepb.LabelMatcher{{Type: storepb.LabelMatcher_RE, Name: "a", Value: ".+"}},
+			},
+			expected: [][2]int64{{1, 20}},
+		},
+		{
+			name: "time range clipped to the request",
+			req: &storepb.SeriesRequest{
+				MinTime:  3,
+				MaxTime:  15,
+				Matchers: []*storepb.LabelMatcher{{Type: storepb.LabelMatcher_EQ, Name: "a", Value: "1"}},
+			},
+			expected: [][2]int64{{3, 10}},
+		},
+		{
+			name: "no matching series",
+			req: &storepb.SeriesRequest{
+				MinTime:  0,
+				MaxTime:  30,
+				Matchers: []*storepb.LabelMatcher{{Type: storepb.LabelMatcher_EQ, Name: "a", Value: "3"}},
+			},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			tc.req.SkipChunks = true
+			srv := storetestutil.NewSeriesServer(ctx)
+			testutil.Ok(t, tsdbStore.Series(tc.req, srv))
+			testutil.Equals(t, 0, len(srv.SeriesSet))
+			testutil.Equals(t, tc.expected, seriesTimeRangeHints(t, srv.HintsSet))
+		})
+	}
+}
+
+func TestBucketStore_SeriesTimeRange(t *testing.T) {
+	s := prepareStoreWithTestBlocks(t, t.TempDir(), objstore.NewInMemBucket(), false, NewChunksLimiterFactory(0), NewSeriesLimiterFactory(0), NewBytesLimiterFactory(0), emptyRelabelConfig, allowAllFilterConf)
+	s.cache.SwapWith(noopCache{})
+	ctx := metadata.NewIncomingContext(context.Background(), metadata.Pairs(SeriesTimeRangeHeader, "true"))
+	slot := (2 * time.Hour).Milliseconds()
+
+	for _, tc := range []struct {
+		name     string
+		req      *storepb.SeriesRequest
+		expected [][2]int64
+	}{
+		{
+			name: "time range of the blocks with matching series",
+			req: &storepb.SeriesRequest{
+				MinTime:  s.minTime,
+				MaxTime:  s.maxTime,
+				Matchers: []*storepb.LabelMatcher{{Type: storepb.LabelMatcher_EQ, Name: "b", Value: "1"}},
+			},
+			expected: [][2]int64{{s.minTime, s.maxTime - 1}},
+		},
+		{
+			name: "time range clipped to the request",
+			req: &storepb.SeriesRequest{
+				MinTime:  s.minTime + slot + 10,
+				MaxTime:  s.minTime + 2*slot - 10,
+				Matchers: []*storepb.LabelMatcher{{Type: storepb.LabelMatcher_EQ, Name: "c", Value: "2"}},
+			},
+			expected: [][2]int64{{s.minTime + slot + 10, s.minTime + 2*slot - 10}},
+		},
+		{
+			name: "only external label matchers",
+			req: &storepb.SeriesRequest{
+				MinTime:  s.minTime + slot,
+				MaxTime:  s.maxTime,
+				Matchers: []*storepb.LabelMatcher{{Type: storepb.LabelMatcher_EQ, Name: "ext2", Value: "value2"}},
+			},
+			expected: [][2]int64{{s.minTime + slot, s.maxTime - 1}},
+		},
+		{
+			name: "no matching series",
+			req: &storepb.SeriesRequest{
+				MinTime:  s.minTime,
+				MaxTime:  s.maxTime,
+				Matchers: []*storepb.LabelMatcher{{Type: storepb.LabelMatcher_EQ, Name: "b", Value: "3"}},
+			},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			tc.req.SkipChunks = true
+			srv := storetestutil.NewSeriesServer(ctx)
+			testutil.Ok(t, s.store.Series(tc.req, srv))
+			testutil.Equals(t, 0, len(srv.SeriesSet))
+			testutil.Equals(t, tc.expected, seriesTimeRangeHints(t, srv.HintsSet))
+		})
+	}
+
+	// Without the header, the series are returned.
+	srv := storetestutil.NewSeriesServer(context.Background())
+	testutil.Ok(t, s.store.Series(&storepb.SeriesRequest{
+		MinTime:    s.minTime,
+		MaxTime:    s.maxTime,
+		SkipChunks: true,
+		Matchers:   []*storepb.LabelMatcher{{Type: storepb.LabelMatcher_EQ, Name: "b", Value: "1"}},
+	}, srv))
+	testutil.Equals(t, 2, len(srv.SeriesSet))
+}
@@ -672,3 +672,45 @@ func TestSeriesRequestToPromQL(t *testing.T) {
 		})
 	}
 }
+
+func TestLastChunks(t *testing.T) {
+	bounds := func(c *AggrChunk) (int64, int64) { return c.MinTime, c.MaxTime }
+	chks := func(ranges ...[2]int64) []*AggrChunk {
+		res := make([]*AggrChunk, 0, len(ranges))
+		for _, r := range ranges {
+			res = append(res, &AggrChunk{MinTime: r[0], MaxTime: r[1]})
+		}
+		return res
+	}
+
+	for _, tc := range []struct {
+		name     string
+		chks     []*AggrChunk
+		maxt     int64
+		expected []*AggrChunk
+	}{
+		{name: "no chunks", maxt: 10},
+		{name: "sorted chunks", chks: chks([2]int64{0, 9}, [2]int64{10, 19}, [2]int64{20, 29}), maxt: 30, expected: chks([2]int64{20, 29})},
+		{name: "last chunk starting after maxt", chks: chks([2]int64{0, 9}, [2]int64{10, 19}, [2]int64{20, 29}), maxt: 15, expected: chks([2]int64{10, 19})},
+		{name: "overlapping chunks", chks: chks([2]int64{0, 25}, [2]int64{10, 19}, [2]int64{20, 29}), maxt: 30, expected: chks([2]int64{0, 25}, [2]int64{20, 29})},
+		{name: "unsorted chunks", chks: chks([2]int64{20, 29}, [2]int64{0, 9}), maxt: 30, expected: chks([2]int64{20, 29})},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			testutil.Equals(t, tc.expected, LastChunks(tc.chks, tc.maxt, bounds))
+		})
+	}
+}
+
+func TestSeriesRequest_OnlyLastSample(t *testing.T) {
+	req := &SeriesRequest{MinTime: 100, MaxTime: 400}
+	testutil.Assert(t, !req.OnlyLastSample())
+
+	req.QueryHints = &QueryHints{Func: &Func{Name: LastOverTimeFunc}, Range: &Range{Millis: 100}}
+	testutil.Assert(t, !req.OnlyLastSample(), "last_over_time evaluated at multiple steps needs all samples")
+
+	req.QueryHints.Range.Millis = 300
+	testutil.Assert(t, req.OnlyLastSample())
+
+	req.QueryHints.Func.Name = "max_over_time"
+	testutil.Assert(t, !req.OnlyLastSample())
+}
@@ -5,9 +5,40 @@ package storepb
 
 import (
 	"fmt"
+	"math"
 	"strings"
 )
 
+// LastOverTimeFunc is the name of the last_over_time PromQL function.
+const LastOverTimeFunc = "last_over_time"
+
+// OnlyLastSample returns true if the request only needs the last sample of each series within its time range,
+// which is the case when it selects series for last_over_time over a range covering the whole request.
+// Stores may then only return the chunks which can contain that sample, see LastChunks.
+func (m *SeriesRequest) OnlyLastSample() bool {
+	return m.GetQueryHints().GetFunc().GetName() == LastOverTimeFunc && m.GetQueryHints().GetRange().GetMillis() >= m.MaxTime-m.MinTime
+}
+
+// LastChunks filters chks in place down to the chunks which can contain the last sample at or before maxt.
+// The chunk starting last at or before maxt contains a sample at or before maxt, so any chunk ending before
+// it starts can be dropped. Chunks do not have to be sorted and may overlap.
+func LastChunks[C any](chks []C, maxt int64, bounds func(C) (int64, int64)) []C {
+	lastStart := int64(math.MinInt64)
+	for _, c := range chks {
+		if mint, _ := bounds(c); mint <= maxt && mint > lastStart {
+			lastStart = mint
+		}
+	}
+
+	res := chks[:0]
+	for _, c := range chks {
+		if mint, cmaxt := bounds(c); mint <= maxt && cmaxt >= lastStart {
+			res = append(res, c)
+		}
+	}
+	return res
+}
+
 func (m *QueryHints) toPromQL(labelMatchers []*LabelMatcher) string {
 	grouping := m.Grouping.toPromQL()
 	matchers := MatchersToString(labelMatchers...)
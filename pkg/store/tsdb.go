@@ -16,6 +16,7 @@ import (
 	"github.com/pkg/errors"
 	"github.com/prometheus/prometheus/model/labels"
 	"github.com/prometheus/prometheus/storage"
+	"github.com/prometheus/prometheus/tsdb/chunks"
 	"google.golang.org/grpc"
 	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/status"
@@ -185,6 +186,13 @@ func (s *TSDBStore) Series(r *storepb.SeriesRequest, seriesSrv storepb.Store_Ser
 		return status.Error(codes.InvalidArgument, errors.New("no matchers specified (excluding external labels)").Error())
 	}
 
+	if r.SkipChunks && seriesTimeRangeRequested(srv.Context()) {
+		return s.seriesTimeRange(srv, r, matchers)
+	}
+	if r.SkipChunks && metricNameStatsRequested(srv.Context()) {
+		return s.metricNameStats(srv, r, matchers)
+	}
+
 	q, err := s.db.ChunkQuerier(r.MinTime, r.MaxTime)
 	if err != nil {
 		return status.Error(codes.Internal, err.Error())
@@ -239,6 +247,9 @@ func (s *TSDBStore) Series(r *storepb.SeriesRequest, seriesSrv storepb.Store_Ser
 
 		seriesChunks := []*storepb.AggrChunk{}
 		chIter := series.Iterator(nil)
+		if r.OnlyLastSample() {
+			chIter = newLastChunksIterator(chIter, r.MaxTime)
+		}
 		isNext := chIter.Next()
 		for isNext {
 			chk := chIter.At()
@@ -409,3 +420,34 @@ func (s *TSDBStore) LabelValues(ctx context.Context, r *storepb.LabelValuesReque
 
 	return &storepb.LabelValuesResponse{Values: values}, nil
 }
+
+// lastChunksIterator is a chunks.Iterator returning only the chunks of the wrapped iterator which
+// can contain the last sample at or before maxt.
+type lastChunksIterator struct {
+	it   chunks.Iterator
+	maxt int64
+
+	chks   []chunks.Meta
+	i      int
+	loaded bool
+}
+
+func newLastChunksIterator(it chunks.Iterator, maxt int64) *lastChunksIterator {
+	return &lastChunksIterator{it: it, maxt: maxt, i: -1}
+}
+
+func (l *lastChunksIterator) Next() bool {
+	if !l.loaded {
+		l.loaded = true
+		for l.it.Next() {
+			l.chks = append(l.chks, l.it.At())
+		}
+		l.chks = storepb.LastChunks(l.chks, l.maxt, chunkMetaBounds)
+	}
+	l.i++
+	return l.i < len(l.chks)
+}
+
+func (l *lastChunksIterator) At() chunks.Meta { return l.chks[l.i] }
+
+func (l *lastChunksIterator) Err() error { return l.it.Err() }
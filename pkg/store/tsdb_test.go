@@ -194,6 +194,59 @@ func TestTSDBStore_Series(t *testing.T) {
 	}
 }
 
+func TestTSDBStore_SeriesOnlyLastSample(t *testing.T) {
+	defer custom.TolerantVerifyLeak(t)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	db, err := e2eutil.NewTSDB()
+	defer func() { testutil.Ok(t, db.Close()) }()
+	testutil.Ok(t, err)
+
+	tsdbStore := NewTSDBStore(nil, db, component.Rule, labels.FromStrings("region", "eu-west"))
+
+	// Three chunks of 120 samples: [1, 120], [121, 240] and [241, 300].
+	appender := db.Appender(context.Background())
+	for i := 1; i <= 300; i++ {
+		_, err = appender.Append(0, labels.FromStrings("a", "1"), int64(i), float64(i))
+		testutil.Ok(t, err)
+	}
+	testutil.Ok(t, appender.Commit())
+
+	lastOverTime := func(rangeMillis int64) *storepb.QueryHints {
+		return &storepb.QueryHints{Func: &storepb.Func{Name: storepb.LastOverTimeFunc}, Range: &storepb.Range{Millis: rangeMillis}}
+	}
+	for _, tc := range []struct {
+		title            string
+		maxt             int64
+		hints            *storepb.QueryHints
+		expectedMinTimes []int64
+	}{
+		{title: "no hints", maxt: 300, expectedMinTimes: []int64{1, 121, 241}},
+		{title: "last_over_time over part of the range", maxt: 300, hints: lastOverTime(100), expectedMinTimes: []int64{1, 121, 241}},
+		{title: "last_over_time over the whole range", maxt: 300, hints: lastOverTime(299), expectedMinTimes: []int64{241}},
+		{title: "last sample in an earlier chunk", maxt: 200, hints: lastOverTime(199), expectedMinTimes: []int64{121}},
+	} {
+		t.Run(tc.title, func(t *testing.T) {
+			srv := newStoreSeriesServer(ctx)
+			testutil.Ok(t, tsdbStore.Series(&storepb.SeriesRequest{
+				MinTime:    1,
+				MaxTime:    tc.maxt,
+				Matchers:   []*storepb.LabelMatcher{{Type: storepb.LabelMatcher_EQ, Name: "a", Value: "1"}},
+				QueryHints: tc.hints,
+			}, srv))
+			testutil.Equals(t, 1, len(srv.SeriesSet))
+
+			var minTimes []int64
+			for _, c := range srv.SeriesSet[0].Chunks {
+				minTimes = append(minTimes, c.MinTime)
+			}
+			testutil.Equals(t, tc.expectedMinTimes, minTimes)
+		})
+	}
+}
+
 type delegatorServer struct {
 	*storetestutil.SeriesServer
 
@@ -28,6 +28,7 @@ import (
 	"gopkg.in/yaml.v2"
 
 	"github.com/thanos-io/thanos/pkg/alert"
+	"github.com/thanos-io/thanos/pkg/block/lifecycle"
 	"github.com/thanos-io/thanos/pkg/cacheutil"
 	"github.com/thanos-io/thanos/pkg/clientconfig"
 	"github.com/thanos-io/thanos/pkg/logging"
@@ -87,6 +88,7 @@ func init() {
 	queryCfg := clientconfig.DefaultConfig()
 	queryCfg.HTTPConfig.EndpointsConfig.FileSDConfigs = []clientconfig.HTTPFileSDConfig{{}}
 	configs[name(clientconfig.Config{})] = []clientconfig.Config{queryCfg}
+	configs[name(lifecycle.Config{})] = lifecycle.DefaultConfig()
 
 	for typ, config := range bucketConfigs {
 		configs[name(config)] = client.BucketConfig{Type: typ, Config: config}
@@ -158,6 +160,10 @@ func checkForOmitEmptyTagOptionRec(v reflect.Value) error {
 			if err != nil {
 				return errors.Wrapf(err, "%s: failed to get tag %q", v.Type().Field(i).Name, v.Type().Field(i).Tag)
 			}
+			if tag.Name == "-" {
+				// Not part of the configuration.
+				continue
+			}
 
 			for _, opts := range tag.Options {
 				if opts == "omitempty" {